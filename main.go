@@ -52,21 +52,21 @@ func main() {
 	restclient.SetDefaultWarningHandler(restclient.NoWarnings{})
 
 	go func() { // open websocket connection to notification server
-		notificationHandler := notificationhandler.NewNotificationHandler(&sessionObj)
+		notificationHandler := notificationhandler.NewNotificationHandler(sessionObj)
 		if err := notificationHandler.WebsocketConnection(ctx); err != nil {
 			logger.L().Ctx(ctx).Fatal(err.Error(), helpers.Error(err))
 		}
 	}()
 
 	go func() { // open a REST API connection listener
-		restAPIHandler := restapihandler.NewHTTPHandler(&sessionObj)
+		restAPIHandler := restapihandler.NewHTTPHandler(sessionObj)
 		if err := restAPIHandler.SetupHTTPListener(); err != nil {
 			logger.L().Ctx(ctx).Fatal(err.Error(), helpers.Error(err))
 		}
 	}()
 
 	// setup main handler
-	mainHandler := mainhandler.NewMainHandler(&sessionObj, k8sApi)
+	mainHandler := mainhandler.NewMainHandler(sessionObj, k8sApi)
 	go mainHandler.StartupTriggerActions(ctx, mainhandler.GetStartupActions())
 
 	isReadinessReady = true
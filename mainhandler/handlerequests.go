@@ -10,6 +10,7 @@ import (
 	"github.com/kubescape/operator/utils"
 	"github.com/kubescape/operator/watcher"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric/global"
 
 	apitypes "github.com/armosec/armoapi-go/armotypes"
 	"github.com/armosec/utils-go/boolutils"
@@ -28,7 +29,7 @@ import (
 )
 
 type MainHandler struct {
-	sessionObj             *chan utils.SessionObj // TODO: wrap chan with struct for mutex support
+	sessionObj             chan utils.SessionObj // TODO: wrap chan with struct for mutex support
 	k8sAPI                 *k8sinterface.KubernetesApi
 	commandResponseChannel *commandResponseChannelData
 }
@@ -60,7 +61,7 @@ func init() {
 }
 
 // CreateWebSocketHandler Create ws-handler obj
-func NewMainHandler(sessionObj *chan utils.SessionObj, k8sAPI *k8sinterface.KubernetesApi) *MainHandler {
+func NewMainHandler(sessionObj chan utils.SessionObj, k8sAPI *k8sinterface.KubernetesApi) *MainHandler {
 
 	commandResponseChannel := make(chan *CommandResponseData, 100)
 	limitedGoRoutinesCommandResponseChannel := make(chan *timerData, 10)
@@ -92,7 +93,47 @@ func (mainHandler *MainHandler) HandleWatchers(ctx context.Context) {
 	if err != nil {
 		logger.L().Ctx(ctx).Fatal(fmt.Sprintf("Unable to initialize the storage client: %v", err))
 	}
-	watchHandler, err := watcher.NewWatchHandler(ctx, mainHandler.k8sAPI, ksStorageClient, nil, nil)
+	deletionPolicies, err := watcher.ParseDeletionPolicies(utils.DeletionPolicies)
+	if err != nil {
+		logger.L().Ctx(ctx).Error("invalid deletion policies", helpers.Error(err))
+		return
+	}
+	watchKinds, err := watcher.ParseWatchKinds(utils.WatchKinds)
+	if err != nil {
+		logger.L().Ctx(ctx).Error("invalid watch kinds", helpers.Error(err))
+		return
+	}
+	opts := []watcher.WatchHandlerOption{
+		watcher.WithDryRun(utils.DryRunDeletions),
+		watcher.WithExcludedNamespaces(utils.ExcludedNamespaces()...),
+		watcher.WithReadinessGate(utils.WaitForPodReadiness, utils.PodStabilizationDelay),
+		watcher.WithControllerPrescans(utils.PrescanWorkloads),
+		watcher.WithInitialReconcile(utils.InitialReconcile),
+		watcher.WithWorkloadKinds(utils.ScanWorkloadKinds, utils.SkipWorkloadKinds),
+		watcher.WithCleanUpJitter(utils.CleanUpJitter),
+		watcher.WithDeletionBurstCleanUp(utils.DeletionBurstThreshold, utils.DeletionBurstWindow),
+		watcher.WithCheckpoint(mainHandler.checkpointStore(), utils.CheckpointInterval),
+		watcher.WithPeriodicRelevancyScan(utils.PeriodicRelevancyScan),
+		watcher.WithOwnerReferences(utils.OwnerReferences),
+		watcher.WithCommandRateLimit(utils.CommandRateLimit, utils.CommandRateBurst),
+		watcher.WithDeletionPolicies(deletionPolicies),
+		watcher.WithVulnerabilityManifestRetention(utils.VulnManifestRetention),
+		watcher.WithDeletionGracePeriod(utils.DeletionGracePeriod),
+		watcher.WithResyncPeriod(utils.ResyncPeriod),
+		watcher.WithEventBufferSize(utils.WatchEventBufferSize),
+		watcher.WithDeletionWorkers(utils.DeletionWorkers),
+		watcher.WithBulkDeletions(utils.BulkDeletions),
+		watcher.WithMaxTrackedWlids(utils.MaxTrackedWlids),
+		watcher.WithManagedBySelector(utils.ManagedBySelector),
+	}
+	watchHandler, err := watcher.NewWatchHandler(mainHandler.k8sAPI, ksStorageClient, nil, nil, opts...)
+	if err == nil {
+		// the metrics are exported once OpenTelemetry is enabled, see OTEL_COLLECTOR_SVC
+		if err := watchHandler.RegisterMetrics(global.Meter("github.com/kubescape/operator/watcher")); err != nil {
+			logger.L().Ctx(ctx).Warning("failed to register the watch handler metrics", helpers.Error(err))
+		}
+		err = watchHandler.Start(ctx)
+	}
 
 	if err != nil {
 		logger.L().Ctx(ctx).Error(err.Error(), helpers.Error(err))
@@ -104,8 +145,8 @@ func (mainHandler *MainHandler) HandleWatchers(ctx context.Context) {
 	waitFunc := isActionNeedToWait(apis.Command{CommandName: apis.TypeScanImages})
 	waitFunc()
 
-	// generate list of commands to scan all workloads
-	wlids := watchHandler.GetWlidsToContainerToImageIDMap()
+	// generate list of commands to scan all workloads, but those scanned before a restart
+	wlids := watchHandler.GetWlidsChangedSinceCheckpoint()
 	commandsList := []*apis.Command{}
 	for wlid := range wlids {
 		cmd := buildScanCommandForWorkload(ctx, wlid, watchHandler.GetContainerToImageIDForWlid(wlid), apis.TypeScanImages)
@@ -116,10 +157,26 @@ func (mainHandler *MainHandler) HandleWatchers(ctx context.Context) {
 	mainHandler.insertCommandsToChannel(ctx, commandsList)
 
 	// start watching
-	go watchHandler.PodWatch(ctx, mainHandler.sessionObj)
-	go watchHandler.SBOMWatch(ctx, mainHandler.sessionObj)
-	go watchHandler.SBOMFilteredWatch(ctx, mainHandler.sessionObj)
-	go watchHandler.VulnerabilityManifestWatch(ctx, mainHandler.sessionObj)
+	commands := utils.NewChannelCommandSink(mainHandler.sessionObj)
+	watchHandler.SetRelevancyScanSink(commands)
+	go func() {
+		// e.g. the scans of the workloads would silently stop being triggered
+		if err := watchHandler.Run(ctx, commands, watchKinds...); err != nil {
+			logger.L().Ctx(ctx).Fatal("the watchers are broken", helpers.Error(err))
+		}
+	}()
+}
+
+// checkpointStore returns the store of the checkpoints of the internal maps of the watchers, nil if checkpoints are disabled
+func (mainHandler *MainHandler) checkpointStore() watcher.CheckpointStore {
+	switch {
+	case utils.CheckpointFile != "":
+		return watcher.NewFileCheckpointStore(utils.CheckpointFile)
+	case utils.CheckpointConfigMap != "":
+		return watcher.NewConfigMapCheckpointStore(mainHandler.k8sAPI.KubernetesClient, utils.Namespace, utils.CheckpointConfigMap)
+	default:
+		return nil
+	}
 }
 
 func (mainHandler *MainHandler) insertCommandsToChannel(ctx context.Context, commandsList []*apis.Command) {
@@ -147,7 +204,7 @@ func (mainHandler *MainHandler) HandleRequest(ctx context.Context) []error {
 
 	go mainHandler.handleCommandResponse(ctx)
 	for {
-		sessionObj := <-*mainHandler.sessionObj
+		sessionObj := <-mainHandler.sessionObj
 		ctx, span := otel.Tracer("").Start(ctx, string(sessionObj.Command.CommandName))
 
 		// the all user experience depends on this line(the user/backend must get the action name in order to understand the job report)
@@ -335,7 +392,7 @@ func (mainHandler *MainHandler) StartupTriggerActions(ctx context.Context, actio
 			waitFunc := isActionNeedToWait(actions[index])
 			waitFunc()
 			sessionObj := utils.NewSessionObj(ctx, &actions[index], "Websocket", "", uuid.NewString(), 1)
-			*mainHandler.sessionObj <- *sessionObj
+			mainHandler.sessionObj <- *sessionObj
 		}(i)
 	}
 }
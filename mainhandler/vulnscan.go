@@ -509,6 +509,11 @@ func (actionHandler *ActionHandler) getCommand(container ContainerData, pod *cor
 		ImageHash:     utils.ExtractImageID(imageID),
 	}
 
+	// forward the scan scope, for the relevancy scans to be told apart from the initial vulnerability scans
+	if scope, ok := actionHandler.command.Args[utils.ScanScopeArg].(string); ok {
+		websocketScanCommand.Args = map[string]interface{}{utils.ScanScopeArg: scope}
+	}
+
 	// Add instanceID only if container is not empty
 	if container.id != "" {
 		websocketScanCommand.InstanceID = &container.id
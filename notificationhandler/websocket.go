@@ -15,10 +15,10 @@ import (
 
 type NotificationHandler struct {
 	connector  IWebsocketActions
-	sessionObj *chan utils.SessionObj
+	sessionObj chan<- utils.SessionObj
 }
 
-func NewNotificationHandler(sessionObj *chan utils.SessionObj) *NotificationHandler {
+func NewNotificationHandler(sessionObj chan<- utils.SessionObj) *NotificationHandler {
 	urlStr := initNotificationServerURL()
 
 	return &NotificationHandler{
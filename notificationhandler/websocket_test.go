@@ -9,7 +9,7 @@ import (
 
 func TestNewTriggerHandlerNotificationHandler(t *testing.T) {
 	type args struct {
-		sessionObj *chan utils.SessionObj
+		sessionObj chan<- utils.SessionObj
 	}
 	tests := []struct {
 		name string
@@ -15,10 +15,10 @@ import (
 
 type HTTPHandler struct {
 	keyPair    *tls.Certificate
-	sessionObj *chan utils.SessionObj
+	sessionObj chan<- utils.SessionObj
 }
 
-func NewHTTPHandler(sessionObj *chan utils.SessionObj) *HTTPHandler {
+func NewHTTPHandler(sessionObj chan<- utils.SessionObj) *HTTPHandler {
 	return &HTTPHandler{
 		keyPair:    nil,
 		sessionObj: sessionObj,
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/armosec/armoapi-go/apis"
+	"github.com/google/uuid"
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+)
+
+// CommandSink delivers the commands produced by the watchers
+type CommandSink interface {
+	// Send delivers a command, returning an error if it could not be delivered
+	Send(ctx context.Context, cmd *apis.Command) error
+}
+
+// ChannelCommandSink delivers commands as sessions on a channel, to be handled by the main handler
+type ChannelCommandSink struct {
+	channel chan<- SessionObj
+}
+
+var _ CommandSink = &ChannelCommandSink{}
+
+func NewChannelCommandSink(channel chan<- SessionObj) *ChannelCommandSink {
+	return &ChannelCommandSink{channel: channel}
+}
+
+// Send wraps the command in a new session and sends it on the channel, blocking until it is received or the context is done
+func (s *ChannelCommandSink) Send(ctx context.Context, cmd *apis.Command) error {
+	logger.L().Ctx(ctx).Info("Triggering scan for", helpers.String("wlid", cmd.Wlid), helpers.String("command", fmt.Sprintf("%v", cmd.CommandName)), helpers.String("args", fmt.Sprintf("%v", cmd.Args)))
+	newSessionObj := NewSessionObj(ctx, cmd, "Websocket", "", uuid.NewString(), 1)
+	select {
+	case s.channel <- *newSessionObj:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -7,4 +7,46 @@ const (
 	PortEnvironmentVariable                     = "PORT"
 	CleanUpDelayEnvironmentVariable             = "CLEANUP_DELAY"
 	TriggerSecurityFrameworkEnvironmentVariable = "TRIGGER_SECURITY_FRAMEWORK"
+	ReconnectSettlingWindowEnvironmentVariable  = "RECONNECT_SETTLING_WINDOW"
+	CommandDedupWindowEnvironmentVariable       = "COMMAND_DEDUP_WINDOW"
+	TrackEphemeralContainersEnvironmentVariable = "TRACK_EPHEMERAL_CONTAINERS"
+	DryRunDeletionsEnvironmentVariable          = "DRY_RUN_DELETIONS"
+	StorageRequestTimeoutEnvironmentVariable    = "STORAGE_REQUEST_TIMEOUT"
+	IncludeSystemNamespacesEnvironmentVariable  = "INCLUDE_SYSTEM_NAMESPACES"
+	CompletedJobPodsWindowEnvironmentVariable   = "COMPLETED_JOB_PODS_WINDOW"
+	TrackFailedJobPodsEnvironmentVariable       = "TRACK_FAILED_JOB_PODS"
+	WaitForPodReadinessEnvironmentVariable      = "WAIT_FOR_POD_READINESS"
+	PodStabilizationDelayEnvironmentVariable    = "POD_STABILIZATION_DELAY"
+	WatchBackoffMaxEnvironmentVariable          = "WATCH_BACKOFF_MAX"
+	PodRelistMaxFailuresEnvironmentVariable     = "POD_RELIST_MAX_FAILURES"
+	WatchHealthThresholdEnvironmentVariable     = "WATCH_HEALTH_THRESHOLD"
+	PodWatchStalenessWindowEnvironmentVariable  = "POD_WATCH_STALENESS_WINDOW"
+	PodWatchWorkersEnvironmentVariable          = "POD_WATCH_WORKERS"
+	PodEventRetriesEnvironmentVariable          = "POD_EVENT_RETRIES"
+	BuildIDsWorkersEnvironmentVariable          = "BUILD_IDS_WORKERS"
+	ParentCacheTTLEnvironmentVariable           = "PARENT_CACHE_TTL"
+	PrescanWorkloadsEnvironmentVariable         = "PRESCAN_WORKLOADS"
+	InitialReconcileEnvironmentVariable         = "INITIAL_RECONCILE"
+	ScanWorkloadKindsEnvironmentVariable        = "SCAN_WORKLOAD_KINDS"
+	SkipWorkloadKindsEnvironmentVariable        = "SKIP_WORKLOAD_KINDS"
+	CleanUpJitterEnvironmentVariable            = "CLEANUP_JITTER"
+	DeletionBurstThresholdEnvironmentVariable   = "DELETION_BURST_THRESHOLD"
+	DeletionBurstWindowEnvironmentVariable      = "DELETION_BURST_WINDOW"
+	CheckpointFileEnvironmentVariable           = "CHECKPOINT_FILE"
+	CheckpointConfigMapEnvironmentVariable      = "CHECKPOINT_CONFIGMAP"
+	CheckpointIntervalEnvironmentVariable       = "CHECKPOINT_INTERVAL"
+	PeriodicRelevancyScanEnvironmentVariable    = "PERIODIC_RELEVANCY_SCAN"
+	OwnerReferencesEnvironmentVariable          = "OWNER_REFERENCES"
+	CommandRateLimitEnvironmentVariable         = "COMMAND_RATE_LIMIT"
+	CommandRateBurstEnvironmentVariable         = "COMMAND_RATE_BURST"
+	DeletionPoliciesEnvironmentVariable         = "DELETION_POLICIES"
+	VulnManifestRetentionEnvironmentVariable    = "VULN_MANIFEST_RETENTION"
+	DeletionGracePeriodEnvironmentVariable      = "DELETION_GRACE_PERIOD"
+	ResyncPeriodEnvironmentVariable             = "RESYNC_PERIOD"
+	WatchEventBufferSizeEnvironmentVariable     = "WATCH_EVENT_BUFFER_SIZE"
+	DeletionWorkersEnvironmentVariable          = "DELETION_WORKERS"
+	WatchKindsEnvironmentVariable               = "WATCH_KINDS"
+	BulkDeletionsEnvironmentVariable            = "BULK_DELETIONS"
+	MaxTrackedWlidsEnvironmentVariable          = "MAX_TRACKED_WLIDS"
+	ManagedBySelectorEnvironmentVariable        = "MANAGED_BY_SELECTOR"
 )
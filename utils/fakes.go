@@ -1,7 +1,10 @@
 package utils
 
 import (
+	"context"
+
 	"github.com/kubescape/k8s-interface/k8sinterface"
+	"k8s.io/client-go/dynamic"
 	k8s "k8s.io/client-go/kubernetes"
 )
 
@@ -14,3 +17,15 @@ import (
 func NewK8sInterfaceFake(k8sClient k8s.Interface) *k8sinterface.KubernetesApi {
 	return &k8sinterface.KubernetesApi{KubernetesClient: k8sClient}
 }
+
+// NewK8sInterfaceFakeWithDynamicClient returns a new K8sInterface with fake Kubernetes and Dynamic Clients attached
+//
+// Same as NewK8sInterfaceFake, but also allows injecting a Dynamic Client,
+// which is needed by the workload resolution methods (e.g. `GetWorkload`)
+func NewK8sInterfaceFakeWithDynamicClient(k8sClient k8s.Interface, dynamicClient dynamic.Interface) *k8sinterface.KubernetesApi {
+	return &k8sinterface.KubernetesApi{
+		KubernetesClient: k8sClient,
+		DynamicClient:    dynamicClient,
+		Context:          context.Background(),
+	}
+}
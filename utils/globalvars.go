@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	utilsmetadata "github.com/armosec/utils-k8s-go/armometadata"
@@ -17,8 +18,61 @@ var (
 	RestAPIPort              string        = "4002"    // default port
 	CleanUpRoutineInterval   time.Duration = 10 * time.Minute
 	TriggerSecurityFramework bool          = false
+	ReconnectSettlingWindow  time.Duration = 30 * time.Second // window after a watcher reconnects during which deletes are suppressed
+	CommandDedupWindow       time.Duration = 10 * time.Second // window during which duplicate scan commands are coalesced
+	TrackEphemeralContainers bool          = false            // track the images of ephemeral (debug) containers
+	DryRunDeletions          bool          = false            // log the storage objects that would be deleted instead of deleting them
+	StorageRequestTimeout    time.Duration = 30 * time.Second // timeout of the requests to the storage, except for watches
+	IncludeSystemNamespaces  bool          = false            // track the workloads of the system namespaces and of the operator's own namespace
+	CompletedJobPodsWindow   time.Duration = 0                // window after their completion during which the succeeded Pods of Jobs are tracked. Zero scans them once without tracking them
+	TrackFailedJobPods       bool          = false            // also track the failed Pods of Jobs, within CompletedJobPodsWindow
+	WaitForPodReadiness      bool          = false            // trigger the scans of Pods only once they are ready
+	PodStabilizationDelay    time.Duration = 0                // delay during which Pods must stay ready before triggering scans, with WaitForPodReadiness
+	WatchBackoffMax          time.Duration = 5 * time.Minute  // maximal delay between attempts to establish a watch
+	PodRelistMaxFailures     int           = 10               // number of consecutive failed relists of the Pods after which the operator exits. Zero retries forever
+	WatchHealthThreshold     time.Duration = time.Hour        // delay without activity after which a watcher is reported unhealthy
+	PodWatchStalenessWindow  time.Duration = 10 * time.Minute // delay without events after which the Pod watch is checked for being stuck. Zero disables the check
+	PodWatchWorkers          int           = 4                // number of workers handling the events of the Pod watcher
+	PodEventRetries          int           = 5                // number of times a Pod event that failed to be handled is retried
+	BuildIDsWorkers          int           = 8                // number of workers building the internal maps from the listed Pods
+	ParentCacheTTL           time.Duration = 5 * time.Minute  // time the resolved parents of Pod owners are cached for. Zero disables the cache
+	PrescanWorkloads         bool          = false            // scan the images of the Pod templates of workload controllers before their Pods run
+	InitialReconcile         bool          = false            // delete the storage objects orphaned while the operator was down once it starts
+	ScanWorkloadKinds        []string      = nil              // kinds of top-level workloads that are tracked, e.g. Deployment. Empty tracks every kind
+	SkipWorkloadKinds        []string      = []string{"Node"} // kinds of top-level workloads that are not tracked. The workloads of static Pods are of kind Node
+	CleanUpJitter            bool          = false            // delay the first cleanup by up to another CleanUpRoutineInterval, at random
+	DeletionBurstThreshold   int           = 50               // number of Pods deleted within DeletionBurstWindow that trigger a cleanup right away. Zero disables it
+	DeletionBurstWindow      time.Duration = time.Minute      // window within which DeletionBurstThreshold Pod deletions trigger a cleanup right away
+	CheckpointFile           string        = ""               // file the internal maps are checkpointed to, to survive restarts. Empty disables it
+	CheckpointConfigMap      string        = ""               // ConfigMap of the operator's namespace the internal maps are checkpointed to, unless CheckpointFile is set. Empty disables it
+	CheckpointInterval       time.Duration = 5 * time.Minute  // interval between two checkpoints of the internal maps
+	PeriodicRelevancyScan    bool          = false            // trigger a relevancy scan of every tracked workload after each cleanup
+	OwnerReferences          bool          = false            // set owners on the storage objects, for the garbage collector to delete them rather than the operator
+	CommandRateLimit         int           = 0                // maximal number of scan commands sent by the watchers per second. Zero disables it
+	CommandRateBurst         int           = 10               // number of scan commands the watchers may send at once above CommandRateLimit
+	DeletionPolicies         []string      = nil              // <kind>=<policy> elements setting what is done with the orphaned storage objects of a kind: Delete, Retain or Label. Kind * sets the others
+	VulnManifestRetention    time.Duration = 0                // time the Vulnerability Manifests of removed workloads are retained for before being deleted. Zero deletes them right away
+	DeletionGracePeriod      time.Duration = 0                // time the storage objects must stay orphaned for before being deleted, e.g. during rolling restarts. Zero disables it
+	ResyncPeriod             time.Duration = 0                // interval between two re-triggers of the scans of every tracked workload. Zero disables them
+	WatchEventBufferSize     int           = 100              // number of events buffered between the reader and the handler of each watch. Zero handles them as they are read
+	DeletionWorkers          int           = 4                // number of workers deleting the orphaned storage objects found by the watchers. Zero deletes them in the watchers
+	WatchKinds               []string      = nil              // kinds of resources watched, e.g. Pods or SBOMs. Empty watches every kind
+	BulkDeletions            bool          = false            // delete the orphaned storage objects found by the cleanups with a DeleteCollection per kind and namespace
+	MaxTrackedWlids          int           = 0                // maximal number of workloads tracked, the least recently updated ones without running Pods being evicted above it. Zero tracks every workload
+	ManagedBySelector        bool          = true             // watch the storage objects only if labeled as created by Kubescape. Unlabeled objects are never deleted either way
 )
 
+// SystemNamespaces are the namespaces whose workloads are not tracked unless IncludeSystemNamespaces is set
+var SystemNamespaces = []string{"kube-system", "kube-node-lease"}
+
+// ExcludedNamespaces returns the namespaces whose workloads are not tracked: the system namespaces and the operator's own namespace, unless IncludeSystemNamespaces is set
+func ExcludedNamespaces() []string {
+	if IncludeSystemNamespaces {
+		return nil
+	}
+	return append(append([]string{}, SystemNamespaces...), Namespace)
+}
+
 var ClusterConfig = &utilsmetadata.ClusterConfig{}
 
 func LoadEnvironmentVariables(ctx context.Context) (err error) {
@@ -60,5 +114,353 @@ func LoadEnvironmentVariables(ctx context.Context) (err error) {
 		}
 	}
 
+	if settlingWindow := os.Getenv(ReconnectSettlingWindowEnvironmentVariable); settlingWindow != "" {
+		dur, err := time.ParseDuration(settlingWindow)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set reconnectSettlingWindow from environment variable", helpers.Error(err))
+		} else {
+			ReconnectSettlingWindow = dur
+		}
+	}
+
+	if dedupWindow := os.Getenv(CommandDedupWindowEnvironmentVariable); dedupWindow != "" {
+		dur, err := time.ParseDuration(dedupWindow)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set commandDedupWindow from environment variable", helpers.Error(err))
+		} else {
+			CommandDedupWindow = dur
+		}
+	}
+
+	if trackEphemeral := os.Getenv(TrackEphemeralContainersEnvironmentVariable); trackEphemeral != "" {
+		TrackEphemeralContainers, err = strconv.ParseBool(trackEphemeral)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set TrackEphemeralContainers from environment variable", helpers.Error(err))
+			TrackEphemeralContainers = false
+		}
+	}
+
+	if dryRun := os.Getenv(DryRunDeletionsEnvironmentVariable); dryRun != "" {
+		DryRunDeletions, err = strconv.ParseBool(dryRun)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set DryRunDeletions from environment variable", helpers.Error(err))
+			DryRunDeletions = false
+		}
+	}
+
+	if storageTimeout := os.Getenv(StorageRequestTimeoutEnvironmentVariable); storageTimeout != "" {
+		dur, err := time.ParseDuration(storageTimeout)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set storageRequestTimeout from environment variable", helpers.Error(err))
+		} else {
+			StorageRequestTimeout = dur
+		}
+	}
+
+	if includeSystemNamespaces := os.Getenv(IncludeSystemNamespacesEnvironmentVariable); includeSystemNamespaces != "" {
+		IncludeSystemNamespaces, err = strconv.ParseBool(includeSystemNamespaces)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set IncludeSystemNamespaces from environment variable", helpers.Error(err))
+			IncludeSystemNamespaces = false
+		}
+	}
+
+	if completedJobPodsWindow := os.Getenv(CompletedJobPodsWindowEnvironmentVariable); completedJobPodsWindow != "" {
+		dur, err := time.ParseDuration(completedJobPodsWindow)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set completedJobPodsWindow from environment variable", helpers.Error(err))
+		} else {
+			CompletedJobPodsWindow = dur
+		}
+	}
+
+	if trackFailedJobPods := os.Getenv(TrackFailedJobPodsEnvironmentVariable); trackFailedJobPods != "" {
+		TrackFailedJobPods, err = strconv.ParseBool(trackFailedJobPods)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set TrackFailedJobPods from environment variable", helpers.Error(err))
+			TrackFailedJobPods = false
+		}
+	}
+
+	if waitForPodReadiness := os.Getenv(WaitForPodReadinessEnvironmentVariable); waitForPodReadiness != "" {
+		WaitForPodReadiness, err = strconv.ParseBool(waitForPodReadiness)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set WaitForPodReadiness from environment variable", helpers.Error(err))
+			WaitForPodReadiness = false
+		}
+	}
+
+	if stabilizationDelay := os.Getenv(PodStabilizationDelayEnvironmentVariable); stabilizationDelay != "" {
+		dur, err := time.ParseDuration(stabilizationDelay)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set podStabilizationDelay from environment variable", helpers.Error(err))
+		} else {
+			PodStabilizationDelay = dur
+		}
+	}
+
+	if watchBackoffMax := os.Getenv(WatchBackoffMaxEnvironmentVariable); watchBackoffMax != "" {
+		dur, err := time.ParseDuration(watchBackoffMax)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set watchBackoffMax from environment variable", helpers.Error(err))
+		} else {
+			WatchBackoffMax = dur
+		}
+	}
+
+	if podRelistMaxFailures := os.Getenv(PodRelistMaxFailuresEnvironmentVariable); podRelistMaxFailures != "" {
+		failures, err := strconv.Atoi(podRelistMaxFailures)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set podRelistMaxFailures from environment variable", helpers.Error(err))
+		} else {
+			PodRelistMaxFailures = failures
+		}
+	}
+
+	if watchHealthThreshold := os.Getenv(WatchHealthThresholdEnvironmentVariable); watchHealthThreshold != "" {
+		dur, err := time.ParseDuration(watchHealthThreshold)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set watchHealthThreshold from environment variable", helpers.Error(err))
+		} else {
+			WatchHealthThreshold = dur
+		}
+	}
+
+	if podWatchStalenessWindow := os.Getenv(PodWatchStalenessWindowEnvironmentVariable); podWatchStalenessWindow != "" {
+		dur, err := time.ParseDuration(podWatchStalenessWindow)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set podWatchStalenessWindow from environment variable", helpers.Error(err))
+		} else {
+			PodWatchStalenessWindow = dur
+		}
+	}
+
+	if podWatchWorkers := os.Getenv(PodWatchWorkersEnvironmentVariable); podWatchWorkers != "" {
+		workers, err := strconv.Atoi(podWatchWorkers)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set podWatchWorkers from environment variable", helpers.Error(err))
+		} else {
+			PodWatchWorkers = workers
+		}
+	}
+
+	if checkpointFile := os.Getenv(CheckpointFileEnvironmentVariable); checkpointFile != "" {
+		CheckpointFile = checkpointFile
+	}
+
+	if checkpointConfigMap := os.Getenv(CheckpointConfigMapEnvironmentVariable); checkpointConfigMap != "" {
+		CheckpointConfigMap = checkpointConfigMap
+	}
+
+	if checkpointInterval := os.Getenv(CheckpointIntervalEnvironmentVariable); checkpointInterval != "" {
+		dur, err := time.ParseDuration(checkpointInterval)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set checkpointInterval from environment variable", helpers.Error(err))
+		} else {
+			CheckpointInterval = dur
+		}
+	}
+
+	if vulnManifestRetention := os.Getenv(VulnManifestRetentionEnvironmentVariable); vulnManifestRetention != "" {
+		dur, err := time.ParseDuration(vulnManifestRetention)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set vulnManifestRetention from environment variable", helpers.Error(err))
+		} else {
+			VulnManifestRetention = dur
+		}
+	}
+
+	if deletionGracePeriod := os.Getenv(DeletionGracePeriodEnvironmentVariable); deletionGracePeriod != "" {
+		dur, err := time.ParseDuration(deletionGracePeriod)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set deletionGracePeriod from environment variable", helpers.Error(err))
+		} else {
+			DeletionGracePeriod = dur
+		}
+	}
+
+	if resyncPeriod := os.Getenv(ResyncPeriodEnvironmentVariable); resyncPeriod != "" {
+		dur, err := time.ParseDuration(resyncPeriod)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set resyncPeriod from environment variable", helpers.Error(err))
+		} else {
+			ResyncPeriod = dur
+		}
+	}
+
+	if deletionBurstThreshold := os.Getenv(DeletionBurstThresholdEnvironmentVariable); deletionBurstThreshold != "" {
+		threshold, err := strconv.Atoi(deletionBurstThreshold)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set deletionBurstThreshold from environment variable", helpers.Error(err))
+		} else {
+			DeletionBurstThreshold = threshold
+		}
+	}
+
+	if deletionBurstWindow := os.Getenv(DeletionBurstWindowEnvironmentVariable); deletionBurstWindow != "" {
+		dur, err := time.ParseDuration(deletionBurstWindow)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set deletionBurstWindow from environment variable", helpers.Error(err))
+		} else {
+			DeletionBurstWindow = dur
+		}
+	}
+
+	if buildIDsWorkers := os.Getenv(BuildIDsWorkersEnvironmentVariable); buildIDsWorkers != "" {
+		workers, err := strconv.Atoi(buildIDsWorkers)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set buildIDsWorkers from environment variable", helpers.Error(err))
+		} else {
+			BuildIDsWorkers = workers
+		}
+	}
+
+	if podEventRetries := os.Getenv(PodEventRetriesEnvironmentVariable); podEventRetries != "" {
+		retries, err := strconv.Atoi(podEventRetries)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set podEventRetries from environment variable", helpers.Error(err))
+		} else {
+			PodEventRetries = retries
+		}
+	}
+
+	if commandRateLimit := os.Getenv(CommandRateLimitEnvironmentVariable); commandRateLimit != "" {
+		rps, err := strconv.Atoi(commandRateLimit)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set commandRateLimit from environment variable", helpers.Error(err))
+		} else {
+			CommandRateLimit = rps
+		}
+	}
+
+	if commandRateBurst := os.Getenv(CommandRateBurstEnvironmentVariable); commandRateBurst != "" {
+		burst, err := strconv.Atoi(commandRateBurst)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set commandRateBurst from environment variable", helpers.Error(err))
+		} else {
+			CommandRateBurst = burst
+		}
+	}
+
+	if watchEventBufferSize := os.Getenv(WatchEventBufferSizeEnvironmentVariable); watchEventBufferSize != "" {
+		size, err := strconv.Atoi(watchEventBufferSize)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set watchEventBufferSize from environment variable", helpers.Error(err))
+		} else {
+			WatchEventBufferSize = size
+		}
+	}
+
+	if deletionWorkers := os.Getenv(DeletionWorkersEnvironmentVariable); deletionWorkers != "" {
+		workers, err := strconv.Atoi(deletionWorkers)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set deletionWorkers from environment variable", helpers.Error(err))
+		} else {
+			DeletionWorkers = workers
+		}
+	}
+
+	if maxTrackedWlids := os.Getenv(MaxTrackedWlidsEnvironmentVariable); maxTrackedWlids != "" {
+		limit, err := strconv.Atoi(maxTrackedWlids)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set maxTrackedWlids from environment variable", helpers.Error(err))
+		} else {
+			MaxTrackedWlids = limit
+		}
+	}
+
+	if parentCacheTTL := os.Getenv(ParentCacheTTLEnvironmentVariable); parentCacheTTL != "" {
+		dur, err := time.ParseDuration(parentCacheTTL)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set parentCacheTTL from environment variable", helpers.Error(err))
+		} else {
+			ParentCacheTTL = dur
+		}
+	}
+
+	if prescanWorkloads := os.Getenv(PrescanWorkloadsEnvironmentVariable); prescanWorkloads != "" {
+		PrescanWorkloads, err = strconv.ParseBool(prescanWorkloads)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set PrescanWorkloads from environment variable", helpers.Error(err))
+			PrescanWorkloads = false
+		}
+	}
+
+	if initialReconcile := os.Getenv(InitialReconcileEnvironmentVariable); initialReconcile != "" {
+		InitialReconcile, err = strconv.ParseBool(initialReconcile)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set InitialReconcile from environment variable", helpers.Error(err))
+			InitialReconcile = false
+		}
+	}
+
+	if periodicRelevancyScan := os.Getenv(PeriodicRelevancyScanEnvironmentVariable); periodicRelevancyScan != "" {
+		PeriodicRelevancyScan, err = strconv.ParseBool(periodicRelevancyScan)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set PeriodicRelevancyScan from environment variable", helpers.Error(err))
+			PeriodicRelevancyScan = false
+		}
+	}
+
+	if ownerReferences := os.Getenv(OwnerReferencesEnvironmentVariable); ownerReferences != "" {
+		OwnerReferences, err = strconv.ParseBool(ownerReferences)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set OwnerReferences from environment variable", helpers.Error(err))
+			OwnerReferences = false
+		}
+	}
+
+	if cleanUpJitter := os.Getenv(CleanUpJitterEnvironmentVariable); cleanUpJitter != "" {
+		CleanUpJitter, err = strconv.ParseBool(cleanUpJitter)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set CleanUpJitter from environment variable", helpers.Error(err))
+			CleanUpJitter = false
+		}
+	}
+
+	if bulkDeletions := os.Getenv(BulkDeletionsEnvironmentVariable); bulkDeletions != "" {
+		BulkDeletions, err = strconv.ParseBool(bulkDeletions)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set BulkDeletions from environment variable", helpers.Error(err))
+			BulkDeletions = false
+		}
+	}
+
+	if managedBySelector := os.Getenv(ManagedBySelectorEnvironmentVariable); managedBySelector != "" {
+		ManagedBySelector, err = strconv.ParseBool(managedBySelector)
+		if err != nil {
+			logger.L().Ctx(ctx).Error("could not set ManagedBySelector from environment variable", helpers.Error(err))
+			ManagedBySelector = true
+		}
+	}
+
+	if deletionPolicies := os.Getenv(DeletionPoliciesEnvironmentVariable); deletionPolicies != "" {
+		DeletionPolicies = splitList(deletionPolicies)
+	}
+
+	if scanKinds := os.Getenv(ScanWorkloadKindsEnvironmentVariable); scanKinds != "" {
+		ScanWorkloadKinds = splitList(scanKinds)
+	}
+
+	if watchKinds := os.Getenv(WatchKindsEnvironmentVariable); watchKinds != "" {
+		WatchKinds = splitList(watchKinds)
+	}
+
+	// set but empty tracks the workloads of every kind, static Pods included
+	if skipKinds, ok := os.LookupEnv(SkipWorkloadKindsEnvironmentVariable); ok {
+		SkipWorkloadKinds = splitList(skipKinds)
+	}
+
 	return nil
 }
+
+// splitList returns the non-empty elements of a comma-separated list
+func splitList(list string) []string {
+	var elements []string
+	for _, element := range strings.Split(list, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}
@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+)
+
+// dockerURN prefixes the image IDs of images without a repository digest reported by dockershim
+const dockerURN = "docker://"
+
+// crioURN prefixes the image IDs reported by some versions of CRI-O
+const crioURN = "cri-o://"
+
+// dockerHubRegistry is the registry of image references without one, as reported by containerd
+const dockerHubRegistry = "docker.io"
+
+var (
+	imageDigestRegExp    = regexp.MustCompile(`^(sha256:[0-9a-f]{64}|sha512:[0-9a-f]{128})$`)
+	bareImageHashRegExp  = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	loggedImageIDFormats sync.Map
+	// runtimeURNs are the prefixes of the image IDs of the known container runtimes, trimmed before normalizing
+	runtimeURNs = []string{dockerPullableURN, dockerURN, crioURN}
+)
+
+// NormalizeImageID returns the normalized form of an image ID reported by the container runtime
+//
+// The CRI formats are normalized as follows:
+//
+//	docker-pullable://nginx@sha256:<hex>       docker.io/library/nginx@sha256:<hex>
+//	docker://sha256:<hex>                      sha256:<hex>
+//	cri-o://quay.io/app@sha256:<hex>           quay.io/app@sha256:<hex>
+//	cri-o://sha256:<hex>                       sha256:<hex>
+//	nginx@sha256:<hex>                         docker.io/library/nginx@sha256:<hex>
+//	index.docker.io/library/nginx@sha256:<hex> docker.io/library/nginx@sha256:<hex>
+//	docker.io/library/nginx@sha256:<hex>       docker.io/library/nginx@sha256:<hex>
+//	sha256:<hex>                               sha256:<hex>
+//	<hex>                                      sha256:<hex>
+//
+// so that the image IDs of an image match regardless of the runtime of its
+// node, e.g. once a node is migrated from dockershim to containerd, or on
+// clusters mixing node pools of CRI-O and containerd. Image IDs
+// of unknown formats are returned without their docker-pullable prefix, and
+// logged once per format.
+func NormalizeImageID(imageID string) string {
+	if normalized, ok := normalizeImageID(imageID); ok {
+		return normalized
+	}
+	format := imageIDFormat(imageID)
+	if _, logged := loggedImageIDFormats.LoadOrStore(format, struct{}{}); !logged {
+		logger.L().Info("unknown image ID format, using the image ID as is", helpers.String("format", format), helpers.String("imageID", imageID))
+	}
+	return strings.TrimPrefix(imageID, dockerPullableURN)
+}
+
+// normalizeImageID returns the normalized form of an image ID, false if its format is unknown
+func normalizeImageID(imageID string) (string, bool) {
+	ref := imageID
+	for _, urn := range runtimeURNs {
+		ref = strings.TrimPrefix(ref, urn)
+	}
+	if bareImageHashRegExp.MatchString(ref) {
+		return "sha256:" + ref, true
+	}
+
+	repository, digest, hasRepository := strings.Cut(ref, "@")
+	if !hasRepository {
+		repository, digest = "", ref
+	}
+	if !imageDigestRegExp.MatchString(digest) {
+		return "", false
+	}
+	if !hasRepository {
+		return digest, true
+	}
+	if repository == "" || strings.Contains(repository, "://") {
+		return "", false
+	}
+	return normalizeRepository(repository) + "@" + digest, true
+}
+
+// normalizeRepository returns the fully qualified name of a repository, as reported by containerd
+func normalizeRepository(repository string) string {
+	// tags are not part of the identity of an image
+	if colon := strings.LastIndex(repository, ":"); colon > strings.LastIndex(repository, "/") {
+		repository = repository[:colon]
+	}
+
+	registry, path, hasRegistry := strings.Cut(repository, "/")
+	// the first component is a registry if it is a host name
+	if !hasRegistry || (!strings.ContainsAny(registry, ".:") && registry != "localhost") {
+		registry, path = dockerHubRegistry, repository
+	}
+	if registry == "index.docker.io" || registry == "registry-1.docker.io" {
+		registry = dockerHubRegistry
+	}
+	if registry == dockerHubRegistry && !strings.Contains(path, "/") {
+		path = "library/" + path
+	}
+	return registry + "/" + path
+}
+
+// imageIDFormat returns the format of an image ID, for it to be logged once per unknown format
+func imageIDFormat(imageID string) string {
+	if scheme, _, ok := strings.Cut(imageID, "://"); ok {
+		return scheme + "://"
+	}
+	if _, digest, ok := strings.Cut(imageID, "@"); ok {
+		if algorithm, _, ok := strings.Cut(digest, ":"); ok {
+			return "<repository>@" + algorithm + ":"
+		}
+		return "<repository>@"
+	}
+	return "<no digest>"
+}
+
+// ImageIDDigest returns the digest of a normalized image ID, e.g. sha256:<hex>
+func ImageIDDigest(imageID string) string {
+	if _, digest, ok := strings.Cut(imageID, "@"); ok {
+		return digest
+	}
+	return imageID
+}
+
+// ImageIDHash returns the digest of an image ID once normalized, e.g. sha256:<hex>, false if its format is unknown
+func ImageIDHash(imageID string) (string, bool) {
+	normalized, ok := normalizeImageID(imageID)
+	if !ok {
+		return "", false
+	}
+	return ImageIDDigest(normalized), true
+}
+
+// SameImageDigest reports whether two normalized image IDs have the same digest, regardless of their repositories
+func SameImageDigest(imageID, other string) bool {
+	return ImageIDDigest(imageID) == ImageIDDigest(other)
+}
@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testImageHash       = "c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ee"
+	testImageDigest     = "sha256:" + testImageHash
+	testImageSHA512Hash = "sha512:" + testImageHash + testImageHash
+)
+
+func TestNormalizeImageID(t *testing.T) {
+	tests := []struct {
+		name     string
+		imageID  string
+		expected string
+	}{
+		{
+			name:     "dockershim image with a repository digest",
+			imageID:  "docker-pullable://alpine@" + testImageDigest,
+			expected: "docker.io/library/alpine@" + testImageDigest,
+		},
+		{
+			name:     "dockershim image with a repository digest of a registry",
+			imageID:  "docker-pullable://quay.io/kubescape/kubevuln@" + testImageDigest,
+			expected: "quay.io/kubescape/kubevuln@" + testImageDigest,
+		},
+		{
+			name:     "dockershim image without a repository digest",
+			imageID:  "docker://" + testImageDigest,
+			expected: testImageDigest,
+		},
+		{
+			name:     "CRI-O image with a prefixed repository digest",
+			imageID:  "cri-o://quay.io/kubescape/kubevuln@" + testImageDigest,
+			expected: "quay.io/kubescape/kubevuln@" + testImageDigest,
+		},
+		{
+			name:     "CRI-O image with a prefixed digest",
+			imageID:  "cri-o://" + testImageDigest,
+			expected: testImageDigest,
+		},
+		{
+			name:     "CRI-O image with a repository digest",
+			imageID:  "registry.access.redhat.com/ubi8/ubi-minimal@" + testImageDigest,
+			expected: "registry.access.redhat.com/ubi8/ubi-minimal@" + testImageDigest,
+		},
+		{
+			name:     "containerd image of Docker Hub",
+			imageID:  "docker.io/library/alpine@" + testImageDigest,
+			expected: "docker.io/library/alpine@" + testImageDigest,
+		},
+		{
+			name:     "containerd image of a Docker Hub user",
+			imageID:  "docker.io/bitnami/redis@" + testImageDigest,
+			expected: "docker.io/bitnami/redis@" + testImageDigest,
+		},
+		{
+			name:     "image of a Docker Hub user without a registry",
+			imageID:  "bitnami/redis@" + testImageDigest,
+			expected: "docker.io/bitnami/redis@" + testImageDigest,
+		},
+		{
+			name:     "image of Docker Hub named after its index",
+			imageID:  "index.docker.io/library/alpine@" + testImageDigest,
+			expected: "docker.io/library/alpine@" + testImageDigest,
+		},
+		{
+			name:     "image of Docker Hub named after its registry",
+			imageID:  "registry-1.docker.io/library/alpine@" + testImageDigest,
+			expected: "docker.io/library/alpine@" + testImageDigest,
+		},
+		{
+			name:     "image of a registry",
+			imageID:  "quay.io/kubescape/kubevuln@" + testImageDigest,
+			expected: "quay.io/kubescape/kubevuln@" + testImageDigest,
+		},
+		{
+			name:     "image of a registry with a port",
+			imageID:  "registry.local:5000/team/app@" + testImageDigest,
+			expected: "registry.local:5000/team/app@" + testImageDigest,
+		},
+		{
+			name:     "image of a local registry",
+			imageID:  "localhost/app@" + testImageDigest,
+			expected: "localhost/app@" + testImageDigest,
+		},
+		{
+			name:     "image with a tag and a digest",
+			imageID:  "quay.io/kubescape/kubevuln:v0.2.0@" + testImageDigest,
+			expected: "quay.io/kubescape/kubevuln@" + testImageDigest,
+		},
+		{
+			name:     "image of a registry with a port, a tag and a digest",
+			imageID:  "registry.local:5000/app:v1@" + testImageDigest,
+			expected: "registry.local:5000/app@" + testImageDigest,
+		},
+		{
+			name:     "containerd image without a repository digest",
+			imageID:  testImageDigest,
+			expected: testImageDigest,
+		},
+		{
+			name:     "bare image hash",
+			imageID:  testImageHash,
+			expected: testImageDigest,
+		},
+		{
+			name:     "SHA-512 digest",
+			imageID:  "alpine@" + testImageSHA512Hash,
+			expected: "docker.io/library/alpine@" + testImageSHA512Hash,
+		},
+		{
+			name:     "unknown scheme is kept",
+			imageID:  "containerd://alpine@" + testImageDigest,
+			expected: "containerd://alpine@" + testImageDigest,
+		},
+		{
+			name:     "malformed digest is kept without the docker-pullable prefix",
+			imageID:  "docker-pullable://alpine@sha256:1",
+			expected: "alpine@sha256:1",
+		},
+		{
+			name:     "uppercase digest is kept",
+			imageID:  "alpine@sha256:" + "C5360B25031E2982544581B9404C8C0EB24F455A8EF2304103D3278DFF70F2EE",
+			expected: "alpine@sha256:" + "C5360B25031E2982544581B9404C8C0EB24F455A8EF2304103D3278DFF70F2EE",
+		},
+		{
+			name:     "missing repository is kept",
+			imageID:  "@" + testImageDigest,
+			expected: "@" + testImageDigest,
+		},
+		{
+			name:     "empty image ID is kept",
+			imageID:  "",
+			expected: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, NormalizeImageID(tt.imageID))
+			// normalizing is idempotent
+			assert.Equal(t, tt.expected, NormalizeImageID(tt.expected))
+		})
+	}
+}
+
+func TestNormalizeImageIDLogsUnknownFormatsOnce(t *testing.T) {
+	loggedImageIDFormats.Delete("unknown://")
+
+	NormalizeImageID("unknown://alpine@" + testImageDigest)
+	_, logged := loggedImageIDFormats.Load("unknown://")
+	assert.True(t, logged)
+
+	// known formats are not recorded
+	loggedImageIDFormats.Delete("<repository>@sha256:")
+	NormalizeImageID("alpine@" + testImageDigest)
+	_, logged = loggedImageIDFormats.Load("<repository>@sha256:")
+	assert.False(t, logged)
+}
+
+func TestImageIDFormat(t *testing.T) {
+	assert.Equal(t, "containerd://", imageIDFormat("containerd://alpine@"+testImageDigest))
+	assert.Equal(t, "<repository>@sha256:", imageIDFormat("alpine@sha256:1"))
+	assert.Equal(t, "<repository>@", imageIDFormat("alpine@1"))
+	assert.Equal(t, "<no digest>", imageIDFormat("alpine:latest"))
+}
+
+func TestSameImageDigest(t *testing.T) {
+	assert.Equal(t, testImageDigest, ImageIDDigest("docker.io/library/alpine@"+testImageDigest))
+	assert.Equal(t, testImageDigest, ImageIDDigest(testImageDigest))
+	assert.True(t, SameImageDigest("docker.io/library/alpine@"+testImageDigest, testImageDigest))
+	assert.True(t, SameImageDigest("docker.io/library/alpine@"+testImageDigest, "quay.io/mirror/alpine@"+testImageDigest))
+	assert.False(t, SameImageDigest("docker.io/library/alpine@"+testImageDigest, "docker.io/library/alpine@sha256:1"))
+}
+
+func TestImageIDHash(t *testing.T) {
+	for _, imageID := range []string{
+		"docker-pullable://alpine@" + testImageDigest,
+		"docker.io/library/alpine@" + testImageDigest,
+		"alpine@" + testImageDigest,
+		testImageDigest,
+		testImageHash,
+	} {
+		hash, ok := ImageIDHash(imageID)
+		assert.True(t, ok, imageID)
+		assert.Equal(t, testImageDigest, hash, imageID)
+	}
+
+	for _, imageID := range []string{"containerd://alpine@" + testImageDigest, "alpine@sha256:1", "alpine:latest"} {
+		_, ok := ImageIDHash(imageID)
+		assert.False(t, ok, imageID)
+	}
+}
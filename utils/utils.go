@@ -2,15 +2,11 @@ package utils
 
 import (
 	"context"
-	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/armosec/armoapi-go/apis"
 	"github.com/armosec/utils-go/httputils"
-	"github.com/google/uuid"
-	"github.com/kubescape/go-logger"
-	"github.com/kubescape/go-logger/helpers"
 	core1 "k8s.io/api/core/v1"
 )
 
@@ -18,8 +14,28 @@ const KubescapeScanV1 = "scanV1"
 const KubescapeRequestPathV1 = "v1/scan"
 const KubescapeRequestStatusV1 = "v1/status"
 const ContainerToImageIdsArg = "containerToImageIDs"
+const ContainerToImagePinnedArg = "containerToImagePinned"
+const ContainerToContainerTypeArg = "containerToContainerType"
+const ContainerNamesArg = "containerNames" // names of the containers of ContainerToImageIdsArg, sorted
+const ScanScopeArg = "scanScope"
 const dockerPullableURN = "docker-pullable://"
 
+// Container types, as reported in the ContainerToContainerTypeArg command argument
+const (
+	ContainerTypeContainer     = "container"
+	ContainerTypeInitContainer = "initContainer"
+	// ContainerTypeEphemeralContainer is the type of ephemeral (debug) containers, e.g. attached by `kubectl debug`
+	ContainerTypeEphemeralContainer = "ephemeralContainer"
+)
+
+// Scan scopes, as reported in the ScanScopeArg command argument
+const (
+	// ScanScopeVulnerability is the scope of the initial vulnerability scans of the images of a workload
+	ScanScopeVulnerability = "vulnerability"
+	// ScanScopeRelevancy is the scope of the scans triggered by the filtered SBOMs of a workload, i.e. of its relevant components
+	ScanScopeRelevancy = "relevancy"
+)
+
 func MapToString(m map[string]interface{}) []string {
 	s := []string{}
 	for i := range m {
@@ -60,27 +76,41 @@ func InitReporterHttpClient() httputils.IHttpClient {
 	return &http.Client{}
 }
 
+// ExtractImageID returns the image ID of a container status as reported by the runtime, without its docker-pullable prefix
+//
+// Image IDs are sent as such in the commands, they are only normalized to be
+// compared, see NormalizeImageID.
 func ExtractImageID(imageID string) string {
 	return strings.TrimPrefix(imageID, dockerPullableURN)
 }
 
-func AddCommandToChannel(ctx context.Context, cmd *apis.Command, channel *chan SessionObj) {
-	logger.L().Ctx(ctx).Info("Triggering scan for", helpers.String("wlid", cmd.Wlid), helpers.String("command", fmt.Sprintf("%v", cmd.CommandName)), helpers.String("args", fmt.Sprintf("%v", cmd.Args)))
-	newSessionObj := NewSessionObj(ctx, cmd, "Websocket", "", uuid.NewString(), 1)
-	*channel <- *newSessionObj
+// AddCommandToChannel sends the command as a new session on the channel, see ChannelCommandSink
+func AddCommandToChannel(ctx context.Context, cmd *apis.Command, channel chan<- SessionObj) {
+	_ = NewChannelCommandSink(channel).Send(ctx, cmd)
+}
+
+// ContainerImageID returns the image ID reported by a container status, see ExtractImageID, false if it reports none yet
+//
+// The kubelet may report a container running before its image ID, which is
+// then empty, or only made of the scheme of the runtime, e.g. docker-pullable://
+func ContainerImageID(containerStatus core1.ContainerStatus) (string, bool) {
+	if containerStatus.ImageID == "" {
+		return "", false
+	}
+	imageID := ExtractImageID(containerStatus.ImageID)
+	return imageID, imageID != ""
 }
 
 func ExtractContainersToImageIDsFromPod(pod *core1.Pod) map[string]string {
 	containersToImageIDs := make(map[string]string)
 	for _, containerStatus := range pod.Status.ContainerStatuses {
-		if containerStatus.State.Running != nil {
-			imageID := ExtractImageID(containerStatus.ImageID)
+		if imageID, ok := ContainerImageID(containerStatus); containerStatus.State.Running != nil && ok {
 			containersToImageIDs[containerStatus.Name] = imageID
 		}
 	}
 
 	for _, containerStatus := range pod.Status.InitContainerStatuses {
-		if containerStatus.State.Running != nil {
+		if InitContainerHasStarted(containerStatus) {
 			imageID := ExtractImageID(containerStatus.ImageID)
 			containersToImageIDs[containerStatus.Name] = imageID
 		}
@@ -88,3 +118,14 @@ func ExtractContainersToImageIDsFromPod(pod *core1.Pod) map[string]string {
 
 	return containersToImageIDs
 }
+
+// InitContainerHasStarted returns true if the init container is running or has already run, so its image ID is known
+//
+// Init containers run to completion before the regular containers start, so
+// they are usually terminated by the time the Pod is running
+func InitContainerHasStarted(containerStatus core1.ContainerStatus) bool {
+	if _, ok := ContainerImageID(containerStatus); !ok {
+		return false
+	}
+	return containerStatus.State.Running != nil || containerStatus.State.Terminated != nil
+}
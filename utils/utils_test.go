@@ -1,9 +1,11 @@
 package utils
 
 import (
+	"context"
 	"reflect"
 	"testing"
 
+	"github.com/armosec/armoapi-go/apis"
 	"github.com/stretchr/testify/assert"
 	core1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -100,6 +102,78 @@ func TestExtractContainersToImageIDsFromPod(t *testing.T) {
 				"container2": "alpine@sha256:2",
 			},
 		},
+		{
+			name: "terminated init container",
+			pod: &core1.Pod{
+				ObjectMeta: v1.ObjectMeta{
+					Name:      "pod3",
+					Namespace: "namespace3",
+				},
+				Status: core1.PodStatus{
+					InitContainerStatuses: []core1.ContainerStatus{
+						{
+							State: core1.ContainerState{
+								Terminated: &core1.ContainerStateTerminated{},
+							},
+							ImageID: "docker-pullable://migrate@sha256:1",
+							Name:    "migrate",
+						},
+					},
+					ContainerStatuses: []core1.ContainerStatus{
+						{
+							State: core1.ContainerState{
+								Running: &core1.ContainerStateRunning{},
+							},
+							ImageID: "docker-pullable://alpine@sha256:1",
+							Name:    "container1",
+						},
+					},
+				},
+			},
+			expected: map[string]string{
+				"container1": "alpine@sha256:1",
+				"migrate":    "migrate@sha256:1",
+			},
+		},
+		{
+			name: "containers reporting no image ID yet",
+			pod: &core1.Pod{
+				ObjectMeta: v1.ObjectMeta{
+					Name:      "pod4",
+					Namespace: "namespace4",
+				},
+				Status: core1.PodStatus{
+					InitContainerStatuses: []core1.ContainerStatus{
+						{
+							State: core1.ContainerState{
+								Running: &core1.ContainerStateRunning{},
+							},
+							ImageID: "docker-pullable://",
+							Name:    "sidecar",
+						},
+					},
+					ContainerStatuses: []core1.ContainerStatus{
+						{
+							State: core1.ContainerState{
+								Running: &core1.ContainerStateRunning{},
+							},
+							ImageID: "",
+							Name:    "container1",
+						},
+						{
+							State: core1.ContainerState{
+								Running: &core1.ContainerStateRunning{},
+							},
+							ImageID: "docker-pullable://alpine@sha256:1",
+							Name:    "container2",
+						},
+					},
+				},
+			},
+			expected: map[string]string{
+				"container2": "alpine@sha256:1",
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -107,3 +181,39 @@ func TestExtractContainersToImageIDsFromPod(t *testing.T) {
 		})
 	}
 }
+
+func TestChannelCommandSink(t *testing.T) {
+	ReporterHttpClient = &ClientMock{}
+	cmd := &apis.Command{CommandName: apis.TypeScanImages, Wlid: "wlid://cluster-/namespace-default/deployment-nginx"}
+
+	channel := make(chan SessionObj, 1)
+	sink := NewChannelCommandSink(channel)
+	assert.NoError(t, sink.Send(context.TODO(), cmd))
+	sessionObj := <-channel
+	assert.Equal(t, *cmd, sessionObj.Command)
+
+	// commands that are not received are dropped once the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	unreceived := make(chan SessionObj)
+	assert.ErrorIs(t, NewChannelCommandSink(unreceived).Send(ctx, cmd), context.Canceled)
+}
+
+func TestExcludedNamespaces(t *testing.T) {
+	defer func(namespace string, include bool) {
+		Namespace, IncludeSystemNamespaces = namespace, include
+	}(Namespace, IncludeSystemNamespaces)
+	Namespace = "kubescape"
+
+	IncludeSystemNamespaces = false
+	assert.Equal(t, []string{"kube-system", "kube-node-lease", "kubescape"}, ExcludedNamespaces())
+
+	IncludeSystemNamespaces = true
+	assert.Empty(t, ExcludedNamespaces())
+}
+
+func TestSplitList(t *testing.T) {
+	assert.Equal(t, []string{"Deployment", "StatefulSet"}, splitList("Deployment, StatefulSet"))
+	assert.Equal(t, []string{"Node"}, splitList(" Node ,,"))
+	assert.Empty(t, splitList(""))
+}
@@ -0,0 +1,123 @@
+package watcher
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+)
+
+// watchBackoffResetAfter is how long a watch must last for the backoff to be reset once it ends
+const watchBackoffResetAfter = time.Minute
+
+// watchBackoff computes the delays before establishing a watch again
+//
+// Delays double from the initial delay after each failure, up to the
+// maximum, and are jittered so that the replicas of the operator do not
+// retry in lockstep during an outage of the API server. Watches that end
+// before lasting resetAfter count as failures, so that a watch closing right
+// away is not re-established in a tight loop. Longer ones reset the backoff.
+//
+// A watchBackoff belongs to a single watch loop and is not safe for concurrent use.
+type watchBackoff struct {
+	initial     time.Duration
+	max         time.Duration
+	resetAfter  time.Duration
+	failures    int
+	connectedAt time.Time
+	now         clock
+	// jitter returns a random number in [0, 1), overridable for tests
+	jitter func() float64
+	// report records the consecutive failures and the time of the next attempt, nil if not recorded
+	report func(failures int, retryAt time.Time)
+}
+
+// newWatchBackoff returns a backoff starting at the initial delay, capped at max. A max lower than the initial delay disables the backoff
+func newWatchBackoff(initial, max, resetAfter time.Duration) *watchBackoff {
+	if max < initial {
+		max = initial
+	}
+	return &watchBackoff{
+		initial:    initial,
+		max:        max,
+		resetAfter: resetAfter,
+		now:        time.Now,
+		jitter:     rand.Float64,
+	}
+}
+
+// newWatchBackoff returns the backoff of the watch loop of the watcher with the given name, recorded by the health tracker, see DumpState
+func (wh *WatchHandler) newWatchBackoff(watcherName string) *watchBackoff {
+	b := newWatchBackoff(retryInterval, wh.watchBackoffMax, watchBackoffResetAfter)
+	if wh.clock != nil {
+		b.now = wh.clock
+	}
+	b.report = func(failures int, retryAt time.Time) { wh.health.BackedOff(watcherName, failures, retryAt) }
+	return b
+}
+
+// Next records a failure to establish or keep a watch and returns the delay before the next attempt
+//
+// The delay is drawn from the upper half of the current backoff.
+func (b *watchBackoff) Next() time.Duration {
+	delay := b.initial
+	for i := 0; i < b.failures && delay < b.max; i++ {
+		// capped before doubling, so that the delay cannot overflow
+		if delay > b.max/2 {
+			delay = b.max
+			break
+		}
+		delay *= 2
+	}
+	b.failures++
+	return delay/2 + time.Duration(b.jitter()*float64(delay/2))
+}
+
+// Failures returns the number of consecutive failures since the backoff was last reset
+func (b *watchBackoff) Failures() int {
+	return b.failures
+}
+
+// Connected records that a watch was established
+func (b *watchBackoff) Connected() {
+	b.connectedAt = b.now()
+}
+
+// Disconnected records that the established watch ended, returning true and
+// resetting the backoff if it lasted at least resetAfter. It returns false if
+// no watch was established.
+func (b *watchBackoff) Disconnected() bool {
+	if b.connectedAt.IsZero() {
+		return false
+	}
+	lasted := b.now().Sub(b.connectedAt) >= b.resetAfter
+	b.connectedAt = time.Time{}
+	if lasted {
+		b.failures = 0
+		if b.report != nil {
+			b.report(0, time.Time{})
+		}
+	}
+	return lasted
+}
+
+// wait records a failure of the watcher and waits for the delay before the next attempt, or until the context is done
+func (b *watchBackoff) wait(ctx context.Context, watcherName string) {
+	delay := b.Next()
+	if b.report != nil {
+		b.report(b.failures, b.now().Add(delay))
+	}
+	logger.L().Ctx(ctx).Info("watch unavailable, backing off before the next attempt",
+		helpers.String("watcher", watcherName),
+		helpers.Int("failures", b.Failures()),
+		helpers.String("delay", delay.String()))
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,106 @@
+package watcher
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newWatchBackoffFake returns a backoff without jitter, on a clock advanced by the returned function
+func newWatchBackoffFake(initial, max, resetAfter time.Duration) (*watchBackoff, func(time.Duration)) {
+	now := time.Now()
+	b := newWatchBackoff(initial, max, resetAfter)
+	b.now = func() time.Time { return now }
+	b.jitter = func() float64 { return 1 }
+	return b, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestWatchBackoffNext(t *testing.T) {
+	tt := []struct {
+		name     string
+		initial  time.Duration
+		max      time.Duration
+		expected []time.Duration
+	}{
+		{
+			name:     "Delays double up to the maximum",
+			initial:  time.Second,
+			max:      10 * time.Second,
+			expected: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second},
+		},
+		{
+			name:     "Maximum lower than the initial delay",
+			initial:  3 * time.Second,
+			max:      0,
+			expected: []time.Duration{3 * time.Second, 3 * time.Second, 3 * time.Second},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			b, _ := newWatchBackoffFake(tc.initial, tc.max, time.Minute)
+			for i, expected := range tc.expected {
+				assert.Equal(t, expected, b.Next())
+				assert.Equal(t, i+1, b.Failures())
+			}
+		})
+	}
+}
+
+func TestWatchBackoffJitter(t *testing.T) {
+	b := newWatchBackoff(time.Second, time.Minute, time.Minute)
+	b.jitter = func() float64 { return 0 }
+	assert.Equal(t, 500*time.Millisecond, b.Next(), "delays should be drawn from the upper half of the backoff")
+	b.jitter = func() float64 { return 0.5 }
+	assert.Equal(t, 1500*time.Millisecond, b.Next())
+}
+
+func TestWatchBackoffDoesNotOverflow(t *testing.T) {
+	tt := []struct {
+		name    string
+		initial time.Duration
+		max     time.Duration
+	}{
+		{name: "Small initial delay", initial: time.Second, max: time.Hour},
+		// 5s doubled 31 times overflows a time.Duration
+		{name: "Large initial delay", initial: 5 * time.Second, max: 24 * time.Hour},
+		{name: "Maximum of a time.Duration", initial: time.Hour, max: time.Duration(math.MaxInt64)},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			b, _ := newWatchBackoffFake(tc.initial, tc.max, time.Minute)
+			for i := 0; i < 100; i++ {
+				delay := b.Next()
+				assert.GreaterOrEqual(t, delay, tc.initial)
+				assert.LessOrEqual(t, delay, tc.max)
+			}
+			assert.Equal(t, tc.max, b.Next())
+		})
+	}
+}
+
+func TestWatchBackoffDisconnected(t *testing.T) {
+	b, advance := newWatchBackoffFake(time.Second, time.Minute, time.Minute)
+	assert.False(t, b.Disconnected(), "the backoff should not reset without a watch")
+
+	b.Next()
+	b.Next()
+
+	// a watch closing right away keeps backing off
+	b.Connected()
+	advance(time.Second)
+	assert.False(t, b.Disconnected())
+	assert.Equal(t, 4*time.Second, b.Next())
+
+	// a watch lasting long enough resets the backoff
+	b.Connected()
+	advance(time.Minute)
+	assert.True(t, b.Disconnected())
+	assert.Equal(t, 0, b.Failures())
+	assert.Equal(t, time.Second, b.Next())
+
+	assert.False(t, b.Disconnected(), "the watch should have been recorded as ended")
+}
@@ -0,0 +1,245 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// orphanedLabel labels the orphaned storage objects about to be deleted in bulk, see deleteOrphansInBulk
+	orphanedLabel = "kubescape.io/orphaned"
+	// orphanedSelector selects the storage objects labeled with orphanedLabel
+	orphanedSelector = orphanedLabel + "=true"
+)
+
+const (
+	// metricBulkDeletionsTotal is the number of orphaned storage objects deleted in bulk
+	metricBulkDeletionsTotal = "operator_bulk_deletions_total"
+	// metricBulkDeletionFallbacksTotal is the number of namespaces whose orphaned storage objects of a kind were deleted one by one after failing to be deleted in bulk
+	metricBulkDeletionFallbacksTotal = "operator_bulk_deletion_fallbacks_total"
+)
+
+// orphanCollection deletes the orphaned storage objects of a kind in bulk, see deleteOrphansInBulk
+type orphanCollection struct {
+	// patch merge-patches an object of the kind along with the objects stored together with it
+	patch func(ctx context.Context, namespace, name string, data []byte) error
+	// listNames returns the names of the objects of the kind, and of the objects stored together with them, matching a label selector in a namespace
+	listNames func(ctx context.Context, namespace, selector string) ([]string, error)
+	// deleteCollection deletes the objects of the kind, along with the objects stored together with them, matching a label selector in a namespace
+	deleteCollection func(ctx context.Context, namespace, selector string) error
+}
+
+// orphanCollection returns the collection deleting the objects of a kind in bulk, nil if they are only deleted one by one
+func (wh *WatchHandler) orphanCollection(kind string) *orphanCollection {
+	for _, sbomKind := range sbomKinds {
+		if sbomKind.kind != kind || sbomKind.deleteCollection == nil {
+			continue
+		}
+		sbomKind := sbomKind
+		return &orphanCollection{
+			patch: sbomKind.patchObject(wh),
+			listNames: func(ctx context.Context, namespace, selector string) ([]string, error) {
+				return sbomKind.listNames(wh, ctx, namespace, selector)
+			},
+			deleteCollection: func(ctx context.Context, namespace, selector string) error {
+				return sbomKind.deleteCollection(wh, ctx, namespace, selector)
+			},
+		}
+	}
+	if kind != vulnerabilityManifestKind {
+		return nil
+	}
+	return &orphanCollection{
+		patch: wh.patchVulnerabilityManifest,
+		listNames: func(ctx context.Context, namespace, selector string) ([]string, error) {
+			list, err := wh.storageClient.SpdxV1beta1().VulnerabilityManifests(namespace).List(ctx, v1.ListOptions{LabelSelector: selector})
+			if err != nil {
+				return nil, err
+			}
+			names := make([]string, 0, len(list.Items))
+			for i := range list.Items {
+				names = append(names, list.Items[i].Name)
+			}
+			return names, nil
+		},
+		deleteCollection: func(ctx context.Context, namespace, selector string) error {
+			return wh.storageClient.SpdxV1beta1().VulnerabilityManifests(namespace).DeleteCollection(ctx, v1.DeleteOptions{}, v1.ListOptions{LabelSelector: selector})
+		},
+	}
+}
+
+// flushBatch performs the deletions of the batch, in bulk where possible, see deleteOrphansInBulk and deletionBatch.Flush
+func (wh *WatchHandler) flushBatch(ctx context.Context, batch *deletionBatch) (int, []error) {
+	bulkDeleted := wh.deleteOrphansInBulk(ctx, batch)
+	deleted, errs := batch.Flush(ctx, orphanDeletionWorkers)
+	return bulkDeleted + deleted, errs
+}
+
+// deleteOrphansInBulk deletes the orphaned storage objects of the batch in bulk, a single collection per kind and namespace, if enabled by WithBulkDeletions
+//
+// The objects still orphaned, once their grace period is over, are labeled
+// with orphanedLabel, and the labeled objects of each namespace are then
+// deleted with a DeleteCollection. Objects labeled by an earlier cleanUp that
+// are not orphaned anymore, e.g. as it failed in between, are unlabeled
+// first, so that only the objects checked orphaned are ever deleted. The
+// deletions of the objects that fail to be labeled, or of every object of a
+// namespace if any other step fails, are left in the batch, to be performed
+// one by one. Kinds whose storage does not support DeleteCollection are
+// deleted one by one from then on. Objects of kinds not deleted by
+// DeletionPolicyDelete, and dry runs, are left in the batch as well.
+//
+// Returns the number of deleted objects, the deletions performed are removed from the batch.
+func (wh *WatchHandler) deleteOrphansInBulk(ctx context.Context, batch *deletionBatch) int {
+	if !wh.bulkDeletions || wh.dryRun {
+		return 0
+	}
+
+	type collectionKey struct{ kind, namespace string }
+	collections := make(map[collectionKey][]orphanDeletion)
+	var remaining []orphanDeletion
+	for _, deletion := range batch.deletions {
+		if _, unsupported := wh.bulkUnsupported.Load(deletion.kind); unsupported || wh.deletionPolicy(deletion.kind) != DeletionPolicyDelete || wh.orphanCollection(deletion.kind) == nil {
+			remaining = append(remaining, deletion)
+			continue
+		}
+		key := collectionKey{kind: deletion.kind, namespace: deletion.namespace}
+		collections[key] = append(collections[key], deletion)
+	}
+	keys := make([]collectionKey, 0, len(collections))
+	for key := range collections {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].kind != keys[j].kind {
+			return keys[i].kind < keys[j].kind
+		}
+		return keys[i].namespace < keys[j].namespace
+	})
+
+	deleted := 0
+	for _, key := range keys {
+		// e.g. found unsupported by the collection of another namespace
+		if _, unsupported := wh.bulkUnsupported.Load(key.kind); unsupported {
+			remaining = append(remaining, collections[key]...)
+			continue
+		}
+		collectionDeleted, fallback := wh.deleteCollectionOfOrphans(ctx, key.kind, key.namespace, collections[key])
+		deleted += collectionDeleted
+		remaining = append(remaining, fallback...)
+	}
+	batch.deletions = remaining
+	return deleted
+}
+
+// deleteCollectionOfOrphans deletes the orphaned storage objects of a kind in a namespace in bulk, see deleteOrphansInBulk
+//
+// Returns the number of deleted objects and the deletions to perform one by one.
+func (wh *WatchHandler) deleteCollectionOfOrphans(ctx context.Context, kind, namespace string, deletions []orphanDeletion) (int, []orphanDeletion) {
+	collection := wh.orphanCollection(kind)
+	var fallback []orphanDeletion
+	labeled := make(map[string]orphanDeletion, len(deletions))
+	for _, deletion := range deletions {
+		if !deletion.isOrphan() {
+			continue
+		}
+		if !wh.pendingDeletions.Due(pendingDeletionKey{kind: kind, namespace: namespace, name: deletion.name}) {
+			logger.L().Ctx(ctx).Debug("not deleting orphaned storage object within its grace period", deletionDetails(kind, namespace, deletion.name, deletion.reason)...)
+			continue
+		}
+		logDeletion(ctx, kind, namespace, deletion.name, deletion.reason, helpers.String("bulk", "true"))
+		// objects not found are considered labeled, as are their counterparts
+		if err := wh.setOrphanedLabel(ctx, collection, namespace, deletion.name, true); err != nil && !k8serrors.IsNotFound(err) {
+			logger.L().Ctx(ctx).Warning("failed to label orphaned storage object, deleting it on its own",
+				append(deletionDetails(kind, namespace, deletion.name, deletion.reason), helpers.Error(err))...)
+			fallback = append(fallback, deletion)
+			continue
+		}
+		labeled[deletion.name] = deletion
+	}
+	if len(labeled) == 0 {
+		return 0, fallback
+	}
+
+	// deleteOneByOne leaves the deletions of the labeled objects to be performed one by one
+	deleteOneByOne := func(err error) (int, []orphanDeletion) {
+		wh.metrics.Inc(metricBulkDeletionFallbacksTotal)
+		logger.L().Ctx(ctx).Warning("failed to delete orphaned storage objects in bulk, deleting them one by one",
+			helpers.String("kind", kind),
+			helpers.String("namespace", namespace),
+			helpers.Int("objects", len(labeled)),
+			helpers.Error(err))
+		for _, deletion := range labeled {
+			fallback = append(fallback, deletion)
+		}
+		return 0, fallback
+	}
+
+	// only the labeled objects still orphaned right before deleting them,
+	// and none labeled earlier, are deleted
+	requestCtx, cancel := wh.storageRequestContext(ctx)
+	names, err := collection.listNames(requestCtx, namespace, orphanedSelector)
+	cancel()
+	if err != nil {
+		return deleteOneByOne(err)
+	}
+	for _, name := range names {
+		if deletion, ok := labeled[name]; ok && deletion.isOrphan() {
+			continue
+		}
+		if err := wh.setOrphanedLabel(ctx, collection, namespace, name, false); err != nil && !k8serrors.IsNotFound(err) {
+			return deleteOneByOne(err)
+		}
+		delete(labeled, name)
+	}
+	if len(labeled) == 0 {
+		return 0, fallback
+	}
+
+	requestCtx, cancel = wh.storageRequestContext(ctx)
+	err = collection.deleteCollection(requestCtx, namespace, orphanedSelector)
+	cancel()
+	if err != nil {
+		if k8serrors.IsMethodNotSupported(err) {
+			logger.L().Ctx(ctx).Info("storage does not delete storage objects in bulk, deleting them one by one", helpers.String("kind", kind))
+			wh.bulkUnsupported.Store(kind, true)
+		}
+		return deleteOneByOne(err)
+	}
+
+	wh.metrics.Add(metricBulkDeletionsTotal, int64(len(labeled)))
+	logger.L().Ctx(ctx).Debug("deleted orphaned storage objects in bulk",
+		helpers.String("kind", kind),
+		helpers.String("namespace", namespace),
+		helpers.Int("objects", len(labeled)))
+	if wh.onDelete != nil {
+		for name := range labeled {
+			wh.onDelete(kind, namespace, name)
+		}
+	}
+	return len(labeled), fallback
+}
+
+// setOrphanedLabel labels a storage object with orphanedLabel, or removes the label from it
+func (wh *WatchHandler) setOrphanedLabel(ctx context.Context, collection *orphanCollection, namespace, name string, orphaned bool) error {
+	var value interface{}
+	if orphaned {
+		value = "true"
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]interface{}{orphanedLabel: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	requestCtx, cancel := wh.storageRequestContext(ctx)
+	defer cancel()
+	return collection.patch(requestCtx, namespace, name, data)
+}
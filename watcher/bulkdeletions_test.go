@@ -0,0 +1,224 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+
+	instanceidhandlerv1 "github.com/kubescape/k8s-interface/instanceidhandler/v1"
+	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// deleteCollectionReactor deletes the objects matching the label selector of a DeleteCollection, which the fake clientset ignores
+func deleteCollectionReactor(storageClient *kssfake.Clientset) k8stesting.ReactionFunc {
+	kinds := map[string]string{
+		"sbomsummaries":          "SBOMSummary",
+		"sbomspdxv2p3s":          "SBOMSPDXv2p3",
+		"sbomspdxv2p3filtereds":  "SBOMSPDXv2p3Filtered",
+		"vulnerabilitymanifests": "VulnerabilityManifest",
+	}
+	return func(action k8stesting.Action) (bool, runtime.Object, error) {
+		deleteCollection := action.(k8stesting.DeleteCollectionAction)
+		gvr := action.GetResource()
+		gvk := schema.GroupVersionKind{Group: gvr.Group, Version: gvr.Version, Kind: kinds[gvr.Resource]}
+		list, err := storageClient.Tracker().List(gvr, gvk, action.GetNamespace())
+		if err != nil {
+			return true, nil, err
+		}
+		objects, err := meta.ExtractList(list)
+		if err != nil {
+			return true, nil, err
+		}
+		selector := deleteCollection.GetListRestrictions().Labels
+		for _, obj := range objects {
+			accessor, _ := meta.Accessor(obj)
+			if selector.Matches(labelSet(accessor.GetLabels())) {
+				if err := storageClient.Tracker().Delete(gvr, accessor.GetNamespace(), accessor.GetName()); err != nil {
+					return true, nil, err
+				}
+			}
+		}
+		return true, nil, nil
+	}
+}
+
+// labelSet are labels matched by a selector
+type labelSet map[string]string
+
+func (s labelSet) Has(label string) bool {
+	_, ok := s[label]
+	return ok
+}
+
+func (s labelSet) Get(label string) string {
+	return s[label]
+}
+
+func TestDeleteOrphansInBulk(t *testing.T) {
+	ctx := context.TODO()
+	trackedImageID := "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"
+	summary := func(namespace, name, imageID string, labels map[string]string) *spdxv1beta1.SBOMSummary {
+		objectLabels := managedLabels()
+		for label, value := range labels {
+			objectLabels[label] = value
+		}
+		return &spdxv1beta1.SBOMSummary{ObjectMeta: v1.ObjectMeta{Namespace: namespace, Name: name, Labels: objectLabels, Annotations: map[string]string{instanceidhandlerv1.ImageIDMetadataKey: imageID}}}
+	}
+	objects := func() []runtime.Object {
+		return []runtime.Object{
+			summary("kubescape", "tracked", trackedImageID, nil),
+			&spdxv1beta1.SBOMSPDXv2p3{ObjectMeta: v1.ObjectMeta{Namespace: "kubescape", Name: "tracked", Labels: managedLabels()}},
+			// labeled by an earlier cleanUp that failed, and tracked again since
+			summary("kubescape", "tracked-again", trackedImageID, map[string]string{orphanedLabel: "true"}),
+			summary("kubescape", "orphan-01", "alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb", nil),
+			&spdxv1beta1.SBOMSPDXv2p3{ObjectMeta: v1.ObjectMeta{Namespace: "kubescape", Name: "orphan-01", Labels: managedLabels()}},
+			summary("kubescape", "orphan-02", "alpine@sha256:8d8beb9fd7bbcfddb9838219929c6ac7c0f44bfd437d52a5c595e2745c1c2316", nil),
+			summary("other", "orphan-03", "alpine@sha256:2b3c88defe3996017045aef9a1f1f28d287e4e7daa6297d0493220b6368a4c4e", nil),
+		}
+	}
+	newWatchHandler := func(t *testing.T, storageClient *kssfake.Clientset) *WatchHandler {
+		k8sAPI, _ := newK8sAPIFake()
+		wh, err := NewWatchHandler(k8sAPI, storageClient, map[string][]string{trackedImageID: {"wlid"}}, nil, WithBulkDeletions(true))
+		assert.NoError(t, err)
+		return wh
+	}
+	newStorageClient := func(deleteCollection k8stesting.ReactionFunc) *kssfake.Clientset {
+		storageClient := kssfake.NewSimpleClientset(objects()...)
+		if deleteCollection == nil {
+			deleteCollection = deleteCollectionReactor(storageClient)
+		}
+		storageClient.PrependReactor("delete-collection", "*", deleteCollection)
+		return storageClient
+	}
+	summaryNames := func(t *testing.T, storageClient *kssfake.Clientset) []string {
+		list, err := storageClient.SpdxV1beta1().SBOMSummaries("").List(ctx, v1.ListOptions{})
+		assert.NoError(t, err)
+		var names []string
+		for i := range list.Items {
+			names = append(names, list.Items[i].Namespace+"/"+list.Items[i].Name)
+			assert.NotContains(t, list.Items[i].Labels, orphanedLabel, "kept objects should not stay labeled")
+		}
+		sort.Strings(names)
+		return names
+	}
+	// countActions returns the number of actions of the given verb on the summaries
+	countActions := func(storageClient *kssfake.Clientset, verb string) int {
+		count := 0
+		for _, action := range storageClient.Actions() {
+			if action.GetVerb() == verb && action.GetResource().Resource == "sbomsummaries" {
+				count++
+			}
+		}
+		return count
+	}
+	kept := []string{"kubescape/tracked", "kubescape/tracked-again"}
+
+	t.Run("orphaned objects are deleted in bulk", func(t *testing.T) {
+		storageClient := newStorageClient(nil)
+		wh := newWatchHandler(t, storageClient)
+		var deleted []string
+		wh.onDelete = func(kind, namespace, name string) { deleted = append(deleted, namespace+"/"+name) }
+
+		wh.reclaimOrphans(ctx)
+
+		assert.Equal(t, kept, summaryNames(t, storageClient))
+		assert.Equal(t, 2, countActions(storageClient, "delete-collection"), "the summaries of each namespace should be deleted together")
+		assert.Zero(t, countActions(storageClient, "delete"))
+		sort.Strings(deleted)
+		assert.Equal(t, []string{"kubescape/orphan-01", "kubescape/orphan-02", "other/orphan-03"}, deleted)
+		_, err := storageClient.SpdxV1beta1().SBOMSPDXv2p3s("kubescape").Get(ctx, "orphan-01", v1.GetOptions{})
+		assert.True(t, k8serrors.IsNotFound(err), "the SBOMs should be deleted along with their summaries")
+		_, err = storageClient.SpdxV1beta1().SBOMSPDXv2p3s("kubescape").Get(ctx, "tracked", v1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), wh.metrics.Get(metricBulkDeletionsTotal))
+	})
+
+	t.Run("objects failing to be labeled are deleted one by one", func(t *testing.T) {
+		storageClient := newStorageClient(nil)
+		storageClient.PrependReactor("patch", "sbomsummaries", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			if action.(k8stesting.PatchAction).GetName() == "orphan-02" {
+				return true, nil, errors.New("storage unavailable")
+			}
+			return false, nil, nil
+		})
+		wh := newWatchHandler(t, storageClient)
+
+		wh.reclaimOrphans(ctx)
+
+		assert.Equal(t, kept, summaryNames(t, storageClient))
+		assert.Equal(t, 1, countActions(storageClient, "delete"))
+	})
+
+	t.Run("objects are deleted one by one if they fail to be deleted in bulk", func(t *testing.T) {
+		storageClient := newStorageClient(func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, errors.New("storage unavailable")
+		})
+		wh := newWatchHandler(t, storageClient)
+
+		wh.reclaimOrphans(ctx)
+
+		assert.Equal(t, kept, summaryNames(t, storageClient))
+		assert.Equal(t, 3, countActions(storageClient, "delete"))
+		assert.Equal(t, int64(2), wh.metrics.Get(metricBulkDeletionFallbacksTotal))
+		assert.Zero(t, wh.metrics.Get(metricBulkDeletionsTotal))
+	})
+
+	t.Run("objects are deleted one by one once the storage does not support deleting them in bulk", func(t *testing.T) {
+		storageClient := newStorageClient(func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, k8serrors.NewMethodNotSupported(action.GetResource().GroupResource(), "deletecollection")
+		})
+		wh := newWatchHandler(t, storageClient)
+
+		wh.reclaimOrphans(ctx)
+		assert.Equal(t, kept, summaryNames(t, storageClient))
+		assert.Equal(t, 1, countActions(storageClient, "delete-collection"), "the unsupported DeleteCollection should not be attempted again")
+		assert.Equal(t, 3, countActions(storageClient, "delete"))
+	})
+
+	t.Run("nothing is deleted in bulk if objects labeled earlier fail to be unlabeled", func(t *testing.T) {
+		storageClient := newStorageClient(nil)
+		storageClient.PrependReactor("patch", "sbomsummaries", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			if action.(k8stesting.PatchAction).GetName() == "tracked-again" {
+				return true, nil, errors.New("storage unavailable")
+			}
+			return false, nil, nil
+		})
+		wh := newWatchHandler(t, storageClient)
+
+		wh.reclaimOrphans(ctx)
+
+		summaries, err := storageClient.SpdxV1beta1().SBOMSummaries("kubescape").List(ctx, v1.ListOptions{})
+		assert.NoError(t, err)
+		var names []string
+		for i := range summaries.Items {
+			names = append(names, summaries.Items[i].Name)
+		}
+		sort.Strings(names)
+		assert.Equal(t, []string{"tracked", "tracked-again"}, names, "objects not orphaned should never be deleted")
+		assert.Equal(t, 1, countActions(storageClient, "delete-collection"), "only the namespace without objects labeled earlier should be deleted in bulk")
+		assert.Equal(t, 2, countActions(storageClient, "delete"))
+	})
+
+	t.Run("dry runs delete nothing", func(t *testing.T) {
+		storageClient := newStorageClient(nil)
+		wh := newWatchHandler(t, storageClient)
+		wh.dryRun = true
+
+		wh.reclaimOrphans(ctx)
+
+		summaries, err := storageClient.SpdxV1beta1().SBOMSummaries("").List(ctx, v1.ListOptions{})
+		assert.NoError(t, err)
+		assert.Len(t, summaries.Items, 5)
+		assert.Zero(t, countActions(storageClient, "patch"))
+		assert.Zero(t, countActions(storageClient, "delete-collection"))
+	})
+}
@@ -0,0 +1,62 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// deleteFilteredSBOMsOfImage deletes the filtered SBOMs of the image of a deleted SBOM, see handleSBOM
+//
+// Filtered SBOMs are identified by instance ID, so without this those of an
+// image no Pod runs anymore would only be deleted once their instance ID is
+// not tracked either, which never happens while a container of the same name
+// runs another image. Only the filtered SBOMs annotated with one of the image
+// IDs of the SBOM, in its namespace, and whose image is still not tracked
+// when they are deleted are deleted, according to the deletion policy of
+// their kind. Deleting a filtered SBOM never deletes the counterpart SBOM.
+func (wh *WatchHandler) deleteFilteredSBOMsOfImage(ctx context.Context, namespace string, imageIDs []string, report func(err error)) {
+	listCtx, cancel := wh.storageRequestContext(ctx)
+	filtered, err := wh.storageClient.SpdxV1beta1().SBOMSPDXv2p3Filtereds(namespace).List(listCtx, v1.ListOptions{})
+	cancel()
+	if err != nil {
+		report(fmt.Errorf("error to list %s: %w", sbomSPDXv2p3FilteredKind, err))
+		return
+	}
+
+	imageHashes := make(map[string]struct{}, len(imageIDs))
+	for _, imageID := range imageIDs {
+		imageHashes[imageHashKey(imageID)] = struct{}{}
+	}
+
+	batch := &deletionBatch{}
+	for i := range filtered.Items {
+		obj := &filtered.Items[i]
+		imageID, err := annotationsToImageID(obj.GetAnnotations())
+		if err != nil {
+			continue
+		}
+		if _, ok := imageHashes[imageHashKey(imageID)]; !ok || wh.leftToGarbageCollector(obj) {
+			continue
+		}
+		wh.addOrphan(batch, sbomSPDXv2p3FilteredKind, obj, deletionReasonImageHashNotTracked, func() bool {
+			return !wh.isImageIDTracked(imageID)
+		}, sbomSPDXv2p3Filtereds.deleteObject(wh, obj), sbomSPDXv2p3Filtereds.patchObject(wh))
+	}
+	if batch.Len() == 0 {
+		return
+	}
+
+	deleted, errs := batch.Flush(ctx, orphanDeletionWorkers)
+	for _, err := range errs {
+		report(err)
+	}
+	logger.L().Ctx(ctx).Debug("deleted the filtered SBOMs of a deleted SBOM",
+		helpers.String("namespace", namespace),
+		helpers.String("imageID", imageIDs[0]),
+		helpers.Int("deleted", deleted),
+		helpers.Int("failed", len(errs)))
+}
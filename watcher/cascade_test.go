@@ -0,0 +1,114 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/armosec/armoapi-go/apis"
+	instanceidv1 "github.com/kubescape/k8s-interface/instanceidhandler/v1"
+	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestDeleteFilteredSBOMsOfImage(t *testing.T) {
+	ctx := context.TODO()
+	orphanedImageID := "nginx@sha256:c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ee"
+	trackedImageID := "redis@sha256:c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ef"
+	meta := func(namespace, name, imageID string) v1.ObjectMeta {
+		return v1.ObjectMeta{Namespace: namespace, Name: name, Labels: managedLabels(), Annotations: map[string]string{
+			instanceidv1.ImageIDMetadataKey:    imageID,
+			instanceidv1.InstanceIDMetadataKey: "apiVersion-v1/namespace-default/kind-Pod/name-" + name + "/containerName-app",
+			instanceidv1.WlidMetadataKey:       "wlid://cluster-/namespace-default/pod-" + name,
+		}}
+	}
+	objects := func() []runtime.Object {
+		return []runtime.Object{
+			&spdxv1beta1.SBOMSummary{ObjectMeta: meta("kubescape", "nginx", orphanedImageID)},
+			&spdxv1beta1.SBOMSPDXv2p3{ObjectMeta: meta("kubescape", "nginx", orphanedImageID)},
+			&spdxv1beta1.SBOMSPDXv2p3Filtered{ObjectMeta: meta("kubescape", "nginx-1", orphanedImageID)},
+			// the same image under its normalized image ID
+			&spdxv1beta1.SBOMSPDXv2p3Filtered{ObjectMeta: meta("kubescape", "nginx-2", "docker.io/library/"+orphanedImageID)},
+			&spdxv1beta1.SBOMSPDXv2p3Filtered{ObjectMeta: meta("kubescape", "redis-1", trackedImageID)},
+			&spdxv1beta1.SBOMSPDXv2p3Filtered{ObjectMeta: meta("other", "nginx-1", orphanedImageID)},
+		}
+	}
+	newWatchHandler := func(t *testing.T, storageClient *kssfake.Clientset) *WatchHandler {
+		k8sAPI, _ := newK8sAPIFake()
+		wh, err := NewWatchHandler(k8sAPI, storageClient, map[string][]string{trackedImageID: {"wlid-01"}}, nil)
+		assert.NoError(t, err)
+		return wh
+	}
+	filteredNames := func(t *testing.T, storageClient *kssfake.Clientset) []string {
+		list, err := storageClient.SpdxV1beta1().SBOMSPDXv2p3Filtereds("").List(ctx, v1.ListOptions{})
+		assert.NoError(t, err)
+		var names []string
+		for i := range list.Items {
+			names = append(names, list.Items[i].Namespace+"/"+list.Items[i].Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	handleSBOMs := func(wh *WatchHandler, objs ...runtime.Object) []error {
+		sbomEvents := make(chan watch.Event, len(objs))
+		for _, obj := range objs {
+			sbomEvents <- watch.Event{Type: watch.Modified, Object: obj}
+		}
+		close(sbomEvents)
+		errCh := make(chan error)
+		go wh.HandleSBOMEvents(ctx, sbomEvents, make(chan *apis.Command, 1), errCh)
+		var errs []error
+		for err := range errCh {
+			errs = append(errs, err)
+		}
+		return errs
+	}
+
+	t.Run("filtered SBOMs of the image of a deleted SBOM are deleted", func(t *testing.T) {
+		storageClient := kssfake.NewSimpleClientset(objects()...)
+		wh := newWatchHandler(t, storageClient)
+
+		assert.Empty(t, handleSBOMs(wh, &spdxv1beta1.SBOMSummary{ObjectMeta: meta("kubescape", "nginx", orphanedImageID)}))
+		_, err := storageClient.SpdxV1beta1().SBOMSummaries("kubescape").Get(ctx, "nginx", v1.GetOptions{})
+		assert.Error(t, err)
+		assert.Equal(t, []string{"kubescape/redis-1", "other/nginx-1"}, filteredNames(t, storageClient),
+			"only the filtered SBOMs of the image in the namespace of the SBOM should be deleted")
+	})
+
+	t.Run("the errors of the deletions are reported", func(t *testing.T) {
+		storageClient := kssfake.NewSimpleClientset(objects()...)
+		storageClient.PrependReactor("delete", "sbomspdxv2p3filtereds", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, errors.New("storage unavailable")
+		})
+		wh := newWatchHandler(t, storageClient)
+
+		errs := handleSBOMs(wh, &spdxv1beta1.SBOMSummary{ObjectMeta: meta("kubescape", "nginx", orphanedImageID)})
+		assert.Len(t, errs, 2, "every failed deletion should be reported")
+	})
+
+	t.Run("deleting filtered SBOMs keeps their SBOM", func(t *testing.T) {
+		storageClient := kssfake.NewSimpleClientset(objects()...)
+		wh := newWatchHandler(t, storageClient)
+
+		filteredEvents := make(chan watch.Event, 1)
+		filteredEvents <- watch.Event{Type: watch.Modified, Object: &spdxv1beta1.SBOMSPDXv2p3Filtered{ObjectMeta: meta("kubescape", "nginx-1", orphanedImageID)}}
+		close(filteredEvents)
+		errCh := make(chan error)
+		go wh.HandleSBOMFilteredEvents(ctx, filteredEvents, make(chan *apis.Command, 1), errCh)
+		for err := range errCh {
+			assert.NoError(t, err)
+		}
+
+		assert.NotContains(t, filteredNames(t, storageClient), "kubescape/nginx-1")
+		_, err := storageClient.SpdxV1beta1().SBOMSummaries("kubescape").Get(ctx, "nginx", v1.GetOptions{})
+		assert.NoError(t, err)
+		_, err = storageClient.SpdxV1beta1().SBOMSPDXv2p3s("kubescape").Get(ctx, "nginx", v1.GetOptions{})
+		assert.NoError(t, err)
+	})
+}
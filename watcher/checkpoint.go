@@ -0,0 +1,229 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// checkpointConfigMapKey is the key of the ConfigMap data holding the checkpoint
+const checkpointConfigMapKey = "checkpoint.json"
+
+// Checkpoint is the part of the internal maps persisted across restarts of the operator, see WithCheckpoint
+type Checkpoint struct {
+	WlidsToContainerToImageID WlidsToContainerToImageIDMap `json:"wlidsToContainerToImageID"`
+	ImageHashToWlids          map[string][]string          `json:"imageHashToWlids"`
+	InstanceIDs               []string                     `json:"instanceIDs"`
+}
+
+// CheckpointStore persists checkpoints of the internal maps
+//
+// Load returns a nil checkpoint, and no error, if none was saved yet.
+type CheckpointStore interface {
+	Load(ctx context.Context) (*Checkpoint, error)
+	Save(ctx context.Context, checkpoint Checkpoint) error
+}
+
+// fileCheckpointStore persists checkpoints to a local file, e.g. on a persistent volume
+type fileCheckpointStore struct {
+	path string
+}
+
+// NewFileCheckpointStore returns a CheckpointStore persisting checkpoints to the file at the given path
+func NewFileCheckpointStore(path string) CheckpointStore {
+	return fileCheckpointStore{path: path}
+}
+
+func (s fileCheckpointStore) Load(_ context.Context) (*Checkpoint, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalCheckpoint(data)
+}
+
+// Save writes the checkpoint to a temporary file renamed over the previous one, so that a crash never leaves a partial checkpoint
+func (s fileCheckpointStore) Save(_ context.Context, checkpoint Checkpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// configMapCheckpointStore persists checkpoints to a ConfigMap
+//
+// ConfigMaps are limited to 1 MiB, which holds the checkpoints of clusters
+// running several thousands of workloads.
+type configMapCheckpointStore struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+}
+
+// NewConfigMapCheckpointStore returns a CheckpointStore persisting checkpoints to the ConfigMap of the given namespace and name, created if needed
+func NewConfigMapCheckpointStore(client kubernetes.Interface, namespace, name string) CheckpointStore {
+	return configMapCheckpointStore{client: client, namespace: namespace, name: name}
+}
+
+func (s configMapCheckpointStore) Load(ctx context.Context) (*Checkpoint, error) {
+	configMap, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, v1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, ok := configMap.Data[checkpointConfigMapKey]
+	if !ok {
+		return nil, nil
+	}
+	return unmarshalCheckpoint([]byte(data))
+}
+
+func (s configMapCheckpointStore) Save(ctx context.Context, checkpoint Checkpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	configMaps := s.client.CoreV1().ConfigMaps(s.namespace)
+	configMap, err := configMaps.Get(ctx, s.name, v1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		_, err = configMaps.Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: v1.ObjectMeta{Name: s.name, Namespace: s.namespace},
+			Data:       map[string]string{checkpointConfigMapKey: string(data)},
+		}, v1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string)
+	}
+	configMap.Data[checkpointConfigMapKey] = string(data)
+	_, err = configMaps.Update(ctx, configMap, v1.UpdateOptions{})
+	return err
+}
+
+func unmarshalCheckpoint(data []byte) (*Checkpoint, error) {
+	checkpoint := &Checkpoint{}
+	if err := json.Unmarshal(data, checkpoint); err != nil {
+		return nil, fmt.Errorf("malformed checkpoint: %w", err)
+	}
+	return checkpoint, nil
+}
+
+// checkpoint returns a checkpoint of the internal maps
+func (wh *WatchHandler) checkpoint() Checkpoint {
+	state := wh.snapshotState()
+	return Checkpoint{
+		WlidsToContainerToImageID: state.WlidsToContainerToImageID,
+		ImageHashToWlids:          state.ImageHashToWlids,
+		InstanceIDs:               state.InstanceIDs,
+	}
+}
+
+// loadCheckpoint seeds the internal maps with the last saved checkpoint, if any
+//
+// The seeded image hashes and instance IDs are tracked like those passed to
+// NewWatchHandler, until the next cleanUp. A checkpoint that fails to load is
+// ignored, as if the operator started for the first time.
+func (wh *WatchHandler) loadCheckpoint(ctx context.Context) {
+	if wh.checkpoints == nil {
+		return
+	}
+
+	checkpoint, err := wh.checkpoints.Load(ctx)
+	if err != nil {
+		logger.L().Ctx(ctx).Warning("failed to load the checkpoint of the internal maps, ignoring it", helpers.Error(err))
+		return
+	}
+	if checkpoint == nil {
+		return
+	}
+
+	for imageHash, wlids := range imageHashKeys(checkpoint.ImageHashToWlids) {
+		wh.addToImageIDToWlidsMap(imageHash, wlids...)
+	}
+	wh.instanceIDsMutex.Lock()
+	for _, instanceID := range checkpoint.InstanceIDs {
+		wh.managedInstanceIDSlugs.Add("", instanceID)
+	}
+	wh.instanceIDsMutex.Unlock()
+	wh.checkpointed = checkpoint.WlidsToContainerToImageID
+	logger.L().Ctx(ctx).Info("loaded the checkpoint of the internal maps",
+		helpers.Int("wlids", len(checkpoint.WlidsToContainerToImageID)),
+		helpers.Int("imageHashes", len(checkpoint.ImageHashToWlids)),
+		helpers.Int("instanceIDs", len(checkpoint.InstanceIDs)))
+}
+
+// startCheckpointRoutine saves a checkpoint of the internal maps every interval, until the context is done
+func (wh *WatchHandler) startCheckpointRoutine(ctx context.Context) {
+	if wh.checkpoints == nil || wh.checkpointInterval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(wh.checkpointInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := wh.checkpoints.Save(ctx, wh.checkpoint()); err != nil {
+					logger.L().Ctx(ctx).Warning("failed to save the checkpoint of the internal maps", helpers.Error(err))
+				}
+			}
+		}
+	}()
+}
+
+// GetWlidsChangedSinceCheckpoint returns the tracked WLIDs, with their container to image ID maps, that are new or run other images since the loaded checkpoint
+//
+// WLIDs unchanged since the checkpoint were scanned before the operator
+// restarted, so only the returned ones need to be scanned once it starts.
+// Every tracked WLID is returned if no checkpoint was loaded.
+func (wh *WatchHandler) GetWlidsChangedSinceCheckpoint() WlidsToContainerToImageIDMap {
+	wh.wlidsToContainerToImageIDMapMutex.RLock()
+	defer wh.wlidsToContainerToImageIDMapMutex.RUnlock()
+
+	changed := make(WlidsToContainerToImageIDMap)
+	for wlid, containers := range wh.wlidsToContainerToImageIDMap {
+		checkpointed := wh.checkpointed[wlid]
+		for container, imageID := range containers {
+			if checkpointed[container] != imageID {
+				changed[wlid] = containers
+				break
+			}
+		}
+	}
+	return changed
+}
@@ -0,0 +1,178 @@
+package watcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCheckpointStores(t *testing.T) {
+	checkpoint := Checkpoint{
+		WlidsToContainerToImageID: WlidsToContainerToImageIDMap{"wlid://cluster-/namespace-default/deployment-nginx": {"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"}},
+		ImageHashToWlids:          map[string][]string{"nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240": {"wlid://cluster-/namespace-default/deployment-nginx"}},
+		InstanceIDs:               []string{"instance-id"},
+	}
+
+	tt := []struct {
+		name  string
+		store func(t *testing.T) CheckpointStore
+	}{
+		{
+			name: "file",
+			store: func(t *testing.T) CheckpointStore {
+				return NewFileCheckpointStore(filepath.Join(t.TempDir(), "checkpoint.json"))
+			},
+		},
+		{
+			name: "ConfigMap",
+			store: func(t *testing.T) CheckpointStore {
+				return NewConfigMapCheckpointStore(k8sfake.NewSimpleClientset(), "kubescape", "operator-checkpoint")
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.TODO()
+			store := tc.store(t)
+
+			loaded, err := store.Load(ctx)
+			assert.NoError(t, err, "a missing checkpoint is no error")
+			assert.Nil(t, loaded)
+
+			assert.NoError(t, store.Save(ctx, Checkpoint{InstanceIDs: []string{"previous"}}))
+			// the previous checkpoint is replaced
+			assert.NoError(t, store.Save(ctx, checkpoint))
+			loaded, err = store.Load(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, &checkpoint, loaded)
+		})
+	}
+}
+
+func TestFileCheckpointStoreMalformed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	assert.NoError(t, os.WriteFile(path, []byte("{"), 0o600))
+
+	_, err := NewFileCheckpointStore(path).Load(context.TODO())
+	assert.Error(t, err)
+}
+
+// memoryCheckpointStore keeps a checkpoint in memory
+type memoryCheckpointStore struct {
+	checkpoint *Checkpoint
+	err        error
+	mu         sync.Mutex
+}
+
+func (s *memoryCheckpointStore) Load(_ context.Context) (*Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.checkpoint, s.err
+}
+
+func (s *memoryCheckpointStore) Save(_ context.Context, checkpoint Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.checkpoint = &checkpoint
+	return nil
+}
+
+func TestWithCheckpoint(t *testing.T) {
+	unchangedWlid := "wlid://cluster-/namespace-default/pod-unchanged"
+	updatedWlid := "wlid://cluster-/namespace-default/pod-updated"
+	newWlid := "wlid://cluster-/namespace-default/pod-new"
+	deletedWlid := "wlid://cluster-/namespace-default/pod-deleted"
+	checkpoint := &Checkpoint{
+		WlidsToContainerToImageID: WlidsToContainerToImageIDMap{
+			unchangedWlid: {"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"},
+			updatedWlid:   {"redis": "redis@sha256:328695eff5583aa7bc95f9dd456106461d588df5bffc296107964fe27ee0e083"},
+			deletedWlid:   {"mysql": "mysql@sha256:14b109bb94e7bf0b06007d3d8ac4547a665eeff2973d2547dd934fcc3a6b15e9"},
+		},
+		ImageHashToWlids: map[string][]string{
+			"nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240": {unchangedWlid},
+			"redis@sha256:328695eff5583aa7bc95f9dd456106461d588df5bffc296107964fe27ee0e083": {updatedWlid},
+			"mysql@sha256:14b109bb94e7bf0b06007d3d8ac4547a665eeff2973d2547dd934fcc3a6b15e9": {deletedWlid},
+		},
+		InstanceIDs: []string{"deleted-instance-id"},
+	}
+
+	k8sAPI, _ := newK8sAPIFake(
+		newRunningPodFake("default", "unchanged", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"}),
+		newRunningPodFake("default", "updated", map[string]string{"redis": "redis@sha256:fb65e6bddd69e47c37aeb0ee4870a366ab82df135c3324a3a74b89c555e7d94b"}),
+		newRunningPodFake("default", "new", map[string]string{"busybox": "busybox@sha256:22a1f96cbccbde731c101c7b6d6acb307af7e35957a2ea374b8e75f0e6d93620"}),
+	)
+
+	tt := []struct {
+		name            string
+		store           *memoryCheckpointStore
+		expectedChanged []string
+		expectedSeeded  bool
+	}{
+		{
+			name:            "checkpoint",
+			store:           &memoryCheckpointStore{checkpoint: checkpoint},
+			expectedChanged: []string{updatedWlid, newWlid},
+			expectedSeeded:  true,
+		},
+		{
+			name:            "no checkpoint",
+			store:           &memoryCheckpointStore{},
+			expectedChanged: []string{unchangedWlid, updatedWlid, newWlid},
+		},
+		{
+			name:            "checkpoint failing to load",
+			store:           &memoryCheckpointStore{checkpoint: checkpoint, err: os.ErrPermission},
+			expectedChanged: []string{unchangedWlid, updatedWlid, newWlid},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			wh, err := NewWatchHandler(k8sAPI, kssfake.NewSimpleClientset(), nil, nil, WithCheckpoint(tc.store, time.Hour))
+			assert.NoError(t, err)
+			assert.NoError(t, wh.Start(ctx))
+
+			changed := []string{}
+			for wlid := range wh.GetWlidsChangedSinceCheckpoint() {
+				changed = append(changed, wlid)
+			}
+			assert.ElementsMatch(t, tc.expectedChanged, changed, "only the workloads that changed since the checkpoint should be scanned")
+
+			// the objects of the checkpointed workloads are kept until the next cleanUp
+			assert.Equal(t, tc.expectedSeeded, wh.isImageIDTracked("mysql@sha256:14b109bb94e7bf0b06007d3d8ac4547a665eeff2973d2547dd934fcc3a6b15e9"))
+			assert.Equal(t, tc.expectedSeeded, wh.hasInstanceID("deleted-instance-id"))
+
+			saved := wh.checkpoint()
+			assert.Len(t, saved.WlidsToContainerToImageID, 3)
+			assert.Equal(t, map[string]string{"redis": "redis@sha256:fb65e6bddd69e47c37aeb0ee4870a366ab82df135c3324a3a74b89c555e7d94b"}, saved.WlidsToContainerToImageID[updatedWlid])
+		})
+	}
+}
+
+func TestCheckpointRoutine(t *testing.T) {
+	store := &memoryCheckpointStore{}
+	wh := NewWatchHandlerMock()
+	WithCheckpoint(store, 10*time.Millisecond)(wh)
+	wh.addToWlidsToContainerToImageIDMap("wlid://cluster-/namespace-default/pod-nginx", "nginx", "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wh.startCheckpointRoutine(ctx)
+
+	assert.Eventually(t, func() bool {
+		saved, _ := store.Load(ctx)
+		return saved != nil && len(saved.WlidsToContainerToImageID) == 1
+	}, time.Second, 10*time.Millisecond, "the internal maps should be checkpointed periodically")
+}
@@ -0,0 +1,38 @@
+package watcher
+
+import "time"
+
+// clock returns the current time
+//
+// The WatchHandler and the trackers it owns share a single clock, time.Now
+// unless another one is set by WithClock, e.g. a fake clock in tests. The
+// trackers created on their own use time.Now.
+type clock func() time.Time
+
+// useClock makes the WatchHandler and the trackers it owns read the time from the given clock, see WithClock
+//
+// It must be called before the WatchHandler is started.
+func (wh *WatchHandler) useClock(now clock) {
+	wh.clock = now
+	if wh.settling != nil {
+		wh.settling.now = now
+	}
+	if wh.health != nil {
+		wh.health.now = now
+	}
+	if wh.podWatchdog != nil {
+		wh.podWatchdog.now = now
+	}
+	if wh.parents != nil {
+		wh.parents.now = now
+	}
+	if wh.deletionBursts != nil {
+		wh.deletionBursts.now = now
+	}
+	if wh.pendingDeletions != nil {
+		wh.pendingDeletions.now = now
+	}
+	if wh.deletionRetries != nil {
+		wh.deletionRetries.now = now
+	}
+}
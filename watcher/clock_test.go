@@ -0,0 +1,30 @@
+package watcher
+
+import (
+	"testing"
+	"time"
+
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithClock(t *testing.T) {
+	fakeNow := time.Date(2023, time.June, 26, 12, 0, 0, 0, time.UTC)
+	k8sAPI, _ := newK8sAPIFake()
+	wh, err := NewWatchHandler(k8sAPI, kssfake.NewSimpleClientset(), nil, nil,
+		WithDeletionBurstCleanUp(10, time.Minute),
+		WithDeletionGracePeriod(time.Minute),
+		WithClock(func() time.Time { return fakeNow }))
+	assert.NoError(t, err)
+
+	// the trackers set by the options before WithClock share it too
+	assert.Equal(t, fakeNow, wh.clock())
+	assert.Equal(t, fakeNow, wh.settling.now())
+	assert.Equal(t, fakeNow, wh.health.now())
+	assert.Equal(t, fakeNow, wh.podWatchdog.now())
+	assert.Equal(t, fakeNow, wh.parents.now())
+	assert.Equal(t, fakeNow, wh.deletionBursts.now())
+	assert.Equal(t, fakeNow, wh.pendingDeletions.now())
+	assert.Equal(t, fakeNow, wh.deletionRetries.now())
+	assert.Equal(t, fakeNow, wh.newWatchBackoff(PodWatcherName).now())
+}
@@ -0,0 +1,257 @@
+package watcher
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	"github.com/kubescape/k8s-interface/workloadinterface"
+	core1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// completedJobPod is a tracked completed Pod of a Job
+type completedJobPod struct {
+	pod         *core1.Pod // running view of the Pod, as tracked
+	parentKind  string
+	parentName  string
+	completedAt time.Time
+}
+
+// completedJobPods retains the tracked completed Pods of Jobs until they leave the window set to track them
+//
+// Jobs are usually cleaned up along with their Pods soon after they complete,
+// e.g. by a TTL or the history limit of their CronJob. The retained Pods are
+// tracked again whenever the internal maps are rebuilt, so that their images
+// are not considered orphaned while they are in the window, even once their
+// Pods are gone.
+type completedJobPods struct {
+	pods map[types.UID]completedJobPod
+	mu   sync.Mutex
+}
+
+// Track retains a completed Pod of a Job
+func (c *completedJobPods) Track(pod *core1.Pod, parent workloadinterface.IWorkload, completedAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pods == nil {
+		c.pods = make(map[types.UID]completedJobPod)
+	}
+	c.pods[pod.UID] = completedJobPod{pod: pod, parentKind: parent.GetKind(), parentName: parent.GetName(), completedAt: completedAt}
+}
+
+// Has returns true if the Pod is retained
+func (c *completedJobPods) Has(uid types.UID) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.pods[uid]
+	return ok
+}
+
+// Expire forgets the Pods completed before the given time and returns the remaining ones
+func (c *completedJobPods) Expire(completedBefore time.Time) []completedJobPod {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	remaining := make([]completedJobPod, 0, len(c.pods))
+	for uid, retained := range c.pods {
+		if retained.completedAt.Before(completedBefore) {
+			delete(c.pods, uid)
+			continue
+		}
+		remaining = append(remaining, retained)
+	}
+	return remaining
+}
+
+// recentJobPodCompletion returns when a completed Pod of a Job completed, false
+// if the Pod is not a completed Pod of a Job or completed outside of the window
+// set to track them
+//
+// Failed Pods are only considered if tracking them is enabled.
+func (wh *WatchHandler) recentJobPodCompletion(pod *core1.Pod) (time.Time, bool) {
+	if wh.completedJobPodsWindow <= 0 {
+		return time.Time{}, false
+	}
+
+	switch pod.Status.Phase {
+	case core1.PodSucceeded:
+	case core1.PodFailed:
+		if !wh.trackFailedJobPods {
+			return time.Time{}, false
+		}
+	default:
+		return time.Time{}, false
+	}
+
+	if !isOwnedByJob(pod) {
+		return time.Time{}, false
+	}
+
+	completedAt, ok := podCompletion(pod)
+	if !ok || time.Since(completedAt) > wh.completedJobPodsWindow {
+		return time.Time{}, false
+	}
+	return completedAt, true
+}
+
+// isOwnedByJob returns true if the owner of the Pod is a Job
+func isOwnedByJob(pod *core1.Pod) bool {
+	ownerReferences := pod.GetOwnerReferences()
+	return len(ownerReferences) > 0 && ownerReferences[0].Kind == "Job"
+}
+
+// podCompletion returns when the last container of a Pod terminated, false if none did
+func podCompletion(pod *core1.Pod) (time.Time, bool) {
+	var completedAt time.Time
+	for i := range pod.Status.ContainerStatuses {
+		if terminated := pod.Status.ContainerStatuses[i].State.Terminated; terminated != nil && terminated.FinishedAt.Time.After(completedAt) {
+			completedAt = terminated.FinishedAt.Time
+		}
+	}
+	return completedAt, !completedAt.IsZero()
+}
+
+// runningViewOfCompletedPod returns a copy of a completed Pod reported running along with its containers that ran
+//
+// The images the containers ran are then extracted like those of running Pods.
+func runningViewOfCompletedPod(pod *core1.Pod) *core1.Pod {
+	view := pod.DeepCopy()
+	view.Status.Phase = core1.PodRunning
+	for _, statuses := range [][]core1.ContainerStatus{view.Status.ContainerStatuses, view.Status.EphemeralContainerStatuses} {
+		for i := range statuses {
+			if terminated := statuses[i].State.Terminated; terminated != nil && statuses[i].ImageID != "" {
+				statuses[i].State = core1.ContainerState{Running: &core1.ContainerStateRunning{StartedAt: terminated.StartedAt}}
+			}
+		}
+	}
+	return view
+}
+
+// retainParent caches the parent of a retained Pod again, as its Job may be gone by the time the Pod is tracked again
+func (wh *WatchHandler) retainParent(retained completedJobPod) {
+	ownerReferences := retained.pod.OwnerReferences
+	if len(ownerReferences) == 0 || ownerReferences[0].UID == "" {
+		return
+	}
+	key := parentCacheKey{namespace: retained.pod.Namespace, ownerUID: ownerReferences[0].UID}
+	wh.parents.Add(key, retained.parentKind, retained.parentName)
+}
+
+// succeededJobPods holds the succeeded Pods of Jobs scanned once, see scanSucceededJobPod
+//
+// Pods are forgotten once they are deleted, or once they are not listed when
+// the internal maps are rebuilt.
+type succeededJobPods struct {
+	uids map[types.UID]struct{}
+	mu   sync.Mutex
+}
+
+// Add adds a Pod, returning false if it was added already
+func (s *succeededJobPods) Add(uid types.UID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.uids[uid]; ok {
+		return false
+	}
+	if s.uids == nil {
+		s.uids = make(map[types.UID]struct{})
+	}
+	s.uids[uid] = struct{}{}
+	return true
+}
+
+// Forget forgets a Pod
+func (s *succeededJobPods) Forget(uid types.UID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.uids, uid)
+}
+
+// Retain forgets all the Pods except the given ones
+func (s *succeededJobPods) Retain(uids map[types.UID]struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for uid := range s.uids {
+		if _, ok := uids[uid]; !ok {
+			delete(s.uids, uid)
+		}
+	}
+}
+
+// Len returns the number of Pods
+func (s *succeededJobPods) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.uids)
+}
+
+// scanSucceededJobPod triggers a single scan of the new images of a succeeded Pod of a Job, returning false if the event is not about one
+//
+// Short Jobs, or those completing while the operator is down, may only ever
+// be seen once their Pods succeeded, so their images would never be scanned.
+// Their images are tracked until the internal maps are rebuilt, so that their
+// SBOMs are not deleted right after the scan, but the Pods are not tracked in
+// wlidsToContainerToImageIDMap as live workloads, so that the Pods spawned by
+// CronJobs do not accumulate in it. Pods that ran while watched are scanned
+// already, and recently completed ones are tracked as if they were still
+// running if a window is set, see recentJobPodCompletion.
+func (wh *WatchHandler) scanSucceededJobPod(ctx context.Context, event watch.Event, commands *commandDeduper) bool {
+	pod, ok := event.Object.(*core1.Pod)
+	if !ok || event.Type != watch.Modified || pod.Status.Phase != core1.PodSucceeded || !isOwnedByJob(pod) {
+		return false
+	}
+	if _, completed := wh.recentJobPodCompletion(pod); completed {
+		return false
+	}
+
+	if pod.GetDeletionTimestamp() != nil || wh.podImageIDs.Has(pod.UID) {
+		return true
+	}
+	if wh.excludedNamespaces.Excludes(pod.Namespace) || !wh.podFilters.Admits(pod) {
+		return true
+	}
+
+	view := runningViewOfCompletedPod(pod)
+	view.APIVersion = "v1"
+	view.Kind = "Pod"
+	parent, parentWlid, err := wh.getParentForPod(view)
+	if err != nil {
+		logger.L().Ctx(ctx).Error("Failed to get parent ID for pod", helpers.String("pod", pod.Name), helpers.String("namespace", pod.Namespace), helpers.Error(err))
+		return true
+	}
+	if !wh.workloadKinds.Admits(workloadKind(parent)) || wh.skipsImageScan(ctx, parentWlid, view) {
+		return true
+	}
+
+	if !wh.succeededJobPods.Add(pod.UID) {
+		return true
+	}
+	// images tracked already are scanned already, while images without a
+	// digest are not tracked, so they are scanned once per Pod
+	newContainersToImageIDs := make(map[string]string)
+	for container, imgID := range wh.getContainersToImageIDsFromPod(view) {
+		if _, err := extractImageHash(imgID); err != nil {
+			newContainersToImageIDs[container] = imgID
+		} else if !wh.iwMap.HasDigest(imgID) {
+			newContainersToImageIDs[container] = imgID
+			wh.addToImageIDToWlidsMap(imgID, parentWlid)
+		}
+	}
+	if len(newContainersToImageIDs) == 0 {
+		return true
+	}
+
+	logger.L().Ctx(ctx).Debug("scanning succeeded job pod once", helpers.String("pod", pod.Name), helpers.String("namespace", pod.Namespace), helpers.String("wlid", parentWlid))
+	commands.Submit(getImageScanCommand(parentWlid, newContainersToImageIDs))
+	return true
+}
@@ -0,0 +1,240 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	instanceidhandlerv1 "github.com/kubescape/k8s-interface/instanceidhandler/v1"
+	"github.com/kubescape/operator/utils"
+	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	batchv1 "k8s.io/api/batch/v1"
+	core1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestRecentJobPodCompletion(t *testing.T) {
+	now := time.Now()
+
+	tt := []struct {
+		name               string
+		window             time.Duration
+		trackFailedJobPods bool
+		opts               []podFakeOption
+		expected           bool
+	}{
+		{
+			name:     "Disabled",
+			opts:     []podFakeOption{withJobOwner("backup"), withCompletion(core1.PodSucceeded, now)},
+			expected: false,
+		},
+		{
+			name:     "Recently succeeded Pod of a Job",
+			window:   time.Hour,
+			opts:     []podFakeOption{withJobOwner("backup"), withCompletion(core1.PodSucceeded, now.Add(-time.Minute))},
+			expected: true,
+		},
+		{
+			name:     "Pod of a Job succeeded outside of the window",
+			window:   time.Hour,
+			opts:     []podFakeOption{withJobOwner("backup"), withCompletion(core1.PodSucceeded, now.Add(-2*time.Hour))},
+			expected: false,
+		},
+		{
+			name:     "Failed Pod of a Job",
+			window:   time.Hour,
+			opts:     []podFakeOption{withJobOwner("backup"), withCompletion(core1.PodFailed, now)},
+			expected: false,
+		},
+		{
+			name:               "Failed Pod of a Job with failed Pods tracked",
+			window:             time.Hour,
+			trackFailedJobPods: true,
+			opts:               []podFakeOption{withJobOwner("backup"), withCompletion(core1.PodFailed, now)},
+			expected:           true,
+		},
+		{
+			name:     "Running Pod of a Job",
+			window:   time.Hour,
+			opts:     []podFakeOption{withJobOwner("backup")},
+			expected: false,
+		},
+		{
+			name:     "Succeeded Pod without a Job",
+			window:   time.Hour,
+			opts:     []podFakeOption{withCompletion(core1.PodSucceeded, now)},
+			expected: false,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			wh := NewWatchHandlerMock()
+			wh.completedJobPodsWindow = tc.window
+			wh.trackFailedJobPods = tc.trackFailedJobPods
+
+			pod := newRunningPodFake("default", "backup", backupImageIDs, append([]podFakeOption{withUID("backup")}, tc.opts...)...)
+			_, completed := wh.recentJobPodCompletion(pod)
+			assert.Equal(t, tc.expected, completed)
+		})
+	}
+}
+
+func TestRunningViewOfCompletedPod(t *testing.T) {
+	pod := newRunningPodFake("default", "backup", backupImageIDs, withUID("backup"), withJobOwner("backup"), withCompletion(core1.PodSucceeded, time.Now()))
+	pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, core1.ContainerStatus{
+		Name:  "never-started",
+		State: core1.ContainerState{Terminated: &core1.ContainerStateTerminated{}},
+	})
+
+	view := runningViewOfCompletedPod(pod)
+
+	assert.Equal(t, core1.PodRunning, view.Status.Phase)
+	assert.Equal(t, map[string]string{"backup": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"}, utils.ExtractContainersToImageIDsFromPod(view))
+	assert.Equal(t, core1.PodSucceeded, pod.Status.Phase, "the Pod should not be mutated")
+	assert.Empty(t, utils.ExtractContainersToImageIDsFromPod(pod))
+}
+
+func TestCompletedJobPods(t *testing.T) {
+	ctx := context.TODO()
+	wlid := "wlid://cluster-/namespace-default/cronjob-backup"
+	cronJob := &batchv1.CronJob{
+		TypeMeta:   v1.TypeMeta{Kind: "CronJob", APIVersion: "batch/v1"},
+		ObjectMeta: v1.ObjectMeta{Name: "backup", Namespace: "default"},
+	}
+	job := newJobFake("default", "backup-28000000", "backup")
+	oldJob := newJobFake("default", "backup-27990000", "backup")
+
+	// a Pod completed before the window was set up and a Pod completed within it
+	oldPod := newRunningPodFake("default", "backup-27990000-abcde", backupImageIDs, withUID("backup-27990000-abcde"), withJobOwner(oldJob.Name), withCompletion(core1.PodSucceeded, time.Now().Add(-2*time.Hour)))
+	oldPod.Status.ContainerStatuses[0].ImageID = "alpine@sha256:3277dade1f848e398bb61a345af27934d51f38314f90278b1be84bdffd4fab2e"
+	pod := newRunningPodFake("default", "backup-28000000-abcde", backupImageIDs, withUID("backup-28000000-abcde"), withJobOwner(job.Name), withCompletion(core1.PodSucceeded, time.Now().Add(-time.Minute)))
+
+	storageClient := kssfake.NewSimpleClientset(
+		&spdxv1beta1.SBOMSummary{ObjectMeta: v1.ObjectMeta{Name: "alpine", Labels: managedLabels(), Annotations: map[string]string{instanceidhandlerv1.ImageIDMetadataKey: "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"}}},
+	)
+	k8sAPI, _ := newK8sAPIFake(cronJob, job, oldJob, oldPod, pod)
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	wh.storageClient = storageClient
+	wh.parents = newParentCache(5*time.Minute, parentCacheSize)
+	wh.completedJobPodsWindow = time.Hour
+
+	assert.NoError(t, wh.buildIDs(ctx, podListIterator(&core1.PodList{Items: []core1.Pod{*oldPod, *pod}})))
+	assert.Equal(t, []string{wlid}, wh.GetWlidsForImageHash("alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"))
+	assert.Empty(t, wh.GetWlidsForImageHash("alpine@sha256:3277dade1f848e398bb61a345af27934d51f38314f90278b1be84bdffd4fab2e"), "Pods completed outside of the window should not be tracked")
+
+	// a Pod of the next run completes before the watcher saw it running
+	nextJob := newJobFake("default", "backup-28001440", "backup")
+	nextPod := newRunningPodFake("default", "backup-28001440-abcde", backupImageIDs, withUID("backup-28001440-abcde"), withJobOwner(nextJob.Name), withCompletion(core1.PodSucceeded, time.Now()))
+	nextPod.Status.ContainerStatuses[0].ImageID = "alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb"
+	// the API no longer serves the Pods, deleted by the end of the watch
+	wh.k8sAPI, _ = newK8sAPIFake(cronJob, job, nextJob)
+
+	recorder := &commandRecorder{}
+	podsWatch := watch.NewFake()
+	done := make(chan struct{})
+	go func() {
+		wh.handlePodWatcher(ctx, podsWatch, newCommandDeduper(0, recorder.emit))
+		close(done)
+	}()
+	podsWatch.Modify(nextPod)
+	// the Pods are garbage-collected along with their Jobs
+	podsWatch.Delete(pod)
+	podsWatch.Delete(nextPod)
+	podsWatch.Stop()
+	<-done
+
+	emitted := recorder.emitted()
+	if assert.Len(t, emitted, 1) {
+		assert.Equal(t, wlid, emitted[0].Wlid)
+		assert.Equal(t, map[string]string{"backup": "alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb"}, emitted[0].Args[utils.ContainerToImageIdsArg])
+	}
+	assert.Equal(t, []string{wlid}, wh.GetWlidsForImageHash("alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"), "deleted Pods in the window should stay tracked")
+	assert.Equal(t, []string{wlid}, wh.GetWlidsForImageHash("alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb"))
+
+	// cleanUp does not consider the images of the deleted Pods orphaned
+	wh.k8sAPI, _ = newK8sAPIFake(cronJob)
+	wh.cleanUp(ctx)
+
+	assert.Equal(t, []string{wlid}, wh.GetWlidsForImageHash("alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"))
+	assert.Equal(t, []string{wlid}, wh.GetWlidsForImageHash("alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb"))
+	summaries, err := storageClient.SpdxV1beta1().SBOMSummaries("").List(ctx, v1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, summaries.Items, 1, "the SBOMs of Pods in the window should not be garbage-collected")
+
+	// once out of the window, they are
+	wh.completedJobPodsWindow = time.Nanosecond
+	wh.cleanUp(ctx)
+
+	assert.Empty(t, wh.GetWlidsForImageHash("alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"))
+	assert.Empty(t, wh.GetWlidsForImageHash("alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb"))
+	assert.False(t, wh.completedJobPods.Has(pod.UID))
+}
+
+func TestScanSucceededJobPods(t *testing.T) {
+	ctx := context.TODO()
+	wlid := "wlid://cluster-/namespace-default/cronjob-backup"
+	cronJob := &batchv1.CronJob{
+		TypeMeta:   v1.TypeMeta{Kind: "CronJob", APIVersion: "batch/v1"},
+		ObjectMeta: v1.ObjectMeta{Name: "backup", Namespace: "default"},
+	}
+	job := newJobFake("default", "backup-28000000", "backup")
+	nextJob := newJobFake("default", "backup-28001440", "backup")
+	// the Pods of both runs are only ever seen once they succeeded
+	pod := newRunningPodFake("default", "backup-28000000-abcde", backupImageIDs, withUID("backup-28000000-abcde"), withJobOwner(job.Name), withCompletion(core1.PodSucceeded, time.Now()))
+	nextPod := newRunningPodFake("default", "backup-28001440-abcde", backupImageIDs, withUID("backup-28001440-abcde"), withJobOwner(nextJob.Name), withCompletion(core1.PodSucceeded, time.Now()))
+	failedPod := newRunningPodFake("default", "backup-28001440-fghij", backupImageIDs, withUID("backup-28001440-fghij"), withJobOwner(nextJob.Name), withCompletion(core1.PodFailed, time.Now()))
+	failedPod.Status.ContainerStatuses[0].ImageID = "alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb"
+
+	k8sAPI, _ := newK8sAPIFake(cronJob, job, nextJob)
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	wh.storageClient = kssfake.NewSimpleClientset()
+	wh.parents = newParentCache(5*time.Minute, parentCacheSize)
+
+	recorder := &commandRecorder{}
+	podsWatch := watch.NewFake()
+	done := make(chan struct{})
+	go func() {
+		wh.handlePodWatcher(ctx, podsWatch, newCommandDeduper(0, recorder.emit))
+		close(done)
+	}()
+	podsWatch.Modify(pod)
+	// e.g. the Pod is updated once done
+	podsWatch.Modify(pod)
+	podsWatch.Modify(nextPod)
+	podsWatch.Modify(failedPod)
+	podsWatch.Stop()
+	<-done
+
+	emitted := recorder.emitted()
+	if assert.Len(t, emitted, 1, "the images of succeeded Pods of Jobs should be scanned once") {
+		assert.Equal(t, wlid, emitted[0].Wlid)
+		assert.Equal(t, map[string]string{"backup": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"}, emitted[0].Args[utils.ContainerToImageIdsArg])
+	}
+	assert.Equal(t, []string{wlid}, wh.GetWlidsForImageHash("alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"), "the scanned images should stay tracked until the maps are rebuilt")
+	assert.Empty(t, wh.GetWlidsForImageHash("alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb"), "failed Pods of Jobs should not be scanned")
+	assert.Empty(t, wh.GetContainerToImageIDForWlid(wlid), "succeeded Pods of Jobs should not be tracked as live workloads")
+	assert.Equal(t, 2, wh.succeededJobPods.Len())
+
+	// the Pods are forgotten once deleted or no longer listed
+	podsWatch = watch.NewFake()
+	done = make(chan struct{})
+	go func() {
+		wh.handlePodWatcher(ctx, podsWatch, newCommandDeduper(0, recorder.emit))
+		close(done)
+	}()
+	podsWatch.Delete(pod)
+	podsWatch.Stop()
+	<-done
+	assert.Equal(t, 1, wh.succeededJobPods.Len())
+
+	wh.k8sAPI, _ = newK8sAPIFake(cronJob)
+	wh.cleanUp(ctx)
+	assert.Equal(t, 0, wh.succeededJobPods.Len())
+	assert.Empty(t, wh.GetWlidsForImageHash("alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"))
+}
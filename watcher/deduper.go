@@ -0,0 +1,100 @@
+package watcher
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armosec/armoapi-go/apis"
+	"github.com/kubescape/operator/utils"
+)
+
+// commandDeduper coalesces scan commands for the same WLID and images issued within a time window
+//
+// The first command for a key is emitted immediately, so commands for new
+// images are never delayed. Duplicates that arrive within the window are
+// held back and only the latest one is emitted once the window passes. A
+// window of zero disables deduplication.
+type commandDeduper struct {
+	window  time.Duration
+	emit    func(cmd *apis.Command)
+	pending map[string]*pendingCommand
+	mu      sync.Mutex
+}
+
+// pendingCommand is the state of a key within its deduplication window
+type pendingCommand struct {
+	// latest is the latest duplicate received within the window, nil if none
+	latest *apis.Command
+	// emit emits latest
+	emit func(cmd *apis.Command)
+}
+
+func newCommandDeduper(window time.Duration, emit func(cmd *apis.Command)) *commandDeduper {
+	return &commandDeduper{
+		window:  window,
+		emit:    emit,
+		pending: make(map[string]*pendingCommand),
+	}
+}
+
+// Submit emits the command immediately if no command with the same key was emitted within the window, or holds it back otherwise
+func (d *commandDeduper) Submit(cmd *apis.Command) {
+	d.SubmitWith(cmd, d.emit)
+}
+
+// SubmitWith is like Submit, but emits the command with the given function rather than the one of the deduper
+//
+// Commands of several watchers are deduplicated together while each is sent
+// on behalf of the watcher that submitted it, see StartSBOMWatchers.
+func (d *commandDeduper) SubmitWith(cmd *apis.Command, emit func(cmd *apis.Command)) {
+	if d.window <= 0 {
+		emit(cmd)
+		return
+	}
+
+	key := commandDedupKey(cmd)
+
+	d.mu.Lock()
+	if p, ok := d.pending[key]; ok {
+		p.latest = cmd
+		p.emit = emit
+		d.mu.Unlock()
+		return
+	}
+	d.pending[key] = &pendingCommand{}
+	d.mu.Unlock()
+
+	time.AfterFunc(d.window, func() { d.flush(key) })
+	emit(cmd)
+}
+
+// flush ends the window of a key and emits the latest held back command, if any
+func (d *commandDeduper) flush(key string) {
+	d.mu.Lock()
+	p := d.pending[key]
+	delete(d.pending, key)
+	d.mu.Unlock()
+
+	if p != nil && p.latest != nil {
+		p.emit(p.latest)
+	}
+}
+
+// commandDedupKey returns the key identifying duplicate commands: the WLID, the scan scope and the sorted image IDs of the command
+//
+// Commands of different scopes are no duplicates, so that a relevancy scan is
+// never coalesced into a vulnerability scan of the same images.
+func commandDedupKey(cmd *apis.Command) string {
+	imageIDs := []string{}
+	if containerToImageIDs, ok := cmd.Args[utils.ContainerToImageIdsArg].(map[string]string); ok {
+		for _, imageID := range containerToImageIDs {
+			imageIDs = append(imageIDs, imageID)
+		}
+	}
+	sort.Strings(imageIDs)
+
+	scope, _ := cmd.Args[utils.ScanScopeArg].(string)
+	return cmd.Wlid + "|" + scope + "|" + strings.Join(imageIDs, ",")
+}
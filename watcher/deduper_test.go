@@ -0,0 +1,133 @@
+package watcher
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/armosec/armoapi-go/apis"
+	"github.com/kubescape/operator/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// commandRecorder records the commands emitted by a commandDeduper
+type commandRecorder struct {
+	commands []*apis.Command
+	mu       sync.Mutex
+}
+
+func (r *commandRecorder) emit(cmd *apis.Command) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commands = append(r.commands, cmd)
+}
+
+// Send records the command, so the recorder can be used as a command sink
+func (r *commandRecorder) Send(_ context.Context, cmd *apis.Command) error {
+	r.emit(cmd)
+	return nil
+}
+
+func (r *commandRecorder) emitted() []*apis.Command {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*apis.Command{}, r.commands...)
+}
+
+func TestCommandDeduper(t *testing.T) {
+	window := 100 * time.Millisecond
+	first := getImageScanCommand("wlid://deployment-nginx", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"})
+	duplicate := getImageScanCommand("wlid://deployment-nginx", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"})
+	latest := getImageScanCommand("wlid://deployment-nginx", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"})
+	newImage := getImageScanCommand("wlid://deployment-nginx", map[string]string{"nginx": "nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432"})
+
+	recorder := &commandRecorder{}
+	deduper := newCommandDeduper(window, recorder.emit)
+
+	deduper.Submit(first)
+	deduper.Submit(duplicate)
+	deduper.Submit(latest)
+	deduper.Submit(newImage)
+
+	// the first command and the command of a new image pass through immediately
+	assert.Equal(t, []*apis.Command{first, newImage}, recorder.emitted())
+
+	// only the latest duplicate is emitted once the window passes
+	assert.Eventually(t, func() bool { return len(recorder.emitted()) == 3 }, time.Second, 10*time.Millisecond)
+	time.Sleep(2 * window)
+	emitted := recorder.emitted()
+	assert.Len(t, emitted, 3)
+	assert.Same(t, latest, emitted[2])
+
+	// commands after the window pass through immediately again
+	deduper.Submit(duplicate)
+	assert.Len(t, recorder.emitted(), 4)
+}
+
+func TestCommandDeduperDisabled(t *testing.T) {
+	cmd := getImageScanCommand("wlid://deployment-nginx", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"})
+
+	recorder := &commandRecorder{}
+	deduper := newCommandDeduper(0, recorder.emit)
+	deduper.Submit(cmd)
+	deduper.Submit(cmd)
+
+	assert.Len(t, recorder.emitted(), 2)
+}
+
+func TestCommandDeduperSubmitWith(t *testing.T) {
+	window := 50 * time.Millisecond
+	first := getImageScanCommand("wlid://deployment-nginx", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"})
+	duplicate := getImageScanCommand("wlid://deployment-nginx", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"})
+
+	summaries, filtereds := &commandRecorder{}, &commandRecorder{}
+	deduper := newCommandDeduper(window, nil)
+	deduper.SubmitWith(first, summaries.emit)
+	deduper.SubmitWith(duplicate, filtereds.emit)
+
+	// duplicates are coalesced across submitters, and emitted by the one of the latest
+	assert.Equal(t, []*apis.Command{first}, summaries.emitted())
+	assert.Eventually(t, func() bool { return len(filtereds.emitted()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Same(t, duplicate, filtereds.emitted()[0])
+	assert.Len(t, summaries.emitted(), 1)
+}
+
+func Test_commandDedupKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		a        *apis.Command
+		b        *apis.Command
+		expected bool
+	}{
+		{
+			name:     "same WLID and images regardless of the containers order",
+			a:        getImageScanCommand("wlid1", map[string]string{"a": "image1", "b": "image2"}),
+			b:        getImageScanCommand("wlid1", map[string]string{"b": "image2", "a": "image1"}),
+			expected: true,
+		},
+		{
+			name:     "different WLIDs",
+			a:        getImageScanCommand("wlid1", map[string]string{"a": "image1"}),
+			b:        getImageScanCommand("wlid2", map[string]string{"a": "image1"}),
+			expected: false,
+		},
+		{
+			name:     "different images",
+			a:        getImageScanCommand("wlid1", map[string]string{"a": "image1"}),
+			b:        getImageScanCommand("wlid1", map[string]string{"a": "image2"}),
+			expected: false,
+		},
+		{
+			name:     "different scan scopes",
+			a:        getImageScanCommand("wlid1", map[string]string{"a": "image1"}),
+			b:        getScanCommand("wlid1", map[string]string{"a": "image1"}, utils.ScanScopeRelevancy),
+			expected: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, commandDedupKey(tt.a) == commandDedupKey(tt.b))
+		})
+	}
+}
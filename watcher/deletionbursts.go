@@ -0,0 +1,78 @@
+package watcher
+
+import (
+	"sync"
+	"time"
+)
+
+// metricDeletionBurstCleanUpsTotal is the number of cleanUps triggered early by bursts of Pod deletions
+const metricDeletionBurstCleanUpsTotal = "operator_deletion_burst_cleanups_total"
+
+// deletionBursts detects bursts of Pod deletions, e.g. when a namespace is deleted, to trigger a cleanUp early
+//
+// A burst is detected once threshold Pods are deleted within the window. The
+// storage objects of their workloads are then reclaimed right away, rather
+// than lingering until the next periodic cleanUp. Deletions are counted again
+// from zero once a burst is detected.
+//
+// The nil value detects no bursts.
+type deletionBursts struct {
+	threshold int
+	window    time.Duration
+	deletions []time.Time // deletions within the window, oldest first
+	triggered chan struct{}
+	now       clock
+	mu        sync.Mutex
+}
+
+// newDeletionBursts returns a detector of bursts of threshold deletions within the window, nil if either is not positive
+func newDeletionBursts(threshold int, window time.Duration) *deletionBursts {
+	if threshold <= 0 || window <= 0 {
+		return nil
+	}
+	return &deletionBursts{
+		threshold: threshold,
+		window:    window,
+		triggered: make(chan struct{}, 1),
+		now:       time.Now,
+	}
+}
+
+// Deleted records the deletion of a Pod, signaling Triggered if it completes a burst
+func (b *deletionBursts) Deleted() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	recent := b.deletions[:0]
+	for _, deletion := range b.deletions {
+		if now.Sub(deletion) < b.window {
+			recent = append(recent, deletion)
+		}
+	}
+	b.deletions = append(recent, now)
+	if len(b.deletions) < b.threshold {
+		return
+	}
+
+	b.deletions = b.deletions[:0]
+	// a burst already pending is not signaled twice
+	select {
+	case b.triggered <- struct{}{}:
+	default:
+	}
+}
+
+// Triggered returns a channel receiving a value once a burst of deletions is detected
+//
+// The channel is nil, and never receives anything, for the nil value.
+func (b *deletionBursts) Triggered() <-chan struct{} {
+	if b == nil {
+		return nil
+	}
+	return b.triggered
+}
@@ -0,0 +1,81 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// triggered reports whether the bursts of deletions signaled a cleanUp, consuming the signal
+func triggered(b *deletionBursts) bool {
+	select {
+	case <-b.Triggered():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestDeletionBursts(t *testing.T) {
+	now := time.Now()
+	b := newDeletionBursts(3, time.Minute)
+	b.now = func() time.Time { return now }
+
+	b.Deleted()
+	b.Deleted()
+	assert.False(t, triggered(b))
+	b.Deleted()
+	assert.True(t, triggered(b), "threshold deletions within the window should trigger a cleanup")
+
+	// deletions are counted again from zero once a burst is detected
+	b.Deleted()
+	b.Deleted()
+	assert.False(t, triggered(b))
+
+	// deletions leave the window
+	now = now.Add(time.Minute)
+	b.Deleted()
+	b.Deleted()
+	assert.False(t, triggered(b), "deletions spread over more than the window should not trigger a cleanup")
+	b.Deleted()
+	assert.True(t, triggered(b))
+
+	// a pending burst is signaled once
+	for i := 0; i < 6; i++ {
+		b.Deleted()
+	}
+	assert.True(t, triggered(b))
+	assert.False(t, triggered(b))
+
+	assert.Nil(t, newDeletionBursts(0, time.Minute))
+	assert.Nil(t, newDeletionBursts(3, 0))
+	var disabled *deletionBursts
+	disabled.Deleted()
+	assert.Nil(t, disabled.Triggered())
+}
+
+func TestDeletionBurstCleansUpEarly(t *testing.T) {
+	wh := NewWatchHandlerMock()
+	WithDeletionBurstCleanUp(2, time.Minute)(wh)
+	commands := newCommandDeduper(0, (&commandRecorder{}).emit)
+
+	for _, name := range []string{"first", "second"} {
+		pod := newRunningPodFake("default", name, map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"})
+		assert.NoError(t, wh.handlePodEvent(context.TODO(), watch.Event{Type: watch.Deleted, Object: pod}, commands))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wh.waitForCleanUp(context.TODO(), time.Hour)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a burst of pod deletions should trigger a cleanup right away")
+	}
+	assert.Equal(t, int64(1), wh.metrics.Get(metricDeletionBurstCleanUpsTotal))
+}
@@ -0,0 +1,129 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	// orphanedAtLabel labels the orphaned storage objects with the Unix time they were found orphaned at, see DeletionPolicyLabel
+	orphanedAtLabel = "kubescape.io/orphaned-at"
+	// anyKind sets the deletion policy of the kinds without a policy of their own
+	anyKind = "*"
+)
+
+// DeletionPolicy is what the watchers and cleanUp do with the orphaned storage objects of a kind
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyDelete deletes the orphaned objects
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+	// DeletionPolicyRetain only logs the orphaned objects
+	DeletionPolicyRetain DeletionPolicy = "Retain"
+	// DeletionPolicyLabel labels the orphaned objects with orphanedAtLabel, for a later pass or a human to decide. Objects are labeled once
+	DeletionPolicyLabel DeletionPolicy = "Label"
+)
+
+// errOrphanKept is returned to a deletionBatch for the orphaned objects that were retained or labeled rather than deleted
+var errOrphanKept = errors.New("orphaned storage object kept by the deletion policy")
+
+// ParseDeletionPolicy returns the deletion policy of the given name
+func ParseDeletionPolicy(name string) (DeletionPolicy, error) {
+	switch policy := DeletionPolicy(name); policy {
+	case DeletionPolicyDelete, DeletionPolicyRetain, DeletionPolicyLabel:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown deletion policy %q, expected one of %s, %s or %s", name, DeletionPolicyDelete, DeletionPolicyRetain, DeletionPolicyLabel)
+	}
+}
+
+// ParseDeletionPolicies returns the deletion policies of a list of <kind>=<policy> elements, e.g. SBOMSummary=Label
+//
+// Kind * sets the policy of the kinds without a policy of their own.
+func ParseDeletionPolicies(list []string) (map[string]DeletionPolicy, error) {
+	policies := make(map[string]DeletionPolicy, len(list))
+	for _, element := range list {
+		kind, name, ok := strings.Cut(element, "=")
+		kind, name = strings.TrimSpace(kind), strings.TrimSpace(name)
+		if !ok || kind == "" {
+			return nil, fmt.Errorf("invalid deletion policy %q, expected <kind>=<policy>", element)
+		}
+		policy, err := ParseDeletionPolicy(name)
+		if err != nil {
+			return nil, err
+		}
+		policies[kind] = policy
+	}
+	return policies, nil
+}
+
+// orphanObject is an orphaned storage object
+type orphanObject interface {
+	GetName() string
+	GetNamespace() string
+	GetLabels() map[string]string
+}
+
+// deletionPolicy returns the deletion policy of the given kind, DeletionPolicyDelete unless set by WithDeletionPolicies
+func (wh *WatchHandler) deletionPolicy(kind string) DeletionPolicy {
+	if policy, ok := wh.deletionPolicies[kind]; ok {
+		return policy
+	}
+	if policy, ok := wh.deletionPolicies[anyKind]; ok {
+		return policy
+	}
+	return DeletionPolicyDelete
+}
+
+// handleOrphan deletes, retains or labels an orphaned storage object according to the deletion policy of its kind
+//
+// Patch merge-patches the object of the given namespace and name, to label
+// it. Objects that are not found are considered labeled. Objects to delete
+// are only deleted once their grace period is over, see pendingDeletions.
+// Returns true if the object was deleted.
+func (wh *WatchHandler) handleOrphan(ctx context.Context, kind string, obj orphanObject, reason string, deleteFunc func(ctx context.Context) error, patch func(ctx context.Context, namespace, name string, data []byte) error, details ...helpers.IDetails) (bool, error) {
+	namespace, name := obj.GetNamespace(), obj.GetName()
+	switch wh.deletionPolicy(kind) {
+	case DeletionPolicyRetain:
+		logger.L().Ctx(ctx).Info("retaining orphaned storage object", append(deletionDetails(kind, namespace, name, reason), details...)...)
+		return false, nil
+	case DeletionPolicyLabel:
+		if _, ok := obj.GetLabels()[orphanedAtLabel]; ok {
+			return false, nil
+		}
+		if wh.dryRun {
+			logger.L().Ctx(ctx).Info("dry run: would label orphaned storage object", append(deletionDetails(kind, namespace, name, reason), details...)...)
+			return false, nil
+		}
+		logger.L().Ctx(ctx).Debug("labeling orphaned storage object", append(deletionDetails(kind, namespace, name, reason), details...)...)
+		data, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"labels": map[string]string{orphanedAtLabel: strconv.FormatInt(time.Now().Unix(), 10)},
+			},
+		})
+		if err != nil {
+			return false, err
+		}
+		requestCtx, cancel := wh.storageRequestContext(ctx)
+		defer cancel()
+		if err := patch(requestCtx, namespace, name, data); err != nil && !k8serrors.IsNotFound(err) {
+			return false, fmt.Errorf("failed to label %s %s/%s: %w", kind, namespace, name, err)
+		}
+		return false, nil
+	default:
+		if !wh.pendingDeletions.Due(orphanKey(kind, obj)) {
+			logger.L().Ctx(ctx).Debug("not deleting orphaned storage object within its grace period", append(deletionDetails(kind, namespace, name, reason), details...)...)
+			return false, nil
+		}
+		return true, wh.deleteStorageObject(ctx, kind, namespace, name, reason, deleteFunc, details...)
+	}
+}
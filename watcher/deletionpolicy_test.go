@@ -0,0 +1,256 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+
+	instanceidv1 "github.com/kubescape/k8s-interface/instanceidhandler/v1"
+	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// patchActions returns the number of patches sent to the given storage client
+func patchActions(storageClient *kssfake.Clientset) int {
+	patches := 0
+	for _, action := range storageClient.Actions() {
+		if _, ok := action.(k8stesting.PatchAction); ok {
+			patches++
+		}
+	}
+	return patches
+}
+
+func TestParseDeletionPolicies(t *testing.T) {
+	tt := []struct {
+		name        string
+		list        []string
+		expected    map[string]DeletionPolicy
+		expectedErr bool
+	}{
+		{
+			name:     "empty",
+			expected: map[string]DeletionPolicy{},
+		},
+		{
+			name: "per kind and for the other kinds",
+			list: []string{"SBOMSummary=Label", " * = Retain "},
+			expected: map[string]DeletionPolicy{
+				"SBOMSummary": DeletionPolicyLabel,
+				anyKind:       DeletionPolicyRetain,
+			},
+		},
+		{
+			name:        "unknown policy",
+			list:        []string{"SBOMSummary=Archive"},
+			expectedErr: true,
+		},
+		{
+			name:        "missing kind",
+			list:        []string{"Retain"},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			policies, err := ParseDeletionPolicies(tc.list)
+			if tc.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, policies)
+		})
+	}
+}
+
+func TestDeletionPolicyOfKind(t *testing.T) {
+	wh := NewWatchHandlerMock()
+	assert.Equal(t, DeletionPolicyDelete, wh.deletionPolicy(sbomSummaryKind), "kinds should be deleted by default")
+
+	WithDeletionPolicies(map[string]DeletionPolicy{sbomSummaryKind: DeletionPolicyLabel, anyKind: DeletionPolicyRetain})(wh)
+	assert.Equal(t, DeletionPolicyLabel, wh.deletionPolicy(sbomSummaryKind))
+	assert.Equal(t, DeletionPolicyRetain, wh.deletionPolicy(vulnerabilityManifestKind))
+}
+
+func TestHandleSBOMEventsWithDeletionPolicies(t *testing.T) {
+	untracked := &spdxv1beta1.SBOMSummary{ObjectMeta: v1.ObjectMeta{
+		Name:        "untracked",
+		Namespace:   "kubescape",
+		Labels:      managedLabels(),
+		Annotations: map[string]string{instanceidv1.ImageIDMetadataKey: "nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432"},
+	}}
+
+	tt := []struct {
+		name            string
+		policy          DeletionPolicy
+		dryRun          bool
+		expectedExists  bool
+		expectedLabeled bool
+	}{
+		{
+			name:   "delete",
+			policy: DeletionPolicyDelete,
+		},
+		{
+			name:           "retain",
+			policy:         DeletionPolicyRetain,
+			expectedExists: true,
+		},
+		{
+			name:            "label",
+			policy:          DeletionPolicyLabel,
+			expectedExists:  true,
+			expectedLabeled: true,
+		},
+		{
+			name:           "label in dry run",
+			policy:         DeletionPolicyLabel,
+			dryRun:         true,
+			expectedExists: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.TODO()
+			k8sAPI, _ := newK8sAPIFake(newRunningPodFake("default", "nginx", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"}))
+			storageClient := kssfake.NewSimpleClientset(untracked.DeepCopy())
+			wh, err := NewWatchHandler(k8sAPI, storageClient, nil, nil,
+				WithDryRun(tc.dryRun), WithDeletionPolicies(map[string]DeletionPolicy{sbomSummaryKind: tc.policy}))
+			assert.NoError(t, err)
+			assert.NoError(t, wh.Start(ctx))
+
+			sbomEvents := make(chan watch.Event, 1)
+			sbomEvents <- watch.Event{Type: watch.Modified, Object: untracked.DeepCopy()}
+			close(sbomEvents)
+			errCh := make(chan error)
+			go wh.HandleSBOMEvents(ctx, sbomEvents, nil, errCh)
+			for err := range errCh {
+				assert.NoError(t, err)
+			}
+
+			summary, err := storageClient.SpdxV1beta1().SBOMSummaries("kubescape").Get(ctx, "untracked", v1.GetOptions{})
+			if !tc.expectedExists {
+				assert.Error(t, err, "the orphaned object should be deleted")
+				return
+			}
+			assert.NoError(t, err)
+			_, labeled := summary.Labels[orphanedAtLabel]
+			assert.Equal(t, tc.expectedLabeled, labeled)
+		})
+	}
+}
+
+func TestHandleOrphanLabelsOnce(t *testing.T) {
+	ctx := context.TODO()
+	untracked := &spdxv1beta1.SBOMSummary{ObjectMeta: v1.ObjectMeta{
+		Name:        "untracked",
+		Namespace:   "kubescape",
+		Labels:      managedLabels(),
+		Annotations: map[string]string{instanceidv1.ImageIDMetadataKey: "nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432"},
+	}}
+	k8sAPI, _ := newK8sAPIFake()
+	storageClient := kssfake.NewSimpleClientset(untracked.DeepCopy())
+	wh, err := NewWatchHandler(k8sAPI, storageClient, nil, nil, WithDeletionPolicies(map[string]DeletionPolicy{anyKind: DeletionPolicyLabel}))
+	assert.NoError(t, err)
+	assert.NoError(t, wh.Start(ctx))
+
+	kind := sbomSummaries
+	handle := func() {
+		obj, err := storageClient.SpdxV1beta1().SBOMSummaries("kubescape").Get(ctx, "untracked", v1.GetOptions{})
+		assert.NoError(t, err)
+		deleted, err := wh.handleOrphan(ctx, kind.kind, obj, deletionReasonImageHashNotTracked, kind.deleteObject(wh, obj), kind.patchObject(wh))
+		assert.NoError(t, err)
+		assert.False(t, deleted)
+	}
+
+	handle()
+	labeled, err := storageClient.SpdxV1beta1().SBOMSummaries("kubescape").Get(ctx, "untracked", v1.GetOptions{})
+	assert.NoError(t, err)
+	orphanedAt := labeled.Labels[orphanedAtLabel]
+	assert.NotEmpty(t, orphanedAt)
+	patches := patchActions(storageClient)
+
+	// the events of the labeled object should not label it again
+	handle()
+	handle()
+	assert.Equal(t, patches, patchActions(storageClient))
+	relabeled, err := storageClient.SpdxV1beta1().SBOMSummaries("kubescape").Get(ctx, "untracked", v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, orphanedAt, relabeled.Labels[orphanedAtLabel])
+}
+
+func TestHandleVulnerabilityManifestEventWithDeletionPolicies(t *testing.T) {
+	ctx := context.TODO()
+	k8sAPI, _ := newK8sAPIFake()
+	manifest := &spdxv1beta1.VulnerabilityManifest{ObjectMeta: v1.ObjectMeta{Name: "nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432", Namespace: "kubescape", Labels: managedLabels()}}
+	storageClient := kssfake.NewSimpleClientset(manifest.DeepCopy())
+	wh, err := NewWatchHandler(k8sAPI, storageClient, nil, nil, WithDeletionPolicies(map[string]DeletionPolicy{vulnerabilityManifestKind: DeletionPolicyLabel}))
+	assert.NoError(t, err)
+	assert.NoError(t, wh.Start(ctx))
+
+	wh.handleVulnerabilityManifestEvent(ctx, watch.Event{Type: watch.Added, Object: manifest.DeepCopy()}, func(err error) {
+		assert.NoError(t, err)
+	})
+
+	labeled, err := storageClient.SpdxV1beta1().VulnerabilityManifests("kubescape").Get(ctx, manifest.Name, v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Contains(t, labeled.Labels, orphanedAtLabel)
+}
+
+func TestReclaimOrphansWithDeletionPolicies(t *testing.T) {
+	tt := []struct {
+		name            string
+		policy          DeletionPolicy
+		expectedExists  bool
+		expectedLabeled bool
+	}{
+		{
+			name:   "delete",
+			policy: DeletionPolicyDelete,
+		},
+		{
+			name:           "retain",
+			policy:         DeletionPolicyRetain,
+			expectedExists: true,
+		},
+		{
+			name:            "label",
+			policy:          DeletionPolicyLabel,
+			expectedExists:  true,
+			expectedLabeled: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.TODO()
+			k8sAPI, _ := newK8sAPIFake(newRunningPodFake("default", "nginx", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"}))
+			storageClient := kssfake.NewSimpleClientset(&spdxv1beta1.SBOMSummary{ObjectMeta: v1.ObjectMeta{
+				Name:        "untracked",
+				Namespace:   "kubescape",
+				Labels:      managedLabels(),
+				Annotations: map[string]string{instanceidv1.ImageIDMetadataKey: "nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432"},
+			}})
+			wh, err := NewWatchHandler(k8sAPI, storageClient, nil, nil, WithDeletionPolicies(map[string]DeletionPolicy{anyKind: tc.policy}))
+			assert.NoError(t, err)
+			assert.NoError(t, wh.Start(ctx))
+
+			wh.reclaimOrphans(ctx)
+
+			summary, err := storageClient.SpdxV1beta1().SBOMSummaries("kubescape").Get(ctx, "untracked", v1.GetOptions{})
+			if !tc.expectedExists {
+				assert.Error(t, err, "the orphaned object should be deleted")
+				return
+			}
+			assert.NoError(t, err)
+			_, labeled := summary.Labels[orphanedAtLabel]
+			assert.Equal(t, tc.expectedLabeled, labeled)
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package watcher
+
+import (
+	"context"
+	"sync"
+)
+
+// deletionQueueSize is the maximal number of deletions waiting for a worker of the deletion pool
+const deletionQueueSize = 1024
+
+// metricDeletionQueueDepth is the number of deletions submitted to the deletion pool and not done yet
+const metricDeletionQueueDepth = "operator_deletion_queue_depth"
+
+// deletionPool performs the deletions of orphaned storage objects decided by the watchers on a bounded pool of workers, see WithDeletionWorkers
+//
+// The watchers keep handling events while the storage deletes the objects,
+// e.g. during the teardown of a large namespace, rather than their backlog
+// growing until the watch is dropped. Deletions are submitted to a bounded
+// queue, so the watchers wait for room in it once it is full. Deletions are
+// not ordered.
+//
+// Deletions are performed right away by the submitter until the pool is
+// started, and once it is closed. Closing it waits for the submitted
+// deletions to be done.
+//
+// The nil value performs the deletions right away.
+type deletionPool struct {
+	workers int
+	queue   chan func()
+	started bool
+	closed  bool
+	// pending is the number of deletions submitted and not done yet
+	pending int
+	mu      sync.Mutex
+	done    *sync.Cond
+}
+
+// newDeletionPool returns a pool of the given number of workers, the nil value if it is not positive
+func newDeletionPool(workers, size int) *deletionPool {
+	if workers <= 0 {
+		return nil
+	}
+	p := &deletionPool{workers: workers, queue: make(chan func(), size)}
+	p.done = sync.NewCond(&p.mu)
+	return p
+}
+
+// Start starts the workers of the pool, which is closed once the context is done
+func (p *deletionPool) Start(ctx context.Context) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.started || p.closed {
+		return
+	}
+	p.started = true
+	for i := 0; i < p.workers; i++ {
+		go func() {
+			for deletion := range p.queue {
+				deletion()
+				p.finish()
+			}
+		}()
+	}
+	go func() {
+		<-ctx.Done()
+		p.Close()
+	}()
+}
+
+// Submit submits a deletion to the workers, waiting for room in the queue until the context is done, in which case the deletion is performed right away
+func (p *deletionPool) Submit(ctx context.Context, deletion func()) {
+	if p == nil {
+		deletion()
+		return
+	}
+
+	p.mu.Lock()
+	if !p.started || p.closed {
+		p.mu.Unlock()
+		deletion()
+		return
+	}
+	p.pending++
+	p.mu.Unlock()
+
+	select {
+	case p.queue <- deletion:
+	case <-ctx.Done():
+		deletion()
+		p.finish()
+	}
+}
+
+// finish records that a submitted deletion is done
+func (p *deletionPool) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pending--
+	p.done.Broadcast()
+}
+
+// Wait waits for the submitted deletions to be done, those submitted meanwhile included
+func (p *deletionPool) Wait() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.pending > 0 {
+		p.done.Wait()
+	}
+}
+
+// Close waits for the submitted deletions to be done and stops the workers
+func (p *deletionPool) Close() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+	for p.pending > 0 {
+		p.done.Wait()
+	}
+	if p.started {
+		close(p.queue)
+	}
+}
+
+// Len returns the number of deletions submitted and not done yet
+func (p *deletionPool) Len() int {
+	if p == nil {
+		return 0
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.pending
+}
@@ -0,0 +1,208 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/armosec/armoapi-go/apis"
+	instanceidv1 "github.com/kubescape/k8s-interface/instanceidhandler/v1"
+	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestDeletionPool(t *testing.T) {
+	t.Run("the nil value deletes right away", func(t *testing.T) {
+		assert.Nil(t, newDeletionPool(0, deletionQueueSize))
+		var p *deletionPool
+		deleted := false
+		p.Submit(context.TODO(), func() { deleted = true })
+		assert.True(t, deleted)
+		p.Wait()
+		assert.Equal(t, 0, p.Len())
+	})
+
+	t.Run("deletions are performed right away until started", func(t *testing.T) {
+		p := newDeletionPool(1, deletionQueueSize)
+		deleted := false
+		p.Submit(context.TODO(), func() { deleted = true })
+		assert.True(t, deleted)
+	})
+
+	t.Run("closing drains the queue", func(t *testing.T) {
+		defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+		p := newDeletionPool(2, deletionQueueSize)
+		ctx, cancel := context.WithCancel(context.TODO())
+		p.Start(ctx)
+		release := make(chan struct{})
+		var deleted atomic.Int32
+		for i := 0; i < 10; i++ {
+			p.Submit(context.TODO(), func() {
+				<-release
+				deleted.Add(1)
+			})
+		}
+		assert.Equal(t, 10, p.Len())
+
+		closed := make(chan struct{})
+		go func() {
+			cancel()
+			// closing waits for the queued deletions
+			p.Close()
+			close(closed)
+		}()
+		close(release)
+		<-closed
+		assert.Equal(t, int32(10), deleted.Load())
+		assert.Equal(t, 0, p.Len())
+
+		// deletions submitted once closed are performed right away
+		p.Submit(context.TODO(), func() { deleted.Add(1) })
+		assert.Equal(t, int32(11), deleted.Load())
+	})
+}
+
+func TestHandleSBOMEventsWithDeletionWorkers(t *testing.T) {
+	const orphans = 500
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	objects := make([]runtime.Object, 0, orphans)
+	for i := 0; i < orphans; i++ {
+		objects = append(objects, &spdxv1beta1.SBOMSummary{ObjectMeta: v1.ObjectMeta{
+			Name:        fmt.Sprintf("nginx-%d", i),
+			Namespace:   "kubescape",
+			Labels:      managedLabels(),
+			Annotations: map[string]string{instanceidv1.ImageIDMetadataKey: fmt.Sprintf("nginx@sha256:%064x", i)},
+		}})
+	}
+	storageClient := kssfake.NewSimpleClientset(objects...)
+	// the storage is slow to delete until released
+	release := make(chan struct{})
+	storageClient.PrependReactor("delete", "sbomsummaries", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		<-release
+		return false, nil, nil
+	})
+	k8sAPI, _ := newK8sAPIFake()
+	wh, err := NewWatchHandler(k8sAPI, storageClient, nil, nil, WithDeletionWorkers(4))
+	assert.NoError(t, err)
+	assert.NoError(t, wh.Start(ctx))
+
+	sbomEvents := make(chan watch.Event)
+	errCh := make(chan error)
+	go wh.HandleSBOMEvents(ctx, sbomEvents, make(chan *apis.Command, 1), errCh)
+	go func() {
+		for err := range errCh {
+			assert.NoError(t, err)
+		}
+	}()
+
+	intake := make(chan struct{})
+	go func() {
+		for _, obj := range objects {
+			sbomEvents <- watch.Event{Type: watch.Modified, Object: obj}
+		}
+		close(intake)
+	}()
+	select {
+	case <-intake:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the events should be handled while the storage deletes the objects")
+	}
+	assert.Eventually(t, func() bool { return wh.Metrics()[metricDeletionQueueDepth] == orphans }, time.Second, 5*time.Millisecond)
+
+	close(release)
+	close(sbomEvents)
+	wh.deletions.Wait()
+	summaries, err := storageClient.SpdxV1beta1().SBOMSummaries("").List(ctx, v1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, summaries.Items, "every orphaned object should be deleted")
+	assert.Equal(t, int64(0), wh.Metrics()[metricDeletionQueueDepth])
+}
+
+func TestSubmittedDeletionsReevaluated(t *testing.T) {
+	const instanceID = "apiVersion-v1/namespace-default/kind-Pod/name-reverse-proxy/containerName-nginx"
+	summary := &spdxv1beta1.SBOMSummary{ObjectMeta: v1.ObjectMeta{
+		Name:        validImageIDSlug,
+		Namespace:   "kubescape",
+		Labels:      managedLabels(),
+		Annotations: map[string]string{instanceidv1.ImageIDMetadataKey: validImageID},
+	}}
+	filtered := &spdxv1beta1.SBOMSPDXv2p3Filtered{ObjectMeta: v1.ObjectMeta{
+		Name:        "filtered",
+		Namespace:   "kubescape",
+		Labels:      managedLabels(),
+		Annotations: map[string]string{instanceidv1.InstanceIDMetadataKey: instanceID},
+	}}
+
+	tt := []struct {
+		name string
+		kind sbomKind
+		obj  runtime.Object
+		// meanwhile changes the handler while the deletion waits for a worker
+		meanwhile func(wh *WatchHandler)
+	}{
+		{
+			name: "SBOM whose image is tracked again",
+			kind: sbomSummaries,
+			obj:  summary,
+			meanwhile: func(wh *WatchHandler) {
+				wh.addToImageIDToWlidsMap(validImageID, "wlid://cluster-/namespace-default/pod-reverse-proxy")
+			},
+		},
+		{
+			name: "filtered SBOM whose instance ID is tracked again",
+			kind: sbomSPDXv2p3Filtereds,
+			obj:  filtered,
+			meanwhile: func(wh *WatchHandler) {
+				slug, err := annotationsToInstanceID(filtered.Annotations)
+				assert.NoError(t, err)
+				wh.managedInstanceIDSlugs.Add("reverse-proxy", slug)
+			},
+		},
+		{
+			name:      "SBOM whose deletion is deferred by a rebuild",
+			kind:      sbomSummaries,
+			obj:       summary,
+			meanwhile: func(wh *WatchHandler) { wh.rebuild.start() },
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.TODO())
+			defer cancel()
+
+			storageClient := kssfake.NewSimpleClientset(tc.obj.DeepCopyObject())
+			k8sAPI, _ := newK8sAPIFake()
+			wh, err := NewWatchHandler(k8sAPI, storageClient, nil, nil, WithDeletionWorkers(1))
+			assert.NoError(t, err)
+			assert.NoError(t, wh.Start(ctx))
+
+			// the only worker is busy until released
+			release := make(chan struct{})
+			wh.deletions.Submit(ctx, func() { <-release })
+			obj, ok := tc.kind.fromObject(tc.obj)
+			assert.True(t, ok)
+			wh.handleSBOMObject(ctx, tc.kind, watch.Modified, obj, func(*apis.Command) {}, func(err error) { assert.NoError(t, err) })
+			assert.Equal(t, 2, wh.deletions.Len(), "the deletion should wait for a worker")
+
+			tc.meanwhile(wh)
+			close(release)
+			wh.deletions.Wait()
+
+			objects, _, err := tc.kind.list(wh, ctx)
+			assert.NoError(t, err)
+			assert.Len(t, objects, 1, "the object should not be deleted once not orphaned anymore")
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package watcher
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	// deletionRetriesSize is the maximal number of failed deletions waiting to be retried
+	deletionRetriesSize = 1024
+	// deletionRetryMaxAttempts is the number of times a failed deletion is attempted before it is given up
+	deletionRetryMaxAttempts = 5
+	// deletionRetryBackoff is the delay before the first retry of a failed deletion, doubled after every further failure
+	deletionRetryBackoff = time.Second
+	// deletionRetryMaxBackoff is the maximal delay between two retries of a failed deletion
+	deletionRetryMaxBackoff = time.Minute
+)
+
+// metricDeletionsGivenUpTotal is the number of deletions of orphaned storage objects given up after failing every attempt
+const metricDeletionsGivenUpTotal = "operator_deletions_given_up_total"
+
+// deletionRetry is a failed deletion of an orphaned storage object waiting to be retried
+type deletionRetry struct {
+	key          pendingDeletionKey
+	reason       string
+	isOrphan     func() bool
+	deleteObject func(ctx context.Context) error
+	attempts     int
+	due          time.Time
+}
+
+// deletionRetries holds the failed deletions of orphaned storage objects, shared by the watchers and cleanUp, see retryFailedDeletion
+//
+// Transient failures of the storage would otherwise leave the objects
+// orphaned until they are modified again or the next cleanUp. Deletions are
+// retried with an exponential backoff, and given up after
+// deletionRetryMaxAttempts attempts. When full, further failed deletions are
+// left to cleanUp.
+//
+// The nil value retries nothing.
+type deletionRetries struct {
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	maxAttempts int
+	size        int
+	entries     map[pendingDeletionKey]*deletionRetry
+	now         clock
+	mu          sync.Mutex
+}
+
+// newDeletionRetries returns the failed deletions retried with the given backoff, up to the given number of attempts
+func newDeletionRetries(backoff, maxBackoff time.Duration, maxAttempts, size int) *deletionRetries {
+	return &deletionRetries{
+		backoff:     backoff,
+		maxBackoff:  maxBackoff,
+		maxAttempts: maxAttempts,
+		size:        size,
+		entries:     make(map[pendingDeletionKey]*deletionRetry),
+		now:         time.Now,
+	}
+}
+
+// Add schedules the retry of a deletion that failed for the first time, returning false if it is not retried
+//
+// Deletions already waiting to be retried keep their attempts and due time.
+func (r *deletionRetries) Add(retry *deletionRetry) bool {
+	if r == nil || r.maxAttempts <= 1 {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.entries[retry.key]; ok {
+		return true
+	}
+	if len(r.entries) >= r.size {
+		return false
+	}
+	retry.attempts = 1
+	retry.due = r.now().Add(r.backoff)
+	r.entries[retry.key] = retry
+	return true
+}
+
+// Due removes and returns the deletions due for a retry
+func (r *deletionRetries) Due() []*deletionRetry {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	var due []*deletionRetry
+	for key, retry := range r.entries {
+		if !now.Before(retry.due) {
+			due = append(due, retry)
+			delete(r.entries, key)
+		}
+	}
+	return due
+}
+
+// Failed schedules the next retry of a due deletion that failed again, returning false if it is given up
+func (r *deletionRetries) Failed(retry *deletionRetry) bool {
+	retry.attempts++
+	if retry.attempts >= r.maxAttempts {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	backoff := r.backoff << (retry.attempts - 1)
+	if backoff <= 0 || backoff > r.maxBackoff {
+		backoff = r.maxBackoff
+	}
+	retry.due = r.now().Add(backoff)
+	// a deletion that failed again in the meantime keeps its attempts
+	if _, ok := r.entries[retry.key]; !ok {
+		r.entries[retry.key] = retry
+	}
+	return true
+}
+
+// Len returns the number of deletions waiting to be retried
+func (r *deletionRetries) Len() int {
+	if r == nil {
+		return 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.entries)
+}
+
+// retryFailedDeletion schedules the retry of the deletion of an orphaned storage object that failed, see deletionRetries
+//
+// Objects that are not found are deleted, so their deletion is not retried.
+// isOrphan is checked again before every retry, so objects tracked again in
+// the meantime are kept.
+func (wh *WatchHandler) retryFailedDeletion(ctx context.Context, kind string, obj orphanObject, reason string, isOrphan func() bool, deleteObject func(ctx context.Context) error, err error) {
+	if err == nil || k8serrors.IsNotFound(err) {
+		return
+	}
+	retry := &deletionRetry{key: orphanKey(kind, obj), reason: reason, isOrphan: isOrphan, deleteObject: deleteObject}
+	if !wh.deletionRetries.Add(retry) {
+		return
+	}
+	logger.L().Ctx(ctx).Debug("retrying the failed deletion of storage object later",
+		append(deletionDetails(kind, retry.key.namespace, retry.key.name, reason), helpers.Error(err))...)
+}
+
+// startDeletionRetryRoutine retries the failed deletions once they are due until the context is done
+func (wh *WatchHandler) startDeletionRetryRoutine(ctx context.Context) {
+	if wh.deletionRetries == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(wh.deletionRetries.backoff)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				wh.retryDueDeletions(ctx)
+			}
+		}
+	}()
+}
+
+// retryDueDeletions retries the failed deletions that are due, giving up those failing their last attempt
+func (wh *WatchHandler) retryDueDeletions(ctx context.Context) {
+	for _, retry := range wh.deletionRetries.Due() {
+		key := retry.key
+		if !retry.isOrphan() {
+			continue
+		}
+		err := wh.deleteStorageObject(ctx, key.kind, key.namespace, key.name, retry.reason, retry.deleteObject)
+		if err == nil || k8serrors.IsNotFound(err) {
+			continue
+		}
+		if wh.deletionRetries.Failed(retry) {
+			continue
+		}
+		wh.metrics.Inc(metricDeletionsGivenUpTotal)
+		logger.L().Ctx(ctx).Error("giving up the deletion of storage object",
+			append(deletionDetails(key.kind, key.namespace, key.name, retry.reason),
+				helpers.Int("attempts", retry.attempts),
+				helpers.Error(err))...)
+	}
+}
@@ -0,0 +1,157 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/armosec/armoapi-go/apis"
+	instanceidv1 "github.com/kubescape/k8s-interface/instanceidhandler/v1"
+	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestDeletionRetries(t *testing.T) {
+	now := time.Now()
+	newDeletionRetriesFake := func(size int) *deletionRetries {
+		r := newDeletionRetries(time.Second, 3*time.Second, 4, size)
+		r.now = func() time.Time { return now }
+		return r
+	}
+	newRetry := func(name string) *deletionRetry {
+		return &deletionRetry{key: pendingDeletionKey{kind: sbomSummaryKind, namespace: "kubescape", name: name}}
+	}
+
+	t.Run("the nil value retries nothing", func(t *testing.T) {
+		var r *deletionRetries
+		assert.False(t, r.Add(newRetry("nginx")))
+		assert.Empty(t, r.Due())
+		assert.Equal(t, 0, r.Len())
+	})
+
+	t.Run("retries back off exponentially until given up", func(t *testing.T) {
+		r := newDeletionRetriesFake(deletionRetriesSize)
+		assert.True(t, r.Add(newRetry("nginx")))
+		assert.True(t, r.Add(newRetry("nginx")), "deletions failing again should be retried once")
+		assert.Equal(t, 1, r.Len())
+
+		for _, backoff := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+			now = now.Add(backoff - time.Millisecond)
+			assert.Empty(t, r.Due(), "deletions should not be retried before their backoff is over")
+			now = now.Add(time.Millisecond)
+			due := r.Due()
+			if !assert.Len(t, due, 1) {
+				return
+			}
+			if due[0].attempts == 3 {
+				assert.False(t, r.Failed(due[0]), "deletions should be given up after their last attempt")
+				break
+			}
+			assert.True(t, r.Failed(due[0]))
+		}
+		assert.Equal(t, 0, r.Len())
+	})
+
+	t.Run("failed deletions are not retried when full", func(t *testing.T) {
+		r := newDeletionRetriesFake(1)
+		assert.True(t, r.Add(newRetry("nginx")))
+		assert.False(t, r.Add(newRetry("redis")))
+		assert.Equal(t, 1, r.Len())
+	})
+}
+
+func TestRetryFailedDeletions(t *testing.T) {
+	ctx := context.TODO()
+	imageID := "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"
+	summary := &spdxv1beta1.SBOMSummary{ObjectMeta: v1.ObjectMeta{
+		Name:        "nginx",
+		Namespace:   "kubescape",
+		Labels:      managedLabels(),
+		Annotations: map[string]string{instanceidv1.ImageIDMetadataKey: imageID},
+	}}
+	// newFailingStorageClientFake returns a storage client failing the given number of deletions of the summaries, all of them if negative
+	newFailingStorageClientFake := func(failures int) *kssfake.Clientset {
+		storageClient := kssfake.NewSimpleClientset(summary.DeepCopy())
+		storageClient.PrependReactor("delete", "sbomsummaries", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			if failures == 0 {
+				return false, nil, nil
+			}
+			failures--
+			return true, nil, errors.New("storage unavailable")
+		})
+		return storageClient
+	}
+	newWatchHandler := func(t *testing.T, storageClient *kssfake.Clientset) (*WatchHandler, *time.Time) {
+		k8sAPI, _ := newK8sAPIFake()
+		now := time.Now()
+		wh, err := NewWatchHandler(k8sAPI, storageClient, nil, nil, WithClock(func() time.Time { return now }))
+		assert.NoError(t, err)
+		return wh, &now
+	}
+	handle := func(t *testing.T, wh *WatchHandler) {
+		sbomEvents := make(chan watch.Event, 1)
+		sbomEvents <- watch.Event{Type: watch.Modified, Object: summary.DeepCopy()}
+		close(sbomEvents)
+		errCh := make(chan error)
+		go wh.HandleSBOMEvents(ctx, sbomEvents, make(chan *apis.Command, 1), errCh)
+		errs := 0
+		for range errCh {
+			errs++
+		}
+		assert.Equal(t, 1, errs, "the failed deletion should be reported")
+	}
+	exists := func(storageClient *kssfake.Clientset) bool {
+		_, err := storageClient.SpdxV1beta1().SBOMSummaries("kubescape").Get(ctx, summary.Name, v1.GetOptions{})
+		return err == nil
+	}
+
+	t.Run("deletions failing twice are retried until they succeed", func(t *testing.T) {
+		storageClient := newFailingStorageClientFake(2)
+		wh, now := newWatchHandler(t, storageClient)
+
+		handle(t, wh)
+		assert.Equal(t, 1, wh.deletionRetries.Len())
+		*now = now.Add(deletionRetryBackoff)
+		wh.retryDueDeletions(ctx)
+		assert.True(t, exists(storageClient))
+		assert.Equal(t, 1, wh.deletionRetries.Len(), "deletions failing again should be retried again")
+
+		*now = now.Add(2 * deletionRetryBackoff)
+		wh.retryDueDeletions(ctx)
+		assert.False(t, exists(storageClient))
+		assert.Equal(t, 0, wh.deletionRetries.Len())
+		assert.Zero(t, wh.metrics.Get(metricDeletionsGivenUpTotal))
+	})
+
+	t.Run("deletions failing every attempt are given up", func(t *testing.T) {
+		storageClient := newFailingStorageClientFake(-1)
+		wh, now := newWatchHandler(t, storageClient)
+
+		handle(t, wh)
+		for i := 0; i < deletionRetryMaxAttempts && wh.deletionRetries.Len() > 0; i++ {
+			*now = now.Add(deletionRetryMaxBackoff)
+			wh.retryDueDeletions(ctx)
+		}
+		assert.True(t, exists(storageClient))
+		assert.Equal(t, 0, wh.deletionRetries.Len())
+		assert.Equal(t, int64(1), wh.metrics.Get(metricDeletionsGivenUpTotal))
+	})
+
+	t.Run("objects tracked again are not deleted", func(t *testing.T) {
+		storageClient := newFailingStorageClientFake(1)
+		wh, now := newWatchHandler(t, storageClient)
+
+		handle(t, wh)
+		wh.addToImageIDToWlidsMap(imageID, "wlid://cluster-/namespace-default/deployment-nginx")
+		*now = now.Add(deletionRetryBackoff)
+		wh.retryDueDeletions(ctx)
+		assert.True(t, exists(storageClient))
+		assert.Equal(t, 0, wh.deletionRetries.Len())
+	})
+}
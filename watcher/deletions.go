@@ -0,0 +1,57 @@
+package watcher
+
+import (
+	"context"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	vulnerabilityManifestKind = "VulnerabilityManifest"
+
+	// deletionReasonImageHashNotTracked is the reason for deleting objects identified by an image hash no workload uses
+	deletionReasonImageHashNotTracked = "image hash not tracked"
+	// deletionReasonInstanceIDNotTracked is the reason for deleting objects identified by an instance ID no container has
+	deletionReasonInstanceIDNotTracked = "instance ID not tracked"
+)
+
+// deletionDetails returns the log fields describing the deletion of a storage object
+func deletionDetails(kind, namespace, name, reason string) []helpers.IDetails {
+	return []helpers.IDetails{
+		helpers.String("kind", kind),
+		helpers.String("namespace", namespace),
+		helpers.String("name", name),
+		helpers.String("reason", reason),
+	}
+}
+
+// DeletionHook is called with the kind, namespace and name of every deleted storage object, see WithOnDelete
+type DeletionHook func(kind, namespace, name string)
+
+// logDeletion logs the decision to delete a storage object along with the reason
+func logDeletion(ctx context.Context, kind, namespace, name, reason string, details ...helpers.IDetails) {
+	logger.L().Ctx(ctx).Debug("deleting storage object", append(deletionDetails(kind, namespace, name, reason), details...)...)
+}
+
+// deleteStorageObject deletes a storage object with the given function and logs the decision
+//
+// The deletion is attempted again while the storage throttles it, see
+// deleteFromStorage, and each attempt is bounded by the storage request
+// timeout. In dry-run mode, the object is not deleted and only the deletion
+// that would have been performed is logged. The deletions that succeed,
+// objects not found included, are passed to the hook of WithOnDelete, if any.
+func (wh *WatchHandler) deleteStorageObject(ctx context.Context, kind, namespace, name, reason string, deleteFunc func(ctx context.Context) error, details ...helpers.IDetails) error {
+	if wh.dryRun {
+		logger.L().Ctx(ctx).Info("dry run: would delete storage object", append(deletionDetails(kind, namespace, name, reason), details...)...)
+		return nil
+	}
+	logDeletion(ctx, kind, namespace, name, reason, details...)
+
+	err := wh.deleteFromStorage(ctx, kind, namespace, name, deleteFunc)
+	if wh.onDelete != nil && (err == nil || k8serrors.IsNotFound(err)) {
+		wh.onDelete(kind, namespace, name)
+	}
+	return err
+}
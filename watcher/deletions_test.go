@@ -0,0 +1,262 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/armosec/armoapi-go/apis"
+	"github.com/kubescape/go-logger"
+	instanceidv1 "github.com/kubescape/k8s-interface/instanceidhandler/v1"
+	"github.com/kubescape/operator/utils"
+	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestDeletionDetails(t *testing.T) {
+	details := deletionDetails(sbomSummaryKind, "kubescape", "name", deletionReasonImageHashNotTracked)
+
+	actual := map[string]interface{}{}
+	for _, detail := range details {
+		actual[detail.Key()] = detail.Value()
+	}
+	assert.Equal(t, map[string]interface{}{
+		"kind":      sbomSummaryKind,
+		"namespace": "kubescape",
+		"name":      "name",
+		"reason":    deletionReasonImageHashNotTracked,
+	}, actual)
+}
+
+func TestSBOMOrphanCheckReasons(t *testing.T) {
+	wh := NewWatchHandlerMock()
+
+	summary := &spdxv1beta1.SBOMSummary{ObjectMeta: v1.ObjectMeta{
+		Labels:      managedLabels(),
+		Annotations: map[string]string{instanceidv1.ImageIDMetadataKey: validImageID},
+	}}
+	isOrphan, reason, ok := wh.sbomOrphanCheck(sbomSummaries, summary)
+	assert.True(t, ok)
+	assert.True(t, isOrphan())
+	assert.Equal(t, deletionReasonImageHashNotTracked, reason)
+
+	filtered := &spdxv1beta1.SBOMSPDXv2p3Filtered{ObjectMeta: v1.ObjectMeta{
+		Labels:      managedLabels(),
+		Annotations: map[string]string{instanceidv1.InstanceIDMetadataKey: "apiVersion-v1/namespace-default/kind-Pod/name-reverse-proxy/containerName-nginx"},
+	}}
+	isOrphan, reason, ok = wh.sbomOrphanCheck(sbomSPDXv2p3Filtereds, filtered)
+	assert.True(t, ok)
+	assert.True(t, isOrphan())
+	assert.Equal(t, deletionReasonInstanceIDNotTracked, reason)
+
+	// objects that cannot be identified are never considered orphaned
+	_, _, ok = wh.sbomOrphanCheck(sbomSummaries, &spdxv1beta1.SBOMSummary{})
+	assert.False(t, ok)
+}
+
+func TestDryRunDoesNotDelete(t *testing.T) {
+	logFile, err := os.CreateTemp(t.TempDir(), "log")
+	assert.NoError(t, err)
+	previousWriter, previousLevel := logger.L().GetWriter(), logger.L().GetLevel()
+	logger.L().SetWriter(logFile)
+	_ = logger.L().SetLevel("info")
+	defer func() {
+		logger.L().SetWriter(previousWriter)
+		_ = logger.L().SetLevel(previousLevel)
+	}()
+
+	summary := &spdxv1beta1.SBOMSummary{ObjectMeta: v1.ObjectMeta{
+		Name:        validImageIDSlug,
+		Namespace:   "kubescape",
+		Labels:      managedLabels(),
+		Annotations: map[string]string{instanceidv1.ImageIDMetadataKey: validImageID},
+	}}
+	sbom := &spdxv1beta1.SBOMSPDXv2p3{ObjectMeta: summary.ObjectMeta}
+	filtered := &spdxv1beta1.SBOMSPDXv2p3Filtered{ObjectMeta: v1.ObjectMeta{
+		Name:        "filtered",
+		Namespace:   "kubescape",
+		Labels:      managedLabels(),
+		Annotations: map[string]string{instanceidv1.InstanceIDMetadataKey: "apiVersion-v1/namespace-default/kind-Pod/name-reverse-proxy/containerName-nginx"},
+	}}
+	storageClient := kssfake.NewSimpleClientset(summary, sbom, filtered)
+
+	wh, err := NewWatchHandler(utils.NewK8sInterfaceFake(k8sfake.NewSimpleClientset()), storageClient, nil, nil, WithDryRun(true))
+	assert.NoError(t, err)
+	assert.NoError(t, wh.Start(context.TODO()))
+
+	// none of the objects is tracked, so all of them would be deleted
+	handle := func(handler func(ctx context.Context, events <-chan watch.Event, errorCh chan<- error), obj runtime.Object) {
+		events := make(chan watch.Event, 1)
+		errorCh := make(chan error)
+		events <- watch.Event{Type: watch.Added, Object: obj}
+		close(events)
+		go handler(context.TODO(), events, errorCh)
+		for range errorCh {
+		}
+	}
+	handle(func(ctx context.Context, events <-chan watch.Event, errorCh chan<- error) {
+		wh.HandleSBOMEvents(ctx, events, make(chan *apis.Command, 1), errorCh)
+	}, summary)
+	handle(func(ctx context.Context, events <-chan watch.Event, errorCh chan<- error) {
+		wh.HandleSBOMFilteredEvents(ctx, events, make(chan *apis.Command, 1), errorCh)
+	}, filtered)
+	wh.reclaimOrphans(context.TODO())
+
+	for _, action := range storageClient.Actions() {
+		assert.NotEqual(t, "delete", action.GetVerb(), "no object should be deleted in dry-run mode")
+	}
+
+	logs, err := os.ReadFile(logFile.Name())
+	assert.NoError(t, err)
+	wouldDelete := 0
+	for _, line := range strings.Split(string(logs), "\n") {
+		if strings.Contains(line, "dry run: would delete storage object") {
+			wouldDelete++
+		}
+	}
+	// once by the handlers and once by the cleanUp for each object
+	assert.Equal(t, 4, wouldDelete)
+	assert.Contains(t, string(logs), deletionReasonImageHashNotTracked)
+	assert.Contains(t, string(logs), deletionReasonInstanceIDNotTracked)
+}
+
+func TestWithOnDelete(t *testing.T) {
+	ctx := context.TODO()
+	summary := &spdxv1beta1.SBOMSummary{ObjectMeta: v1.ObjectMeta{
+		Name:        "nginx",
+		Namespace:   "kubescape",
+		Labels:      managedLabels(),
+		Annotations: map[string]string{instanceidv1.ImageIDMetadataKey: validImageID},
+	}}
+
+	tt := []struct {
+		name     string
+		dryRun   bool
+		fails    bool
+		expected []string
+	}{
+		{name: "deletions are passed to the hook", expected: []string{sbomSummaryKind + " kubescape/nginx"}},
+		{name: "dry runs are not passed", dryRun: true},
+		{name: "failed deletions are not passed", fails: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			storageClient := kssfake.NewSimpleClientset(summary.DeepCopy())
+			if tc.fails {
+				storageClient.PrependReactor("delete", "sbomsummaries", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, errors.New("storage unavailable")
+				})
+			}
+			var mu sync.Mutex
+			var deleted []string
+			k8sAPI, _ := newK8sAPIFake()
+			wh, err := NewWatchHandler(k8sAPI, storageClient, nil, nil, WithDryRun(tc.dryRun), WithOnDelete(func(kind, namespace, name string) {
+				mu.Lock()
+				defer mu.Unlock()
+				deleted = append(deleted, kind+" "+namespace+"/"+name)
+			}))
+			assert.NoError(t, err)
+
+			sbomEvents := make(chan watch.Event, 1)
+			sbomEvents <- watch.Event{Type: watch.Modified, Object: summary.DeepCopy()}
+			close(sbomEvents)
+			errCh := make(chan error)
+			go wh.HandleSBOMEvents(ctx, sbomEvents, make(chan *apis.Command, 1), errCh)
+			for range errCh {
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, tc.expected, deleted)
+		})
+	}
+}
+
+func TestDeleteFromStorage(t *testing.T) {
+	throttled := k8serrors.NewTooManyRequests("storage throttled", 0)
+	unavailable := k8serrors.NewServiceUnavailable("storage unavailable")
+	forbidden := k8serrors.NewForbidden(spdxv1beta1.Resource("sbomsummaries"), "nginx", errors.New("forbidden"))
+
+	tt := []struct {
+		name             string
+		errs             []error
+		expectedErr      error
+		expectedAttempts int
+		expectedRetries  int64
+		expectedFailures int64
+	}{
+		{name: "deletions succeeding at once are not retried", expectedAttempts: 1},
+		{name: "throttled deletions are retried until they succeed", errs: []error{throttled, unavailable}, expectedAttempts: 3, expectedRetries: 2},
+		{name: "throttled deletions fail once their attempts are exhausted", errs: []error{throttled, throttled, unavailable, nil}, expectedErr: unavailable, expectedAttempts: storageDeleteAttempts, expectedRetries: storageDeleteAttempts - 1, expectedFailures: 1},
+		{name: "deletions exceeding the storage request timeout are retried", errs: []error{fmt.Errorf("delete: %w", context.DeadlineExceeded)}, expectedAttempts: 2, expectedRetries: 1},
+		{name: "other errors are not retried", errs: []error{forbidden, nil}, expectedErr: forbidden, expectedAttempts: 1, expectedFailures: 1},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			wh := NewWatchHandlerMock()
+			wh.storageDeleteBackoff = time.Millisecond
+			attempts := 0
+			err := wh.deleteFromStorage(context.TODO(), sbomSummaryKind, "kubescape", "nginx", func(ctx context.Context) error {
+				attempts++
+				if attempts <= len(tc.errs) {
+					return tc.errs[attempts-1]
+				}
+				return nil
+			})
+			assert.Equal(t, tc.expectedErr, err)
+			assert.Equal(t, tc.expectedAttempts, attempts)
+			assert.Equal(t, tc.expectedRetries, wh.metrics.Get(metricStorageDeleteRetriesTotal))
+			assert.Equal(t, tc.expectedFailures, wh.metrics.Get(metricStorageDeleteFailuresTotal))
+		})
+	}
+
+	t.Run("attempts are bounded by the storage request timeout", func(t *testing.T) {
+		wh := NewWatchHandlerMock()
+		wh.storageDeleteBackoff = time.Millisecond
+		wh.storageRequestTimeout = 10 * time.Millisecond
+		attempts := 0
+		err := wh.deleteFromStorage(context.TODO(), sbomSummaryKind, "kubescape", "nginx", func(ctx context.Context) error {
+			attempts++
+			if attempts == 1 {
+				// a wedged storage never responds
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, attempts)
+	})
+
+	t.Run("retries stop once the context is done", func(t *testing.T) {
+		wh := NewWatchHandlerMock()
+		wh.storageDeleteBackoff = time.Hour
+		ctx, cancel := context.WithCancel(context.TODO())
+		done := make(chan error)
+		go func() {
+			done <- wh.deleteFromStorage(ctx, sbomSummaryKind, "kubescape", "nginx", func(ctx context.Context) error {
+				return throttled
+			})
+		}()
+		assert.Eventually(t, func() bool { return wh.metrics.Get(metricStorageDeleteRetriesTotal) == 1 }, time.Second, 5*time.Millisecond)
+		cancel()
+		select {
+		case err := <-done:
+			assert.Equal(t, throttled, err)
+		case <-time.After(time.Second):
+			t.Fatal("the backoff should not delay a shutdown")
+		}
+	})
+}
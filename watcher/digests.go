@@ -0,0 +1,141 @@
+package watcher
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	"golang.org/x/exp/slices"
+)
+
+// imageDigestsAnnotation lists, comma-separated, the other image IDs of the image an SBOM describes
+//
+// With multi-arch images, Pods report the digest of the platform-specific
+// manifest, while SBOMs may be named after the digest of the image index, or
+// the other way around.
+const imageDigestsAnnotation = "kubescape.io/image-digests"
+
+// ImageDigestResolver returns the other image IDs of the image of a given image ID, e.g. the index digest of a platform-specific digest
+type ImageDigestResolver func(ctx context.Context, imageID string) ([]string, error)
+
+// imageDigestAliases records the other image IDs of the tracked image IDs, as returned by a resolver
+//
+// Image IDs are resolved once, as digests are immutable. Image IDs that
+// failed to resolve are resolved again the next time they are tracked.
+//
+// The nil value resolves nothing.
+type imageDigestAliases struct {
+	resolve  ImageDigestResolver
+	aliases  map[string][]string // <image hash of another image ID> : tracked image IDs of the same image
+	resolved map[string]struct{}
+	mu       sync.RWMutex
+}
+
+func newImageDigestAliases(resolve ImageDigestResolver) *imageDigestAliases {
+	return &imageDigestAliases{
+		resolve:  resolve,
+		aliases:  make(map[string][]string),
+		resolved: make(map[string]struct{}),
+	}
+}
+
+// Resolve records the other image IDs of a given image ID, unless it was resolved already
+func (a *imageDigestAliases) Resolve(ctx context.Context, imageID string) {
+	if a == nil {
+		return
+	}
+
+	a.mu.RLock()
+	_, resolved := a.resolved[imageID]
+	a.mu.RUnlock()
+	if resolved {
+		return
+	}
+
+	others, err := a.resolve(ctx, imageID)
+	if err != nil {
+		logger.L().Ctx(ctx).Debug("failed to resolve the other digests of the image", helpers.String("imageID", imageID), helpers.Error(err))
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.resolved[imageID] = struct{}{}
+	for _, other := range others {
+		otherHash := imageHashKey(other)
+		if otherHash != imageHashKey(imageID) && !slices.Contains(a.aliases[otherHash], imageID) {
+			a.aliases[otherHash] = append(a.aliases[otherHash], imageID)
+		}
+	}
+}
+
+// ImageIDs returns the resolved image IDs the given image ID is another image ID of
+func (a *imageDigestAliases) ImageIDs(other string) []string {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return append([]string(nil), a.aliases[imageHashKey(other)]...)
+}
+
+// sbomImageIDs returns the image IDs of the image an SBOM describes: its image ID along with those of its image digests annotation
+func sbomImageIDs(imageID string, annotations map[string]string) []string {
+	imageIDs := []string{imageID}
+	for _, other := range strings.Split(annotations[imageDigestsAnnotation], ",") {
+		if other = strings.TrimSpace(other); other != "" && other != imageID {
+			imageIDs = append(imageIDs, other)
+		}
+	}
+	return imageIDs
+}
+
+// isImageIDTracked reports whether any of the given image IDs of an image is tracked, directly or as another image ID of a tracked one
+func (wh *WatchHandler) isImageIDTracked(imageIDs ...string) bool {
+	for _, imageID := range imageIDs {
+		if len(wh.GetWlidsForImageHash(imageID)) > 0 {
+			return true
+		}
+		for _, tracked := range wh.imageDigests.ImageIDs(imageID) {
+			if len(wh.GetWlidsForImageHash(tracked)) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// trackedImageID returns the first of the given image IDs of an image that is tracked, see isImageIDTracked, or the first one if none is
+func (wh *WatchHandler) trackedImageID(imageIDs ...string) string {
+	for _, imageID := range imageIDs {
+		if wh.isImageIDTracked(imageID) {
+			return imageID
+		}
+	}
+	return imageIDs[0]
+}
+
+// wlidsOfImageIDs returns the sorted WLIDs running any of the given image IDs of an image, directly or as another image ID of a tracked one, see isImageIDTracked
+func (wh *WatchHandler) wlidsOfImageIDs(imageIDs ...string) []string {
+	var wlids []string
+	addWlids := func(imageID string) {
+		for _, wlid := range wh.GetWlidsForImageHash(imageID) {
+			if !slices.Contains(wlids, wlid) {
+				wlids = append(wlids, wlid)
+			}
+		}
+	}
+	for _, imageID := range imageIDs {
+		addWlids(imageID)
+		for _, tracked := range wh.imageDigests.ImageIDs(imageID) {
+			addWlids(tracked)
+		}
+	}
+	slices.Sort(wlids)
+	return wlids
+}
@@ -0,0 +1,147 @@
+package watcher
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	instanceidv1 "github.com/kubescape/k8s-interface/instanceidhandler/v1"
+	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+const (
+	// the normalized digests of the index of a multi-arch image and of its linux/amd64 and linux/arm64 manifests
+	multiArchIndexImageID = "docker.io/library/nginx@sha256:0f04e4f646a3f14bf31d8bc8d885b6c951fdcf42589d06845f64d18aec6a3c4d"
+	multiArchAMD64ImageID = "docker.io/library/nginx@sha256:b4af4f8b6470febf45dc10f564551af682a802eda1743055a7dfc8332dffa595"
+	multiArchARM64ImageID = "docker.io/library/nginx@sha256:d2e65182b5fd330470eca9b8e23e8a1a0d87cc9b820eb1fb3f034bf8248d37ee"
+)
+
+// an SBOM named after the index digest of a multi-arch image, listing its platform-specific digests
+//
+//go:embed testdata/sbom-summary-multi-arch.json
+var sbomSummaryMultiArchJson []byte
+
+// multiArchResolver resolves the platform-specific digests of the multi-arch image to its index digest
+func multiArchResolver(_ context.Context, imageID string) ([]string, error) {
+	switch imageID {
+	case multiArchAMD64ImageID, multiArchARM64ImageID:
+		return []string{multiArchIndexImageID}, nil
+	}
+	return nil, nil
+}
+
+func TestImageDigestAliases(t *testing.T) {
+	calls := 0
+	failing := true
+	aliases := newImageDigestAliases(func(ctx context.Context, imageID string) ([]string, error) {
+		calls++
+		if failing {
+			return nil, errors.New("registry unavailable")
+		}
+		return multiArchResolver(ctx, imageID)
+	})
+
+	// image IDs that failed to resolve are resolved again
+	aliases.Resolve(context.TODO(), multiArchAMD64ImageID)
+	assert.Empty(t, aliases.ImageIDs(multiArchIndexImageID))
+	failing = false
+	aliases.Resolve(context.TODO(), multiArchAMD64ImageID)
+	assert.Equal(t, []string{multiArchAMD64ImageID}, aliases.ImageIDs(multiArchIndexImageID))
+	assert.Equal(t, 2, calls)
+
+	// resolved image IDs are not resolved again
+	aliases.Resolve(context.TODO(), multiArchAMD64ImageID)
+	assert.Equal(t, 2, calls)
+
+	// the index digest is another image ID of every platform-specific digest
+	aliases.Resolve(context.TODO(), multiArchARM64ImageID)
+	assert.Equal(t, []string{multiArchAMD64ImageID, multiArchARM64ImageID}, aliases.ImageIDs(multiArchIndexImageID))
+	assert.Empty(t, aliases.ImageIDs(multiArchAMD64ImageID))
+
+	// the nil value resolves nothing
+	var disabled *imageDigestAliases
+	disabled.Resolve(context.TODO(), multiArchAMD64ImageID)
+	assert.Empty(t, disabled.ImageIDs(multiArchIndexImageID))
+}
+
+func TestSBOMImageIDs(t *testing.T) {
+	summary := &spdxv1beta1.SBOMSummary{}
+	assert.NoError(t, json.Unmarshal(sbomSummaryMultiArchJson, summary))
+
+	imageID, err := annotationsToImageID(summary.GetAnnotations())
+	assert.NoError(t, err)
+	// the image IDs are normalized when looked up, see isImageIDTracked
+	assert.Equal(t, []string{
+		"nginx@sha256:0f04e4f646a3f14bf31d8bc8d885b6c951fdcf42589d06845f64d18aec6a3c4d",
+		"nginx@sha256:b4af4f8b6470febf45dc10f564551af682a802eda1743055a7dfc8332dffa595",
+		"nginx@sha256:d2e65182b5fd330470eca9b8e23e8a1a0d87cc9b820eb1fb3f034bf8248d37ee",
+	}, sbomImageIDs(imageID, summary.GetAnnotations()))
+	assert.Equal(t, []string{validImageID}, sbomImageIDs(validImageID, map[string]string{}))
+}
+
+func TestHandleSBOMEventsMultiArchImages(t *testing.T) {
+	annotated := &spdxv1beta1.SBOMSummary{}
+	assert.NoError(t, json.Unmarshal(sbomSummaryMultiArchJson, annotated))
+	unannotated := annotated.DeepCopy()
+	unannotated.Annotations = map[string]string{instanceidv1.ImageIDMetadataKey: multiArchIndexImageID}
+
+	tt := []struct {
+		name         string
+		summary      *spdxv1beta1.SBOMSummary
+		opts         []WatchHandlerOption
+		expectedKept bool
+	}{
+		{
+			name:         "SBOM listing the platform-specific digest of the Pod gets kept",
+			summary:      annotated,
+			expectedKept: true,
+		},
+		{
+			name:         "SBOM of the index digest resolved from the platform-specific digest of the Pod gets kept",
+			summary:      unannotated,
+			opts:         []WatchHandlerOption{WithImageDigestResolver(multiArchResolver)},
+			expectedKept: true,
+		},
+		{
+			name:         "SBOM of the index digest gets deleted if it cannot be resolved",
+			summary:      unannotated,
+			expectedKept: false,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := newRunningPodFake("default", "nginx", map[string]string{"nginx": multiArchAMD64ImageID})
+			k8sAPI, _ := newK8sAPIFake(pod.DeepCopy())
+			ksStorageClient := kssfake.NewSimpleClientset(tc.summary.DeepCopy(), &spdxv1beta1.SBOMSPDXv2p3{ObjectMeta: tc.summary.ObjectMeta})
+			wh, _ := NewWatchHandler(k8sAPI, ksStorageClient, nil, nil, tc.opts...)
+			assert.NoError(t, wh.Start(context.TODO()))
+
+			// the Pod reports the platform-specific digest
+			handlePodEvents(context.TODO(), wh, pod)
+
+			sbomEvents := make(chan watch.Event, 1)
+			sbomEvents <- watch.Event{Type: watch.Added, Object: tc.summary.DeepCopy()}
+			close(sbomEvents)
+			errCh := make(chan error)
+			go wh.HandleSBOMEvents(context.TODO(), sbomEvents, nil, errCh)
+			for err := range errCh {
+				assert.NoError(t, err)
+			}
+
+			_, err := ksStorageClient.SpdxV1beta1().SBOMSummaries("kubescape").Get(context.TODO(), tc.summary.Name, v1.GetOptions{})
+			assert.Equal(t, tc.expectedKept, err == nil)
+
+			// the periodic cleanUp agrees
+			isOrphan, _, ok := wh.sbomOrphanCheck(sbomSummaries, tc.summary)
+			assert.True(t, ok)
+			assert.Equal(t, !tc.expectedKept, isOrphan())
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package watcher
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+)
+
+// StateDump is a point-in-time snapshot of the internal state of a WatchHandler
+type StateDump struct {
+	WlidsToContainerToImageID WlidsToContainerToImageIDMap `json:"wlidsToContainerToImageID"`
+	ImageHashToWlids          map[string][]string          `json:"imageHashToWlids"`
+	InstanceIDs               []string                     `json:"instanceIDs"`
+	PodListResourceVersion    string                       `json:"podListResourceVersion"`
+	Watchers                  map[string]WatcherState      `json:"watchers"`
+	Metrics                   map[string]int64             `json:"metrics"`
+}
+
+// WatcherState is the state of a watcher in a StateDump
+type WatcherState struct {
+	Healthy   bool      `json:"healthy"`
+	LastEvent time.Time `json:"lastEvent"`
+	// BackoffFailures is the number of consecutive failures of its watch, see watchBackoff
+	BackoffFailures int `json:"backoffFailures"`
+	// BackoffRetryAt is when it attempts to watch again after the last failure, zero if it did not fail since last reset
+	BackoffRetryAt time.Time `json:"backoffRetryAt"`
+}
+
+// snapshotState returns a deep copy of the internal maps, along with the state of the watchers and the metrics
+//
+// All the locks are held together so that the returned snapshot is
+// consistent. They are always acquired in the same order: WLIDs map, instance
+// IDs and the image hash map.
+func (wh *WatchHandler) snapshotState() StateDump {
+	wh.wlidsToContainerToImageIDMapMutex.RLock()
+	defer wh.wlidsToContainerToImageIDMapMutex.RUnlock()
+	wh.instanceIDsMutex.RLock()
+	defer wh.instanceIDsMutex.RUnlock()
+	wh.iwMap.mu.RLock()
+	defer wh.iwMap.mu.RUnlock()
+
+	wlids := make(WlidsToContainerToImageIDMap, len(wh.wlidsToContainerToImageIDMap))
+	for wlid, containers := range wh.wlidsToContainerToImageIDMap {
+		wlids[wlid] = make(map[string]string, len(containers))
+		for container, imageID := range containers {
+			wlids[wlid][container] = imageID
+		}
+	}
+
+	imageHashes := make(map[string][]string, len(wh.iwMap.wlidsByImageHash))
+	for imageHash, set := range wh.iwMap.wlidsByImageHash {
+		imageWlids := set.ToSlice()
+		sort.Strings(imageWlids)
+		imageHashes[imageHash] = imageWlids
+	}
+
+	watchers := make(map[string]WatcherState, len(watcherNames))
+	for _, watcherName := range watcherNames {
+		watchers[watcherName] = wh.health.WatcherState(watcherName)
+	}
+
+	return StateDump{
+		WlidsToContainerToImageID: wlids,
+		ImageHashToWlids:          imageHashes,
+		InstanceIDs:               wh.managedInstanceIDSlugs.listInstanceIDs(),
+		PodListResourceVersion:    wh.podListResourceVersion(),
+		Watchers:                  watchers,
+		Metrics:                   wh.metricsUnsafe(),
+	}
+}
+
+// DumpState writes a consolidated diagnostic dump of the tracked state to the logs and returns it
+//
+// It is meant for field debugging, e.g. wired to a SIGUSR1 handler
+func (wh *WatchHandler) DumpState(ctx context.Context) StateDump {
+	state := wh.snapshotState()
+
+	logger.L().Ctx(ctx).Info("watch handler state dump",
+		helpers.Int("wlids", len(state.WlidsToContainerToImageID)),
+		helpers.Int("imageHashes", len(state.ImageHashToWlids)),
+		helpers.Int("instanceIDs", len(state.InstanceIDs)),
+		helpers.String("podListResourceVersion", state.PodListResourceVersion),
+		helpers.Interface("wlidsToContainerToImageID", state.WlidsToContainerToImageID),
+		helpers.Interface("imageHashToWlids", state.ImageHashToWlids),
+		helpers.Interface("instanceIDs", state.InstanceIDs),
+		helpers.Interface("watchers", state.Watchers),
+		helpers.Interface("metrics", state.Metrics),
+	)
+
+	return state
+}
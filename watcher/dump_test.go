@@ -0,0 +1,129 @@
+package watcher
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	core1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestDumpState(t *testing.T) {
+	wh := NewWatchHandlerMock()
+	wh.iwMap = NewImageHashWLIDsMapFrom(imageHashKeys(map[string][]string{
+		"alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547": {"wlid2", "wlid1"},
+		"alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb": {"wlid2"},
+	}))
+	wh.wlidsToContainerToImageIDMap = WlidsToContainerToImageIDMap{
+		"wlid1": {"container1": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"},
+		"wlid2": {"container1": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547", "container2": "alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb"},
+	}
+	wh.managedInstanceIDSlugs = newPodInstanceIDs("instance-id-1", "instance-id-2")
+	wh.setPodListResourceVersion("42")
+	now := time.Now()
+	wh.health = newWatchHealthTracker(time.Minute)
+	wh.useClock(func() time.Time { return now })
+	wh.health.Processed(PodWatcherName)
+	wh.health.Started(SBOMWatcherName)
+	wh.health.BackedOff(SBOMWatcherName, 3, now.Add(time.Second))
+	// the backoff of the Pod watcher was reset
+	wh.health.BackedOff(PodWatcherName, 0, time.Time{})
+	wh.metrics.Inc(metricStalePodWatchRestartsTotal)
+
+	expected := StateDump{
+		WlidsToContainerToImageID: WlidsToContainerToImageIDMap{
+			"wlid1": {"container1": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"},
+			"wlid2": {"container1": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547", "container2": "alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb"},
+		},
+		ImageHashToWlids: map[string][]string{
+			"sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547": {"wlid1", "wlid2"},
+			"sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb": {"wlid2"},
+		},
+		InstanceIDs:            []string{"instance-id-1", "instance-id-2"},
+		PodListResourceVersion: "42",
+		Watchers: map[string]WatcherState{
+			PodWatcherName:                 {Healthy: true, LastEvent: now},
+			SBOMWatcherName:                {Healthy: true, BackoffFailures: 3, BackoffRetryAt: now.Add(time.Second)},
+			SBOMFilteredWatcherName:        {Healthy: true},
+			VulnerabilityManifestWatchName: {Healthy: true},
+			ControllerWatcherName:          {Healthy: true},
+		},
+		Metrics: map[string]int64{
+			metricMutableTagContainersTotal:  0,
+			metricDigestlessContainersTotal:  0,
+			metricPodsPendingImageIDs:        0,
+			metricDeletionQueueDepth:         0,
+			metricTrackedWlids:               2,
+			metricStalePodWatchRestartsTotal: 1,
+		},
+	}
+
+	actual := wh.DumpState(context.TODO())
+	assert.Equal(t, expected, actual)
+
+	// the dump must be a copy that does not reflect later changes
+	wh.addToWlidsToContainerToImageIDMap("wlid3", "container3", "alpine@sha256:8d8beb9fd7bbcfddb9838219929c6ac7c0f44bfd437d52a5c595e2745c1c2316")
+	wh.addToImageIDToWlidsMap("alpine@sha256:8d8beb9fd7bbcfddb9838219929c6ac7c0f44bfd437d52a5c595e2745c1c2316", "wlid3")
+	wh.cleanUpInstanceIDs()
+	actual.WlidsToContainerToImageID["wlid1"]["container1"] = "modified"
+
+	assert.Equal(t, expected.InstanceIDs, actual.InstanceIDs)
+	assert.NotContains(t, actual.WlidsToContainerToImageID, "wlid3")
+	assert.NotContains(t, actual.ImageHashToWlids, "alpine@sha256:8d8beb9fd7bbcfddb9838219929c6ac7c0f44bfd437d52a5c595e2745c1c2316")
+	assert.Equal(t, "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547", wh.GetContainerToImageIDForWlid("wlid1")["container1"])
+}
+
+// TestDumpStateDuringBookmarks dumps the state while the Pod watcher handles bookmarks, to be run with -race
+func TestDumpStateDuringBookmarks(t *testing.T) {
+	ctx := context.TODO()
+	k8sAPI, _ := newK8sAPIFake()
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	wh.setPodListResourceVersion("1")
+
+	bookmarks := 100
+	podsWatch := watch.NewFakeWithChanSize(bookmarks, false)
+	done := make(chan struct{})
+	go func() {
+		wh.handlePodWatcher(ctx, podsWatch, newCommandDeduper(0, (&commandRecorder{}).emit))
+		close(done)
+	}()
+	for i := 1; i <= bookmarks; i++ {
+		podsWatch.Action(watch.Bookmark, &core1.Pod{ObjectMeta: v1.ObjectMeta{ResourceVersion: strconv.Itoa(i)}})
+		wh.DumpState(ctx)
+	}
+	podsWatch.Stop()
+	<-done
+
+	assert.Equal(t, strconv.Itoa(bookmarks), wh.DumpState(ctx).PodListResourceVersion)
+}
+
+func TestWatchBackoffReportsItsState(t *testing.T) {
+	now := time.Now()
+	wh := NewWatchHandlerMock()
+	wh.health = newWatchHealthTracker(time.Minute)
+	b := wh.newWatchBackoff(VulnerabilityManifestWatchName)
+	b.now = func() time.Time { return now }
+	b.jitter = func() float64 { return 0 }
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	b.wait(ctx, VulnerabilityManifestWatchName)
+	b.wait(ctx, VulnerabilityManifestWatchName)
+	state := wh.DumpState(context.TODO()).Watchers[VulnerabilityManifestWatchName]
+	assert.Equal(t, 2, state.BackoffFailures)
+	// the delays of the mock are not doubled, and drawn from the upper half of the backoff
+	assert.Equal(t, now.Add(retryInterval/2), state.BackoffRetryAt)
+
+	// watches that lasted long enough reset the backoff
+	b.Connected()
+	now = now.Add(watchBackoffResetAfter)
+	assert.True(t, b.Disconnected())
+	state = wh.DumpState(context.TODO()).Watchers[VulnerabilityManifestWatchName]
+	assert.Zero(t, state.BackoffFailures)
+	assert.True(t, state.BackoffRetryAt.IsZero())
+}
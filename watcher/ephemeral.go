@@ -0,0 +1,74 @@
+package watcher
+
+import (
+	"github.com/kubescape/operator/utils"
+	core1 "k8s.io/api/core/v1"
+)
+
+// getImageIDsToContainersFromPod returns a map of <imageID> : <containerNames> for the tracked containers of the Pod
+//
+// Ephemeral containers are included only if tracking them is enabled
+func (wh *WatchHandler) getImageIDsToContainersFromPod(pod *core1.Pod) map[string][]string {
+	imageIDsToContainers := extractImageIDsToContainersFromPod(pod)
+	if !wh.trackEphemeralContainers {
+		return imageIDsToContainers
+	}
+
+	for imageID, containers := range extractImageIDsToEphemeralContainersFromPod(pod) {
+		imageIDsToContainers[imageID] = append(imageIDsToContainers[imageID], containers...)
+	}
+	return imageIDsToContainers
+}
+
+// getContainersToImageIDsFromPod returns a map of <containerName> : <imageID> for the tracked containers of the Pod
+//
+// Ephemeral containers are included only if tracking them is enabled
+func (wh *WatchHandler) getContainersToImageIDsFromPod(pod *core1.Pod) map[string]string {
+	containersToImageIDs := utils.ExtractContainersToImageIDsFromPod(pod)
+	if !wh.trackEphemeralContainers {
+		return containersToImageIDs
+	}
+
+	for imageID, containers := range extractImageIDsToEphemeralContainersFromPod(pod) {
+		for _, container := range containers {
+			containersToImageIDs[container] = imageID
+		}
+	}
+	return containersToImageIDs
+}
+
+// removeTerminatedEphemeralContainers removes the ephemeral containers of the Pod that have terminated from the maps of a given WLID
+//
+// The WLID is removed from the image hash map for images that none of its
+// remaining containers use
+func (wh *WatchHandler) removeTerminatedEphemeralContainers(wlid string, pod *core1.Pod) {
+	if !wh.trackEphemeralContainers {
+		return
+	}
+	terminated := extractTerminatedEphemeralContainersFromPod(pod)
+	if len(terminated) == 0 {
+		return
+	}
+
+	wh.wlidsToContainerToImageIDMapMutex.Lock()
+	defer wh.wlidsToContainerToImageIDMapMutex.Unlock()
+
+	removedImageIDs := []string{}
+	for _, containerName := range terminated {
+		if wh.wlidsToContainerToContainerTypeMap[wlid][containerName] != utils.ContainerTypeEphemeralContainer {
+			continue
+		}
+		if imageID, ok := wh.wlidsToContainerToImageIDMap[wlid][containerName]; ok {
+			removedImageIDs = append(removedImageIDs, imageID)
+		}
+		delete(wh.wlidsToContainerToImageIDMap[wlid], containerName)
+		delete(wh.wlidsToContainerToImagePinnedMap[wlid], containerName)
+		delete(wh.wlidsToContainerToContainerTypeMap[wlid], containerName)
+	}
+
+	for _, imageID := range removedImageIDs {
+		if !wh.wlidUsesImageIDUnsafe(wlid, imageID) {
+			wh.removeFromImageIDToWlidsMap(imageID, wlid)
+		}
+	}
+}
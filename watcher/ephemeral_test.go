@@ -0,0 +1,98 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kubescape/operator/utils"
+	"github.com/stretchr/testify/assert"
+	core1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// debuggedImageIDs are the image IDs of the regular containers of the debugged Pod
+var debuggedImageIDs = map[string]string{"app": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"}
+
+// withDebugger adds a debugger ephemeral container to the Pod, in the given state
+func withDebugger(state core1.ContainerState) podFakeOption {
+	return withEphemeralContainer("debugger", "busybox:latest", "docker-pullable://busybox@sha256:22a1f96cbccbde731c101c7b6d6acb307af7e35957a2ea374b8e75f0e6d93620", state)
+}
+
+func TestBuildIDsEphemeralContainers(t *testing.T) {
+	expectedWlid := "wlid://cluster-/namespace-default/pod-debugged"
+	pod := newRunningPodFake("default", "debugged", debuggedImageIDs, withDebugger(core1.ContainerState{Running: &core1.ContainerStateRunning{}}))
+
+	tt := []struct {
+		name                       string
+		trackEphemeralContainers   bool
+		expectedContainerToImageID map[string]string
+	}{
+		{
+			name:                       "Ephemeral containers are ignored by default",
+			trackEphemeralContainers:   false,
+			expectedContainerToImageID: map[string]string{"app": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"},
+		},
+		{
+			name:                       "Ephemeral containers are tracked when enabled",
+			trackEphemeralContainers:   true,
+			expectedContainerToImageID: map[string]string{"app": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547", "debugger": "busybox@sha256:22a1f96cbccbde731c101c7b6d6acb307af7e35957a2ea374b8e75f0e6d93620"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			k8sAPI, _ := newK8sAPIFake(pod)
+			wh := NewWatchHandlerMock()
+			wh.k8sAPI = k8sAPI
+			wh.trackEphemeralContainers = tc.trackEphemeralContainers
+
+			_ = wh.buildIDs(context.TODO(), podListIterator(&core1.PodList{Items: []core1.Pod{*pod}}))
+
+			_, ephemeralImageTracked := wh.iwMap.Load(imageHashKey("busybox@sha256:22a1f96cbccbde731c101c7b6d6acb307af7e35957a2ea374b8e75f0e6d93620"))
+			assert.Equal(t, tc.trackEphemeralContainers, ephemeralImageTracked)
+			assert.Equal(t, tc.expectedContainerToImageID, wh.GetContainerToImageIDForWlid(expectedWlid))
+		})
+	}
+}
+
+func TestHandlePodWatcherEphemeralContainers(t *testing.T) {
+	expectedWlid := "wlid://cluster-/namespace-default/pod-debugged"
+	runningPod := newRunningPodFake("default", "debugged", debuggedImageIDs, withDebugger(core1.ContainerState{Running: &core1.ContainerStateRunning{}}))
+	terminatedPod := newRunningPodFake("default", "debugged", debuggedImageIDs, withDebugger(core1.ContainerState{Terminated: &core1.ContainerStateTerminated{}}))
+
+	// the API serves the last state of the Pod, relisted once the watch ends
+	k8sAPI, _ := newK8sAPIFake(terminatedPod.DeepCopy())
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	wh.trackEphemeralContainers = true
+	// the regular container is already known
+	wh.addToImageIDToWlidsMap("alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547", expectedWlid)
+	wh.addToWlidsToContainerToImageIDMap(expectedWlid, "app", "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547")
+
+	recorder := &commandRecorder{}
+	podsWatch := watch.NewFake()
+	done := make(chan struct{})
+	go func() {
+		wh.handlePodWatcher(context.TODO(), podsWatch, newCommandDeduper(0, recorder.emit))
+		close(done)
+	}()
+
+	// attaching an ephemeral container with a new image triggers a scan of the parent WLID
+	podsWatch.Modify(runningPod)
+	assert.Eventually(t, func() bool { return len(recorder.emitted()) == 1 }, time.Second, 10*time.Millisecond)
+	cmd := recorder.emitted()[0]
+	assert.Equal(t, expectedWlid, cmd.Wlid)
+	assert.Equal(t, map[string]string{"debugger": "busybox@sha256:22a1f96cbccbde731c101c7b6d6acb307af7e35957a2ea374b8e75f0e6d93620"}, cmd.Args[utils.ContainerToImageIdsArg])
+	assert.Equal(t, map[string]string{"debugger": utils.ContainerTypeEphemeralContainer}, cmd.Args[utils.ContainerToContainerTypeArg])
+
+	// once the ephemeral container terminates, its entries are cleaned up
+	podsWatch.Modify(terminatedPod)
+	podsWatch.Stop()
+	<-done
+
+	_, ephemeralImageTracked := wh.iwMap.Load(imageHashKey("busybox@sha256:22a1f96cbccbde731c101c7b6d6acb307af7e35957a2ea374b8e75f0e6d93620"))
+	assert.False(t, ephemeralImageTracked)
+	assert.Equal(t, map[string]string{"app": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"}, wh.GetContainerToImageIDForWlid(expectedWlid))
+	assert.Equal(t, []string{expectedWlid}, wh.GetWlidsForImageHash("alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"))
+}
@@ -1,13 +1,60 @@
 package watcher
 
 import (
+	"context"
 	"errors"
+	"fmt"
+
+	"github.com/kubescape/go-logger"
 )
 
 var (
 	errInvalidImageID = errors.New("input is not valid Image ID")
 
-	ErrMissingInstanceIDAnnotation = errors.New("object is missing Instance ID annotation")
-	ErrMissingWLIDAnnotation       = errors.New("object is missing the WLID annotation")
-	ErrMissingImageIDAnnotation    = errors.New("object is missing the Image ID annotation")
+	ErrMissingInstanceIDAnnotation   = errors.New("object is missing Instance ID annotation")
+	ErrMalformedInstanceIDAnnotation = errors.New("object has a malformed Instance ID annotation")
+	ErrMissingWLIDAnnotation         = errors.New("object is missing the WLID annotation")
+	ErrMissingImageIDAnnotation      = errors.New("object is missing the Image ID annotation")
+	ErrWatchStatus                   = errors.New("watch failed with a status")
+	ErrInternalMapsNotBuilt          = errors.New("the internal maps were not built from the Pods yet")
+	ErrAlreadyStarted                = errors.New("the watch handler was started already")
+	ErrMissingKubernetesClient       = errors.New("the watch handler requires a Kubernetes client")
+	ErrMissingStorageClient          = errors.New("the watch handler requires a storage client")
+)
+
+// Names of the watchers, as reported in a WatchError
+const (
+	SBOMWatcherName                = "SBOMWatch"
+	SBOMFilteredWatcherName        = "SBOMFilteredWatch"
+	VulnerabilityManifestWatchName = "VulnerabilityManifestWatch"
+	PodWatcherName                 = "PodWatch"
+	ControllerWatcherName          = "ControllerWatch"
 )
+
+// watcherNames are the names of all the watchers
+var watcherNames = []string{PodWatcherName, SBOMWatcherName, SBOMFilteredWatcherName, VulnerabilityManifestWatchName, ControllerWatcherName}
+
+// WatchError is an error that occurred while running one of the watchers
+type WatchError struct {
+	// Watcher is the name of the watcher that produced the error
+	Watcher string
+	Err     error
+}
+
+func (e *WatchError) Error() string {
+	return fmt.Sprintf("error in %s: %v", e.Watcher, e.Err)
+}
+
+func (e *WatchError) Unwrap() error {
+	return e.Err
+}
+
+// reportError logs an error produced by a watcher and passes it to the error handler, if any, see WithErrorHandler
+func (wh *WatchHandler) reportError(ctx context.Context, watcherName string, err error) {
+	watchErr := &WatchError{Watcher: watcherName, Err: err}
+	logger.L().Ctx(ctx).Error(watchErr.Error())
+
+	if wh.errorHandler != nil {
+		wh.errorHandler(watchErr)
+	}
+}
@@ -0,0 +1,133 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/armosec/armoapi-go/apis"
+	instanceidv1 "github.com/kubescape/k8s-interface/instanceidhandler/v1"
+	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestWatchError(t *testing.T) {
+	err := &WatchError{Watcher: SBOMWatcherName, Err: ErrUnsupportedObject}
+
+	assert.Equal(t, "error in SBOMWatch: unsupported object type", err.Error())
+	assert.ErrorIs(t, err, ErrUnsupportedObject)
+}
+
+func TestSBOMWatchReportsErrorsToHandler(t *testing.T) {
+	fakeWatcher := watch.NewFake()
+	storageClient := kssfake.NewSimpleClientset()
+	storageClient.PrependWatchReactor("sbomsummaries", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		return true, fakeWatcher, nil
+	})
+
+	wh := NewWatchHandlerMock()
+	wh.storageClient = storageClient
+
+	reportedErrors := make(chan error, 1)
+	WithErrorHandler(func(err error) {
+		select {
+		case reportedErrors <- err:
+		default:
+		}
+	})(wh)
+
+	go wh.SBOMWatch(context.TODO(), &commandRecorder{})
+
+	// an SBOM summary without the image ID annotation produces an error
+	fakeWatcher.Add(&spdxv1beta1.SBOMSummary{ObjectMeta: v1.ObjectMeta{Name: "missing-annotation", Labels: managedLabels()}})
+
+	select {
+	case err := <-reportedErrors:
+		var watchErr *WatchError
+		assert.True(t, errors.As(err, &watchErr))
+		assert.Equal(t, SBOMWatcherName, watchErr.Watcher)
+		assert.ErrorIs(t, err, ErrMissingImageIDAnnotation)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the error to be reported")
+	}
+}
+
+// failingCommandSink fails to deliver any command
+type failingCommandSink struct {
+	err error
+}
+
+func (s failingCommandSink) Send(_ context.Context, _ *apis.Command) error {
+	return s.err
+}
+
+func TestStartSBOMWatchersReportsUndeliveredCommandsPerKind(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	errQueueFull := errors.New("queue full")
+	wlid := "wlid://cluster-/namespace-default/deployment-nginx"
+
+	k8sAPI, _ := newK8sAPIFake()
+	storageClient := kssfake.NewSimpleClientset()
+	reportedErrors := make(chan error, 1)
+	wh, err := NewWatchHandler(k8sAPI, storageClient, map[string][]string{"nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240": {wlid}}, nil,
+		WithErrorHandler(func(err error) {
+			select {
+			case reportedErrors <- err:
+			default:
+			}
+		}))
+	assert.NoError(t, err)
+	// created once the handler started, to trigger the scans of its image
+	summary := &spdxv1beta1.SBOMSummary{ObjectMeta: v1.ObjectMeta{
+		Name:              "nginx",
+		Namespace:         "kubescape",
+		Labels:            managedLabels(),
+		Annotations:       map[string]string{instanceidv1.ImageIDMetadataKey: "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"},
+		CreationTimestamp: v1.Now(),
+	}}
+	_, err = storageClient.SpdxV1beta1().SBOMSummaries("kubescape").Create(ctx, summary, v1.CreateOptions{})
+	assert.NoError(t, err)
+
+	wh.StartSBOMWatchers(ctx, failingCommandSink{err: errQueueFull})
+
+	select {
+	case err := <-reportedErrors:
+		var watchErr *WatchError
+		assert.True(t, errors.As(err, &watchErr))
+		assert.Equal(t, SBOMWatcherName, watchErr.Watcher, "the commands of SBOM summaries should be reported by their own watcher")
+		assert.ErrorIs(t, err, errQueueFull)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the error to be reported")
+	}
+}
+
+func TestSendToReportsUndeliveredCommands(t *testing.T) {
+	errQueueFull := errors.New("queue full")
+	wh := NewWatchHandlerMock()
+
+	var reportedErrors []error
+	WithErrorHandler(func(err error) {
+		reportedErrors = append(reportedErrors, err)
+	})(wh)
+
+	send := wh.sendTo(context.TODO(), failingCommandSink{err: errQueueFull}, PodWatcherName)
+	send(getImageScanCommand("wlid://cluster-/namespace-default/deployment-nginx", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"}))
+
+	if assert.Len(t, reportedErrors, 1) {
+		var watchErr *WatchError
+		assert.True(t, errors.As(reportedErrors[0], &watchErr))
+		assert.Equal(t, PodWatcherName, watchErr.Watcher)
+		assert.ErrorIs(t, reportedErrors[0], errQueueFull)
+	}
+
+	recorder := &commandRecorder{}
+	wh.sendTo(context.TODO(), recorder, PodWatcherName)(getImageScanCommand("wlid://cluster-/namespace-default/deployment-nginx", nil))
+	assert.Len(t, recorder.emitted(), 1)
+	assert.Len(t, reportedErrors, 1, "delivered commands should not be reported")
+}
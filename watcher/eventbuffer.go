@@ -0,0 +1,58 @@
+package watcher
+
+import (
+	"context"
+
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// metricWatchEventBufferFullTotal is the number of events the watch readers had to wait for room in their buffer for, see WithEventBufferSize
+const metricWatchEventBufferFullTotal = "operator_watch_event_buffer_full_total"
+
+// bufferEvents returns a handle passing the events of a watch to the given one through a buffer, and a function stopping it
+//
+// The buffered events are handled in order by a single goroutine, so slow
+// handlers, e.g. waiting for the storage to delete an object, do not hold off
+// the reader of the watch. When the buffer is full, the reader waits for room
+// in it until the context is done, so the watch is backpressured rather than
+// its events dropped. Stopping waits for the buffered events to be handled,
+// those left once the context is done being skipped. runWatchRetry buffers
+// the events of all its watches through the same buffer, so the events are
+// buffered across reconnects.
+//
+// Without a buffer size, handle is returned as is, and the events are handled
+// by the reader of the watch.
+func (wh *WatchHandler) bufferEvents(ctx context.Context, handle func(event watch.Event)) (func(event watch.Event), func()) {
+	if wh.eventBufferSize <= 0 {
+		return handle, func() {}
+	}
+
+	events := make(chan watch.Event, wh.eventBufferSize)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for event := range events {
+			if ctx.Err() == nil {
+				handle(event)
+			}
+		}
+	}()
+
+	enqueue := func(event watch.Event) {
+		select {
+		case events <- event:
+			return
+		default:
+		}
+		wh.metrics.Inc(metricWatchEventBufferFullTotal)
+		select {
+		case events <- event:
+		case <-ctx.Done():
+		}
+	}
+	stop := func() {
+		close(events)
+		<-done
+	}
+	return enqueue, stop
+}
@@ -0,0 +1,105 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestBufferEvents(t *testing.T) {
+	event := func(name string) watch.Event {
+		return watch.Event{Type: watch.Modified, Object: &v1.PartialObjectMetadata{ObjectMeta: v1.ObjectMeta{Name: name}}}
+	}
+	name := func(event watch.Event) string {
+		return event.Object.(*v1.PartialObjectMetadata).Name
+	}
+
+	t.Run("without a size the events are handled as they are read", func(t *testing.T) {
+		var handled []string
+		handle, stop := NewWatchHandlerMock().bufferEvents(context.TODO(), func(event watch.Event) { handled = append(handled, name(event)) })
+		handle(event("nginx"))
+		assert.Equal(t, []string{"nginx"}, handled)
+		stop()
+	})
+
+	t.Run("slow handlers do not hold off the reader", func(t *testing.T) {
+		defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+		wh := NewWatchHandlerMock()
+		WithEventBufferSize(2)(wh)
+		handling := make(chan struct{}, 4)
+		release := make(chan struct{})
+		var handled []string
+		handle, stop := wh.bufferEvents(context.TODO(), func(event watch.Event) {
+			handling <- struct{}{}
+			<-release
+			handled = append(handled, name(event))
+		})
+
+		// the first event is taken by the handler, the next two are buffered
+		handle(event("nginx"))
+		<-handling
+		handle(event("redis"))
+		handle(event("mysql"))
+		assert.Zero(t, wh.metrics.Get(metricWatchEventBufferFullTotal), "the reader should not wait for the handler while the buffer has room")
+
+		// the buffer is full, so the reader waits for the handler
+		read := make(chan struct{})
+		go func() {
+			handle(event("postgres"))
+			close(read)
+		}()
+		assert.Eventually(t, func() bool { return wh.metrics.Get(metricWatchEventBufferFullTotal) == 1 }, time.Second, 5*time.Millisecond)
+		select {
+		case <-read:
+			t.Fatal("the reader should wait for room in a full buffer")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(release)
+		<-read
+		stop()
+		assert.Equal(t, []string{"nginx", "redis", "mysql", "postgres"}, handled, "the events should be handled in order")
+	})
+
+	t.Run("the reader stops waiting once the context is done", func(t *testing.T) {
+		defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+		wh := NewWatchHandlerMock()
+		WithEventBufferSize(1)(wh)
+		ctx, cancel := context.WithCancel(context.TODO())
+		handling := make(chan struct{}, 2)
+		release := make(chan struct{})
+		handled := 0
+		handle, stop := wh.bufferEvents(ctx, func(event watch.Event) {
+			handling <- struct{}{}
+			<-release
+			handled++
+		})
+		handle(event("nginx"))
+		<-handling
+		handle(event("redis"))
+
+		read := make(chan struct{})
+		go func() {
+			handle(event("mysql"))
+			close(read)
+		}()
+		assert.Eventually(t, func() bool { return wh.metrics.Get(metricWatchEventBufferFullTotal) == 1 }, time.Second, 5*time.Millisecond)
+		cancel()
+		select {
+		case <-read:
+		case <-time.After(time.Second):
+			t.Fatal("the reader should stop waiting once the context is done")
+		}
+
+		close(release)
+		stop()
+		assert.Equal(t, 1, handled, "the events left once the context is done should be skipped")
+	})
+}
@@ -0,0 +1,150 @@
+package watcher
+
+import (
+	"sync"
+	"time"
+)
+
+// HealthStatus reports the liveness of the watchers
+//
+// A watcher is healthy if it processed an event or established its watch
+// within the health threshold. Watchers that were not started yet are
+// reported healthy, as they cannot have died.
+type HealthStatus struct {
+	PodWatchHealthy   bool      `json:"podWatchHealthy"`
+	PodWatchLastEvent time.Time `json:"podWatchLastEvent"`
+	// PodWatchStaleness is for how long the Pod watch has not been known to be current, see podWatchdog
+	PodWatchStaleness          time.Duration `json:"podWatchStaleness"`
+	PodWatchLastRelist         time.Time     `json:"podWatchLastRelist"`
+	SBOMWatchHealthy           bool          `json:"sbomWatchHealthy"`
+	SBOMWatchLastEvent         time.Time     `json:"sbomWatchLastEvent"`
+	SBOMFilteredWatchHealthy   bool          `json:"sbomFilteredWatchHealthy"`
+	SBOMFilteredWatchLastEvent time.Time     `json:"sbomFilteredWatchLastEvent"`
+	VulnManifestWatchHealthy   bool          `json:"vulnManifestWatchHealthy"`
+	VulnManifestWatchLastEvent time.Time     `json:"vulnManifestWatchLastEvent"`
+}
+
+// Healthy returns true if all the watchers are healthy
+func (s HealthStatus) Healthy() bool {
+	return s.PodWatchHealthy && s.SBOMWatchHealthy && s.SBOMFilteredWatchHealthy && s.VulnManifestWatchHealthy
+}
+
+// watchHealthTracker tracks the activity of the watchers
+//
+// The nil value tracks nothing and reports every watcher healthy.
+type watchHealthTracker struct {
+	threshold    time.Duration
+	lastEvent    map[string]time.Time         // last event processed by each watcher
+	lastActivity map[string]time.Time         // last event processed or watch established by each watcher
+	backoffs     map[string]watchBackoffState // backoff of each watcher after the last failure of its watch
+	now          clock
+	mu           sync.RWMutex
+}
+
+// watchBackoffState is the backoff of a watcher, see watchBackoff
+type watchBackoffState struct {
+	failures int
+	retryAt  time.Time
+}
+
+func newWatchHealthTracker(threshold time.Duration) *watchHealthTracker {
+	return &watchHealthTracker{
+		threshold:    threshold,
+		lastEvent:    make(map[string]time.Time),
+		lastActivity: make(map[string]time.Time),
+		backoffs:     make(map[string]watchBackoffState),
+		now:          time.Now,
+	}
+}
+
+// Started records that the watcher with the given name started, so that it is unhealthy if it never establishes its watch
+func (h *watchHealthTracker) Started(watcherName string) {
+	h.Connected(watcherName)
+}
+
+// Connected records that the watcher with the given name established its watch
+func (h *watchHealthTracker) Connected(watcherName string) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastActivity[watcherName] = h.now()
+}
+
+// Processed records that the watcher with the given name processed an event
+func (h *watchHealthTracker) Processed(watcherName string) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.now()
+	h.lastEvent[watcherName] = now
+	h.lastActivity[watcherName] = now
+}
+
+// Status returns whether the watcher with the given name is healthy and the time of its last processed event, if any
+func (h *watchHealthTracker) Status(watcherName string) (bool, time.Time) {
+	if h == nil {
+		return true, time.Time{}
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.statusUnsafe(watcherName)
+}
+
+// statusUnsafe is Status without locking
+//
+// NOT THREAD SAFE! Assumes the caller is holding the lock of the tracker.
+func (h *watchHealthTracker) statusUnsafe(watcherName string) (bool, time.Time) {
+	lastActivity, started := h.lastActivity[watcherName]
+	healthy := !started || h.now().Sub(lastActivity) <= h.threshold
+	return healthy, h.lastEvent[watcherName]
+}
+
+// BackedOff records that the watcher with the given name backs off until retryAt after the given number of consecutive failures, none once its backoff is reset
+func (h *watchHealthTracker) BackedOff(watcherName string, failures int, retryAt time.Time) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.backoffs[watcherName] = watchBackoffState{failures: failures, retryAt: retryAt}
+}
+
+// WatcherState returns the liveness and the backoff of the watcher with the given name, see StateDump
+func (h *watchHealthTracker) WatcherState(watcherName string) WatcherState {
+	if h == nil {
+		return WatcherState{Healthy: true}
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var state WatcherState
+	state.Healthy, state.LastEvent = h.statusUnsafe(watcherName)
+	backoff := h.backoffs[watcherName]
+	state.BackoffFailures, state.BackoffRetryAt = backoff.failures, backoff.retryAt
+	return state
+}
+
+// HealthStatus returns the liveness of the watchers, e.g. for a liveness probe
+func (wh *WatchHandler) HealthStatus() HealthStatus {
+	var status HealthStatus
+	status.PodWatchHealthy, status.PodWatchLastEvent = wh.health.Status(PodWatcherName)
+	status.PodWatchStaleness = wh.podWatchdog.Staleness()
+	status.PodWatchLastRelist = wh.podWatchdog.LastRelist()
+	status.SBOMWatchHealthy, status.SBOMWatchLastEvent = wh.health.Status(SBOMWatcherName)
+	status.SBOMFilteredWatchHealthy, status.SBOMFilteredWatchLastEvent = wh.health.Status(SBOMFilteredWatcherName)
+	status.VulnManifestWatchHealthy, status.VulnManifestWatchLastEvent = wh.health.Status(VulnerabilityManifestWatchName)
+	return status
+}
@@ -0,0 +1,102 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	core1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestWatchHealthTracker(t *testing.T) {
+	start := time.Now()
+	now := start
+	h := newWatchHealthTracker(time.Minute)
+	h.now = func() time.Time { return now }
+
+	healthy, lastEvent := h.Status(SBOMWatcherName)
+	assert.True(t, healthy, "watchers that were not started should be healthy")
+	assert.True(t, lastEvent.IsZero())
+
+	// the watcher never connects
+	h.Started(SBOMWatcherName)
+	now = now.Add(time.Minute)
+	healthy, _ = h.Status(SBOMWatcherName)
+	assert.True(t, healthy)
+	now = now.Add(time.Second)
+	healthy, _ = h.Status(SBOMWatcherName)
+	assert.False(t, healthy, "watchers that never connect should become unhealthy")
+
+	// it reconnects, then processes an event
+	h.Connected(SBOMWatcherName)
+	healthy, lastEvent = h.Status(SBOMWatcherName)
+	assert.True(t, healthy)
+	assert.True(t, lastEvent.IsZero(), "connecting should not count as processing an event")
+
+	now = now.Add(30 * time.Second)
+	h.Processed(SBOMWatcherName)
+	eventAt := now
+	now = now.Add(time.Minute)
+	healthy, lastEvent = h.Status(SBOMWatcherName)
+	assert.True(t, healthy)
+	assert.Equal(t, eventAt, lastEvent)
+
+	// and goes silent
+	now = now.Add(time.Second)
+	healthy, lastEvent = h.Status(SBOMWatcherName)
+	assert.False(t, healthy)
+	assert.Equal(t, eventAt, lastEvent)
+
+	healthy, _ = h.Status(PodWatcherName)
+	assert.True(t, healthy, "watchers should be tracked separately")
+}
+
+func TestHealthStatus(t *testing.T) {
+	wh := NewWatchHandlerMock()
+	assert.True(t, wh.HealthStatus().Healthy(), "the nil tracker should report every watcher healthy")
+
+	now := time.Now()
+	wh.health = newWatchHealthTracker(time.Minute)
+	wh.useClock(func() time.Time { return now })
+	wh.health.Started(PodWatcherName)
+	wh.health.Started(SBOMWatcherName)
+	wh.health.Started(SBOMFilteredWatcherName)
+	wh.health.Started(VulnerabilityManifestWatchName)
+	now = now.Add(time.Hour)
+	wh.health.Processed(SBOMFilteredWatcherName)
+
+	status := wh.HealthStatus()
+	assert.Equal(t, HealthStatus{SBOMFilteredWatchHealthy: true, SBOMFilteredWatchLastEvent: now}, status)
+	assert.False(t, status.Healthy())
+}
+
+func TestPodWatchReportsActivity(t *testing.T) {
+	fakeWatcher := watch.NewFake()
+	k8sAPI, k8sClient := newK8sAPIFake()
+	k8sClient.PrependWatchReactor("pods", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		return true, fakeWatcher, nil
+	})
+
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	wh.health = newWatchHealthTracker(time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		wh.PodWatch(ctx, &commandRecorder{})
+		close(done)
+	}()
+
+	before := time.Now()
+	fakeWatcher.Action(watch.Bookmark, &core1.Pod{})
+	assert.Eventually(t, func() bool { return !wh.HealthStatus().PodWatchLastEvent.Before(before) }, time.Second, 10*time.Millisecond, "bookmarks should count as activity")
+	assert.True(t, wh.HealthStatus().PodWatchHealthy)
+
+	cancel()
+	fakeWatcher.Stop()
+	<-done
+}
@@ -0,0 +1,113 @@
+package watcher
+
+import (
+	"context"
+	"sync"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	"github.com/kubescape/operator/utils"
+	core1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// metricPodsPendingImageIDs is the number of running Pods deferred until their container statuses report image IDs
+const metricPodsPendingImageIDs = "operator_pods_pending_image_ids"
+
+// pendingImageIDPods tracks the running Pods whose containers do not report image IDs yet
+//
+// The kubelet populates the image IDs of the container statuses once the
+// images are pulled, which may happen after the Pod is reported running, e.g.
+// with a slow CRI. Such Pods are not tracked until a later event of the Pod
+// watcher, or a retry of their event, reports all their image IDs, so that
+// they are scanned once complete.
+type pendingImageIDPods struct {
+	keys map[string]struct{}
+	mu   sync.Mutex
+}
+
+// Add starts tracking a Pod as pending
+func (p *pendingImageIDPods) Add(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.keys == nil {
+		p.keys = make(map[string]struct{})
+	}
+	p.keys[key] = struct{}{}
+}
+
+// Remove stops tracking a Pod as pending, returning whether it was pending
+func (p *pendingImageIDPods) Remove(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, ok := p.keys[key]
+	delete(p.keys, key)
+	return ok
+}
+
+// Len returns the number of pending Pods
+func (p *pendingImageIDPods) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.keys)
+}
+
+// Reset stops tracking all the pending Pods
+func (p *pendingImageIDPods) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.keys = nil
+}
+
+// hasMissingImageIDs reports whether a running container of the Pod that would be tracked has no image ID yet, see utils.ContainerImageID
+func (wh *WatchHandler) hasMissingImageIDs(pod *core1.Pod) bool {
+	statuses := append(pod.Status.ContainerStatuses[:len(pod.Status.ContainerStatuses):len(pod.Status.ContainerStatuses)], pod.Status.InitContainerStatuses...)
+	if wh.trackEphemeralContainers {
+		statuses = append(statuses, pod.Status.EphemeralContainerStatuses...)
+	}
+	for i := range statuses {
+		if _, ok := utils.ContainerImageID(statuses[i]); statuses[i].State.Running != nil && !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// latestPodWithImageIDs returns the current Pod of an event if the Pod of the event misses image IDs, as they may have been reported since
+//
+// The Pod of the event is returned if it misses no image ID, or if its
+// current state cannot be fetched, e.g. once it is deleted or recreated.
+func (wh *WatchHandler) latestPodWithImageIDs(ctx context.Context, pod *core1.Pod) *core1.Pod {
+	if wh.k8sAPI == nil || !wh.hasMissingImageIDs(pod) {
+		return pod
+	}
+	latest, err := wh.k8sAPI.KubernetesClient.CoreV1().Pods(pod.GetNamespace()).Get(ctx, pod.GetName(), v1.GetOptions{})
+	if err != nil || latest.GetUID() != pod.GetUID() {
+		return pod
+	}
+	latest.APIVersion = "v1"
+	latest.Kind = "Pod"
+	return latest
+}
+
+// deferPodWithoutImageIDs reports whether the Pod should not be handled yet, as some of its image IDs are missing
+//
+// Deferred Pods are tracked as pending until an event reports all their image IDs
+func (wh *WatchHandler) deferPodWithoutImageIDs(ctx context.Context, pod *core1.Pod) bool {
+	key := pod.GetNamespace() + "/" + pod.GetName()
+	if wh.hasMissingImageIDs(pod) {
+		wh.pendingImageIDs.Add(key)
+		logger.L().Ctx(ctx).Debug("deferring Pod until its containers report image IDs",
+			helpers.String("pod", pod.GetName()), helpers.String("namespace", pod.GetNamespace()))
+		return true
+	}
+	if wh.pendingImageIDs.Remove(key) {
+		logger.L().Ctx(ctx).Debug("containers of deferred Pod report image IDs",
+			helpers.String("pod", pod.GetName()), helpers.String("namespace", pod.GetNamespace()))
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package watcher
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kubescape/operator/utils"
+	"github.com/stretchr/testify/assert"
+	core1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// slowPullImageIDs are the image IDs of the containers of the slow-pull Pod, whose sidecar container may not report its image ID yet, see withImageID
+var slowPullImageIDs = map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240", "sidecar": "envoy@sha256:73971a8f26642b2749d12b0c0692ac2e75ea36137badf768fd3ef11da87c570f"}
+
+func TestHasMissingImageIDs(t *testing.T) {
+	running := core1.ContainerState{Running: &core1.ContainerStateRunning{}}
+	waitingPod := newRunningPodFake("default", "slow-pull", slowPullImageIDs, withImageID("sidecar", ""))
+	waitingPod.Status.ContainerStatuses[1].State = core1.ContainerState{Waiting: &core1.ContainerStateWaiting{}}
+	initPod := newRunningPodFake("default", "sidecar", map[string]string{"app": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"})
+	initPod.Status.InitContainerStatuses = []core1.ContainerStatus{{Name: "sidecar", ImageID: "docker-pullable://", State: running}}
+	debuggedPod := newRunningPodFake("default", "debugged", map[string]string{"app": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"},
+		withEphemeralContainer("debugger", "busybox:latest", "", running))
+
+	tt := []struct {
+		name                     string
+		pod                      *core1.Pod
+		trackEphemeralContainers bool
+		expected                 bool
+	}{
+		{
+			name:     "running container without an image ID",
+			pod:      newRunningPodFake("default", "slow-pull", slowPullImageIDs, withImageID("sidecar", "")),
+			expected: true,
+		},
+		{
+			name: "running containers with their image IDs",
+			pod:  newRunningPodFake("default", "nginx", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"}),
+		},
+		{
+			name: "waiting containers have no image ID until they start",
+			pod:  waitingPod,
+		},
+		{
+			name:     "image IDs made of the scheme of the runtime only are missing too, also for running init containers",
+			pod:      initPod,
+			expected: true,
+		},
+		{
+			name: "ephemeral containers do not count unless they are tracked",
+			pod:  debuggedPod,
+		},
+		{
+			name:                     "tracked ephemeral containers count",
+			pod:                      debuggedPod,
+			trackEphemeralContainers: true,
+			expected:                 true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			wh := NewWatchHandlerMock()
+			wh.trackEphemeralContainers = tc.trackEphemeralContainers
+			assert.Equal(t, tc.expected, wh.hasMissingImageIDs(tc.pod))
+		})
+	}
+}
+
+func TestHandlePodWatcherDefersPodsWithoutImageIDs(t *testing.T) {
+	expectedWlid := "wlid://cluster-/namespace-default/pod-slow-pull"
+	completePod := newRunningPodFake("default", "slow-pull", slowPullImageIDs)
+
+	tt := []struct {
+		name string
+		// listed is set if the Pod is listed before watching, e.g. on startup
+		listed bool
+	}{
+		{name: "watched Pod"},
+		{name: "listed Pod", listed: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			k8sAPI, _ := newK8sAPIFake(completePod.DeepCopy())
+			wh := NewWatchHandlerMock()
+			wh.k8sAPI = k8sAPI
+
+			if tc.listed {
+				assert.NoError(t, wh.buildIDs(context.TODO(), podListIterator(&core1.PodList{Items: []core1.Pod{*newRunningPodFake("default", "slow-pull", slowPullImageIDs, withImageID("sidecar", ""))}})))
+				assert.Empty(t, wh.GetWlidsToContainerToImageIDMap(), "Pods missing image IDs should not be tracked")
+				assert.Equal(t, int64(1), wh.Metrics()[metricPodsPendingImageIDs])
+			}
+
+			recorder := &commandRecorder{}
+			podsWatch := watch.NewFake()
+			done := make(chan struct{})
+			go func() {
+				wh.handlePodWatcher(context.TODO(), podsWatch, newCommandDeduper(0, recorder.emit))
+				close(done)
+			}()
+
+			// the image ID of the sidecar is reported on the second event only
+			podsWatch.Modify(newRunningPodFake("default", "slow-pull", slowPullImageIDs, withImageID("sidecar", "")))
+			podsWatch.Modify(completePod.DeepCopy())
+			podsWatch.Modify(completePod.DeepCopy())
+			assert.Eventually(t, func() bool { return len(recorder.emitted()) == 1 }, time.Second, 10*time.Millisecond)
+			podsWatch.Stop()
+			<-done
+
+			emitted := recorder.emitted()
+			assert.Len(t, emitted, 1)
+			assert.Equal(t, expectedWlid, emitted[0].Wlid)
+			assert.Equal(t, map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240", "sidecar": "envoy@sha256:73971a8f26642b2749d12b0c0692ac2e75ea36137badf768fd3ef11da87c570f"}, emitted[0].Args[utils.ContainerToImageIdsArg])
+			assert.NotContains(t, wh.iwMap.Map(), "", "empty image IDs should never be tracked")
+			assert.Equal(t, int64(0), wh.Metrics()[metricPodsPendingImageIDs])
+		})
+	}
+}
+
+func TestHandlePodEventRetriesPodsWithoutImageIDs(t *testing.T) {
+	expectedWlid := "wlid://cluster-/namespace-default/pod-slow-pull"
+	completePod := newRunningPodFake("default", "slow-pull", slowPullImageIDs)
+
+	tt := []struct {
+		name string
+		// completeAfter is the number of times the Pod is fetched before it reports its image IDs, negative if it never does
+		completeAfter    int
+		expectedCommands int
+		expectedDropped  int64
+	}{
+		{name: "image IDs reported before the retries run out", completeAfter: 2, expectedCommands: 1},
+		{name: "image IDs never reported", completeAfter: -1, expectedDropped: 1},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			k8sAPI, k8sClient := newK8sAPIFake()
+			var mu sync.Mutex
+			fetched := 0
+			k8sClient.PrependReactor("get", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				fetched++
+				if tc.completeAfter >= 0 && fetched > tc.completeAfter {
+					return true, completePod.DeepCopy(), nil
+				}
+				return true, newRunningPodFake("default", "slow-pull", slowPullImageIDs, withImageID("sidecar", "")), nil
+			})
+			wh := NewWatchHandlerMock()
+			wh.k8sAPI = k8sAPI
+			wh.podEventRetries = 3
+
+			// a single event reports the Pod, no later one reports its image IDs
+			recorder := &commandRecorder{}
+			podsWatch := watch.NewFake()
+			done := make(chan struct{})
+			go func() {
+				wh.handlePodWatcher(context.TODO(), podsWatch, newCommandDeduper(0, recorder.emit))
+				close(done)
+			}()
+			podsWatch.Modify(newRunningPodFake("default", "slow-pull", slowPullImageIDs, withImageID("sidecar", "")))
+			podsWatch.Stop()
+			<-done
+
+			emitted := recorder.emitted()
+			assert.Len(t, emitted, tc.expectedCommands)
+			if tc.expectedCommands > 0 {
+				assert.Equal(t, expectedWlid, emitted[0].Wlid)
+			}
+			assert.Equal(t, tc.expectedDropped, wh.metrics.Get(metricPodEventsDroppedTotal))
+			assert.NotContains(t, wh.iwMap.Map(), "", "empty image IDs should never be tracked")
+			mu.Lock()
+			defer mu.Unlock()
+			if tc.completeAfter < 0 {
+				assert.Equal(t, wh.podEventRetries+1, fetched, "the retries should be bounded")
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package watcher
+
+import (
+	"sort"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// podInstanceIDs records the hashed instance IDs of the tracked Pods, by Pod UID
+//
+// Recording which Pod contributed each instance ID lets the instance IDs of a
+// Pod be evicted along with it. Instance IDs not known to be of any Pod, e.g.
+// those a WatchHandler is created with, are recorded under the empty UID.
+// Guarded by instanceIDsMutex.
+type podInstanceIDs map[types.UID]map[string]struct{}
+
+func newPodInstanceIDs(instanceIDs ...string) podInstanceIDs {
+	ids := make(podInstanceIDs)
+	for _, instanceID := range instanceIDs {
+		ids.Add("", instanceID)
+	}
+	return ids
+}
+
+// Add records a hashed instance ID of the Pod of the given UID
+func (ids podInstanceIDs) Add(uid types.UID, instanceID string) {
+	if _, ok := ids[uid]; !ok {
+		ids[uid] = make(map[string]struct{})
+	}
+	ids[uid][instanceID] = struct{}{}
+}
+
+// Forget forgets the hashed instance IDs of the Pod of the given UID
+func (ids podInstanceIDs) Forget(uid types.UID) {
+	delete(ids, uid)
+}
+
+// Has reports whether a hashed instance ID is recorded for any Pod
+func (ids podInstanceIDs) Has(instanceID string) bool {
+	for _, podIDs := range ids {
+		if _, ok := podIDs[instanceID]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// listInstanceIDs returns the sorted hashed instance IDs of every Pod, each of them once
+func (ids podInstanceIDs) listInstanceIDs() []string {
+	seen := make(map[string]struct{})
+	instanceIDs := []string{}
+	for _, podIDs := range ids {
+		for instanceID := range podIDs {
+			if _, ok := seen[instanceID]; !ok {
+				seen[instanceID] = struct{}{}
+				instanceIDs = append(instanceIDs, instanceID)
+			}
+		}
+	}
+	sort.Strings(instanceIDs)
+	return instanceIDs
+}
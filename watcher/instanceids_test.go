@@ -0,0 +1,48 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+
+	instanceidv1 "github.com/kubescape/k8s-interface/instanceidhandler/v1"
+	"github.com/stretchr/testify/assert"
+	core1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestPodInstanceIDs(t *testing.T) {
+	ids := newPodInstanceIDs("known")
+	ids.Add("uid-1", "b")
+	ids.Add("uid-1", "a")
+	ids.Add("uid-2", "a")
+
+	assert.True(t, ids.Has("known"))
+	assert.True(t, ids.Has("a"))
+	assert.False(t, ids.Has("c"))
+	assert.Equal(t, []string{"a", "b", "known"}, ids.listInstanceIDs(), "instance IDs of several Pods should be listed once")
+	assert.Equal(t, map[string]struct{}{"a": {}, "b": {}}, ids["uid-1"])
+
+	assert.Equal(t, []string{}, newPodInstanceIDs().listInstanceIDs())
+}
+
+func TestInstanceIDsByPodUID(t *testing.T) {
+	pod := newRunningPodFake("default", "nginx", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"})
+	pod.UID = types.UID("nginx-uid")
+	k8sAPI, _ := newK8sAPIFake(pod.DeepCopy())
+
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	assert.NoError(t, wh.buildIDs(context.TODO(), podListIterator(&core1.PodList{Items: []core1.Pod{*pod}})))
+
+	instanceID, _ := instanceidv1.GenerateInstanceIDFromString("apiVersion-v1/namespace-default/kind-Pod/name-nginx/containerName-nginx")
+	slug, _ := instanceID.GetSlug()
+	assert.Equal(t, map[string]struct{}{slug: {}}, wh.managedInstanceIDSlugs[pod.UID])
+	assert.Equal(t, []string{slug}, wh.GetInstanceIDs())
+
+	// the recreated Pod contributes its instance IDs under its own UID
+	recreated := newRunningPodFake("default", "nginx", map[string]string{"nginx": "nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432"})
+	recreated.UID = types.UID("nginx-uid-2")
+	handlePodEvents(context.TODO(), wh, recreated)
+	assert.Equal(t, map[string]struct{}{slug: {}}, wh.managedInstanceIDSlugs[recreated.UID])
+	assert.Equal(t, []string{slug}, wh.GetInstanceIDs())
+}
@@ -0,0 +1,68 @@
+package watcher
+
+import (
+	"strings"
+
+	"github.com/kubescape/k8s-interface/workloadinterface"
+)
+
+// nodeKind is the kind of the workloads of static Pods, which are owned by their Node
+const nodeKind = "Node"
+
+// workloadKindFilter selects the kinds of top-level workloads that are tracked and scanned
+//
+// Kinds are matched case-insensitively. A kind is admitted if it is not
+// denied and, unless no kind is allowed explicitly, if it is allowed. The nil
+// value admits every kind.
+type workloadKindFilter struct {
+	allowed map[string]struct{}
+	denied  map[string]struct{}
+}
+
+func newWorkloadKindFilter(allowed, denied []string) *workloadKindFilter {
+	if len(allowed) == 0 && len(denied) == 0 {
+		return nil
+	}
+	return &workloadKindFilter{
+		allowed: kindSet(allowed),
+		denied:  kindSet(denied),
+	}
+}
+
+func kindSet(kinds []string) map[string]struct{} {
+	if len(kinds) == 0 {
+		return nil
+	}
+	set := make(map[string]struct{}, len(kinds))
+	for _, kind := range kinds {
+		set[strings.ToLower(kind)] = struct{}{}
+	}
+	return set
+}
+
+// Admits returns true if the workloads of the kind are tracked
+func (f *workloadKindFilter) Admits(kind string) bool {
+	if f == nil {
+		return true
+	}
+	kind = strings.ToLower(kind)
+	if _, ok := f.denied[kind]; ok {
+		return false
+	}
+	if f.allowed == nil {
+		return true
+	}
+	_, ok := f.allowed[kind]
+	return ok
+}
+
+// workloadKind returns the kind of the top-level parent of a Pod, as filtered by workloadKindFilter
+//
+// Static Pods are their own parents, their kind is that of the Node owning
+// their mirror Pod.
+func workloadKind(parent workloadinterface.IWorkload) string {
+	if isMirrorPod(parent) {
+		return nodeKind
+	}
+	return parent.GetKind()
+}
@@ -0,0 +1,123 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestWorkloadKindFilter(t *testing.T) {
+	tt := []struct {
+		name     string
+		allowed  []string
+		denied   []string
+		admitted []string
+		rejected []string
+	}{
+		{
+			name:     "Denied kinds are rejected",
+			denied:   []string{"Node"},
+			admitted: []string{"Deployment", "Pod", "CronJob"},
+			rejected: []string{"Node", "node"},
+		},
+		{
+			name:     "Only allowed kinds are admitted",
+			allowed:  []string{"Deployment", "statefulset"},
+			admitted: []string{"Deployment", "deployment", "StatefulSet"},
+			rejected: []string{"DaemonSet", "Pod", "Node"},
+		},
+		{
+			name:     "Denied kinds are rejected even if allowed",
+			allowed:  []string{"Deployment", "Node"},
+			denied:   []string{"Node"},
+			admitted: []string{"Deployment"},
+			rejected: []string{"Node", "Job"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			filter := newWorkloadKindFilter(tc.allowed, tc.denied)
+			for _, kind := range tc.admitted {
+				assert.True(t, filter.Admits(kind), kind)
+			}
+			for _, kind := range tc.rejected {
+				assert.False(t, filter.Admits(kind), kind)
+			}
+		})
+	}
+
+	assert.Nil(t, newWorkloadKindFilter(nil, nil))
+	var nilFilter *workloadKindFilter
+	assert.True(t, nilFilter.Admits("Node"), "the nil filter should admit every kind")
+}
+
+func TestWorkloadKinds(t *testing.T) {
+	staticWlid := "wlid://cluster-/namespace-kube-system/pod-kube-apiserver-control-plane"
+	workloadWlid := "wlid://cluster-/namespace-default/pod-nginx"
+
+	// static Pods are mirrored by the kubelet, as Pods owned by their Node
+	nodeOwner := withOwner(v1.OwnerReference{APIVersion: "v1", Kind: "Node", Name: "control-plane"})
+
+	tt := []struct {
+		name          string
+		opts          []WatchHandlerOption
+		expectTracked bool
+	}{
+		{
+			name:          "Static Pods are not tracked when the Node kind is denied",
+			opts:          []WatchHandlerOption{WithWorkloadKinds(nil, []string{"Node"})},
+			expectTracked: false,
+		},
+		{
+			name:          "Static Pods are not tracked when only other kinds are allowed",
+			opts:          []WatchHandlerOption{WithWorkloadKinds([]string{"Pod", "Deployment"}, nil)},
+			expectTracked: false,
+		},
+		{
+			name:          "Static Pods are tracked when every kind is",
+			expectTracked: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			staticPod := newRunningPodFake("kube-system", "kube-apiserver-control-plane", map[string]string{"kube-apiserver": "kube-apiserver@sha256:e82e2128653d0fabcbeeb06bd059af3a020be21453caa54fa3a31352582c749f"}, nodeOwner)
+			workloadPod := newRunningPodFake("default", "nginx", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"})
+			k8sAPI, _ := newK8sAPIFake(staticPod.DeepCopy(), workloadPod.DeepCopy())
+
+			wh, err := NewWatchHandler(k8sAPI, kssfake.NewSimpleClientset(), nil, nil, tc.opts...)
+			assert.NoError(t, err)
+			assert.NoError(t, wh.Start(context.TODO()))
+
+			// the initial build
+			assert.Equal(t, []string{workloadWlid}, wh.GetWlidsForImageHash("nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"))
+			if tc.expectTracked {
+				assert.Equal(t, []string{staticWlid}, wh.GetWlidsForImageHash("kube-apiserver@sha256:e82e2128653d0fabcbeeb06bd059af3a020be21453caa54fa3a31352582c749f"))
+			} else {
+				assert.Empty(t, wh.GetWlidsForImageHash("kube-apiserver@sha256:e82e2128653d0fabcbeeb06bd059af3a020be21453caa54fa3a31352582c749f"))
+				assert.Empty(t, wh.GetContainerToImageIDForWlid(staticWlid))
+			}
+
+			// the incremental path, once both Pods are updated with new images
+			commands := handlePodEvents(context.TODO(), wh,
+				newRunningPodFake("kube-system", "kube-apiserver-control-plane", map[string]string{"kube-apiserver": "kube-apiserver@sha256:6e12b8112ead35e77719a2d9bb753e8ffe077fa92b08a2709ec271ca6c307dca"}, nodeOwner),
+				newRunningPodFake("default", "nginx", map[string]string{"nginx": "nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432"}),
+			)
+			var wlids []string
+			for _, cmd := range commands {
+				wlids = append(wlids, cmd.Wlid)
+			}
+			assert.Contains(t, wlids, workloadWlid)
+			if tc.expectTracked {
+				assert.Contains(t, wlids, staticWlid)
+			} else {
+				assert.NotContains(t, wlids, staticWlid)
+				assert.Empty(t, wh.GetWlidsForImageHash("kube-apiserver@sha256:6e12b8112ead35e77719a2d9bb753e8ffe077fa92b08a2709ec271ca6c307dca"))
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package watcher
+
+import (
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// managedByLabel labels the storage objects created by Kubescape, see managedByLabelSelector
+	managedByLabel = "app.kubernetes.io/managed-by"
+	// managedByValue is the value of managedByLabel on the storage objects created by Kubescape
+	managedByValue = "kubescape"
+	// managedByLabelSelector selects the storage objects labeled with managedByLabel, so that the objects created by other tools or users are never deleted
+	managedByLabelSelector = managedByLabel + "=" + managedByValue
+)
+
+// isManagedObject returns true if the storage object is labeled as created by Kubescape, see managedByLabel
+func isManagedObject(obj orphanObject) bool {
+	return obj.GetLabels()[managedByLabel] == managedByValue
+}
+
+// storageWatchOptions returns the options of the watches, and of the lists preceding them, of the storage objects, from the given resource version
+//
+// Only the objects labeled as created by Kubescape are watched, unless
+// disabled by WithManagedBySelector.
+func (wh *WatchHandler) storageWatchOptions(resourceVersion string) v1.ListOptions {
+	options := v1.ListOptions{ResourceVersion: resourceVersion}
+	if wh.managedBySelector {
+		options.LabelSelector = managedByLabelSelector
+	}
+	return options
+}
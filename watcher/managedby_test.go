@@ -0,0 +1,234 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/armosec/armoapi-go/apis"
+	instanceidv1 "github.com/kubescape/k8s-interface/instanceidhandler/v1"
+	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// managedLabels returns the labels of the storage objects created by Kubescape, see isManagedObject
+func managedLabels() map[string]string {
+	return map[string]string{managedByLabel: managedByValue}
+}
+
+func TestStorageWatchOptions(t *testing.T) {
+	tt := []struct {
+		name             string
+		opts             []WatchHandlerOption
+		expectedSelector string
+	}{
+		{
+			name:             "only the managed objects are watched by default",
+			expectedSelector: managedByLabelSelector,
+		},
+		{
+			name: "every object is watched once the selector is disabled",
+			opts: []WatchHandlerOption{WithManagedBySelector(false)},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.TODO()
+			k8sAPI, _ := newK8sAPIFake()
+			storageClient := kssfake.NewSimpleClientset()
+			wh, err := NewWatchHandler(k8sAPI, storageClient, nil, nil, tc.opts...)
+			assert.NoError(t, err)
+
+			_, err = wh.getSBOMWatcher(ctx, "")
+			assert.NoError(t, err)
+			_, err = wh.getSBOMFilteredWatcher(ctx, "")
+			assert.NoError(t, err)
+			_, err = wh.getVulnerabilityManifestWatcher(ctx)
+			assert.NoError(t, err)
+			for _, kind := range sbomKinds {
+				_, _, err = kind.list(wh, ctx)
+				assert.NoError(t, err)
+			}
+
+			selectors := map[string]string{}
+			for _, action := range storageClient.Actions() {
+				switch action := action.(type) {
+				case k8stesting.WatchAction:
+					selectors["watch "+action.GetResource().Resource] = action.GetWatchRestrictions().Labels.String()
+				case k8stesting.ListAction:
+					selectors["list "+action.GetResource().Resource] = action.GetListRestrictions().Labels.String()
+				}
+			}
+			assert.Equal(t, map[string]string{
+				"watch sbomsummaries":          tc.expectedSelector,
+				"watch sbomspdxv2p3filtereds":  tc.expectedSelector,
+				"watch vulnerabilitymanifests": tc.expectedSelector,
+				"list sbomsummaries":           tc.expectedSelector,
+				"list sbomspdxv2p3filtereds":   tc.expectedSelector,
+			}, selectors)
+		})
+	}
+}
+
+func TestUnmanagedStorageObjectsAreKept(t *testing.T) {
+	ctx := context.TODO()
+	untrackedImageID := "nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432"
+	unknownInstanceID := "apiVersion-v1/namespace-default/kind-Pod/name-reverse-proxy/containerName-sidecar"
+	meta := func(name string, labels map[string]string, annotations map[string]string) v1.ObjectMeta {
+		return v1.ObjectMeta{Name: name, Namespace: "kubescape", Labels: labels, Annotations: annotations}
+	}
+	imageAnnotations := map[string]string{instanceidv1.ImageIDMetadataKey: untrackedImageID}
+	instanceAnnotations := map[string]string{instanceidv1.InstanceIDMetadataKey: unknownInstanceID}
+	// created by other tools or users, e.g. experimenting with the CRDs
+	unlabeled := map[string]string{"app.kubernetes.io/managed-by": "someone-else"}
+	objects := func() []runtime.Object {
+		return []runtime.Object{
+			&spdxv1beta1.SBOMSummary{ObjectMeta: meta("managed", managedLabels(), imageAnnotations)},
+			&spdxv1beta1.SBOMSPDXv2p3{ObjectMeta: meta("managed", managedLabels(), imageAnnotations)},
+			&spdxv1beta1.SBOMSummary{ObjectMeta: meta("unmanaged", nil, imageAnnotations)},
+			&spdxv1beta1.SBOMSPDXv2p3{ObjectMeta: meta("unmanaged", nil, imageAnnotations)},
+			&spdxv1beta1.SBOMSummary{ObjectMeta: meta("managed-by-someone-else", unlabeled, imageAnnotations)},
+			&spdxv1beta1.SBOMSPDXv2p3{ObjectMeta: meta("unmanaged-without-summary", nil, imageAnnotations)},
+			&spdxv1beta1.SBOMSPDXv2p3Filtered{ObjectMeta: meta("managed", managedLabels(), instanceAnnotations)},
+			&spdxv1beta1.SBOMSPDXv2p3Filtered{ObjectMeta: meta("unmanaged", nil, instanceAnnotations)},
+			&spdxv1beta1.VulnerabilityManifest{ObjectMeta: meta(untrackedImageID, managedLabels(), nil)},
+			&spdxv1beta1.VulnerabilityManifest{ObjectMeta: meta("unmanaged", nil, nil)},
+		}
+	}
+	// names returns the names of the remaining objects of every kind
+	names := func(t *testing.T, storageClient *kssfake.Clientset) []string {
+		var names []string
+		summaries, err := storageClient.SpdxV1beta1().SBOMSummaries("").List(ctx, v1.ListOptions{})
+		assert.NoError(t, err)
+		for i := range summaries.Items {
+			names = append(names, sbomSummaryKind+"/"+summaries.Items[i].Name)
+		}
+		sboms, err := storageClient.SpdxV1beta1().SBOMSPDXv2p3s("").List(ctx, v1.ListOptions{})
+		assert.NoError(t, err)
+		for i := range sboms.Items {
+			names = append(names, sbomSPDXv2p3Kind+"/"+sboms.Items[i].Name)
+		}
+		filtered, err := storageClient.SpdxV1beta1().SBOMSPDXv2p3Filtereds("").List(ctx, v1.ListOptions{})
+		assert.NoError(t, err)
+		for i := range filtered.Items {
+			names = append(names, sbomSPDXv2p3FilteredKind+"/"+filtered.Items[i].Name)
+		}
+		manifests, err := storageClient.SpdxV1beta1().VulnerabilityManifests("").List(ctx, v1.ListOptions{})
+		assert.NoError(t, err)
+		for i := range manifests.Items {
+			names = append(names, vulnerabilityManifestKind+"/"+manifests.Items[i].Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	unmanaged := []string{
+		sbomSPDXv2p3Kind + "/unmanaged",
+		sbomSPDXv2p3Kind + "/unmanaged-without-summary",
+		sbomSPDXv2p3FilteredKind + "/unmanaged",
+		sbomSummaryKind + "/managed-by-someone-else",
+		sbomSummaryKind + "/unmanaged",
+		vulnerabilityManifestKind + "/unmanaged",
+	}
+	newWatchHandler := func(t *testing.T, storageClient *kssfake.Clientset, opts ...WatchHandlerOption) *WatchHandler {
+		k8sAPI, _ := newK8sAPIFake(newRunningPodFake("default", "nginx", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"}))
+		wh, err := NewWatchHandler(k8sAPI, storageClient, nil, nil, opts...)
+		assert.NoError(t, err)
+		return wh
+	}
+
+	for _, selector := range []bool{true, false} {
+		opts := []WatchHandlerOption{WithManagedBySelector(selector)}
+
+		t.Run(fmt.Sprintf("the watchers skip the unlabeled objects with the selector set to %t", selector), func(t *testing.T) {
+			storageClient := kssfake.NewSimpleClientset(objects()...)
+			wh := newWatchHandler(t, storageClient, append(opts, WithDeletionPolicies(map[string]DeletionPolicy{vulnerabilityManifestKind: DeletionPolicyLabel}))...)
+
+			// the events are not selected by the fake watches, like by storages not supporting selectors
+			sbomEvents := make(chan watch.Event, 3)
+			filteredEvents := make(chan watch.Event, 2)
+			manifestEvents := make(chan watch.Event, 2)
+			for _, obj := range objects() {
+				switch obj.(type) {
+				case *spdxv1beta1.SBOMSummary:
+					sbomEvents <- watch.Event{Type: watch.Modified, Object: obj}
+				case *spdxv1beta1.SBOMSPDXv2p3Filtered:
+					filteredEvents <- watch.Event{Type: watch.Modified, Object: obj}
+				case *spdxv1beta1.VulnerabilityManifest:
+					manifestEvents <- watch.Event{Type: watch.Added, Object: obj}
+				}
+			}
+			close(sbomEvents)
+			close(filteredEvents)
+			close(manifestEvents)
+			for _, handle := range []func(errCh chan<- error){
+				func(errCh chan<- error) { wh.HandleSBOMEvents(ctx, sbomEvents, nil, errCh) },
+				func(errCh chan<- error) {
+					wh.HandleSBOMFilteredEvents(ctx, filteredEvents, make(chan *apis.Command, 2), errCh)
+				},
+				func(errCh chan<- error) { wh.HandleVulnerabilityManifestEvents(ctx, manifestEvents, errCh) },
+			} {
+				errCh := make(chan error)
+				go handle(errCh)
+				for err := range errCh {
+					assert.NoError(t, err)
+				}
+			}
+
+			// the orphaned manifest is only labeled
+			expected := append([]string{vulnerabilityManifestKind + "/" + untrackedImageID}, unmanaged...)
+			sort.Strings(expected)
+			assert.Equal(t, expected, names(t, storageClient))
+			manifest, err := storageClient.SpdxV1beta1().VulnerabilityManifests("kubescape").Get(ctx, "unmanaged", v1.GetOptions{})
+			assert.NoError(t, err)
+			assert.NotContains(t, manifest.Labels, orphanedAtLabel, "the unlabeled objects should not be handled at all")
+		})
+
+		t.Run(fmt.Sprintf("the unlabeled SBOMs still trigger scans with the selector set to %t", selector), func(t *testing.T) {
+			storageClient := kssfake.NewSimpleClientset()
+			wh := newWatchHandler(t, storageClient, append(opts, WithOwnerReferences(true))...)
+			assert.NoError(t, wh.Start(ctx))
+			instanceIDs, err := instanceidv1.GenerateInstanceIDFromPod(newRunningPodFake("default", "nginx", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"}))
+			assert.NoError(t, err)
+
+			var commands []*apis.Command
+			emit := func(cmd *apis.Command) { commands = append(commands, cmd) }
+			report := func(err error) { assert.NoError(t, err) }
+			// created once the handler started, to trigger the scans of its image
+			summary := &spdxv1beta1.SBOMSummary{ObjectMeta: meta("unmanaged", nil, map[string]string{instanceidv1.ImageIDMetadataKey: "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"})}
+			summary.CreationTimestamp = v1.Now()
+			wh.handleSBOMObject(ctx, sbomSummaries, watch.Added, summary, emit, report)
+			wh.handleSBOMObject(ctx, sbomSPDXv2p3Filtereds, watch.Added, &spdxv1beta1.SBOMSPDXv2p3Filtered{
+				ObjectMeta: meta("unmanaged", nil, map[string]string{
+					instanceidv1.InstanceIDMetadataKey: instanceIDs[0].GetStringFormatted(),
+					instanceidv1.WlidMetadataKey:       "wlid://cluster-/namespace-default/pod-nginx",
+				}),
+			}, emit, report)
+
+			if assert.Len(t, commands, 2) {
+				assert.Equal(t, "wlid://cluster-/namespace-default/pod-nginx", commands[0].Wlid)
+				assert.Equal(t, "wlid://cluster-/namespace-default/pod-nginx", commands[1].Wlid)
+			}
+			for _, action := range storageClient.Actions() {
+				assert.NotEqual(t, "patch", action.GetVerb(), "the unlabeled objects should not be adopted")
+			}
+		})
+
+		t.Run(fmt.Sprintf("the cleanups skip the unlabeled objects with the selector set to %t", selector), func(t *testing.T) {
+			storageClient := kssfake.NewSimpleClientset(objects()...)
+			wh := newWatchHandler(t, storageClient, opts...)
+			assert.NoError(t, wh.Start(ctx))
+
+			assert.NoError(t, wh.reconcileOnStartup(ctx))
+			wh.reclaimOrphans(ctx)
+
+			assert.Equal(t, unmanaged, names(t, storageClient))
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"sync"
 
 	sets "github.com/deckarep/golang-set/v2"
+	"github.com/kubescape/operator/utils"
 )
 
 // wlidSet is a set of WLIDs.
@@ -85,6 +86,22 @@ func (m *imageHashWLIDMap) Load(imageHash string) ([]string, bool) {
 	return nil, ok
 }
 
+// HasDigest reports whether the map holds an image hash with the same digest as the given one, regardless of its repository
+func (m *imageHashWLIDMap) HasDigest(imageHash string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.getUnsafe(imageHash); ok {
+		return true
+	}
+	for other := range m.wlidsByImageHash {
+		if utils.SameImageDigest(imageHash, other) {
+			return true
+		}
+	}
+	return false
+}
+
 // LoadSet returns a copy of a set of WLIDs for the provided image hash
 //
 // This method returns a copy so that callers will not be able to modify the
@@ -122,6 +139,23 @@ func (m *imageHashWLIDMap) Add(imageHash string, wlids ...string) {
 	}
 }
 
+// Remove removes a given list of WLIDs from a provided image hash
+//
+// The image hash is removed from the map once no WLIDs are left for it
+func (m *imageHashWLIDMap) Remove(imageHash string, wlids ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existingWlids, ok := m.getUnsafe(imageHash)
+	if !ok {
+		return
+	}
+	existingWlids.RemoveAll(wlids...)
+	if existingWlids.Cardinality() == 0 {
+		delete(m.wlidsByImageHash, imageHash)
+	}
+}
+
 // Range calls f sequentially over the contents of the map, using WLIDs as slice of string
 func (m *imageHashWLIDMap) Range(f func(imageHash string, wlids []string) bool) {
 	m.mu.RLock()
@@ -315,6 +315,57 @@ func TestImageIDWLIDsAdd(t *testing.T) {
 	}
 }
 
+func TestImageIDWLIDsRemove(t *testing.T) {
+	tt := []struct {
+		name           string
+		startingValues map[string][]string
+		imageHash      string
+		wlids          []string
+		expectedMap    map[string][]string
+	}{
+		{
+			name: "Removing some WLIDs of an imageHash should keep the rest",
+			startingValues: map[string][]string{
+				"7238b08a6bad494e84ed1c632a62d39bdeed1f929950a05c1a32b6d4490a0047": {"wlid-01", "wlid-02"},
+			},
+			imageHash: "7238b08a6bad494e84ed1c632a62d39bdeed1f929950a05c1a32b6d4490a0047",
+			wlids:     []string{"wlid-01"},
+			expectedMap: map[string][]string{
+				"7238b08a6bad494e84ed1c632a62d39bdeed1f929950a05c1a32b6d4490a0047": {"wlid-02"},
+			},
+		},
+		{
+			name: "Removing all WLIDs of an imageHash should remove the imageHash",
+			startingValues: map[string][]string{
+				"7238b08a6bad494e84ed1c632a62d39bdeed1f929950a05c1a32b6d4490a0047": {"wlid-01"},
+				"7238b08a6bad494e84ed1c632a62d39bdeed1f929950a05c1a32b6d4490a0048": {"wlid-01"},
+			},
+			imageHash: "7238b08a6bad494e84ed1c632a62d39bdeed1f929950a05c1a32b6d4490a0047",
+			wlids:     []string{"wlid-01"},
+			expectedMap: map[string][]string{
+				"7238b08a6bad494e84ed1c632a62d39bdeed1f929950a05c1a32b6d4490a0048": {"wlid-01"},
+			},
+		},
+		{
+			name:           "Removing from a missing imageHash should be a no-op",
+			startingValues: map[string][]string{},
+			imageHash:      "7238b08a6bad494e84ed1c632a62d39bdeed1f929950a05c1a32b6d4490a0047",
+			wlids:          []string{"wlid-01"},
+			expectedMap:    map[string][]string{},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			iwMap := NewImageHashWLIDsMapFrom(tc.startingValues)
+
+			iwMap.Remove(tc.imageHash, tc.wlids...)
+
+			assertRawMapEqualsIWMap(t, tc.expectedMap, iwMap)
+		})
+	}
+}
+
 func TestImageIDWLIDsMapLoad(t *testing.T) {
 	type loadResult struct {
 		imageHash     string
@@ -0,0 +1,169 @@
+package watcher
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/instrument"
+)
+
+const (
+	// metricMutableTagContainersTotal is the number of tracked containers whose image is referenced by a mutable tag instead of a digest
+	metricMutableTagContainersTotal = "operator_mutable_tag_containers_total"
+	// metricDigestlessContainersTotal is the number of tracked containers whose image was reported without a digest, so it is not tracked by image hash
+	metricDigestlessContainersTotal = "operator_digestless_containers_total"
+)
+
+// metricGauges are the metrics set to the current value of what they measure, exported as gauges by RegisterMetrics
+var metricGauges = []string{
+	metricMutableTagContainersTotal,
+	metricDigestlessContainersTotal,
+	metricPodsPendingImageIDs,
+	metricDeletionQueueDepth,
+	metricTrackedWlids,
+}
+
+// metricCounters are the metrics counting events since the start of the operator, exported as counters by RegisterMetrics
+var metricCounters = []string{
+	metricBulkDeletionsTotal,
+	metricBulkDeletionFallbacksTotal,
+	metricDeletionBurstCleanUpsTotal,
+	metricDeletionsGivenUpTotal,
+	metricParentCacheHitsTotal,
+	metricParentCacheMissesTotal,
+	metricPodEventsDroppedTotal,
+	metricReconciledVulnerabilityManifestsKeptTotal,
+	metricReconciledVulnerabilityManifestsDeletedTotal,
+	metricRelevancyScansTriggeredTotal,
+	metricResyncScansTriggeredTotal,
+	metricStalePodWatchRestartsTotal,
+	metricStorageDeleteRetriesTotal,
+	metricStorageDeleteFailuresTotal,
+	metricWatchEventBufferFullTotal,
+	metricWlidEvictionsTotal,
+}
+
+// int64Observer is an asynchronous instrument observing int64 values, i.e. a counter or a gauge
+type int64Observer interface {
+	instrument.Asynchronous
+	Observe(ctx context.Context, x int64, attrs ...attribute.KeyValue)
+}
+
+// metricsRegistry is a minimal thread-safe registry of named metric values
+type metricsRegistry struct {
+	values map[string]int64
+	mu     sync.RWMutex
+}
+
+// Add adds delta to the metric with the given name
+func (m *metricsRegistry) Add(name string, delta int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.values == nil {
+		m.values = make(map[string]int64)
+	}
+	m.values[name] += delta
+}
+
+// Inc increments the metric with the given name by one
+func (m *metricsRegistry) Inc(name string) {
+	m.Add(name, 1)
+}
+
+// Set sets the metric with the given name to value
+func (m *metricsRegistry) Set(name string, value int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.values == nil {
+		m.values = make(map[string]int64)
+	}
+	m.values[name] = value
+}
+
+// Get returns the current value of the metric with the given name
+func (m *metricsRegistry) Get(name string) int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.values[name]
+}
+
+// Snapshot returns a copy of all the metric values at the moment of the call
+func (m *metricsRegistry) Snapshot() map[string]int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	res := make(map[string]int64, len(m.values))
+	for name, value := range m.values {
+		res[name] = value
+	}
+	return res
+}
+
+// Metrics returns the current values of the WatchHandler metrics, which RegisterMetrics exports and DumpState logs
+func (wh *WatchHandler) Metrics() map[string]int64 {
+	wh.wlidsToContainerToImageIDMapMutex.RLock()
+	defer wh.wlidsToContainerToImageIDMapMutex.RUnlock()
+
+	return wh.metricsUnsafe()
+}
+
+// metricsUnsafe is Metrics without locking, see snapshotState
+//
+// NOT THREAD SAFE! Assumes the caller is holding the WLIDs map lock.
+func (wh *WatchHandler) metricsUnsafe() map[string]int64 {
+	wh.metrics.Set(metricMutableTagContainersTotal, int64(wh.countMutableTagContainersUnsafe()))
+	wh.metrics.Set(metricDigestlessContainersTotal, int64(wh.countDigestlessContainersUnsafe()))
+	wh.metrics.Set(metricPodsPendingImageIDs, int64(wh.pendingImageIDs.Len()))
+	wh.metrics.Set(metricDeletionQueueDepth, int64(wh.deletions.Len()))
+	wh.metrics.Set(metricTrackedWlids, int64(len(wh.wlidsToContainerToImageIDMap)))
+	return wh.metrics.Snapshot()
+}
+
+// RegisterMetrics exports the WatchHandler metrics through an OpenTelemetry meter, e.g. the global one configured by logger.InitOtel
+//
+// The metrics are observed from Metrics whenever the meter collects them.
+// The errors received by the watchers are counted by
+// operator_watch_statuses_total with a reason attribute, rather than by a
+// metric of each reason.
+func (wh *WatchHandler) RegisterMetrics(meter metric.Meter) error {
+	observers := make(map[string]int64Observer, len(metricGauges)+len(metricCounters))
+	instruments := make([]instrument.Asynchronous, 0, len(metricGauges)+len(metricCounters)+1)
+	for _, name := range metricGauges {
+		gauge, err := meter.AsyncInt64().Gauge(name)
+		if err != nil {
+			return err
+		}
+		observers[name] = gauge
+		instruments = append(instruments, gauge)
+	}
+	for _, name := range metricCounters {
+		counter, err := meter.AsyncInt64().Counter(name)
+		if err != nil {
+			return err
+		}
+		observers[name] = counter
+		instruments = append(instruments, counter)
+	}
+	watchStatuses, err := meter.AsyncInt64().Counter(metricWatchStatusesTotal)
+	if err != nil {
+		return err
+	}
+	instruments = append(instruments, watchStatuses)
+
+	return meter.RegisterCallback(instruments, func(ctx context.Context) {
+		metrics := wh.Metrics()
+		for name, observer := range observers {
+			observer.Observe(ctx, metrics[name])
+		}
+		for name, value := range metrics {
+			if reason, ok := watchStatusReasonOfMetric(name); ok {
+				watchStatuses.Observe(ctx, value, attribute.String("reason", reason))
+			}
+		}
+	})
+}
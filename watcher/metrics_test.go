@@ -0,0 +1,56 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRegisterMetrics(t *testing.T) {
+	ctx := context.TODO()
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+
+	wh := NewWatchHandlerMock()
+	wh.wlidsToContainerToImageIDMap = WlidsToContainerToImageIDMap{"wlid1": {"container1": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"}}
+	assert.NoError(t, wh.RegisterMetrics(meter))
+	wh.metrics.Add(metricStalePodWatchRestartsTotal, 2)
+	wh.metrics.Inc(metricWatchStatusesTotal)
+	wh.metrics.Inc(watchStatusReasonMetric(v1.StatusReasonExpired))
+
+	collected, err := reader.Collect(ctx)
+	assert.NoError(t, err)
+	sums := map[string]metricdata.Sum[int64]{}
+	gauges := map[string]metricdata.Gauge[int64]{}
+	for _, scope := range collected.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			switch data := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				sums[m.Name] = data
+			case metricdata.Gauge[int64]:
+				gauges[m.Name] = data
+			}
+		}
+	}
+	assert.Len(t, sums, len(metricCounters)+1, "every counter should be exported")
+	assert.Len(t, gauges, len(metricGauges), "every gauge should be exported")
+
+	if assert.Len(t, gauges[metricTrackedWlids].DataPoints, 1) {
+		assert.Equal(t, int64(1), gauges[metricTrackedWlids].DataPoints[0].Value)
+	}
+	if assert.Len(t, sums[metricStalePodWatchRestartsTotal].DataPoints, 1) {
+		assert.True(t, sums[metricStalePodWatchRestartsTotal].IsMonotonic)
+		assert.Equal(t, int64(2), sums[metricStalePodWatchRestartsTotal].DataPoints[0].Value)
+	}
+	// the errors of each reason are counted with a reason attribute
+	if assert.Len(t, sums[metricWatchStatusesTotal].DataPoints, 1) {
+		point := sums[metricWatchStatusesTotal].DataPoints[0]
+		assert.Equal(t, int64(1), point.Value)
+		assert.Equal(t, attribute.NewSet(attribute.String("reason", "expired")), point.Attributes)
+	}
+}
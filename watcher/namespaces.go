@@ -0,0 +1,23 @@
+package watcher
+
+// namespaceFilter is a set of namespaces whose workloads are not tracked
+//
+// The nil value excludes nothing
+type namespaceFilter map[string]struct{}
+
+func newNamespaceFilter(namespaces ...string) namespaceFilter {
+	if len(namespaces) == 0 {
+		return nil
+	}
+	filter := make(namespaceFilter, len(namespaces))
+	for _, namespace := range namespaces {
+		filter[namespace] = struct{}{}
+	}
+	return filter
+}
+
+// Excludes returns true if the workloads of the namespace are not tracked
+func (f namespaceFilter) Excludes(namespace string) bool {
+	_, ok := f[namespace]
+	return ok
+}
@@ -0,0 +1,127 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	instanceidhandlerv1 "github.com/kubescape/k8s-interface/instanceidhandler/v1"
+	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	core1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestNamespaceFilter(t *testing.T) {
+	filter := newNamespaceFilter("kube-system", "kubescape")
+	assert.True(t, filter.Excludes("kube-system"))
+	assert.True(t, filter.Excludes("kubescape"))
+	assert.False(t, filter.Excludes("default"))
+
+	assert.Nil(t, newNamespaceFilter())
+	var nilFilter namespaceFilter
+	assert.False(t, nilFilter.Excludes("kube-system"), "the nil filter should exclude nothing")
+}
+
+func TestExcludedNamespaces(t *testing.T) {
+	systemWlid := "wlid://cluster-/namespace-kube-system/pod-coredns"
+	workloadWlid := "wlid://cluster-/namespace-default/pod-nginx"
+
+	tt := []struct {
+		name          string
+		opts          []WatchHandlerOption
+		expectTracked bool
+	}{
+		{
+			name:          "System namespaces are excluded",
+			opts:          []WatchHandlerOption{WithExcludedNamespaces("kube-system", "kube-node-lease")},
+			expectTracked: false,
+		},
+		{
+			name:          "System namespaces are included when nothing is excluded",
+			expectTracked: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			systemPod := newRunningPodFake("kube-system", "coredns", map[string]string{"coredns": "coredns@sha256:0c22bf10e9320da3b90b6525655c6ceca4719b608112cf5f1fc74b92aaedf107"})
+			workloadPod := newRunningPodFake("default", "nginx", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"})
+			k8sAPI, _ := newK8sAPIFake(systemPod.DeepCopy(), workloadPod.DeepCopy())
+
+			wh, err := NewWatchHandler(k8sAPI, kssfake.NewSimpleClientset(), nil, nil, tc.opts...)
+			assert.NoError(t, err)
+			assert.NoError(t, wh.Start(context.TODO()))
+
+			assert.Equal(t, []string{workloadWlid}, wh.GetWlidsForImageHash("nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"))
+			if tc.expectTracked {
+				assert.Equal(t, []string{systemWlid}, wh.GetWlidsForImageHash("coredns@sha256:0c22bf10e9320da3b90b6525655c6ceca4719b608112cf5f1fc74b92aaedf107"))
+			} else {
+				assert.Empty(t, wh.GetWlidsForImageHash("coredns@sha256:0c22bf10e9320da3b90b6525655c6ceca4719b608112cf5f1fc74b92aaedf107"))
+				assert.Empty(t, wh.GetContainerToImageIDForWlid(systemWlid))
+			}
+
+			// both Pods are updated with new images, which the API serves once the watch ends
+			updatedSystemPod := newRunningPodFake("kube-system", "coredns", map[string]string{"coredns": "coredns@sha256:71d40feffdebfad9450a6ff4c8c29d1bdab015cf5a490bf2bd59ea43836eb3f3"})
+			updatedWorkloadPod := newRunningPodFake("default", "nginx", map[string]string{"nginx": "nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432"})
+			wh.k8sAPI, _ = newK8sAPIFake(updatedSystemPod.DeepCopy(), updatedWorkloadPod.DeepCopy())
+			recorder := &commandRecorder{}
+			podsWatch := watch.NewFake()
+			done := make(chan struct{})
+			go func() {
+				wh.handlePodWatcher(context.TODO(), podsWatch, newCommandDeduper(0, recorder.emit))
+				close(done)
+			}()
+			podsWatch.Modify(updatedSystemPod)
+			podsWatch.Modify(updatedWorkloadPod)
+			assert.Eventually(t, func() bool {
+				for _, cmd := range recorder.emitted() {
+					if cmd.Wlid == workloadWlid {
+						return true
+					}
+				}
+				return false
+			}, time.Second, 10*time.Millisecond)
+			podsWatch.Stop()
+			<-done
+
+			wlids := []string{}
+			for _, cmd := range recorder.emitted() {
+				wlids = append(wlids, cmd.Wlid)
+			}
+			if tc.expectTracked {
+				assert.ElementsMatch(t, []string{systemWlid, workloadWlid}, wlids)
+			} else {
+				assert.Equal(t, []string{workloadWlid}, wlids, "Pods of excluded namespaces should not be scanned")
+			}
+		})
+	}
+}
+
+func TestCleanUpDropsNewlyExcludedNamespaces(t *testing.T) {
+	ctx := context.TODO()
+	systemWlid := "wlid://cluster-/namespace-kube-system/pod-coredns"
+	systemPod := newRunningPodFake("kube-system", "coredns", map[string]string{"coredns": "coredns@sha256:0c22bf10e9320da3b90b6525655c6ceca4719b608112cf5f1fc74b92aaedf107"})
+	k8sAPI, _ := newK8sAPIFake(systemPod.DeepCopy())
+	storageClient := kssfake.NewSimpleClientset(
+		&spdxv1beta1.SBOMSummary{ObjectMeta: v1.ObjectMeta{Name: "coredns", Labels: managedLabels(), Annotations: map[string]string{instanceidhandlerv1.ImageIDMetadataKey: "coredns@sha256:0c22bf10e9320da3b90b6525655c6ceca4719b608112cf5f1fc74b92aaedf107"}}},
+	)
+
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	wh.storageClient = storageClient
+	assert.NoError(t, wh.buildIDs(ctx, podListIterator(&core1.PodList{Items: []core1.Pod{*systemPod.DeepCopy()}})))
+	assert.Equal(t, []string{systemWlid}, wh.GetWlidsForImageHash("coredns@sha256:0c22bf10e9320da3b90b6525655c6ceca4719b608112cf5f1fc74b92aaedf107"))
+
+	// the namespace moves from included to excluded
+	wh.excludedNamespaces = newNamespaceFilter("kube-system")
+	wh.cleanUp(ctx)
+
+	assert.Empty(t, wh.GetWlidsForImageHash("coredns@sha256:0c22bf10e9320da3b90b6525655c6ceca4719b608112cf5f1fc74b92aaedf107"))
+	assert.Empty(t, wh.GetContainerToImageIDForWlid(systemWlid))
+	summaries, err := storageClient.SpdxV1beta1().SBOMSummaries("").List(ctx, v1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, summaries.Items, "the SBOMs of excluded namespaces should be garbage-collected")
+}
@@ -0,0 +1,324 @@
+package watcher
+
+import (
+	"math/rand"
+	"time"
+)
+
+// WatchHandlerOption configures optional behavior of a WatchHandler
+type WatchHandlerOption func(wh *WatchHandler)
+
+// WithDryRun makes the WatchHandler log the storage objects it would delete instead of deleting them
+//
+// Everything else, including the internal maps and the periodic cleanUp,
+// behaves the same, so garbage collection can be validated on a new cluster
+// before letting the operator remove storage objects.
+func WithDryRun(dryRun bool) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		wh.dryRun = dryRun
+	}
+}
+
+// WithExcludedNamespaces makes the WatchHandler ignore the workloads of the given namespaces
+//
+// Pods of excluded namespaces are neither tracked nor scanned, so the storage
+// objects describing them are garbage-collected like those of deleted
+// workloads.
+func WithExcludedNamespaces(namespaces ...string) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		wh.excludedNamespaces = newNamespaceFilter(namespaces...)
+	}
+}
+
+// WithWorkloadKinds makes the WatchHandler only track the top-level workloads of the given kinds
+//
+// Workloads of an allowed kind are tracked unless their kind is denied, every
+// kind is allowed if none is. The workloads of static Pods are of kind Node.
+func WithWorkloadKinds(allowed, denied []string) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		wh.workloadKinds = newWorkloadKindFilter(allowed, denied)
+	}
+}
+
+// WithPodFilter makes the WatchHandler only track and scan the Pods for which the filter returns true
+//
+// Filters are applied to the listed Pods and to the events of the Pod
+// watcher, before resolving their parents, so excluded Pods cause no API
+// calls. Several filters can be registered, Pods must then pass all of them.
+// Tracked Pods that stop passing a filter are forgotten by the next cleanUp.
+func WithPodFilter(filter PodFilter) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		if filter != nil {
+			wh.podFilters = append(wh.podFilters, filter)
+		}
+	}
+}
+
+// WithReadinessGate makes the WatchHandler trigger the scans of Pods only once they are ready
+//
+// Pods trigger scans once their Ready condition has been true for the
+// stabilization delay, so that crash-looping Pods do not trigger a scan each
+// time they restart. Their instance IDs are tracked right away, so their
+// relevancy objects are kept in the meantime.
+func WithReadinessGate(enabled bool, stabilizationDelay time.Duration) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		if enabled {
+			wh.readiness = newReadinessGate(stabilizationDelay)
+		}
+	}
+}
+
+// WithControllerPrescans makes the WatchHandler scan the images of the Pod templates of workload controllers, see ControllerWatch
+//
+// Deployments, StatefulSets and DaemonSets trigger provisional scans once
+// created or when their template images change, so slow-starting workloads
+// are scanned before their Pods run. Their Pods then trigger scans for the
+// images that were not scanned provisionally only.
+func WithControllerPrescans(enabled bool) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		if enabled {
+			wh.prescans = newPrescanTracker()
+		}
+	}
+}
+
+// WithImageDigestResolver makes the WatchHandler resolve the other image IDs of the images it tracks, see ImageDigestResolver
+//
+// Storage objects named after any image ID of a tracked image are kept, e.g.
+// SBOMs named after the index digest of a multi-arch image whose Pods report
+// its platform-specific digest. A nil resolver resolves nothing.
+func WithImageDigestResolver(resolve ImageDigestResolver) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		if resolve != nil {
+			wh.imageDigests = newImageDigestAliases(resolve)
+		}
+	}
+}
+
+// WithInitialReconcile makes the WatchHandler delete the storage objects orphaned before it started, see reconcileOnStartup
+//
+// Objects orphaned while the operator was down are deleted in a single pass
+// once the internal maps are built, rather than as events happen to arrive
+// for them or at the next cleanUp.
+func WithInitialReconcile(enabled bool) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		wh.initialReconcile = enabled
+	}
+}
+
+// WithCleanUpJitter makes the WatchHandler delay its first cleanUp by up to another interval, at random
+//
+// The interval between the later runs is unchanged.
+func WithCleanUpJitter(enabled bool) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		if enabled {
+			wh.cleanUpJitter = rand.Float64
+		} else {
+			wh.cleanUpJitter = nil
+		}
+	}
+}
+
+// WithDeletionBurstCleanUp makes the WatchHandler clean up early once threshold Pods are deleted within the window, see deletionBursts
+//
+// The storage objects of the workloads of a deleted namespace are reclaimed
+// right away rather than at the next periodic cleanUp. A threshold or window
+// that is not positive disables it.
+func WithDeletionBurstCleanUp(threshold int, window time.Duration) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		wh.deletionBursts = newDeletionBursts(threshold, window)
+	}
+}
+
+// WithCheckpoint makes the WatchHandler save a checkpoint of its internal maps to the store every interval, and load it on startup
+//
+// Once restarted, the operator keeps the storage objects of the checkpointed
+// workloads until the next cleanUp, and only needs to scan the workloads that
+// changed since the checkpoint, see GetWlidsChangedSinceCheckpoint. A nil
+// store disables it.
+func WithCheckpoint(store CheckpointStore, interval time.Duration) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		wh.checkpoints = store
+		wh.checkpointInterval = interval
+	}
+}
+
+// WithPeriodicRelevancyScan makes the WatchHandler trigger a relevancy scan of every tracked workload after each cleanUp, see triggerRelevancyScan
+//
+// The scans are sent to the sink set by SetRelevancyScanSink.
+func WithPeriodicRelevancyScan(enabled bool) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		if enabled {
+			wh.relevancyScans = &relevancyScanTrigger{}
+		} else {
+			wh.relevancyScans = nil
+		}
+	}
+}
+
+// WithOwnerReferences makes the WatchHandler set owners on the storage objects it tracks, for the garbage collector to delete them, see storageOwner
+//
+// The storage objects of an image or an instance ID are owned by a
+// bookkeeping ConfigMap of their namespace, which cleanUp deletes once they
+// are not tracked anymore. Only the objects without owners, which predate
+// the ownership scheme, are deleted by the watch handlers and cleanUp.
+func WithOwnerReferences(enabled bool) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		if enabled {
+			wh.storageOwners = newStorageOwnerUIDs()
+		} else {
+			wh.storageOwners = nil
+		}
+	}
+}
+
+// WithCommandRateLimit makes the watchers send at most rps scan commands per second, with bursts of up to burst commands, see rateLimited
+//
+// The commands exceeding the rate are queued rather than dropped. A rate that
+// is not positive disables it.
+func WithCommandRateLimit(rps int, burst int) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		wh.commandLimiter = newCommandLimiter(rps, burst)
+	}
+}
+
+// WithDeletionPolicies sets what the watch handlers and cleanUp do with the orphaned storage objects of each kind, see ParseDeletionPolicies
+//
+// The kinds are those of the storage objects, e.g. SBOMSummary or
+// VulnerabilityManifest, and ConfigMap for the bookkeeping objects of
+// WithOwnerReferences. Kinds without a policy are deleted.
+func WithDeletionPolicies(policies map[string]DeletionPolicy) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		wh.deletionPolicies = policies
+	}
+}
+
+// WithVulnerabilityManifestRetention makes the WatchHandler retain the orphaned Vulnerability Manifests for the given duration before deleting them, see dueForDeletion
+//
+// Orphaned manifests are marked with the time they are due for deletion at,
+// and deleted by the first cleanUp past it. The ones tracked again before
+// are unmarked. A duration that is not positive disables the retention.
+func WithVulnerabilityManifestRetention(retention time.Duration) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		wh.vulnerabilityManifestRetention = retention
+	}
+}
+
+// WithDeletionGracePeriod makes the WatchHandler delete the orphaned storage objects only if they are still orphaned after the given grace period, see pendingDeletions
+//
+// The objects found orphaned within the grace period are deleted by the
+// first cleanUp or event past it. A grace period that is not positive
+// deletes them right away.
+func WithDeletionGracePeriod(gracePeriod time.Duration) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		wh.pendingDeletions = newPendingDeletions(gracePeriod, pendingDeletionsSize)
+	}
+}
+
+// WithResyncPeriod makes the WatchHandler re-trigger the scans of every tracked workload at the given interval, see ResyncWatch
+//
+// The resyncs run independently of the cleanUp routine, at the rate of
+// WithCommandRateLimit if set. A period that is not positive disables them.
+func WithResyncPeriod(period time.Duration) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		wh.resyncPeriod = period
+	}
+}
+
+// WithEventBufferSize makes the watchers buffer up to size events between the reader of their watch and their handler, see bufferEvents
+//
+// Bursts of events are read while the handler waits on the storage, sparing
+// the buffer of the watch on the server. A size that is not positive handles
+// the events as they are read.
+func WithEventBufferSize(size int) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		wh.eventBufferSize = size
+	}
+}
+
+// WithOnDelete makes the WatchHandler call hook after every successful deletion of an orphaned storage object, see deleteStorageObject
+//
+// The kinds are those of the deletion policies, e.g. SBOMSummary or
+// VulnerabilityManifest, and objects are passed whether they were deleted by
+// a watcher or by cleanUp. Objects already gone are passed as well, as they
+// count as deleted, but not the deletions of dry runs and failed ones. The
+// hook is called synchronously, possibly from several goroutines at once, so
+// it must be safe for concurrent use and must not block.
+func WithOnDelete(hook DeletionHook) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		wh.onDelete = hook
+	}
+}
+
+// WithDeletionWorkers makes the watchers submit the deletions of the orphaned storage objects to the given number of workers, see deletionPool
+//
+// The watchers keep handling events while the objects are deleted, in no
+// particular order. The number of deletions waiting for a worker is reported
+// by the operator_deletion_queue_depth metric. A number that is not positive
+// deletes the objects in the watchers, one at a time.
+func WithDeletionWorkers(workers int) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		wh.deletions = newDeletionPool(workers, deletionQueueSize)
+	}
+}
+
+// WithBulkDeletions makes cleanUp and the initial reconcile delete the orphaned storage objects with a DeleteCollection per kind and namespace, see deleteOrphansInBulk
+//
+// The orphaned objects are labeled with kubescape.io/orphaned=true and then
+// deleted together, rather than one request per object. Objects are deleted
+// one by one whenever deleting them in bulk fails, e.g. if the storage does
+// not support DeleteCollection. Objects deleted by the watchers are always
+// deleted one by one.
+func WithBulkDeletions(enabled bool) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		wh.bulkDeletions = enabled
+	}
+}
+
+// WithMaxTrackedWlids bounds the number of workloads tracked in the internal maps, evicting the least recently updated ones above it, see wlidLRU
+//
+// The number of tracked workloads and of evicted ones are reported by the
+// operator_tracked_wlids and operator_wlid_evictions_total metrics. Only the
+// workloads without running Pods are evicted, so the bound is exceeded while
+// more workloads are running. Evicted workloads no longer keep their images
+// tracked until their next Pod event. A number that is not positive tracks every workload, which is the default.
+func WithMaxTrackedWlids(max int) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		wh.wlids = newWlidLRU(max)
+	}
+}
+
+// WithManagedBySelector sets whether the storage objects are watched only if labeled as created by Kubescape, which is the default
+//
+// The Vulnerability Manifests and the SBOMs of every kind are watched with
+// the app.kubernetes.io/managed-by=kubescape label selector. Disabling it
+// supports storages not selecting the watched objects by label: the
+// watchers and cleanUp never delete nor adopt the objects without the label
+// either way, so that the objects created by other tools or users are kept,
+// while the SBOMs still trigger the scans of the workloads of their images.
+func WithManagedBySelector(enabled bool) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		wh.managedBySelector = enabled
+	}
+}
+
+// WithClock makes the WatchHandler and the trackers it owns read the current time from the given clock rather than time.Now, e.g. a fake clock in tests
+//
+// It applies to the watch backoffs, the health of the watchers, the settling
+// after reconnects, the Pod watchdog, the parent cache, the deletion bursts,
+// the deletion grace periods and the deletion retries.
+func WithClock(now func() time.Time) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		wh.clock = now
+	}
+}
+
+// WithErrorHandler makes the WatchHandler pass every error produced by the watchers to the given handler, wrapped in a WatchError
+//
+// Errors are logged regardless of the handler. The handler is called
+// synchronously from the watch loops, so it must not block.
+func WithErrorHandler(handler func(err error)) WatchHandlerOption {
+	return func(wh *WatchHandler) {
+		wh.errorHandler = handler
+	}
+}
@@ -0,0 +1,24 @@
+package watcher
+
+import (
+	"context"
+	"strconv"
+
+	core1 "k8s.io/api/core/v1"
+)
+
+// skipImageScanAnnotation opts a workload out of image scanning when set to "true" on its top-level parent
+const skipImageScanAnnotation = "kubescape.io/skip-image-scan"
+
+// hasSkipImageScanAnnotation returns true if the annotations opt a workload out of image scanning
+func hasSkipImageScanAnnotation(annotations map[string]string) bool {
+	skip, err := strconv.ParseBool(annotations[skipImageScanAnnotation])
+	return err == nil && skip
+}
+
+// skipsImageScan returns true if the workload of the WLID opted out of image scanning
+//
+// Parents that cannot be fetched are not skipped.
+func (wh *WatchHandler) skipsImageScan(ctx context.Context, wlid string, pod *core1.Pod) bool {
+	return hasSkipImageScanAnnotation(wh.getParentAnnotations(ctx, wlid, pod))
+}
@@ -0,0 +1,165 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/armosec/armoapi-go/apis"
+	instanceidhandlerv1 "github.com/kubescape/k8s-interface/instanceidhandler/v1"
+	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	core1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestHasSkipImageScanAnnotation(t *testing.T) {
+	tt := []struct {
+		name        string
+		annotations map[string]string
+		expected    bool
+	}{
+		{name: "No annotations", expected: false},
+		{name: "Opted out", annotations: map[string]string{skipImageScanAnnotation: "true"}, expected: true},
+		{name: "Explicitly opted in", annotations: map[string]string{skipImageScanAnnotation: "false"}, expected: false},
+		{name: "Invalid value", annotations: map[string]string{skipImageScanAnnotation: "yes please"}, expected: false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, hasSkipImageScanAnnotation(tc.annotations))
+		})
+	}
+}
+
+// newDeploymentFake returns a Deployment along with its ReplicaSet and a running Pod of it
+func newDeploymentFake(name string, annotations map[string]string) (*appsv1.Deployment, *appsv1.ReplicaSet, *core1.Pod) {
+	hash := "5d8b7f9c6d"
+	deployment := &appsv1.Deployment{
+		TypeMeta:   v1.TypeMeta{Kind: "Deployment", APIVersion: "apps/v1"},
+		ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+	}
+	replicaSet := &appsv1.ReplicaSet{
+		TypeMeta: v1.TypeMeta{Kind: "ReplicaSet", APIVersion: "apps/v1"},
+		ObjectMeta: v1.ObjectMeta{
+			Name:            name + "-" + hash,
+			Namespace:       "default",
+			Labels:          map[string]string{podTemplateHashLabel: hash},
+			OwnerReferences: []v1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: name}},
+		},
+	}
+	pod := newRunningPodFake("default", name+"-"+hash+"-abcde", map[string]string{name: name + "@" + testDigest(name)})
+	pod.Labels = map[string]string{podTemplateHashLabel: hash}
+	pod.OwnerReferences = []v1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: replicaSet.Name}}
+	return deployment, replicaSet, pod
+}
+
+func TestSkipImageScanAnnotation(t *testing.T) {
+	skipped := map[string]string{skipImageScanAnnotation: "true"}
+	optedOutDeployment, optedOutReplicaSet, optedOutPod := newDeploymentFake("agent", skipped)
+	deployment, replicaSet, pod := newDeploymentFake("nginx", nil)
+	optedOutNakedPod := newRunningPodFake("default", "debug", map[string]string{"debug": "debug@sha256:2ea94eaa0dd665e61ff99839e1f396ce2d1dbfcf82910a48ff00941d0eb9570d"})
+	optedOutNakedPod.Annotations = skipped
+
+	ctx := context.TODO()
+	k8sAPI, k8sClient := newK8sAPIFake(optedOutDeployment, optedOutReplicaSet, optedOutPod, deployment, replicaSet, pod, optedOutNakedPod)
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	wh.parentAnnotations = &parentAnnotationCache{}
+
+	assert.NoError(t, wh.buildIDs(ctx, podListIterator(&core1.PodList{Items: []core1.Pod{*optedOutPod, *pod, *optedOutNakedPod}})))
+
+	wlid := "wlid://cluster-/namespace-default/deployment-nginx"
+	optedOutWlid := "wlid://cluster-/namespace-default/deployment-agent"
+	assert.Equal(t, []string{wlid}, wh.GetWlidsForImageHash("nginx@"+testDigest("nginx")))
+	assert.Empty(t, wh.GetWlidsForImageHash("agent@"+testDigest("agent")))
+	assert.Empty(t, wh.GetWlidsForImageHash("debug@sha256:2ea94eaa0dd665e61ff99839e1f396ce2d1dbfcf82910a48ff00941d0eb9570d"))
+	assert.Empty(t, wh.GetContainerToImageIDForWlid(optedOutWlid))
+	assert.Len(t, wh.GetInstanceIDs(), 1, "only the instance IDs of the workload that did not opt out should be tracked")
+
+	// the Pods are updated with new images
+	recorder := &commandRecorder{}
+	podsWatch := watch.NewFake()
+	done := make(chan struct{})
+	go func() {
+		wh.handlePodWatcher(ctx, podsWatch, newCommandDeduper(0, recorder.emit))
+		close(done)
+	}()
+	for _, p := range []*core1.Pod{optedOutPod, optedOutNakedPod, pod} {
+		updated := p.DeepCopy()
+		updated.Status.ContainerStatuses[0].ImageID = "docker-pullable://" + updated.Status.ContainerStatuses[0].Name + "@" + testDigest(updated.Status.ContainerStatuses[0].Name+"-updated")
+		// the API serves the updated Pods when they are relisted once the watch ends
+		_, err := k8sClient.CoreV1().Pods(updated.Namespace).Update(ctx, updated, v1.UpdateOptions{})
+		assert.NoError(t, err)
+		podsWatch.Modify(updated)
+	}
+	assert.Eventually(t, func() bool { return len(recorder.emitted()) > 0 }, time.Second, 10*time.Millisecond)
+	podsWatch.Stop()
+	<-done
+
+	emitted := recorder.emitted()
+	if assert.Len(t, emitted, 1, "workloads that opted out should not be scanned") {
+		assert.Equal(t, wlid, emitted[0].Wlid)
+	}
+
+	// filtered SBOMs of workloads that opted out trigger no scans
+	var producedCommands []*apis.Command
+	var reportedErrors []error
+	instanceIDs, err := instanceidhandlerv1.GenerateInstanceIDFromPod(pod)
+	assert.NoError(t, err)
+	wh.handleFilteredSBOM(ctx, sbomSPDXv2p3Filtereds, &spdxv1beta1.SBOMSPDXv2p3Filtered{
+		ObjectMeta: v1.ObjectMeta{Name: "agent-filtered", Labels: managedLabels(), Annotations: map[string]string{
+			instanceidhandlerv1.InstanceIDMetadataKey: instanceIDs[0].GetStringFormatted(),
+			instanceidhandlerv1.WlidMetadataKey:       optedOutWlid,
+		}},
+	}, func(cmd *apis.Command) { producedCommands = append(producedCommands, cmd) }, func(err error) { reportedErrors = append(reportedErrors, err) })
+	assert.Empty(t, producedCommands)
+	assert.Empty(t, reportedErrors)
+}
+
+func TestSkipImageScanAnnotationAddedAfterTracking(t *testing.T) {
+	ctx := context.TODO()
+	wlid := "wlid://cluster-/namespace-default/deployment-agent"
+	deployment, replicaSet, pod := newDeploymentFake("agent", nil)
+
+	instanceIDs, err := instanceidhandlerv1.GenerateInstanceIDFromPod(pod)
+	assert.NoError(t, err)
+	storageClient := kssfake.NewSimpleClientset(
+		&spdxv1beta1.SBOMSummary{ObjectMeta: v1.ObjectMeta{Name: "agent", Labels: managedLabels(), Annotations: map[string]string{instanceidhandlerv1.ImageIDMetadataKey: "agent@" + testDigest("agent")}}},
+		&spdxv1beta1.SBOMSPDXv2p3Filtered{ObjectMeta: v1.ObjectMeta{Name: "agent-filtered", Labels: managedLabels(), Annotations: map[string]string{
+			instanceidhandlerv1.InstanceIDMetadataKey: instanceIDs[0].GetStringFormatted(),
+			instanceidhandlerv1.WlidMetadataKey:       wlid,
+		}}},
+	)
+
+	k8sAPI, _ := newK8sAPIFake(deployment, replicaSet, pod)
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	wh.storageClient = storageClient
+	wh.parentAnnotations = &parentAnnotationCache{}
+
+	assert.NoError(t, wh.buildIDs(ctx, podListIterator(&core1.PodList{Items: []core1.Pod{*pod}})))
+	assert.Equal(t, []string{wlid}, wh.GetWlidsForImageHash("agent@"+testDigest("agent")))
+	assert.NotEmpty(t, wh.GetInstanceIDs())
+
+	// the Deployment opts out once already tracked
+	optedOutDeployment := deployment.DeepCopy()
+	optedOutDeployment.Annotations = map[string]string{skipImageScanAnnotation: "true"}
+	wh.k8sAPI, _ = newK8sAPIFake(optedOutDeployment, replicaSet, pod)
+
+	wh.cleanUp(ctx)
+
+	assert.Empty(t, wh.GetWlidsForImageHash("agent@"+testDigest("agent")))
+	assert.Empty(t, wh.GetContainerToImageIDForWlid(wlid))
+	assert.Empty(t, wh.GetInstanceIDs())
+
+	summaries, err := storageClient.SpdxV1beta1().SBOMSummaries("").List(ctx, v1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, summaries.Items, "the SBOMs of workloads that opted out should be garbage-collected")
+	filtered, err := storageClient.SpdxV1beta1().SBOMSPDXv2p3Filtereds("").List(ctx, v1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, filtered.Items, "the filtered SBOMs of workloads that opted out should be garbage-collected")
+}
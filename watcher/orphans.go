@@ -0,0 +1,201 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	// orphanDeletionWorkers is the maximal number of storage deletions performed in parallel
+	orphanDeletionWorkers = 4
+
+	sbomSummaryKind          = "SBOMSummary"
+	sbomSPDXv2p3FilteredKind = "SBOMSPDXv2p3Filtered"
+)
+
+// orphanDeletion is a pending deletion of a storage object
+type orphanDeletion struct {
+	kind      string
+	namespace string
+	name      string
+	// reason is the reason the object is considered orphaned
+	reason string
+	// isOrphan reports if the object is still orphaned. Evaluated right
+	// before deleting, so objects that became tracked again in the
+	// meantime are kept
+	isOrphan func() bool
+	delete   func(ctx context.Context) error
+}
+
+// deletionBatch collects deletions of orphaned storage objects to perform them together
+type deletionBatch struct {
+	deletions []orphanDeletion
+}
+
+// Add adds a deletion to the batch
+func (b *deletionBatch) Add(deletion orphanDeletion) {
+	b.deletions = append(b.deletions, deletion)
+}
+
+// Len returns the number of pending deletions
+func (b *deletionBatch) Len() int {
+	return len(b.deletions)
+}
+
+// Flush performs the pending deletions using a bounded pool of workers
+//
+// Returns the number of deleted objects and the errors that occurred.
+// Objects that are not found are considered deleted, objects kept by the
+// deletion policy of their kind are neither.
+func (b *deletionBatch) Flush(ctx context.Context, workers int) (int, []error) {
+	deletionsCh := make(chan orphanDeletion)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	deleted := 0
+	errs := []error{}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for deletion := range deletionsCh {
+				if !deletion.isOrphan() {
+					continue
+				}
+				err := deletion.delete(ctx)
+				if errors.Is(err, errOrphanKept) {
+					continue
+				}
+
+				mu.Lock()
+				if err != nil && !k8serrors.IsNotFound(err) {
+					errs = append(errs, err)
+				} else {
+					deleted++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, deletion := range b.deletions {
+		deletionsCh <- deletion
+	}
+	close(deletionsCh)
+	wg.Wait()
+
+	b.deletions = nil
+	return deleted, errs
+}
+
+// reclaimOrphans lists the managed storage objects and deletes the ones not tracked anymore in a single batch
+//
+// Vulnerability Manifests are deleted once due, see vulnerabilityManifestDue.
+func (wh *WatchHandler) reclaimOrphans(ctx context.Context) {
+	batch := &deletionBatch{}
+	wh.addSBOMOrphans(ctx, batch)
+	wh.addStorageOwnerOrphans(ctx, batch)
+	wh.addExpiredVulnerabilityManifests(ctx, batch)
+	wh.flushOrphans(ctx, "cleanUp", batch)
+}
+
+// addSBOMOrphans lists the objects of every SBOM kind and adds the deletions of the orphaned ones to the batch
+func (wh *WatchHandler) addSBOMOrphans(ctx context.Context, batch *deletionBatch) {
+	for _, kind := range sbomKinds {
+		kind := kind
+		listCtx, cancel := wh.storageRequestContext(ctx)
+		objects, _, err := kind.list(wh, listCtx)
+		cancel()
+		if err != nil {
+			logger.L().Ctx(ctx).Error("failed to list SBOMs for cleanup", helpers.String("kind", kind.kind), helpers.Error(err))
+			continue
+		}
+		for _, obj := range objects {
+			isOrphan, reason, ok := wh.sbomOrphanCheck(kind, obj)
+			if !ok {
+				continue
+			}
+			wh.addOrphan(batch, kind.kind, obj, reason, isOrphan, kind.deleteObject(wh, obj), kind.patchObject(wh))
+		}
+	}
+}
+
+// addOrphan adds the deletion of an orphaned storage object to the batch, performed according to the deletion policy of its kind, see handleOrphan
+func (wh *WatchHandler) addOrphan(batch *deletionBatch, kind string, obj orphanObject, reason string, isOrphan func() bool, deleteObject func(ctx context.Context) error, patch func(ctx context.Context, namespace, name string, data []byte) error) {
+	// storage objects not created by Kubescape are never deleted, while the
+	// storage owners are ConfigMaps of the operator, see storageOwnerLabel
+	if kind != storageOwnerKind && !isManagedObject(obj) {
+		return
+	}
+	batch.Add(orphanDeletion{
+		kind:      kind,
+		namespace: obj.GetNamespace(),
+		name:      obj.GetName(),
+		reason:    reason,
+		isOrphan: func() bool {
+			if isOrphan() {
+				return true
+			}
+			// tracked again, its grace period starts over once orphaned again
+			wh.pendingDeletions.Forget(orphanKey(kind, obj))
+			return false
+		},
+		delete: func(ctx context.Context) error {
+			deleted, err := wh.handleOrphan(ctx, kind, obj, reason, deleteObject, patch)
+			if err == nil && !deleted {
+				return errOrphanKept
+			}
+			if deleted {
+				wh.retryFailedDeletion(ctx, kind, obj, reason, isOrphan, deleteObject, err)
+			}
+			return err
+		},
+	})
+}
+
+// flushOrphans performs the deletions of the batch and logs their outcome for the given routine
+func (wh *WatchHandler) flushOrphans(ctx context.Context, routine string, batch *deletionBatch) {
+	checked := batch.Len()
+	deleted, errs := wh.flushBatch(ctx, batch)
+	for _, err := range errs {
+		logger.L().Ctx(ctx).Error("failed to delete orphaned storage object", helpers.Error(err))
+	}
+	logger.L().Ctx(ctx).Info(routine+" reclaimed orphaned storage objects",
+		helpers.Int("checked", checked),
+		helpers.Int("deleted", deleted),
+		helpers.Int("failed", len(errs)),
+		helpers.String("dryRun", strconv.FormatBool(wh.dryRun)),
+	)
+}
+
+// sbomOrphanCheck returns a function reporting if an SBOM is orphaned and the reason it would be, false if the SBOM cannot be identified or is left to the garbage collector
+func (wh *WatchHandler) sbomOrphanCheck(kind sbomKind, obj sbomObject) (func() bool, string, bool) {
+	if wh.leftToGarbageCollector(obj) {
+		return nil, "", false
+	}
+
+	if kind.filtered {
+		instanceID, err := annotationsToInstanceID(obj.GetAnnotations())
+		if err != nil {
+			return nil, "", false
+		}
+		return func() bool {
+			return !wh.hasInstanceID(instanceID)
+		}, deletionReasonInstanceIDNotTracked, true
+	}
+
+	imageID, err := annotationsToImageID(obj.GetAnnotations())
+	if err != nil {
+		return nil, "", false
+	}
+	imageIDs := sbomImageIDs(imageID, obj.GetAnnotations())
+	return func() bool {
+		return !wh.isImageIDTracked(imageIDs...)
+	}, deletionReasonImageHashNotTracked, true
+}
@@ -0,0 +1,88 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+
+	instanceidhandlerv1 "github.com/kubescape/k8s-interface/instanceidhandler/v1"
+	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDeletionBatchFlush(t *testing.T) {
+	errDeletion := errors.New("deletion failed")
+	tracked := map[string]bool{"tracked": true}
+	deletedNames := make(chan string, 10)
+
+	batch := &deletionBatch{}
+	for _, name := range []string{"orphan-01", "orphan-02", "tracked", "failing", "reappearing"} {
+		name := name
+		batch.Add(orphanDeletion{
+			name:     name,
+			isOrphan: func() bool { return !tracked[name] },
+			delete: func(ctx context.Context) error {
+				if name == "failing" {
+					return errDeletion
+				}
+				deletedNames <- name
+				return nil
+			},
+		})
+	}
+	// the hash reappears in the live map after being added to the batch
+	tracked["reappearing"] = true
+
+	deleted, errs := batch.Flush(context.TODO(), 2)
+	close(deletedNames)
+
+	actualNames := []string{}
+	for name := range deletedNames {
+		actualNames = append(actualNames, name)
+	}
+	sort.Strings(actualNames)
+
+	assert.Equal(t, 2, deleted)
+	assert.Equal(t, []error{errDeletion}, errs)
+	assert.Equal(t, []string{"orphan-01", "orphan-02"}, actualNames)
+	assert.Equal(t, 0, batch.Len())
+}
+
+func TestReclaimOrphans(t *testing.T) {
+	knownImageID := "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"
+	unknownImageID := "alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb"
+	knownInstanceID := "apiVersion-v1/namespace-default/kind-Pod/name-reverse-proxy/containerName-nginx"
+	unknownInstanceID := "apiVersion-v1/namespace-default/kind-Pod/name-reverse-proxy/containerName-sidecar"
+
+	ctx := context.TODO()
+	storageClient := kssfake.NewSimpleClientset(
+		&spdxv1beta1.SBOMSummary{ObjectMeta: v1.ObjectMeta{Name: "known", Labels: managedLabels(), Annotations: map[string]string{instanceidhandlerv1.ImageIDMetadataKey: knownImageID}}},
+		&spdxv1beta1.SBOMSPDXv2p3{ObjectMeta: v1.ObjectMeta{Name: "known", Labels: managedLabels()}},
+		&spdxv1beta1.SBOMSummary{ObjectMeta: v1.ObjectMeta{Name: "unknown", Labels: managedLabels(), Annotations: map[string]string{instanceidhandlerv1.ImageIDMetadataKey: unknownImageID}}},
+		&spdxv1beta1.SBOMSPDXv2p3{ObjectMeta: v1.ObjectMeta{Name: "unknown", Labels: managedLabels()}},
+		&spdxv1beta1.SBOMSPDXv2p3Filtered{ObjectMeta: v1.ObjectMeta{Name: "known-filtered", Labels: managedLabels(), Annotations: map[string]string{instanceidhandlerv1.InstanceIDMetadataKey: knownInstanceID}}},
+		&spdxv1beta1.SBOMSPDXv2p3Filtered{ObjectMeta: v1.ObjectMeta{Name: "unknown-filtered", Labels: managedLabels(), Annotations: map[string]string{instanceidhandlerv1.InstanceIDMetadataKey: unknownInstanceID}}},
+	)
+	knownInstanceIDSlug, _ := annotationsToInstanceID(map[string]string{instanceidhandlerv1.InstanceIDMetadataKey: knownInstanceID})
+
+	wh := NewWatchHandlerMock()
+	wh.storageClient = storageClient
+	wh.iwMap = NewImageHashWLIDsMapFrom(imageHashKeys(map[string][]string{knownImageID: {"wlid"}}))
+	wh.managedInstanceIDSlugs = newPodInstanceIDs(knownInstanceIDSlug)
+
+	wh.reclaimOrphans(ctx)
+
+	summaries, _ := storageClient.SpdxV1beta1().SBOMSummaries("").List(ctx, v1.ListOptions{})
+	sboms, _ := storageClient.SpdxV1beta1().SBOMSPDXv2p3s("").List(ctx, v1.ListOptions{})
+	filtered, _ := storageClient.SpdxV1beta1().SBOMSPDXv2p3Filtereds("").List(ctx, v1.ListOptions{})
+
+	assert.Len(t, summaries.Items, 1)
+	assert.Equal(t, "known", summaries.Items[0].Name)
+	assert.Len(t, sboms.Items, 1)
+	assert.Equal(t, "known", sboms.Items[0].Name)
+	assert.Len(t, filtered.Items, 1)
+	assert.Equal(t, "known-filtered", filtered.Items[0].Name)
+}
@@ -0,0 +1,92 @@
+package watcher
+
+import (
+	"strings"
+
+	"github.com/kubescape/k8s-interface/workloadinterface"
+	core1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// podTemplateHashLabel is the label set by the Deployment controller on its ReplicaSets and their Pods
+const podTemplateHashLabel = "pod-template-hash"
+
+// resolvePodParentLocally resolves the parent of a Pod that is known to be its own parent from its owner references only
+//
+// Standalone Pods and static Pods, whose mirror Pods are owned by their Node,
+// are their own parent. Returns false for the Pods of other owners, whose
+// parent may itself be owned, e.g. a StatefulSet owned by a custom resource,
+// in which case the caller should resolve it with calculateWorkloadParent.
+func resolvePodParentLocally(pod *core1.Pod) (string, string, bool) {
+	ownerReferences := pod.GetOwnerReferences()
+	if len(ownerReferences) == 0 {
+		// Pods with a pod-template-hash label but no owner have to be
+		// matched to their ReplicaSet by labels
+		if _, ok := pod.GetLabels()[podTemplateHashLabel]; ok {
+			return "", "", false
+		}
+		return "Pod", pod.GetName(), true
+	}
+	if ownerReferences[0].Kind == nodeKind {
+		// static Pods are their own parent, see calculateWorkloadParent
+		return "Pod", pod.GetName(), true
+	}
+	return "", "", false
+}
+
+// candidatePodParent returns the kind and name of the likely top-level parent of a Pod from its owner references and labels
+//
+// The Pod → ReplicaSet → Deployment chain is derived from the ReplicaSet name,
+// which the Deployment controller builds from the Deployment name and the
+// pod-template-hash label, and StatefulSets and DaemonSets are their own
+// parent unless they are owned. The candidate is only the top-level parent if
+// it has no owner, see calculateWorkloadParentFromOwners. Returns false when
+// there is no candidate, e.g. for Jobs, bare ReplicaSets and custom resources.
+func candidatePodParent(ownerReferences []v1.OwnerReference, labels map[string]string) (string, string, bool) {
+	if len(ownerReferences) == 0 {
+		return "", "", false
+	}
+
+	owner := ownerReferences[0]
+	switch owner.Kind {
+	case "StatefulSet", "DaemonSet":
+		return owner.Kind, owner.Name, true
+	case "ReplicaSet":
+		hash, ok := labels[podTemplateHashLabel]
+		if !ok || hash == "" {
+			return "", "", false
+		}
+		deploymentName, ok := strings.CutSuffix(owner.Name, "-"+hash)
+		if !ok || deploymentName == "" {
+			return "", "", false
+		}
+		return "Deployment", deploymentName, true
+	}
+	return "", "", false
+}
+
+// calculateWorkloadParentFromOwners resolves the top-level parent of a Pod from its candidate parent, see candidatePodParent
+//
+// Only the candidate is fetched, to make sure it has no owner, rather than
+// every owner between the Pod and its parent. The parent is resolved through
+// the API like the upstream resolution otherwise, see
+// calculateWorkloadParentFromAPI, so that the WLID does not depend on the path.
+func (wh *WatchHandler) calculateWorkloadParentFromOwners(wl workloadinterface.IWorkload) (string, string, error) {
+	ownerReferences, err := wl.GetOwnerReferences()
+	if err != nil || wl.GetKind() != "Pod" {
+		return wh.calculateWorkloadParentFromAPI(wl)
+	}
+	kind, name, ok := candidatePodParent(ownerReferences, wl.GetLabels())
+	if !ok {
+		return wh.calculateWorkloadParentFromAPI(wl)
+	}
+
+	candidate, err := wh.k8sAPI.GetWorkload(wl.GetNamespace(), kind, name)
+	if err != nil {
+		return wh.calculateWorkloadParentFromAPI(wl)
+	}
+	if candidateOwners, err := candidate.GetOwnerReferences(); err != nil || len(candidateOwners) > 0 {
+		return wh.calculateWorkloadParentFromAPI(wl)
+	}
+	return kind, name, nil
+}
@@ -0,0 +1,211 @@
+package watcher
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	pkgwlid "github.com/armosec/utils-k8s-go/wlid"
+	"github.com/kubescape/k8s-interface/k8sinterface"
+	"github.com/kubescape/k8s-interface/workloadinterface"
+	"github.com/kubescape/operator/utils"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	core1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+func TestGetParentForPodFromOwners(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		TypeMeta:   v1.TypeMeta{Kind: "Deployment", APIVersion: "apps/v1"},
+		ObjectMeta: v1.ObjectMeta{Name: "nginx", Namespace: "default"},
+	}
+	deploymentReplicaSet := &appsv1.ReplicaSet{
+		TypeMeta: v1.TypeMeta{Kind: "ReplicaSet", APIVersion: "apps/v1"},
+		ObjectMeta: v1.ObjectMeta{
+			Name:            "nginx-5d8b7f9c6d",
+			Namespace:       "default",
+			Labels:          map[string]string{podTemplateHashLabel: "5d8b7f9c6d"},
+			OwnerReferences: []v1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: "nginx"}},
+		},
+	}
+	bareReplicaSet := &appsv1.ReplicaSet{
+		TypeMeta:   v1.TypeMeta{Kind: "ReplicaSet", APIVersion: "apps/v1"},
+		ObjectMeta: v1.ObjectMeta{Name: "bare", Namespace: "default"},
+	}
+	statefulSet := &appsv1.StatefulSet{
+		TypeMeta:   v1.TypeMeta{Kind: "StatefulSet", APIVersion: "apps/v1"},
+		ObjectMeta: v1.ObjectMeta{Name: "postgres", Namespace: "default"},
+	}
+	daemonSet := &appsv1.DaemonSet{
+		TypeMeta:   v1.TypeMeta{Kind: "DaemonSet", APIVersion: "apps/v1"},
+		ObjectMeta: v1.ObjectMeta{Name: "fluentd", Namespace: "default"},
+	}
+	// workloads managed by the operators of custom resources
+	natsCluster := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "nats.io/v1alpha2",
+		"kind":       "NatsCluster",
+		"metadata":   map[string]interface{}{"name": "nats", "namespace": "default"},
+	}}
+	ownedStatefulSet := &appsv1.StatefulSet{
+		TypeMeta: v1.TypeMeta{Kind: "StatefulSet", APIVersion: "apps/v1"},
+		ObjectMeta: v1.ObjectMeta{
+			Name:            "nats",
+			Namespace:       "default",
+			OwnerReferences: []v1.OwnerReference{{APIVersion: "nats.io/v1alpha2", Kind: "NatsCluster", Name: "nats"}},
+		},
+	}
+	vizier := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "px.dev/v1alpha1",
+		"kind":       "Vizier",
+		"metadata":   map[string]interface{}{"name": "pixie", "namespace": "default"},
+	}}
+	ownedDeployment := &appsv1.Deployment{
+		TypeMeta: v1.TypeMeta{Kind: "Deployment", APIVersion: "apps/v1"},
+		ObjectMeta: v1.ObjectMeta{
+			Name:            "kelvin",
+			Namespace:       "default",
+			OwnerReferences: []v1.OwnerReference{{APIVersion: "px.dev/v1alpha1", Kind: "Vizier", Name: "pixie"}},
+		},
+	}
+	ownedDeploymentReplicaSet := &appsv1.ReplicaSet{
+		TypeMeta: v1.TypeMeta{Kind: "ReplicaSet", APIVersion: "apps/v1"},
+		ObjectMeta: v1.ObjectMeta{
+			Name:            "kelvin-7c9f8d6b5",
+			Namespace:       "default",
+			Labels:          map[string]string{podTemplateHashLabel: "7c9f8d6b5"},
+			OwnerReferences: []v1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: "kelvin"}},
+		},
+	}
+
+	tt := []struct {
+		name    string
+		podName string
+		owner   v1.OwnerReference
+		labels  map[string]string
+		// expectedParentOnly is true if only the parent is fetched to resolve it
+		expectedParentOnly bool
+	}{
+		{
+			name:               "Pod of a Deployment",
+			podName:            "nginx-5d8b7f9c6d-abcde",
+			owner:              v1.OwnerReference{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "nginx-5d8b7f9c6d", UID: "nginx-5d8b7f9c6d"},
+			labels:             map[string]string{podTemplateHashLabel: "5d8b7f9c6d"},
+			expectedParentOnly: true,
+		},
+		{
+			name:               "Pod of a StatefulSet",
+			podName:            "postgres-0",
+			owner:              v1.OwnerReference{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "postgres", UID: "postgres"},
+			expectedParentOnly: true,
+		},
+		{
+			name:               "Pod of a DaemonSet",
+			podName:            "fluentd-abcde",
+			owner:              v1.OwnerReference{APIVersion: "apps/v1", Kind: "DaemonSet", Name: "fluentd", UID: "fluentd"},
+			expectedParentOnly: true,
+		},
+		{
+			name:    "Pod of a bare ReplicaSet is resolved through the API",
+			podName: "bare-abcde",
+			owner:   v1.OwnerReference{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "bare", UID: "bare"},
+		},
+		{
+			name:    "Pod of a StatefulSet owned by a custom resource is resolved through the API",
+			podName: "nats-0",
+			owner:   v1.OwnerReference{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "nats", UID: "nats"},
+		},
+		{
+			name:    "Pod of a Deployment owned by a custom resource is resolved through the API",
+			podName: "kelvin-7c9f8d6b5-abcde",
+			owner:   v1.OwnerReference{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "kelvin-7c9f8d6b5", UID: "kelvin-7c9f8d6b5"},
+			labels:  map[string]string{podTemplateHashLabel: "7c9f8d6b5"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := newRunningPodFake("default", tc.podName, map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"},
+				withOwner(tc.owner), withLabels(tc.labels))
+			objects := []runtime.Object{deployment, deploymentReplicaSet, bareReplicaSet, statefulSet, daemonSet, ownedStatefulSet, ownedDeployment, ownedDeploymentReplicaSet, pod}
+			k8sinterface.InitializeMapResourcesMock()
+			dynamicClient := dynamicfake.NewSimpleDynamicClient(scheme.Scheme, append([]runtime.Object{natsCluster, vizier}, objects...)...)
+			k8sAPI := utils.NewK8sInterfaceFakeWithDynamicClient(k8sfake.NewSimpleClientset(objects...), dynamicClient)
+
+			// the parent resolved through the API
+			podMarshalled, err := json.Marshal(pod)
+			assert.NoError(t, err)
+			wl, err := workloadinterface.NewWorkload(podMarshalled)
+			assert.NoError(t, err)
+			expectedKind, expectedName, err := k8sAPI.CalculateWorkloadParentRecursive(wl)
+			assert.NoError(t, err)
+			expectedWlid := pkgwlid.GetWLID(utils.ClusterConfig.ClusterName, "default", expectedKind, expectedName)
+
+			_, _, ok := resolvePodParentLocally(pod)
+			assert.False(t, ok, "the parents of owned Pods may be owned")
+
+			wh := NewWatchHandlerMock()
+			wh.k8sAPI = k8sAPI
+			wh.parents = newParentCache(time.Minute, parentCacheSize)
+			dynamicClient.ClearActions()
+
+			_, wlid, err := wh.getParentForPod(pod.DeepCopy())
+			assert.NoError(t, err)
+			assert.Equal(t, expectedWlid, wlid)
+			if tc.expectedParentOnly {
+				assert.Len(t, dynamicClient.Actions(), 1, "the parent should be fetched without its intermediate owners")
+			}
+
+			// the parents of the other Pods of the owner are cached
+			dynamicClient.ClearActions()
+			_, wlid, err = wh.getParentForPod(pod.DeepCopy())
+			assert.NoError(t, err)
+			assert.Equal(t, expectedWlid, wlid)
+			assert.Empty(t, dynamicClient.Actions())
+		})
+	}
+}
+
+func TestResolvePodParentLocally(t *testing.T) {
+	tt := []struct {
+		name         string
+		pod          *core1.Pod
+		expected     bool
+		expectedName string
+	}{
+		{
+			name:         "standalone Pods are their own parent",
+			pod:          newRunningPodFake("default", "debug", map[string]string{"debug": "debug@sha256:2ea94eaa0dd665e61ff99839e1f396ce2d1dbfcf82910a48ff00941d0eb9570d"}),
+			expected:     true,
+			expectedName: "debug",
+		},
+		{
+			name: "static Pods are their own parent",
+			pod: newRunningPodFake("kube-system", "kube-apiserver-node1", map[string]string{"kube-apiserver": "kube-apiserver@sha256:e82e2128653d0fabcbeeb06bd059af3a020be21453caa54fa3a31352582c749f"},
+				withOwner(v1.OwnerReference{APIVersion: "v1", Kind: nodeKind, Name: "node1"})),
+			expected:     true,
+			expectedName: "kube-apiserver-node1",
+		},
+		{
+			name: "Pods matched to their ReplicaSet by labels are not resolved locally",
+			pod: newRunningPodFake("default", "nginx-abcde", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"},
+				withLabels(map[string]string{podTemplateHashLabel: "5d8b7f9c6d"})),
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			kind, name, ok := resolvePodParentLocally(tc.pod)
+			assert.Equal(t, tc.expected, ok)
+			if tc.expected {
+				assert.Equal(t, "Pod", kind)
+				assert.Equal(t, tc.expectedName, name)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package watcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	storageOwnerKind = "ConfigMap"
+	// storageOwnerLabel labels the bookkeeping objects owning storage objects, see WithOwnerReferences
+	storageOwnerLabel = "kubescape.io/storage-owner"
+	// storageOwnerPrefix prefixes the names of the bookkeeping objects owning storage objects
+	storageOwnerPrefix = "storage-owner-"
+	// ownedImageHashAnnotation is the image hash of the storage objects a bookkeeping object owns
+	ownedImageHashAnnotation = "kubescape.io/owned-image-hash"
+	// ownedInstanceIDAnnotation is the hashed instance ID of the storage objects a bookkeeping object owns
+	ownedInstanceIDAnnotation = "kubescape.io/owned-instance-id"
+)
+
+// ownedObject is a storage object that may have owners
+type ownedObject interface {
+	GetName() string
+	GetNamespace() string
+	GetOwnerReferences() []v1.OwnerReference
+}
+
+// storageOwner identifies the bookkeeping object owning the storage objects of an image or of an instance ID
+//
+// Storage objects are shared by the workloads of an image, and live in
+// another namespace than them, so they cannot be owned by their workloads.
+// They are owned by a bookkeeping object of their namespace instead, which
+// cleanUp deletes once its image or instance ID is not tracked anymore: the
+// garbage collector then deletes the storage objects it owns.
+type storageOwner struct {
+	namespace  string
+	annotation string // ownedImageHashAnnotation or ownedInstanceIDAnnotation
+	id         string // image hash or hashed instance ID
+}
+
+// imageStorageOwner returns the owner of the storage objects of the given namespace identified by an image ID
+func imageStorageOwner(namespace, imageID string) storageOwner {
+	return storageOwner{namespace: namespace, annotation: ownedImageHashAnnotation, id: imageHashKey(imageID)}
+}
+
+// instanceIDStorageOwner returns the owner of the storage objects of the given namespace identified by a hashed instance ID
+func instanceIDStorageOwner(namespace, hashedInstanceID string) storageOwner {
+	return storageOwner{namespace: namespace, annotation: ownedInstanceIDAnnotation, id: hashedInstanceID}
+}
+
+// name returns the name of the bookkeeping object, derived from what it owns as image hashes are no valid names
+func (o storageOwner) name() string {
+	sum := sha256.Sum256([]byte(o.annotation + "/" + o.id))
+	return storageOwnerPrefix + hex.EncodeToString(sum[:16])
+}
+
+// storageOwnerUIDs caches the UIDs of the bookkeeping objects, to avoid getting them for every event
+//
+// The nil value caches nothing.
+type storageOwnerUIDs struct {
+	uids map[string]types.UID // <namespace>/<name> : UID
+	mu   sync.RWMutex
+}
+
+func newStorageOwnerUIDs() *storageOwnerUIDs {
+	return &storageOwnerUIDs{uids: make(map[string]types.UID)}
+}
+
+// Get returns the cached UID of a bookkeeping object, false if it is not cached
+func (c *storageOwnerUIDs) Get(namespace, name string) (types.UID, bool) {
+	if c == nil {
+		return "", false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	uid, ok := c.uids[namespace+"/"+name]
+	return uid, ok
+}
+
+// Set caches the UID of a bookkeeping object
+func (c *storageOwnerUIDs) Set(namespace, name string, uid types.UID) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.uids[namespace+"/"+name] = uid
+}
+
+// Forget removes a bookkeeping object from the cache, once it is deleted
+func (c *storageOwnerUIDs) Forget(namespace, name string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.uids, namespace+"/"+name)
+}
+
+// leftToGarbageCollector returns true if an untracked storage object is deleted by the garbage collector rather than by the operator
+//
+// With WithOwnerReferences, only the objects without owners, which predate
+// the ownership scheme, are deleted by the operator.
+func (wh *WatchHandler) leftToGarbageCollector(obj ownedObject) bool {
+	return wh.storageOwners != nil && len(obj.GetOwnerReferences()) > 0
+}
+
+// ensureStorageOwner returns the owner reference of the bookkeeping object of an owner, creating the object if needed
+func (wh *WatchHandler) ensureStorageOwner(ctx context.Context, owner storageOwner) (v1.OwnerReference, error) {
+	name := owner.name()
+	ref := v1.OwnerReference{APIVersion: "v1", Kind: storageOwnerKind, Name: name}
+	if uid, ok := wh.storageOwners.Get(owner.namespace, name); ok {
+		ref.UID = uid
+		return ref, nil
+	}
+
+	configMaps := wh.k8sAPI.KubernetesClient.CoreV1().ConfigMaps(owner.namespace)
+	configMap, err := configMaps.Create(ctx, &corev1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        name,
+			Namespace:   owner.namespace,
+			Labels:      map[string]string{storageOwnerLabel: "true"},
+			Annotations: map[string]string{owner.annotation: owner.id},
+		},
+	}, v1.CreateOptions{})
+	if k8serrors.IsAlreadyExists(err) {
+		configMap, err = configMaps.Get(ctx, name, v1.GetOptions{})
+	}
+	if err != nil {
+		return ref, fmt.Errorf("failed to get the owner of the storage objects: %w", err)
+	}
+
+	wh.storageOwners.Set(owner.namespace, name, configMap.UID)
+	ref.UID = configMap.UID
+	return ref, nil
+}
+
+// adoptStorageObject sets the bookkeeping object of an owner as the owner of a tracked storage object, unless the object has owners already
+//
+// It does nothing unless WithOwnerReferences is enabled. Patch patches the
+// object of the given namespace and name with a merge patch.
+func (wh *WatchHandler) adoptStorageObject(ctx context.Context, kind string, obj ownedObject, owner storageOwner, patch func(ctx context.Context, namespace, name string, data []byte) error) error {
+	if wh.storageOwners == nil || len(obj.GetOwnerReferences()) > 0 {
+		return nil
+	}
+
+	ref, err := wh.ensureStorageOwner(ctx, owner)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"ownerReferences": []v1.OwnerReference{ref}},
+	})
+	if err != nil {
+		return err
+	}
+
+	requestCtx, cancel := wh.storageRequestContext(ctx)
+	defer cancel()
+	if err := patch(requestCtx, obj.GetNamespace(), obj.GetName(), data); err != nil && !k8serrors.IsNotFound(err) {
+		return fmt.Errorf("failed to set the owner of %s %s/%s: %w", kind, obj.GetNamespace(), obj.GetName(), err)
+	}
+	logger.L().Ctx(ctx).Debug("set the owner of storage object",
+		helpers.String("kind", kind), helpers.String("namespace", obj.GetNamespace()), helpers.String("name", obj.GetName()), helpers.String("owner", ref.Name))
+	return nil
+}
+
+// storageOwnerOrphanCheck returns a function reporting if a bookkeeping object owns the storage objects of an untracked image or instance ID, false if it owns nothing known
+func (wh *WatchHandler) storageOwnerOrphanCheck(configMap *corev1.ConfigMap) (func() bool, string, bool) {
+	if imageHash, ok := configMap.Annotations[ownedImageHashAnnotation]; ok {
+		return func() bool {
+			return !wh.isImageIDTracked(imageHash)
+		}, deletionReasonImageHashNotTracked, true
+	}
+	if instanceID, ok := configMap.Annotations[ownedInstanceIDAnnotation]; ok {
+		return func() bool {
+			return !wh.hasInstanceID(instanceID)
+		}, deletionReasonInstanceIDNotTracked, true
+	}
+	return nil, "", false
+}
+
+// addStorageOwnerOrphans lists the bookkeeping objects and adds the deletions of those owning untracked storage objects to the batch
+//
+// Deleting them lets the garbage collector delete the storage objects they own.
+func (wh *WatchHandler) addStorageOwnerOrphans(ctx context.Context, batch *deletionBatch) {
+	if wh.storageOwners == nil {
+		return
+	}
+
+	configMaps, err := wh.k8sAPI.KubernetesClient.CoreV1().ConfigMaps("").List(ctx, v1.ListOptions{LabelSelector: storageOwnerLabel + "=true"})
+	if err != nil {
+		logger.L().Ctx(ctx).Error("failed to list the owners of the storage objects for cleanup", helpers.Error(err))
+		return
+	}
+	for i := range configMaps.Items {
+		configMap := &configMaps.Items[i]
+		isOrphan, reason, ok := wh.storageOwnerOrphanCheck(configMap)
+		if !ok {
+			continue
+		}
+		namespace, name := configMap.Namespace, configMap.Name
+		wh.addOrphan(batch, storageOwnerKind, configMap, reason, isOrphan, func(ctx context.Context) error {
+			wh.storageOwners.Forget(namespace, name)
+			propagation := v1.DeletePropagationBackground
+			return wh.k8sAPI.KubernetesClient.CoreV1().ConfigMaps(namespace).Delete(ctx, name, v1.DeleteOptions{PropagationPolicy: &propagation})
+		}, func(ctx context.Context, namespace, name string, data []byte) error {
+			_, err := wh.k8sAPI.KubernetesClient.CoreV1().ConfigMaps(namespace).Patch(ctx, name, types.MergePatchType, data, v1.PatchOptions{})
+			return err
+		})
+	}
+}
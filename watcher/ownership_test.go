@@ -0,0 +1,174 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+
+	instanceidv1 "github.com/kubescape/k8s-interface/instanceidhandler/v1"
+	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// ownedBy returns object metadata of the given name and image ID, owned by the given owners
+func ownedBy(name, imageID string, owners ...string) v1.ObjectMeta {
+	meta := v1.ObjectMeta{
+		Name:        name,
+		Namespace:   "kubescape",
+		Labels:      managedLabels(),
+		Annotations: map[string]string{instanceidv1.ImageIDMetadataKey: imageID},
+	}
+	for _, owner := range owners {
+		meta.OwnerReferences = append(meta.OwnerReferences, v1.OwnerReference{APIVersion: "v1", Kind: storageOwnerKind, Name: owner, UID: types.UID("uid-" + owner)})
+	}
+	return meta
+}
+
+func TestHandleSBOMEventsWithOwnerReferences(t *testing.T) {
+	trackedImageID := "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"
+	untrackedImageID := "nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432"
+	tracked := &spdxv1beta1.SBOMSummary{ObjectMeta: ownedBy("tracked", trackedImageID)}
+	// some objects predate the ownership scheme while others were adopted already
+	legacy := &spdxv1beta1.SBOMSummary{ObjectMeta: ownedBy("legacy", untrackedImageID)}
+	owned := &spdxv1beta1.SBOMSummary{ObjectMeta: ownedBy("owned", untrackedImageID, "previous-owner")}
+
+	tt := []struct {
+		name            string
+		ownerReferences bool
+		expectedNames   []string
+		expectedOwned   bool
+	}{
+		{
+			name:          "owned objects are deleted like the others by default",
+			expectedNames: []string{"tracked"},
+		},
+		{
+			name:            "owned objects are left to the garbage collector",
+			ownerReferences: true,
+			expectedNames:   []string{"owned", "tracked"},
+			expectedOwned:   true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.TODO()
+			k8sAPI, k8sClient := newK8sAPIFake(newRunningPodFake("default", "nginx", map[string]string{"nginx": trackedImageID}))
+			storageClient := kssfake.NewSimpleClientset(tracked.DeepCopy(), legacy.DeepCopy(), owned.DeepCopy())
+			wh, err := NewWatchHandler(k8sAPI, storageClient, nil, nil, WithOwnerReferences(tc.ownerReferences))
+			assert.NoError(t, err)
+			assert.NoError(t, wh.Start(ctx))
+
+			sbomEvents := make(chan watch.Event, 3)
+			for _, obj := range []*spdxv1beta1.SBOMSummary{tracked, legacy, owned} {
+				sbomEvents <- watch.Event{Type: watch.Modified, Object: obj.DeepCopy()}
+			}
+			close(sbomEvents)
+			errCh := make(chan error)
+			go wh.HandleSBOMEvents(ctx, sbomEvents, nil, errCh)
+			for err := range errCh {
+				assert.NoError(t, err)
+			}
+
+			summaries, err := storageClient.SpdxV1beta1().SBOMSummaries("").List(ctx, v1.ListOptions{})
+			assert.NoError(t, err)
+			names := []string{}
+			for i := range summaries.Items {
+				names = append(names, summaries.Items[i].Name)
+			}
+			assert.ElementsMatch(t, tc.expectedNames, names)
+
+			adopted, err := storageClient.SpdxV1beta1().SBOMSummaries("kubescape").Get(ctx, "tracked", v1.GetOptions{})
+			assert.NoError(t, err)
+			owner := imageStorageOwner("kubescape", trackedImageID)
+			configMap, err := k8sClient.CoreV1().ConfigMaps("kubescape").Get(ctx, owner.name(), v1.GetOptions{})
+			if !tc.expectedOwned {
+				assert.Empty(t, adopted.OwnerReferences)
+				assert.Error(t, err, "no owner should be created by default")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, owner.id, configMap.Annotations[ownedImageHashAnnotation])
+			if assert.Len(t, adopted.OwnerReferences, 1, "tracked objects should be adopted") {
+				assert.Equal(t, owner.name(), adopted.OwnerReferences[0].Name)
+				assert.Equal(t, configMap.UID, adopted.OwnerReferences[0].UID)
+			}
+		})
+	}
+}
+
+func TestHandleVulnerabilityManifestEventWithOwnerReferences(t *testing.T) {
+	ctx := context.TODO()
+	imageID := "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"
+	k8sAPI, k8sClient := newK8sAPIFake(newRunningPodFake("default", "nginx", map[string]string{"nginx": imageID}))
+	manifest := &spdxv1beta1.VulnerabilityManifest{ObjectMeta: v1.ObjectMeta{Name: imageID, Namespace: "kubescape", Labels: managedLabels()}}
+	storageClient := kssfake.NewSimpleClientset(manifest.DeepCopy())
+	wh, err := NewWatchHandler(k8sAPI, storageClient, nil, nil, WithOwnerReferences(true))
+	assert.NoError(t, err)
+	assert.NoError(t, wh.Start(ctx))
+
+	wh.handleVulnerabilityManifestEvent(ctx, watch.Event{Type: watch.Added, Object: manifest.DeepCopy()}, func(err error) {
+		assert.NoError(t, err)
+	})
+
+	adopted, err := storageClient.SpdxV1beta1().VulnerabilityManifests("kubescape").Get(ctx, imageID, v1.GetOptions{})
+	assert.NoError(t, err)
+	owner := imageStorageOwner("kubescape", imageID)
+	_, err = k8sClient.CoreV1().ConfigMaps("kubescape").Get(ctx, owner.name(), v1.GetOptions{})
+	assert.NoError(t, err)
+	if assert.Len(t, adopted.OwnerReferences, 1) {
+		assert.Equal(t, owner.name(), adopted.OwnerReferences[0].Name)
+	}
+}
+
+func TestReclaimOrphansWithOwnerReferences(t *testing.T) {
+	ctx := context.TODO()
+	trackedImageID := "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"
+	untrackedImageID := "nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432"
+	storageOwnerFake := func(owner storageOwner) *corev1.ConfigMap {
+		return &corev1.ConfigMap{ObjectMeta: v1.ObjectMeta{
+			Name:        owner.name(),
+			Namespace:   owner.namespace,
+			Labels:      map[string]string{storageOwnerLabel: "true"},
+			Annotations: map[string]string{owner.annotation: owner.id},
+		}}
+	}
+	trackedOwner := imageStorageOwner("kubescape", trackedImageID)
+	untrackedOwner := imageStorageOwner("kubescape", untrackedImageID)
+	untrackedInstanceIDOwner := instanceIDStorageOwner("kubescape", "default-pod-nginx-1234-5678")
+
+	k8sAPI, k8sClient := newK8sAPIFake(
+		newRunningPodFake("default", "nginx", map[string]string{"nginx": trackedImageID}),
+		storageOwnerFake(trackedOwner),
+		storageOwnerFake(untrackedOwner),
+		storageOwnerFake(untrackedInstanceIDOwner),
+	)
+	storageClient := kssfake.NewSimpleClientset(
+		&spdxv1beta1.SBOMSummary{ObjectMeta: ownedBy("owned", untrackedImageID, untrackedOwner.name())},
+		&spdxv1beta1.SBOMSummary{ObjectMeta: ownedBy("legacy", untrackedImageID)},
+	)
+	wh, err := NewWatchHandler(k8sAPI, storageClient, nil, nil, WithOwnerReferences(true))
+	assert.NoError(t, err)
+	assert.NoError(t, wh.Start(ctx))
+
+	wh.reclaimOrphans(ctx)
+
+	configMaps, err := k8sClient.CoreV1().ConfigMaps("kubescape").List(ctx, v1.ListOptions{})
+	assert.NoError(t, err)
+	names := []string{}
+	for i := range configMaps.Items {
+		names = append(names, configMaps.Items[i].Name)
+	}
+	assert.Equal(t, []string{trackedOwner.name()}, names, "the owners of untracked objects should be deleted")
+
+	// the garbage collector deletes the owned objects once their owner is gone, the others are deleted right away
+	summaries, err := storageClient.SpdxV1beta1().SBOMSummaries("").List(ctx, v1.ListOptions{})
+	assert.NoError(t, err)
+	if assert.Len(t, summaries.Items, 1) {
+		assert.Equal(t, "owned", summaries.Items[0].Name)
+	}
+}
@@ -0,0 +1,92 @@
+package watcher
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	pkgwlid "github.com/armosec/utils-k8s-go/wlid"
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	core1 "k8s.io/api/core/v1"
+)
+
+// parentAnnotationCache caches the annotations of the top-level parents of Pods, by WLID
+//
+// The cache is reset whenever the internal maps are rebuilt, so annotations
+// added to or removed from a workload take effect at the next cleanUp at the
+// latest. The nil value caches nothing, and no parent is fetched
+type parentAnnotationCache struct {
+	annotations map[string]map[string]string
+	mu          sync.Mutex
+}
+
+// Get returns the cached annotations of the parent of the WLID, false if it is not cached
+func (c *parentAnnotationCache) Get(wlid string) (map[string]string, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	annotations, ok := c.annotations[wlid]
+	return annotations, ok
+}
+
+// Set caches the annotations of the parent of the WLID
+func (c *parentAnnotationCache) Set(wlid string, annotations map[string]string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.annotations == nil {
+		c.annotations = make(map[string]map[string]string)
+	}
+	c.annotations[wlid] = annotations
+}
+
+// Reset removes all the cached parents
+func (c *parentAnnotationCache) Reset() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.annotations = nil
+}
+
+// getParentAnnotations returns the annotations of the top-level parent of the WLID
+//
+// Pods that are their own parent are read directly. Other parents are
+// fetched from the API, and their annotations are cached. It returns nil if
+// the parent cannot be fetched, or if the cache is disabled.
+func (wh *WatchHandler) getParentAnnotations(ctx context.Context, wlid string, pod *core1.Pod) map[string]string {
+	if wh.parentAnnotations == nil {
+		return nil
+	}
+
+	kind, name := pkgwlid.GetKindFromWlid(wlid), pkgwlid.GetNameFromWlid(wlid)
+	if pod != nil && strings.EqualFold(kind, "Pod") && name == pod.GetName() {
+		return pod.GetAnnotations()
+	}
+
+	if annotations, ok := wh.parentAnnotations.Get(wlid); ok {
+		return annotations
+	}
+
+	parent, err := wh.k8sAPI.GetWorkload(pkgwlid.GetNamespaceFromWlid(wlid), kind, name)
+	if err != nil {
+		logger.L().Ctx(ctx).Debug("could not fetch the parent workload to read its annotations", helpers.String("wlid", wlid), helpers.Error(err))
+		return nil
+	}
+
+	annotations := parent.GetAnnotations()
+	wh.parentAnnotations.Set(wlid, annotations)
+	return annotations
+}
@@ -0,0 +1,138 @@
+package watcher
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// parentCacheSize is the maximal number of cached parents
+	parentCacheSize = 4096
+
+	// metricParentCacheHitsTotal is the number of parent resolutions served from the cache
+	metricParentCacheHitsTotal = "operator_parent_cache_hits_total"
+	// metricParentCacheMissesTotal is the number of parent resolutions that were not cached
+	metricParentCacheMissesTotal = "operator_parent_cache_misses_total"
+)
+
+// parentCacheKey identifies the owner of a Pod
+//
+// Owners are identified by UID rather than name, so a workload that is
+// deleted and recreated with the same name is resolved again
+type parentCacheKey struct {
+	namespace string
+	ownerUID  types.UID
+}
+
+// parentCacheEntry is the resolved top-level parent of a Pod owner
+type parentCacheEntry struct {
+	key     parentCacheKey
+	kind    string
+	name    string
+	expires time.Time
+}
+
+// parentCache is an LRU cache with expiration of the parents resolved for Pod owners
+//
+// The nil value caches nothing
+type parentCache struct {
+	ttl     time.Duration
+	size    int
+	entries map[parentCacheKey]*list.Element
+	lru     *list.List
+	now     clock
+	mu      sync.Mutex
+}
+
+// newParentCache returns a cache of the parents resolved for Pod owners, caching them for the given TTL. A TTL of zero disables the cache, returning the nil cache
+func newParentCache(ttl time.Duration, size int) *parentCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &parentCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[parentCacheKey]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+// Get returns the kind and name of the cached parent of an owner, if any and not expired
+func (c *parentCache) Get(key parentCacheKey) (string, string, bool) {
+	if c == nil {
+		return "", "", false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return "", "", false
+	}
+	entry := element.Value.(*parentCacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+		return "", "", false
+	}
+	c.lru.MoveToFront(element)
+	return entry.kind, entry.name, true
+}
+
+// Add caches the parent of an owner, evicting the least recently used parent if the cache is full
+func (c *parentCache) Add(key parentCacheKey, kind, name string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := c.now().Add(c.ttl)
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*parentCacheEntry)
+		entry.kind, entry.name, entry.expires = kind, name, expires
+		c.lru.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&parentCacheEntry{key: key, kind: kind, name: name, expires: expires})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*parentCacheEntry).key)
+	}
+}
+
+// Invalidate removes the cached parent of an owner
+func (c *parentCache) Invalidate(key parentCacheKey) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+// Reset removes all the cached parents
+func (c *parentCache) Reset() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[parentCacheKey]*list.Element)
+	c.lru.Init()
+}
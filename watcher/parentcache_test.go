@@ -0,0 +1,116 @@
+package watcher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	batchv1 "k8s.io/api/batch/v1"
+	core1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestParentCache(t *testing.T) {
+	now := time.Now()
+	cache := newParentCache(time.Minute, 2)
+	cache.now = func() time.Time { return now }
+
+	first := parentCacheKey{namespace: "default", ownerUID: "1"}
+	second := parentCacheKey{namespace: "default", ownerUID: "2"}
+	third := parentCacheKey{namespace: "default", ownerUID: "3"}
+
+	_, _, ok := cache.Get(first)
+	assert.False(t, ok)
+
+	cache.Add(first, "CronJob", "backup")
+	kind, name, ok := cache.Get(first)
+	assert.True(t, ok)
+	assert.Equal(t, "CronJob", kind)
+	assert.Equal(t, "backup", name)
+
+	// the least recently used parent is evicted once the cache is full
+	cache.Add(second, "Job", "migrate")
+	cache.Get(first)
+	cache.Add(third, "Job", "seed")
+	_, _, ok = cache.Get(second)
+	assert.False(t, ok, "the least recently used parent should be evicted")
+	_, _, ok = cache.Get(first)
+	assert.True(t, ok)
+
+	cache.Invalidate(first)
+	_, _, ok = cache.Get(first)
+	assert.False(t, ok, "invalidated parents should not be served")
+
+	// parents expire after the TTL
+	now = now.Add(time.Minute)
+	_, _, ok = cache.Get(third)
+	assert.False(t, ok, "expired parents should not be served")
+
+	cache.Add(first, "CronJob", "backup")
+	cache.Reset()
+	_, _, ok = cache.Get(first)
+	assert.False(t, ok, "reset should remove all parents")
+
+	var nilCache *parentCache
+	nilCache.Add(first, "CronJob", "backup")
+	_, _, ok = nilCache.Get(first)
+	assert.False(t, ok)
+	assert.Nil(t, newParentCache(0, 2), "a TTL of zero should disable the cache")
+}
+
+func TestParentCacheResolution(t *testing.T) {
+	cronJob := &batchv1.CronJob{
+		TypeMeta:   v1.TypeMeta{Kind: "CronJob", APIVersion: "batch/v1"},
+		ObjectMeta: v1.ObjectMeta{Name: "backup", Namespace: "default"},
+	}
+	job := newJobFake("default", "backup-28000000", "backup")
+	job.UID = types.UID("job-uid-1")
+	// the Pods are owned by their Job along with its UID, which tells apart the Jobs recreated with the same name
+	ownedBy := func(job *batchv1.Job) podFakeOption {
+		return withOwner(v1.OwnerReference{APIVersion: "batch/v1", Kind: "Job", Name: job.Name, UID: job.UID})
+	}
+	firstPod := newRunningPodFake("default", "backup-28000000-abcde", backupImageIDs, ownedBy(job))
+	secondPod := newRunningPodFake("default", "backup-28000000-fghij", backupImageIDs, ownedBy(job))
+
+	k8sAPI, _ := newK8sAPIFake(cronJob, job, firstPod, secondPod)
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	wh.parents = newParentCache(5*time.Minute, parentCacheSize)
+
+	expectedWlid := "wlid://cluster-/namespace-default/cronjob-backup"
+	for _, pod := range []*core1.Pod{firstPod, secondPod} {
+		_, wlid, err := wh.getParentForPod(pod.DeepCopy())
+		assert.NoError(t, err)
+		assert.Equal(t, expectedWlid, wlid)
+	}
+	assert.Equal(t, int64(1), wh.metrics.Get(metricParentCacheMissesTotal))
+	assert.Equal(t, int64(1), wh.metrics.Get(metricParentCacheHitsTotal))
+
+	// a Job recreated with the same name is a different owner
+	recreatedJob := newJobFake("default", "backup-28000000", "")
+	recreatedJob.UID = types.UID("job-uid-2")
+	recreatedPod := newRunningPodFake("default", "backup-28000000-klmno", backupImageIDs, ownedBy(recreatedJob))
+	k8sAPI, _ = newK8sAPIFake(recreatedJob, recreatedPod)
+	wh.k8sAPI = k8sAPI
+
+	_, wlid, err := wh.getParentForPod(recreatedPod.DeepCopy())
+	assert.NoError(t, err)
+	assert.Equal(t, "wlid://cluster-/namespace-default/job-backup-28000000", wlid)
+
+	// failed lookups are not cached
+	k8sAPI, _ = newK8sAPIFake()
+	wh.k8sAPI = k8sAPI
+	orphanJob := newJobFake("default", "orphan", "")
+	orphanJob.UID = types.UID("job-uid-3")
+	_, _, err = wh.getParentForPod(newRunningPodFake("default", "orphan-abcde", backupImageIDs, ownedBy(orphanJob)))
+	assert.Error(t, err)
+	_, _, ok := wh.parents.Get(parentCacheKey{namespace: "default", ownerUID: orphanJob.UID})
+	assert.False(t, ok)
+
+	// cleanUp rebuilds the parents
+	wh.parents.Add(parentCacheKey{namespace: "default", ownerUID: job.UID}, "CronJob", "backup")
+	wh.cleanUpIDs()
+	_, _, ok = wh.parents.Get(parentCacheKey{namespace: "default", ownerUID: job.UID})
+	assert.False(t, ok)
+}
@@ -0,0 +1,115 @@
+package watcher
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// pendingDeletionsSize is the maximal number of orphaned storage objects waiting for their grace period to end
+const pendingDeletionsSize = 4096
+
+// pendingDeletionKey identifies an orphaned storage object
+type pendingDeletionKey struct {
+	kind      string
+	namespace string
+	name      string
+}
+
+// orphanKey returns the key of a storage object of the given kind
+func orphanKey(kind string, obj orphanObject) pendingDeletionKey {
+	return pendingDeletionKey{kind: kind, namespace: obj.GetNamespace(), name: obj.GetName()}
+}
+
+// pendingDeletion is an orphaned storage object waiting for its grace period to end
+type pendingDeletion struct {
+	key      pendingDeletionKey
+	orphaned time.Time
+}
+
+// pendingDeletions holds the orphaned storage objects within their grace period, see WithDeletionGracePeriod
+//
+// Rolling restarts briefly leave images without running Pods, so objects are
+// deleted only if still orphaned once the grace period after they were first
+// found orphaned is over. The objects are kept apart from the internal maps,
+// so they survive their rebuilds. When full, the objects found orphaned the
+// longest ago are forgotten, and their grace period starts over.
+//
+// The nil value deletes the objects right away.
+type pendingDeletions struct {
+	gracePeriod time.Duration
+	size        int
+	entries     map[pendingDeletionKey]*list.Element
+	order       *list.List // oldest at the back
+	now         clock
+	mu          sync.Mutex
+}
+
+// newPendingDeletions returns the objects waiting for the given grace period to end. A grace period of zero disables it, returning the nil value
+func newPendingDeletions(gracePeriod time.Duration, size int) *pendingDeletions {
+	if gracePeriod <= 0 {
+		return nil
+	}
+	return &pendingDeletions{
+		gracePeriod: gracePeriod,
+		size:        size,
+		entries:     make(map[pendingDeletionKey]*list.Element),
+		order:       list.New(),
+		now:         time.Now,
+	}
+}
+
+// Due returns true if an orphaned object may be deleted, remembering it if it was not found orphaned before
+func (p *pendingDeletions) Due(key pendingDeletionKey) bool {
+	if p == nil {
+		return true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	if element, ok := p.entries[key]; ok {
+		if now.Sub(element.Value.(*pendingDeletion).orphaned) < p.gracePeriod {
+			return false
+		}
+		p.order.Remove(element)
+		delete(p.entries, key)
+		return true
+	}
+
+	p.entries[key] = p.order.PushFront(&pendingDeletion{key: key, orphaned: now})
+	for p.order.Len() > p.size {
+		oldest := p.order.Back()
+		p.order.Remove(oldest)
+		delete(p.entries, oldest.Value.(*pendingDeletion).key)
+	}
+	return false
+}
+
+// Forget removes an object that is not orphaned anymore
+func (p *pendingDeletions) Forget(key pendingDeletionKey) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if element, ok := p.entries[key]; ok {
+		p.order.Remove(element)
+		delete(p.entries, key)
+	}
+}
+
+// Len returns the number of objects within their grace period
+func (p *pendingDeletions) Len() int {
+	if p == nil {
+		return 0
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.order.Len()
+}
@@ -0,0 +1,113 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	instanceidv1 "github.com/kubescape/k8s-interface/instanceidhandler/v1"
+	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestPendingDeletions(t *testing.T) {
+	now := time.Now()
+	newPendingDeletionsFake := func(size int) *pendingDeletions {
+		p := newPendingDeletions(time.Minute, size)
+		p.now = func() time.Time { return now }
+		return p
+	}
+	key := pendingDeletionKey{kind: sbomSummaryKind, namespace: "kubescape", name: "nginx"}
+	otherKey := pendingDeletionKey{kind: sbomSummaryKind, namespace: "kubescape", name: "redis"}
+
+	t.Run("the nil value deletes right away", func(t *testing.T) {
+		assert.Nil(t, newPendingDeletions(0, pendingDeletionsSize))
+		var p *pendingDeletions
+		assert.True(t, p.Due(key))
+		p.Forget(key)
+		assert.Equal(t, 0, p.Len())
+	})
+
+	t.Run("due once the grace period is over", func(t *testing.T) {
+		p := newPendingDeletionsFake(pendingDeletionsSize)
+		assert.False(t, p.Due(key), "objects found orphaned the first time should not be due")
+		now = now.Add(30 * time.Second)
+		assert.False(t, p.Due(key))
+		now = now.Add(30 * time.Second)
+		assert.True(t, p.Due(key))
+		assert.Equal(t, 0, p.Len(), "due objects should be forgotten")
+	})
+
+	t.Run("forgotten objects start over", func(t *testing.T) {
+		p := newPendingDeletionsFake(pendingDeletionsSize)
+		assert.False(t, p.Due(key))
+		now = now.Add(time.Minute)
+		p.Forget(key)
+		assert.False(t, p.Due(key))
+	})
+
+	t.Run("the oldest objects are evicted when full", func(t *testing.T) {
+		p := newPendingDeletionsFake(1)
+		assert.False(t, p.Due(key))
+		now = now.Add(time.Minute)
+		assert.False(t, p.Due(otherKey))
+		assert.Equal(t, 1, p.Len())
+		assert.False(t, p.Due(key), "evicted objects should start over")
+	})
+}
+
+func TestHandleSBOMEventsWithGracePeriod(t *testing.T) {
+	ctx := context.TODO()
+	imageID := "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"
+	wlid := "wlid://cluster-/namespace-default/deployment-nginx"
+	summary := &spdxv1beta1.SBOMSummary{ObjectMeta: v1.ObjectMeta{
+		Name:        "nginx",
+		Namespace:   "kubescape",
+		Labels:      managedLabels(),
+		Annotations: map[string]string{instanceidv1.ImageIDMetadataKey: imageID},
+	}}
+	k8sAPI, _ := newK8sAPIFake()
+	storageClient := kssfake.NewSimpleClientset(summary.DeepCopy())
+	now := time.Now()
+	wh, err := NewWatchHandler(k8sAPI, storageClient, nil, nil, WithDeletionGracePeriod(time.Minute), WithClock(func() time.Time { return now }))
+	assert.NoError(t, err)
+
+	handle := func() {
+		sbomEvents := make(chan watch.Event, 1)
+		sbomEvents <- watch.Event{Type: watch.Modified, Object: summary.DeepCopy()}
+		close(sbomEvents)
+		errCh := make(chan error)
+		go wh.HandleSBOMEvents(ctx, sbomEvents, nil, errCh)
+		for err := range errCh {
+			assert.NoError(t, err)
+		}
+	}
+	exists := func() bool {
+		_, err := storageClient.SpdxV1beta1().SBOMSummaries("kubescape").Get(ctx, summary.Name, v1.GetOptions{})
+		return err == nil
+	}
+
+	// the old Pods of a rolling restart are gone before the new ones run
+	handle()
+	assert.True(t, exists(), "orphaned objects should be kept within their grace period")
+
+	// the pending deletions survive the rebuilds of the maps
+	wh.cleanUpIDs()
+	assert.Equal(t, 1, wh.pendingDeletions.Len())
+	now = now.Add(30 * time.Second)
+	wh.addToImageIDToWlidsMap(imageID, wlid)
+	handle()
+	assert.Equal(t, 0, wh.pendingDeletions.Len(), "objects referenced again should be forgotten")
+
+	// orphaned again, the grace period starts over
+	wh.cleanUpIDs()
+	now = now.Add(45 * time.Second)
+	handle()
+	assert.True(t, exists())
+	now = now.Add(time.Minute)
+	wh.reclaimOrphans(ctx)
+	assert.False(t, exists(), "objects still orphaned after their grace period should be deleted")
+}
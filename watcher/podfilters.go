@@ -0,0 +1,23 @@
+package watcher
+
+import (
+	core1 "k8s.io/api/core/v1"
+)
+
+// PodFilter returns false for the Pods that should never be tracked nor scanned
+type PodFilter func(pod *core1.Pod) bool
+
+// podFilters are the filters registered with WithPodFilter, which a Pod must all pass to be tracked
+//
+// The nil value admits every Pod
+type podFilters []PodFilter
+
+// Admits returns true if the Pod passes every filter
+func (f podFilters) Admits(pod *core1.Pod) bool {
+	for _, filter := range f {
+		if !filter(pod) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,69 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	core1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestPodFilters(t *testing.T) {
+	pod := newRunningPodFake("default", "nginx", nil)
+	assert.True(t, podFilters(nil).Admits(pod))
+
+	hasName := func(name string) PodFilter {
+		return func(pod *core1.Pod) bool { return pod.Name == name }
+	}
+	assert.True(t, podFilters{hasName("nginx")}.Admits(pod))
+	assert.False(t, podFilters{hasName("nginx"), hasName("redis")}.Admits(pod), "pods should pass every filter")
+}
+
+func TestWithPodFilter(t *testing.T) {
+	const skipAnnotation = "example.com/skip-scan"
+	deployment, replicaSet, pod := newDeploymentFake("agent", nil)
+	// the parent is resolved from the API, rather than from the pod-template-hash
+	// label, and cached for the UID of the owner
+	pod.Labels = nil
+	pod.OwnerReferences[0].UID = "replicaset-uid"
+	skipped := pod.DeepCopy()
+	skipped.Annotations = map[string]string{skipAnnotation: "true"}
+
+	tt := []struct {
+		name     string
+		pod      *core1.Pod
+		expected bool
+	}{
+		{name: "admitted", pod: pod, expected: true},
+		{name: "filtered out", pod: skipped},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, path := range []string{"buildIDs", "handlePodEvent"} {
+				k8sAPI, _ := newK8sAPIFake(deployment, replicaSet, tc.pod)
+				wh := NewWatchHandlerMock()
+				wh.k8sAPI = k8sAPI
+				wh.parents = newParentCache(time.Minute, parentCacheSize)
+				WithPodFilter(nil)(wh)
+				WithPodFilter(func(pod *core1.Pod) bool { return pod.Annotations[skipAnnotation] != "true" })(wh)
+
+				recorder := &commandRecorder{}
+				if path == "buildIDs" {
+					assert.NoError(t, wh.buildIDs(context.TODO(), podListIterator(&core1.PodList{Items: []core1.Pod{*tc.pod}})))
+				} else {
+					assert.NoError(t, wh.handlePodEvent(context.TODO(), watch.Event{Type: watch.Modified, Object: tc.pod.DeepCopy()}, newCommandDeduper(0, recorder.emit)))
+				}
+
+				assert.Equal(t, tc.expected, len(wh.GetWlidsToContainerToImageIDMap()) == 1, path)
+				// the parent of the pod is resolved on a miss of the parent cache
+				assert.Equal(t, tc.expected, wh.metrics.Get(metricParentCacheMissesTotal) > 0, "%s: the parents of filtered out pods should not be resolved", path)
+				if !tc.expected {
+					assert.Empty(t, recorder.emitted(), path)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package watcher
+
+import (
+	"sync"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// trackedPodImageIDs are the image IDs of the containers of a Pod, along with the WLID of its parent
+type trackedPodImageIDs struct {
+	wlid                string
+	containerToImageIDs map[string]string
+}
+
+// podImageIDTracker tracks the image ID of every container of each Pod, by Pod UID
+//
+// A container may run a different image after a restart without its Pod
+// being replaced, e.g. with an in-place image update or when the image of a
+// tag is pulled again after garbage collection. Such changes are detected by
+// comparing the image IDs reported by the Pod with the tracked ones.
+//
+// The tracked Pods also tell which images a WLID still runs, as Pods of the
+// same WLID may run different images, e.g. while a StatefulSet is rolled out
+// one Pod at a time. Pods without a UID are not tracked.
+type podImageIDTracker struct {
+	podsByUID map[types.UID]trackedPodImageIDs
+	mu        sync.Mutex
+}
+
+// Update tracks the current image IDs of the containers of a Pod of a given WLID
+//
+// Returns a map of <containerName> : <imageID> for the containers that were
+// tracked with a different image ID
+func (t *podImageIDTracker) Update(uid types.UID, wlid string, containerToImageIDs map[string]string) map[string]string {
+	changed := make(map[string]string)
+	if uid == "" {
+		return changed
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tracked := t.podsByUID[uid].containerToImageIDs
+	for containerName, imageID := range containerToImageIDs {
+		if trackedImageID, ok := tracked[containerName]; ok && trackedImageID != imageID {
+			changed[containerName] = imageID
+		}
+	}
+	t.setUnsafe(uid, wlid, containerToImageIDs)
+	return changed
+}
+
+// Track tracks the image IDs of the containers of a Pod of a given WLID, unless it is already tracked
+//
+// Pods that are listed are tracked without being compared, so a change that
+// the Pod watcher has not handled yet is still detected by the watcher
+func (t *podImageIDTracker) Track(uid types.UID, wlid string, containerToImageIDs map[string]string) {
+	if uid == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.podsByUID[uid]; ok {
+		return
+	}
+	t.setUnsafe(uid, wlid, containerToImageIDs)
+}
+
+// setUnsafe sets the tracked image IDs of a Pod
+//
+// NOT THREAD SAFE! Assumes the caller is holding the lock.
+func (t *podImageIDTracker) setUnsafe(uid types.UID, wlid string, containerToImageIDs map[string]string) {
+	if t.podsByUID == nil {
+		t.podsByUID = make(map[types.UID]trackedPodImageIDs)
+	}
+	current := make(map[string]string, len(containerToImageIDs))
+	for containerName, imageID := range containerToImageIDs {
+		current[containerName] = imageID
+	}
+	t.podsByUID[uid] = trackedPodImageIDs{wlid: wlid, containerToImageIDs: current}
+}
+
+// Forget stops tracking a Pod, returning what was tracked for it if anything
+func (t *podImageIDTracker) Forget(uid types.UID) (trackedPodImageIDs, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tracked, ok := t.podsByUID[uid]
+	delete(t.podsByUID, uid)
+	return tracked, ok
+}
+
+// Has returns true if the Pod is tracked
+func (t *podImageIDTracker) Has(uid types.UID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, ok := t.podsByUID[uid]
+	return ok
+}
+
+// Retain stops tracking all the Pods except the given ones
+func (t *podImageIDTracker) Retain(uids map[types.UID]struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for uid := range t.podsByUID {
+		if _, ok := uids[uid]; !ok {
+			delete(t.podsByUID, uid)
+		}
+	}
+}
+
+// WlidRunsImageID reports whether a tracked Pod of a given WLID runs the image ID
+func (t *podImageIDTracker) WlidRunsImageID(wlid string, imageID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, tracked := range t.podsByUID {
+		if tracked.wlid != wlid {
+			continue
+		}
+		for _, containerImageID := range tracked.containerToImageIDs {
+			if containerImageID == imageID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// HasWlid reports whether a Pod of a given WLID is tracked, i.e. the WLID still runs
+func (t *podImageIDTracker) HasWlid(wlid string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, tracked := range t.podsByUID {
+		if tracked.wlid == wlid {
+			return true
+		}
+	}
+	return false
+}
+
+// PodsByWlid returns the UIDs of the tracked Pods of every WLID
+func (t *podImageIDTracker) PodsByWlid() map[string][]types.UID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pods := make(map[string][]types.UID)
+	for uid, tracked := range t.podsByUID {
+		pods[tracked.wlid] = append(pods[tracked.wlid], uid)
+	}
+	return pods
+}
@@ -0,0 +1,190 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kubescape/operator/utils"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	core1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestPodImageIDTracker(t *testing.T) {
+	tracker := &podImageIDTracker{}
+
+	assert.Empty(t, tracker.Update("uid1", "wlid1", map[string]string{"app": "myapp@sha256:6882017e7f8e9312816a4e6f174fd7c3690392272e93207bdc38e19ca7512255", "sidecar": "envoy@sha256:73971a8f26642b2749d12b0c0692ac2e75ea36137badf768fd3ef11da87c570f"}))
+	assert.Equal(t, map[string]string{"app": "myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822"},
+		tracker.Update("uid1", "wlid1", map[string]string{"app": "myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822", "sidecar": "envoy@sha256:73971a8f26642b2749d12b0c0692ac2e75ea36137badf768fd3ef11da87c570f"}))
+	assert.Empty(t, tracker.Update("uid1", "wlid1", map[string]string{"app": "myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822", "sidecar": "envoy@sha256:73971a8f26642b2749d12b0c0692ac2e75ea36137badf768fd3ef11da87c570f"}))
+	// containers that were not tracked are not changes
+	assert.Empty(t, tracker.Update("uid1", "wlid1", map[string]string{"app": "myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822", "debugger": "busybox@sha256:22a1f96cbccbde731c101c7b6d6acb307af7e35957a2ea374b8e75f0e6d93620"}))
+
+	// listed Pods do not override the tracked image IDs
+	tracker.Track("uid1", "wlid1", map[string]string{"app": "myapp@sha256:bfa6cab9db625262aa947ab3f0deadc3b404c3b8e6d0bfedebaf2578c8329a3e"})
+	assert.Equal(t, map[string]string{"app": "myapp@sha256:bfa6cab9db625262aa947ab3f0deadc3b404c3b8e6d0bfedebaf2578c8329a3e"}, tracker.Update("uid1", "wlid1", map[string]string{"app": "myapp@sha256:bfa6cab9db625262aa947ab3f0deadc3b404c3b8e6d0bfedebaf2578c8329a3e"}))
+
+	// Pods without UID are not tracked
+	tracker.Update("", "wlid1", map[string]string{"app": "myapp@sha256:6882017e7f8e9312816a4e6f174fd7c3690392272e93207bdc38e19ca7512255"})
+	assert.Empty(t, tracker.Update("", "wlid1", map[string]string{"app": "myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822"}))
+
+	tracker.Track("uid2", "wlid2", map[string]string{"app": "myapp@sha256:6882017e7f8e9312816a4e6f174fd7c3690392272e93207bdc38e19ca7512255"})
+	tracker.Track("uid3", "wlid2", map[string]string{"app": "myapp@sha256:6882017e7f8e9312816a4e6f174fd7c3690392272e93207bdc38e19ca7512255"})
+	assert.True(t, tracker.WlidRunsImageID("wlid2", "myapp@sha256:6882017e7f8e9312816a4e6f174fd7c3690392272e93207bdc38e19ca7512255"))
+	assert.False(t, tracker.WlidRunsImageID("wlid2", "myapp@sha256:bfa6cab9db625262aa947ab3f0deadc3b404c3b8e6d0bfedebaf2578c8329a3e"))
+	assert.False(t, tracker.WlidRunsImageID("wlid3", "myapp@sha256:6882017e7f8e9312816a4e6f174fd7c3690392272e93207bdc38e19ca7512255"))
+	forgotten, ok := tracker.Forget("uid2")
+	assert.True(t, ok)
+	assert.Equal(t, trackedPodImageIDs{wlid: "wlid2", containerToImageIDs: map[string]string{"app": "myapp@sha256:6882017e7f8e9312816a4e6f174fd7c3690392272e93207bdc38e19ca7512255"}}, forgotten)
+	_, ok = tracker.Forget("uid2")
+	assert.False(t, ok)
+	assert.Empty(t, tracker.Update("uid2", "wlid1", map[string]string{"app": "myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822"}), "forgotten Pods should not be compared")
+	tracker.Retain(map[types.UID]struct{}{"uid1": {}})
+	assert.False(t, tracker.WlidRunsImageID("wlid2", "myapp@sha256:6882017e7f8e9312816a4e6f174fd7c3690392272e93207bdc38e19ca7512255"))
+	assert.Empty(t, tracker.Update("uid3", "wlid2", map[string]string{"app": "myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822"}), "Pods not retained should not be compared")
+	assert.Equal(t, map[string]string{"app": "myapp@sha256:613b7bf2a7fe085428b0d06eb5e72d6ccf6c1809427f7329fe48b95f944ccff7"}, tracker.Update("uid1", "wlid1", map[string]string{"app": "myapp@sha256:613b7bf2a7fe085428b0d06eb5e72d6ccf6c1809427f7329fe48b95f944ccff7"}))
+}
+
+func TestHandlePodWatcherInPlaceImageChange(t *testing.T) {
+	expectedWlid := "wlid://cluster-/namespace-default/pod-myapp"
+	imageIDs := map[string]string{"app": "myapp@sha256:6882017e7f8e9312816a4e6f174fd7c3690392272e93207bdc38e19ca7512255", "sidecar": "envoy@sha256:73971a8f26642b2749d12b0c0692ac2e75ea36137badf768fd3ef11da87c570f"}
+	pod := newRunningPodFake("default", "myapp", imageIDs, withUID("myapp-uid"))
+
+	tt := []struct {
+		name             string
+		restartedImageID string
+		// listed is set if the Pod is listed before watching, e.g. on startup
+		listed           bool
+		expectedCommands []map[string]string
+	}{
+		{
+			name:             "restart with the same image",
+			restartedImageID: "myapp@sha256:6882017e7f8e9312816a4e6f174fd7c3690392272e93207bdc38e19ca7512255",
+			expectedCommands: []map[string]string{{"app": "myapp@sha256:6882017e7f8e9312816a4e6f174fd7c3690392272e93207bdc38e19ca7512255", "sidecar": "envoy@sha256:73971a8f26642b2749d12b0c0692ac2e75ea36137badf768fd3ef11da87c570f"}},
+		},
+		{
+			name:             "restart with another image",
+			restartedImageID: "myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822",
+			expectedCommands: []map[string]string{{"app": "myapp@sha256:6882017e7f8e9312816a4e6f174fd7c3690392272e93207bdc38e19ca7512255", "sidecar": "envoy@sha256:73971a8f26642b2749d12b0c0692ac2e75ea36137badf768fd3ef11da87c570f"}, {"app": "myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822"}},
+		},
+		{
+			name:             "listed Pod restarts with another image",
+			restartedImageID: "myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822",
+			listed:           true,
+			expectedCommands: []map[string]string{{"app": "myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822"}},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// the API serves the restarted Pod when it is relisted once the watch ends
+			restarted := newRunningPodFake("default", "myapp", imageIDs, withUID("myapp-uid"), withRestartedContainer("app", tc.restartedImageID))
+			k8sAPI, _ := newK8sAPIFake(restarted.DeepCopy())
+			wh := NewWatchHandlerMock()
+			wh.k8sAPI = k8sAPI
+			// the restarted image is already run by another workload
+			otherWlid := "wlid://cluster-/namespace-default/pod-other"
+			wh.addToImageIDToWlidsMap("myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822", otherWlid)
+			wh.addToWlidsToContainerToImageIDMap(otherWlid, "app", "myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822")
+			if tc.listed {
+				assert.NoError(t, wh.buildIDs(context.TODO(), podListIterator(&core1.PodList{Items: []core1.Pod{*pod.DeepCopy()}})))
+			}
+
+			recorder := &commandRecorder{}
+			podsWatch := watch.NewFake()
+			done := make(chan struct{})
+			go func() {
+				wh.handlePodWatcher(context.TODO(), podsWatch, newCommandDeduper(0, recorder.emit))
+				close(done)
+			}()
+
+			if !tc.listed {
+				podsWatch.Modify(pod.DeepCopy())
+				assert.Eventually(t, func() bool { return len(recorder.emitted()) == 1 }, time.Second, 10*time.Millisecond)
+			}
+			podsWatch.Modify(restarted)
+			assert.Eventually(t, func() bool { return len(recorder.emitted()) == len(tc.expectedCommands) }, time.Second, 10*time.Millisecond)
+			podsWatch.Stop()
+			<-done
+
+			emitted := recorder.emitted()
+			assert.Len(t, emitted, len(tc.expectedCommands))
+			for i := range emitted {
+				assert.Equal(t, expectedWlid, emitted[i].Wlid)
+				assert.Equal(t, tc.expectedCommands[i], emitted[i].Args[utils.ContainerToImageIdsArg])
+			}
+			assert.Equal(t, map[string]string{"app": tc.restartedImageID, "sidecar": "envoy@sha256:73971a8f26642b2749d12b0c0692ac2e75ea36137badf768fd3ef11da87c570f"}, wh.GetContainerToImageIDForWlid(expectedWlid))
+		})
+	}
+}
+
+func TestHandlePodWatcherForgetsDeletedPods(t *testing.T) {
+	pod := newRunningPodFake("default", "myapp", map[string]string{"app": "myapp@sha256:6882017e7f8e9312816a4e6f174fd7c3690392272e93207bdc38e19ca7512255"})
+	pod.UID = "myapp-uid"
+	wh := NewWatchHandlerMock()
+	wh.podImageIDs.Track(pod.UID, "wlid://cluster-/namespace-default/pod-myapp", map[string]string{"app": "myapp@sha256:6882017e7f8e9312816a4e6f174fd7c3690392272e93207bdc38e19ca7512255"})
+
+	podsWatch := watch.NewFakeWithChanSize(1, false)
+	podsWatch.Delete(pod)
+	podsWatch.Stop()
+	k8sAPI, _ := newK8sAPIFake()
+	wh.k8sAPI = k8sAPI
+	wh.handlePodWatcher(context.TODO(), podsWatch, newCommandDeduper(0, (&commandRecorder{}).emit))
+
+	assert.Empty(t, wh.podImageIDs.Update(pod.UID, "wlid://cluster-/namespace-default/pod-myapp", map[string]string{"app": "myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822"}), "deleted Pods should not be tracked")
+}
+
+func TestHandlePodWatcherStatefulSetPodRecreated(t *testing.T) {
+	expectedWlid := "wlid://cluster-/namespace-default/statefulset-web"
+	oldImageID := "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"
+	newImageID := "nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432"
+	webOwner := withOwner(v1.OwnerReference{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "web"})
+	oldPods := []*core1.Pod{
+		newRunningPodFake("default", "web-0", map[string]string{"nginx": oldImageID}, webOwner, withUID("web-0-old")),
+		newRunningPodFake("default", "web-1", map[string]string{"nginx": oldImageID}, webOwner, withUID("web-1-old")),
+	}
+
+	k8sAPI, _ := newK8sAPIFake(&appsv1.StatefulSet{
+		TypeMeta:   v1.TypeMeta{Kind: "StatefulSet", APIVersion: "apps/v1"},
+		ObjectMeta: v1.ObjectMeta{Name: "web", Namespace: "default"},
+	})
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	assert.NoError(t, wh.buildIDs(context.TODO(), podListIterator(&core1.PodList{Items: []core1.Pod{*oldPods[0], *oldPods[1]}})))
+
+	recorder := &commandRecorder{}
+	podsWatch := watch.NewFake()
+	done := make(chan struct{})
+	go func() {
+		wh.handlePodWatcher(context.TODO(), podsWatch, newCommandDeduper(0, recorder.emit))
+		close(done)
+	}()
+	wlidsOf := func(imageID string) func() []string {
+		return func() []string { return wh.GetWlidsForImageHash(imageID) }
+	}
+
+	// the Pods are recreated with the same names and a new digest, one at a time
+	podsWatch.Delete(oldPods[1])
+	podsWatch.Modify(newRunningPodFake("default", "web-1", map[string]string{"nginx": newImageID}, webOwner, withUID("web-1-new")))
+	assert.Eventually(t, func() bool { return len(recorder.emitted()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{expectedWlid}, wlidsOf(oldImageID)(), "the old digest is still run by web-0")
+
+	podsWatch.Delete(oldPods[0])
+	assert.Eventually(t, func() bool { return len(wlidsOf(oldImageID)()) == 0 }, time.Second, 10*time.Millisecond,
+		"the old digest should not reference the WLID once no Pod runs it")
+	podsWatch.Modify(newRunningPodFake("default", "web-0", map[string]string{"nginx": newImageID}, webOwner, withUID("web-0-new")))
+	podsWatch.Stop()
+	<-done
+
+	emitted := recorder.emitted()
+	assert.Len(t, emitted, 1)
+	assert.Equal(t, expectedWlid, emitted[0].Wlid)
+	assert.Equal(t, map[string]string{"nginx": newImageID}, emitted[0].Args[utils.ContainerToImageIdsArg])
+	assert.Empty(t, wh.GetWlidsForImageHash(oldImageID))
+	assert.Equal(t, []string{expectedWlid}, wh.GetWlidsForImageHash(newImageID))
+	assert.Equal(t, map[string]string{"nginx": newImageID}, wh.GetContainerToImageIDForWlid(expectedWlid))
+}
@@ -0,0 +1,123 @@
+package watcher
+
+import (
+	"context"
+	"sync"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	core1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// metricPodEventsDroppedTotal is the number of Pod events dropped after failing for every retry
+const metricPodEventsDroppedTotal = "operator_pod_events_dropped_total"
+
+// podQueue dispatches the events of the Pod watcher to workers through a rate-limited workqueue
+//
+// Events are queued by Pod key, so that the events of a Pod are handled in
+// order and never concurrently, while the events of different Pods are
+// handled in parallel. A failed event is retried with a per-Pod backoff
+// before the later events of its Pod, until it failed for every retry and is
+// dropped.
+type podQueue struct {
+	queue   workqueue.RateLimitingInterface
+	retries int
+	metrics *metricsRegistry
+	events  map[string][]watch.Event // pending events of each queued Pod
+	queued  sync.WaitGroup           // Pods with pending events
+	workers sync.WaitGroup
+	mu      sync.Mutex
+}
+
+func newPodQueue(retries int, metrics *metricsRegistry) *podQueue {
+	return &podQueue{
+		queue:   workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		retries: retries,
+		metrics: metrics,
+		events:  make(map[string][]watch.Event),
+	}
+}
+
+// podQueueKey returns the key under which the events of a Pod are queued
+func podQueueKey(pod *core1.Pod) string {
+	return pod.GetNamespace() + "/" + pod.GetName()
+}
+
+// Add queues an event of a Pod
+func (q *podQueue) Add(pod *core1.Pod, event watch.Event) {
+	key := podQueueKey(pod)
+
+	q.mu.Lock()
+	if _, ok := q.events[key]; !ok {
+		q.queued.Add(1)
+	}
+	q.events[key] = append(q.events[key], event)
+	q.mu.Unlock()
+
+	q.queue.Add(key)
+}
+
+// Run starts the given number of workers handling the queued events, at least one
+func (q *podQueue) Run(ctx context.Context, workers int, handle func(event watch.Event) error) {
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		q.workers.Add(1)
+		go func() {
+			defer q.workers.Done()
+			for q.processNext(ctx, handle) {
+			}
+		}()
+	}
+}
+
+// ShutDown waits for the queued events to be handled, or dropped, and stops the workers
+func (q *podQueue) ShutDown() {
+	q.queued.Wait()
+	q.queue.ShutDown()
+	q.workers.Wait()
+}
+
+// processNext handles the pending events of the next queued Pod, returning false once the queue is shut down
+func (q *podQueue) processNext(ctx context.Context, handle func(event watch.Event) error) bool {
+	item, shutdown := q.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer q.queue.Done(item)
+	key := item.(string)
+
+	for {
+		q.mu.Lock()
+		events := q.events[key]
+		if len(events) == 0 {
+			// the Pod may have been handled already, if queued again while its events were handled
+			if _, ok := q.events[key]; ok {
+				delete(q.events, key)
+				q.queued.Done()
+			}
+			q.mu.Unlock()
+			return true
+		}
+		event := events[0]
+		q.mu.Unlock()
+
+		if err := handle(event); err != nil {
+			if q.queue.NumRequeues(item) < q.retries {
+				logger.L().Ctx(ctx).Debug("failed to handle pod event, retrying", helpers.String("pod", key), helpers.Int("retries", q.queue.NumRequeues(item)), helpers.Error(err))
+				q.queue.AddRateLimited(item)
+				return true
+			}
+			logger.L().Ctx(ctx).Error("failed to handle pod event, dropping it", helpers.String("pod", key), helpers.Error(err))
+			q.metrics.Inc(metricPodEventsDroppedTotal)
+		}
+		q.queue.Forget(item)
+
+		q.mu.Lock()
+		q.events[key] = q.events[key][1:]
+		q.mu.Unlock()
+	}
+}
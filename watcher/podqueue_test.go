@@ -0,0 +1,137 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kubescape/operator/utils"
+	"github.com/stretchr/testify/assert"
+	core1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// failJobLookups makes the first n lookups of Jobs fail, returning the number of failed lookups
+func failJobLookups(wh *WatchHandler, n int) func() int {
+	var mu sync.Mutex
+	failed := 0
+	wh.k8sAPI.DynamicClient.(*dynamicfake.FakeDynamicClient).PrependReactor("get", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failed >= n {
+			return false, nil, nil
+		}
+		failed++
+		return true, nil, errors.New("connection refused")
+	})
+	return func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return failed
+	}
+}
+
+func TestHandlePodWatcherRetriesFailedEvents(t *testing.T) {
+	tt := []struct {
+		name             string
+		failures         int
+		retries          int
+		expectedCommands int
+		expectedDropped  int64
+	}{
+		{
+			name:             "parent lookup succeeding on the second attempt",
+			failures:         1,
+			retries:          5,
+			expectedCommands: 1,
+		},
+		{
+			name:             "parent lookup failing for every retry",
+			failures:         3,
+			retries:          2,
+			expectedCommands: 0,
+			expectedDropped:  1,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := newRunningPodFake("default", "backup-28000000-abcde", backupImageIDs, withJobOwner("backup-28000000"))
+			k8sAPI, _ := newK8sAPIFake(pod, newJobFake("default", "backup-28000000", ""))
+			wh := NewWatchHandlerMock()
+			wh.k8sAPI = k8sAPI
+			wh.podEventRetries = tc.retries
+			failed := failJobLookups(wh, tc.failures)
+
+			emitted := handlePodEvents(context.TODO(), wh, pod)
+
+			assert.Equal(t, tc.failures, failed())
+			assert.Equal(t, tc.expectedDropped, wh.metrics.Get(metricPodEventsDroppedTotal))
+			if assert.Len(t, emitted, tc.expectedCommands) && tc.expectedCommands > 0 {
+				assert.Equal(t, "wlid://cluster-/namespace-default/job-backup-28000000", emitted[0].Wlid)
+				assert.Equal(t, map[string]string{"backup": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"}, emitted[0].Args[utils.ContainerToImageIdsArg])
+				assert.Equal(t, []string{"wlid://cluster-/namespace-default/job-backup-28000000"}, wh.GetWlidsForImageHash("alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"))
+			} else {
+				assert.Empty(t, wh.GetWlidsForImageHash("alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"), "dropped events should leave the maps untouched")
+			}
+		})
+	}
+}
+
+func TestPodQueue(t *testing.T) {
+	var metrics metricsRegistry
+	q := newPodQueue(1, &metrics)
+
+	var mu sync.Mutex
+	handled := make(map[string][]string)
+	running := make(map[string]bool)
+	concurrent, maxConcurrent := 0, 0
+	failed := make(map[string]bool)
+	q.Run(context.TODO(), 4, func(event watch.Event) error {
+		pod := event.Object.(*core1.Pod)
+		key := podQueueKey(pod)
+
+		mu.Lock()
+		assert.False(t, running[key], "the events of a Pod should not be handled concurrently")
+		running[key] = true
+		concurrent++
+		if concurrent > maxConcurrent {
+			maxConcurrent = concurrent
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		running[key] = false
+		concurrent--
+		// the second event of each Pod fails once
+		if pod.ResourceVersion == "2" && !failed[key] {
+			failed[key] = true
+			return errors.New("transient failure")
+		}
+		handled[key] = append(handled[key], pod.ResourceVersion)
+		return nil
+	})
+
+	for _, resourceVersion := range []string{"1", "2", "3"} {
+		for _, name := range []string{"a", "b", "c", "d"} {
+			pod := newRunningPodFake("default", name, map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"})
+			pod.ResourceVersion = resourceVersion
+			q.Add(pod, watch.Event{Type: watch.Modified, Object: pod})
+		}
+	}
+	q.ShutDown()
+
+	for _, name := range []string{"a", "b", "c", "d"} {
+		assert.Equal(t, []string{"1", "2", "3"}, handled["default/"+name], "the events of a Pod should be handled in order, after the retries of the failed ones")
+	}
+	assert.Greater(t, maxConcurrent, 1, "the events of different Pods should be handled in parallel")
+	assert.Zero(t, metrics.Get(metricPodEventsDroppedTotal))
+}
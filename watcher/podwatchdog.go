@@ -0,0 +1,103 @@
+package watcher
+
+import (
+	"sync"
+	"time"
+)
+
+// metricStalePodWatchRestartsTotal is the number of Pod watches restarted as they stopped delivering events
+const metricStalePodWatchRestartsTotal = "operator_stale_pod_watch_restarts_total"
+
+// podWatchdog detects Pod watches that stay open but silently stop delivering events
+//
+// Idle timeouts of load balancers or dropped conntrack entries can leave a
+// watch open without it ever delivering anything again. As bookmarks are
+// requested, a healthy watch keeps producing events even when no Pod changes.
+// A watch that produces none for the staleness window is checked by relisting
+// the Pods: it is considered stuck if the resource version moved meanwhile,
+// see restartStalePodWatch. The zero window disables the watchdog.
+type podWatchdog struct {
+	window     time.Duration
+	lastEvent  time.Time // last event received by the watch
+	lastRelist time.Time // last successful relist of the Pods
+	now        clock
+	mu         sync.RWMutex
+}
+
+func newPodWatchdog(window time.Duration) *podWatchdog {
+	return &podWatchdog{
+		window: window,
+		now:    time.Now,
+	}
+}
+
+// Received records that the watch received an event, or was established
+func (d *podWatchdog) Received() {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.lastEvent = d.now()
+}
+
+// Relisted records a successful relist of the Pods
+func (d *podWatchdog) Relisted() {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.lastRelist = d.now()
+}
+
+// LastRelist returns the time of the last successful relist of the Pods
+func (d *podWatchdog) LastRelist() time.Time {
+	if d == nil {
+		return time.Time{}
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.lastRelist
+}
+
+// Staleness returns for how long the watch has not been known to be current, i.e. since its last event or relist
+func (d *podWatchdog) Staleness() time.Duration {
+	if d == nil {
+		return 0
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	current := d.lastEvent
+	if d.lastRelist.After(current) {
+		current = d.lastRelist
+	}
+	if current.IsZero() {
+		return 0
+	}
+	return d.now().Sub(current)
+}
+
+// Stale returns true if the watch has not been known to be current for the staleness window
+func (d *podWatchdog) Stale() bool {
+	return d != nil && d.window > 0 && d.Staleness() >= d.window
+}
+
+// checks returns a channel ticking when the staleness of the watch should be checked, along with a function stopping it
+//
+// The channel is nil if the watchdog is disabled.
+func (d *podWatchdog) checks() (<-chan time.Time, func()) {
+	if d == nil || d.window <= 0 {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(d.window / 2)
+	return ticker.C, ticker.Stop
+}
@@ -0,0 +1,115 @@
+package watcher
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	core1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestPodWatchdogStaleness(t *testing.T) {
+	now := time.Now()
+	d := newPodWatchdog(time.Minute)
+	d.now = func() time.Time { return now }
+
+	assert.Zero(t, d.Staleness())
+	assert.False(t, d.Stale())
+
+	d.Received()
+	now = now.Add(59 * time.Second)
+	assert.Equal(t, 59*time.Second, d.Staleness())
+	assert.False(t, d.Stale())
+	now = now.Add(time.Second)
+	assert.True(t, d.Stale())
+
+	// a relist confirms the watch is current
+	d.Relisted()
+	assert.Equal(t, now, d.LastRelist())
+	assert.Zero(t, d.Staleness())
+	assert.False(t, d.Stale())
+
+	var disabled *podWatchdog
+	disabled.Received()
+	assert.False(t, disabled.Stale())
+	assert.Zero(t, newPodWatchdog(0).Staleness())
+	assert.False(t, newPodWatchdog(0).Stale())
+}
+
+func TestHandlePodWatcherRestartsStuckWatch(t *testing.T) {
+	tt := []struct {
+		name                    string
+		listedResourceVersion   string
+		expectedRestart         bool
+		expectedResourceVersion string
+		expectedListLimits      []int64
+	}{
+		{
+			name:                    "stuck watch in a changing cluster",
+			listedResourceVersion:   "43",
+			expectedRestart:         true,
+			expectedResourceVersion: "43",
+			expectedListLimits:      []int64{1, podListPageSize},
+		},
+		{
+			name:                    "quiet cluster",
+			listedResourceVersion:   "42",
+			expectedRestart:         false,
+			expectedResourceVersion: "42",
+			expectedListLimits:      []int64{1},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			k8sAPI, k8sClient := newK8sAPIFake()
+			k8sClient.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				return true, &core1.PodList{ListMeta: v1.ListMeta{ResourceVersion: tc.listedResourceVersion}}, nil
+			})
+			var limits []int64
+			var mu sync.Mutex
+			k8sAPI.KubernetesClient = optionsValidatingClient{Interface: k8sClient, onList: func(opts v1.ListOptions) {
+				mu.Lock()
+				defer mu.Unlock()
+				limits = append(limits, opts.Limit)
+			}}
+			wh := NewWatchHandlerMock()
+			wh.k8sAPI = k8sAPI
+			wh.setPodListResourceVersion("42")
+			wh.podWatchdog = newPodWatchdog(50 * time.Millisecond)
+
+			// the watch stays open but delivers nothing
+			podsWatch := watch.NewFake()
+			done := make(chan struct{})
+			go func() {
+				wh.handlePodWatcher(context.TODO(), podsWatch, newCommandDeduper(0, (&commandRecorder{}).emit))
+				close(done)
+			}()
+
+			select {
+			case <-done:
+				assert.True(t, tc.expectedRestart, "the watch of a quiet cluster should not be restarted")
+				assert.True(t, podsWatch.IsStopped())
+			case <-time.After(300 * time.Millisecond):
+				assert.False(t, tc.expectedRestart, "the stuck watch should be restarted")
+				podsWatch.Stop()
+				<-done
+			}
+			assert.Equal(t, tc.expectedResourceVersion, wh.podListResourceVersion())
+			mu.Lock()
+			// the quiet cluster is checked again every staleness window
+			if assert.GreaterOrEqual(t, len(limits), len(tc.expectedListLimits)) {
+				assert.Equal(t, tc.expectedListLimits, limits[:len(tc.expectedListLimits)], "the Pods should only be relisted once the resource version moved")
+			}
+			mu.Unlock()
+			assert.False(t, wh.podWatchdog.LastRelist().IsZero(), "the Pods should be relisted to check the watch")
+			assert.Equal(t, wh.podWatchdog.LastRelist(), wh.HealthStatus().PodWatchLastRelist)
+		})
+	}
+}
@@ -0,0 +1,371 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/armosec/armoapi-go/apis"
+	pkgwlid "github.com/armosec/utils-k8s-go/wlid"
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	"github.com/kubescape/operator/utils"
+	appsv1 "k8s.io/api/apps/v1"
+	core1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// prescanTracker tracks the provisional scans triggered from the Pod templates of workload controllers
+//
+// Controllers are scanned as soon as they are created or their template
+// images change, before their Pods run. Digests are not known yet, so the
+// images are scanned by tag, unless a Pod already resolved the tag. The first
+// Pod of the workload then reconciles the provisional scans with the image
+// IDs it runs, so that the images are not scanned twice, see reconcilePrescans.
+//
+// The nil value tracks nothing.
+type prescanTracker struct {
+	templates   map[string]map[string]string // <wlid> : <containerName> : image of the Pod template, as last seen
+	provisional map[string]map[string]string // <wlid> : <containerName> : image provisionally scanned, until reconciled by a Pod
+	resolved    map[string]string            // <image> : image ID a Pod resolved the image to
+	mu          sync.Mutex
+}
+
+func newPrescanTracker() *prescanTracker {
+	return &prescanTracker{
+		templates:   make(map[string]map[string]string),
+		provisional: make(map[string]map[string]string),
+		resolved:    make(map[string]string),
+	}
+}
+
+// Seed records the template images of a controller without scanning them, e.g. for controllers that exist on startup
+func (p *prescanTracker) Seed(wlid string, containersToImages map[string]string) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.templates[wlid] = containersToImages
+}
+
+// Provision records the template images of a controller and returns the images to scan provisionally: those that changed since last seen
+//
+// Images already resolved by Pods are returned as the image ID they resolved to.
+func (p *prescanTracker) Provision(wlid string, containersToImages map[string]string) map[string]string {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	toScan := make(map[string]string)
+	for container, image := range containersToImages {
+		if p.templates[wlid][container] == image {
+			continue
+		}
+		if imageID, ok := p.resolved[image]; ok {
+			image = imageID
+		}
+		toScan[container] = image
+	}
+	p.templates[wlid] = containersToImages
+	if len(toScan) == 0 {
+		return toScan
+	}
+
+	if p.provisional[wlid] == nil {
+		p.provisional[wlid] = make(map[string]string)
+	}
+	for container, image := range toScan {
+		p.provisional[wlid][container] = image
+	}
+	return toScan
+}
+
+// Reconcile records the image ID a container of a Pod of the workload runs, returning true if a provisional scan covered it
+//
+// A provisional scan covers the image ID if it scanned the same digest, or the
+// image the Pod runs by tag: the tag is assumed to resolve to the same digest,
+// as the scan and the Pod resolved it moments apart. Either way, the
+// provisional scan of the container is reconciled, so later changes trigger
+// scans as usual.
+func (p *prescanTracker) Reconcile(wlid, container, image, imageID string) bool {
+	if p == nil {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if image != "" {
+		p.resolved[image] = imageID
+	}
+
+	scanned, ok := p.provisional[wlid][container]
+	if !ok {
+		return false
+	}
+	delete(p.provisional[wlid], container)
+	if len(p.provisional[wlid]) == 0 {
+		delete(p.provisional, wlid)
+	}
+	return scanned == image || sameDigest(scanned, imageID)
+}
+
+// ForgetResolved forgets the image IDs the images were resolved to, as mutable tags may resolve to other image IDs since
+func (p *prescanTracker) ForgetResolved() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.resolved = make(map[string]string)
+}
+
+// Forget stops tracking a deleted controller
+func (p *prescanTracker) Forget(wlid string) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.templates, wlid)
+	delete(p.provisional, wlid)
+}
+
+// sameDigest returns true if both image references include the same digest
+func sameDigest(a, b string) bool {
+	_, digestA, okA := strings.Cut(a, "@")
+	_, digestB, okB := strings.Cut(b, "@")
+	return okA && okB && digestA == digestB
+}
+
+// reconcilePrescans removes from a scan command triggered by a Pod the containers whose image was provisionally scanned already
+//
+// It returns false if no container is left to scan.
+func (wh *WatchHandler) reconcilePrescans(ctx context.Context, pod *core1.Pod, cmd *apis.Command) bool {
+	containerToImageIDs, ok := cmd.Args[utils.ContainerToImageIdsArg].(map[string]string)
+	if !ok || wh.prescans == nil {
+		return true
+	}
+
+	images := templateImages(&pod.Spec)
+	toScan := make(map[string]string, len(containerToImageIDs))
+	for container, imageID := range containerToImageIDs {
+		if wh.prescans.Reconcile(cmd.Wlid, container, images[container], imageID) {
+			logger.L().Ctx(ctx).Debug("image already scanned from the pod template, no triggering", helpers.String("wlid", cmd.Wlid), helpers.String("container", container), helpers.String("imageID", imageID))
+			continue
+		}
+		toScan[container] = imageID
+	}
+	setContainerToImageIDsArg(cmd, toScan)
+	return len(toScan) > 0
+}
+
+// templateImages returns a map of <containerName> : image of the regular and init containers of a Pod spec
+func templateImages(spec *core1.PodSpec) map[string]string {
+	images := make(map[string]string, len(spec.Containers)+len(spec.InitContainers))
+	for _, container := range spec.Containers {
+		images[container.Name] = container.Image
+	}
+	for _, container := range spec.InitContainers {
+		images[container.Name] = container.Image
+	}
+	return images
+}
+
+// controllerKind is a kind of workload controller whose Pod templates trigger provisional scans
+type controllerKind struct {
+	kind string
+	// list returns the controllers of this kind along with the resource version to watch them from
+	list  func(wh *WatchHandler, ctx context.Context) ([]runtime.Object, string, error)
+	watch func(wh *WatchHandler, ctx context.Context, resourceVersion string) (watch.Interface, error)
+}
+
+// controllerKinds are the kinds of workload controllers watched for provisional scans
+var controllerKinds = []controllerKind{
+	{
+		kind: "Deployment",
+		list: func(wh *WatchHandler, ctx context.Context) ([]runtime.Object, string, error) {
+			list, err := wh.k8sAPI.KubernetesClient.AppsV1().Deployments("").List(ctx, v1.ListOptions{})
+			if err != nil {
+				return nil, "", err
+			}
+			objects := make([]runtime.Object, 0, len(list.Items))
+			for i := range list.Items {
+				objects = append(objects, &list.Items[i])
+			}
+			return objects, list.ResourceVersion, nil
+		},
+		watch: func(wh *WatchHandler, ctx context.Context, resourceVersion string) (watch.Interface, error) {
+			return wh.k8sAPI.KubernetesClient.AppsV1().Deployments("").Watch(ctx, v1.ListOptions{ResourceVersion: resourceVersion})
+		},
+	},
+	{
+		kind: "StatefulSet",
+		list: func(wh *WatchHandler, ctx context.Context) ([]runtime.Object, string, error) {
+			list, err := wh.k8sAPI.KubernetesClient.AppsV1().StatefulSets("").List(ctx, v1.ListOptions{})
+			if err != nil {
+				return nil, "", err
+			}
+			objects := make([]runtime.Object, 0, len(list.Items))
+			for i := range list.Items {
+				objects = append(objects, &list.Items[i])
+			}
+			return objects, list.ResourceVersion, nil
+		},
+		watch: func(wh *WatchHandler, ctx context.Context, resourceVersion string) (watch.Interface, error) {
+			return wh.k8sAPI.KubernetesClient.AppsV1().StatefulSets("").Watch(ctx, v1.ListOptions{ResourceVersion: resourceVersion})
+		},
+	},
+	{
+		kind: "DaemonSet",
+		list: func(wh *WatchHandler, ctx context.Context) ([]runtime.Object, string, error) {
+			list, err := wh.k8sAPI.KubernetesClient.AppsV1().DaemonSets("").List(ctx, v1.ListOptions{})
+			if err != nil {
+				return nil, "", err
+			}
+			objects := make([]runtime.Object, 0, len(list.Items))
+			for i := range list.Items {
+				objects = append(objects, &list.Items[i])
+			}
+			return objects, list.ResourceVersion, nil
+		},
+		watch: func(wh *WatchHandler, ctx context.Context, resourceVersion string) (watch.Interface, error) {
+			return wh.k8sAPI.KubernetesClient.AppsV1().DaemonSets("").Watch(ctx, v1.ListOptions{ResourceVersion: resourceVersion})
+		},
+	},
+}
+
+// controllerTemplate returns the metadata and the Pod template of a workload controller, false if the object is not one
+func controllerTemplate(obj runtime.Object) (string, v1.Object, *core1.PodTemplateSpec, bool) {
+	switch controller := obj.(type) {
+	case *appsv1.Deployment:
+		return "Deployment", controller, &controller.Spec.Template, true
+	case *appsv1.StatefulSet:
+		return "StatefulSet", controller, &controller.Spec.Template, true
+	case *appsv1.DaemonSet:
+		return "DaemonSet", controller, &controller.Spec.Template, true
+	}
+	return "", nil, nil, false
+}
+
+// controllerWlid returns the WLID of a workload controller
+func controllerWlid(kind string, meta v1.Object) string {
+	return pkgwlid.GetWLID(utils.ClusterConfig.ClusterName, meta.GetNamespace(), kind, meta.GetName())
+}
+
+// ControllerWatch watches workload controllers and triggers provisional scans of their Pod templates, if enabled
+//
+// The controllers that exist when the watch starts are not scanned, as their
+// Pods are already.
+func (wh *WatchHandler) ControllerWatch(ctx context.Context, sink utils.CommandSink) {
+	if wh.prescans == nil {
+		return
+	}
+
+	logger.L().Ctx(ctx).Debug("starting controller watch")
+	commands := newCommandDeduper(wh.commandDedupWindow, wh.sendTo(ctx, sink, ControllerWatcherName))
+	var wg sync.WaitGroup
+	for _, kind := range controllerKinds {
+		wg.Add(1)
+		go func(kind controllerKind) {
+			defer wg.Done()
+			wh.watchControllerKind(ctx, kind, commands)
+		}(kind)
+	}
+	wg.Wait()
+}
+
+// watchControllerKind watches the controllers of a kind, listing them again before each watch
+func (wh *WatchHandler) watchControllerKind(ctx context.Context, kind controllerKind, commands *commandDeduper) {
+	backoff := wh.newWatchBackoff(ControllerWatcherName)
+	for ctx.Err() == nil {
+		controllers, resourceVersion, err := kind.list(wh, ctx)
+		if err != nil {
+			wh.reportError(ctx, ControllerWatcherName, fmt.Errorf("error to list %s: %w", kind.kind, err))
+			backoff.wait(ctx, ControllerWatcherName)
+			continue
+		}
+		// changes missed while the watch was down are left to the Pods
+		for _, obj := range controllers {
+			if controllerKind, meta, template, ok := controllerTemplate(obj); ok {
+				wh.prescans.Seed(controllerWlid(controllerKind, meta), templateImages(&template.Spec))
+			}
+		}
+
+		controllersWatch, err := kind.watch(wh, ctx, resourceVersion)
+		if err != nil {
+			wh.reportError(ctx, ControllerWatcherName, fmt.Errorf("error to watch %s: %w", kind.kind, err))
+			backoff.wait(ctx, ControllerWatcherName)
+			continue
+		}
+		backoff.Connected()
+		wh.handleControllerWatcher(ctx, controllersWatch, commands)
+		if !backoff.Disconnected() {
+			backoff.wait(ctx, ControllerWatcherName)
+		}
+	}
+}
+
+// handleControllerWatcher triggers provisional scans from the events of a controller watch until it closes or fails
+func (wh *WatchHandler) handleControllerWatcher(ctx context.Context, controllersWatch watch.Interface, commands *commandDeduper) {
+	defer controllersWatch.Stop()
+	for {
+		var event watch.Event
+		var ok bool
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok = <-controllersWatch.ResultChan():
+		}
+		if !ok {
+			return
+		}
+
+		if err := wh.watchStatusError(event); err != nil {
+			wh.reportError(ctx, ControllerWatcherName, err)
+			return
+		}
+		kind, meta, template, ok := controllerTemplate(event.Object)
+		if !ok {
+			continue
+		}
+		wlid := controllerWlid(kind, meta)
+
+		switch event.Type {
+		case watch.Deleted:
+			wh.prescans.Forget(wlid)
+			continue
+		case watch.Added, watch.Modified:
+		default:
+			continue
+		}
+
+		if wh.excludedNamespaces.Excludes(meta.GetNamespace()) || !wh.workloadKinds.Admits(kind) {
+			continue
+		}
+		if hasSkipImageScanAnnotation(meta.GetAnnotations()) {
+			logger.L().Ctx(ctx).Debug("workload opted out of image scanning, no triggering", helpers.String("wlid", wlid))
+			continue
+		}
+
+		toScan := wh.prescans.Provision(wlid, templateImages(&template.Spec))
+		if len(toScan) == 0 {
+			continue
+		}
+		logger.L().Ctx(ctx).Info("pod template images changed, triggering a provisional scan", helpers.String("wlid", wlid))
+		commands.Submit(getImageScanCommand(wlid, toScan))
+	}
+}
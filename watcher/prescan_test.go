@@ -0,0 +1,121 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kubescape/operator/utils"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	core1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestPrescanTracker(t *testing.T) {
+	wlid := "wlid://cluster-/namespace-default/deployment-web"
+	p := newPrescanTracker()
+
+	p.Seed(wlid, map[string]string{"web": "web:1"})
+	assert.Empty(t, p.Provision(wlid, map[string]string{"web": "web:1"}), "unchanged templates should not be scanned")
+	assert.Equal(t, map[string]string{"sidecar": "sidecar:1"}, p.Provision(wlid, map[string]string{"web": "web:1", "sidecar": "sidecar:1"}))
+
+	// the Pod runs the provisionally scanned tag
+	assert.True(t, p.Reconcile(wlid, "sidecar", "sidecar:1", "sidecar@sha256:4bcfcc21e91d770550fb013ef4dd93aa96a04772b013b7012b851e4b89f27f07"))
+	assert.False(t, p.Reconcile(wlid, "sidecar", "sidecar:1", "sidecar@sha256:4bcfcc21e91d770550fb013ef4dd93aa96a04772b013b7012b851e4b89f27f07"), "reconciled scans should not cover later Pods")
+	assert.False(t, p.Reconcile(wlid, "web", "web:1", "web@sha256:08d1902ae9276e327467b0ff12e0963c2684493e911b3fb7b8b3842ac9a6b800"), "seeded images were not scanned provisionally")
+
+	// tags resolved by Pods are scanned by digest
+	assert.Equal(t, map[string]string{"web": "web@sha256:08d1902ae9276e327467b0ff12e0963c2684493e911b3fb7b8b3842ac9a6b800"}, p.Provision("wlid://cluster-/namespace-default/deployment-other", map[string]string{"web": "web:1"}))
+	assert.True(t, p.Reconcile("wlid://cluster-/namespace-default/deployment-other", "web", "registry.local/web:1", "registry.local/web@sha256:08d1902ae9276e327467b0ff12e0963c2684493e911b3fb7b8b3842ac9a6b800"), "scans of the same digest should be deduplicated")
+
+	// the template changed again before the Pod ran
+	p.Provision(wlid, map[string]string{"web": "web:2"})
+	assert.False(t, p.Reconcile(wlid, "web", "web:3", "web@sha256:f014a006cea2a103b910863c1c11aff2ba05a273e18ab488dc7f043e7353f9ce"))
+
+	p.Provision(wlid, map[string]string{"web": "web:4"})
+	p.Forget(wlid)
+	assert.False(t, p.Reconcile(wlid, "web", "web:4", "web@sha256:c09db4691450c6d6bc83571a00c7f15380497385375e5177b461dc814a68fa4d"), "deleted controllers should not be tracked")
+	assert.Equal(t, map[string]string{"web": "web@sha256:c09db4691450c6d6bc83571a00c7f15380497385375e5177b461dc814a68fa4d"}, p.Provision(wlid, map[string]string{"web": "web:4"}), "recreated controllers should be scanned again")
+
+	p.ForgetResolved()
+	assert.Equal(t, map[string]string{"web": "web:1"}, p.Provision("wlid://cluster-/namespace-default/deployment-new", map[string]string{"web": "web:1"}))
+
+	var disabled *prescanTracker
+	assert.Nil(t, disabled.Provision(wlid, map[string]string{"web": "web:1"}))
+	assert.False(t, disabled.Reconcile(wlid, "web", "web:1", "web@sha256:08d1902ae9276e327467b0ff12e0963c2684493e911b3fb7b8b3842ac9a6b800"))
+}
+
+// withTemplate returns a copy of a Deployment whose Pod template runs the given images
+func withTemplate(deployment *appsv1.Deployment, containerToImage map[string]string) *appsv1.Deployment {
+	updated := deployment.DeepCopy()
+	updated.Spec.Template.Spec.Containers = nil
+	for container, image := range containerToImage {
+		updated.Spec.Template.Spec.Containers = append(updated.Spec.Template.Spec.Containers, core1.Container{Name: container, Image: image})
+	}
+	return updated
+}
+
+func TestControllerWatch(t *testing.T) {
+	wlid := "wlid://cluster-/namespace-default/deployment-web"
+	existing, _, _ := newDeploymentFake("existing", nil)
+	existing = withTemplate(existing, map[string]string{"existing": "existing:1"})
+	deployment, replicaSet, pod := newDeploymentFake("web", nil)
+
+	k8sAPI, k8sClient := newK8sAPIFake(existing, replicaSet)
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	wh.prescans = newPrescanTracker()
+
+	recorder := &commandRecorder{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		wh.ControllerWatch(ctx, recorder)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool {
+		watches := 0
+		for _, action := range k8sClient.Actions() {
+			if action.GetVerb() == "watch" {
+				watches++
+			}
+		}
+		return watches == len(controllerKinds)
+	}, time.Second, 10*time.Millisecond)
+
+	// a Deployment is created, and updated without changing its images
+	deployments := k8sClient.AppsV1().Deployments("default")
+	_, err := deployments.Create(ctx, withTemplate(deployment, map[string]string{"web": "web"}), v1.CreateOptions{})
+	assert.NoError(t, err)
+	scaled := withTemplate(deployment, map[string]string{"web": "web"})
+	scaled.ResourceVersion = ""
+	scaled.Spec.Replicas = new(int32)
+	_, err = deployments.Update(ctx, scaled, v1.UpdateOptions{})
+	assert.NoError(t, err)
+	// the images of an existing one change
+	_, err = deployments.Update(ctx, withTemplate(existing, map[string]string{"existing": "existing:2"}), v1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool { return len(recorder.emitted()) == 2 }, time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+
+	emitted := recorder.emitted()
+	if assert.Len(t, emitted, 2) {
+		assert.Equal(t, wlid, emitted[0].Wlid)
+		assert.Equal(t, map[string]string{"web": "web"}, emitted[0].Args[utils.ContainerToImageIdsArg], "images should be scanned by tag before Pods run")
+		assert.Equal(t, "wlid://cluster-/namespace-default/deployment-existing", emitted[1].Wlid)
+		assert.Equal(t, map[string]string{"existing": "existing:2"}, emitted[1].Args[utils.ContainerToImageIdsArg])
+	}
+
+	// the first Pod runs the provisionally scanned image, of the Deployment resolved by the dynamic client
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(deployment)
+	assert.NoError(t, err)
+	assert.NoError(t, k8sAPI.DynamicClient.(*dynamicfake.FakeDynamicClient).Tracker().Add(&unstructured.Unstructured{Object: object}))
+	assert.Empty(t, handlePodEvents(context.TODO(), wh, pod), "images scanned from the Pod template should not be scanned again")
+	assert.Equal(t, map[string]string{"web": "web@" + testDigest("web")}, wh.GetContainerToImageIDForWlid(wlid), "the image IDs of the Pod should be tracked")
+}
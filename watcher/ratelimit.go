@@ -0,0 +1,73 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/armosec/armoapi-go/apis"
+	"github.com/kubescape/operator/utils"
+	"golang.org/x/time/rate"
+)
+
+// commandRateLimitQueueSize is the maximal number of commands queued by a rate-limited sink before sending blocks
+const commandRateLimitQueueSize = 1024
+
+// rateLimitedSink queues the commands sent to a sink, delivering them at the rate of a limiter shared by the watchers, see WithCommandRateLimit
+//
+// Commands exceeding the rate are queued rather than dropped, so the watch
+// loops keep handling events during a mass rollout. Sending only blocks once
+// the queue is full.
+type rateLimitedSink struct {
+	queue chan *apis.Command
+}
+
+var _ utils.CommandSink = &rateLimitedSink{}
+
+// Send queues the command, blocking while the queue is full until the context is done
+func (s *rateLimitedSink) Send(ctx context.Context, cmd *apis.Command) error {
+	select {
+	case s.queue <- cmd:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimited returns a sink delivering the commands of a watcher to the given sink at the rate set by WithCommandRateLimit, or the sink itself if it is not set
+//
+// Commands are delivered until the context is done, the ones that could not
+// be delivered are reported as errors of the watcher.
+func (wh *WatchHandler) rateLimited(ctx context.Context, sink utils.CommandSink, watcherName string) utils.CommandSink {
+	if wh.commandLimiter == nil {
+		return sink
+	}
+
+	limited := &rateLimitedSink{queue: make(chan *apis.Command, commandRateLimitQueueSize)}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case cmd := <-limited.queue:
+				if err := wh.commandLimiter.Wait(ctx); err != nil {
+					return
+				}
+				if err := sink.Send(ctx, cmd); err != nil {
+					wh.reportError(ctx, watcherName, fmt.Errorf("failed to send command for %s: %w", cmd.Wlid, err))
+				}
+			}
+		}
+	}()
+	return limited
+}
+
+// newCommandLimiter returns a limiter of rps commands per second with bursts of burst commands, nil if rps is not positive
+func newCommandLimiter(rps, burst int) *rate.Limiter {
+	if rps <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(rps), burst)
+}
@@ -0,0 +1,54 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/armosec/armoapi-go/apis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendToRateLimitsCommands(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	wh := NewWatchHandlerMock()
+	WithCommandRateLimit(10, 1)(wh)
+	rec := &commandRecorder{}
+	send := wh.sendTo(ctx, rec, PodWatcherName)
+
+	start := time.Now()
+	wlids := []string{"wlid://first", "wlid://second", "wlid://third", "wlid://fourth"}
+	for _, wlid := range wlids {
+		send(getImageScanCommand(wlid, map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"}))
+	}
+	assert.Less(t, time.Since(start), 50*time.Millisecond, "commands exceeding the rate should be queued without blocking the watcher")
+	assert.LessOrEqual(t, len(rec.emitted()), 2)
+
+	assert.Eventually(t, func() bool { return len(rec.emitted()) == len(wlids) }, time.Second, 10*time.Millisecond, "queued commands should not be dropped")
+	assert.GreaterOrEqual(t, time.Since(start), 3*100*time.Millisecond, "commands should be delivered at the rate")
+	for i, cmd := range rec.emitted() {
+		assert.Equal(t, wlids[i], cmd.Wlid, "commands should be delivered in order")
+	}
+}
+
+func TestSendToWithoutRateLimit(t *testing.T) {
+	wh := NewWatchHandlerMock()
+	WithCommandRateLimit(0, 10)(wh)
+	rec := &commandRecorder{}
+	assert.Same(t, rec, wh.rateLimited(context.TODO(), rec, PodWatcherName))
+
+	wh.sendTo(context.TODO(), rec, PodWatcherName)(getImageScanCommand("wlid://first", nil))
+	assert.Len(t, rec.emitted(), 1, "commands should be sent right away")
+}
+
+func TestRateLimitedSinkFullQueue(t *testing.T) {
+	limited := &rateLimitedSink{queue: make(chan *apis.Command, 1)}
+	assert.NoError(t, limited.Send(context.TODO(), &apis.Command{Wlid: "wlid://first"}))
+
+	// a full queue blocks the sender rather than dropping the command
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, limited.Send(ctx, &apis.Command{Wlid: "wlid://second"}), context.DeadlineExceeded)
+}
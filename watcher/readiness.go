@@ -0,0 +1,174 @@
+package watcher
+
+import (
+	"sync"
+	"time"
+
+	core1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// readinessGate holds back the scans of Pods until they are ready
+//
+// A crash-looping Pod briefly reports a running container each time it
+// restarts, which would trigger a scan per restart if its image keeps
+// changing. Gated Pods instead only trigger scans once their Ready condition
+// has been true for the stabilization delay. The images that were new while
+// a Pod was not ready are held until then, as they are tracked in the
+// meantime and would not be considered new anymore.
+//
+// Pods that become ready produce an event, but Pods that then stay ready for
+// the delay do not: those are revisited once the delay elapsed, see Due.
+//
+// The nil value gates nothing.
+type readinessGate struct {
+	delay  time.Duration
+	now    func() time.Time
+	held   map[types.UID]map[string]string // <pod UID> : <containerName> : imageID held until the Pod is ready
+	timers map[types.UID]*time.Timer       // Pods to revisit once ready for the delay
+	due    map[types.UID]*core1.Pod        // latest state of the Pods whose delay elapsed
+	wake   chan struct{}                   // signaled when Pods become due
+	mu     sync.Mutex
+}
+
+func newReadinessGate(delay time.Duration) *readinessGate {
+	return &readinessGate{
+		delay:  delay,
+		now:    time.Now,
+		held:   make(map[types.UID]map[string]string),
+		timers: make(map[types.UID]*time.Timer),
+		due:    make(map[types.UID]*core1.Pod),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Admit returns true if the Pod may trigger scans, i.e. it has been ready for the stabilization delay
+//
+// Ready Pods that are not admitted yet are revisited once the delay elapsed.
+func (g *readinessGate) Admit(pod *core1.Pod) bool {
+	if g == nil {
+		return true
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.due, pod.UID)
+	g.stopTimerUnsafe(pod.UID)
+	readySince, ready := podReadySince(pod)
+	if !ready {
+		return false
+	}
+
+	remaining := g.delay - g.now().Sub(readySince)
+	if remaining <= 0 {
+		return true
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(remaining, func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		// the timer may have been replaced or stopped while firing
+		if g.timers[pod.UID] != timer {
+			return
+		}
+		delete(g.timers, pod.UID)
+		g.due[pod.UID] = pod
+		select {
+		case g.wake <- struct{}{}:
+		default:
+		}
+	})
+	g.timers[pod.UID] = timer
+	return false
+}
+
+// Hold holds new images of a Pod that is not admitted yet
+func (g *readinessGate) Hold(uid types.UID, containersToImageIDs map[string]string) {
+	if g == nil || len(containersToImageIDs) == 0 {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.held[uid] == nil {
+		g.held[uid] = make(map[string]string)
+	}
+	for container, imageID := range containersToImageIDs {
+		g.held[uid][container] = imageID
+	}
+}
+
+// Release returns and forgets the images held for an admitted Pod
+func (g *readinessGate) Release(uid types.UID) map[string]string {
+	if g == nil {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	held := g.held[uid]
+	delete(g.held, uid)
+	return held
+}
+
+// Forget stops gating a deleted Pod
+func (g *readinessGate) Forget(uid types.UID) {
+	if g == nil {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.stopTimerUnsafe(uid)
+	delete(g.held, uid)
+	delete(g.due, uid)
+}
+
+// Wake returns a channel signaled when Pods become due. It is nil for the nil gate
+func (g *readinessGate) Wake() <-chan struct{} {
+	if g == nil {
+		return nil
+	}
+	return g.wake
+}
+
+// Due returns and forgets the Pods that have been ready for the stabilization delay since they were last seen
+func (g *readinessGate) Due() []*core1.Pod {
+	if g == nil {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	due := make([]*core1.Pod, 0, len(g.due))
+	for uid, pod := range g.due {
+		due = append(due, pod)
+		delete(g.due, uid)
+	}
+	return due
+}
+
+// stopTimerUnsafe stops revisiting a Pod. The caller must hold the lock
+func (g *readinessGate) stopTimerUnsafe(uid types.UID) {
+	if timer, ok := g.timers[uid]; ok {
+		timer.Stop()
+		delete(g.timers, uid)
+	}
+}
+
+// podReadySince returns since when the Ready condition of the Pod is true, false if it is not
+func podReadySince(pod *core1.Pod) (time.Time, bool) {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == core1.PodReady {
+			return condition.LastTransitionTime.Time, condition.Status == core1.ConditionTrue
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,120 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kubescape/operator/utils"
+	"github.com/stretchr/testify/assert"
+	core1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// withPodReadiness returns a copy of a Pod with the given Ready condition
+func withPodReadiness(pod *core1.Pod, ready bool, since time.Time) *core1.Pod {
+	updated := pod.DeepCopy()
+	status := core1.ConditionFalse
+	if ready {
+		status = core1.ConditionTrue
+	}
+	updated.Status.Conditions = []core1.PodCondition{{Type: core1.PodReady, Status: status, LastTransitionTime: v1.NewTime(since)}}
+	return updated
+}
+
+// withCrashLoopBackOff returns a copy of a Pod whose containers wait to be restarted
+func withCrashLoopBackOff(pod *core1.Pod) *core1.Pod {
+	updated := withPodReadiness(pod, false, time.Now())
+	for i := range updated.Status.ContainerStatuses {
+		updated.Status.ContainerStatuses[i].State = core1.ContainerState{Waiting: &core1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}}
+	}
+	return updated
+}
+
+func TestPodReadySince(t *testing.T) {
+	since := time.Now().Truncate(time.Second)
+	pod := newRunningPodFake("default", "nginx", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"})
+
+	_, ready := podReadySince(pod)
+	assert.False(t, ready, "Pods without a Ready condition should not be ready")
+
+	_, ready = podReadySince(withPodReadiness(pod, false, since))
+	assert.False(t, ready)
+
+	readySince, ready := podReadySince(withPodReadiness(pod, true, since))
+	assert.True(t, ready)
+	assert.Equal(t, since, readySince)
+}
+
+func TestReadinessGateFlappingPod(t *testing.T) {
+	ctx := context.TODO()
+	wlid := "wlid://cluster-/namespace-default/pod-nginx"
+	pod := newRunningPodFake("default", "nginx", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"})
+	pod.UID = types.UID("nginx")
+
+	k8sAPI, _ := newK8sAPIFake(pod)
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	wh.readiness = newReadinessGate(0)
+
+	// the image is broken and repushed while the Pod crash-loops
+	repushed := pod.DeepCopy()
+	repushed.Status.ContainerStatuses[0].ImageID = "nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432"
+	emitted := handlePodEvents(ctx, wh,
+		withPodReadiness(pod, false, time.Now()),
+		withCrashLoopBackOff(pod),
+		withPodReadiness(repushed, false, time.Now()),
+		withCrashLoopBackOff(repushed),
+		withPodReadiness(repushed, false, time.Now()),
+	)
+	assert.Empty(t, emitted, "Pods that are not ready should not trigger scans")
+	assert.NotEmpty(t, wh.GetInstanceIDs(), "the instance IDs of Pods that are not ready should be tracked")
+
+	// the Pod stabilizes
+	emitted = handlePodEvents(ctx, wh, withPodReadiness(repushed, true, time.Now()), withPodReadiness(repushed, true, time.Now()))
+	if assert.Len(t, emitted, 1, "the Pod should trigger a single scan once ready") {
+		assert.Equal(t, wlid, emitted[0].Wlid)
+		assert.Equal(t, map[string]string{"nginx": "nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432"}, emitted[0].Args[utils.ContainerToImageIdsArg])
+	}
+	assert.Empty(t, wh.GetWlidsForImageHash("nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"))
+}
+
+func TestReadinessGateStabilizationDelay(t *testing.T) {
+	ctx := context.TODO()
+	pod := newRunningPodFake("default", "nginx", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"})
+	pod.UID = types.UID("nginx")
+	flapping := newRunningPodFake("default", "flapping", map[string]string{"flapping": "flapping@sha256:ed9f56f5f8879eff25466b5f959ce407b66110c0da0b0117f51e420cbf4f616e"})
+	flapping.UID = types.UID("flapping")
+
+	k8sAPI, _ := newK8sAPIFake(pod, flapping)
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	wh.readiness = newReadinessGate(100 * time.Millisecond)
+
+	recorder := &commandRecorder{}
+	podsWatch := watch.NewFake()
+	done := make(chan struct{})
+	go func() {
+		wh.handlePodWatcher(ctx, podsWatch, newCommandDeduper(0, recorder.emit))
+		close(done)
+	}()
+
+	// both Pods become ready, but only one of them stays ready for the delay
+	podsWatch.Modify(withPodReadiness(pod, true, time.Now()))
+	podsWatch.Modify(withPodReadiness(flapping, true, time.Now()))
+	podsWatch.Modify(withPodReadiness(flapping, false, time.Now()))
+	assert.Empty(t, recorder.emitted(), "Pods should not trigger scans before the delay elapsed")
+
+	assert.Eventually(t, func() bool { return len(recorder.emitted()) > 0 }, time.Second, 10*time.Millisecond, "Pods ready for the delay should trigger scans without further events")
+	// leave time for the flapping Pod to trigger a scan, which it should not
+	time.Sleep(200 * time.Millisecond)
+	podsWatch.Stop()
+	<-done
+
+	emitted := recorder.emitted()
+	if assert.Len(t, emitted, 1) {
+		assert.Equal(t, "wlid://cluster-/namespace-default/pod-nginx", emitted[0].Wlid)
+	}
+}
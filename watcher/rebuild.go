@@ -0,0 +1,157 @@
+package watcher
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	core1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// idsRebuild records the Pods handled by the Pod watcher while the internal maps are rebuilt
+//
+// The maps are rebuilt into fresh maps that are swapped in once complete.
+// Pods handled by the watcher in the meantime are replayed onto the fresh
+// maps before the swap, so their entries are not lost.
+type idsRebuild struct {
+	inProgress bool
+	pods       []*core1.Pod
+	mu         sync.Mutex
+}
+
+// start starts recording the handled Pods
+func (r *idsRebuild) start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.inProgress = true
+	r.pods = nil
+}
+
+// record records a Pod handled by the watcher, if a rebuild is in progress
+//
+// Must be called before the Pod is added to the internal maps, so that it is
+// either replayed onto the fresh maps or added to them after the swap
+func (r *idsRebuild) record(pod *core1.Pod) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.inProgress {
+		r.pods = append(r.pods, pod)
+	}
+}
+
+// InProgress returns true while the internal maps are rebuilt
+func (r *idsRebuild) InProgress() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.inProgress
+}
+
+// deletionsDeferred returns why the handlers defer the deletions of the orphaned objects of a kind to cleanUp, if they do
+//
+// While the internal maps are rebuilt, or while a watch settles after a
+// reconnect, objects may look orphaned only because the maps are not up to
+// date yet. The cleanUp re-evaluates them once the maps are rebuilt.
+func (wh *WatchHandler) deletionsDeferred(kind string) (string, bool) {
+	if wh.rebuild.InProgress() {
+		return "while rebuilding the internal maps", true
+	}
+	if wh.settling.IsSettling(kind) {
+		return "while settling after a reconnect", true
+	}
+	return "", false
+}
+
+// newIDsShadow returns a WatchHandler holding nothing but empty internal maps, to rebuild them into
+func newIDsShadow() *WatchHandler {
+	return &WatchHandler{
+		iwMap:                              NewImageHashWLIDsMap(),
+		managedInstanceIDSlugs:             newPodInstanceIDs(),
+		instanceIDsMutex:                   &sync.RWMutex{},
+		wlidsToContainerToImageIDMap:       make(WlidsToContainerToImageIDMap),
+		wlidsToContainerToImagePinnedMap:   make(map[string]map[string]bool),
+		wlidsToContainerToContainerTypeMap: make(map[string]map[string]string),
+		wlidsToContainerToImageIDMapMutex:  &sync.RWMutex{},
+	}
+}
+
+// rebuildIDs builds the internal maps again from the listed Pods and swaps them in
+//
+// The current maps keep serving lookups and incremental updates until the
+// swap, which is atomic with respect to them. A failing list leaves them
+// untouched. Callers must hold resyncMutex.
+func (wh *WatchHandler) rebuildIDs(ctx context.Context) error {
+	wh.rebuild.start()
+	// parents are resolved again, e.g. for owners that changed, along with
+	// their annotations, and Pods still missing image IDs are deferred again
+	// when listed
+	wh.parents.Reset()
+	wh.parentAnnotations.Reset()
+	wh.prescans.ForgetResolved()
+	wh.pendingImageIDs.Reset()
+
+	shadow := newIDsShadow()
+	podUIDs := make(map[types.UID]struct{})
+	err := wh.buildIDsInto(ctx, shadow, func(handlePod func(pod *core1.Pod) error) error {
+		_, err := wh.listPods(ctx, func(pod *core1.Pod) error {
+			podUIDs[pod.UID] = struct{}{}
+			return handlePod(pod)
+		})
+		return err
+	})
+
+	wh.rebuild.mu.Lock()
+	defer wh.rebuild.mu.Unlock()
+
+	handledPods := wh.rebuild.pods
+	wh.rebuild.inProgress = false
+	wh.rebuild.pods = nil
+	if err != nil {
+		return err
+	}
+
+	for _, pod := range handledPods {
+		podUIDs[pod.UID] = struct{}{}
+		wh.buildIDsForPodInto(ctx, shadow, pod)
+	}
+	// the completed Pods of Jobs still in the window are tracked even once
+	// they are gone, along with their parents, whose Jobs may be gone too
+	for _, retained := range wh.completedJobPods.Expire(time.Now().Add(-wh.completedJobPodsWindow)) {
+		if _, ok := podUIDs[retained.pod.UID]; ok {
+			continue
+		}
+		podUIDs[retained.pod.UID] = struct{}{}
+		wh.retainParent(retained)
+		wh.buildIDsForPodInto(ctx, shadow, retained.pod)
+	}
+	// the rescan nonces of workloads that are gone are forgotten
+	wh.rescans.Retain(shadow.wlidsToContainerToImageIDMap)
+	wh.swapIDs(shadow)
+	// Pods deleted while the watcher was down are not tracked anymore
+	wh.podImageIDs.Retain(podUIDs)
+	wh.retainWlids()
+	wh.succeededJobPods.Retain(podUIDs)
+	return nil
+}
+
+// swapIDs replaces the internal maps with the ones of shadow, which must not be used afterwards
+func (wh *WatchHandler) swapIDs(shadow *WatchHandler) {
+	wh.wlidsToContainerToImageIDMapMutex.Lock()
+	defer wh.wlidsToContainerToImageIDMapMutex.Unlock()
+	wh.instanceIDsMutex.Lock()
+	defer wh.instanceIDsMutex.Unlock()
+	wh.iwMap.mu.Lock()
+	defer wh.iwMap.mu.Unlock()
+
+	wh.wlidsToContainerToImageIDMap = shadow.wlidsToContainerToImageIDMap
+	wh.wlidsToContainerToImagePinnedMap = shadow.wlidsToContainerToImagePinnedMap
+	wh.wlidsToContainerToContainerTypeMap = shadow.wlidsToContainerToContainerTypeMap
+	wh.managedInstanceIDSlugs = shadow.managedInstanceIDSlugs
+	wh.iwMap.wlidsByImageHash = shadow.iwMap.wlidsByImageHash
+	if wh.iwMap.wlidsByImageHash == nil {
+		wh.iwMap.init()
+	}
+}
@@ -0,0 +1,140 @@
+package watcher
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	instanceidv1 "github.com/kubescape/k8s-interface/instanceidhandler/v1"
+	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestRebuildIDsKeepsPodsWatchedMeanwhile(t *testing.T) {
+	listedWlid := "wlid://cluster-/namespace-default/pod-listed"
+	scheduledWlid := "wlid://cluster-/namespace-default/pod-scheduled"
+	scheduledPod := newRunningPodFake("default", "scheduled", map[string]string{"nginx": "nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432"})
+
+	// the scheduled Pod is not part of the list, as it is created after it
+	k8sAPI, k8sClient := newK8sAPIFake(newRunningPodFake("default", "listed", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"}))
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	wh.storageClient = kssfake.NewSimpleClientset()
+
+	recorder := &commandRecorder{}
+	podsWatch := watch.NewFake()
+	done := make(chan struct{})
+	go func() {
+		wh.handlePodWatcher(context.TODO(), podsWatch, newCommandDeduper(0, recorder.emit))
+		close(done)
+	}()
+
+	// the watcher handles the scheduled Pod while the Pods are listed by cleanUp
+	var scheduled sync.Once
+	k8sClient.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		scheduled.Do(func() {
+			podsWatch.Modify(scheduledPod)
+			assert.Eventually(t, func() bool { return len(wh.GetContainerToImageIDForWlid(scheduledWlid)) > 0 }, time.Second, 10*time.Millisecond)
+		})
+		return false, nil, nil
+	})
+
+	wh.cleanUp(context.TODO())
+	podsWatch.Stop()
+	<-done
+
+	assert.Equal(t, WlidsToContainerToImageIDMap{
+		listedWlid:    {"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"},
+		scheduledWlid: {"nginx": "nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432"},
+	}, wh.GetWlidsToContainerToImageIDMap())
+	assert.Equal(t, []string{scheduledWlid}, wh.GetWlidsForImageHash("nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432"))
+	assert.Len(t, wh.GetInstanceIDs(), 2)
+	assert.Len(t, recorder.emitted(), 1)
+}
+
+func TestRebuildIDsConcurrentLookups(t *testing.T) {
+	expectedWlid := "wlid://cluster-/namespace-default/pod-nginx"
+	k8sAPI, _ := newK8sAPIFake(newRunningPodFake("default", "nginx", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"}))
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+
+	// run with -race: lookups must be synchronized with the swap of the maps
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			assert.NoError(t, wh.ForceResync(context.TODO()))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			_ = wh.GetContainerToImageIDForWlid(expectedWlid)
+			_ = wh.GetWlidsForImageHash("nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240")
+			_ = wh.GetInstanceIDs()
+			_ = wh.snapshotState()
+		}
+	}()
+	wg.Wait()
+
+	// the maps are never observed empty once built
+	assert.Equal(t, map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"}, wh.GetContainerToImageIDForWlid(expectedWlid))
+}
+
+func TestRebuildIDsDefersDeletions(t *testing.T) {
+	ctx := context.TODO()
+	imageID := "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"
+	summary := &spdxv1beta1.SBOMSummary{ObjectMeta: v1.ObjectMeta{
+		Name:        "nginx",
+		Namespace:   "kubescape",
+		Labels:      managedLabels(),
+		Annotations: map[string]string{instanceidv1.ImageIDMetadataKey: imageID},
+	}}
+	manifest := &spdxv1beta1.VulnerabilityManifest{ObjectMeta: v1.ObjectMeta{Name: imageID, Namespace: "kubescape", Labels: managedLabels()}}
+
+	// the image is only tracked once the maps are rebuilt from the listed Pods
+	k8sAPI, k8sClient := newK8sAPIFake(newRunningPodFake("default", "nginx", map[string]string{"nginx": imageID}))
+	storageClient := kssfake.NewSimpleClientset(summary.DeepCopy(), manifest.DeepCopy())
+	wh, err := NewWatchHandler(k8sAPI, storageClient, nil, nil, WithDeletionPolicies(map[string]DeletionPolicy{vulnerabilityManifestKind: DeletionPolicyLabel}))
+	assert.NoError(t, err)
+
+	// the events arrive while the Pods are slowly listed by cleanUp
+	var handled sync.Once
+	k8sClient.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		handled.Do(func() {
+			assert.True(t, wh.rebuild.InProgress())
+			sbomEvents := make(chan watch.Event, 1)
+			sbomEvents <- watch.Event{Type: watch.Modified, Object: summary.DeepCopy()}
+			close(sbomEvents)
+			errCh := make(chan error)
+			go wh.HandleSBOMEvents(ctx, sbomEvents, nil, errCh)
+			for err := range errCh {
+				assert.NoError(t, err)
+			}
+			wh.handleVulnerabilityManifestEvent(ctx, watch.Event{Type: watch.Modified, Object: manifest.DeepCopy()}, func(err error) {
+				assert.NoError(t, err)
+			})
+
+			_, err := storageClient.SpdxV1beta1().SBOMSummaries("kubescape").Get(ctx, summary.Name, v1.GetOptions{})
+			assert.NoError(t, err, "no deletion should happen while the maps are rebuilt")
+		})
+		return false, nil, nil
+	})
+
+	wh.cleanUp(ctx)
+	assert.False(t, wh.rebuild.InProgress())
+
+	// the cleanUp re-evaluates the objects once the maps are rebuilt
+	_, err = storageClient.SpdxV1beta1().SBOMSummaries("kubescape").Get(ctx, summary.Name, v1.GetOptions{})
+	assert.NoError(t, err)
+	kept, err := storageClient.SpdxV1beta1().VulnerabilityManifests("kubescape").Get(ctx, manifest.Name, v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NotContains(t, kept.Labels, orphanedAtLabel)
+}
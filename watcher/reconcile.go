@@ -0,0 +1,127 @@
+package watcher
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// sbomSPDXv2p3Kind is the kind of the SBOMs stored along with their summaries
+const sbomSPDXv2p3Kind = "SBOMSPDXv2p3"
+
+const (
+	// metricReconciledVulnerabilityManifestsKeptTotal is the number of Vulnerability Manifests the initial reconcile found tracked and kept
+	metricReconciledVulnerabilityManifestsKeptTotal = "operator_reconciled_vulnerability_manifests_kept_total"
+	// metricReconciledVulnerabilityManifestsDeletedTotal is the number of orphaned Vulnerability Manifests the initial reconcile deleted
+	metricReconciledVulnerabilityManifestsDeletedTotal = "operator_reconciled_vulnerability_manifests_deleted_total"
+)
+
+// reconcileOnStartup deletes the storage objects orphaned while the operator was not running, in a single batch
+//
+// Besides the objects reclaimed by cleanUp, SBOMs whose summary is gone and
+// orphaned Vulnerability Manifests are deleted, as HandleVulnerabilityManifestEvents
+// only sees the manifests changing while the operator runs. Every object
+// looks orphaned until the internal maps are built from the Pods of the
+// cluster, so ErrInternalMapsNotBuilt is returned, and nothing is deleted,
+// if they were not built yet.
+func (wh *WatchHandler) reconcileOnStartup(ctx context.Context) error {
+	if !wh.idsBuilt.Load() {
+		return ErrInternalMapsNotBuilt
+	}
+
+	wh.resyncMutex.Lock()
+	defer wh.resyncMutex.Unlock()
+
+	batch := &deletionBatch{}
+	wh.addSBOMOrphans(ctx, batch)
+	wh.addSBOMWithoutSummaryOrphans(ctx, batch)
+	wh.addStorageOwnerOrphans(ctx, batch)
+	wh.flushOrphans(ctx, "initial reconcile", batch)
+	wh.reconcileVulnerabilityManifests(ctx)
+	return nil
+}
+
+// addSBOMWithoutSummaryOrphans adds the deletions of the orphaned SBOMs that have no summary to the batch
+//
+// SBOMs with a summary are deleted along with it, see addSBOMOrphans
+func (wh *WatchHandler) addSBOMWithoutSummaryOrphans(ctx context.Context, batch *deletionBatch) {
+	listCtx, cancel := wh.storageRequestContext(ctx)
+	defer cancel()
+
+	summaries, err := wh.storageClient.SpdxV1beta1().SBOMSummaries("").List(listCtx, v1.ListOptions{})
+	if err != nil {
+		logger.L().Ctx(ctx).Error("failed to list SBOMs for cleanup", helpers.String("kind", sbomSummaryKind), helpers.Error(err))
+		return
+	}
+	sboms, err := wh.storageClient.SpdxV1beta1().SBOMSPDXv2p3s("").List(listCtx, v1.ListOptions{})
+	if err != nil {
+		logger.L().Ctx(ctx).Error("failed to list SBOMs for cleanup", helpers.String("kind", sbomSPDXv2p3Kind), helpers.Error(err))
+		return
+	}
+
+	withSummary := make(map[string]struct{}, len(summaries.Items))
+	for i := range summaries.Items {
+		withSummary[summaries.Items[i].Namespace+"/"+summaries.Items[i].Name] = struct{}{}
+	}
+	for i := range sboms.Items {
+		sbom := &sboms.Items[i]
+		if _, ok := withSummary[sbom.Namespace+"/"+sbom.Name]; ok {
+			continue
+		}
+		// SBOMs are identified by image ID, like their summaries
+		isOrphan, reason, ok := wh.sbomOrphanCheck(sbomSummaries, sbom)
+		if !ok {
+			continue
+		}
+		namespace, name := sbom.Namespace, sbom.Name
+		wh.addOrphan(batch, sbomSPDXv2p3Kind, sbom, reason, isOrphan, func(ctx context.Context) error {
+			return wh.storageClient.SpdxV1beta1().SBOMSPDXv2p3s(namespace).Delete(ctx, name, v1.DeleteOptions{})
+		}, func(ctx context.Context, namespace, name string, data []byte) error {
+			_, err := wh.storageClient.SpdxV1beta1().SBOMSPDXv2p3s(namespace).Patch(ctx, name, types.MergePatchType, data, v1.PatchOptions{})
+			return err
+		})
+	}
+}
+
+// reconcileVulnerabilityManifests deletes the orphaned Vulnerability Manifests in a single batch, recording how many were kept and deleted
+//
+// Only the manifests that are due are deleted, see vulnerabilityManifestDue.
+func (wh *WatchHandler) reconcileVulnerabilityManifests(ctx context.Context) {
+	listCtx, cancel := wh.storageRequestContext(ctx)
+	manifests, err := wh.storageClient.SpdxV1beta1().VulnerabilityManifests("").List(listCtx, v1.ListOptions{})
+	cancel()
+	if err != nil {
+		logger.L().Ctx(ctx).Error("failed to list Vulnerability Manifests for cleanup", helpers.Error(err))
+		return
+	}
+
+	batch := &deletionBatch{}
+	for i := range manifests.Items {
+		manifest := &manifests.Items[i]
+		if isRegistryScanManifest(manifest) {
+			continue
+		}
+		if orphaned, reason := wh.vulnerabilityManifestOrphanCheck(manifest); orphaned {
+			wh.addDueVulnerabilityManifest(ctx, batch, manifest, reason)
+		}
+	}
+
+	deleted, errs := wh.flushBatch(ctx, batch)
+	for _, err := range errs {
+		logger.L().Ctx(ctx).Error("failed to delete orphaned storage object", helpers.Error(err))
+	}
+	kept := len(manifests.Items) - deleted - len(errs)
+	wh.metrics.Add(metricReconciledVulnerabilityManifestsKeptTotal, int64(kept))
+	wh.metrics.Add(metricReconciledVulnerabilityManifestsDeletedTotal, int64(deleted))
+	logger.L().Ctx(ctx).Info("initial reconcile reconciled Vulnerability Manifests",
+		helpers.Int("checked", len(manifests.Items)),
+		helpers.Int("kept", kept),
+		helpers.Int("deleted", deleted),
+		helpers.Int("failed", len(errs)),
+		helpers.String("dryRun", strconv.FormatBool(wh.dryRun)),
+	)
+}
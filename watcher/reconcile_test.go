@@ -0,0 +1,297 @@
+package watcher
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	instanceidhandlerv1 "github.com/kubescape/k8s-interface/instanceidhandler/v1"
+	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestReconcileOnStartup(t *testing.T) {
+	knownImageID := "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"
+	unknownImageID := "nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432"
+	annotated := func(imageID string) v1.ObjectMeta {
+		return v1.ObjectMeta{Labels: managedLabels(), Annotations: map[string]string{instanceidhandlerv1.ImageIDMetadataKey: imageID}}
+	}
+	named := func(meta v1.ObjectMeta, name string) v1.ObjectMeta {
+		meta.Name, meta.Namespace = name, "kubescape"
+		meta.Labels = managedLabels()
+		return meta
+	}
+
+	tt := []struct {
+		name                  string
+		initialReconcile      bool
+		expectedSummaryNames  []string
+		expectedSBOMNames     []string
+		expectedManifestNames []string
+	}{
+		{
+			name:                  "Orphaned objects are kept until events arrive by default",
+			initialReconcile:      false,
+			expectedSummaryNames:  []string{"known", "unknown"},
+			expectedSBOMNames:     []string{"known", "known-without-summary", "unknown", "unknown-without-summary"},
+			expectedManifestNames: []string{knownImageID, "unknown"},
+		},
+		{
+			name:                  "Orphaned objects are deleted on startup when enabled",
+			initialReconcile:      true,
+			expectedSummaryNames:  []string{"known"},
+			expectedSBOMNames:     []string{"known", "known-without-summary"},
+			expectedManifestNames: []string{knownImageID},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.TODO()
+			pod := newRunningPodFake("default", "nginx", map[string]string{"nginx": knownImageID})
+			k8sAPI, _ := newK8sAPIFake(pod)
+			storageClient := kssfake.NewSimpleClientset(
+				&spdxv1beta1.SBOMSummary{ObjectMeta: named(annotated(knownImageID), "known")},
+				&spdxv1beta1.SBOMSPDXv2p3{ObjectMeta: named(annotated(knownImageID), "known")},
+				&spdxv1beta1.SBOMSummary{ObjectMeta: named(annotated(unknownImageID), "unknown")},
+				&spdxv1beta1.SBOMSPDXv2p3{ObjectMeta: named(annotated(unknownImageID), "unknown")},
+				&spdxv1beta1.SBOMSPDXv2p3{ObjectMeta: named(annotated(knownImageID), "known-without-summary")},
+				&spdxv1beta1.SBOMSPDXv2p3{ObjectMeta: named(annotated(unknownImageID), "unknown-without-summary")},
+				&spdxv1beta1.VulnerabilityManifest{ObjectMeta: named(v1.ObjectMeta{}, knownImageID)},
+				&spdxv1beta1.VulnerabilityManifest{ObjectMeta: named(v1.ObjectMeta{}, "unknown")},
+			)
+
+			wh, err := NewWatchHandler(k8sAPI, storageClient, nil, nil, WithInitialReconcile(tc.initialReconcile))
+			assert.NoError(t, err)
+			assert.NoError(t, wh.Start(ctx))
+
+			names := func() ([]string, []string, []string) {
+				summaries, _ := storageClient.SpdxV1beta1().SBOMSummaries("").List(ctx, v1.ListOptions{})
+				sboms, _ := storageClient.SpdxV1beta1().SBOMSPDXv2p3s("").List(ctx, v1.ListOptions{})
+				manifests, _ := storageClient.SpdxV1beta1().VulnerabilityManifests("").List(ctx, v1.ListOptions{})
+				var summaryNames, sbomNames, manifestNames []string
+				for i := range summaries.Items {
+					summaryNames = append(summaryNames, summaries.Items[i].Name)
+				}
+				for i := range sboms.Items {
+					sbomNames = append(sbomNames, sboms.Items[i].Name)
+				}
+				for i := range manifests.Items {
+					manifestNames = append(manifestNames, manifests.Items[i].Name)
+				}
+				sort.Strings(summaryNames)
+				sort.Strings(sbomNames)
+				sort.Strings(manifestNames)
+				return summaryNames, sbomNames, manifestNames
+			}
+
+			assert.Eventually(t, func() bool {
+				summaryNames, sbomNames, manifestNames := names()
+				return assert.ObjectsAreEqual(tc.expectedSummaryNames, summaryNames) &&
+					assert.ObjectsAreEqual(tc.expectedSBOMNames, sbomNames) &&
+					assert.ObjectsAreEqual(tc.expectedManifestNames, manifestNames)
+			}, time.Second, 10*time.Millisecond)
+			if tc.initialReconcile {
+				assert.Eventually(t, func() bool {
+					return wh.metrics.Get(metricReconciledVulnerabilityManifestsKeptTotal) == 1 &&
+						wh.metrics.Get(metricReconciledVulnerabilityManifestsDeletedTotal) == 1
+				}, time.Second, 10*time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestReconcileOnStartupBeforeTheMapsAreBuilt(t *testing.T) {
+	ctx := context.TODO()
+	storageClient := kssfake.NewSimpleClientset(
+		&spdxv1beta1.VulnerabilityManifest{ObjectMeta: v1.ObjectMeta{Name: "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240", Namespace: "kubescape", Labels: managedLabels()}},
+	)
+	wh := NewWatchHandlerMock()
+	wh.storageClient = storageClient
+
+	// every object looks orphaned while the maps are empty
+	assert.ErrorIs(t, wh.reconcileOnStartup(ctx), ErrInternalMapsNotBuilt)
+	manifests, err := storageClient.SpdxV1beta1().VulnerabilityManifests("").List(ctx, v1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, manifests.Items, 1, "nothing should be deleted before the maps are built")
+
+	wh.addToImageIDToWlidsMap("nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240", "wlid://cluster-/namespace-default/pod-nginx")
+	wh.idsBuilt.Store(true)
+	assert.NoError(t, wh.reconcileOnStartup(ctx))
+	manifests, err = storageClient.SpdxV1beta1().VulnerabilityManifests("").List(ctx, v1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, manifests.Items, 1, "tracked manifests should be kept")
+	assert.Equal(t, int64(1), wh.metrics.Get(metricReconciledVulnerabilityManifestsKeptTotal))
+}
+
+func TestVulnerabilityManifestOrphanCheck(t *testing.T) {
+	instanceID := "apiVersion-v1/namespace-default/kind-Pod/name-reverse-proxy/containerName-nginx"
+	instanceIDSlug, _ := annotationsToInstanceID(map[string]string{instanceidhandlerv1.InstanceIDMetadataKey: instanceID})
+
+	wh := NewWatchHandlerMock()
+	wh.iwMap = NewImageHashWLIDsMapFrom(imageHashKeys(map[string][]string{"nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240": {"wlid"}}))
+	wh.managedInstanceIDSlugs = newPodInstanceIDs(instanceIDSlug)
+
+	manifest := func(name string, withRelevancy bool) *spdxv1beta1.VulnerabilityManifest {
+		vm := &spdxv1beta1.VulnerabilityManifest{ObjectMeta: v1.ObjectMeta{Name: name, Labels: managedLabels()}}
+		vm.Spec.Metadata.WithRelevancy = withRelevancy
+		return vm
+	}
+
+	orphaned, reason := wh.vulnerabilityManifestOrphanCheck(manifest("nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240", false))
+	assert.False(t, orphaned)
+	assert.Equal(t, deletionReasonImageHashNotTracked, reason)
+	orphaned, _ = wh.vulnerabilityManifestOrphanCheck(manifest("nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432", false))
+	assert.True(t, orphaned)
+
+	orphaned, reason = wh.vulnerabilityManifestOrphanCheck(manifest(instanceIDSlug, true))
+	assert.False(t, orphaned)
+	assert.Equal(t, deletionReasonInstanceIDNotTracked, reason)
+	orphaned, _ = wh.vulnerabilityManifestOrphanCheck(manifest("unknown", true))
+	assert.True(t, orphaned)
+}
+
+func TestVulnerabilityManifestOrphanCheckAnnotations(t *testing.T) {
+	trackedInstanceID := "apiVersion-v1/namespace-default/kind-Pod/name-reverse-proxy/containerName-nginx"
+	trackedInstanceIDSlug, _ := annotationsToInstanceID(map[string]string{instanceidhandlerv1.InstanceIDMetadataKey: trackedInstanceID})
+	untrackedInstanceID := "apiVersion-v1/namespace-default/kind-Pod/name-reverse-proxy/containerName-redis"
+	untrackedInstanceIDSlug, _ := annotationsToInstanceID(map[string]string{instanceidhandlerv1.InstanceIDMetadataKey: untrackedInstanceID})
+
+	wh := NewWatchHandlerMock()
+	wh.iwMap = NewImageHashWLIDsMapFrom(imageHashKeys(map[string][]string{"nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240": {"wlid"}}))
+	wh.managedInstanceIDSlugs = newPodInstanceIDs(trackedInstanceIDSlug)
+
+	tt := []struct {
+		name             string
+		manifestName     string
+		withRelevancy    bool
+		imageID          string
+		instanceID       string
+		expectedOrphaned bool
+	}{
+		{
+			name:          "annotated with a tracked image ID and an untracked instance ID",
+			manifestName:  untrackedInstanceIDSlug,
+			withRelevancy: true,
+			imageID:       "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240",
+			instanceID:    untrackedInstanceID,
+		},
+		{
+			name:         "annotated with an untracked image ID and a tracked instance ID",
+			manifestName: "nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432",
+			imageID:      "nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432",
+			instanceID:   trackedInstanceID,
+		},
+		{
+			name:             "annotated with untracked identifiers",
+			manifestName:     untrackedInstanceIDSlug,
+			withRelevancy:    true,
+			imageID:          "nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432",
+			instanceID:       untrackedInstanceID,
+			expectedOrphaned: true,
+		},
+		{
+			name:         "without annotations, named after a tracked image",
+			manifestName: "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240",
+		},
+		{
+			name:             "without annotations, named after an untracked instance ID",
+			manifestName:     untrackedInstanceIDSlug,
+			withRelevancy:    true,
+			expectedOrphaned: true,
+		},
+		{
+			name:          "named after a tracked instance ID but annotated with untracked identifiers",
+			manifestName:  trackedInstanceIDSlug,
+			withRelevancy: true,
+			imageID:       "nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432",
+			instanceID:    untrackedInstanceID,
+			// the annotations take precedence over the name
+			expectedOrphaned: true,
+		},
+		{
+			name:         "named after a different storage convention but annotated with a tracked image ID",
+			manifestName: "nginx-sha256-1",
+			imageID:      "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			vm := &spdxv1beta1.VulnerabilityManifest{ObjectMeta: v1.ObjectMeta{Name: tc.manifestName, Labels: managedLabels(), Annotations: map[string]string{}}}
+			vm.Spec.Metadata.WithRelevancy = tc.withRelevancy
+			if tc.imageID != "" {
+				vm.Annotations[instanceidhandlerv1.ImageIDMetadataKey] = tc.imageID
+			}
+			if tc.instanceID != "" {
+				vm.Annotations[instanceidhandlerv1.InstanceIDMetadataKey] = tc.instanceID
+			}
+
+			orphaned, _ := wh.vulnerabilityManifestOrphanCheck(vm)
+			assert.Equal(t, tc.expectedOrphaned, orphaned)
+		})
+	}
+}
+
+func TestRegistryScanManifestsAreKept(t *testing.T) {
+	ctx := context.TODO()
+	trackedImageID := "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"
+	registryContext := map[string]string{instanceidhandlerv1.ContextMetadataKey: registryScanContext}
+	registryLabels := managedLabels()
+	registryLabels[instanceidhandlerv1.ContextMetadataKey] = registryScanContext
+	manifests := func() []runtime.Object {
+		return []runtime.Object{
+			&spdxv1beta1.VulnerabilityManifest{ObjectMeta: v1.ObjectMeta{Name: trackedImageID, Namespace: "kubescape", Labels: managedLabels()}},
+			&spdxv1beta1.VulnerabilityManifest{ObjectMeta: v1.ObjectMeta{Name: "redis@sha256:328695eff5583aa7bc95f9dd456106461d588df5bffc296107964fe27ee0e083", Namespace: "kubescape", Labels: managedLabels()}},
+			&spdxv1beta1.VulnerabilityManifest{ObjectMeta: v1.ObjectMeta{Name: "mysql@sha256:14b109bb94e7bf0b06007d3d8ac4547a665eeff2973d2547dd934fcc3a6b15e9", Namespace: "kubescape", Labels: registryLabels}},
+			&spdxv1beta1.VulnerabilityManifest{ObjectMeta: v1.ObjectMeta{Name: "postgres@sha256:d153d3e932d74d5063aa74de5eaeb29e5cfb30ee0f8d5f8646a12ec513dbca6e", Namespace: "kubescape", Labels: managedLabels(), Annotations: registryContext}},
+		}
+	}
+	names := func(storageClient *kssfake.Clientset) []string {
+		list, err := storageClient.SpdxV1beta1().VulnerabilityManifests("").List(ctx, v1.ListOptions{})
+		assert.NoError(t, err)
+		var names []string
+		for i := range list.Items {
+			names = append(names, list.Items[i].Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	t.Run("reconciled", func(t *testing.T) {
+		k8sAPI, _ := newK8sAPIFake()
+		storageClient := kssfake.NewSimpleClientset(manifests()...)
+		wh, err := NewWatchHandler(k8sAPI, storageClient, map[string][]string{trackedImageID: {"wlid-01"}}, nil)
+		assert.NoError(t, err)
+		wh.idsBuilt.Store(true)
+
+		assert.NoError(t, wh.reconcileOnStartup(ctx))
+		assert.Equal(t, []string{"mysql@sha256:14b109bb94e7bf0b06007d3d8ac4547a665eeff2973d2547dd934fcc3a6b15e9", trackedImageID, "postgres@sha256:d153d3e932d74d5063aa74de5eaeb29e5cfb30ee0f8d5f8646a12ec513dbca6e"}, names(storageClient), "only the orphaned manifests of Pods should be deleted")
+	})
+
+	t.Run("retained", func(t *testing.T) {
+		k8sAPI, _ := newK8sAPIFake()
+		storageClient := kssfake.NewSimpleClientset(manifests()...)
+		wh, err := NewWatchHandler(k8sAPI, storageClient, map[string][]string{trackedImageID: {"wlid-01"}}, nil,
+			WithVulnerabilityManifestRetention(24*time.Hour))
+		assert.NoError(t, err)
+		for _, obj := range manifests() {
+			wh.handleVulnerabilityManifestEvent(ctx, watch.Event{Type: watch.Modified, Object: obj}, func(err error) {
+				assert.NoError(t, err)
+			})
+		}
+		wh.reclaimOrphans(ctx)
+
+		list, err := storageClient.SpdxV1beta1().VulnerabilityManifests("").List(ctx, v1.ListOptions{})
+		assert.NoError(t, err)
+		for i := range list.Items {
+			_, marked := list.Items[i].Annotations[deletionDueAnnotation]
+			assert.Equal(t, list.Items[i].Name == "redis@sha256:328695eff5583aa7bc95f9dd456106461d588df5bffc296107964fe27ee0e083", marked, "only the orphaned manifests of Pods should be marked: %s", list.Items[i].Name)
+		}
+	})
+}
@@ -0,0 +1,110 @@
+package watcher
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	"github.com/kubescape/operator/utils"
+)
+
+// metricRelevancyScansTriggeredTotal is the number of relevancy scans triggered after the cleanUps
+const metricRelevancyScansTriggeredTotal = "operator_relevancy_scans_triggered_total"
+
+// relevancyScanTrigger holds the sink of the relevancy scans triggered after every cleanUp, see WithPeriodicRelevancyScan
+//
+// The sink is set once the watchers start, after the cleanUp routine did.
+// The nil value triggers nothing.
+type relevancyScanTrigger struct {
+	sink utils.CommandSink
+	mu   sync.RWMutex
+}
+
+// SetSink sets the sink the relevancy scans are sent to
+func (t *relevancyScanTrigger) SetSink(sink utils.CommandSink) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sink = sink
+}
+
+// Sink returns the sink the relevancy scans are sent to, nil if none was set yet
+func (t *relevancyScanTrigger) Sink() utils.CommandSink {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.sink
+}
+
+// SetRelevancyScanSink sets the sink of the relevancy scans triggered after every cleanUp
+//
+// It does nothing unless WithPeriodicRelevancyScan enabled them. Scans are
+// not triggered until the sink is set.
+func (wh *WatchHandler) SetRelevancyScanSink(sink utils.CommandSink) {
+	wh.relevancyScans.SetSink(sink)
+}
+
+// triggerRelevancyScan sends a relevancy scan command for each tracked WLID, with the images of its tracked containers
+//
+// It must be called after cleanUp: a WLID has an instance ID per container
+// of each of its Pods, including the Pods replaced since the last cleanUp,
+// so the commands are built per WLID from the rebuilt maps and each WLID is
+// scanned once, whatever its number of instance IDs.
+func (wh *WatchHandler) triggerRelevancyScan(ctx context.Context) {
+	sink := wh.relevancyScans.Sink()
+	if sink == nil {
+		return
+	}
+
+	wlids, triggered := wh.scanTrackedWorkloads(ctx, sink, utils.ScanScopeRelevancy)
+	wh.metrics.Add(metricRelevancyScansTriggeredTotal, int64(triggered))
+	logger.L().Ctx(ctx).Info("triggered relevancy scans of the tracked workloads", helpers.Int("wlids", wlids), helpers.Int("triggered", triggered))
+}
+
+// scanTrackedWorkloads sends a scan command of the given scope for each tracked WLID, with the images of its tracked containers
+//
+// The commands are sent in the order of the WLIDs, at the rate of the
+// command limiter if any. Returns the number of tracked WLIDs and of
+// commands sent, stopping early once the context is done.
+func (wh *WatchHandler) scanTrackedWorkloads(ctx context.Context, sink utils.CommandSink, scope string) (int, int) {
+	wh.wlidsToContainerToImageIDMapMutex.RLock()
+	wlids := make([]string, 0, len(wh.wlidsToContainerToImageIDMap))
+	for wlid, containerToImageID := range wh.wlidsToContainerToImageIDMap {
+		if len(containerToImageID) > 0 {
+			wlids = append(wlids, wlid)
+		}
+	}
+	wh.wlidsToContainerToImageIDMapMutex.RUnlock()
+	sort.Strings(wlids)
+
+	sent := 0
+	for _, wlid := range wlids {
+		if ctx.Err() != nil {
+			break
+		}
+		if !wh.triggersScan(ctx, wlid) {
+			continue
+		}
+		if wh.commandLimiter != nil {
+			if err := wh.commandLimiter.Wait(ctx); err != nil {
+				break
+			}
+		}
+		if err := sink.Send(ctx, wh.scanCommandForWlid(ctx, wlid, scope)); err != nil {
+			logger.L().Ctx(ctx).Error("failed to send scan command", helpers.String("wlid", wlid), helpers.String("scope", scope), helpers.Error(err))
+			continue
+		}
+		sent++
+	}
+	return len(wlids), sent
+}
@@ -0,0 +1,68 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/armosec/armoapi-go/apis"
+	"github.com/kubescape/operator/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTriggerRelevancyScan(t *testing.T) {
+	nginxWlid := "wlid://cluster-/namespace-default/deployment-nginx"
+	redisWlid := "wlid://cluster-/namespace-default/deployment-redis"
+	excludedWlid := "wlid://cluster-/namespace-kube-system/deployment-coredns"
+
+	newWatchHandler := func(opts ...WatchHandlerOption) *WatchHandler {
+		wh := NewWatchHandlerMock()
+		WithExcludedNamespaces("kube-system")(wh)
+		for _, opt := range opts {
+			opt(wh)
+		}
+		// the replicas of a WLID share its containers, whatever their number of instance IDs
+		wh.addToWlidsToContainerToImageIDMap(nginxWlid, "nginx", "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240")
+		wh.addToWlidsToContainerToImageIDMap(redisWlid, "redis", "redis@sha256:328695eff5583aa7bc95f9dd456106461d588df5bffc296107964fe27ee0e083")
+		wh.addToWlidsToContainerToImageIDMap(excludedWlid, "coredns", "coredns@sha256:0c22bf10e9320da3b90b6525655c6ceca4719b608112cf5f1fc74b92aaedf107")
+		return wh
+	}
+
+	t.Run("disabled by default", func(t *testing.T) {
+		wh := newWatchHandler()
+		rec := &commandRecorder{}
+		wh.SetRelevancyScanSink(rec)
+		wh.triggerRelevancyScan(context.TODO())
+		assert.Empty(t, rec.emitted())
+	})
+
+	t.Run("nothing is triggered until the sink is set", func(t *testing.T) {
+		wh := newWatchHandler(WithPeriodicRelevancyScan(true))
+		wh.triggerRelevancyScan(context.TODO())
+		assert.Equal(t, int64(0), wh.metrics.Get(metricRelevancyScansTriggeredTotal))
+	})
+
+	t.Run("scans each tracked WLID once", func(t *testing.T) {
+		wh := newWatchHandler(WithPeriodicRelevancyScan(true))
+		rec := &commandRecorder{}
+		wh.SetRelevancyScanSink(rec)
+		wh.triggerRelevancyScan(context.TODO())
+
+		wlids := []string{}
+		for _, cmd := range rec.emitted() {
+			assert.Equal(t, apis.TypeScanImages, cmd.CommandName)
+			assert.Equal(t, utils.ScanScopeRelevancy, cmd.Args[utils.ScanScopeArg])
+			assert.Equal(t, wh.GetContainerToImageIDForWlid(cmd.Wlid), cmd.Args[utils.ContainerToImageIdsArg])
+			wlids = append(wlids, cmd.Wlid)
+		}
+		assert.Equal(t, []string{nginxWlid, redisWlid}, wlids, "excluded WLIDs should not be scanned")
+		assert.Equal(t, int64(2), wh.metrics.Get(metricRelevancyScansTriggeredTotal))
+	})
+
+	t.Run("undelivered commands", func(t *testing.T) {
+		wh := newWatchHandler(WithPeriodicRelevancyScan(true))
+		wh.SetRelevancyScanSink(failingCommandSink{err: errors.New("queue full")})
+		wh.triggerRelevancyScan(context.TODO())
+		assert.Equal(t, int64(0), wh.metrics.Get(metricRelevancyScansTriggeredTotal))
+	})
+}
@@ -0,0 +1,81 @@
+package watcher
+
+import (
+	"context"
+	"sync"
+
+	core1 "k8s.io/api/core/v1"
+)
+
+// rescanAnnotation requests a rescan of all the containers of a workload whenever its value changes, e.g. to a timestamp or nonce
+//
+// It is read from the Pods, or else from their top-level parent. Changes are
+// noticed on the events of the Pods, and the annotations of parents are only
+// fetched again once the internal maps are rebuilt.
+const rescanAnnotation = "kubescape.io/rescan"
+
+// rescanNonces tracks the last value of the rescan annotation seen for each WLID
+//
+// The zero value is ready to use
+type rescanNonces struct {
+	nonces map[string]string
+	mu     sync.Mutex
+}
+
+// Track records the nonce of the WLID if none is recorded yet, so that the
+// nonces found when the internal maps are built trigger no rescans
+func (r *rescanNonces) Track(wlid, nonce string) {
+	if nonce == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.nonces[wlid]; ok {
+		return
+	}
+	if r.nonces == nil {
+		r.nonces = make(map[string]string)
+	}
+	r.nonces[wlid] = nonce
+}
+
+// Update records the nonce of the WLID, returning true if it is set and differs from the recorded one
+func (r *rescanNonces) Update(wlid, nonce string) bool {
+	if nonce == "" {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.nonces[wlid] == nonce {
+		return false
+	}
+	if r.nonces == nil {
+		r.nonces = make(map[string]string)
+	}
+	r.nonces[wlid] = nonce
+	return true
+}
+
+// Retain forgets the nonces of the WLIDs not in wlids
+func (r *rescanNonces) Retain(wlids WlidsToContainerToImageIDMap) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for wlid := range r.nonces {
+		if _, ok := wlids[wlid]; !ok {
+			delete(r.nonces, wlid)
+		}
+	}
+}
+
+// getRescanNonce returns the value of the rescan annotation of the Pod, or else of its top-level parent
+func (wh *WatchHandler) getRescanNonce(ctx context.Context, wlid string, pod *core1.Pod) string {
+	if nonce := pod.GetAnnotations()[rescanAnnotation]; nonce != "" {
+		return nonce
+	}
+	return wh.getParentAnnotations(ctx, wlid, pod)[rescanAnnotation]
+}
@@ -0,0 +1,143 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+
+	"github.com/armosec/armoapi-go/apis"
+	"github.com/kubescape/operator/utils"
+	"github.com/stretchr/testify/assert"
+	core1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestRescanNonces(t *testing.T) {
+	var nonces rescanNonces
+
+	assert.False(t, nonces.Update("wlid", ""), "a missing annotation should not trigger a rescan")
+	nonces.Track("wlid", "1")
+	nonces.Track("wlid", "2")
+	assert.False(t, nonces.Update("wlid", "1"), "the first tracked nonce should be kept")
+	assert.True(t, nonces.Update("wlid", "2"))
+	assert.False(t, nonces.Update("wlid", "2"))
+	assert.False(t, nonces.Update("wlid", ""), "removing the annotation should not trigger a rescan")
+	assert.False(t, nonces.Update("wlid", "2"))
+
+	nonces.Retain(WlidsToContainerToImageIDMap{})
+	assert.True(t, nonces.Update("wlid", "2"), "the nonces of forgotten workloads should trigger a rescan")
+}
+
+// handlePodEvents modifies the Pods in turn and returns the commands produced by the Pod watcher
+//
+// The watch ends after a bookmark, so that it is resumed without relisting
+// the Pods, see updateResourceVersion
+func handlePodEvents(ctx context.Context, wh *WatchHandler, pods ...*core1.Pod) []*apis.Command {
+	recorder := &commandRecorder{}
+	podsWatch := watch.NewFake()
+	done := make(chan struct{})
+	go func() {
+		wh.handlePodWatcher(ctx, podsWatch, newCommandDeduper(0, recorder.emit))
+		close(done)
+	}()
+	for _, pod := range pods {
+		podsWatch.Modify(pod)
+	}
+	podsWatch.Action(watch.Bookmark, &core1.Pod{ObjectMeta: v1.ObjectMeta{ResourceVersion: "bookmark"}})
+	podsWatch.Stop()
+	<-done
+	return recorder.emitted()
+}
+
+func TestRescanAnnotation(t *testing.T) {
+	wlid := "wlid://cluster-/namespace-default/pod-nginx"
+	containerToImageID := map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240", "sidecar": "sidecar@sha256:4bcfcc21e91d770550fb013ef4dd93aa96a04772b013b7012b851e4b89f27f07"}
+
+	tt := []struct {
+		name               string
+		trackedAnnotations map[string]string
+		annotations        []map[string]string
+		expectedCommands   int
+	}{
+		{
+			name:             "No annotation",
+			annotations:      []map[string]string{nil},
+			expectedCommands: 0,
+		},
+		{
+			name:             "First-time annotation",
+			annotations:      []map[string]string{{rescanAnnotation: "1"}},
+			expectedCommands: 1,
+		},
+		{
+			name:               "Value change",
+			trackedAnnotations: map[string]string{rescanAnnotation: "1"},
+			annotations:        []map[string]string{{rescanAnnotation: "2"}},
+			expectedCommands:   1,
+		},
+		{
+			name:               "Unchanged value",
+			trackedAnnotations: map[string]string{rescanAnnotation: "1"},
+			annotations:        []map[string]string{{rescanAnnotation: "1"}},
+			expectedCommands:   0,
+		},
+		{
+			name:             "Repeated events with the same value",
+			annotations:      []map[string]string{{rescanAnnotation: "1"}, {rescanAnnotation: "1"}, {rescanAnnotation: "1"}},
+			expectedCommands: 1,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.TODO()
+			pod := newRunningPodFake("default", "nginx", containerToImageID)
+			pod.Annotations = tc.trackedAnnotations
+
+			wh := NewWatchHandlerMock()
+			wh.k8sAPI, _ = newK8sAPIFake(pod)
+			assert.NoError(t, wh.buildIDs(ctx, podListIterator(&core1.PodList{Items: []core1.Pod{*pod}})))
+
+			var pods []*core1.Pod
+			for _, annotations := range tc.annotations {
+				updated := pod.DeepCopy()
+				updated.Annotations = annotations
+				pods = append(pods, updated)
+			}
+
+			emitted := handlePodEvents(ctx, wh, pods...)
+			if assert.Len(t, emitted, tc.expectedCommands) {
+				for _, cmd := range emitted {
+					assert.Equal(t, wlid, cmd.Wlid)
+					assert.Equal(t, containerToImageID, cmd.Args[utils.ContainerToImageIdsArg], "all the containers of the workload should be scanned")
+				}
+			}
+		})
+	}
+}
+
+func TestRescanAnnotationOnParent(t *testing.T) {
+	ctx := context.TODO()
+	wlid := "wlid://cluster-/namespace-default/deployment-nginx"
+	deployment, replicaSet, pod := newDeploymentFake("nginx", nil)
+
+	k8sAPI, _ := newK8sAPIFake(deployment, replicaSet, pod)
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	wh.parentAnnotations = &parentAnnotationCache{}
+
+	assert.NoError(t, wh.buildIDs(ctx, podListIterator(&core1.PodList{Items: []core1.Pod{*pod}})))
+	assert.Empty(t, handlePodEvents(ctx, wh, pod.DeepCopy()))
+
+	// the annotation of the Deployment is seen once its annotations are fetched again
+	annotatedDeployment := deployment.DeepCopy()
+	annotatedDeployment.Annotations = map[string]string{rescanAnnotation: "2026-10-14T00:00:00Z"}
+	wh.k8sAPI, _ = newK8sAPIFake(annotatedDeployment, replicaSet, pod)
+	wh.parentAnnotations.Reset()
+
+	emitted := handlePodEvents(ctx, wh, pod.DeepCopy(), pod.DeepCopy())
+	if assert.Len(t, emitted, 1) {
+		assert.Equal(t, wlid, emitted[0].Wlid)
+		assert.Equal(t, map[string]string{"nginx": "nginx@" + testDigest("nginx")}, emitted[0].Args[utils.ContainerToImageIdsArg])
+	}
+}
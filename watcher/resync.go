@@ -0,0 +1,43 @@
+package watcher
+
+import (
+	"context"
+	"time"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	"github.com/kubescape/operator/utils"
+)
+
+// metricResyncScansTriggeredTotal is the number of scans re-triggered by the resyncs
+const metricResyncScansTriggeredTotal = "operator_resync_scans_triggered_total"
+
+// ResyncWatch periodically re-triggers the scans of every tracked workload, see WithResyncPeriod
+//
+// Scan results lost downstream, e.g. because of a transient failure of the
+// backend, are eventually retried. It does nothing unless a resync period is
+// set, and returns once the context is done.
+func (wh *WatchHandler) ResyncWatch(ctx context.Context, sink utils.CommandSink) {
+	if wh.resyncPeriod <= 0 {
+		return
+	}
+
+	logger.L().Ctx(ctx).Debug("starting resync", helpers.String("period", wh.resyncPeriod.String()))
+	ticker := time.NewTicker(wh.resyncPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			wh.resync(ctx, sink)
+		}
+	}
+}
+
+// resync re-triggers the scans of every tracked workload
+func (wh *WatchHandler) resync(ctx context.Context, sink utils.CommandSink) {
+	wlids, triggered := wh.scanTrackedWorkloads(ctx, sink, utils.ScanScopeVulnerability)
+	wh.metrics.Add(metricResyncScansTriggeredTotal, int64(triggered))
+	logger.L().Ctx(ctx).Info("resynced the scans of the tracked workloads", helpers.Int("wlids", wlids), helpers.Int("triggered", triggered))
+}
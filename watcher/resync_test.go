@@ -0,0 +1,75 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/armosec/armoapi-go/apis"
+	"github.com/kubescape/operator/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResyncWatch(t *testing.T) {
+	nginxWlid := "wlid://cluster-/namespace-default/deployment-nginx"
+	redisWlid := "wlid://cluster-/namespace-default/deployment-redis"
+	newWatchHandler := func(opts ...WatchHandlerOption) *WatchHandler {
+		wh := NewWatchHandlerMock()
+		for _, opt := range opts {
+			opt(wh)
+		}
+		wh.addToWlidsToContainerToImageIDMap(nginxWlid, "nginx", "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240")
+		wh.addToWlidsToContainerToImageIDMap(redisWlid, "redis", "redis@sha256:328695eff5583aa7bc95f9dd456106461d588df5bffc296107964fe27ee0e083")
+		return wh
+	}
+
+	t.Run("disabled by default", func(t *testing.T) {
+		done := make(chan struct{})
+		go func() {
+			newWatchHandler().ResyncWatch(context.TODO(), &commandRecorder{})
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("the resync should return right away when disabled")
+		}
+	})
+
+	t.Run("re-triggers the scans of every tracked WLID", func(t *testing.T) {
+		wh := newWatchHandler(WithResyncPeriod(10 * time.Millisecond))
+		rec := &commandRecorder{}
+		ctx, cancel := context.WithCancel(context.TODO())
+		done := make(chan struct{})
+		go func() {
+			wh.ResyncWatch(ctx, rec)
+			close(done)
+		}()
+
+		assert.Eventually(t, func() bool { return len(rec.emitted()) >= 4 }, time.Second, 5*time.Millisecond, "every resync should scan every WLID")
+		cancel()
+		<-done
+
+		wlids := map[string]int{}
+		for _, cmd := range rec.emitted() {
+			assert.Equal(t, apis.TypeScanImages, cmd.CommandName)
+			assert.Equal(t, utils.ScanScopeVulnerability, cmd.Args[utils.ScanScopeArg])
+			assert.Equal(t, wh.GetContainerToImageIDForWlid(cmd.Wlid), cmd.Args[utils.ContainerToImageIdsArg])
+			wlids[cmd.Wlid]++
+		}
+		assert.GreaterOrEqual(t, wlids[nginxWlid], 2)
+		assert.GreaterOrEqual(t, wlids[redisWlid], 2)
+		assert.Equal(t, int64(len(rec.emitted())), wh.metrics.Get(metricResyncScansTriggeredTotal))
+	})
+
+	t.Run("respects the command rate limit", func(t *testing.T) {
+		wh := newWatchHandler(WithCommandRateLimit(1, 1))
+		rec := &commandRecorder{}
+		ctx, cancel := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+		defer cancel()
+
+		// the burst lets the first command through, the second waits for longer than the context lasts
+		wh.resync(ctx, rec)
+		assert.Len(t, rec.emitted(), 1)
+	})
+}
@@ -0,0 +1,136 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// deletionDueAnnotation is the RFC 3339 time an orphaned Vulnerability Manifest is due for deletion at, see WithVulnerabilityManifestRetention
+const deletionDueAnnotation = "kubescape.io/deletion-due"
+
+// vulnerabilityManifestDue returns true if an orphaned Vulnerability Manifest is to be handled according to the deletion policy of its kind now, see handleOrphan
+//
+// It is the deletion policy of the watcher, the initial reconcile and the
+// cleanUp alike. Manifests left to the garbage collector never are. With the
+// delete policy, they are once due, see dueForDeletion, so right away without
+// retention. The other policies apply right away.
+func (wh *WatchHandler) vulnerabilityManifestDue(ctx context.Context, manifest *spdxv1beta1.VulnerabilityManifest, reason string) (bool, error) {
+	if wh.leftToGarbageCollector(manifest) {
+		return false, nil
+	}
+	if wh.deletionPolicy(vulnerabilityManifestKind) != DeletionPolicyDelete {
+		return true, nil
+	}
+	return wh.dueForDeletion(ctx, manifest, reason)
+}
+
+// dueForDeletion returns true if an orphaned Vulnerability Manifest may be deleted, marking it with the time it is due at otherwise
+//
+// Manifests are due once retained for the retention duration after they
+// were first found orphaned. Without retention, they are due right away.
+func (wh *WatchHandler) dueForDeletion(ctx context.Context, manifest *spdxv1beta1.VulnerabilityManifest, reason string) (bool, error) {
+	if wh.vulnerabilityManifestRetention <= 0 {
+		return true, nil
+	}
+
+	if due, ok := manifest.Annotations[deletionDueAnnotation]; ok {
+		dueAt, err := time.Parse(time.RFC3339, due)
+		if err == nil {
+			return !time.Now().Before(dueAt), nil
+		}
+		logger.L().Ctx(ctx).Warning("malformed deletion due time, marking the Vulnerability Manifest again",
+			helpers.String("namespace", manifest.Namespace), helpers.String("name", manifest.Name), helpers.Error(err))
+	}
+
+	dueAt := time.Now().Add(wh.vulnerabilityManifestRetention).UTC().Format(time.RFC3339)
+	details := append(deletionDetails(vulnerabilityManifestKind, manifest.Namespace, manifest.Name, reason), helpers.String("dueAt", dueAt))
+	if wh.dryRun {
+		logger.L().Ctx(ctx).Info("dry run: would retain orphaned storage object until due", details...)
+		return false, nil
+	}
+	logger.L().Ctx(ctx).Debug("retaining orphaned storage object until due", details...)
+	return false, wh.annotateVulnerabilityManifest(ctx, manifest, &dueAt)
+}
+
+// unmarkVulnerabilityManifest removes the deletion due time of a Vulnerability Manifest that is tracked again, if it has one
+func (wh *WatchHandler) unmarkVulnerabilityManifest(ctx context.Context, manifest *spdxv1beta1.VulnerabilityManifest) error {
+	if _, ok := manifest.Annotations[deletionDueAnnotation]; !ok || wh.dryRun {
+		return nil
+	}
+
+	logger.L().Ctx(ctx).Debug("storage object tracked again, not deleting it anymore",
+		helpers.String("kind", vulnerabilityManifestKind), helpers.String("namespace", manifest.Namespace), helpers.String("name", manifest.Name))
+	return wh.annotateVulnerabilityManifest(ctx, manifest, nil)
+}
+
+// annotateVulnerabilityManifest sets the deletion due time of a Vulnerability Manifest, removing it if nil
+func (wh *WatchHandler) annotateVulnerabilityManifest(ctx context.Context, manifest *spdxv1beta1.VulnerabilityManifest, dueAt *string) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]*string{deletionDueAnnotation: dueAt},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	requestCtx, cancel := wh.storageRequestContext(ctx)
+	defer cancel()
+	if err := wh.patchVulnerabilityManifest(requestCtx, manifest.Namespace, manifest.Name, data); err != nil && !k8serrors.IsNotFound(err) {
+		return fmt.Errorf("failed to set the deletion due time of %s %s/%s: %w", vulnerabilityManifestKind, manifest.Namespace, manifest.Name, err)
+	}
+	return nil
+}
+
+// addExpiredVulnerabilityManifests lists the Vulnerability Manifests and adds the deletions of the orphaned ones that are due to the batch, see vulnerabilityManifestDue
+//
+// The orphaned manifests that are not marked yet are marked, and the ones
+// tracked again are unmarked.
+func (wh *WatchHandler) addExpiredVulnerabilityManifests(ctx context.Context, batch *deletionBatch) {
+	listCtx, cancel := wh.storageRequestContext(ctx)
+	manifests, err := wh.storageClient.SpdxV1beta1().VulnerabilityManifests("").List(listCtx, v1.ListOptions{})
+	cancel()
+	if err != nil {
+		logger.L().Ctx(ctx).Error("failed to list Vulnerability Manifests for cleanup", helpers.Error(err))
+		return
+	}
+
+	for i := range manifests.Items {
+		manifest := &manifests.Items[i]
+		if isRegistryScanManifest(manifest) {
+			continue
+		}
+		orphaned, reason := wh.vulnerabilityManifestOrphanCheck(manifest)
+		if !orphaned {
+			if err := wh.unmarkVulnerabilityManifest(ctx, manifest); err != nil {
+				logger.L().Ctx(ctx).Error("failed to unmark Vulnerability Manifest", helpers.Error(err))
+			}
+			continue
+		}
+		wh.addDueVulnerabilityManifest(ctx, batch, manifest, reason)
+	}
+}
+
+// addDueVulnerabilityManifest adds the deletion of an orphaned Vulnerability Manifest to the batch if it is due, see vulnerabilityManifestDue
+func (wh *WatchHandler) addDueVulnerabilityManifest(ctx context.Context, batch *deletionBatch, manifest *spdxv1beta1.VulnerabilityManifest, reason string) {
+	due, err := wh.vulnerabilityManifestDue(ctx, manifest, reason)
+	if err != nil {
+		logger.L().Ctx(ctx).Error("failed to mark Vulnerability Manifest", helpers.Error(err))
+		return
+	}
+	if !due {
+		return
+	}
+	wh.addOrphan(batch, vulnerabilityManifestKind, manifest, reason, func() bool {
+		orphaned, _ := wh.vulnerabilityManifestOrphanCheck(manifest)
+		return orphaned
+	}, wh.deleteVulnerabilityManifest(manifest), wh.patchVulnerabilityManifest)
+}
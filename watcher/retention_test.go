@@ -0,0 +1,201 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// vulnerabilityManifestDueAt returns a Vulnerability Manifest of the given image ID, due for deletion at the given time unless zero
+func vulnerabilityManifestDueAt(imageID string, dueAt time.Time) *spdxv1beta1.VulnerabilityManifest {
+	manifest := &spdxv1beta1.VulnerabilityManifest{ObjectMeta: v1.ObjectMeta{Name: imageID, Namespace: "kubescape", Labels: managedLabels()}}
+	if !dueAt.IsZero() {
+		manifest.Annotations = map[string]string{deletionDueAnnotation: dueAt.UTC().Format(time.RFC3339)}
+	}
+	return manifest
+}
+
+func TestHandleVulnerabilityManifestEventWithRetention(t *testing.T) {
+	ctx := context.TODO()
+	trackedImageID := "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"
+	untrackedImageID := "nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432"
+
+	tt := []struct {
+		name            string
+		retention       time.Duration
+		manifest        *spdxv1beta1.VulnerabilityManifest
+		expectedMarked  bool
+		expectedDeleted bool
+	}{
+		{
+			name:           "orphaned manifests are marked once",
+			retention:      24 * time.Hour,
+			manifest:       vulnerabilityManifestDueAt(untrackedImageID, time.Time{}),
+			expectedMarked: true,
+		},
+		{
+			name:      "tracked manifests are unmarked",
+			retention: 24 * time.Hour,
+			manifest:  vulnerabilityManifestDueAt(trackedImageID, time.Now().Add(time.Hour)),
+		},
+		{
+			name:            "orphaned manifests are deleted right away without retention",
+			manifest:        vulnerabilityManifestDueAt(untrackedImageID, time.Time{}),
+			expectedDeleted: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			k8sAPI, _ := newK8sAPIFake()
+			storageClient := kssfake.NewSimpleClientset(tc.manifest.DeepCopy())
+			wh, err := NewWatchHandler(k8sAPI, storageClient, map[string][]string{trackedImageID: {"wlid-01"}}, nil,
+				WithVulnerabilityManifestRetention(tc.retention))
+			assert.NoError(t, err)
+			handle := func(manifest *spdxv1beta1.VulnerabilityManifest) {
+				wh.handleVulnerabilityManifestEvent(ctx, watch.Event{Type: watch.Modified, Object: manifest}, func(err error) {
+					assert.NoError(t, err)
+				})
+			}
+
+			handle(tc.manifest.DeepCopy())
+			manifest, err := storageClient.SpdxV1beta1().VulnerabilityManifests("kubescape").Get(ctx, tc.manifest.Name, v1.GetOptions{})
+			if tc.expectedDeleted {
+				assert.True(t, k8serrors.IsNotFound(err), "orphaned manifests should be deleted")
+				assert.Zero(t, patchActions(storageClient))
+				return
+			}
+			assert.NoError(t, err, "the manifests should be retained")
+			if !tc.expectedMarked {
+				assert.NotContains(t, manifest.Annotations, deletionDueAnnotation)
+				return
+			}
+			dueAt, err := time.Parse(time.RFC3339, manifest.Annotations[deletionDueAnnotation])
+			assert.NoError(t, err)
+			assert.WithinDuration(t, time.Now().Add(tc.retention), dueAt, time.Minute)
+
+			// the event of the mark should not mark it again
+			patches := patchActions(storageClient)
+			handle(manifest)
+			assert.Equal(t, patches, patchActions(storageClient))
+		})
+	}
+}
+
+func TestReclaimOrphansWithRetention(t *testing.T) {
+	ctx := context.TODO()
+	trackedImageID := "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"
+	now := time.Now()
+	objects := []runtime.Object{
+		vulnerabilityManifestDueAt("redis@sha256:328695eff5583aa7bc95f9dd456106461d588df5bffc296107964fe27ee0e083", now.Add(-time.Minute)),
+		vulnerabilityManifestDueAt("redis@sha256:fb65e6bddd69e47c37aeb0ee4870a366ab82df135c3324a3a74b89c555e7d94b", now.Add(time.Hour)),
+		vulnerabilityManifestDueAt("redis@sha256:a1b75389c4fdc1563535ac060c039d33e22270641552b3565a4801d06f7cb246", time.Time{}),
+		// the workload was recreated with the same image before the manifest was due
+		vulnerabilityManifestDueAt(trackedImageID, now.Add(time.Hour)),
+	}
+
+	t.Run("manifests are deleted once due", func(t *testing.T) {
+		k8sAPI, _ := newK8sAPIFake()
+		storageClient := kssfake.NewSimpleClientset(objects...)
+		wh, err := NewWatchHandler(k8sAPI, storageClient, map[string][]string{trackedImageID: {"wlid-01"}}, nil,
+			WithVulnerabilityManifestRetention(24*time.Hour))
+		assert.NoError(t, err)
+		wh.reclaimOrphans(ctx)
+
+		manifests, err := storageClient.SpdxV1beta1().VulnerabilityManifests("kubescape").List(ctx, v1.ListOptions{})
+		assert.NoError(t, err)
+		annotations := map[string]string{}
+		for i := range manifests.Items {
+			annotations[manifests.Items[i].Name] = manifests.Items[i].Annotations[deletionDueAnnotation]
+		}
+		assert.NotContains(t, annotations, "redis@sha256:328695eff5583aa7bc95f9dd456106461d588df5bffc296107964fe27ee0e083", "manifests past their retention should be deleted")
+		assert.Equal(t, now.Add(time.Hour).UTC().Format(time.RFC3339), annotations["redis@sha256:fb65e6bddd69e47c37aeb0ee4870a366ab82df135c3324a3a74b89c555e7d94b"], "manifests not due yet should be kept as is")
+		assert.NotEmpty(t, annotations["redis@sha256:a1b75389c4fdc1563535ac060c039d33e22270641552b3565a4801d06f7cb246"], "unmarked orphaned manifests should be marked")
+		assert.Contains(t, annotations, trackedImageID)
+		assert.Empty(t, annotations[trackedImageID], "manifests tracked again should be unmarked")
+	})
+
+	t.Run("orphaned manifests are reclaimed right away without retention", func(t *testing.T) {
+		k8sAPI, _ := newK8sAPIFake()
+		storageClient := kssfake.NewSimpleClientset(objects...)
+		wh, err := NewWatchHandler(k8sAPI, storageClient, map[string][]string{trackedImageID: {"wlid-01"}}, nil,
+			WithVulnerabilityManifestRetention(0))
+		assert.NoError(t, err)
+		wh.reclaimOrphans(ctx)
+
+		manifests, err := storageClient.SpdxV1beta1().VulnerabilityManifests("kubescape").List(ctx, v1.ListOptions{})
+		assert.NoError(t, err)
+		if assert.Len(t, manifests.Items, 1, "only the tracked manifest should be kept") {
+			assert.Equal(t, trackedImageID, manifests.Items[0].Name)
+			assert.NotContains(t, manifests.Items[0].Annotations, deletionDueAnnotation, "manifests tracked again should be unmarked")
+		}
+	})
+}
+
+func TestReconcileOnStartupWithRetention(t *testing.T) {
+	ctx := context.TODO()
+	trackedImageID := "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"
+
+	tt := []struct {
+		name      string
+		retention time.Duration
+		objects   []runtime.Object
+		// expectedManifests are the manifests left, and whether they are marked
+		expectedManifests map[string]bool
+		expectedDeleted   int64
+	}{
+		{
+			name:      "only the manifests past their retention are deleted",
+			retention: 24 * time.Hour,
+			objects: []runtime.Object{
+				vulnerabilityManifestDueAt("redis@sha256:328695eff5583aa7bc95f9dd456106461d588df5bffc296107964fe27ee0e083", time.Now().Add(-time.Minute)),
+				vulnerabilityManifestDueAt("redis@sha256:fb65e6bddd69e47c37aeb0ee4870a366ab82df135c3324a3a74b89c555e7d94b", time.Time{}),
+			},
+			expectedManifests: map[string]bool{"redis@sha256:fb65e6bddd69e47c37aeb0ee4870a366ab82df135c3324a3a74b89c555e7d94b": true},
+			expectedDeleted:   1,
+		},
+		{
+			name: "the orphaned manifests are deleted right away without retention, marked or not",
+			objects: []runtime.Object{
+				vulnerabilityManifestDueAt(trackedImageID, time.Time{}),
+				vulnerabilityManifestDueAt("redis@sha256:328695eff5583aa7bc95f9dd456106461d588df5bffc296107964fe27ee0e083", time.Now().Add(time.Hour)),
+				vulnerabilityManifestDueAt("redis@sha256:fb65e6bddd69e47c37aeb0ee4870a366ab82df135c3324a3a74b89c555e7d94b", time.Time{}),
+			},
+			expectedManifests: map[string]bool{trackedImageID: false},
+			expectedDeleted:   2,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			k8sAPI, _ := newK8sAPIFake()
+			storageClient := kssfake.NewSimpleClientset(tc.objects...)
+			wh, err := NewWatchHandler(k8sAPI, storageClient, map[string][]string{trackedImageID: {"wlid-01"}}, nil,
+				WithVulnerabilityManifestRetention(tc.retention))
+			assert.NoError(t, err)
+			wh.idsBuilt.Store(true)
+			assert.NoError(t, wh.reconcileOnStartup(ctx))
+
+			manifests, err := storageClient.SpdxV1beta1().VulnerabilityManifests("kubescape").List(ctx, v1.ListOptions{})
+			assert.NoError(t, err)
+			left := map[string]bool{}
+			for i := range manifests.Items {
+				_, marked := manifests.Items[i].Annotations[deletionDueAnnotation]
+				left[manifests.Items[i].Name] = marked
+			}
+			assert.Equal(t, tc.expectedManifests, left)
+			if tc.retention <= 0 {
+				assert.Zero(t, patchActions(storageClient))
+			}
+			assert.Equal(t, tc.expectedDeleted, wh.metrics.Get(metricReconciledVulnerabilityManifestsDeletedTotal))
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	"github.com/kubescape/operator/utils"
+)
+
+// WatchKind is a kind of resources watched by the watch handler, see Run
+type WatchKind string
+
+const (
+	// WatchKindPods watches the Pods and triggers the scans of their workloads, see PodWatch
+	WatchKindPods WatchKind = "Pods"
+	// WatchKindControllers watches the workload controllers and triggers provisional scans of their Pod templates, see ControllerWatch
+	WatchKindControllers WatchKind = "Controllers"
+	// WatchKindSBOMs watches the SBOMs of every kind and deletes the orphaned ones, see StartSBOMWatchers
+	WatchKindSBOMs WatchKind = "SBOMs"
+	// WatchKindVulnerabilityManifests watches the Vulnerability Manifests and deletes the orphaned ones, see VulnerabilityManifestWatch
+	WatchKindVulnerabilityManifests WatchKind = "VulnerabilityManifests"
+	// WatchKindResync periodically re-triggers the scans of every tracked workload, see ResyncWatch
+	WatchKindResync WatchKind = "Resync"
+)
+
+// WatchKinds are the kinds of resources watched by Run unless given others
+var WatchKinds = []WatchKind{WatchKindPods, WatchKindControllers, WatchKindSBOMs, WatchKindVulnerabilityManifests, WatchKindResync}
+
+// ParseWatchKinds returns the watch kinds of the given names, matched case-insensitively
+func ParseWatchKinds(names []string) ([]WatchKind, error) {
+	kinds := make([]WatchKind, 0, len(names))
+	for _, name := range names {
+		kind, ok := parseWatchKind(strings.TrimSpace(name))
+		if !ok {
+			return nil, fmt.Errorf("unknown watch kind %q, expected one of %s", name, joinWatchKinds(WatchKinds))
+		}
+		kinds = append(kinds, kind)
+	}
+	return kinds, nil
+}
+
+func parseWatchKind(name string) (WatchKind, bool) {
+	for _, kind := range WatchKinds {
+		if strings.EqualFold(name, string(kind)) {
+			return kind, true
+		}
+	}
+	return "", false
+}
+
+func joinWatchKinds(kinds []WatchKind) string {
+	names := make([]string, 0, len(kinds))
+	for _, kind := range kinds {
+		names = append(names, string(kind))
+	}
+	return strings.Join(names, ", ")
+}
+
+// Run runs the watchers of the given kinds, every kind of WatchKinds if none is given, until the context is done
+//
+// Each watcher reconnects independently of the others. If one of them fails
+// for good, e.g. the pod watch once the Pods failed to be relisted too many
+// times, the others are stopped and the errors of the failed watchers are
+// returned, each wrapped in a WatchError. It returns nil once the context is
+// done otherwise. The handler must be started first, see Start.
+func (wh *WatchHandler) Run(ctx context.Context, sink utils.CommandSink, kinds ...WatchKind) error {
+	if len(kinds) == 0 {
+		kinds = WatchKinds
+	}
+	watchers := make(map[WatchKind]func(ctx context.Context) error, len(kinds))
+	for _, kind := range kinds {
+		watch, err := wh.watcherOf(kind, sink)
+		if err != nil {
+			return err
+		}
+		watchers[kind] = watch
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	logger.L().Ctx(ctx).Info("starting watchers", helpers.String("kinds", joinWatchKinds(kinds)))
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for _, watch := range watchers {
+		wg.Add(1)
+		go func(watch func(ctx context.Context) error) {
+			defer wg.Done()
+			if err := watch(ctx); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+				cancel()
+			}
+		}(watch)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// watcherOf returns the watcher of the given kind, which blocks until the context is done or it fails for good
+func (wh *WatchHandler) watcherOf(kind WatchKind, sink utils.CommandSink) (func(ctx context.Context) error, error) {
+	switch kind {
+	case WatchKindPods:
+		return func(ctx context.Context) error {
+			if err := wh.PodWatch(ctx, sink); err != nil {
+				return &WatchError{Watcher: PodWatcherName, Err: err}
+			}
+			return nil
+		}, nil
+	case WatchKindControllers:
+		return func(ctx context.Context) error {
+			wh.ControllerWatch(ctx, sink)
+			return nil
+		}, nil
+	case WatchKindSBOMs:
+		return func(ctx context.Context) error {
+			wh.StartSBOMWatchers(ctx, sink)
+			<-ctx.Done()
+			return nil
+		}, nil
+	case WatchKindVulnerabilityManifests:
+		return func(ctx context.Context) error {
+			wh.VulnerabilityManifestWatch(ctx)
+			return nil
+		}, nil
+	case WatchKindResync:
+		return func(ctx context.Context) error {
+			wh.ResyncWatch(ctx, sink)
+			return nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown watch kind %q, expected one of %s", kind, joinWatchKinds(WatchKinds))
+	}
+}
@@ -0,0 +1,85 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestParseWatchKinds(t *testing.T) {
+	kinds, err := ParseWatchKinds([]string{"pods", " SBOMs", "VulnerabilityManifests"})
+	assert.NoError(t, err)
+	assert.Equal(t, []WatchKind{WatchKindPods, WatchKindSBOMs, WatchKindVulnerabilityManifests}, kinds)
+
+	_, err = ParseWatchKinds([]string{"Pods", "Nodes"})
+	assert.Error(t, err)
+}
+
+func TestRun(t *testing.T) {
+	// watchedResources returns the resources watched by the watch handler until the context is done
+	watchedResources := func(k8sClient *k8stesting.Fake, storageClient *kssfake.Clientset) map[string]bool {
+		resources := map[string]bool{}
+		for _, actions := range [][]k8stesting.Action{k8sClient.Actions(), storageClient.Actions()} {
+			for _, action := range actions {
+				if action.GetVerb() == "watch" {
+					resources[action.GetResource().Resource] = true
+				}
+			}
+		}
+		return resources
+	}
+
+	t.Run("only the watchers of the given kinds are run", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		k8sAPI, k8sClient := newK8sAPIFake()
+		storageClient := kssfake.NewSimpleClientset()
+		wh, err := NewWatchHandler(k8sAPI, storageClient, nil, nil)
+		assert.NoError(t, err)
+
+		assert.NoError(t, wh.Run(ctx, &commandRecorder{}, WatchKindSBOMs))
+		resources := watchedResources(&k8sClient.Fake, storageClient)
+		assert.True(t, resources["sbomsummaries"])
+		assert.True(t, resources["sbomspdxv2p3filtereds"])
+		assert.False(t, resources["pods"], "the pods should not be watched")
+		assert.False(t, resources["vulnerabilitymanifests"], "the vulnerability manifests should not be watched")
+	})
+
+	t.Run("unknown kinds are not run", func(t *testing.T) {
+		wh := NewWatchHandlerMock()
+		assert.Error(t, wh.Run(context.Background(), &commandRecorder{}, WatchKindPods, "Nodes"))
+	})
+
+	t.Run("a watcher failing for good stops the others", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		k8sAPI, k8sClient := newK8sAPIFake()
+		k8sClient.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, errors.New("list failed")
+		})
+		k8sClient.PrependWatchReactor("pods", func(action k8stesting.Action) (bool, watch.Interface, error) {
+			fakeWatcher := watch.NewFake()
+			fakeWatcher.Stop()
+			return true, fakeWatcher, nil
+		})
+		wh, err := NewWatchHandler(k8sAPI, kssfake.NewSimpleClientset(), nil, nil)
+		assert.NoError(t, err)
+		wh.setPodListResourceVersion("42")
+		wh.podRelistMaxFailures = 1
+
+		err = wh.Run(ctx, &commandRecorder{}, WatchKindPods, WatchKindVulnerabilityManifests)
+		assert.ErrorIs(t, err, ErrPodRelistFailed)
+		var watchErr *WatchError
+		if assert.ErrorAs(t, err, &watchErr) {
+			assert.Equal(t, PodWatcherName, watchErr.Watcher)
+		}
+		assert.NoError(t, ctx.Err(), "the other watchers should be stopped once the pod watch failed")
+	})
+}
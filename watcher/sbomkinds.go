@@ -0,0 +1,531 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/armosec/armoapi-go/apis"
+	pkgwlid "github.com/armosec/utils-k8s-go/wlid"
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	instanceidhandlerv1 "github.com/kubescape/k8s-interface/instanceidhandler/v1"
+	"github.com/kubescape/operator/utils"
+	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// sbomObject is the part of an SBOM object the watchers rely on, common to all SBOM kinds
+type sbomObject interface {
+	GetName() string
+	GetNamespace() string
+	GetAnnotations() map[string]string
+	GetCreationTimestamp() v1.Time
+	GetOwnerReferences() []v1.OwnerReference
+	GetLabels() map[string]string
+}
+
+// sbomKind describes an SBOM CRD kind that the operator watches and garbage-collects
+type sbomKind struct {
+	// kind is the name of the CRD kind, also identifying its watcher for settling
+	kind string
+	// watcherName is the name of the watcher reported with its errors
+	watcherName string
+	// filtered is set for kinds filtered by relevancy. Their objects are
+	// identified by instance ID and trigger scans of their workload, while
+	// objects of other kinds are identified by image ID
+	filtered bool
+	// fromObject returns the SBOM object of an event, false if it is not of this kind
+	fromObject func(obj runtime.Object) (sbomObject, bool)
+	// watch watches the objects of this kind from the given resource version, the most recent one if empty
+	watch func(wh *WatchHandler, ctx context.Context, resourceVersion string) (watch.Interface, error)
+	// list returns the objects of this kind along with the resource version to watch them from
+	list func(wh *WatchHandler, ctx context.Context) ([]sbomObject, string, error)
+	// delete deletes an object of this kind along with the objects stored together with it
+	delete func(wh *WatchHandler, ctx context.Context, namespace, name string) error
+	// patch merge-patches an object of this kind along with the objects stored together with it
+	patch func(wh *WatchHandler, ctx context.Context, namespace, name string, data []byte) error
+	// listNames returns the names of the objects of this kind, and of the objects stored together with them, matching a label selector in a namespace
+	listNames func(wh *WatchHandler, ctx context.Context, namespace, selector string) ([]string, error)
+	// deleteCollection deletes the objects of this kind, along with the objects stored together with them, matching a label selector in a namespace
+	deleteCollection func(wh *WatchHandler, ctx context.Context, namespace, selector string) error
+}
+
+var (
+	sbomSummaries = sbomKind{
+		kind:        sbomSummaryKind,
+		watcherName: SBOMWatcherName,
+		fromObject: func(obj runtime.Object) (sbomObject, bool) {
+			sbom, ok := obj.(*spdxv1beta1.SBOMSummary)
+			return sbom, ok
+		},
+		watch: (*WatchHandler).getSBOMWatcher,
+		list: func(wh *WatchHandler, ctx context.Context) ([]sbomObject, string, error) {
+			list, err := wh.storageClient.SpdxV1beta1().SBOMSummaries("").List(ctx, wh.storageWatchOptions(""))
+			if err != nil {
+				return nil, "", err
+			}
+			objects := make([]sbomObject, 0, len(list.Items))
+			for i := range list.Items {
+				objects = append(objects, &list.Items[i])
+			}
+			return objects, list.ResourceVersion, nil
+		},
+		delete: func(wh *WatchHandler, ctx context.Context, namespace, name string) error {
+			// summaries and SBOMs are stored together with the same name
+			err := wh.storageClient.SpdxV1beta1().SBOMSummaries(namespace).Delete(ctx, name, v1.DeleteOptions{})
+			if err != nil && !k8serrors.IsNotFound(err) {
+				return err
+			}
+			return wh.storageClient.SpdxV1beta1().SBOMSPDXv2p3s(namespace).Delete(ctx, name, v1.DeleteOptions{})
+		},
+		patch: func(wh *WatchHandler, ctx context.Context, namespace, name string, data []byte) error {
+			_, err := wh.storageClient.SpdxV1beta1().SBOMSummaries(namespace).Patch(ctx, name, types.MergePatchType, data, v1.PatchOptions{})
+			if err != nil && !k8serrors.IsNotFound(err) {
+				return err
+			}
+			_, err = wh.storageClient.SpdxV1beta1().SBOMSPDXv2p3s(namespace).Patch(ctx, name, types.MergePatchType, data, v1.PatchOptions{})
+			return err
+		},
+		listNames: func(wh *WatchHandler, ctx context.Context, namespace, selector string) ([]string, error) {
+			summaries, err := wh.storageClient.SpdxV1beta1().SBOMSummaries(namespace).List(ctx, v1.ListOptions{LabelSelector: selector})
+			if err != nil {
+				return nil, err
+			}
+			sboms, err := wh.storageClient.SpdxV1beta1().SBOMSPDXv2p3s(namespace).List(ctx, v1.ListOptions{LabelSelector: selector})
+			if err != nil {
+				return nil, err
+			}
+			names := make([]string, 0, len(summaries.Items)+len(sboms.Items))
+			for i := range summaries.Items {
+				names = append(names, summaries.Items[i].Name)
+			}
+			for i := range sboms.Items {
+				names = append(names, sboms.Items[i].Name)
+			}
+			return names, nil
+		},
+		deleteCollection: func(wh *WatchHandler, ctx context.Context, namespace, selector string) error {
+			listOptions := v1.ListOptions{LabelSelector: selector}
+			if err := wh.storageClient.SpdxV1beta1().SBOMSummaries(namespace).DeleteCollection(ctx, v1.DeleteOptions{}, listOptions); err != nil {
+				return err
+			}
+			return wh.storageClient.SpdxV1beta1().SBOMSPDXv2p3s(namespace).DeleteCollection(ctx, v1.DeleteOptions{}, listOptions)
+		},
+	}
+
+	sbomSPDXv2p3Filtereds = sbomKind{
+		kind:        sbomSPDXv2p3FilteredKind,
+		watcherName: SBOMFilteredWatcherName,
+		filtered:    true,
+		fromObject: func(obj runtime.Object) (sbomObject, bool) {
+			sbom, ok := obj.(*spdxv1beta1.SBOMSPDXv2p3Filtered)
+			return sbom, ok
+		},
+		watch: (*WatchHandler).getSBOMFilteredWatcher,
+		list: func(wh *WatchHandler, ctx context.Context) ([]sbomObject, string, error) {
+			list, err := wh.storageClient.SpdxV1beta1().SBOMSPDXv2p3Filtereds("").List(ctx, wh.storageWatchOptions(""))
+			if err != nil {
+				return nil, "", err
+			}
+			objects := make([]sbomObject, 0, len(list.Items))
+			for i := range list.Items {
+				objects = append(objects, &list.Items[i])
+			}
+			return objects, list.ResourceVersion, nil
+		},
+		delete: func(wh *WatchHandler, ctx context.Context, namespace, name string) error {
+			return wh.storageClient.SpdxV1beta1().SBOMSPDXv2p3Filtereds(namespace).Delete(ctx, name, v1.DeleteOptions{})
+		},
+		patch: func(wh *WatchHandler, ctx context.Context, namespace, name string, data []byte) error {
+			_, err := wh.storageClient.SpdxV1beta1().SBOMSPDXv2p3Filtereds(namespace).Patch(ctx, name, types.MergePatchType, data, v1.PatchOptions{})
+			return err
+		},
+		listNames: func(wh *WatchHandler, ctx context.Context, namespace, selector string) ([]string, error) {
+			list, err := wh.storageClient.SpdxV1beta1().SBOMSPDXv2p3Filtereds(namespace).List(ctx, v1.ListOptions{LabelSelector: selector})
+			if err != nil {
+				return nil, err
+			}
+			names := make([]string, 0, len(list.Items))
+			for i := range list.Items {
+				names = append(names, list.Items[i].Name)
+			}
+			return names, nil
+		},
+		deleteCollection: func(wh *WatchHandler, ctx context.Context, namespace, selector string) error {
+			return wh.storageClient.SpdxV1beta1().SBOMSPDXv2p3Filtereds(namespace).DeleteCollection(ctx, v1.DeleteOptions{}, v1.ListOptions{LabelSelector: selector})
+		},
+	}
+)
+
+// patchObject returns a function patching an object of this kind, see adoptStorageObject
+func (k sbomKind) patchObject(wh *WatchHandler) func(ctx context.Context, namespace, name string, data []byte) error {
+	return func(ctx context.Context, namespace, name string, data []byte) error {
+		return k.patch(wh, ctx, namespace, name, data)
+	}
+}
+
+// deleteObject returns a function deleting the given object of this kind
+func (k sbomKind) deleteObject(wh *WatchHandler, obj sbomObject) func(ctx context.Context) error {
+	namespace, name := obj.GetNamespace(), obj.GetName()
+	return func(ctx context.Context) error {
+		return k.delete(wh, ctx, namespace, name)
+	}
+}
+
+// sbomKinds are the SBOM kinds watched and garbage-collected by the operator
+//
+// While migrating between kinds, register both the old and the new kinds:
+// each is watched separately and deletes only its own objects, and objects
+// that are already gone are not considered errors.
+var sbomKinds = []sbomKind{sbomSummaries, sbomSPDXv2p3Filtereds}
+
+// StartSBOMWatchers starts a watcher for every registered SBOM kind
+//
+// Scan commands are deduplicated across kinds, so objects of several kinds
+// describing the same workload trigger a single scan. Each command is sent,
+// and its errors reported, on behalf of the watcher of its kind.
+func (wh *WatchHandler) StartSBOMWatchers(ctx context.Context, sink utils.CommandSink) {
+	commands := newCommandDeduper(wh.commandDedupWindow, nil)
+	for _, kind := range sbomKinds {
+		send := wh.sendTo(ctx, sink, kind.watcherName)
+		go wh.watchSBOMKind(ctx, kind, func(cmd *apis.Command) { commands.SubmitWith(cmd, send) })
+	}
+}
+
+// watchSBOMKind watches the objects of an SBOM kind and handles them accordingly
+func (wh *WatchHandler) watchSBOMKind(ctx context.Context, kind sbomKind, emit func(cmd *apis.Command)) {
+	report := func(err error) { wh.reportError(ctx, kind.watcherName, err) }
+	// the objects that exist before the first watch are reconciled once,
+	// later watches only report changes
+	reconciled := false
+	newWatcher := func() (watch.Interface, error) {
+		if reconciled {
+			return kind.watch(wh, ctx, "")
+		}
+		resourceVersion, err := wh.reconcileSBOMKind(ctx, kind, emit, report)
+		if err != nil {
+			report(fmt.Errorf("error to list %s: %w", kind.kind, err))
+			return nil, err
+		}
+		sbomsWatch, err := kind.watch(wh, ctx, resourceVersion)
+		reconciled = err == nil
+		return sbomsWatch, err
+	}
+	wh.runWatchRetry(ctx, kind.watcherName, newWatcher,
+		func(event watch.Event) { wh.handleSBOMKindEvent(ctx, kind, event, emit, report) },
+		// events after further connects are treated as possibly stale
+		func() { wh.settling.Start(kind.kind) })
+}
+
+// handleSBOMKindEvents handles the events of an SBOM kind
+//
+// Objects not known to the Operator are deleted. Known filtered SBOMs trigger
+// a scan of their workload.
+func (wh *WatchHandler) handleSBOMKindEvents(ctx context.Context, kind sbomKind, sbomEvents <-chan watch.Event, producedCommands chan<- *apis.Command, errorCh chan<- error) {
+	defer close(errorCh)
+	// the deletions report their errors on errorCh
+	defer wh.deletions.Wait()
+
+	emit := func(cmd *apis.Command) { producedCommands <- cmd }
+	report := func(err error) { errorCh <- err }
+	for event := range sbomEvents {
+		// the watch failed, the watch loop restarts it
+		if err := wh.watchStatusError(event); err != nil {
+			errorCh <- err
+			continue
+		}
+
+		wh.handleSBOMKindEvent(ctx, kind, event, emit, report)
+	}
+}
+
+// handleSBOMKindEvent handles an event of an SBOM kind, see handleSBOMKindEvents
+func (wh *WatchHandler) handleSBOMKindEvent(ctx context.Context, kind sbomKind, event watch.Event, emit func(cmd *apis.Command), report func(err error)) {
+	obj, ok := kind.fromObject(event.Object)
+	if !ok {
+		logger.L().Ctx(ctx).Error(
+			fmt.Sprintf(
+				`Unsupported object. Got: %v`,
+				event.Object,
+			),
+		)
+		report(ErrUnsupportedObject)
+		return
+	}
+
+	// Deleting an already deleted object makes no sense
+	if event.Type == watch.Deleted {
+		wh.sbomScans.Forget(kind, obj)
+		return
+	}
+
+	wh.handleSBOMObject(ctx, kind, event.Type, obj, emit, report)
+}
+
+// handleSBOMObject handles an added or modified object of an SBOM kind, see handleSBOMKindEvents
+func (wh *WatchHandler) handleSBOMObject(ctx context.Context, kind sbomKind, eventType watch.EventType, obj sbomObject, emit func(cmd *apis.Command), report func(err error)) {
+	if kind.filtered {
+		wh.handleFilteredSBOM(ctx, kind, obj, emit, report)
+	} else {
+		wh.handleSBOM(ctx, kind, eventType, obj, emit, report)
+	}
+}
+
+// reconcileSBOMKind handles the existing objects of an SBOM kind as if they were just added, returning the resource version to watch them from
+//
+// Objects created while the operator was down are deleted, or trigger scans,
+// before the watch starts, as the watch only reports later changes.
+func (wh *WatchHandler) reconcileSBOMKind(ctx context.Context, kind sbomKind, emit func(cmd *apis.Command), report func(err error)) (string, error) {
+	listCtx, cancel := wh.storageRequestContext(ctx)
+	objects, resourceVersion, err := kind.list(wh, listCtx)
+	cancel()
+	if err != nil {
+		return "", err
+	}
+
+	for _, obj := range objects {
+		wh.handleSBOMObject(ctx, kind, watch.Added, obj, emit, report)
+	}
+	logger.L().Ctx(ctx).Debug("reconciled the existing SBOMs", helpers.String("kind", kind.kind), helpers.Int("objects", len(objects)))
+	return resourceVersion, nil
+}
+
+// handleSBOM deletes an SBOM whose image ID is not known to the Operator along with its filtered SBOMs, or triggers the scans of the workloads of its image once it is created otherwise
+func (wh *WatchHandler) handleSBOM(ctx context.Context, kind sbomKind, eventType watch.EventType, obj sbomObject, emit func(cmd *apis.Command), report func(err error)) {
+	imageID, err := annotationsToImageID(obj.GetAnnotations())
+	if err != nil {
+		report(err)
+	}
+
+	// the SBOM may be named after another digest of a multi-arch image than the one its Pods report
+	imageIDs := sbomImageIDs(imageID, obj.GetAnnotations())
+	if wh.isImageIDTracked(imageIDs...) {
+		wh.pendingDeletions.Forget(orphanKey(kind.kind, obj))
+		// owners would have the garbage collector delete the objects not created by Kubescape
+		if isManagedObject(obj) {
+			if err := wh.adoptStorageObject(ctx, kind.kind, obj, imageStorageOwner(obj.GetNamespace(), wh.trackedImageID(imageIDs...)), kind.patchObject(wh)); err != nil {
+				report(err)
+			}
+		}
+		if eventType == watch.Added && wh.sbomScans.Trigger(kind, obj) {
+			for _, wlid := range wh.wlidsOfImageIDs(imageIDs...) {
+				if wh.triggersScan(ctx, wlid) {
+					emit(wh.scanCommandForWlid(ctx, wlid, utils.ScanScopeVulnerability))
+				}
+			}
+		}
+		return
+	}
+
+	// the objects not created by Kubescape are never deleted, see managedByLabel
+	if !isManagedObject(obj) {
+		return
+	}
+
+	if wh.leftToGarbageCollector(obj) {
+		logger.L().Ctx(ctx).Debug(
+			fmt.Sprintf(
+				`Cannot find image ID "%s" of an owned object, leaving its deletion to the garbage collector`,
+				imageID,
+			),
+		)
+		return
+	}
+
+	if why, deferred := wh.deletionsDeferred(kind.kind); deferred {
+		logger.L().Ctx(ctx).Debug(
+			fmt.Sprintf(
+				`Cannot find image ID "%s" %s, deferring deletion to cleanUp`,
+				imageID,
+				why,
+			),
+		)
+		return
+	}
+
+	isOrphan := func() bool { return !wh.isImageIDTracked(imageIDs...) }
+	wh.deletions.Submit(ctx, func() {
+		if !wh.stillOrphaned(kind.kind, obj, isOrphan) {
+			return
+		}
+		deleteObject := kind.deleteObject(wh, obj)
+		deleted, err := wh.handleOrphan(ctx, kind.kind, obj, deletionReasonImageHashNotTracked,
+			deleteObject, kind.patchObject(wh), helpers.String("imageID", imageID))
+		if err != nil && !k8serrors.IsNotFound(err) {
+			report(err)
+			if deleted {
+				wh.retryFailedDeletion(ctx, kind.kind, obj, deletionReasonImageHashNotTracked, isOrphan, deleteObject, err)
+			}
+			return
+		}
+		if deleted && imageID != "" {
+			wh.deleteFilteredSBOMsOfImage(ctx, obj.GetNamespace(), imageIDs, report)
+		}
+	})
+}
+
+// stillOrphaned re-evaluates a deletion submitted to the deletion pool right before it is performed, like deletionBatch.Flush
+//
+// The object may have been tracked again, or the internal maps may be
+// rebuilding, while the deletion waited for a worker, see deletionsDeferred.
+func (wh *WatchHandler) stillOrphaned(kind string, obj orphanObject, isOrphan func() bool) bool {
+	if !isOrphan() {
+		// tracked again, its grace period starts over once orphaned again
+		wh.pendingDeletions.Forget(orphanKey(kind, obj))
+		return false
+	}
+	_, deferred := wh.deletionsDeferred(kind)
+	return !deferred
+}
+
+// handleFilteredSBOM deletes a filtered SBOM whose instance ID is not known to the Operator, or triggers a relevancy scan of its workload otherwise
+func (wh *WatchHandler) handleFilteredSBOM(ctx context.Context, kind sbomKind, obj sbomObject, emit func(cmd *apis.Command), report func(err error)) {
+	annotations := obj.GetAnnotations()
+
+	hashedInstanceID, err := annotationsToInstanceID(annotations)
+	if errors.Is(err, ErrMalformedInstanceIDAnnotation) {
+		// a malformed instance ID is not an unknown one, the object is kept
+		logger.L().Ctx(ctx).Error("Malformed instance ID annotation, skipping", helpers.String("name", obj.GetName()), helpers.Error(err))
+		report(ErrMalformedInstanceIDAnnotation)
+		return
+	}
+	if err != nil {
+		logger.L().Ctx(ctx).Error(
+			fmt.Sprintf(
+				`Missing instance ID annotation. Got: %v`,
+				annotations,
+			),
+		)
+		report(ErrMissingInstanceIDAnnotation)
+		return
+	}
+
+	if !wh.hasInstanceID(hashedInstanceID) {
+		// the objects not created by Kubescape are never deleted, see managedByLabel
+		if !isManagedObject(obj) {
+			return
+		}
+		if wh.leftToGarbageCollector(obj) {
+			logger.L().Ctx(ctx).Debug(
+				fmt.Sprintf(
+					`unrecognized instance ID "%s" of an owned object, leaving its deletion to the garbage collector`,
+					hashedInstanceID,
+				),
+			)
+			return
+		}
+		if why, deferred := wh.deletionsDeferred(kind.kind); deferred {
+			logger.L().Ctx(ctx).Debug(
+				fmt.Sprintf(
+					`unrecognized instance ID "%s" %s, deferring deletion to cleanUp`,
+					hashedInstanceID,
+					why,
+				),
+			)
+			return
+		}
+		isOrphan := func() bool { return !wh.hasInstanceID(hashedInstanceID) }
+		wh.deletions.Submit(ctx, func() {
+			if !wh.stillOrphaned(kind.kind, obj, isOrphan) {
+				return
+			}
+			deleteObject := kind.deleteObject(wh, obj)
+			deleted, err := wh.handleOrphan(ctx, kind.kind, obj, deletionReasonInstanceIDNotTracked,
+				deleteObject, kind.patchObject(wh), helpers.String("instanceID", hashedInstanceID))
+			if err != nil && !k8serrors.IsNotFound(err) {
+				report(err)
+				if deleted {
+					wh.retryFailedDeletion(ctx, kind.kind, obj, deletionReasonInstanceIDNotTracked, isOrphan, deleteObject, err)
+				}
+			}
+		})
+		logger.L().Ctx(ctx).Info(
+			fmt.Sprintf(
+				`unrecognized instance ID "%s". Known: "%v", no triggering`,
+				hashedInstanceID,
+				wh.GetInstanceIDs(),
+			),
+		)
+		return
+	}
+
+	wh.pendingDeletions.Forget(orphanKey(kind.kind, obj))
+	// owners would have the garbage collector delete the objects not created by Kubescape
+	if isManagedObject(obj) {
+		if err := wh.adoptStorageObject(ctx, kind.kind, obj, instanceIDStorageOwner(obj.GetNamespace(), hashedInstanceID), kind.patchObject(wh)); err != nil {
+			report(err)
+		}
+	}
+
+	wlid, ok := annotations[instanceidhandlerv1.WlidMetadataKey]
+	if !ok {
+		logger.L().Ctx(ctx).Error(
+			fmt.Sprintf(
+				`Missing WLID annotation. Got: %v`,
+				annotations,
+			),
+		)
+		report(ErrMissingWLIDAnnotation)
+		return
+	}
+
+	if !wh.triggersScan(ctx, wlid) {
+		return
+	}
+
+	emit(wh.scanCommandForWlid(ctx, wlid, utils.ScanScopeRelevancy))
+}
+
+// triggersScan returns true if the storage objects of a WLID trigger its scans, i.e. it is neither excluded nor opted out of image scanning
+func (wh *WatchHandler) triggersScan(ctx context.Context, wlid string) bool {
+	if wh.excludedNamespaces.Excludes(pkgwlid.GetNamespaceFromWlid(wlid)) {
+		logger.L().Ctx(ctx).Debug(
+			fmt.Sprintf(
+				`WLID "%s" is in an excluded namespace, no triggering`,
+				wlid,
+			),
+		)
+		return false
+	}
+
+	if !wh.workloadKinds.Admits(pkgwlid.GetKindFromWlid(wlid)) {
+		logger.L().Ctx(ctx).Debug(
+			fmt.Sprintf(
+				`WLID "%s" is of a kind that is not tracked, no triggering`,
+				wlid,
+			),
+		)
+		return false
+	}
+
+	if wh.skipsImageScan(ctx, wlid, nil) {
+		logger.L().Ctx(ctx).Debug(
+			fmt.Sprintf(
+				`WLID "%s" opted out of image scanning, no triggering`,
+				wlid,
+			),
+		)
+		return false
+	}
+
+	return true
+}
+
+// scanCommandForWlid returns the command scanning the images of the tracked containers of a WLID, within the given scan scope
+func (wh *WatchHandler) scanCommandForWlid(ctx context.Context, wlid string, scope string) *apis.Command {
+	cmd := getScanCommand(wlid, wh.GetContainerToImageIDForWlid(wlid), scope)
+	wh.setImagePinningArg(cmd)
+	wh.setContainerTypeArg(cmd)
+	logger.L().Ctx(ctx).Debug(
+		fmt.Sprintf(
+			`Triggering scan with command: %v`,
+			cmd,
+		),
+	)
+	return cmd
+}
@@ -0,0 +1,182 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/armosec/armoapi-go/apis"
+	instanceidv1 "github.com/kubescape/k8s-interface/instanceidhandler/v1"
+	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestSBOMKindsFromObject(t *testing.T) {
+	objects := map[string]runtime.Object{
+		sbomSummaryKind:          &spdxv1beta1.SBOMSummary{},
+		sbomSPDXv2p3FilteredKind: &spdxv1beta1.SBOMSPDXv2p3Filtered{},
+	}
+
+	// watchers of different kinds never act on the objects of each other
+	for _, kind := range sbomKinds {
+		for objectKind, obj := range objects {
+			_, ok := kind.fromObject(obj)
+			assert.Equal(t, kind.kind == objectKind, ok, "kind %s, object %s", kind.kind, objectKind)
+		}
+	}
+}
+
+func TestHandleSBOMKindEventsAlreadyDeleted(t *testing.T) {
+	tt := []struct {
+		name string
+		kind sbomKind
+		obj  runtime.Object
+	}{
+		{
+			name: "SBOM summary",
+			kind: sbomSummaries,
+			obj: &spdxv1beta1.SBOMSummary{
+				ObjectMeta: v1.ObjectMeta{
+					Name:        validImageIDSlug,
+					Namespace:   "kubescape",
+					Labels:      managedLabels(),
+					Annotations: map[string]string{instanceidv1.ImageIDMetadataKey: validImageID},
+				},
+			},
+		},
+		{
+			name: "filtered SBOM",
+			kind: sbomSPDXv2p3Filtereds,
+			obj: &spdxv1beta1.SBOMSPDXv2p3Filtered{
+				ObjectMeta: v1.ObjectMeta{
+					Name:        "filtered",
+					Namespace:   "kubescape",
+					Labels:      managedLabels(),
+					Annotations: map[string]string{instanceidv1.InstanceIDMetadataKey: "apiVersion-v1/namespace-default/kind-Pod/name-reverse-proxy/containerName-nginx"},
+				},
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// the storage is empty, as if the objects were already deleted,
+			// e.g. by the watcher of another kind during a migration
+			wh := NewWatchHandlerMock()
+			wh.storageClient = kssfake.NewSimpleClientset()
+
+			events := make(chan watch.Event)
+			errorCh := make(chan error)
+			go wh.handleSBOMKindEvents(context.TODO(), tc.kind, events, make(chan *apis.Command, 1), errorCh)
+			go func() {
+				events <- watch.Event{Type: watch.Added, Object: tc.obj}
+				close(events)
+			}()
+
+			actualErrors := []error{}
+			for err := range errorCh {
+				actualErrors = append(actualErrors, err)
+			}
+			assert.Equal(t, []error{}, actualErrors)
+		})
+	}
+}
+
+func TestWatchSBOMKindReconcilesExistingObjects(t *testing.T) {
+	knownImageID := "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"
+	knownInstanceID := "apiVersion-v1/namespace-default/kind-Pod/name-reverse-proxy/containerName-nginx"
+	knownWlid := "wlid://cluster-/namespace-default/pod-reverse-proxy"
+
+	tt := []struct {
+		kind             sbomKind
+		resource         string
+		objects          []runtime.Object
+		expectedDeleted  []string
+		expectedCommands []string
+	}{
+		{
+			kind:     sbomSummaries,
+			resource: "sbomsummaries",
+			objects: []runtime.Object{
+				&spdxv1beta1.SBOMSummary{ObjectMeta: v1.ObjectMeta{Name: "known", Labels: managedLabels(), Annotations: map[string]string{instanceidv1.ImageIDMetadataKey: knownImageID}}},
+				&spdxv1beta1.SBOMSummary{ObjectMeta: v1.ObjectMeta{Name: "orphan", Labels: managedLabels(), Annotations: map[string]string{instanceidv1.ImageIDMetadataKey: "alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb"}}},
+			},
+			expectedDeleted:  []string{"orphan"},
+			expectedCommands: []string{},
+		},
+		{
+			kind:     sbomSPDXv2p3Filtereds,
+			resource: "sbomspdxv2p3filtereds",
+			objects: []runtime.Object{
+				&spdxv1beta1.SBOMSPDXv2p3Filtered{ObjectMeta: v1.ObjectMeta{Name: "known", Labels: managedLabels(), Annotations: map[string]string{
+					instanceidv1.InstanceIDMetadataKey: knownInstanceID,
+					instanceidv1.WlidMetadataKey:       knownWlid,
+				}}},
+				&spdxv1beta1.SBOMSPDXv2p3Filtered{ObjectMeta: v1.ObjectMeta{Name: "orphan", Labels: managedLabels(), Annotations: map[string]string{
+					instanceidv1.InstanceIDMetadataKey: "apiVersion-v1/namespace-default/kind-Pod/name-reverse-proxy/containerName-sidecar",
+					instanceidv1.WlidMetadataKey:       knownWlid,
+				}}},
+			},
+			expectedDeleted:  []string{"orphan"},
+			expectedCommands: []string{knownWlid},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.kind.kind, func(t *testing.T) {
+			storageClient := kssfake.NewSimpleClientset(tc.objects...)
+			// the list reports the resource version to watch from
+			storageClient.PrependReactor("list", tc.resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+				list, err := storageClient.Tracker().List(action.GetResource(), spdxv1beta1.SchemeGroupVersion.WithKind(tc.kind.kind), "")
+				if err != nil {
+					return true, nil, err
+				}
+				listMeta, _ := meta.ListAccessor(list)
+				listMeta.SetResourceVersion("42")
+				return true, list, nil
+			})
+			watchedFrom := make(chan string, 1)
+			storageClient.PrependWatchReactor(tc.resource, func(action k8stesting.Action) (bool, watch.Interface, error) {
+				watchedFrom <- action.(k8stesting.WatchActionImpl).GetWatchRestrictions().ResourceVersion
+				return true, watch.NewFake(), nil
+			})
+			knownInstanceIDSlug, _ := annotationsToInstanceID(map[string]string{instanceidv1.InstanceIDMetadataKey: knownInstanceID})
+
+			wh := NewWatchHandlerMock()
+			wh.storageClient = storageClient
+			wh.iwMap = NewImageHashWLIDsMapFrom(imageHashKeys(map[string][]string{knownImageID: {knownWlid}}))
+			wh.managedInstanceIDSlugs = newPodInstanceIDs(knownInstanceIDSlug)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			recorder := &commandRecorder{}
+			go wh.watchSBOMKind(ctx, tc.kind, recorder.emit)
+
+			select {
+			case resourceVersion := <-watchedFrom:
+				assert.Equal(t, "42", resourceVersion, "the watch should start from the resource version of the list")
+			case <-time.After(time.Second):
+				t.Fatal("the objects should be watched once reconciled")
+			}
+
+			// the existing objects are handled before the watch starts
+			deleted := []string{}
+			for _, action := range storageClient.Actions() {
+				if deletion, ok := action.(k8stesting.DeleteAction); ok && deletion.GetResource().Resource == tc.resource {
+					deleted = append(deleted, deletion.GetName())
+				}
+			}
+			assert.Equal(t, tc.expectedDeleted, deleted)
+			wlids := []string{}
+			for _, cmd := range recorder.emitted() {
+				wlids = append(wlids, cmd.Wlid)
+			}
+			assert.Equal(t, tc.expectedCommands, wlids)
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package watcher
+
+import (
+	"sync"
+	"time"
+)
+
+// sbomScanTracker records the SBOMs that triggered the scans of the workloads of their image, see handleSBOM
+//
+// SBOMs trigger the scans once created, so that workloads are scanned as soon
+// as the SBOMs of their images are generated, rather than at the next event
+// of their Pods. Watches replay the existing objects whenever they are
+// established, so SBOMs created before the tracker trigger nothing, and each
+// SBOM triggers once until it is deleted.
+//
+// The nil value triggers nothing.
+type sbomScanTracker struct {
+	since     time.Time
+	triggered map[string]struct{} // <kind>/<namespace>/<name> of the SBOMs that triggered
+	mu        sync.Mutex
+}
+
+func newSBOMScanTracker(since time.Time) *sbomScanTracker {
+	return &sbomScanTracker{
+		since:     since,
+		triggered: make(map[string]struct{}),
+	}
+}
+
+func sbomScanKey(kind sbomKind, obj sbomObject) string {
+	return kind.kind + "/" + obj.GetNamespace() + "/" + obj.GetName()
+}
+
+// Trigger returns true if the SBOM was created after the tracker and did not trigger yet, recording that it did
+func (t *sbomScanTracker) Trigger(kind sbomKind, obj sbomObject) bool {
+	if t == nil || obj.GetCreationTimestamp().Time.Before(t.since) {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := sbomScanKey(kind, obj)
+	if _, ok := t.triggered[key]; ok {
+		return false
+	}
+	t.triggered[key] = struct{}{}
+	return true
+}
+
+// Forget forgets a deleted SBOM, so that an SBOM created again with the same name triggers again
+func (t *sbomScanTracker) Forget(kind sbomKind, obj sbomObject) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.triggered, sbomScanKey(kind, obj))
+}
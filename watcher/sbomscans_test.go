@@ -0,0 +1,89 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/armosec/armoapi-go/apis"
+	instanceidv1 "github.com/kubescape/k8s-interface/instanceidhandler/v1"
+	"github.com/kubescape/operator/utils"
+	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func newSBOMSummaryFake(name, imageID string, created time.Time) *spdxv1beta1.SBOMSummary {
+	return &spdxv1beta1.SBOMSummary{
+		ObjectMeta: v1.ObjectMeta{
+			Name:              name,
+			Namespace:         "kubescape",
+			Labels:            managedLabels(),
+			CreationTimestamp: v1.NewTime(created),
+			Annotations:       map[string]string{instanceidv1.ImageIDMetadataKey: imageID},
+		},
+	}
+}
+
+func TestSBOMScanTracker(t *testing.T) {
+	since := time.Now()
+	tracker := newSBOMScanTracker(since)
+
+	assert.False(t, tracker.Trigger(sbomSummaries, newSBOMSummaryFake("old", "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240", since.Add(-time.Minute))),
+		"SBOMs created before the tracker should not trigger")
+
+	created := newSBOMSummaryFake("new", "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240", since.Add(time.Minute))
+	assert.True(t, tracker.Trigger(sbomSummaries, created))
+	assert.False(t, tracker.Trigger(sbomSummaries, created), "SBOMs should trigger once")
+	assert.True(t, tracker.Trigger(sbomSPDXv2p3Filtereds, created), "SBOMs of other kinds are tracked apart")
+
+	tracker.Forget(sbomSummaries, created)
+	assert.True(t, tracker.Trigger(sbomSummaries, created), "SBOMs created again should trigger again")
+
+	// the nil value triggers nothing
+	var disabled *sbomScanTracker
+	assert.False(t, disabled.Trigger(sbomSummaries, created))
+	disabled.Forget(sbomSummaries, created)
+}
+
+func TestHandleSBOMEventsTriggersScans(t *testing.T) {
+	imageID := "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"
+	k8sAPI, _ := newK8sAPIFake(
+		newRunningPodFake("default", "first", map[string]string{"nginx": imageID}),
+		newRunningPodFake("default", "second", map[string]string{"nginx": imageID}),
+		newRunningPodFake("default", "other", map[string]string{"redis": "redis@sha256:328695eff5583aa7bc95f9dd456106461d588df5bffc296107964fe27ee0e083"}),
+	)
+	wh, err := NewWatchHandler(k8sAPI, kssfake.NewSimpleClientset(), nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, wh.Start(context.TODO()))
+
+	created := newSBOMSummaryFake("nginx", imageID, time.Now().Add(time.Minute))
+	sbomEvents := make(chan watch.Event, 5)
+	sbomEvents <- watch.Event{Type: watch.Added, Object: created.DeepCopy()}
+	// neither updates nor replays of the same SBOM trigger again
+	sbomEvents <- watch.Event{Type: watch.Modified, Object: created.DeepCopy()}
+	sbomEvents <- watch.Event{Type: watch.Added, Object: created.DeepCopy()}
+	// SBOMs existing before the watch started trigger nothing
+	sbomEvents <- watch.Event{Type: watch.Added, Object: newSBOMSummaryFake("existing", imageID, time.Now().Add(-time.Hour))}
+	// SBOMs of untracked images trigger nothing
+	sbomEvents <- watch.Event{Type: watch.Added, Object: newSBOMSummaryFake("untracked", "busybox@sha256:22a1f96cbccbde731c101c7b6d6acb307af7e35957a2ea374b8e75f0e6d93620", time.Now().Add(time.Minute))}
+	close(sbomEvents)
+
+	producedCommands := make(chan *apis.Command, 10)
+	errCh := make(chan error)
+	go wh.HandleSBOMEvents(context.TODO(), sbomEvents, producedCommands, errCh)
+	for range errCh {
+	}
+	close(producedCommands)
+
+	wlids := []string{}
+	for cmd := range producedCommands {
+		assert.Equal(t, apis.TypeScanImages, cmd.CommandName)
+		assert.Equal(t, utils.ScanScopeVulnerability, cmd.Args[utils.ScanScopeArg], "new SBOMs trigger vulnerability scans")
+		wlids = append(wlids, cmd.Wlid)
+	}
+	assert.Equal(t, wh.wlidsOfImageIDs(imageID), wlids, "each workload of the image should be scanned once")
+	assert.Len(t, wlids, 2)
+}
@@ -0,0 +1,52 @@
+package watcher
+
+import (
+	"sync"
+	"time"
+)
+
+// settlingTracker tracks the watchers that are settling after a reconnect
+//
+// The initial burst of events after a reconnect may re-deliver objects that
+// have already been processed, possibly based on stale data. While a watcher
+// is settling, deletes based on its events are suppressed and left to the
+// periodic cleanUp. The zero value never settles.
+type settlingTracker struct {
+	window time.Duration
+	until  map[string]time.Time
+	now    clock
+	mu     sync.RWMutex
+}
+
+func newSettlingTracker(window time.Duration) *settlingTracker {
+	return &settlingTracker{
+		window: window,
+		until:  make(map[string]time.Time),
+		now:    time.Now,
+	}
+}
+
+// Start starts the settling window of the watcher with the given name
+func (s *settlingTracker) Start(watcherName string) {
+	if s == nil || s.window <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.until[watcherName] = s.now().Add(s.window)
+}
+
+// IsSettling reports if the watcher with the given name is within its settling window
+func (s *settlingTracker) IsSettling(watcherName string) bool {
+	if s == nil {
+		return false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	until, ok := s.until[watcherName]
+	return ok && s.now().Before(until)
+}
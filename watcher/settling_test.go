@@ -0,0 +1,124 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/armosec/armoapi-go/apis"
+	instanceidhandlerv1 "github.com/kubescape/k8s-interface/instanceidhandler/v1"
+	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestSettlingTracker(t *testing.T) {
+	now := time.Now()
+	tracker := newSettlingTracker(time.Minute)
+	tracker.now = func() time.Time { return now }
+
+	assert.False(t, tracker.IsSettling(sbomSummaryKind), "should not settle before a reconnect")
+
+	tracker.Start(sbomSummaryKind)
+	assert.True(t, tracker.IsSettling(sbomSummaryKind))
+	assert.False(t, tracker.IsSettling(sbomSPDXv2p3FilteredKind), "other watchers should not be affected")
+
+	now = now.Add(time.Minute)
+	assert.False(t, tracker.IsSettling(sbomSummaryKind), "should stop settling once the window passes")
+
+	disabled := newSettlingTracker(0)
+	disabled.Start(sbomSummaryKind)
+	assert.False(t, disabled.IsSettling(sbomSummaryKind), "an empty window disables settling")
+
+	var nilTracker *settlingTracker
+	nilTracker.Start(sbomSummaryKind)
+	assert.False(t, nilTracker.IsSettling(sbomSummaryKind))
+}
+
+func TestDeletesDeferredWhileSettling(t *testing.T) {
+	unknownSummary := &spdxv1beta1.SBOMSummary{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        "unknown",
+			Namespace:   "kubescape",
+			Labels:      managedLabels(),
+			Annotations: map[string]string{instanceidhandlerv1.ImageIDMetadataKey: validImageID},
+		},
+	}
+	unknownFiltered := &spdxv1beta1.SBOMSPDXv2p3Filtered{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "unknown-filtered",
+			Namespace: "kubescape",
+			Labels:    managedLabels(),
+			Annotations: map[string]string{
+				instanceidhandlerv1.InstanceIDMetadataKey: "apiVersion-v1/namespace-default/kind-Pod/name-reverse-proxy/containerName-nginx",
+			},
+		},
+	}
+
+	tt := []struct {
+		name             string
+		windowPassed     bool
+		expectedExisting bool
+	}{
+		{
+			name:             "Deletes are deferred during the settling window after a reconnect",
+			windowPassed:     false,
+			expectedExisting: true,
+		},
+		{
+			name:             "Deletes resume once the settling window passes",
+			windowPassed:     true,
+			expectedExisting: false,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.TODO()
+			storageClient := kssfake.NewSimpleClientset(
+				unknownSummary.DeepCopy(),
+				&spdxv1beta1.SBOMSPDXv2p3{ObjectMeta: unknownSummary.ObjectMeta},
+				unknownFiltered.DeepCopy(),
+			)
+
+			now := time.Now()
+			wh := NewWatchHandlerMock()
+			wh.storageClient = storageClient
+			wh.settling = newSettlingTracker(time.Minute)
+			wh.useClock(func() time.Time { return now })
+
+			// simulate the reconnect of both watchers
+			wh.settling.Start(sbomSummaryKind)
+			wh.settling.Start(sbomSPDXv2p3FilteredKind)
+			if tc.windowPassed {
+				now = now.Add(2 * time.Minute)
+			}
+
+			sbomEvents := make(chan watch.Event, 1)
+			sbomEvents <- watch.Event{Type: watch.Added, Object: unknownSummary}
+			close(sbomEvents)
+			sbomErrCh := make(chan error)
+			go wh.HandleSBOMEvents(context.TODO(), sbomEvents, nil, sbomErrCh)
+			for range sbomErrCh {
+			}
+
+			filteredEvents := make(chan watch.Event, 1)
+			filteredEvents <- watch.Event{Type: watch.Added, Object: unknownFiltered}
+			close(filteredEvents)
+			filteredErrCh := make(chan error)
+			go wh.HandleSBOMFilteredEvents(context.TODO(), filteredEvents, make(chan *apis.Command), filteredErrCh)
+			for range filteredErrCh {
+			}
+
+			_, summaryErr := storageClient.SpdxV1beta1().SBOMSummaries("kubescape").Get(ctx, "unknown", v1.GetOptions{})
+			_, sbomErr := storageClient.SpdxV1beta1().SBOMSPDXv2p3s("kubescape").Get(ctx, "unknown", v1.GetOptions{})
+			_, filteredErr := storageClient.SpdxV1beta1().SBOMSPDXv2p3Filtereds("kubescape").Get(ctx, "unknown-filtered", v1.GetOptions{})
+
+			assert.Equal(t, tc.expectedExisting, summaryErr == nil, "SBOM summary existence should match")
+			assert.Equal(t, tc.expectedExisting, sbomErr == nil, "SBOM existence should match")
+			assert.Equal(t, tc.expectedExisting, filteredErr == nil, "filtered SBOM existence should match")
+		})
+	}
+}
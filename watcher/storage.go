@@ -0,0 +1,97 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	// storageDeleteAttempts is the number of times a deletion throttled or refused by an unavailable storage is attempted before its error is returned
+	storageDeleteAttempts = 3
+	// storageDeleteBackoff is the delay before attempting a throttled deletion again, doubled after every further attempt
+	storageDeleteBackoff = 200 * time.Millisecond
+	// storageDeleteMaxBackoff is the maximal delay between two attempts of a throttled deletion, including the delays suggested by the storage
+	storageDeleteMaxBackoff = 2 * time.Second
+)
+
+const (
+	// metricStorageDeleteRetriesTotal is the number of deletions attempted again after being throttled or refused by the storage
+	metricStorageDeleteRetriesTotal = "operator_storage_delete_retries_total"
+	// metricStorageDeleteFailuresTotal is the number of deletions that failed, once their attempts are exhausted
+	metricStorageDeleteFailuresTotal = "operator_storage_delete_failures_total"
+)
+
+// storageRequestContext returns the context of a single request to the storage, derived from ctx
+//
+// The request is bounded by the storage request timeout, so a storage that
+// is slow to respond does not stall the caller. Watches are long-lived and
+// should use ctx directly instead.
+func (wh *WatchHandler) storageRequestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if wh.storageRequestTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, wh.storageRequestTimeout)
+}
+
+// isTransientStorageError reports whether the storage failed a request because it was throttled or momentarily unavailable
+//
+// Requests exceeding the storage request timeout are considered transient as
+// well, as a wedged storage does not fail them by itself.
+func isTransientStorageError(err error) bool {
+	return k8serrors.IsTooManyRequests(err) || k8serrors.IsServiceUnavailable(err) || k8serrors.IsServerTimeout(err) || k8serrors.IsTimeout(err) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// deleteFromStorage deletes a storage object with the given function, attempting it again while the storage throttles or refuses it, see isTransientStorageError
+//
+// Each attempt is bounded by the storage request timeout, and attempted again
+// once it is exceeded unless the context is done. Attempts back off from each
+// other, by at least the delay suggested by the storage, until the context is
+// done, so that a shutdown is not delayed. The error of the last attempt is
+// returned once they are exhausted. Objects that are not found are considered
+// deleted.
+func (wh *WatchHandler) deleteFromStorage(ctx context.Context, kind, namespace, name string, deleteFunc func(ctx context.Context) error) error {
+	backoff := newWatchBackoff(wh.storageDeleteBackoff, storageDeleteMaxBackoff, 0)
+	for attempt := 1; ; attempt++ {
+		requestCtx, cancel := wh.storageRequestContext(ctx)
+		err := deleteFunc(requestCtx)
+		cancel()
+		if err == nil || k8serrors.IsNotFound(err) {
+			return err
+		}
+		if !isTransientStorageError(err) || attempt >= storageDeleteAttempts || ctx.Err() != nil {
+			wh.metrics.Inc(metricStorageDeleteFailuresTotal)
+			return err
+		}
+
+		delay := backoff.Next()
+		if seconds, ok := k8serrors.SuggestsClientDelay(err); ok && time.Duration(seconds)*time.Second > delay {
+			delay = time.Duration(seconds) * time.Second
+		}
+		if delay > storageDeleteMaxBackoff {
+			delay = storageDeleteMaxBackoff
+		}
+		wh.metrics.Inc(metricStorageDeleteRetriesTotal)
+		logger.L().Ctx(ctx).Debug("storage unavailable, deleting storage object again",
+			helpers.String("kind", kind),
+			helpers.String("namespace", namespace),
+			helpers.String("name", name),
+			helpers.Int("attempt", attempt),
+			helpers.String("delay", delay.String()),
+			helpers.Error(err))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			wh.metrics.Inc(metricStorageDeleteFailuresTotal)
+			return err
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorageRequestContext(t *testing.T) {
+	wh := NewWatchHandlerMock()
+
+	// no timeout by default
+	ctx, cancel := wh.storageRequestContext(context.TODO())
+	_, hasDeadline := ctx.Deadline()
+	assert.False(t, hasDeadline)
+	cancel()
+	assert.Error(t, ctx.Err(), "the request context should be released by cancel")
+
+	wh.storageRequestTimeout = time.Minute
+	ctx, cancel = wh.storageRequestContext(context.TODO())
+	deadline, hasDeadline := ctx.Deadline()
+	assert.True(t, hasDeadline)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, time.Second)
+	cancel()
+
+	// requests are canceled along with the context they are derived from
+	parent, cancelParent := context.WithCancel(context.TODO())
+	ctx, cancel = wh.storageRequestContext(parent)
+	defer cancel()
+	cancelParent()
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+}
+
+func TestDeleteStorageObjectTimeout(t *testing.T) {
+	wh := NewWatchHandlerMock()
+	wh.storageRequestTimeout = 50 * time.Millisecond
+
+	// a storage that never responds
+	stuckDelete := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- wh.deleteStorageObject(context.TODO(), sbomSummaryKind, "kubescape", "nginx", deletionReasonImageHashNotTracked, stuckDelete)
+	}()
+
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(time.Second):
+		t.Fatal("a stuck delete should time out")
+	}
+}
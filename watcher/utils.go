@@ -1,22 +1,72 @@
 package watcher
 
 import (
+	"context"
 	"regexp"
+	"sort"
+	"strings"
 
 	"github.com/armosec/armoapi-go/apis"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
 	"github.com/kubescape/operator/utils"
 	core1 "k8s.io/api/core/v1"
 )
 
 var (
 	imageHashRegExp = regexp.MustCompile(`^[0-9a-f]+$`)
+	// imageDigestPrefixRegExp matches the normalized image IDs made of a digest only
+	imageDigestPrefixRegExp = regexp.MustCompile(`^sha(256|512):`)
 )
 
+// extractImageHash returns the image hash of an image ID, i.e. the key it is tracked under in the image hash map
+//
+// Runtimes report the same image as <repository>@sha256:<hex>, sha256:<hex>
+// or <hex>, prefixed by docker-pullable://, docker:// or cri-o:// depending
+// on the runtime and its version, so image IDs of the formats known to
+// utils.NormalizeImageID are tracked under their digest, e.g. sha256:<hex>.
+// Image IDs of other formats with a digest are tracked as is.
+//
+// Image IDs without a digest, e.g. of locally built images, never match the
+// names of storage objects, so they have no image hash and
+// ErrUnknownImageHash is returned. Their containers are tracked nonetheless.
+func extractImageHash(imageID string) (string, error) {
+	if digest, ok := utils.ImageIDHash(imageID); ok {
+		return digest, nil
+	}
+	imageID = utils.NormalizeImageID(imageID)
+	if strings.Contains(imageID, "@") || imageDigestPrefixRegExp.MatchString(imageID) {
+		return imageID, nil
+	}
+	return "", ErrUnknownImageHash
+}
+
+// imageHashKey returns the key an image ID is tracked under in the image hash map: its image hash, or its normalized form if it has none
+//
+// Image IDs without a digest are only tracked under their normalized form if
+// passed to NewWatchHandler, so that they match themselves.
+func imageHashKey(imageID string) string {
+	if imageHash, err := extractImageHash(imageID); err == nil {
+		return imageHash
+	}
+	return utils.NormalizeImageID(imageID)
+}
+
+// logDigestlessImage logs that containers of a Pod run an image reported without a digest, which is not tracked by image hash
+func logDigestlessImage(ctx context.Context, pod *core1.Pod, imageID string, containers []string) {
+	logger.L().Ctx(ctx).Warning("image reported without a digest, tracking its containers only",
+		helpers.String("namespace", pod.GetNamespace()),
+		helpers.String("pod", pod.GetName()),
+		helpers.String("containers", strings.Join(containers, ",")),
+		helpers.String("imageID", imageID))
+}
+
 func extractImageIDsToContainersFromPod(pod *core1.Pod) map[string][]string {
 	imageIDsToContainers := make(map[string][]string)
 	for _, containerStatus := range pod.Status.ContainerStatuses {
-		if containerStatus.State.Running != nil {
-			imageID := utils.ExtractImageID(containerStatus.ImageID)
+		// containers reporting no image ID yet are deferred, see deferPodWithoutImageIDs
+		if imageID, ok := utils.ContainerImageID(containerStatus); containerStatus.State.Running != nil && ok {
 			if _, ok := imageIDsToContainers[imageID]; !ok {
 				imageIDsToContainers[imageID] = []string{}
 			}
@@ -25,30 +75,51 @@ func extractImageIDsToContainersFromPod(pod *core1.Pod) map[string][]string {
 	}
 
 	for _, containerStatus := range pod.Status.InitContainerStatuses {
-		if containerStatus.State.Running != nil {
+		if utils.InitContainerHasStarted(containerStatus) {
 			imageID := utils.ExtractImageID(containerStatus.ImageID)
 			if _, ok := imageIDsToContainers[imageID]; !ok {
 				imageIDsToContainers[imageID] = []string{}
 			}
 			imageIDsToContainers[imageID] = append(imageIDsToContainers[imageID], containerStatus.Name)
 		}
-
 	}
 
 	return imageIDsToContainers
 }
 
+// extractImageIDsToEphemeralContainersFromPod returns a map of <imageID> : <containerNames> for the running ephemeral containers of the Pod
+func extractImageIDsToEphemeralContainersFromPod(pod *core1.Pod) map[string][]string {
+	imageIDsToContainers := make(map[string][]string)
+	for _, containerStatus := range pod.Status.EphemeralContainerStatuses {
+		if imageID, ok := utils.ContainerImageID(containerStatus); containerStatus.State.Running != nil && ok {
+			imageIDsToContainers[imageID] = append(imageIDsToContainers[imageID], containerStatus.Name)
+		}
+	}
+	return imageIDsToContainers
+}
+
+// extractTerminatedEphemeralContainersFromPod returns the names of the ephemeral containers of the Pod that have terminated
+func extractTerminatedEphemeralContainersFromPod(pod *core1.Pod) []string {
+	containerNames := []string{}
+	for _, containerStatus := range pod.Status.EphemeralContainerStatuses {
+		if containerStatus.State.Terminated != nil {
+			containerNames = append(containerNames, containerStatus.Name)
+		}
+	}
+	return containerNames
+}
+
 func extractImageIDsFromPod(pod *core1.Pod) []string {
 	imageIDs := []string{}
 	for _, containerStatus := range pod.Status.ContainerStatuses {
-		if containerStatus.State.Running != nil {
+		if containerStatus.State.Running != nil && containerStatus.ImageID != "" {
 			imageID := containerStatus.ImageID
 			imageIDs = append(imageIDs, utils.ExtractImageID(imageID))
 		}
 	}
 
 	for _, containerStatus := range pod.Status.InitContainerStatuses {
-		if containerStatus.State.Running != nil {
+		if utils.InitContainerHasStarted(containerStatus) {
 			imageID := containerStatus.ImageID
 			imageIDs = append(imageIDs, utils.ExtractImageID(imageID))
 		}
@@ -57,10 +128,71 @@ func extractImageIDsFromPod(pod *core1.Pod) []string {
 	return imageIDs
 }
 
+// isImagePinnedByDigest returns true if the image reference includes a digest, so it is immutable
+func isImagePinnedByDigest(image string) bool {
+	_, err := name.NewDigest(image)
+	return err == nil
+}
+
+// extractContainersToImagePinnedFromPod returns a map of <containerName> : <is image pinned by digest> for the containers in the Pod spec
+func extractContainersToImagePinnedFromPod(pod *core1.Pod) map[string]bool {
+	containersToImagePinned := make(map[string]bool)
+	for _, container := range pod.Spec.Containers {
+		containersToImagePinned[container.Name] = isImagePinnedByDigest(container.Image)
+	}
+	for _, container := range pod.Spec.InitContainers {
+		containersToImagePinned[container.Name] = isImagePinnedByDigest(container.Image)
+	}
+	for _, container := range pod.Spec.EphemeralContainers {
+		containersToImagePinned[container.Name] = isImagePinnedByDigest(container.Image)
+	}
+	return containersToImagePinned
+}
+
+// extractContainersToContainerTypeFromPod returns a map of <containerName> : <container type> for the containers in the Pod spec
+func extractContainersToContainerTypeFromPod(pod *core1.Pod) map[string]string {
+	containersToContainerType := make(map[string]string)
+	for _, container := range pod.Spec.Containers {
+		containersToContainerType[container.Name] = utils.ContainerTypeContainer
+	}
+	for _, container := range pod.Spec.InitContainers {
+		containersToContainerType[container.Name] = utils.ContainerTypeInitContainer
+	}
+	for _, container := range pod.Spec.EphemeralContainers {
+		containersToContainerType[container.Name] = utils.ContainerTypeEphemeralContainer
+	}
+	return containersToContainerType
+}
+
 func getImageScanCommand(wlid string, containerToimageID map[string]string) *apis.Command {
-	return &apis.Command{
+	return getScanCommand(wlid, containerToimageID, utils.ScanScopeVulnerability)
+}
+
+// getScanCommand returns the command scanning the images of the given containers of a WLID, within the given scan scope
+//
+// Both scopes share the command name, the scope argument lets the backend tell
+// the relevancy scans apart from the initial vulnerability scans.
+func getScanCommand(wlid string, containerToimageID map[string]string, scope string) *apis.Command {
+	cmd := &apis.Command{
 		Wlid:        wlid,
 		CommandName: apis.TypeScanImages,
-		Args:        map[string]interface{}{utils.ContainerToImageIdsArg: containerToimageID},
+		Args:        map[string]interface{}{utils.ScanScopeArg: scope},
 	}
+	setContainerToImageIDsArg(cmd, containerToimageID)
+	return cmd
+}
+
+// setContainerToImageIDsArg sets the containers to scan of a command, along with their names sorted
+//
+// Maps have no order, so consumers ranging over the containers of a command
+// use the sorted names for the commands to be handled deterministically.
+func setContainerToImageIDsArg(cmd *apis.Command, containerToImageID map[string]string) {
+	containerNames := make([]string, 0, len(containerToImageID))
+	for containerName := range containerToImageID {
+		containerNames = append(containerNames, containerName)
+	}
+	sort.Strings(containerNames)
+
+	cmd.Args[utils.ContainerToImageIdsArg] = containerToImageID
+	cmd.Args[utils.ContainerNamesArg] = containerNames
 }
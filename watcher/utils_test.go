@@ -1,9 +1,12 @@
 package watcher
 
 import (
+	"context"
 	"reflect"
 	"testing"
 
+	"github.com/armosec/armoapi-go/apis"
+	"github.com/kubescape/operator/utils"
 	"github.com/stretchr/testify/assert"
 	core1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -28,13 +31,13 @@ func Test_extractImageIDsToContainersFromPod(t *testing.T) {
 							State: core1.ContainerState{
 								Running: &core1.ContainerStateRunning{},
 							},
-							ImageID: "docker-pullable://alpine@sha256:1",
+							ImageID: "docker-pullable://alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547",
 							Name:    "container1",
 						},
 					},
 				},
 			},
-			expected: map[string][]string{"alpine@sha256:1": {"container1"}},
+			expected: map[string][]string{"alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547": {"container1"}},
 		},
 		{
 			name: "two containers",
@@ -49,22 +52,22 @@ func Test_extractImageIDsToContainersFromPod(t *testing.T) {
 							State: core1.ContainerState{
 								Running: &core1.ContainerStateRunning{},
 							},
-							ImageID: "docker-pullable://alpine@sha256:1",
+							ImageID: "docker-pullable://alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547",
 							Name:    "container1",
 						},
 						{
 							State: core1.ContainerState{
 								Running: &core1.ContainerStateRunning{},
 							},
-							ImageID: "docker-pullable://alpine@sha256:2",
+							ImageID: "docker-pullable://alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb",
 							Name:    "container2",
 						},
 					},
 				},
 			},
 			expected: map[string][]string{
-				"alpine@sha256:1": {"container1"},
-				"alpine@sha256:2": {"container2"},
+				"alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547": {"container1"},
+				"alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb": {"container2"},
 			},
 		},
 		{
@@ -80,22 +83,61 @@ func Test_extractImageIDsToContainersFromPod(t *testing.T) {
 							State: core1.ContainerState{
 								Running: &core1.ContainerStateRunning{},
 							},
-							ImageID: "docker-pullable://alpine@sha256:1",
+							ImageID: "docker-pullable://alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547",
 							Name:    "container1",
 						},
 						{
 							State: core1.ContainerState{
 								Running: &core1.ContainerStateRunning{},
 							},
-							ImageID: "docker-pullable://alpine@sha256:2",
+							ImageID: "docker-pullable://alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb",
 							Name:    "container2",
 						},
 					},
 				},
 			},
 			expected: map[string][]string{
-				"alpine@sha256:1": {"container1"},
-				"alpine@sha256:2": {"container2"},
+				"alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547": {"container1"},
+				"alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb": {"container2"},
+			},
+		},
+		{
+			name: "terminated init container with a different image than the container",
+			pod: &core1.Pod{
+				ObjectMeta: v1.ObjectMeta{
+					Name:      "pod3",
+					Namespace: "namespace3",
+				},
+				Status: core1.PodStatus{
+					InitContainerStatuses: []core1.ContainerStatus{
+						{
+							State: core1.ContainerState{
+								Terminated: &core1.ContainerStateTerminated{},
+							},
+							ImageID: "docker-pullable://migrate@sha256:2e0e455c9e1056b56154d3b2dafc55dcab163ce0acdc2ff6c3a06b80a5d0bf80",
+							Name:    "migrate",
+						},
+						{
+							State: core1.ContainerState{
+								Waiting: &core1.ContainerStateWaiting{},
+							},
+							Name: "not-started",
+						},
+					},
+					ContainerStatuses: []core1.ContainerStatus{
+						{
+							State: core1.ContainerState{
+								Running: &core1.ContainerStateRunning{},
+							},
+							ImageID: "docker-pullable://alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547",
+							Name:    "container1",
+						},
+					},
+				},
+			},
+			expected: map[string][]string{
+				"alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547":  {"container1"},
+				"migrate@sha256:2e0e455c9e1056b56154d3b2dafc55dcab163ce0acdc2ff6c3a06b80a5d0bf80": {"migrate"},
 			},
 		},
 		{
@@ -111,21 +153,50 @@ func Test_extractImageIDsToContainersFromPod(t *testing.T) {
 							State: core1.ContainerState{
 								Running: &core1.ContainerStateRunning{},
 							},
-							ImageID: "docker-pullable://alpine@sha256:1",
+							ImageID: "docker-pullable://alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547",
 							Name:    "container1",
 						},
 						{
 							State: core1.ContainerState{
 								Running: &core1.ContainerStateRunning{},
 							},
-							ImageID: "docker-pullable://alpine@sha256:1",
+							ImageID: "docker-pullable://alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547",
 							Name:    "container2",
 						},
 					},
 				},
 			},
 			expected: map[string][]string{
-				"alpine@sha256:1": {"container1", "container2"},
+				"alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547": {"container1", "container2"},
+			},
+		},
+		{
+			name: "running container without an image ID yet",
+			pod: &core1.Pod{
+				ObjectMeta: v1.ObjectMeta{
+					Name:      "pod5",
+					Namespace: "namespace5",
+				},
+				Status: core1.PodStatus{
+					ContainerStatuses: []core1.ContainerStatus{
+						{
+							State: core1.ContainerState{
+								Running: &core1.ContainerStateRunning{},
+							},
+							ImageID: "docker-pullable://alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547",
+							Name:    "container1",
+						},
+						{
+							State: core1.ContainerState{
+								Running: &core1.ContainerStateRunning{},
+							},
+							Name: "container2",
+						},
+					},
+				},
+			},
+			expected: map[string][]string{
+				"alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547": {"container1"},
 			},
 		},
 	}
@@ -156,13 +227,13 @@ func Test_extractImageIDsFromPod(t *testing.T) {
 							State: core1.ContainerState{
 								Running: &core1.ContainerStateRunning{},
 							},
-							ImageID: "docker-pullable://alpine@sha256:1",
+							ImageID: "docker-pullable://alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547",
 							Name:    "container1",
 						},
 					},
 				},
 			},
-			expected: []string{"alpine@sha256:1"},
+			expected: []string{"alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"},
 		},
 		{
 			name: "two containers",
@@ -177,20 +248,20 @@ func Test_extractImageIDsFromPod(t *testing.T) {
 							State: core1.ContainerState{
 								Running: &core1.ContainerStateRunning{},
 							},
-							ImageID: "docker-pullable://alpine@sha256:1",
+							ImageID: "docker-pullable://alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547",
 							Name:    "container1",
 						},
 						{
 							State: core1.ContainerState{
 								Running: &core1.ContainerStateRunning{},
 							},
-							ImageID: "docker-pullable://alpine@sha256:2",
+							ImageID: "docker-pullable://alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb",
 							Name:    "container2",
 						},
 					},
 				},
 			},
-			expected: []string{"alpine@sha256:1", "alpine@sha256:2"},
+			expected: []string{"alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547", "alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb"},
 		},
 		{
 			name: "init container",
@@ -205,20 +276,20 @@ func Test_extractImageIDsFromPod(t *testing.T) {
 							State: core1.ContainerState{
 								Running: &core1.ContainerStateRunning{},
 							},
-							ImageID: "docker-pullable://alpine@sha256:1",
+							ImageID: "docker-pullable://alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547",
 							Name:    "container1",
 						},
 						{
 							State: core1.ContainerState{
 								Running: &core1.ContainerStateRunning{},
 							},
-							ImageID: "docker-pullable://alpine@sha256:2",
+							ImageID: "docker-pullable://alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb",
 							Name:    "container2",
 						},
 					},
 				},
 			},
-			expected: []string{"alpine@sha256:1", "alpine@sha256:2"},
+			expected: []string{"alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547", "alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb"},
 		},
 	}
 	for _, tt := range tests {
@@ -227,3 +298,219 @@ func Test_extractImageIDsFromPod(t *testing.T) {
 		})
 	}
 }
+
+func Test_isImagePinnedByDigest(t *testing.T) {
+	tests := []struct {
+		name     string
+		image    string
+		expected bool
+	}{
+		{
+			name:     "image with a tag",
+			image:    "nginx:1.25",
+			expected: false,
+		},
+		{
+			name:     "image without a tag",
+			image:    "nginx",
+			expected: false,
+		},
+		{
+			name:     "image pinned by digest",
+			image:    "nginx@sha256:1f4e3b6489888647ce1834b601c6c06b9f8c03dee6e097e13ed3e28c01ea3ac8",
+			expected: true,
+		},
+		{
+			name:     "image with a tag and a digest",
+			image:    "quay.io/kubescape/kubevuln:v0.2.0@sha256:1f4e3b6489888647ce1834b601c6c06b9f8c03dee6e097e13ed3e28c01ea3ac8",
+			expected: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, isImagePinnedByDigest(tt.image))
+		})
+	}
+}
+
+func Test_extractContainersToImagePinnedFromPod(t *testing.T) {
+	pod := &core1.Pod{
+		Spec: core1.PodSpec{
+			Containers:     []core1.Container{{Name: "app", Image: "nginx:1.25"}},
+			InitContainers: []core1.Container{{Name: "init", Image: "busybox@sha256:1f4e3b6489888647ce1834b601c6c06b9f8c03dee6e097e13ed3e28c01ea3ac8"}},
+			EphemeralContainers: []core1.EphemeralContainer{
+				{EphemeralContainerCommon: core1.EphemeralContainerCommon{Name: "debugger", Image: "alpine@sha256:1f4e3b6489888647ce1834b601c6c06b9f8c03dee6e097e13ed3e28c01ea3ac8"}},
+			},
+		},
+	}
+	assert.Equal(t, map[string]bool{"app": false, "init": true, "debugger": true}, extractContainersToImagePinnedFromPod(pod))
+}
+
+func Test_extractImageHash(t *testing.T) {
+	tests := []struct {
+		name        string
+		imageID     string
+		expected    string
+		expectedErr error
+	}{
+		{
+			name:     "image ID with a repository digest",
+			imageID:  "docker.io/library/alpine@sha256:c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ee",
+			expected: "sha256:c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ee",
+		},
+		{
+			name:     "image ID with a repository digest of another registry",
+			imageID:  "quay.io/prometheus/node-exporter@sha256:c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ee",
+			expected: "sha256:c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ee",
+		},
+		{
+			name:     "image ID with a repository digest without registry",
+			imageID:  "alpine@sha256:c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ee",
+			expected: "sha256:c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ee",
+		},
+		{
+			name:     "docker-pullable image ID",
+			imageID:  "docker-pullable://alpine@sha256:c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ee",
+			expected: "sha256:c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ee",
+		},
+		{
+			name:     "docker image ID",
+			imageID:  "docker://sha256:c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ee",
+			expected: "sha256:c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ee",
+		},
+		{
+			name:     "image ID made of a digest",
+			imageID:  "sha256:c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ee",
+			expected: "sha256:c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ee",
+		},
+		{
+			name:     "image ID made of a bare hash",
+			imageID:  "c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ee",
+			expected: "sha256:c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ee",
+		},
+		{
+			name:     "CRI-O image ID with a prefixed repository digest",
+			imageID:  "cri-o://registry.access.redhat.com/ubi8/ubi-minimal@sha256:c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ee",
+			expected: "sha256:c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ee",
+		},
+		{
+			name:     "CRI-O image ID with a prefixed digest",
+			imageID:  "cri-o://sha256:c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ee",
+			expected: "sha256:c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ee",
+		},
+		{
+			name:        "image ID with a tag",
+			imageID:     "docker.io/library/myapp:latest",
+			expectedErr: ErrUnknownImageHash,
+		},
+		{
+			name:        "image ID of a locally built image",
+			imageID:     "myapp",
+			expectedErr: ErrUnknownImageHash,
+		},
+		{
+			name:        "CRI-O image ID with a tag",
+			imageID:     "cri-o://quay.io/kubescape/kubevuln:v0.2.0",
+			expectedErr: ErrUnknownImageHash,
+		},
+		{
+			name:        "empty image ID",
+			imageID:     "",
+			expectedErr: ErrUnknownImageHash,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imageHash, err := extractImageHash(tt.imageID)
+			assert.ErrorIs(t, err, tt.expectedErr)
+			assert.Equal(t, tt.expected, imageHash)
+		})
+	}
+}
+
+func Test_extractImageHashUnknownFormats(t *testing.T) {
+	tests := []struct {
+		name     string
+		imageID  string
+		expected string
+	}{
+		{
+			name:     "image ID with a malformed digest is kept as is",
+			imageID:  "alpine@sha256:1",
+			expected: "alpine@sha256:1",
+		},
+		{
+			name:     "docker-pullable image ID with a malformed digest is kept without its prefix",
+			imageID:  "docker-pullable://alpine@sha256:1",
+			expected: "alpine@sha256:1",
+		},
+		{
+			name:     "image ID with a digest of an unknown algorithm is kept as is",
+			imageID:  "alpine@md5:d41d8cd98f00b204e9800998ecf8427e",
+			expected: "alpine@md5:d41d8cd98f00b204e9800998ecf8427e",
+		},
+		{
+			name:     "image ID made of a malformed digest is kept as is",
+			imageID:  "sha256:1",
+			expected: "sha256:1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imageHash, err := extractImageHash(tt.imageID)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, imageHash)
+		})
+	}
+
+	// image IDs of unknown formats only match themselves, not the other images of their repository
+	wh := NewWatchHandlerMock()
+	wh.addToImageIDToWlidsMap("docker-pullable://alpine@sha256:1", "wlid1")
+	assert.Equal(t, []string{"wlid1"}, wh.GetWlidsForImageHash("alpine@sha256:1"))
+	assert.Empty(t, wh.GetWlidsForImageHash("alpine@sha256:2"))
+	assert.Empty(t, wh.GetWlidsForImageHash("nginx@sha256:1"))
+	assert.Equal(t, map[string][]string{"alpine@sha256:1": {"wlid1"}}, wh.SnapshotImageHashWLIDs())
+}
+
+func Test_getImageScanCommand(t *testing.T) {
+	containerToImageID := map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240", "envoy": "envoy@sha256:73971a8f26642b2749d12b0c0692ac2e75ea36137badf768fd3ef11da87c570f", "app": "app@sha256:21c115349ecbe7d7071c0431df3bc24f2b19b0a1a4a22d8d55358b6c642e4395"}
+	cmd := getImageScanCommand("wlid://cluster-/namespace-default/pod-nginx", containerToImageID)
+
+	assert.Equal(t, containerToImageID, cmd.Args[utils.ContainerToImageIdsArg])
+	assert.Equal(t, []string{"app", "envoy", "nginx"}, cmd.Args[utils.ContainerNamesArg])
+	assert.Equal(t, utils.ScanScopeVulnerability, cmd.Args[utils.ScanScopeArg])
+
+	relevancy := getScanCommand("wlid://cluster-/namespace-default/pod-nginx", containerToImageID, utils.ScanScopeRelevancy)
+	assert.Equal(t, apis.TypeScanImages, relevancy.CommandName, "relevancy scans are routed like the vulnerability scans")
+	assert.Equal(t, utils.ScanScopeRelevancy, relevancy.Args[utils.ScanScopeArg])
+
+	// the sorted names follow the containers when they are replaced
+	setContainerToImageIDsArg(cmd, map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"})
+	assert.Equal(t, []string{"nginx"}, cmd.Args[utils.ContainerNamesArg])
+}
+
+func TestImageScanCommandsAreDeterministic(t *testing.T) {
+	containerToImageID := map[string]string{}
+	for _, container := range []string{"nginx", "envoy", "app", "logger", "metrics", "cache", "worker", "proxy"} {
+		containerToImageID[container] = container + "@" + testDigest(container)
+	}
+
+	var first map[string]interface{}
+	for i := 0; i < 20; i++ {
+		pod := newRunningPodFake("default", "nginx", containerToImageID)
+		k8sAPI, _ := newK8sAPIFake(pod.DeepCopy())
+		wh := NewWatchHandlerMock()
+		wh.k8sAPI = k8sAPI
+
+		commands := handlePodEvents(context.TODO(), wh, pod)
+		if !assert.Len(t, commands, 1) {
+			return
+		}
+		if first == nil {
+			first = commands[0].Args
+			assert.Equal(t, []string{"app", "cache", "envoy", "logger", "metrics", "nginx", "proxy", "worker"}, first[utils.ContainerNamesArg])
+			continue
+		}
+		assert.Equal(t, first, commands[0].Args, "commands should not depend on the iteration order of maps")
+	}
+}
@@ -2,10 +2,11 @@ package watcher
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/armosec/armoapi-go/apis"
@@ -20,18 +21,33 @@ import (
 	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
 	kssc "github.com/kubescape/storage/pkg/generated/clientset/versioned"
 	"golang.org/x/exp/slices"
+	"golang.org/x/time/rate"
 	core1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/watch"
 )
 
 const (
 	retryInterval = 3 * time.Second
+	// podListPageSize is the maximal number of Pods fetched per List request
+	podListPageSize = 500
 )
 
+// builtinControllerKinds are the kinds of the built-in Kubernetes controllers that own Pods
+var builtinControllerKinds = []string{"ReplicaSet", "ReplicationController", "StatefulSet", "DaemonSet", "Job"}
+
 var (
 	ErrUnsupportedObject = errors.New("unsupported object type")
 	ErrUnknownImageHash  = errors.New("unknown image hash")
+	// ErrPodWatchClosed is returned by the Pod watcher once its watch ended, and can be resumed
+	ErrPodWatchClosed = errors.New("pod watch closed")
+	// ErrPodRelistFailed is returned by the Pod watcher once its watch ended, and the Pods failed to be relisted to resume it
+	ErrPodRelistFailed = errors.New("pod relist failed")
+	// ErrPodWatchCancelled is returned by the Pod watcher once its context is done
+	ErrPodWatchCancelled = errors.New("pod watch cancelled")
 )
 
 type WlidsToContainerToImageIDMap map[string]map[string]string
@@ -43,72 +59,298 @@ type WatchHandler struct {
 	// TODO(vladklokun): unify the following two fields with their
 	// respective mutexes into concurrent data structures with public
 	// methods
-	managedInstanceIDSlugs            []string
-	instanceIDsMutex                  *sync.RWMutex
-	wlidsToContainerToImageIDMap      WlidsToContainerToImageIDMap // <wlid> : <containerName> : imageID
-	wlidsToContainerToImageIDMapMutex *sync.RWMutex
-	currentPodListResourceVersion     string // current PodList version, used by watcher (https://kubernetes.io/docs/reference/using-api/api-concepts/#efficient-detection-of-changes)
+	managedInstanceIDSlugs             podInstanceIDs // <pod UID> : hashed instance IDs
+	instanceIDsMutex                   *sync.RWMutex
+	wlidsToContainerToImageIDMap       WlidsToContainerToImageIDMap // <wlid> : <containerName> : imageID
+	wlids                              *wlidLRU                     // WLIDs of wlidsToContainerToImageIDMap from the most to the least recently updated, if bounded
+	wlidsToContainerToImagePinnedMap   map[string]map[string]bool   // <wlid> : <containerName> : is image pinned by digest. Guarded by wlidsToContainerToImageIDMapMutex
+	wlidsToContainerToContainerTypeMap map[string]map[string]string // <wlid> : <containerName> : container type. Guarded by wlidsToContainerToImageIDMapMutex
+	wlidsToContainerToImageIDMapMutex  *sync.RWMutex
+	currentPodListResourceVersion      atomic.Value // string, current PodList version, used by watcher (https://kubernetes.io/docs/reference/using-api/api-concepts/#efficient-detection-of-changes)
+	metrics                            metricsRegistry
+	settling                           *settlingTracker             // watchers settling after a reconnect, during which deletes are suppressed
+	health                             *watchHealthTracker          // activity of the watchers, for their liveness
+	podWatchdog                        *podWatchdog                 // detects Pod watches that silently stopped delivering events
+	podWatchWorkers                    int                          // number of workers handling the events of the Pod watcher, at least one
+	buildIDsWorkers                    int                          // number of workers building the internal maps from the listed Pods, at least one
+	podEventRetries                    int                          // number of times a failed Pod event is retried before it is dropped
+	prescans                           *prescanTracker              // provisional scans triggered from the Pod templates of workload controllers, if enabled
+	imageDigests                       *imageDigestAliases          // other image IDs of the tracked images, if a resolver is set
+	errorHandler                       func(err error)              // optional handler of the errors produced by the watchers
+	commandDedupWindow                 time.Duration                // window during which duplicate scan commands of the Pod watcher are coalesced
+	trackEphemeralContainers           bool                         // whether the images of ephemeral (debug) containers are tracked
+	completedJobPodsWindow             time.Duration                // window after their completion during which the completed Pods of Jobs are tracked. Zero disables it
+	trackFailedJobPods                 bool                         // whether the failed Pods of Jobs are tracked along with the succeeded ones
+	completedJobPods                   completedJobPods             // tracked completed Pods of Jobs, retained until they leave the window
+	succeededJobPods                   succeededJobPods             // succeeded Pods of Jobs scanned once without being tracked
+	readiness                          *readinessGate               // holds back the scans of Pods until they are ready, if set
+	dryRun                             bool                         // whether deletions of storage objects only log what would be deleted
+	initialReconcile                   bool                         // whether the storage objects orphaned before the WatchHandler started are deleted right away
+	cleanUpJitter                      func() float64               // random number in [0, 1) of an interval by which the first cleanUp is delayed further. Nil disables it
+	parents                            *parentCache                 // parents resolved for Pod owners
+	resyncMutex                        sync.Mutex                   // serializes rebuilds of the internal maps
+	rebuild                            idsRebuild                   // Pods handled while the internal maps are rebuilt
+	pendingImageIDs                    pendingImageIDPods           // running Pods deferred until their containers report image IDs
+	podImageIDs                        podImageIDTracker            // image IDs of the containers of each Pod, to detect in-place image changes
+	watchBackoffMax                    time.Duration                // maximal delay between attempts to establish a watch
+	podRelistMaxFailures               int                          // number of consecutive failed relists of the Pods after which PodWatch gives up. Zero retries forever
+	storageRequestTimeout              time.Duration                // timeout of the requests to the storage, except for watches. Zero means no timeout
+	excludedNamespaces                 namespaceFilter              // namespaces whose workloads are not tracked
+	workloadKinds                      *workloadKindFilter          // kinds of top-level workloads that are tracked
+	parentAnnotations                  *parentAnnotationCache       // annotations of the top-level parents, for opt-outs and rescans
+	rescans                            rescanNonces                 // last rescan annotation value seen for each WLID
+	deletionBursts                     *deletionBursts              // bursts of Pod deletions triggering an early cleanUp, if enabled
+	podFilters                         podFilters                   // custom filters of the Pods that are tracked
+	checkpoints                        CheckpointStore              // store of the checkpoints of the internal maps, if enabled
+	checkpointInterval                 time.Duration                // interval between two checkpoints of the internal maps
+	checkpointed                       WlidsToContainerToImageIDMap // WLIDs of the checkpoint loaded on startup, if any
+	sbomScans                          *sbomScanTracker             // SBOMs that triggered the scans of the workloads of their image
+	idsBuilt                           atomic.Bool                  // whether the internal maps were built from the listed Pods, which the initial reconcile requires
+	relevancyScans                     *relevancyScanTrigger        // sink of the relevancy scans triggered after every cleanUp, if enabled
+	storageOwners                      *storageOwnerUIDs            // UIDs of the bookkeeping objects owning the storage objects, if WithOwnerReferences is enabled
+	commandLimiter                     *rate.Limiter                // rate at which the watchers send scan commands, shared by them. Nil does not limit it
+	deletionPolicies                   map[string]DeletionPolicy    // <kind> : what is done with its orphaned storage objects. Unset kinds are deleted
+	started                            atomic.Bool                  // whether Start was called
+	vulnerabilityManifestRetention     time.Duration                // time the orphaned Vulnerability Manifests are retained for before being deleted. Zero disables it
+	pendingDeletions                   *pendingDeletions            // orphaned storage objects within their grace period, if enabled
+	resyncPeriod                       time.Duration                // interval between two resyncs of the scans of the tracked workloads. Zero disables them
+	eventBufferSize                    int                          // number of events buffered between the reader and the handler of each watch. Zero handles them in the reader
+	onDelete                           DeletionHook                 // optional hook called after every deletion of an orphaned storage object
+	deletionRetries                    *deletionRetries             // failed deletions of orphaned storage objects waiting to be retried
+	storageDeleteBackoff               time.Duration                // delay before attempting a deletion throttled by the storage again
+	bulkDeletions                      bool                         // whether cleanUp deletes the orphaned storage objects with a DeleteCollection per kind and namespace
+	bulkUnsupported                    sync.Map                     // kinds of storage objects the storage does not delete in bulk
+	managedBySelector                  bool                         // whether the storage objects are watched only if labeled as created by Kubescape
+	deletions                          *deletionPool                // workers deleting the orphaned storage objects found by the watchers. Nil deletes them in the watchers
+	clock                              clock                        // current time of the WatchHandler and its trackers, see WithClock
 }
 
 // remove unused imageIDs and instanceIDs from storage. Update internal maps
 func (wh *WatchHandler) cleanUp(ctx context.Context) {
-	// list Pods, extract their imageIDs and instanceIDs
-	podsList, err := wh.k8sAPI.ListPods("", map[string]string{})
-	if err != nil {
+	wh.resyncMutex.Lock()
+	defer wh.resyncMutex.Unlock()
+
+	if err := wh.rebuildIDs(ctx); err != nil {
 		logger.L().Ctx(ctx).Error("could not complete cleanUp routine: error to ListPods", helpers.Error(err))
 		return
 	}
 
-	// reset maps - clean them and build them again
-	wh.cleanUpIDs()
-	wh.buildIDs(ctx, podsList)
+	wh.reclaimOrphans(ctx)
+}
+
+// ForceResync rebuilds the internal maps from the Pods currently running in the cluster
+//
+// It performs the same rebuild as the cleanUp routine, synchronously, and
+// never concurrently with it. Orphaned storage objects are not reclaimed.
+func (wh *WatchHandler) ForceResync(ctx context.Context) error {
+	wh.resyncMutex.Lock()
+	defer wh.resyncMutex.Unlock()
+
+	return wh.rebuildIDs(ctx)
+}
+
+// podIterator calls handlePod for every Pod it iterates over, stopping at the first error
+type podIterator func(handlePod func(pod *core1.Pod) error) error
+
+// podListIterator returns an iterator over the Pods of a PodList
+func podListIterator(podList *core1.PodList) podIterator {
+	return func(handlePod func(pod *core1.Pod) error) error {
+		for i := range podList.Items {
+			if err := handlePod(&podList.Items[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// listPods lists all Pods in the cluster in pages and calls handlePod for each of them
+//
+// Every page is discarded once handled, so the whole PodList is never held
+// in memory at once. Returns the resource version of the list.
+func (wh *WatchHandler) listPods(ctx context.Context, handlePod func(pod *core1.Pod) error) (string, error) {
+	return wh.listPodsWith(ctx, v1.ListOptions{}, handlePod)
+}
+
+// listPodsWith lists all Pods in the cluster in pages with the given options, see listPods
+//
+// The resource version options only apply to the first page: the API server
+// forbids them along with a continue token, which already pins the list to
+// the resource version of its first page.
+func (wh *WatchHandler) listPodsWith(ctx context.Context, listOptions v1.ListOptions, handlePod func(pod *core1.Pod) error) (string, error) {
+	listOptions.Limit = podListPageSize
+	for {
+		podList, err := wh.k8sAPI.KubernetesClient.CoreV1().Pods("").List(ctx, listOptions)
+		if err != nil {
+			return "", err
+		}
+
+		if err := podListIterator(podList)(handlePod); err != nil {
+			return "", err
+		}
+
+		if podList.GetContinue() == "" {
+			return podList.GetResourceVersion(), nil
+		}
+		listOptions.Continue = podList.GetContinue()
+		listOptions.ResourceVersion = ""
+		listOptions.ResourceVersionMatch = ""
+	}
 }
 
-// NewWatchHandler creates a new WatchHandler, initializes the maps and returns it
-func NewWatchHandler(ctx context.Context, k8sAPI *k8sinterface.KubernetesApi, storageClient kssc.Interface, imageIDsToWLIDsMap map[string][]string, instanceIDs []string) (*WatchHandler, error) {
+// NewWatchHandler creates a new WatchHandler with the maps seeded from the given image IDs and instance IDs and returns it
+//
+// It does not call the API server: the maps are built from the Pods of the
+// cluster, and the background routines started, by Start.
+func NewWatchHandler(k8sAPI *k8sinterface.KubernetesApi, storageClient kssc.Interface, imageIDsToWLIDsMap map[string][]string, instanceIDs []string, opts ...WatchHandlerOption) (*WatchHandler, error) {
+	if k8sAPI == nil || k8sAPI.KubernetesClient == nil {
+		return nil, ErrMissingKubernetesClient
+	}
+	if storageClient == nil {
+		return nil, ErrMissingStorageClient
+	}
 
 	wh := &WatchHandler{
-		storageClient:                     storageClient,
-		k8sAPI:                            k8sAPI,
-		iwMap:                             NewImageHashWLIDsMapFrom(imageIDsToWLIDsMap),
-		wlidsToContainerToImageIDMap:      make(WlidsToContainerToImageIDMap),
-		wlidsToContainerToImageIDMapMutex: &sync.RWMutex{},
-		instanceIDsMutex:                  &sync.RWMutex{},
-		managedInstanceIDSlugs:            instanceIDs,
+		storageClient:                      storageClient,
+		k8sAPI:                             k8sAPI,
+		iwMap:                              NewImageHashWLIDsMapFrom(imageHashKeys(imageIDsToWLIDsMap)),
+		wlidsToContainerToImageIDMap:       make(WlidsToContainerToImageIDMap),
+		wlidsToContainerToImagePinnedMap:   make(map[string]map[string]bool),
+		wlidsToContainerToContainerTypeMap: make(map[string]map[string]string),
+		wlidsToContainerToImageIDMapMutex:  &sync.RWMutex{},
+		instanceIDsMutex:                   &sync.RWMutex{},
+		managedInstanceIDSlugs:             newPodInstanceIDs(instanceIDs...),
+		settling:                           newSettlingTracker(utils.ReconnectSettlingWindow),
+		health:                             newWatchHealthTracker(utils.WatchHealthThreshold),
+		podWatchdog:                        newPodWatchdog(utils.PodWatchStalenessWindow),
+		podWatchWorkers:                    utils.PodWatchWorkers,
+		buildIDsWorkers:                    utils.BuildIDsWorkers,
+		podEventRetries:                    utils.PodEventRetries,
+		commandDedupWindow:                 utils.CommandDedupWindow,
+		trackEphemeralContainers:           utils.TrackEphemeralContainers,
+		completedJobPodsWindow:             utils.CompletedJobPodsWindow,
+		trackFailedJobPods:                 utils.TrackFailedJobPods,
+		managedBySelector:                  utils.ManagedBySelector,
+		storageRequestTimeout:              utils.StorageRequestTimeout,
+		watchBackoffMax:                    utils.WatchBackoffMax,
+		podRelistMaxFailures:               utils.PodRelistMaxFailures,
+		parents:                            newParentCache(utils.ParentCacheTTL, parentCacheSize),
+		parentAnnotations:                  &parentAnnotationCache{},
+		sbomScans:                          newSBOMScanTracker(time.Now()),
+		storageDeleteBackoff:               storageDeleteBackoff,
+		deletionRetries:                    newDeletionRetries(deletionRetryBackoff, deletionRetryMaxBackoff, deletionRetryMaxAttempts, deletionRetriesSize),
+		clock:                              time.Now,
+	}
+	for _, opt := range opts {
+		opt(wh)
+	}
+	// the trackers set by the options share the clock as well
+	wh.useClock(wh.clock)
+
+	return wh, nil
+}
+
+// Start builds the internal maps from the listed Pods and starts the cleanUp, checkpoint and deletion routines, returning once they are started
+//
+// It must be called before starting the watchers, and returns
+// ErrAlreadyStarted if called again. The routines run until the context is
+// done. If the maps cannot be built, the error is returned and Start may be
+// called again.
+func (wh *WatchHandler) Start(ctx context.Context) error {
+	if !wh.started.CompareAndSwap(false, true) {
+		return ErrAlreadyStarted
 	}
 
+	// the maps persisted before a restart are seeded like imageIDsToWLIDsMap and instanceIDs
+	wh.loadCheckpoint(ctx)
+
 	// list all Pods and extract their image IDs
-	podsList, err := wh.k8sAPI.ListPods("", map[string]string{})
+	var resourceVersion string
+	err := wh.buildIDs(ctx, func(handlePod func(pod *core1.Pod) error) (err error) {
+		resourceVersion, err = wh.listPods(ctx, handlePod)
+		return err
+	})
 	if err != nil {
-		return nil, err
+		wh.started.Store(false)
+		return err
 	}
 
-	wh.buildIDs(ctx, podsList)
-
-	wh.currentPodListResourceVersion = podsList.GetResourceVersion()
+	wh.setPodListResourceVersion(resourceVersion)
+	wh.idsBuilt.Store(true)
 
 	wh.startCleanUpAndTriggerScanRoutine(ctx)
+	wh.startCheckpointRoutine(ctx)
+	wh.startDeletionRetryRoutine(ctx)
+	wh.deletions.Start(ctx)
 
-	return wh, nil
+	return nil
+}
+
+// imageHashKeys returns a copy of a map of <imageID> : <WLIDs> keyed by the image hashes of the image IDs, see imageHashKey
+func imageHashKeys(imageIDsToWLIDsMap map[string][]string) map[string][]string {
+	imageHashes := make(map[string][]string, len(imageIDsToWLIDsMap))
+	for imageID, wlids := range imageIDsToWLIDsMap {
+		imageHash := imageHashKey(imageID)
+		imageHashes[imageHash] = append(imageHashes[imageHash], wlids...)
+	}
+	return imageHashes
 }
 
 // start routine which cleans up unused imageIDs and instanceIDs from storage, and  triggers relevancy scan
 func (wh *WatchHandler) startCleanUpAndTriggerScanRoutine(ctx context.Context) {
 	go func() {
+		if wh.initialReconcile {
+			if err := wh.reconcileOnStartup(ctx); err != nil {
+				logger.L().Ctx(ctx).Warning("skipping the initial reconcile", helpers.Error(err))
+			}
+		}
+		wh.waitForCleanUp(ctx, wh.firstCleanUpDelay(utils.CleanUpRoutineInterval))
 		for {
-			time.Sleep(utils.CleanUpRoutineInterval)
 			wh.cleanUp(ctx)
 			// must be called after cleanUp, since we can have two instanceIDs with same wlid
-			// wh.triggerRelevancyScan(ctx)
+			wh.triggerRelevancyScan(ctx)
+			wh.waitForCleanUp(ctx, utils.CleanUpRoutineInterval)
 		}
 	}()
 }
 
-func (wh *WatchHandler) listInstanceIDs() []string {
+// waitForCleanUp waits for the given delay before the next cleanUp, or less if a burst of Pod deletions is detected, see deletionBursts
+func (wh *WatchHandler) waitForCleanUp(ctx context.Context, delay time.Duration) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-wh.deletionBursts.Triggered():
+		logger.L().Ctx(ctx).Info("burst of pod deletions, cleaning up early")
+		wh.metrics.Inc(metricDeletionBurstCleanUpsTotal)
+	}
+}
+
+// firstCleanUpDelay returns the delay before the first cleanUp: the interval, plus a random part of it if jittered
+//
+// Operators starting together, e.g. across clusters reporting to the same
+// backend, would otherwise list their Pods at the same time on every run.
+func (wh *WatchHandler) firstCleanUpDelay(interval time.Duration) time.Duration {
+	if wh.cleanUpJitter == nil {
+		return interval
+	}
+	return interval + time.Duration(wh.cleanUpJitter()*float64(interval))
+}
+
+// GetInstanceIDs returns a copy of the instance IDs currently tracked by the operator
+func (wh *WatchHandler) GetInstanceIDs() []string {
+	wh.instanceIDsMutex.RLock()
+	defer wh.instanceIDsMutex.RUnlock()
+
+	return wh.managedInstanceIDSlugs.listInstanceIDs()
+}
+
+// hasInstanceID reports whether the given instance ID is tracked by the operator
+func (wh *WatchHandler) hasInstanceID(instanceID string) bool {
 	wh.instanceIDsMutex.RLock()
 	defer wh.instanceIDsMutex.RUnlock()
 
-	return wh.managedInstanceIDSlugs
+	return wh.managedInstanceIDSlugs.Has(instanceID)
 }
 
 // returns wlids map
@@ -119,16 +361,23 @@ func (wh *WatchHandler) GetWlidsToContainerToImageIDMap() WlidsToContainerToImag
 	return wh.wlidsToContainerToImageIDMap
 }
 
+// annotationsToInstanceID returns the slug of the instance ID an object is annotated with
+//
+// Instance IDs that do not conform to the instance ID format, i.e. that are
+// not reproduced when formatted again after parsing, are reported as
+// ErrMalformedInstanceIDAnnotation
 func annotationsToInstanceID(annotations map[string]string) (string, error) {
 	rawInstanceID, ok := annotations[instanceidhandlerv1.InstanceIDMetadataKey]
 	if !ok {
 		return rawInstanceID, ErrMissingInstanceIDAnnotation
 	}
 
-	// TODO(vladklokun): cover with tests
 	instanceID, err := instanceidhandlerv1.GenerateInstanceIDFromString(rawInstanceID)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("%w: %v", ErrMalformedInstanceIDAnnotation, err)
+	}
+	if instanceID.GetStringFormatted() != rawInstanceID {
+		return "", fmt.Errorf("%w: %s", ErrMalformedInstanceIDAnnotation, rawInstanceID)
 	}
 
 	slug, err := instanceID.GetSlug()
@@ -138,173 +387,176 @@ func annotationsToInstanceID(annotations map[string]string) (string, error) {
 	return slug, nil
 }
 
-func (wh *WatchHandler) getVulnerabilityManifestWatcher() (watch.Interface, error) {
-	return wh.storageClient.SpdxV1beta1().VulnerabilityManifests("").Watch(context.TODO(), v1.ListOptions{})
+func (wh *WatchHandler) getVulnerabilityManifestWatcher(ctx context.Context) (watch.Interface, error) {
+	return wh.storageClient.SpdxV1beta1().VulnerabilityManifests("").Watch(ctx, wh.storageWatchOptions(""))
 }
 
 // VulnerabilityManifestWatch watches for Vulnerability Manifests and handles them accordingly
-func (wh *WatchHandler) VulnerabilityManifestWatch(ctx context.Context, sessionObjChan *chan utils.SessionObj) {
-	inputEvents := make(chan watch.Event)
-	errorCh := make(chan error)
-	vmEvents := make(<-chan watch.Event)
+func (wh *WatchHandler) VulnerabilityManifestWatch(ctx context.Context) {
+	report := func(err error) { wh.reportError(ctx, VulnerabilityManifestWatchName, err) }
+	wh.runWatchRetry(ctx, VulnerabilityManifestWatchName,
+		func() (watch.Interface, error) { return wh.getVulnerabilityManifestWatcher(ctx) },
+		func(event watch.Event) { wh.handleVulnerabilityManifestEvent(ctx, event, report) },
+		nil)
+}
 
-	// The watcher is considered unavailable by default
-	watcherUnavailable := make(chan struct{})
-	go func() {
-		watcherUnavailable <- struct{}{}
-	}()
+func (wh *WatchHandler) HandleVulnerabilityManifestEvents(ctx context.Context, vmEvents <-chan watch.Event, errorCh chan<- error) {
+	defer close(errorCh)
 
-	go wh.HandleVulnerabilityManifestEvents(inputEvents, errorCh)
+	report := func(err error) { errorCh <- err }
+	for e := range vmEvents {
+		// the watch failed, the watch loop restarts it
+		if err := wh.watchStatusError(e); err != nil {
+			errorCh <- err
+			continue
+		}
 
-	// notifyWatcherDown notifies the appropriate channel that the watcher
-	// is down and backs off for the retry interval to not produce
-	// unnecessary events
-	notifyWatcherDown := func(watcherDownCh chan<- struct{}) {
-		go func() { watcherDownCh <- struct{}{} }()
-		time.Sleep(retryInterval)
+		wh.handleVulnerabilityManifestEvent(ctx, e, report)
 	}
+}
 
-	var watcher watch.Interface
-	var err error
-	for {
-		select {
-		case event, ok := <-vmEvents:
-			if ok {
-				inputEvents <- event
-			} else {
-				notifyWatcherDown(watcherUnavailable)
-			}
-		case err, ok := <-errorCh:
-			if ok {
-				logger.L().Ctx(ctx).Error(fmt.Sprintf("error in SBOMWatch: %v", err.Error()))
-			} else {
-				notifyWatcherDown(watcherUnavailable)
-			}
-		case <-watcherUnavailable:
-			if watcher != nil {
-				watcher.Stop()
-			}
+// handleVulnerabilityManifestEvent handles an event of a Vulnerability Manifest, see HandleVulnerabilityManifestEvents
+func (wh *WatchHandler) handleVulnerabilityManifestEvent(ctx context.Context, e watch.Event, report func(err error)) {
+	if e.Type == watch.Deleted {
+		return
+	}
 
-			watcher, err = wh.getVulnerabilityManifestWatcher()
-			if err != nil {
-				notifyWatcherDown(watcherUnavailable)
-			} else {
-				vmEvents = watcher.ResultChan()
-			}
-		}
+	obj, ok := e.Object.(*spdxv1beta1.VulnerabilityManifest)
+	if !ok {
+		report(ErrUnsupportedObject)
+		return
 	}
-}
 
-func (wh *WatchHandler) HandleVulnerabilityManifestEvents(vmEvents <-chan watch.Event, errorCh chan<- error) {
-	defer close(errorCh)
+	if isRegistryScanManifest(obj) {
+		return
+	}
+	// not created by Kubescape, see managedByLabel
+	if !isManagedObject(obj) {
+		return
+	}
 
-	for e := range vmEvents {
-		if e.Type == watch.Deleted {
-			continue
+	manifestName := obj.ObjectMeta.Name
+	orphaned, reason := wh.vulnerabilityManifestOrphanCheck(obj)
+	if !orphaned {
+		wh.pendingDeletions.Forget(orphanKey(vulnerabilityManifestKind, obj))
+		if err := wh.adoptStorageObject(ctx, vulnerabilityManifestKind, obj, vulnerabilityManifestStorageOwner(obj), wh.patchVulnerabilityManifest); err != nil {
+			report(err)
 		}
-
-		obj, ok := e.Object.(*spdxv1beta1.VulnerabilityManifest)
-		if !ok {
-			errorCh <- ErrUnsupportedObject
-			continue
+		if err := wh.unmarkVulnerabilityManifest(ctx, obj); err != nil {
+			report(err)
 		}
-
-		manifestName := obj.ObjectMeta.Name
-		imageHash := manifestName
-		withRelevancy := obj.Spec.Metadata.WithRelevancy
-
-		var hasObject bool
-		if withRelevancy {
-			instanceIDs := wh.listInstanceIDs()
-			hashedInstanceID := manifestName
-			hasObject = slices.Contains(instanceIDs, hashedInstanceID)
-		} else {
-			_, hasObject = wh.iwMap.Load(imageHash)
+		return
+	}
+	if why, deferred := wh.deletionsDeferred(vulnerabilityManifestKind); deferred {
+		logger.L().Ctx(ctx).Debug("deferring the deletion decision of storage object to cleanUp",
+			append(deletionDetails(vulnerabilityManifestKind, obj.ObjectMeta.Namespace, manifestName, reason), helpers.String("why", why))...)
+		return
+	}
+	due, err := wh.vulnerabilityManifestDue(ctx, obj, reason)
+	if err != nil {
+		report(err)
+		return
+	}
+	if !due {
+		return
+	}
+	deleteObject := wh.deleteVulnerabilityManifest(obj)
+	deleted, err := wh.handleOrphan(ctx, vulnerabilityManifestKind, obj, reason, deleteObject, wh.patchVulnerabilityManifest)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		report(err)
+		if deleted {
+			wh.retryFailedDeletion(ctx, vulnerabilityManifestKind, obj, reason, func() bool {
+				orphaned, _ := wh.vulnerabilityManifestOrphanCheck(obj)
+				return orphaned
+			}, deleteObject, err)
 		}
+	}
+}
 
-		if !hasObject {
-			// TODO(vladklokun): deletes are disabled for a quick hack
-			// wh.storageClient.SpdxV1beta1().VulnerabilityManifests(obj.ObjectMeta.Namespace).Delete(context.TODO(), manifestName, v1.DeleteOptions{})
-		}
+// vulnerabilityManifestStorageOwner returns the owner of a Vulnerability Manifest, named after its instance ID or image hash like in vulnerabilityManifestOrphanCheck
+func vulnerabilityManifestStorageOwner(obj *spdxv1beta1.VulnerabilityManifest) storageOwner {
+	if obj.Spec.Metadata.WithRelevancy {
+		return instanceIDStorageOwner(obj.ObjectMeta.Namespace, obj.ObjectMeta.Name)
 	}
+	return imageStorageOwner(obj.ObjectMeta.Namespace, obj.ObjectMeta.Name)
 }
 
-func (wh *WatchHandler) HandleSBOMFilteredEvents(sfEvents <-chan watch.Event, producedCommands chan<- *apis.Command, errorCh chan<- error) {
-	defer close(errorCh)
+// patchVulnerabilityManifest merge-patches a Vulnerability Manifest, see adoptStorageObject
+func (wh *WatchHandler) patchVulnerabilityManifest(ctx context.Context, namespace, name string, data []byte) error {
+	_, err := wh.storageClient.SpdxV1beta1().VulnerabilityManifests(namespace).Patch(ctx, name, types.MergePatchType, data, v1.PatchOptions{})
+	return err
+}
 
-	for e := range sfEvents {
-		obj, ok := e.Object.(*spdxv1beta1.SBOMSPDXv2p3Filtered)
-		if !ok {
-			logger.L().Ctx(context.TODO()).Error(
-				fmt.Sprintf(
-					`Unsupported object. Got: %v`,
-					e.Object,
-				),
-			)
-			errorCh <- ErrUnsupportedObject
-			continue
-		}
+// deleteVulnerabilityManifest returns the deletion of a Vulnerability Manifest, see handleOrphan
+func (wh *WatchHandler) deleteVulnerabilityManifest(obj *spdxv1beta1.VulnerabilityManifest) func(ctx context.Context) error {
+	namespace, name := obj.ObjectMeta.Namespace, obj.ObjectMeta.Name
+	return func(ctx context.Context) error {
+		return wh.storageClient.SpdxV1beta1().VulnerabilityManifests(namespace).Delete(ctx, name, v1.DeleteOptions{})
+	}
+}
 
-		// Deleting an already deleted object makes no sense
-		if e.Type == watch.Deleted {
-			continue
-		}
+// vulnerabilityManifestOrphanCheck reports whether a Vulnerability Manifest is orphaned and the reason it is
+//
+// A manifest is orphaned only if neither its image hash nor its instance ID
+// is tracked. Both are read from its annotations, falling back to its name:
+// manifests with relevancy are named after an instance ID, others after an
+// image hash, but the naming conventions changed between storage versions.
+func (wh *WatchHandler) vulnerabilityManifestOrphanCheck(obj *spdxv1beta1.VulnerabilityManifest) (bool, string) {
+	imageID, instanceID := vulnerabilityManifestIDs(obj)
+	if imageID != "" && wh.isImageIDTracked(imageID) {
+		return false, deletionReasonImageHashNotTracked
+	}
+	if instanceID != "" && wh.hasInstanceID(instanceID) {
+		return false, deletionReasonInstanceIDNotTracked
+	}
+	if obj.Spec.Metadata.WithRelevancy {
+		return true, deletionReasonInstanceIDNotTracked
+	}
+	return true, deletionReasonImageHashNotTracked
+}
 
-		// TODO(vladklokun): refactor: generalize inserts of managed
-		// instance IDs, push for a broader refactor of the
-		// mutex-detached fields
-		hashedInstanceID, err := annotationsToInstanceID(obj.ObjectMeta.Annotations)
-		if err != nil {
-			logger.L().Ctx(context.TODO()).Error(
-				fmt.Sprintf(
-					`Missing instance ID annotation. Got: %v`,
-					obj.ObjectMeta.Annotations,
-				),
-			)
-			errorCh <- ErrMissingInstanceIDAnnotation
-			continue
-		}
+// registryScanContext is the context of the Vulnerability Manifests produced by registry scans, see isRegistryScanManifest
+const registryScanContext = "registry"
 
-		if !slices.Contains(wh.managedInstanceIDSlugs, hashedInstanceID) {
-			wh.storageClient.SpdxV1beta1().SBOMSPDXv2p3Filtereds(obj.ObjectMeta.Namespace).Delete(context.TODO(), obj.ObjectMeta.Name, v1.DeleteOptions{})
-			logger.L().Ctx(context.TODO()).Info(
-				fmt.Sprintf(
-					`unrecognized instance ID "%s". Known: "%v", no triggering`,
-					hashedInstanceID,
-					wh.managedInstanceIDSlugs,
-				),
-			)
-			continue
-		}
+// isRegistryScanManifest returns true if a Vulnerability Manifest was produced by a registry scan rather than for the image of a Pod
+//
+// Such manifests are not tied to any running Pod, so they are never orphaned
+// and the handlers and cleanUp leave them be. Their context is read from
+// their labels, falling back to their annotations.
+func isRegistryScanManifest(obj *spdxv1beta1.VulnerabilityManifest) bool {
+	if source, ok := obj.ObjectMeta.Labels[instanceidhandlerv1.ContextMetadataKey]; ok {
+		return source == registryScanContext
+	}
+	return obj.ObjectMeta.Annotations[instanceidhandlerv1.ContextMetadataKey] == registryScanContext
+}
 
-		wlid, ok := obj.ObjectMeta.Annotations[instanceidhandlerv1.WlidMetadataKey]
-		if !ok {
-			logger.L().Ctx(context.TODO()).Error(
-				fmt.Sprintf(
-					`Missing WLID annotation. Got: %v`,
-					obj.ObjectMeta.Annotations,
-				),
-			)
-			errorCh <- ErrMissingWLIDAnnotation
-			continue
-		}
+// vulnerabilityManifestIDs returns the image ID and the hashed instance ID of a Vulnerability Manifest, empty if unknown
+//
+// The annotations take precedence over the name, which only stands for the
+// instance ID of the manifests with relevancy and for the image ID of the others.
+func vulnerabilityManifestIDs(obj *spdxv1beta1.VulnerabilityManifest) (string, string) {
+	var imageID, instanceID string
+	if obj.Spec.Metadata.WithRelevancy {
+		instanceID = obj.ObjectMeta.Name
+	} else {
+		imageID = obj.ObjectMeta.Name
+	}
 
-		containerToImageIDs := wh.GetContainerToImageIDForWlid(wlid)
-		cmd := getImageScanCommand(wlid, containerToImageIDs)
-		logger.L().Ctx(context.TODO()).Debug(
-			fmt.Sprintf(
-				`Triggering scan with command: %v`,
-				cmd,
-			),
-		)
-		producedCommands <- cmd
-		logger.L().Ctx(context.TODO()).Debug(
-			fmt.Sprintf(
-				`Scan triggered with command: %v`,
-				cmd,
-			),
-		)
+	if annotated, err := annotationsToImageID(obj.ObjectMeta.Annotations); err == nil && annotated != "" {
+		imageID = annotated
 	}
+	if annotated, err := annotationsToInstanceID(obj.ObjectMeta.Annotations); err == nil {
+		instanceID = annotated
+	}
+	return imageID, instanceID
+}
+
+// HandleSBOMFilteredEvents handles Filtered SBOM events
+//
+// Handling events is defined as deleting Filtered SBOMs that are not known to
+// the Operator and triggering scans of the workloads of known ones
+func (wh *WatchHandler) HandleSBOMFilteredEvents(ctx context.Context, sfEvents <-chan watch.Event, producedCommands chan<- *apis.Command, errorCh chan<- error) {
+	wh.handleSBOMKindEvents(ctx, sbomSPDXv2p3Filtereds, sfEvents, producedCommands, errorCh)
 }
 
 func annotationsToImageID(annotations map[string]string) (string, error) {
@@ -317,205 +569,123 @@ func annotationsToImageID(annotations map[string]string) (string, error) {
 
 // HandleSBOMEvents handles SBOM-related events
 //
-// Handling events is defined as deleting SBOMs that are not known to the Operator
-func (wh *WatchHandler) HandleSBOMEvents(sbomEvents <-chan watch.Event, errorCh chan<- error) {
-	defer close(errorCh)
-
-	for event := range sbomEvents {
-		obj, ok := event.Object.(*spdxv1beta1.SBOMSummary)
-		if !ok {
-			errorCh <- ErrUnsupportedObject
-			continue
-		}
-
-		// We don’t need to try deleting SBOMs that have been deleted
-		if event.Type == watch.Deleted {
-			continue
-		}
-
-		imageID, err := annotationsToImageID(obj.ObjectMeta.Annotations)
-		if err != nil {
-			errorCh <- err
-		}
-
-		_, imageHashOk := wh.iwMap.Load(imageID)
-		if !imageHashOk {
-			logger.L().Ctx(context.TODO()).Debug(
-				fmt.Sprintf(
-					`Cannot find image ID "%s" among managed "%v". Deleting`,
-					imageID,
-					// TODO(vladklokun): converting to map can be expensive, implement Stringer on this
-					wh.iwMap.Map(),
-				),
-			)
-
-			// We assume that other components store summaries and
-			// SBOMs together with the same name, so we have to
-			// clean them up together
-			err := wh.storageClient.SpdxV1beta1().SBOMSummaries(obj.ObjectMeta.Namespace).Delete(context.TODO(), obj.ObjectMeta.Name, v1.DeleteOptions{})
-			if err != nil {
-				errorCh <- err
-			}
-
-			err = wh.storageClient.SpdxV1beta1().SBOMSPDXv2p3s(obj.ObjectMeta.Namespace).Delete(context.TODO(), obj.ObjectMeta.Name, v1.DeleteOptions{})
-			if err != nil {
-				errorCh <- err
-			}
+// Handling events is defined as deleting SBOMs that are not known to the
+// Operator and triggering scans of the workloads of the images of newly
+// created known ones
+func (wh *WatchHandler) HandleSBOMEvents(ctx context.Context, sbomEvents <-chan watch.Event, producedCommands chan<- *apis.Command, errorCh chan<- error) {
+	wh.handleSBOMKindEvents(ctx, sbomSummaries, sbomEvents, producedCommands, errorCh)
+}
 
-			continue
+// sendTo returns a function sending commands to the sink, reporting the commands that could not be delivered as errors of the watcher
+//
+// Commands are sent at the rate set by WithCommandRateLimit, if any.
+func (wh *WatchHandler) sendTo(ctx context.Context, sink utils.CommandSink, watcherName string) func(cmd *apis.Command) {
+	sink = wh.rateLimited(ctx, sink, watcherName)
+	return func(cmd *apis.Command) {
+		if err := sink.Send(ctx, cmd); err != nil {
+			wh.reportError(ctx, watcherName, fmt.Errorf("failed to send command for %s: %w", cmd.Wlid, err))
 		}
 	}
 }
 
-func (wh *WatchHandler) getSBOMWatcher() (watch.Interface, error) {
-	return wh.storageClient.SpdxV1beta1().SBOMSummaries("").Watch(context.TODO(), v1.ListOptions{})
+func (wh *WatchHandler) getSBOMWatcher(ctx context.Context, resourceVersion string) (watch.Interface, error) {
+	return wh.storageClient.SpdxV1beta1().SBOMSummaries("").Watch(ctx, wh.storageWatchOptions(resourceVersion))
 }
 
 // watch for sbom changes, and trigger scans accordingly
-func (wh *WatchHandler) SBOMWatch(ctx context.Context, sessionObjChan *chan utils.SessionObj) {
-	inputEvents := make(chan watch.Event)
-	commands := make(chan *apis.Command)
-	errorCh := make(chan error)
-	sbomEvents := make(<-chan watch.Event)
-
-	// The watcher is considered unavailable by default
-	sbomWatcherUnavailable := make(chan struct{})
-	go func() {
-		sbomWatcherUnavailable <- struct{}{}
-	}()
-
-	go wh.HandleSBOMEvents(inputEvents, errorCh)
-
-	// notifyWatcherDown notifies the appropriate channel that the watcher
-	// is down and backs off for the retry interval to not produce
-	// unnecessary events
-	notifyWatcherDown := func(watcherDownCh chan<- struct{}) {
-		go func() { watcherDownCh <- struct{}{} }()
-		time.Sleep(retryInterval)
-	}
-
-	var watcher watch.Interface
-	var err error
-	for {
-		select {
-		case sbomEvent, ok := <-sbomEvents:
-			if ok {
-				inputEvents <- sbomEvent
-			} else {
-				notifyWatcherDown(sbomWatcherUnavailable)
-			}
-		case cmd, ok := <-commands:
-			if ok {
-				utils.AddCommandToChannel(ctx, cmd, sessionObjChan)
-			} else {
-				notifyWatcherDown(sbomWatcherUnavailable)
-			}
-		case err, ok := <-errorCh:
-			if ok {
-				logger.L().Ctx(ctx).Error(fmt.Sprintf("error in SBOMWatch: %v", err.Error()))
-			} else {
-				notifyWatcherDown(sbomWatcherUnavailable)
-			}
-		case <-sbomWatcherUnavailable:
-			if watcher != nil {
-				watcher.Stop()
-			}
-
-			watcher, err = wh.getSBOMWatcher()
-			if err != nil {
-				notifyWatcherDown(sbomWatcherUnavailable)
-			} else {
-				sbomEvents = watcher.ResultChan()
-			}
-		}
-	}
+func (wh *WatchHandler) SBOMWatch(ctx context.Context, sink utils.CommandSink) {
+	wh.watchSBOMKind(ctx, sbomSummaries, wh.sendTo(ctx, sink, SBOMWatcherName))
 }
 
-func (wh *WatchHandler) getSBOMFilteredWatcher() (watch.Interface, error) {
-	return wh.storageClient.SpdxV1beta1().SBOMSPDXv2p3Filtereds("").Watch(context.TODO(), v1.ListOptions{})
+func (wh *WatchHandler) getSBOMFilteredWatcher(ctx context.Context, resourceVersion string) (watch.Interface, error) {
+	return wh.storageClient.SpdxV1beta1().SBOMSPDXv2p3Filtereds("").Watch(ctx, wh.storageWatchOptions(resourceVersion))
 }
 
 // SBOMFilteredWatch watches and processes changes on Filtered SBOMs
-func (wh *WatchHandler) SBOMFilteredWatch(ctx context.Context, sessionObjChan *chan utils.SessionObj) {
-	inputEvents := make(chan watch.Event)
-	cmdCh := make(chan *apis.Command)
-	errorCh := make(chan error)
-	sbomEvents := make(<-chan watch.Event)
-
-	// The watcher is considered unavailable by default
-	sbomWatcherUnavailable := make(chan struct{})
-	go func() {
-		sbomWatcherUnavailable <- struct{}{}
-	}()
-
-	go wh.HandleSBOMFilteredEvents(inputEvents, cmdCh, errorCh)
-
-	// notifyWatcherDown notifies the appropriate channel that the watcher
-	// is down and backs off for the retry interval to not produce
-	// unnecessary events
-	notifyWatcherDown := func(watcherDownCh chan<- struct{}) {
-		go func() { watcherDownCh <- struct{}{} }()
-		time.Sleep(retryInterval)
-	}
-
-	var watcher watch.Interface
-	var err error
-	for {
-		select {
-		case sbomEvent, ok := <-sbomEvents:
-			if ok {
-				inputEvents <- sbomEvent
-			} else {
-				notifyWatcherDown(sbomWatcherUnavailable)
-			}
-		case cmd, ok := <-cmdCh:
-			if ok {
-				utils.AddCommandToChannel(ctx, cmd, sessionObjChan)
-			} else {
-				notifyWatcherDown(sbomWatcherUnavailable)
-			}
-		case err, ok := <-errorCh:
-			if ok {
-				logger.L().Ctx(ctx).Error(fmt.Sprintf("error in SBOMFilteredWatch: %v", err.Error()))
-			} else {
-				notifyWatcherDown(sbomWatcherUnavailable)
-			}
-		case <-sbomWatcherUnavailable:
-			if watcher != nil {
-				watcher.Stop()
-			}
-
-			watcher, err = wh.getSBOMFilteredWatcher()
-			if err != nil {
-				notifyWatcherDown(sbomWatcherUnavailable)
-			} else {
-				sbomEvents = watcher.ResultChan()
-			}
-		}
-	}
+func (wh *WatchHandler) SBOMFilteredWatch(ctx context.Context, sink utils.CommandSink) {
+	wh.watchSBOMKind(ctx, sbomSPDXv2p3Filtereds, wh.sendTo(ctx, sink, SBOMFilteredWatcherName))
 }
 
 // watch for pods changes, and trigger scans accordingly
-func (wh *WatchHandler) PodWatch(ctx context.Context, sessionObjChan *chan utils.SessionObj) {
+//
+// The watch is established again whenever it ends, right away if it can be
+// resumed and after a backoff otherwise. An error is returned if the Pods
+// failed to be relisted podRelistMaxFailures times in a row, as the watcher
+// is blind to the changes of the cluster until they are.
+func (wh *WatchHandler) PodWatch(ctx context.Context, sink utils.CommandSink) error {
 	logger.L().Ctx(ctx).Debug("starting pod watch")
-	for {
-		podsWatch, err := wh.getPodWatcher()
+	// coalesce duplicate commands, e.g. when a rollout creates many identical Pods
+	commands := newCommandDeduper(wh.commandDedupWindow, wh.sendTo(ctx, sink, PodWatcherName))
+	backoff := wh.newWatchBackoff(PodWatcherName)
+	relistFailures := 0
+	// relistFailed records a failed relist of the Pods, returning an error once they failed too many times in a row
+	relistFailed := func(err error) error {
+		relistFailures++
+		if wh.podRelistMaxFailures > 0 && relistFailures >= wh.podRelistMaxFailures {
+			return fmt.Errorf("failed to relist the pods %d times in a row: %w", relistFailures, err)
+		}
+		return nil
+	}
+	wh.health.Started(PodWatcherName)
+	for ctx.Err() == nil {
+		podsWatch, err := wh.getPodWatcher(ctx)
 		if err != nil {
-			logger.L().Ctx(ctx).Error(fmt.Sprintf("error to getPodWatcher, err :%s", err.Error()), helpers.Error(err))
-			time.Sleep(retryInterval)
+			wh.reportError(ctx, PodWatcherName, fmt.Errorf("error to getPodWatcher: %w", err))
+			// the resource version is too old to resume from, so the Pods
+			// are relisted before reconnecting rather than retrying with it
+			if isResourceVersionExpired(err) {
+				// no watch is running, so the relisted Pods are handled right away
+				handlePod := func(pod *core1.Pod) {
+					if err := wh.handlePodEvent(ctx, watch.Event{Type: watch.Modified, Object: pod}, commands); err != nil {
+						logger.L().Ctx(ctx).Error("failed to handle relisted pod", helpers.String("pod", podQueueKey(pod)), helpers.Error(err))
+					}
+				}
+				if err := wh.resetResourceVersion(ctx, handlePod); err != nil {
+					logger.L().Ctx(ctx).Error(fmt.Sprintf("error to resetResourceVersion, err :%s", err.Error()), helpers.Error(err))
+					if err := relistFailed(fmt.Errorf("%w: %w", ErrPodRelistFailed, err)); err != nil {
+						return err
+					}
+				} else {
+					relistFailures = 0
+					continue
+				}
+			}
+			backoff.wait(ctx, PodWatcherName)
 			continue
 		}
-		wh.handlePodWatcher(ctx, podsWatch, sessionObjChan)
+		backoff.Connected()
+		wh.health.Connected(PodWatcherName)
+		err = wh.handlePodWatcher(ctx, podsWatch, commands)
+		// watches that lasted long enough reset the backoff
+		lasted := backoff.Disconnected()
+		switch {
+		case errors.Is(err, ErrPodWatchCancelled):
+			return nil
+		case errors.Is(err, ErrPodRelistFailed):
+			logger.L().Ctx(ctx).Warning("pod watch ended and the pods failed to be relisted", helpers.Error(err))
+			if err := relistFailed(err); err != nil {
+				return err
+			}
+			backoff.wait(ctx, PodWatcherName)
+		default:
+			relistFailures = 0
+			// watches ending right away are not re-established in a tight loop
+			if !lasted {
+				backoff.wait(ctx, PodWatcherName)
+			}
+		}
 	}
+	return nil
 }
 
 func (wh *WatchHandler) cleanUpInstanceIDs() {
 	wh.instanceIDsMutex.Lock()
-	wh.managedInstanceIDSlugs = []string{}
+	wh.managedInstanceIDSlugs = newPodInstanceIDs()
 	wh.instanceIDsMutex.Unlock()
 }
 
 func (wh *WatchHandler) cleanUpIDs() {
+	wh.parents.Reset()
 	wh.iwMap.Clear()
 	wh.cleanUpInstanceIDs()
 	wh.cleanUpWlidsToContainerToImageIDMap()
@@ -526,16 +696,31 @@ func (wh *WatchHandler) cleanUpWlidsToContainerToImageIDMap() {
 	defer wh.wlidsToContainerToImageIDMapMutex.Unlock()
 
 	wh.wlidsToContainerToImageIDMap = make(WlidsToContainerToImageIDMap)
+	wh.wlidsToContainerToImagePinnedMap = make(map[string]map[string]bool)
+	wh.wlidsToContainerToContainerTypeMap = make(map[string]map[string]string)
+	wh.wlids.Retain(wh.wlidsToContainerToImageIDMap)
 }
 
 func (wh *WatchHandler) GetWlidsForImageHash(imageHash string) []string {
-	wlids, ok := wh.iwMap.Load(imageHash)
+	wlids, ok := wh.iwMap.Load(imageHashKey(imageHash))
 	if !ok {
 		return []string{}
 	}
 	return wlids
 }
 
+// SnapshotImageHashWLIDs returns a copy of the WLIDs running each tracked image hash
+//
+// The WLIDs of each image hash are sorted. The result is not shared with the
+// WatchHandler, so callers are free to modify it.
+func (wh *WatchHandler) SnapshotImageHashWLIDs() map[string][]string {
+	snapshot := wh.iwMap.Map()
+	for _, wlids := range snapshot {
+		sort.Strings(wlids)
+	}
+	return snapshot
+}
+
 func (wh *WatchHandler) GetContainerToImageIDForWlid(wlid string) map[string]string {
 	wh.wlidsToContainerToImageIDMapMutex.RLock()
 	defer wh.wlidsToContainerToImageIDMapMutex.RUnlock()
@@ -547,91 +732,407 @@ func (wh *WatchHandler) GetContainerToImageIDForWlid(wlid string) map[string]str
 	return containerToImageIds
 }
 
-func (wh *WatchHandler) addToInstanceIDsList(instanceID instanceidhandler.IInstanceID) {
-	wh.instanceIDsMutex.Lock()
-	defer wh.instanceIDsMutex.Unlock()
-	h, _ := instanceID.GetSlug()
+// copyContainerToImageIDForWlid returns a copy of the containers to image IDs of a given WLID
+func (wh *WatchHandler) copyContainerToImageIDForWlid(wlid string) map[string]string {
+	wh.wlidsToContainerToImageIDMapMutex.RLock()
+	defer wh.wlidsToContainerToImageIDMapMutex.RUnlock()
 
-	if !slices.Contains(wh.managedInstanceIDSlugs, h) {
-		wh.managedInstanceIDSlugs = append(wh.managedInstanceIDSlugs, h)
+	containerToImageIds := make(map[string]string, len(wh.wlidsToContainerToImageIDMap[wlid]))
+	for container, imgID := range wh.wlidsToContainerToImageIDMap[wlid] {
+		containerToImageIds[container] = imgID
 	}
+	return containerToImageIds
 }
 
-func (wh *WatchHandler) addToImageIDToWlidsMap(imageID string, wlids ...string) {
-	if len(wlids) == 0 {
-		return
+// GetContainerToImagePinnedForWlid returns whether the image of each container of a given WLID is pinned by digest
+func (wh *WatchHandler) GetContainerToImagePinnedForWlid(wlid string) map[string]bool {
+	wh.wlidsToContainerToImageIDMapMutex.RLock()
+	defer wh.wlidsToContainerToImageIDMapMutex.RUnlock()
+
+	res := make(map[string]bool, len(wh.wlidsToContainerToImagePinnedMap[wlid]))
+	for containerName, pinned := range wh.wlidsToContainerToImagePinnedMap[wlid] {
+		res[containerName] = pinned
 	}
-	wh.iwMap.Add(imageID, wlids...)
+	return res
 }
 
-func (wh *WatchHandler) addToWlidsToContainerToImageIDMap(wlid string, containerName string, imageID string) {
-	wh.wlidsToContainerToImageIDMapMutex.Lock()
-	defer wh.wlidsToContainerToImageIDMapMutex.Unlock()
+// GetContainerToContainerTypeForWlid returns the type of each container of a given WLID, e.g. regular or init container
+func (wh *WatchHandler) GetContainerToContainerTypeForWlid(wlid string) map[string]string {
+	wh.wlidsToContainerToImageIDMapMutex.RLock()
+	defer wh.wlidsToContainerToImageIDMapMutex.RUnlock()
 
-	if _, ok := wh.wlidsToContainerToImageIDMap[wlid]; !ok {
-		wh.wlidsToContainerToImageIDMap[wlid] = make(map[string]string)
+	res := make(map[string]string, len(wh.wlidsToContainerToContainerTypeMap[wlid]))
+	for containerName, containerType := range wh.wlidsToContainerToContainerTypeMap[wlid] {
+		res[containerName] = containerType
 	}
-
-	wh.wlidsToContainerToImageIDMap[wlid][containerName] = imageID
+	return res
 }
 
-func (wh *WatchHandler) buildIDs(ctx context.Context, podList *core1.PodList) {
-	for i := range podList.Items {
-
-		if podList.Items[i].Status.Phase != core1.PodRunning {
-			continue
-		}
-
-		podList.Items[i].APIVersion = "v1"
-		podList.Items[i].Kind = "Pod"
+// GetMutableTagContainers returns the containers whose images are referenced by a mutable tag, grouped by WLID
+func (wh *WatchHandler) GetMutableTagContainers() map[string][]string {
+	wh.wlidsToContainerToImageIDMapMutex.RLock()
+	defer wh.wlidsToContainerToImageIDMapMutex.RUnlock()
 
-		//check if at least one container is  running
-		hasOneContainerRunning := false
-		for _, containerStatus := range podList.Items[i].Status.ContainerStatuses {
-			if containerStatus.State.Running != nil {
-				hasOneContainerRunning = true
-				break
+	res := make(map[string][]string)
+	for wlid, containers := range wh.wlidsToContainerToImagePinnedMap {
+		for containerName, pinned := range containers {
+			if !pinned {
+				res[wlid] = append(res[wlid], containerName)
 			}
 		}
+	}
+	for wlid := range res {
+		sort.Strings(res[wlid])
+	}
+	return res
+}
 
-		if !hasOneContainerRunning {
-			continue
+// countDigestlessContainersUnsafe returns the number of tracked containers whose image was reported without a digest
+//
+// NOT THREAD SAFE! Assumes the caller is holding the WLIDs map lock.
+func (wh *WatchHandler) countDigestlessContainersUnsafe() int {
+	count := 0
+	for _, containers := range wh.wlidsToContainerToImageIDMap {
+		for _, imageID := range containers {
+			if _, err := extractImageHash(imageID); err != nil {
+				count++
+			}
 		}
+	}
+	return count
+}
 
-		wl, err := wh.getParentWorkloadForPod(&podList.Items[i])
-		if err != nil {
-			logger.L().Ctx(ctx).Error("Failed to get parent ID for pod", helpers.String("pod", podList.Items[i].Name), helpers.String("namespace", podList.Items[i].Namespace), helpers.Error(err))
-			continue
+// countMutableTagContainersUnsafe returns the number of tracked containers whose image is not pinned by digest
+//
+// NOT THREAD SAFE! Assumes the caller is holding the WLIDs map lock.
+func (wh *WatchHandler) countMutableTagContainersUnsafe() int {
+	count := 0
+	for _, containers := range wh.wlidsToContainerToImagePinnedMap {
+		for _, pinned := range containers {
+			if !pinned {
+				count++
+			}
 		}
+	}
+	return count
+}
 
-		parentWlid := pkgwlid.GetWLID(utils.ClusterConfig.ClusterName, wl.GetNamespace(), wl.GetKind(), wl.GetName())
+// setImagePinningArg attaches the known image pinning status of the command's containers to its arguments
+func (wh *WatchHandler) setImagePinningArg(cmd *apis.Command) {
+	containerToImageIDs, ok := cmd.Args[utils.ContainerToImageIdsArg].(map[string]string)
+	if !ok {
+		return
+	}
 
-		imgIDsToContainers := extractImageIDsToContainersFromPod(&podList.Items[i])
+	knownPinning := wh.GetContainerToImagePinnedForWlid(cmd.Wlid)
+	containerToImagePinned := make(map[string]bool)
+	for containerName := range containerToImageIDs {
+		if pinned, ok := knownPinning[containerName]; ok {
+			containerToImagePinned[containerName] = pinned
+		}
+	}
+	if len(containerToImagePinned) == 0 {
+		return
+	}
+	cmd.Args[utils.ContainerToImagePinnedArg] = containerToImagePinned
+}
 
-		instanceID, err := instanceidhandlerv1.GenerateInstanceIDFromPod(&podList.Items[i])
-		if err != nil {
-			logger.L().Ctx(ctx).Error("Failed to generate instance ID for pod", helpers.String("pod", podList.Items[i].Name), helpers.String("namespace", podList.Items[i].Namespace), helpers.Error(err))
-			continue
+// setContainerTypeArg attaches the known container types of the command's containers to its arguments
+func (wh *WatchHandler) setContainerTypeArg(cmd *apis.Command) {
+	containerToImageIDs, ok := cmd.Args[utils.ContainerToImageIdsArg].(map[string]string)
+	if !ok {
+		return
+	}
+
+	knownTypes := wh.GetContainerToContainerTypeForWlid(cmd.Wlid)
+	containerToContainerType := make(map[string]string)
+	for containerName := range containerToImageIDs {
+		if containerType, ok := knownTypes[containerName]; ok {
+			containerToContainerType[containerName] = containerType
 		}
+	}
+	if len(containerToContainerType) == 0 {
+		return
+	}
+	cmd.Args[utils.ContainerToContainerTypeArg] = containerToContainerType
+}
 
-		for i := range instanceID {
-			wh.addToInstanceIDsList(instanceID[i])
+func (wh *WatchHandler) addToWlidsToContainerToContainerTypeMap(wlid string, containerToContainerType map[string]string) {
+	wh.wlidsToContainerToImageIDMapMutex.Lock()
+	defer wh.wlidsToContainerToImageIDMapMutex.Unlock()
+
+	if _, ok := wh.wlidsToContainerToContainerTypeMap[wlid]; !ok {
+		wh.wlidsToContainerToContainerTypeMap[wlid] = make(map[string]string)
+	}
+	for containerName, containerType := range containerToContainerType {
+		wh.wlidsToContainerToContainerTypeMap[wlid][containerName] = containerType
+	}
+}
+
+func (wh *WatchHandler) addToWlidsToContainerToImagePinnedMap(wlid string, containerToImagePinned map[string]bool) {
+	wh.wlidsToContainerToImageIDMapMutex.Lock()
+	defer wh.wlidsToContainerToImageIDMapMutex.Unlock()
+
+	if _, ok := wh.wlidsToContainerToImagePinnedMap[wlid]; !ok {
+		wh.wlidsToContainerToImagePinnedMap[wlid] = make(map[string]bool)
+	}
+	for containerName, pinned := range containerToImagePinned {
+		wh.wlidsToContainerToImagePinnedMap[wlid][containerName] = pinned
+	}
+}
+
+func (wh *WatchHandler) addToInstanceIDsList(podUID types.UID, instanceID instanceidhandler.IInstanceID) {
+	wh.instanceIDsMutex.Lock()
+	defer wh.instanceIDsMutex.Unlock()
+	h, _ := instanceID.GetSlug()
+
+	wh.managedInstanceIDSlugs.Add(podUID, h)
+}
+
+// addToImageIDToWlidsMap adds WLIDs to those running the image hash of an image ID, see imageHashKey
+func (wh *WatchHandler) addToImageIDToWlidsMap(imageID string, wlids ...string) {
+	if len(wlids) == 0 {
+		return
+	}
+	wh.iwMap.Add(imageHashKey(imageID), wlids...)
+}
+
+// removeFromImageIDToWlidsMap removes a WLID from those running the image hash of an image ID, see imageHashKey
+func (wh *WatchHandler) removeFromImageIDToWlidsMap(imageID string, wlid string) {
+	wh.iwMap.Remove(imageHashKey(imageID), wlid)
+}
+
+func (wh *WatchHandler) addToWlidsToContainerToImageIDMap(wlid string, containerName string, imageID string) {
+	wh.wlidsToContainerToImageIDMapMutex.Lock()
+	defer wh.wlidsToContainerToImageIDMapMutex.Unlock()
+
+	if _, ok := wh.wlidsToContainerToImageIDMap[wlid]; !ok {
+		wh.wlidsToContainerToImageIDMap[wlid] = make(map[string]string)
+	}
+
+	wh.wlidsToContainerToImageIDMap[wlid][containerName] = imageID
+	wh.touchWlidUnsafe(wlid)
+}
+
+// replaceInWlidsToContainerToImageIDMap sets the image ID of a container of a given WLID, replacing the image it ran before
+//
+// If the WLID no longer runs the previous image, neither in another of its
+// containers nor in another of its Pods, the WLID is removed from the WLIDs of
+// the previous image
+func (wh *WatchHandler) replaceInWlidsToContainerToImageIDMap(wlid string, containerName string, imageID string) {
+	wh.wlidsToContainerToImageIDMapMutex.Lock()
+	defer wh.wlidsToContainerToImageIDMapMutex.Unlock()
+
+	if _, ok := wh.wlidsToContainerToImageIDMap[wlid]; !ok {
+		wh.wlidsToContainerToImageIDMap[wlid] = make(map[string]string)
+	}
+
+	previousImageID, hadImageID := wh.wlidsToContainerToImageIDMap[wlid][containerName]
+	wh.wlidsToContainerToImageIDMap[wlid][containerName] = imageID
+	if hadImageID && previousImageID != imageID && !wh.wlidUsesImageIDUnsafe(wlid, previousImageID) {
+		wh.removeFromImageIDToWlidsMap(previousImageID, wlid)
+	}
+	wh.touchWlidUnsafe(wlid)
+}
+
+// wlidUsesImageIDUnsafe reports whether a given WLID still runs the image ID, in any of its containers or Pods
+//
+// NOT THREAD SAFE! Assumes the caller is holding the WLIDs map lock.
+func (wh *WatchHandler) wlidUsesImageIDUnsafe(wlid string, imageID string) bool {
+	for _, containerImageID := range wh.wlidsToContainerToImageIDMap[wlid] {
+		if containerImageID == imageID {
+			return true
 		}
+	}
+	return wh.podImageIDs.WlidRunsImageID(wlid, imageID)
+}
 
-		for imgID, containers := range imgIDsToContainers {
-			wh.addToImageIDToWlidsMap(imgID, parentWlid)
-			for _, containerName := range containers {
-				wh.addToWlidsToContainerToImageIDMap(parentWlid, containerName, imgID)
+// forgetPod stops tracking the image IDs of a deleted Pod
+//
+// The WLID of the Pod is removed from the WLIDs of the images it no longer
+// runs in any of its containers or other Pods
+func (wh *WatchHandler) forgetPod(pod *core1.Pod) {
+	tracked, ok := wh.podImageIDs.Forget(pod.UID)
+	if !ok {
+		return
+	}
+
+	wh.wlidsToContainerToImageIDMapMutex.RLock()
+	defer wh.wlidsToContainerToImageIDMapMutex.RUnlock()
+
+	for _, imageID := range tracked.containerToImageIDs {
+		if !wh.wlidUsesImageIDUnsafe(tracked.wlid, imageID) {
+			wh.removeFromImageIDToWlidsMap(imageID, tracked.wlid)
+		}
+	}
+}
+
+// getChangedContainerToImageIDsForWlid returns a map of <containerName> : <imageID> for the containers of the Pod whose image ID differs from the one tracked for a given WLID
+func (wh *WatchHandler) getChangedContainerToImageIDsForWlid(wlid string, pod *core1.Pod) map[string]string {
+	wh.wlidsToContainerToImageIDMapMutex.RLock()
+	defer wh.wlidsToContainerToImageIDMapMutex.RUnlock()
+
+	changed := make(map[string]string)
+	for container, imageID := range wh.getContainersToImageIDsFromPod(pod) {
+		if trackedImageID, ok := wh.wlidsToContainerToImageIDMap[wlid][container]; ok && !utils.SameImageDigest(trackedImageID, imageID) {
+			changed[container] = imageID
+		}
+	}
+	return changed
+}
+
+// getUntrackedContainerToImageIDsForWlid returns a map of <containerName> : <imageID> for the containers of the Pod that a given WLID tracks no image ID for
+//
+// Containers are untracked regardless of their image being tracked, e.g. for
+// a sidecar running the same image as the main container
+func (wh *WatchHandler) getUntrackedContainerToImageIDsForWlid(wlid string, pod *core1.Pod) map[string]string {
+	wh.wlidsToContainerToImageIDMapMutex.RLock()
+	defer wh.wlidsToContainerToImageIDMapMutex.RUnlock()
+
+	untracked := make(map[string]string)
+	for container, imageID := range wh.getContainersToImageIDsFromPod(pod) {
+		if _, ok := wh.wlidsToContainerToImageIDMap[wlid][container]; !ok {
+			untracked[container] = imageID
+		}
+	}
+	return untracked
+}
+
+// buildIDs adds the IDs of every Pod produced by pods to the internal maps
+//
+// Pods are neither retained past the build nor mutated, so callers can stream
+// them from a pager or an informer store, but the Pods handed to the iterator
+// callback must stay unchanged until buildIDs returns. Pods that cannot be
+// processed are skipped.
+func (wh *WatchHandler) buildIDs(ctx context.Context, pods podIterator) error {
+	return wh.buildIDsInto(ctx, wh, pods)
+}
+
+// buildIDsInto adds the IDs of every Pod produced by pods to the internal maps of target
+//
+// Resolving the parents of Pods takes a round-trip to the API for each of
+// them, so Pods are handled by buildIDsWorkers workers concurrently. The maps
+// do not depend on the order Pods are handled in, unless Pods of the same WLID
+// run different images in a container, e.g. during a rollout, in which case
+// the image ID of any of them is tracked. It returns once every Pod is handled.
+func (wh *WatchHandler) buildIDsInto(ctx context.Context, target *WatchHandler, pods podIterator) error {
+	workers := wh.buildIDsWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	queue := make(chan *core1.Pod, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pod := range queue {
+				wh.buildIDsForPodInto(ctx, target, pod)
 			}
+		}()
+	}
+
+	err := pods(func(pod *core1.Pod) error {
+		queue <- pod
+		return nil
+	})
+	close(queue)
+	wg.Wait()
+	return err
+}
+
+// buildIDsForPodInto adds the IDs of a single Pod to the internal maps of target
+func (wh *WatchHandler) buildIDsForPodInto(ctx context.Context, target *WatchHandler, originalPod *core1.Pod) {
+	// recently completed Pods of Jobs are tracked as if they were still running
+	completedAt, completed := wh.recentJobPodCompletion(originalPod)
+	if completed {
+		originalPod = runningViewOfCompletedPod(originalPod)
+	}
+
+	if originalPod.Status.Phase != core1.PodRunning {
+		return
+	}
+
+	if wh.excludedNamespaces.Excludes(originalPod.Namespace) || !wh.podFilters.Admits(originalPod) {
+		return
+	}
+
+	//check if at least one container is  running
+	hasOneContainerRunning := false
+	for _, containerStatus := range originalPod.Status.ContainerStatuses {
+		if containerStatus.State.Running != nil {
+			hasOneContainerRunning = true
+			break
 		}
 	}
+
+	if !hasOneContainerRunning {
+		return
+	}
+
+	if wh.deferPodWithoutImageIDs(ctx, originalPod) {
+		return
+	}
+
+	// work on a copy, so the caller's object is not mutated. Only the
+	// TypeMeta is modified, so a shallow copy is enough
+	podCopy := *originalPod
+	pod := &podCopy
+	pod.APIVersion = "v1"
+	pod.Kind = "Pod"
+
+	parent, parentWlid, err := wh.getParentForPod(pod)
+	if err != nil {
+		logger.L().Ctx(ctx).Error("Failed to get parent ID for pod", helpers.String("pod", pod.Name), helpers.String("namespace", pod.Namespace), helpers.Error(err))
+		return
+	}
+
+	if !wh.workloadKinds.Admits(workloadKind(parent)) {
+		return
+	}
+
+	if wh.skipsImageScan(ctx, parentWlid, pod) {
+		return
+	}
+
+	if completed {
+		wh.completedJobPods.Track(pod, parent, completedAt)
+	}
+
+	wh.rescans.Track(parentWlid, wh.getRescanNonce(ctx, parentWlid, pod))
+
+	imgIDsToContainers := wh.getImageIDsToContainersFromPod(pod)
+	wh.podImageIDs.Track(pod.UID, parentWlid, wh.getContainersToImageIDsFromPod(pod))
+
+	instanceID, err := instanceidhandlerv1.GenerateInstanceIDFromPod(pod)
+	if err != nil {
+		logger.L().Ctx(ctx).Error("Failed to generate instance ID for pod", helpers.String("pod", pod.Name), helpers.String("namespace", pod.Namespace), helpers.Error(err))
+		return
+	}
+
+	for i := range instanceID {
+		target.addToInstanceIDsList(pod.UID, instanceID[i])
+	}
+
+	for imgID, containers := range imgIDsToContainers {
+		if _, err := extractImageHash(imgID); err != nil {
+			logDigestlessImage(ctx, pod, imgID, containers)
+		} else {
+			wh.imageDigests.Resolve(ctx, imgID)
+			target.addToImageIDToWlidsMap(imgID, parentWlid)
+		}
+		for _, containerName := range containers {
+			target.addToWlidsToContainerToImageIDMap(parentWlid, containerName, imgID)
+		}
+	}
+	target.addToWlidsToContainerToImagePinnedMap(parentWlid, extractContainersToImagePinnedFromPod(pod))
+	target.addToWlidsToContainerToContainerTypeMap(parentWlid, extractContainersToContainerTypeFromPod(pod))
 }
 
 // returns a watcher watching from current resource version
-func (wh *WatchHandler) getPodWatcher() (watch.Interface, error) {
-	podsWatch, err := wh.k8sAPI.KubernetesClient.CoreV1().Pods("").Watch(context.TODO(), v1.ListOptions{
-		ResourceVersion: wh.currentPodListResourceVersion,
-	})
+func (wh *WatchHandler) getPodWatcher(ctx context.Context) (watch.Interface, error) {
+	podsWatch, err := wh.k8sAPI.KubernetesClient.CoreV1().Pods("").Watch(ctx, wh.podWatchOptions())
 	if err != nil {
 		return nil, err
 	}
@@ -639,28 +1140,143 @@ func (wh *WatchHandler) getPodWatcher() (watch.Interface, error) {
 	return podsWatch, nil
 }
 
-func (wh *WatchHandler) restartResourceVersion(podWatch watch.Interface) error {
+// podListResourceVersion returns the current resource version of the Pods, which the Pod watch resumes from
+//
+// It is read by DumpState while the Pod watcher updates it, so it is atomic.
+func (wh *WatchHandler) podListResourceVersion() string {
+	resourceVersion, _ := wh.currentPodListResourceVersion.Load().(string)
+	return resourceVersion
+}
+
+// setPodListResourceVersion sets the current resource version of the Pods, see podListResourceVersion
+func (wh *WatchHandler) setPodListResourceVersion(resourceVersion string) {
+	wh.currentPodListResourceVersion.Store(resourceVersion)
+}
+
+// podWatchOptions returns the options of the Pod watch, resuming from the current resource version
+//
+// Bookmarks are requested, so the resource version is kept up to date even
+// when no Pod changes, see handlePodWatcher
+func (wh *WatchHandler) podWatchOptions() v1.ListOptions {
+	return v1.ListOptions{
+		ResourceVersion:     wh.podListResourceVersion(),
+		AllowWatchBookmarks: true,
+	}
+}
+
+func (wh *WatchHandler) restartResourceVersion(ctx context.Context, podWatch watch.Interface, handlePod func(pod *core1.Pod)) error {
 	podWatch.Stop()
-	return wh.updateResourceVersion()
+	return wh.updateResourceVersion(ctx, handlePod)
 }
 
-func (wh *WatchHandler) updateResourceVersion() error {
-	podsList, err := wh.k8sAPI.ListPods("", map[string]string{})
+// updateResourceVersion relists the Pods to get a fresh resource version to resume the Pod watch from, calling handlePod for each listed Pod
+//
+// The events between the last one the watch delivered and the list are never
+// delivered by a watch resumed from the fresh resource version, and new
+// images show up in such events. Callers must therefore handle the listed
+// Pods as modified before resuming the watch, so that no Pod running when it
+// resumes is missing from the internal maps: Pods already tracked trigger
+// nothing, while Pods created or changed in the meantime trigger their scans.
+// Pods deleted in the meantime are forgotten by the next cleanUp.
+//
+// The list is not older than the current resource version, so that it may
+// be served from the watch cache of the API server, unless none is known.
+func (wh *WatchHandler) updateResourceVersion(ctx context.Context, handlePod func(pod *core1.Pod)) error {
+	resourceVersion, err := wh.listPodsWith(ctx, wh.podRelistOptions(), func(pod *core1.Pod) error {
+		handlePod(pod)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	wh.currentPodListResourceVersion = podsList.GetResourceVersion()
+	wh.setPodListResourceVersion(resourceVersion)
+	wh.podWatchdog.Relisted()
 	return nil
 }
 
+// podRelistOptions returns the options of the relists of the Pods, not older than the current resource version if any
+func (wh *WatchHandler) podRelistOptions() v1.ListOptions {
+	if wh.podListResourceVersion() == "" {
+		return v1.ListOptions{}
+	}
+	return v1.ListOptions{
+		ResourceVersion:      wh.podListResourceVersion(),
+		ResourceVersionMatch: v1.ResourceVersionMatchNotOlderThan,
+	}
+}
+
+// restartStalePodWatch relists the Pods while the Pod watch has delivered nothing for the staleness window,
+// stopping the watch if it is stuck, i.e. the resource version moved since its last event. It returns true if
+// the watch was stopped, to be established again from the fresh resource version, once the relisted Pods
+// are handled by handlePod
+//
+// A single Pod is listed first to get the current resource version, so that
+// the Pods are only relisted, and handled as they are, if the watch missed
+// events.
+func (wh *WatchHandler) restartStalePodWatch(ctx context.Context, podsWatch watch.Interface, lastResourceVersion string, handlePod func(pod *core1.Pod)) bool {
+	staleness := wh.podWatchdog.Staleness()
+	resourceVersion, err := wh.latestPodListResourceVersion(ctx)
+	if err != nil {
+		logger.L().Ctx(ctx).Error(fmt.Sprintf("error to latestPodListResourceVersion, err :%s", err.Error()), helpers.Error(err))
+		return false
+	}
+	if resourceVersion == lastResourceVersion {
+		// the cluster is quiet, the watch has nothing to deliver
+		wh.podWatchdog.Relisted()
+		return false
+	}
+
+	logger.L().Ctx(ctx).Info("pod watch delivered no events while the cluster changed, restarting it",
+		helpers.String("staleness", staleness.String()),
+		helpers.String("lastResourceVersion", lastResourceVersion),
+		helpers.String("resourceVersion", resourceVersion))
+	wh.metrics.Inc(metricStalePodWatchRestartsTotal)
+	podsWatch.Stop()
+	if err := wh.updateResourceVersion(ctx, handlePod); err != nil {
+		// the watch is established again from the current resource version
+		logger.L().Ctx(ctx).Error(fmt.Sprintf("error to updateResourceVersion, err :%s", err.Error()), helpers.Error(err))
+	}
+	return true
+}
+
+// latestPodListResourceVersion returns the resource version of the Pods not older than the current one, listing a single Pod
+func (wh *WatchHandler) latestPodListResourceVersion(ctx context.Context) (string, error) {
+	listOptions := wh.podRelistOptions()
+	listOptions.Limit = 1
+	podList, err := wh.k8sAPI.KubernetesClient.CoreV1().Pods("").List(ctx, listOptions)
+	if err != nil {
+		return "", err
+	}
+	return podList.GetResourceVersion(), nil
+}
+
+// resetResourceVersion forgets the current resource version, as it expired, and relists the Pods to get a fresh one, see updateResourceVersion
+//
+// The resource version is cleared first, so that the watch is established
+// from the most recent one rather than the expired one if the relist fails.
+func (wh *WatchHandler) resetResourceVersion(ctx context.Context, handlePod func(pod *core1.Pod)) error {
+	wh.setPodListResourceVersion("")
+	return wh.updateResourceVersion(ctx, handlePod)
+}
+
+// isResourceVersionExpired returns true if the error reports that a resource version is too old to watch from
+func isResourceVersionExpired(err error) bool {
+	return k8serrors.IsResourceExpired(err) || k8serrors.IsGone(err)
+}
+
 // returns a map of <imageID> : <containerName> for imageIDs in pod that are not in the map
 func (wh *WatchHandler) getNewContainerToImageIDsFromPod(pod *core1.Pod) map[string]string {
 	newContainerToImageIDs := make(map[string]string)
-	imageIDsToContainers := extractImageIDsToContainersFromPod(pod)
+	imageIDsToContainers := wh.getImageIDsToContainersFromPod(pod)
 
 	for imageID, containers := range imageIDsToContainers {
+		// the containers of images without a digest are new if their WLID does not track them, see getUntrackedContainerToImageIDsForWlid
+		if _, err := extractImageHash(imageID); err != nil {
+			continue
+		}
 		for _, container := range containers {
-			if _, imageIDinMap := wh.iwMap.Load(imageID); !imageIDinMap {
+			// image IDs are compared by digest, as runtimes report different repositories for the same image
+			if !wh.iwMap.HasDigest(imageID) {
 				newContainerToImageIDs[container] = imageID
 			}
 		}
@@ -678,6 +1294,10 @@ func (wh *WatchHandler) getPodFromEventIfRunning(ctx context.Context, event watc
 	if val, ok := event.Object.(*core1.Pod); ok {
 		pod = val
 		if pod.Status.Phase != core1.PodRunning {
+			// recently completed Pods of Jobs are handled as if they were still running
+			if _, completed := wh.recentJobPodCompletion(pod); completed {
+				return runningViewOfCompletedPod(pod), true
+			}
 			return nil, false
 		}
 	} else {
@@ -685,7 +1305,16 @@ func (wh *WatchHandler) getPodFromEventIfRunning(ctx context.Context, event watc
 		return nil, false
 	}
 
-	// check that Pod exists (when deleting a Pod we get MODIFIED events with Running status)
+	// when deleting a Pod we get MODIFIED events with Running status
+	if pod.GetDeletionTimestamp() != nil {
+		return nil, false
+	}
+	if hasRunningContainer(pod) {
+		return pod, true
+	}
+
+	// no container is running, the Pod may be terminating without the event
+	// telling so. Check that the Pod still exists
 	_, err := wh.k8sAPI.GetWorkload(pod.GetNamespace(), "pod", pod.GetName())
 	if err != nil {
 		return nil, false
@@ -694,121 +1323,455 @@ func (wh *WatchHandler) getPodFromEventIfRunning(ctx context.Context, event watc
 	return pod, true
 }
 
-func (wh *WatchHandler) getParentIDForPod(pod *core1.Pod) (string, error) {
-	pod.TypeMeta.Kind = "Pod"
-	podMarshalled, err := json.Marshal(pod)
-	if err != nil {
-		return "", err
+// hasRunningContainer reports whether any regular or ephemeral container of the Pod is running
+func hasRunningContainer(pod *core1.Pod) bool {
+	for _, statuses := range [][]core1.ContainerStatus{pod.Status.ContainerStatuses, pod.Status.EphemeralContainerStatuses} {
+		for i := range statuses {
+			if statuses[i].State.Running != nil {
+				return true
+			}
+		}
 	}
-	wl, err := workloadinterface.NewWorkload(podMarshalled)
+	return false
+}
+
+// getParentForPod returns the top-level parent workload of a Pod along with its WLID
+//
+// The parent is not fetched from the API: unless the Pod is its own parent,
+// the returned workload only identifies the parent by kind, namespace and name
+func (wh *WatchHandler) getParentForPod(pod *core1.Pod) (workloadinterface.IWorkload, string, error) {
+	wl, err := podToWorkload(pod)
 	if err != nil {
-		return "", err
+		return nil, "", err
 	}
-	kind, name, err := wh.k8sAPI.CalculateWorkloadParentRecursive(wl)
-	if err != nil {
-		return "", err
+
+	kind, name, ok := resolvePodParentLocally(pod)
+	if !ok {
+		kind, name, err = wh.calculateWorkloadParent(wl)
+		if err != nil {
+			return nil, "", err
+		}
 	}
-	return pkgwlid.GetWLID(utils.ClusterConfig.ClusterName, wl.GetNamespace(), kind, name), nil
 
+	parentWlid := pkgwlid.GetWLID(utils.ClusterConfig.ClusterName, wl.GetNamespace(), kind, name)
+	if kind == "Pod" && name == wl.GetName() {
+		return wl, parentWlid, nil
+	}
+	return newWorkloadReference(wl.GetNamespace(), kind, name), parentWlid, nil
 }
 
-func (wh *WatchHandler) getParentWorkloadForPod(pod *core1.Pod) (workloadinterface.IWorkload, error) {
-	pod.TypeMeta.Kind = "Pod"
-	podMarshalled, err := json.Marshal(pod)
+// podToWorkload returns a Pod as a workload, without mutating it
+func podToWorkload(pod *core1.Pod) (workloadinterface.IWorkload, error) {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pod)
 	if err != nil {
 		return nil, err
 	}
-	wl, err := workloadinterface.NewWorkload(podMarshalled)
-	if err != nil {
-		return nil, err
+	// the TypeMeta of typed objects received from the API is usually empty
+	obj["apiVersion"] = "v1"
+	obj["kind"] = "Pod"
+	return workloadinterface.NewWorkloadObj(obj), nil
+}
+
+// newWorkloadReference returns a workload identifying a workload by kind, namespace and name only
+func newWorkloadReference(namespace, kind, name string) workloadinterface.IWorkload {
+	return workloadinterface.NewWorkloadObj(map[string]interface{}{
+		"kind": kind,
+		"metadata": map[string]interface{}{
+			"namespace": namespace,
+			"name":      name,
+		},
+	})
+}
+
+// calculateWorkloadParent returns the kind and name of the top-level parent of a workload
+//
+// Jobs created by a CronJob are resolved to the CronJob even if the CronJob
+// cannot be fetched, so that every run of a CronJob shares the same WLID
+// instead of producing a new one per Job.
+//
+// Standalone Pods and Pods owned by a resource that cannot be resolved, e.g. a
+// custom resource, are their own parent. So are static Pods, whose mirror Pods
+// are owned by their Node: like their instance IDs, their WLIDs are Pod-kind,
+// so that the control plane components of a Node are tracked separately.
+//
+// The parents resolved for the owners of Pods are cached by owner UID.
+func (wh *WatchHandler) calculateWorkloadParent(wl workloadinterface.IWorkload) (string, string, error) {
+	if isMirrorPod(wl) {
+		return "Pod", wl.GetName(), nil
+	}
+
+	key, cacheable := wh.parentCacheKeyOf(wl)
+	if cacheable {
+		if kind, name, ok := wh.parents.Get(key); ok {
+			wh.metrics.Inc(metricParentCacheHitsTotal)
+			return kind, name, nil
+		}
+		wh.metrics.Inc(metricParentCacheMissesTotal)
+	}
+
+	kind, name, err := wh.calculateWorkloadParentFromOwners(wl)
+	if cacheable {
+		// Pods that are their own parent are not cached, as the other Pods
+		// of the same owner have different names
+		if err != nil || kind == "Pod" {
+			wh.parents.Invalidate(key)
+		} else {
+			wh.parents.Add(key, kind, name)
+		}
 	}
+	return kind, name, err
+}
+
+// parentCacheKeyOf returns the key of the parent cache for a Pod, false if its parent is not cached
+func (wh *WatchHandler) parentCacheKeyOf(wl workloadinterface.IWorkload) (parentCacheKey, bool) {
+	if wh.parents == nil || wl.GetKind() != "Pod" {
+		return parentCacheKey{}, false
+	}
+	ownerReferences, err := wl.GetOwnerReferences()
+	if err != nil || len(ownerReferences) == 0 || ownerReferences[0].UID == "" {
+		return parentCacheKey{}, false
+	}
+	return parentCacheKey{namespace: wl.GetNamespace(), ownerUID: ownerReferences[0].UID}, true
+}
 
+// calculateWorkloadParentFromAPI resolves the top-level parent of a workload by fetching its owners
+func (wh *WatchHandler) calculateWorkloadParentFromAPI(wl workloadinterface.IWorkload) (string, string, error) {
 	kind, name, err := wh.k8sAPI.CalculateWorkloadParentRecursive(wl)
-	if kind == "Node" {
-		return wl, nil
+	if kind == "Job" {
+		if cronJobName, ok := wh.getCronJobOwnerOfJob(wl.GetNamespace(), name); ok {
+			return "CronJob", cronJobName, nil
+		}
+	}
+	if err != nil && wl.GetKind() == "Pod" && kind == "Pod" && !isOwnedByBuiltinController(wl) {
+		return "Pod", wl.GetName(), nil
+	}
+	return kind, name, err
+}
+
+// isOwnedByBuiltinController returns true if the workload is owned by a built-in Kubernetes controller
+//
+// Failing to resolve such an owner is an actual error, unlike failing to
+// resolve a custom resource the operator might not have access to
+func isOwnedByBuiltinController(wl workloadinterface.IWorkload) bool {
+	ownerReferences, err := wl.GetOwnerReferences()
+	if err != nil || len(ownerReferences) == 0 {
+		return false
+	}
+	return slices.Contains(builtinControllerKinds, ownerReferences[0].Kind)
+}
+
+// isMirrorPod returns true if the workload is the mirror Pod of a static Pod, i.e. a Pod owned by a Node
+func isMirrorPod(wl workloadinterface.IWorkload) bool {
+	if wl.GetKind() != "Pod" {
+		return false
+	}
+	ownerReferences, err := wl.GetOwnerReferences()
+	if err != nil || len(ownerReferences) == 0 {
+		return false
 	}
+	return ownerReferences[0].Kind == nodeKind
+}
 
+// getCronJobOwnerOfJob returns the name of the CronJob that owns a given Job, if any
+func (wh *WatchHandler) getCronJobOwnerOfJob(namespace, jobName string) (string, bool) {
+	job, err := wh.k8sAPI.GetWorkload(namespace, "Job", jobName)
 	if err != nil {
-		return nil, err
+		return "", false
 	}
-	parentWorkload, err := wh.k8sAPI.GetWorkload(wl.GetNamespace(), kind, name)
+	ownerReferences, err := job.GetOwnerReferences()
 	if err != nil {
-		return nil, err
+		return "", false
+	}
+	for _, ownerReference := range ownerReferences {
+		if ownerReference.Kind == "CronJob" {
+			return ownerReference.Name, true
+		}
 	}
-	return parentWorkload, nil
+	return "", false
 }
 
-func (wh *WatchHandler) handlePodWatcher(ctx context.Context, podsWatch watch.Interface, sessionObjChan *chan utils.SessionObj) {
-	var err error
+// handlePodWatcher handles the events of a Pod watch until it ends, returning why it did
+//
+// The returned error wraps ErrPodWatchClosed if the watch can be established
+// again, ErrPodRelistFailed if the Pods failed to be relisted to resume it,
+// or ErrPodWatchCancelled if the context is done.
+func (wh *WatchHandler) handlePodWatcher(ctx context.Context, podsWatch watch.Interface, commands *commandDeduper) error {
+	// resumable is set once a bookmark provides a resource version to resume
+	// the watch from, so that no full relist is needed when it closes
+	resumable := false
+	// lastResourceVersion is the resource version of the last event, to
+	// tell stuck watches from quiet clusters, see podWatchdog
+	lastResourceVersion := wh.podListResourceVersion()
+	wh.podWatchdog.Received()
+	staleChecks, stopStaleChecks := wh.podWatchdog.checks()
+	defer stopStaleChecks()
+	// the events of Pods are handled by workers, which are done with them
+	// once the watcher returns
+	pods := newPodQueue(wh.podEventRetries, &wh.metrics)
+	pods.Run(ctx, wh.podWatchWorkers, func(event watch.Event) error {
+		return wh.handlePodEvent(ctx, event, commands)
+	})
+	defer pods.ShutDown()
+	// the Pods relisted before the watch is established again are handled
+	// before it is, as the queue is drained once the watcher returns
+	requeuePod := func(pod *core1.Pod) {
+		pods.Add(pod, watch.Event{Type: watch.Modified, Object: pod})
+	}
 	for {
-		event, ok := <-podsWatch.ResultChan()
-		if !ok {
-			err = wh.restartResourceVersion(podsWatch)
-			if err != nil {
-				logger.L().Ctx(ctx).Error(fmt.Sprintf("error to restartResourceVersion, err :%s", err.Error()), helpers.Error(err))
+		var event watch.Event
+		var ok bool
+		select {
+		case <-wh.readiness.Wake():
+			// the gated Pods that stayed ready for the stabilization delay
+			// produce no event
+			for _, pod := range wh.readiness.Due() {
+				pods.Add(pod, watch.Event{Type: watch.Modified, Object: pod})
+			}
+			continue
+		case <-staleChecks:
+			if wh.podWatchdog.Stale() && wh.restartStalePodWatch(ctx, podsWatch, lastResourceVersion, requeuePod) {
+				return fmt.Errorf("%w: no events while the cluster changed", ErrPodWatchClosed)
 			}
-			return
+			continue
+		case <-ctx.Done():
+			podsWatch.Stop()
+			return fmt.Errorf("%w: %w", ErrPodWatchCancelled, ctx.Err())
+		case event, ok = <-podsWatch.ResultChan():
 		}
-
-		pod, ok := wh.getPodFromEventIfRunning(ctx, event)
 		if !ok {
-			continue
+			if resumable {
+				podsWatch.Stop()
+				return ErrPodWatchClosed
+			}
+			if err := wh.restartResourceVersion(ctx, podsWatch, requeuePod); err != nil {
+				logger.L().Ctx(ctx).Error(fmt.Sprintf("error to restartResourceVersion, err :%s", err.Error()), helpers.Error(err))
+				return fmt.Errorf("%w: %w", ErrPodRelistFailed, err)
+			}
+			return ErrPodWatchClosed
 		}
-
-		pod.APIVersion = "v1"
-		pod.Kind = "Pod"
-
-		parentWlid, err := wh.getParentIDForPod(pod)
-		if err != nil {
-			logger.L().Ctx(ctx).Error(fmt.Sprintf("error to getParentIDForPod, err :%s", err.Error()), helpers.Error(err))
-			continue
+		// bookmarks count as activity, so that a quiet cluster does not make the watcher unhealthy
+		wh.health.Processed(PodWatcherName)
+		wh.podWatchdog.Received()
+		if pod, ok := event.Object.(*core1.Pod); ok && pod.ResourceVersion != "" {
+			lastResourceVersion = pod.ResourceVersion
 		}
 
-		newContainersToImageIDs := wh.getNewContainerToImageIDsFromPod(pod)
-
-		var cmd *apis.Command
-		if len(newContainersToImageIDs) > 0 {
-			// new image, add to respective maps
-			for container, imgID := range newContainersToImageIDs {
-				wh.addToImageIDToWlidsMap(imgID, parentWlid)
-				wh.addToWlidsToContainerToImageIDMap(parentWlid, container, imgID)
+		switch event.Type {
+		case watch.Bookmark:
+			// bookmarks only carry a resource version, never a Pod to handle
+			if resourceVersion, ok := resourceVersionFromBookmark(event); ok {
+				wh.setPodListResourceVersion(resourceVersion)
+				resumable = true
 			}
-			// new image, trigger SBOM
-			cmd = getImageScanCommand(parentWlid, newContainersToImageIDs)
-		} else {
-			// old image
-			if wh.isWlidInMap(parentWlid) {
-				// old workload, no need to trigger CVE
-				continue
+		case watch.Error:
+			statusErr := wh.watchStatusError(event)
+			wh.reportError(ctx, PodWatcherName, statusErr)
+			// the watch failed, so it is restarted rather than waiting for it to close
+			podsWatch.Stop()
+			var err error
+			// the resource version is too old to resume from
+			if isResourceVersionExpired(k8serrors.FromObject(event.Object)) {
+				err = wh.resetResourceVersion(ctx, requeuePod)
+			} else if !resumable {
+				err = wh.updateResourceVersion(ctx, requeuePod)
+			}
+			if err != nil {
+				logger.L().Ctx(ctx).Error(fmt.Sprintf("error to updateResourceVersion, err :%s", err.Error()), helpers.Error(err))
+				return fmt.Errorf("%w: %w", ErrPodRelistFailed, err)
 			}
-			// new workload, trigger CVE
-			containersToImageIds := utils.ExtractContainersToImageIDsFromPod(pod)
-			for container, imgID := range containersToImageIds {
-				wh.addToWlidsToContainerToImageIDMap(parentWlid, container, imgID)
+			return fmt.Errorf("%w: %w", ErrPodWatchClosed, statusErr)
+		case watch.Modified, watch.Deleted:
+			if pod, ok := event.Object.(*core1.Pod); ok {
+				pods.Add(pod, event)
+			} else if event.Type == watch.Modified {
+				logger.L().Ctx(ctx).Error("Failed to cast event object to pod", helpers.Error(fmt.Errorf("failed to cast event object to pod")))
 			}
-			cmd = getImageScanCommand(parentWlid, containersToImageIds)
 		}
+	}
+}
 
-		// generate instance IDs
-		instanceID, err := instanceidhandlerv1.GenerateInstanceIDFromPod(pod)
-		if err != nil {
-			logger.L().Ctx(ctx).Error("Failed to generate instance ID for pod", helpers.String("pod", pod.GetName()), helpers.String("namespace", pod.GetNamespace()), helpers.Error(err))
-			continue
+// handlePodEvent updates the internal maps with a Pod event and submits the scan commands it triggers
+//
+// An error is returned if the event should be retried. It is returned before
+// the internal maps are updated, so that retrying the event triggers the same
+// command.
+func (wh *WatchHandler) handlePodEvent(ctx context.Context, event watch.Event, commands *commandDeduper) error {
+	eventPod, ok := event.Object.(*core1.Pod)
+	if !ok {
+		// e.g. the Status of an Error event, which the watch loop handles
+		logger.L().Ctx(ctx).Warning("skipping a Pod event without a Pod",
+			helpers.String("eventType", string(event.Type)),
+			helpers.String("object", fmt.Sprintf("%T", event.Object)))
+		return nil
+	}
+
+	if event.Type == watch.Deleted {
+		// the completed Pods of Jobs are retained until they leave the window
+		wh.deletionBursts.Deleted()
+		wh.readiness.Forget(eventPod.UID)
+		wh.succeededJobPods.Forget(eventPod.UID)
+		if !wh.completedJobPods.Has(eventPod.UID) {
+			wh.forgetPod(eventPod)
 		}
+		return nil
+	}
+
+	if wh.scanSucceededJobPod(ctx, event, commands) {
+		return nil
+	}
+
+	pod, ok := wh.getPodFromEventIfRunning(ctx, event)
+	if !ok {
+		return nil
+	}
+
+	if wh.excludedNamespaces.Excludes(pod.Namespace) || !wh.podFilters.Admits(pod) {
+		return nil
+	}
+
+	pod.APIVersion = "v1"
+	pod.Kind = "Pod"
 
-		// save on map
+	pod = wh.latestPodWithImageIDs(ctx, pod)
+	// a rebuild of the maps in progress replays the Pod onto the rebuilt maps
+	wh.rebuild.record(pod)
+
+	if wh.deferPodWithoutImageIDs(ctx, pod) {
+		// the event is retried, until it is dropped once out of retries, in
+		// case no later event reports the missing image IDs
+		return fmt.Errorf("%w: containers of the Pod report no image ID yet", ErrUnknownImageHash)
+	}
+
+	parent, parentWlid, err := wh.getParentForPod(pod)
+	if err != nil {
+		return fmt.Errorf("error to getParentForPod: %w", err)
+	}
+
+	if !wh.workloadKinds.Admits(workloadKind(parent)) {
+		logger.L().Ctx(ctx).Debug("workload kind is not tracked, no triggering", helpers.String("wlid", parentWlid))
+		return nil
+	}
+
+	if wh.skipsImageScan(ctx, parentWlid, pod) {
+		logger.L().Ctx(ctx).Debug("workload opted out of image scanning, no triggering", helpers.String("wlid", parentWlid))
+		return nil
+	}
+
+	// generate instance IDs. They are only generated for the regular
+	// containers, so ephemeral containers get scanned without relevancy
+	instanceID, err := instanceidhandlerv1.GenerateInstanceIDFromPod(pod)
+	if err != nil {
+		return fmt.Errorf("failed to generate instance ID for pod %s/%s: %w", pod.GetNamespace(), pod.GetName(), err)
+	}
+
+	// of the Pod of the event rather than its running view, see getPodFromEventIfRunning
+	completedAt, completed := wh.recentJobPodCompletion(eventPod)
+	if completed {
+		wh.completedJobPods.Track(pod, parent, completedAt)
+	}
+
+	// the tracked image IDs of the Pod are updated first, so that the
+	// images it no longer runs are not considered in use by its WLID
+	restartedContainersToImageIDs := wh.podImageIDs.Update(pod.UID, parentWlid, wh.getContainersToImageIDsFromPod(pod))
+	// along with the Pod of the WLID, whose instance IDs are forgotten once evicted
+	wh.trackWlidPod(parentWlid, pod.UID)
+
+	wh.removeTerminatedEphemeralContainers(parentWlid, pod)
+
+	newContainersToImageIDs := wh.getNewContainerToImageIDsFromPod(pod)
+	// containers whose image changed, e.g. a mutable tag resolving to a
+	// new digest, are rescanned even if the new image is already known
+	for container, imgID := range wh.getChangedContainerToImageIDsForWlid(parentWlid, pod) {
+		newContainersToImageIDs[container] = imgID
+	}
+	// as are containers of the Pod that restarted with another image
+	for container, imgID := range restartedContainersToImageIDs {
+		newContainersToImageIDs[container] = imgID
+	}
+	// as are containers the WLID does not track yet, even if their image is,
+	// e.g. new workloads of known images or sidecars sharing an image
+	for container, imgID := range wh.getUntrackedContainerToImageIDsForWlid(parentWlid, pod) {
+		newContainersToImageIDs[container] = imgID
+	}
+
+	// completed Pods never become ready, so they are not gated
+	if !completed && !wh.readiness.Admit(pod) {
+		// the new images of a Pod that is not ready yet are held until
+		// it is, while its instance IDs are registered right away so
+		// that its relevancy objects are kept in the meantime
+		logger.L().Ctx(ctx).Debug("pod is not ready yet, no triggering", helpers.String("pod", pod.GetName()), helpers.String("namespace", pod.GetNamespace()))
+		wh.readiness.Hold(pod.UID, newContainersToImageIDs)
 		for i := range instanceID {
-			wh.addToInstanceIDsList(instanceID[i])
+			wh.addToInstanceIDsList(pod.UID, instanceID[i])
+		}
+		return nil
+	}
+	currentContainersToImageIDs := wh.getContainersToImageIDsFromPod(pod)
+	for container, imgID := range wh.readiness.Release(pod.UID) {
+		// unless the container runs another image since
+		if currentContainersToImageIDs[container] == imgID {
+			newContainersToImageIDs[container] = imgID
 		}
+	}
 
-		utils.AddCommandToChannel(ctx, cmd, sessionObjChan)
+	rescan := wh.rescans.Update(parentWlid, wh.getRescanNonce(ctx, parentWlid, pod))
+
+	var cmd *apis.Command
+	if len(newContainersToImageIDs) > 0 {
+		// new containers or images, add to respective maps. Containers are
+		// replaced first, so that images they no longer run are released
+		// before the new ones are associated with the WLID, once per image
+		imageIDsToContainers := make(map[string][]string, len(newContainersToImageIDs))
+		for container, imgID := range newContainersToImageIDs {
+			wh.replaceInWlidsToContainerToImageIDMap(parentWlid, container, imgID)
+			imageIDsToContainers[imgID] = append(imageIDsToContainers[imgID], container)
+		}
+		for imgID, containers := range imageIDsToContainers {
+			// images without a digest are scanned by tag, but not tracked by image hash
+			if _, err := extractImageHash(imgID); err != nil {
+				sort.Strings(containers)
+				logDigestlessImage(ctx, pod, imgID, containers)
+				continue
+			}
+			wh.imageDigests.Resolve(ctx, imgID)
+			wh.addToImageIDToWlidsMap(imgID, parentWlid)
+		}
+		// trigger SBOM
+		cmd = getImageScanCommand(parentWlid, newContainersToImageIDs)
+	} else if !rescan {
+		// every container of the Pod is tracked already, no need to trigger CVE
+		return nil
+	}
+	if rescan {
+		// a rescan was requested, scan all the containers of the workload
+		logger.L().Ctx(ctx).Info("rescan requested for workload", helpers.String("wlid", parentWlid))
+		cmd = getImageScanCommand(parentWlid, wh.copyContainerToImageIDForWlid(parentWlid))
 	}
-}
 
-func (wh *WatchHandler) isWlidInMap(wlid string) bool {
-	wh.wlidsToContainerToImageIDMapMutex.RLock()
-	defer wh.wlidsToContainerToImageIDMapMutex.RUnlock()
+	// save on map
+	for i := range instanceID {
+		wh.addToInstanceIDsList(pod.UID, instanceID[i])
+	}
+
+	wh.addToWlidsToContainerToImagePinnedMap(parentWlid, extractContainersToImagePinnedFromPod(pod))
+	wh.addToWlidsToContainerToContainerTypeMap(parentWlid, extractContainersToContainerTypeFromPod(pod))
+	// images scanned from the Pod template of the workload already are not
+	// scanned again, unless a rescan was requested
+	if !rescan && !wh.reconcilePrescans(ctx, pod, cmd) {
+		return nil
+	}
+	wh.setImagePinningArg(cmd)
+	wh.setContainerTypeArg(cmd)
 
-	_, ok := wh.wlidsToContainerToImageIDMap[wlid]
-	return ok
+	commands.Submit(cmd)
+	return nil
+}
+
+// resourceVersionFromBookmark returns the resource version carried by a bookmark event
+func resourceVersionFromBookmark(event watch.Event) (string, bool) {
+	pod, ok := event.Object.(*core1.Pod)
+	if !ok || pod.GetResourceVersion() == "" {
+		return "", false
+	}
+	return pod.GetResourceVersion(), true
 }
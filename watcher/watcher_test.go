@@ -2,39 +2,193 @@ package watcher
 
 import (
 	"context"
+	"crypto/sha256"
 	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"reflect"
 	"sort"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/armosec/armoapi-go/apis"
+	pkgwlid "github.com/armosec/utils-k8s-go/wlid"
 	instanceidv1 "github.com/kubescape/k8s-interface/instanceidhandler/v1"
+	"github.com/kubescape/k8s-interface/k8sinterface"
 	"github.com/kubescape/operator/utils"
 	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
 	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
 	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	core1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	"k8s.io/apimachinery/pkg/apis/meta/internalversion/validation"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes"
 	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 const (
-	deletesQuickFix = "Deletes have been disabled for a quick hack"
-
 	validImageID     = "docker-pullable://alpine@sha256:c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ee"
 	validImageIDSlug = "docker-pullable-alpine-sha256-c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ee-70f2ee"
 )
 
+// testDigest returns a well-formed digest derived from a seed, for the image IDs built by the tests
+func testDigest(seed string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(seed)))
+}
+
 func NewWatchHandlerMock() *WatchHandler {
 	return &WatchHandler{
-		iwMap:                             NewImageHashWLIDsMap(),
-		wlidsToContainerToImageIDMap:      make(map[string]map[string]string),
-		wlidsToContainerToImageIDMapMutex: &sync.RWMutex{},
-		instanceIDsMutex:                  &sync.RWMutex{},
+		iwMap:                              NewImageHashWLIDsMap(),
+		wlidsToContainerToImageIDMap:       make(map[string]map[string]string),
+		wlidsToContainerToImagePinnedMap:   make(map[string]map[string]bool),
+		wlidsToContainerToContainerTypeMap: make(map[string]map[string]string),
+		wlidsToContainerToImageIDMapMutex:  &sync.RWMutex{},
+		instanceIDsMutex:                   &sync.RWMutex{},
+		managedInstanceIDSlugs:             newPodInstanceIDs(),
+	}
+}
+
+// newK8sAPIFake returns a Kubernetes API with fake Kubernetes and Dynamic
+// clients that both serve the provided objects
+func newK8sAPIFake(objects ...runtime.Object) (*k8sinterface.KubernetesApi, *k8sfake.Clientset) {
+	k8sinterface.InitializeMapResourcesMock()
+	k8sClient := k8sfake.NewSimpleClientset(objects...)
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(scheme.Scheme, objects...)
+	return utils.NewK8sInterfaceFakeWithDynamicClient(k8sClient, dynamicClient), k8sClient
+}
+
+// podFakeOption modifies a Pod returned by newRunningPodFake
+type podFakeOption func(pod *core1.Pod)
+
+// withOwner makes the Pod owned by the given owner
+func withOwner(owner v1.OwnerReference) podFakeOption {
+	return func(pod *core1.Pod) {
+		pod.OwnerReferences = []v1.OwnerReference{owner}
+	}
+}
+
+// withJobOwner makes the Pod owned by the Job with the given name, whose UID is its name
+func withJobOwner(jobName string) podFakeOption {
+	return withOwner(v1.OwnerReference{APIVersion: "batch/v1", Kind: "Job", Name: jobName, UID: types.UID(jobName)})
+}
+
+// withLabels sets the labels of the Pod
+func withLabels(labels map[string]string) podFakeOption {
+	return func(pod *core1.Pod) {
+		pod.Labels = labels
+	}
+}
+
+// withUID sets the UID of the Pod
+func withUID(uid types.UID) podFakeOption {
+	return func(pod *core1.Pod) {
+		pod.UID = uid
+	}
+}
+
+// withContainerStates sets the phase of the Pod and the state of all its containers
+func withContainerStates(phase core1.PodPhase, state core1.ContainerState) podFakeOption {
+	return func(pod *core1.Pod) {
+		pod.Status.Phase = phase
+		for i := range pod.Status.ContainerStatuses {
+			pod.Status.ContainerStatuses[i].State = state
+		}
+	}
+}
+
+// withCompletion makes the Pod completed in the given phase, its containers terminated at finishedAt
+func withCompletion(phase core1.PodPhase, finishedAt time.Time) podFakeOption {
+	return withContainerStates(phase, core1.ContainerState{Terminated: &core1.ContainerStateTerminated{FinishedAt: v1.NewTime(finishedAt)}})
+}
+
+// withDeletion marks the Pod for graceful deletion
+func withDeletion() podFakeOption {
+	return func(pod *core1.Pod) {
+		deletionTimestamp := v1.Now()
+		gracePeriodSeconds := int64(30)
+		pod.DeletionTimestamp = &deletionTimestamp
+		pod.DeletionGracePeriodSeconds = &gracePeriodSeconds
+	}
+}
+
+// withImageID sets the image ID reported by a container of the Pod, e.g. empty if the kubelet does not report it yet
+func withImageID(containerName, imageID string) podFakeOption {
+	return func(pod *core1.Pod) {
+		for i := range pod.Status.ContainerStatuses {
+			if pod.Status.ContainerStatuses[i].Name == containerName {
+				pod.Status.ContainerStatuses[i].ImageID = imageID
+			}
+		}
+	}
+}
+
+// withRestartedContainer makes a container of the Pod restarted with the given image ID
+func withRestartedContainer(containerName, imageID string) podFakeOption {
+	return func(pod *core1.Pod) {
+		withImageID(containerName, imageID)(pod)
+		for i := range pod.Status.ContainerStatuses {
+			if pod.Status.ContainerStatuses[i].Name == containerName {
+				pod.Status.ContainerStatuses[i].RestartCount++
+			}
+		}
+	}
+}
+
+// withEphemeralContainer adds an ephemeral container to the Pod, in the given state
+func withEphemeralContainer(name, image, imageID string, state core1.ContainerState) podFakeOption {
+	return func(pod *core1.Pod) {
+		pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, core1.EphemeralContainer{
+			EphemeralContainerCommon: core1.EphemeralContainerCommon{Name: name, Image: image},
+		})
+		pod.Status.EphemeralContainerStatuses = append(pod.Status.EphemeralContainerStatuses, core1.ContainerStatus{
+			Name:    name,
+			ImageID: imageID,
+			State:   state,
+		})
+	}
+}
+
+// newRunningPodFake returns a running naked Pod with running containers
+// that use the provided image IDs, modified by the given options
+func newRunningPodFake(namespace, name string, containerToImageID map[string]string, opts ...podFakeOption) *core1.Pod {
+	pod := &core1.Pod{
+		TypeMeta:   v1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+		ObjectMeta: v1.ObjectMeta{Name: name, Namespace: namespace},
+		Status:     core1.PodStatus{Phase: core1.PodRunning},
+	}
+	containerNames := make([]string, 0, len(containerToImageID))
+	for containerName := range containerToImageID {
+		containerNames = append(containerNames, containerName)
+	}
+	sort.Strings(containerNames)
+	for _, containerName := range containerNames {
+		pod.Spec.Containers = append(pod.Spec.Containers, core1.Container{Name: containerName, Image: containerName})
+		pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, core1.ContainerStatus{
+			Name:    containerName,
+			ImageID: containerToImageID[containerName],
+			State:   core1.ContainerState{Running: &core1.ContainerStateRunning{}},
+		})
 	}
+	for _, opt := range opts {
+		opt(pod)
+	}
+	return pod
 }
 
 func TestNewWatchHandlerProducesValidResult(t *testing.T) {
@@ -71,22 +225,83 @@ func TestNewWatchHandlerProducesValidResult(t *testing.T) {
 			k8sAPI := utils.NewK8sInterfaceFake(k8sClient)
 			storageClient := kssfake.NewSimpleClientset()
 
-			wh, err := NewWatchHandler(ctx, k8sAPI, storageClient, tc.imageIDsToWLIDSsMap, nil)
+			wh, err := NewWatchHandler(k8sAPI, storageClient, tc.imageIDsToWLIDSsMap, nil)
+			assert.NoErrorf(t, err, "Constructing should produce no errors")
+			assert.NotNilf(t, wh, "Constructing should create a non-nil object")
+			assert.NoError(t, wh.Start(ctx))
 
 			actualMap := wh.iwMap.Map()
 			for imageID := range actualMap {
 				sort.Strings(actualMap[imageID])
 			}
-			assert.NoErrorf(t, err, "Constructing should produce no errors")
-			assert.NotNilf(t, wh, "Constructing should create a non-nil object")
 			assert.Equal(t, tc.expectedIWMap, actualMap)
 		})
 	}
 }
 
+func TestNewWatchHandlerValidatesClients(t *testing.T) {
+	k8sAPI, _ := newK8sAPIFake()
+
+	_, err := NewWatchHandler(nil, kssfake.NewSimpleClientset(), nil, nil)
+	assert.ErrorIs(t, err, ErrMissingKubernetesClient)
+	_, err = NewWatchHandler(k8sAPI, nil, nil, nil)
+	assert.ErrorIs(t, err, ErrMissingStorageClient)
+}
+
+func TestWatchHandlerStart(t *testing.T) {
+	ctx := context.TODO()
+	injectedImageID := "redis@sha256:328695eff5583aa7bc95f9dd456106461d588df5bffc296107964fe27ee0e083"
+	podImageID := "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"
+	k8sAPI, k8sClient := newK8sAPIFake(newRunningPodFake("default", "nginx", map[string]string{"nginx": podImageID}))
+	storageClient := kssfake.NewSimpleClientset(
+		&spdxv1beta1.SBOMSummary{ObjectMeta: v1.ObjectMeta{Name: "injected", Namespace: "kubescape", Labels: managedLabels(), Annotations: map[string]string{instanceidv1.ImageIDMetadataKey: injectedImageID}}},
+		&spdxv1beta1.SBOMSummary{ObjectMeta: v1.ObjectMeta{Name: "pod", Namespace: "kubescape", Labels: managedLabels(), Annotations: map[string]string{instanceidv1.ImageIDMetadataKey: podImageID}}},
+	)
+
+	wh, err := NewWatchHandler(k8sAPI, storageClient, map[string][]string{injectedImageID: {"wlid-01"}}, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, k8sClient.Actions(), "the Pods should not be listed before Start")
+	assert.True(t, wh.isImageIDTracked(imageHashKey(injectedImageID)))
+	assert.False(t, wh.isImageIDTracked(imageHashKey(podImageID)))
+
+	// the handlers only see the injected maps
+	summaries, err := storageClient.SpdxV1beta1().SBOMSummaries("kubescape").List(ctx, v1.ListOptions{})
+	assert.NoError(t, err)
+	sbomEvents := make(chan watch.Event, len(summaries.Items))
+	for i := range summaries.Items {
+		sbomEvents <- watch.Event{Type: watch.Modified, Object: &summaries.Items[i]}
+	}
+	close(sbomEvents)
+	errCh := make(chan error)
+	go wh.HandleSBOMEvents(ctx, sbomEvents, nil, errCh)
+	for err := range errCh {
+		assert.NoError(t, err)
+	}
+	summaries, err = storageClient.SpdxV1beta1().SBOMSummaries("kubescape").List(ctx, v1.ListOptions{})
+	assert.NoError(t, err)
+	if assert.Len(t, summaries.Items, 1) {
+		assert.Equal(t, "injected", summaries.Items[0].Name)
+	}
+
+	startCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// the errors of the initial build surface from Start, which may be retried
+	listErr := errors.New("API server unavailable")
+	k8sClient.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if listErr != nil {
+			return true, nil, listErr
+		}
+		return false, nil, nil
+	})
+	assert.ErrorIs(t, wh.Start(startCtx), listErr)
+	listErr = nil
+	assert.NoError(t, wh.Start(startCtx))
+	assert.True(t, wh.isImageIDTracked(imageHashKey(podImageID)), "Start should build the maps from the listed Pods")
+	assert.ErrorIs(t, wh.Start(startCtx), ErrAlreadyStarted)
+}
+
 func TestHandleVulnerabilityManifestEvents(t *testing.T) {
 	tt := []struct {
-		skipReason          string
 		name                string
 		imageWLIDsMap       map[string][]string
 		instanceIDs         []string
@@ -95,7 +310,6 @@ func TestHandleVulnerabilityManifestEvents(t *testing.T) {
 		expectedErrors      []error
 	}{
 		{
-			skipReason:    deletesQuickFix,
 			name:          "Adding a new Vulnerability Manifest (no relevancy) with an unknown image ID should delete it from storage",
 			imageWLIDsMap: map[string][]string{},
 			instanceIDs:   []string{},
@@ -104,7 +318,8 @@ func TestHandleVulnerabilityManifestEvents(t *testing.T) {
 					Type: watch.Added,
 					Object: &spdxv1beta1.VulnerabilityManifest{
 						ObjectMeta: v1.ObjectMeta{
-							Name: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+							Name:   "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+							Labels: managedLabels(),
 						},
 						Spec: spdxv1beta1.VulnerabilityManifestSpec{
 							Metadata: spdxv1beta1.VulnerabilityManifestMeta{
@@ -128,7 +343,8 @@ func TestHandleVulnerabilityManifestEvents(t *testing.T) {
 					Type: watch.Added,
 					Object: &spdxv1beta1.VulnerabilityManifest{
 						ObjectMeta: v1.ObjectMeta{
-							Name: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+							Name:   "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+							Labels: managedLabels(),
 						},
 						Spec: spdxv1beta1.VulnerabilityManifestSpec{
 							Metadata: spdxv1beta1.VulnerabilityManifestMeta{
@@ -142,8 +358,7 @@ func TestHandleVulnerabilityManifestEvents(t *testing.T) {
 			expectedErrors:      []error{},
 		},
 		{
-			skipReason: deletesQuickFix,
-			name:       "Adding Vulnerability Manifests should keep or delete them from storage accordingly",
+			name: "Adding Vulnerability Manifests should keep or delete them from storage accordingly",
 			imageWLIDsMap: map[string][]string{
 				"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824": {"wlid://some-wlid"},
 			},
@@ -154,7 +369,8 @@ func TestHandleVulnerabilityManifestEvents(t *testing.T) {
 					Type: watch.Added,
 					Object: &spdxv1beta1.VulnerabilityManifest{
 						ObjectMeta: v1.ObjectMeta{
-							Name: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+							Name:   "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+							Labels: managedLabels(),
 						},
 						Spec: spdxv1beta1.VulnerabilityManifestSpec{
 							Metadata: spdxv1beta1.VulnerabilityManifestMeta{
@@ -168,7 +384,8 @@ func TestHandleVulnerabilityManifestEvents(t *testing.T) {
 					Type: watch.Added,
 					Object: &spdxv1beta1.VulnerabilityManifest{
 						ObjectMeta: v1.ObjectMeta{
-							Name: "486ea46224d1bb4fb680f34f7c9ad96a8f24ec88be73ea8e5a6c65260e9cb8a7",
+							Name:   "486ea46224d1bb4fb680f34f7c9ad96a8f24ec88be73ea8e5a6c65260e9cb8a7",
+							Labels: managedLabels(),
 						},
 						Spec: spdxv1beta1.VulnerabilityManifestSpec{
 							Metadata: spdxv1beta1.VulnerabilityManifestMeta{
@@ -182,7 +399,8 @@ func TestHandleVulnerabilityManifestEvents(t *testing.T) {
 					Type: watch.Added,
 					Object: &spdxv1beta1.VulnerabilityManifest{
 						ObjectMeta: v1.ObjectMeta{
-							Name: "b9776d7ddf459c9ad5b0e1d6ac61e27befb5e99fd62446677600d7cacef544d0",
+							Name:   "b9776d7ddf459c9ad5b0e1d6ac61e27befb5e99fd62446677600d7cacef544d0",
+							Labels: managedLabels(),
 						},
 						Spec: spdxv1beta1.VulnerabilityManifestSpec{
 							Metadata: spdxv1beta1.VulnerabilityManifestMeta{
@@ -196,7 +414,8 @@ func TestHandleVulnerabilityManifestEvents(t *testing.T) {
 					Type: watch.Added,
 					Object: &spdxv1beta1.VulnerabilityManifest{
 						ObjectMeta: v1.ObjectMeta{
-							Name: "22c72aa82ce77c82e2ca65a711c79eaa4b51c57f85f91489ceeacc7b385943ba",
+							Name:   "22c72aa82ce77c82e2ca65a711c79eaa4b51c57f85f91489ceeacc7b385943ba",
+							Labels: managedLabels(),
 							Annotations: map[string]string{
 								"instanceID": "apiVersion-v1/namespace-webapp/kind-deployment/name-webapp-leader/containerName-webapp",
 							},
@@ -226,7 +445,8 @@ func TestHandleVulnerabilityManifestEvents(t *testing.T) {
 					Type: watch.Deleted,
 					Object: &spdxv1beta1.VulnerabilityManifest{
 						ObjectMeta: v1.ObjectMeta{
-							Name: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+							Name:   "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+							Labels: managedLabels(),
 						},
 						Spec: spdxv1beta1.VulnerabilityManifestSpec{
 							Metadata: spdxv1beta1.VulnerabilityManifestMeta{
@@ -252,7 +472,8 @@ func TestHandleVulnerabilityManifestEvents(t *testing.T) {
 					Type: watch.Added,
 					Object: &spdxv1beta1.SBOMSPDXv2p3{
 						ObjectMeta: v1.ObjectMeta{
-							Name: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+							Name:   "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+							Labels: managedLabels(),
 						},
 					},
 				},
@@ -264,10 +485,6 @@ func TestHandleVulnerabilityManifestEvents(t *testing.T) {
 
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
-			if tc.skipReason != "" {
-				t.Skipf(`Skipping "%s" due to: %s`, tc.name, tc.skipReason)
-			}
-
 			// Prepare starting startingObjects for storage
 			startingObjects := []runtime.Object{}
 			for _, e := range tc.inputEvents {
@@ -283,9 +500,10 @@ func TestHandleVulnerabilityManifestEvents(t *testing.T) {
 			errorCh := make(chan error)
 			vmEvents := make(chan watch.Event)
 
-			wh, _ := NewWatchHandler(ctx, k8sAPI, storageClient, iwMap, tc.instanceIDs)
+			wh, _ := NewWatchHandler(k8sAPI, storageClient, iwMap, tc.instanceIDs)
+			assert.NoError(t, wh.Start(ctx))
 
-			go wh.HandleVulnerabilityManifestEvents(vmEvents, errorCh)
+			go wh.HandleVulnerabilityManifestEvents(context.TODO(), vmEvents, errorCh)
 
 			go func() {
 				for _, e := range tc.inputEvents {
@@ -319,14 +537,102 @@ func Test_getSBOMWatcher(t *testing.T) {
 	k8sClient := k8sfake.NewSimpleClientset()
 	k8sAPI := utils.NewK8sInterfaceFake(k8sClient)
 	storageClient := kssfake.NewSimpleClientset()
-	wh, _ := NewWatchHandler(ctx, k8sAPI, storageClient, nil, nil)
+	wh, _ := NewWatchHandler(k8sAPI, storageClient, nil, nil)
+	assert.NoError(t, wh.Start(ctx))
 
-	sbomWatcher, err := wh.getSBOMWatcher()
+	sbomWatcher, err := wh.getSBOMWatcher(context.TODO(), "")
 
 	assert.NoErrorf(t, err, "Should get no errors")
 	assert.NotNilf(t, sbomWatcher, "Returned value should not be nil")
 }
 
+func TestWatchesStopOnCancellation(t *testing.T) {
+	tt := []struct {
+		name     string
+		resource string
+		watch    func(wh *WatchHandler, ctx context.Context, sink utils.CommandSink)
+	}{
+		{
+			name:     "Vulnerability manifests",
+			resource: "vulnerabilitymanifests",
+			watch: func(wh *WatchHandler, ctx context.Context, _ utils.CommandSink) {
+				wh.VulnerabilityManifestWatch(ctx)
+			},
+		},
+		{
+			name:     "SBOM summaries",
+			resource: "sbomsummaries",
+			watch:    (*WatchHandler).SBOMWatch,
+		},
+		{
+			name:     "Filtered SBOMs",
+			resource: "sbomspdxv2p3filtereds",
+			watch:    (*WatchHandler).SBOMFilteredWatch,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeWatcher := watch.NewFake()
+			watched := make(chan struct{})
+			var watchedOnce sync.Once
+			storageClient := kssfake.NewSimpleClientset()
+			storageClient.PrependWatchReactor(tc.resource, func(action k8stesting.Action) (bool, watch.Interface, error) {
+				watchedOnce.Do(func() { close(watched) })
+				return true, fakeWatcher, nil
+			})
+
+			wh := NewWatchHandlerMock()
+			wh.storageClient = storageClient
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				tc.watch(wh, ctx, &commandRecorder{})
+				close(done)
+			}()
+
+			<-watched
+			cancel()
+
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the watch loop should return once its context is cancelled")
+			}
+			assert.True(t, fakeWatcher.IsStopped(), "the watch should be stopped along with the loop")
+		})
+	}
+
+	t.Run("Pods", func(t *testing.T) {
+		fakeWatcher := watch.NewFake()
+		k8sAPI, k8sClient := newK8sAPIFake()
+		k8sClient.PrependWatchReactor("pods", func(action k8stesting.Action) (bool, watch.Interface, error) {
+			return true, fakeWatcher, nil
+		})
+
+		wh := NewWatchHandlerMock()
+		wh.k8sAPI = k8sAPI
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			wh.PodWatch(ctx, &commandRecorder{})
+			close(done)
+		}()
+
+		cancel()
+		// the API server closes the watch once its context is cancelled
+		fakeWatcher.Stop()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the pod watch should not be re-established once its context is cancelled")
+		}
+	})
+}
+
 func TestHandleSBOMFilteredEvents(t *testing.T) {
 	tt := []struct {
 		name                           string
@@ -345,7 +651,8 @@ func TestHandleSBOMFilteredEvents(t *testing.T) {
 					Type: watch.Added,
 					Object: &spdxv1beta1.SBOMSPDXv2p3Filtered{
 						ObjectMeta: v1.ObjectMeta{
-							Name: "default-pod-reverse-proxy-2f07-68bd",
+							Name:   "default-pod-reverse-proxy-2f07-68bd",
+							Labels: managedLabels(),
 							Annotations: map[string]string{
 								instanceidv1.InstanceIDMetadataKey: "apiVersion-v1/namespace-default/kind-Pod/name-reverse-proxy/containerName-nginx",
 							},
@@ -370,7 +677,8 @@ func TestHandleSBOMFilteredEvents(t *testing.T) {
 					Type: watch.Added,
 					Object: &spdxv1beta1.SBOMSPDXv2p3Filtered{
 						ObjectMeta: v1.ObjectMeta{
-							Name: "default-pod-reverse-proxy-2f07-68bd",
+							Name:   "default-pod-reverse-proxy-2f07-68bd",
+							Labels: managedLabels(),
 							Annotations: map[string]string{
 								instanceidv1.InstanceIDMetadataKey: "apiVersion-v1/namespace-default/kind-Pod/name-reverse-proxy/containerName-nginx",
 								instanceidv1.WlidMetadataKey:       "wlid://cluster-relevant-clutser/namespace-default/deployment-nginx",
@@ -388,6 +696,8 @@ func TestHandleSBOMFilteredEvents(t *testing.T) {
 						utils.ContainerToImageIdsArg: map[string]string{
 							"nginx": "nginx@sha256:1f4e3b6489888647ce1834b601c6c06b9f8c03dee6e097e13ed3e28c01ea3ac8c",
 						},
+						utils.ContainerNamesArg: []string{"nginx"},
+						utils.ScanScopeArg:      utils.ScanScopeRelevancy,
 					},
 				},
 			},
@@ -406,7 +716,8 @@ func TestHandleSBOMFilteredEvents(t *testing.T) {
 					Type: watch.Added,
 					Object: &spdxv1beta1.SBOMSPDXv2p3Filtered{
 						ObjectMeta: v1.ObjectMeta{
-							Name: "default-pod-reverse-proxy-2f07-68bd",
+							Name:   "default-pod-reverse-proxy-2f07-68bd",
+							Labels: managedLabels(),
 							Annotations: map[string]string{
 								instanceidv1.InstanceIDMetadataKey: "apiVersion-v1/namespace-default/kind-Pod/name-reverse-proxy/containerName-nginx",
 							},
@@ -431,7 +742,8 @@ func TestHandleSBOMFilteredEvents(t *testing.T) {
 					Type: watch.Added,
 					Object: &spdxv1beta1.SBOMSPDXv2p3Filtered{
 						ObjectMeta: v1.ObjectMeta{
-							Name: "default-pod-reverse-proxy-1ba5-4aaf",
+							Name:   "default-pod-reverse-proxy-1ba5-4aaf",
+							Labels: managedLabels(),
 							Annotations: map[string]string{
 								instanceidv1.WlidMetadataKey: "wlid://cluster-relevant-clutser/namespace-routing/deployment-nginx",
 							},
@@ -443,6 +755,28 @@ func TestHandleSBOMFilteredEvents(t *testing.T) {
 			expectedCommands:    []*apis.Command{},
 			expectedErrors:      []error{ErrMissingInstanceIDAnnotation},
 		},
+		{
+			name:                 "Adding a new Filtered SBOM with a malformed InstanceID annotation should keep it and produce a matching error",
+			knownInstanceIDSlugs: []string{},
+			inputEvents: []watch.Event{
+				{
+					Type: watch.Added,
+					Object: &spdxv1beta1.SBOMSPDXv2p3Filtered{
+						ObjectMeta: v1.ObjectMeta{
+							Name:   "default-pod-reverse-proxy-malformed",
+							Labels: managedLabels(),
+							Annotations: map[string]string{
+								instanceidv1.InstanceIDMetadataKey: "apiVersion-v1/namespace-default/kind-Pod/reverse-proxy/containerName-nginx",
+								instanceidv1.WlidMetadataKey:       "wlid://cluster-relevant-clutser/namespace-default/pod-reverse-proxy",
+							},
+						},
+					},
+				},
+			},
+			expectedObjectNames: []string{"default-pod-reverse-proxy-malformed"},
+			expectedCommands:    []*apis.Command{},
+			expectedErrors:      []error{ErrMalformedInstanceIDAnnotation},
+		},
 		{
 			name:                 "Filtered SBOM deletion events should be ignored",
 			knownInstanceIDSlugs: []string{},
@@ -452,6 +786,7 @@ func TestHandleSBOMFilteredEvents(t *testing.T) {
 					Object: &spdxv1beta1.SBOMSPDXv2p3Filtered{
 						ObjectMeta: v1.ObjectMeta{
 							Name:        "default-pod-reverse-proxy-1ba5-4aaf",
+							Labels:      managedLabels(),
 							Annotations: map[string]string{instanceidv1.InstanceIDMetadataKey: "60d3737f69e6bd1e1573ecbdb395937219428d00687b4e5f1553f6f192c63e6c"},
 						},
 					},
@@ -470,6 +805,7 @@ func TestHandleSBOMFilteredEvents(t *testing.T) {
 					Object: &spdxv1beta1.VulnerabilityManifest{
 						ObjectMeta: v1.ObjectMeta{
 							Name:        "default-pod-reverse-proxy-1ba5-4aaf",
+							Labels:      managedLabels(),
 							Annotations: map[string]string{instanceidv1.InstanceIDMetadataKey: "60d3737f69e6bd1e1573ecbdb395937219428d00687b4e5f1553f6f192c63e6c"},
 						},
 					},
@@ -490,8 +826,8 @@ func TestHandleSBOMFilteredEvents(t *testing.T) {
 			}
 
 			ctx := context.Background()
-			k8sClient := k8sfake.NewSimpleClientset()
-			k8sAPI := utils.NewK8sInterfaceFake(k8sClient)
+			// the parents of scanned workloads are fetched to check whether they opted out
+			k8sAPI, _ := newK8sAPIFake()
 			storageClient := kssfake.NewSimpleClientset(startingObjects...)
 			iwMap := map[string][]string(nil)
 
@@ -499,10 +835,11 @@ func TestHandleSBOMFilteredEvents(t *testing.T) {
 			cmdCh := make(chan *apis.Command)
 			errorCh := make(chan error)
 
-			wh, _ := NewWatchHandler(ctx, k8sAPI, storageClient, iwMap, tc.knownInstanceIDSlugs)
+			wh, _ := NewWatchHandler(k8sAPI, storageClient, iwMap, tc.knownInstanceIDSlugs)
+			assert.NoError(t, wh.Start(ctx))
 			wh.wlidsToContainerToImageIDMap = tc.wlidsToContainersToImageIDsMap
 
-			go wh.HandleSBOMFilteredEvents(inputEvents, cmdCh, errorCh)
+			go wh.HandleSBOMFilteredEvents(context.TODO(), inputEvents, cmdCh, errorCh)
 
 			go func() {
 				for _, e := range tc.inputEvents {
@@ -570,6 +907,7 @@ func TestHandleSBOMEvents(t *testing.T) {
 						ObjectMeta: v1.ObjectMeta{
 							Name:        validImageIDSlug,
 							Namespace:   "kubescape",
+							Labels:      managedLabels(),
 							Annotations: validAnnotation,
 						},
 					},
@@ -578,6 +916,29 @@ func TestHandleSBOMEvents(t *testing.T) {
 			expectedSBOMSummaryNames: []string{validImageIDSlug},
 			expectedErrors:           []error{},
 		},
+		{
+			name: "New SBOM with the bare digest of a recognized image ID gets kept",
+			imageIDstoWlids: map[string][]string{
+				validImageID: {"wlid://some-wlid"},
+			},
+			inputEvents: []watch.Event{
+				{
+					Type: watch.Added,
+					Object: &spdxv1beta1.SBOMSummary{
+						ObjectMeta: v1.ObjectMeta{
+							Name:      validImageIDSlug,
+							Namespace: "kubescape",
+							Labels:    managedLabels(),
+							Annotations: map[string]string{
+								instanceidv1.ImageIDMetadataKey: "sha256:c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ee",
+							},
+						},
+					},
+				},
+			},
+			expectedSBOMSummaryNames: []string{validImageIDSlug},
+			expectedErrors:           []error{},
+		},
 		{
 			name: "New SBOM with missing image ID annotation produces an error and gets deleted",
 			imageIDstoWlids: map[string][]string{
@@ -590,6 +951,7 @@ func TestHandleSBOMEvents(t *testing.T) {
 						ObjectMeta: v1.ObjectMeta{
 							Name:        validImageID,
 							Namespace:   "kubescape",
+							Labels:      managedLabels(),
 							Annotations: map[string]string{},
 						},
 					},
@@ -610,6 +972,7 @@ func TestHandleSBOMEvents(t *testing.T) {
 						ObjectMeta: v1.ObjectMeta{
 							Name:      "ab" + validImageID[2:],
 							Namespace: "kubescape",
+							Labels:    managedLabels(),
 							Annotations: map[string]string{
 								instanceidv1.ImageIDMetadataKey: validImageID,
 							},
@@ -632,6 +995,7 @@ func TestHandleSBOMEvents(t *testing.T) {
 						ObjectMeta: v1.ObjectMeta{
 							Name:      validImageID,
 							Namespace: "kubescape",
+							Labels:    managedLabels(),
 						},
 					},
 				},
@@ -651,6 +1015,7 @@ func TestHandleSBOMEvents(t *testing.T) {
 						ObjectMeta: v1.ObjectMeta{
 							Name:      validImageIDSlug,
 							Namespace: "kubescape",
+							Labels:    managedLabels(),
 							Annotations: map[string]string{
 								instanceidv1.ImageIDMetadataKey: validImageID + "a",
 							},
@@ -668,7 +1033,7 @@ func TestHandleSBOMEvents(t *testing.T) {
 				{
 					Type: watch.Added,
 					Object: &spdxv1beta1.VulnerabilityManifest{
-						ObjectMeta: v1.ObjectMeta{Name: "testName"},
+						ObjectMeta: v1.ObjectMeta{Name: "testName", Labels: managedLabels()},
 					},
 				},
 			},
@@ -685,6 +1050,7 @@ func TestHandleSBOMEvents(t *testing.T) {
 						ObjectMeta: v1.ObjectMeta{
 							Name:        validImageIDSlug,
 							Namespace:   "kubescape",
+							Labels:      managedLabels(),
 							Annotations: validAnnotation,
 						},
 					},
@@ -700,7 +1066,7 @@ func TestHandleSBOMEvents(t *testing.T) {
 				{
 					Type: watch.Deleted,
 					Object: &spdxv1beta1.SBOMSummary{
-						ObjectMeta: v1.ObjectMeta{Name: "testName", Namespace: "kubescape"},
+						ObjectMeta: v1.ObjectMeta{Name: "testName", Namespace: "kubescape", Labels: managedLabels()},
 					},
 				},
 			},
@@ -734,7 +1100,8 @@ func TestHandleSBOMEvents(t *testing.T) {
 
 			k8sAPI := utils.NewK8sInterfaceFake(k8sClient)
 			ksStorageClient := kssfake.NewSimpleClientset(inputObjects...)
-			wh, _ := NewWatchHandler(context.TODO(), k8sAPI, ksStorageClient, tc.imageIDstoWlids, nil)
+			wh, _ := NewWatchHandler(k8sAPI, ksStorageClient, tc.imageIDstoWlids, nil)
+			assert.NoError(t, wh.Start(context.TODO()))
 
 			errCh := make(chan error)
 
@@ -748,7 +1115,7 @@ func TestHandleSBOMEvents(t *testing.T) {
 				close(sbomEvents)
 			}()
 
-			go wh.HandleSBOMEvents(sbomEvents, errCh)
+			go wh.HandleSBOMEvents(context.TODO(), sbomEvents, nil, errCh)
 
 			actualErrors := []error{}
 
@@ -803,10 +1170,10 @@ func TestSBOMWatch(t *testing.T) {
 
 	k8sAPI := utils.NewK8sInterfaceFake(k8sClient)
 	ksStorageClient := kssfake.NewSimpleClientset()
-	wh, _ := NewWatchHandler(context.TODO(), k8sAPI, ksStorageClient, imageIDsToWlids, nil)
+	wh, _ := NewWatchHandler(k8sAPI, ksStorageClient, imageIDsToWlids, nil)
+	assert.NoError(t, wh.Start(context.TODO()))
 
 	sessionObjCh := make(chan utils.SessionObj)
-	sessionObjChPtr := &sessionObjCh
 
 	ctx := context.TODO()
 	sbomClient := ksStorageClient.SpdxV1beta1().SBOMSPDXv2p3s("")
@@ -814,13 +1181,13 @@ func TestSBOMWatch(t *testing.T) {
 	sbomWatcher.ResultChan()
 
 	SBOMStub := spdxv1beta1.SBOMSPDXv2p3{
-		ObjectMeta: v1.ObjectMeta{Name: "some-imageID"},
+		ObjectMeta: v1.ObjectMeta{Name: "some-imageID", Labels: managedLabels()},
 	}
 
 	expectedCommands := []apis.Command{{CommandName: apis.TypeScanImages, Wlid: expectedWlid}}
 
 	doneCh := make(chan struct{})
-	go wh.SBOMWatch(context.TODO(), sessionObjChPtr)
+	go wh.SBOMWatch(context.TODO(), utils.NewChannelCommandSink(sessionObjCh))
 
 	go func() {
 		sbomClient.Create(ctx, &SBOMStub, v1.CreateOptions{})
@@ -830,7 +1197,7 @@ func TestSBOMWatch(t *testing.T) {
 	<-doneCh
 
 	actualCommands := []apis.Command{}
-	sessionObj := <-*sessionObjChPtr
+	sessionObj := <-sessionObjCh
 	actualCommands = append(actualCommands, sessionObj.Command)
 
 	assert.Equalf(t, expectedCommands, actualCommands, "Produced commands should match")
@@ -858,14 +1225,14 @@ func TestSBOMWatch(t *testing.T) {
 // 						Status: core1.PodStatus{
 // 							ContainerStatuses: []core1.ContainerStatus{
 // 								{
-// 									ImageID: "docker-pullable://alpine@sha256:1",
+// 									ImageID: "docker-pullable://alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547",
 // 									Name:    "container1",
 // 								},
 // 							},
 // 						},
 // 					}}},
 // 			expectedImageIDsMap: map[string][]string{
-// 				"alpine@sha256:1": {pkgwlid.GetWLID("", "default", "pod", "test")},
+// 				"alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547": {pkgwlid.GetWLID("", "default", "pod", "test")},
 // 			},
 // 		},
 // 		{
@@ -883,14 +1250,14 @@ func TestSBOMWatch(t *testing.T) {
 // 						Status: core1.PodStatus{
 // 							ContainerStatuses: []core1.ContainerStatus{
 // 								{
-// 									ImageID: "alpine@sha256:1",
+// 									ImageID: "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547",
 // 									Name:    "container1",
 // 								},
 // 							},
 // 						},
 // 					}}},
 // 			expectedImageIDsMap: map[string][]string{
-// 				"alpine@sha256:1": {pkgwlid.GetWLID("", "default", "pod", "test")},
+// 				"alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547": {pkgwlid.GetWLID("", "default", "pod", "test")},
 // 			},
 // 		},
 // 		{
@@ -908,7 +1275,7 @@ func TestSBOMWatch(t *testing.T) {
 // 						Status: core1.PodStatus{
 // 							ContainerStatuses: []core1.ContainerStatus{
 // 								{
-// 									ImageID: "docker-pullable://alpine@sha256:1",
+// 									ImageID: "docker-pullable://alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547",
 // 									Name:    "container1",
 // 								},
 // 							},
@@ -925,7 +1292,7 @@ func TestSBOMWatch(t *testing.T) {
 // 						Status: core1.PodStatus{
 // 							ContainerStatuses: []core1.ContainerStatus{
 // 								{
-// 									ImageID: "docker-pullable://alpine@sha256:1",
+// 									ImageID: "docker-pullable://alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547",
 // 									Name:    "container2",
 // 								},
 // 							},
@@ -934,7 +1301,7 @@ func TestSBOMWatch(t *testing.T) {
 // 				},
 // 			},
 // 			expectedImageIDsMap: map[string][]string{
-// 				"alpine@sha256:1": {pkgwlid.GetWLID("", "default", "pod", "test"), pkgwlid.GetWLID("", "default", "pod", "test2")},
+// 				"alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547": {pkgwlid.GetWLID("", "default", "pod", "test"), pkgwlid.GetWLID("", "default", "pod", "test2")},
 // 			},
 // 		},
 // 		{
@@ -952,7 +1319,7 @@ func TestSBOMWatch(t *testing.T) {
 // 						Status: core1.PodStatus{
 // 							ContainerStatuses: []core1.ContainerStatus{
 // 								{
-// 									ImageID: "docker-pullable://alpine@sha256:1",
+// 									ImageID: "docker-pullable://alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547",
 // 									Name:    "container1",
 // 								},
 // 							},
@@ -969,15 +1336,15 @@ func TestSBOMWatch(t *testing.T) {
 // 						Status: core1.PodStatus{
 // 							ContainerStatuses: []core1.ContainerStatus{
 // 								{
-// 									ImageID: "docker-pullable://alpine@sha256:2",
+// 									ImageID: "docker-pullable://alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb",
 // 									Name:    "container2",
 // 								},
 // 							},
 // 						},
 // 					}}},
 // 			expectedImageIDsMap: map[string][]string{
-// 				"alpine@sha256:1": {pkgwlid.GetWLID("", "default", "pod", "test")},
-// 				"alpine@sha256:2": {pkgwlid.GetWLID("", "default", "pod", "test2")},
+// 				"alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547": {pkgwlid.GetWLID("", "default", "pod", "test")},
+// 				"alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb": {pkgwlid.GetWLID("", "default", "pod", "test2")},
 // 			},
 // 		},
 // 		{
@@ -995,19 +1362,19 @@ func TestSBOMWatch(t *testing.T) {
 // 						Status: core1.PodStatus{
 // 							ContainerStatuses: []core1.ContainerStatus{
 // 								{
-// 									ImageID: "docker-pullable://alpine@sha256:1",
+// 									ImageID: "docker-pullable://alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547",
 // 									Name:    "container1",
 // 								},
 // 								{
-// 									ImageID: "docker-pullable://alpine@sha256:2",
+// 									ImageID: "docker-pullable://alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb",
 // 									Name:    "container2",
 // 								},
 // 							},
 // 						},
 // 					}}},
 // 			expectedImageIDsMap: map[string][]string{
-// 				"alpine@sha256:1": {pkgwlid.GetWLID("", "default", "pod", "test")},
-// 				"alpine@sha256:2": {pkgwlid.GetWLID("", "default", "pod", "test")},
+// 				"alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547": {pkgwlid.GetWLID("", "default", "pod", "test")},
+// 				"alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb": {pkgwlid.GetWLID("", "default", "pod", "test")},
 // 			},
 // 		},
 // 	}
@@ -1015,7 +1382,7 @@ func TestSBOMWatch(t *testing.T) {
 // 	for _, tt := range tests {
 // 		wh := NewWatchHandlerMock()
 // 		t.Run(tt.name, func(t *testing.T) {
-// 			wh.buildIDs(context.TODO(), &tt.podList)
+// 			wh.buildIDs(context.TODO(), podListIterator(&tt.podList))
 // 			assert.True(t, reflect.DeepEqual(wh.getImagesIDsToWlidMap(), tt.expectedImageIDsMap))
 // 		})
 // 	}
@@ -1039,7 +1406,7 @@ func TestSBOMWatch(t *testing.T) {
 // 						Status: core1.PodStatus{
 // 							ContainerStatuses: []core1.ContainerStatus{
 // 								{
-// 									ImageID: "docker-pullable://alpine@sha256:1",
+// 									ImageID: "docker-pullable://alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547",
 // 									Name:    "container1",
 // 								},
 // 							},
@@ -1048,7 +1415,7 @@ func TestSBOMWatch(t *testing.T) {
 // 			},
 // 			expectedwlidsToContainerToImageIDMap: WlidsToContainerToImageIDMap{
 // 				pkgwlid.GetWLID("", "namespace1", "pod", "pod1"): {
-// 					"container1": "alpine@sha256:1",
+// 					"container1": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547",
 // 				},
 // 			},
 // 		},
@@ -1064,7 +1431,7 @@ func TestSBOMWatch(t *testing.T) {
 // 						Status: core1.PodStatus{
 // 							ContainerStatuses: []core1.ContainerStatus{
 // 								{
-// 									ImageID: "alpine@sha256:1",
+// 									ImageID: "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547",
 // 									Name:    "container1",
 // 								},
 // 							},
@@ -1073,7 +1440,7 @@ func TestSBOMWatch(t *testing.T) {
 // 			},
 // 			expectedwlidsToContainerToImageIDMap: WlidsToContainerToImageIDMap{
 // 				pkgwlid.GetWLID("", "namespace1", "pod", "pod1"): {
-// 					"container1": "alpine@sha256:1",
+// 					"container1": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547",
 // 				},
 // 			},
 // 		},
@@ -1089,11 +1456,11 @@ func TestSBOMWatch(t *testing.T) {
 // 						Status: core1.PodStatus{
 // 							ContainerStatuses: []core1.ContainerStatus{
 // 								{
-// 									ImageID: "docker-pullable://alpine@sha256:3",
+// 									ImageID: "docker-pullable://alpine@sha256:8d8beb9fd7bbcfddb9838219929c6ac7c0f44bfd437d52a5c595e2745c1c2316",
 // 									Name:    "container3",
 // 								},
 // 								{
-// 									ImageID: "docker-pullable://alpine@sha256:4",
+// 									ImageID: "docker-pullable://alpine@sha256:2b3c88defe3996017045aef9a1f1f28d287e4e7daa6297d0493220b6368a4c4e",
 // 									Name:    "container4",
 // 								},
 // 							},
@@ -1102,8 +1469,8 @@ func TestSBOMWatch(t *testing.T) {
 // 				}},
 // 			expectedwlidsToContainerToImageIDMap: WlidsToContainerToImageIDMap{
 // 				pkgwlid.GetWLID("", "namespace3", "pod", "pod3"): {
-// 					"container3": "alpine@sha256:3",
-// 					"container4": "alpine@sha256:4",
+// 					"container3": "alpine@sha256:8d8beb9fd7bbcfddb9838219929c6ac7c0f44bfd437d52a5c595e2745c1c2316",
+// 					"container4": "alpine@sha256:2b3c88defe3996017045aef9a1f1f28d287e4e7daa6297d0493220b6368a4c4e",
 // 				},
 // 			},
 // 		},
@@ -1112,7 +1479,7 @@ func TestSBOMWatch(t *testing.T) {
 // 	for _, tt := range tests {
 // 		wh := NewWatchHandlerMock()
 // 		t.Run(tt.name, func(t *testing.T) {
-// 			wh.buildIDs(context.TODO(), &tt.podList)
+// 			wh.buildIDs(context.TODO(), podListIterator(&tt.podList))
 // 			got := wh.GetWlidsToContainerToImageIDMap()
 // 			assert.True(t, reflect.DeepEqual(got, tt.expectedwlidsToContainerToImageIDMap))
 // 		})
@@ -1139,8 +1506,20 @@ func Test_addToImageIDToWlidsMap(t *testing.T) {
 				{"alpine@sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", "wlid3"},
 			},
 			expectedMap: map[string][]string{
-				"alpine@sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824": {"wlid1", "wlid3"},
-				"alpine@sha256:486ea46224d1bb4fb680f34f7c9ad96a8f24ec88be73ea8e5a6c65260e9cb8a7": {"wlid2"},
+				"sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824": {"wlid1", "wlid3"},
+				"sha256:486ea46224d1bb4fb680f34f7c9ad96a8f24ec88be73ea8e5a6c65260e9cb8a7": {"wlid2"},
+			},
+		},
+		{
+			name: "Adding the image ID of an image as reported by different runtimes produces a single key",
+			inputOperations: []inputOperation{
+				{"docker-pullable://alpine@sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", "wlid1"},
+				{"docker.io/library/alpine@sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", "wlid2"},
+				{"sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", "wlid3"},
+				{"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", "wlid4"},
+			},
+			expectedMap: map[string][]string{
+				"sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824": {"wlid1", "wlid2", "wlid3", "wlid4"},
 			},
 		},
 	}
@@ -1166,15 +1545,15 @@ func Test_addToImageIDToWlidsMap(t *testing.T) {
 func TestAddTowlidsToContainerToImageIDMap(t *testing.T) {
 	wh := NewWatchHandlerMock()
 
-	wh.addToWlidsToContainerToImageIDMap("wlid1", "container1", "alpine@sha256:1")
-	wh.addToWlidsToContainerToImageIDMap("wlid2", "container2", "alpine@sha256:2")
+	wh.addToWlidsToContainerToImageIDMap("wlid1", "container1", "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547")
+	wh.addToWlidsToContainerToImageIDMap("wlid2", "container2", "alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb")
 
 	assert.True(t, reflect.DeepEqual(wh.GetWlidsToContainerToImageIDMap(), WlidsToContainerToImageIDMap{
 		"wlid1": {
-			"container1": "alpine@sha256:1",
+			"container1": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547",
 		},
 		"wlid2": {
-			"container2": "alpine@sha256:2",
+			"container2": "alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb",
 		},
 	}))
 }
@@ -1182,11 +1561,11 @@ func TestAddTowlidsToContainerToImageIDMap(t *testing.T) {
 func TestGetNewImageIDsToContainerFromPod(t *testing.T) {
 	wh := NewWatchHandlerMock()
 
-	wh.iwMap = NewImageHashWLIDsMapFrom(map[string][]string{
+	wh.iwMap = NewImageHashWLIDsMapFrom(imageHashKeys(map[string][]string{
 		"alpine@sha256:a4f71a32837ac3c5bd06ddda91b7093429c6bc5f04732451bd90c1c2f15dde8e": {"wlid"},
 		"alpine@sha256:313ce8b6e98d02254f84aa2193c9b3a45b8d6ab16aeb966aa680d373ebda4e70": {"wlid"},
 		"alpine@sha256:5b183f918bfb0de9a21b7cd33cea3171627f6ae1f753d370afef6c2555bd76eb": {"wlid"},
-	})
+	}))
 
 	tests := []struct {
 		name     string
@@ -1293,9 +1672,9 @@ func TestGetNewImageIDsToContainerFromPod(t *testing.T) {
 func TestCleanUpWlidsToContainerToImageIDMap(t *testing.T) {
 	wh := NewWatchHandlerMock()
 	wh.wlidsToContainerToImageIDMap = map[string]map[string]string{
-		"pod1": {"container1": "alpine@sha256:1"},
-		"pod2": {"container2": "alpine@sha256:2"},
-		"pod3": {"container3": "alpine@sha256:3"},
+		"pod1": {"container1": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"},
+		"pod2": {"container2": "alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb"},
+		"pod3": {"container3": "alpine@sha256:8d8beb9fd7bbcfddb9838219929c6ac7c0f44bfd437d52a5c595e2745c1c2316"},
 	}
 	wh.cleanUpWlidsToContainerToImageIDMap()
 
@@ -1304,21 +1683,21 @@ func TestCleanUpWlidsToContainerToImageIDMap(t *testing.T) {
 
 func Test_cleanUpIDs(t *testing.T) {
 	wh := NewWatchHandlerMock()
-	wh.iwMap = NewImageHashWLIDsMapFrom(map[string][]string{
-		"alpine@sha256:1": {"pod1"},
-		"alpine@sha256:2": {"pod2"},
-		"alpine@sha256:3": {"pod3"},
-	})
+	wh.iwMap = NewImageHashWLIDsMapFrom(imageHashKeys(map[string][]string{
+		"alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547": {"pod1"},
+		"alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb": {"pod2"},
+		"alpine@sha256:8d8beb9fd7bbcfddb9838219929c6ac7c0f44bfd437d52a5c595e2745c1c2316": {"pod3"},
+	}))
 	wh.wlidsToContainerToImageIDMap = map[string]map[string]string{
-		"pod1": {"container1": "alpine@sha256:1"},
-		"pod2": {"container2": "alpine@sha256:2"},
-		"pod3": {"container3": "alpine@sha256:3"},
+		"pod1": {"container1": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"},
+		"pod2": {"container2": "alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb"},
+		"pod3": {"container3": "alpine@sha256:8d8beb9fd7bbcfddb9838219929c6ac7c0f44bfd437d52a5c595e2745c1c2316"},
 	}
-	wh.managedInstanceIDSlugs = []string{
+	wh.managedInstanceIDSlugs = newPodInstanceIDs(
 		"60d3737f69e6bd1e1573ecbdb395937219428d00687b4e5f1553f6f192c63e6c",
 		"f26b54ef2073feae80c40423a9fac44468ec4c655476ea8a57f601daa62240c2",
 		"8d39971275da811436922ae8d8f839827e5c6567738a1390bc94cfdb58bb8762",
-	}
+	)
 	wh.cleanUpIDs()
 
 	assert.Equal(t, 0, len(wh.iwMap.Map()))
@@ -1326,8 +1705,1570 @@ func Test_cleanUpIDs(t *testing.T) {
 	assert.Equal(t, 0, len(wh.managedInstanceIDSlugs))
 }
 
-//go:embed testdata/deployment-two-containers.json
-var deploymentTwoContainersJson []byte
+func TestSnapshotImageHashWLIDs(t *testing.T) {
+	wh := NewWatchHandlerMock()
+	wh.addToImageIDToWlidsMap("alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547", "wlid2", "wlid1")
+	wh.addToImageIDToWlidsMap("alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb", "wlid2")
+
+	snapshot := wh.SnapshotImageHashWLIDs()
+	assert.Equal(t, map[string][]string{
+		"sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547": {"wlid1", "wlid2"},
+		"sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb": {"wlid2"},
+	}, snapshot)
+
+	// the snapshot is a copy that does not reflect later changes either way
+	snapshot["sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"][0] = "modified"
+	delete(snapshot, "sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb")
+	wh.addToImageIDToWlidsMap("alpine@sha256:8d8beb9fd7bbcfddb9838219929c6ac7c0f44bfd437d52a5c595e2745c1c2316", "wlid3")
+	assert.Equal(t, map[string][]string{
+		"sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547": {"wlid1", "wlid2"},
+		"sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb": {"wlid2"},
+		"sha256:8d8beb9fd7bbcfddb9838219929c6ac7c0f44bfd437d52a5c595e2745c1c2316": {"wlid3"},
+	}, wh.SnapshotImageHashWLIDs())
+	assert.Equal(t, []string{"modified", "wlid2"}, snapshot["sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"])
+}
 
-//go:embed testdata/deployment.json
-var deploymentJson []byte
+func TestReplaceInWlidsToContainerToImageIDMap(t *testing.T) {
+	wh := NewWatchHandlerMock()
+	for container, imageID := range map[string]string{"app": "myapp@sha256:6882017e7f8e9312816a4e6f174fd7c3690392272e93207bdc38e19ca7512255", "worker": "myapp@sha256:6882017e7f8e9312816a4e6f174fd7c3690392272e93207bdc38e19ca7512255", "sidecar": "envoy@sha256:73971a8f26642b2749d12b0c0692ac2e75ea36137badf768fd3ef11da87c570f"} {
+		wh.addToImageIDToWlidsMap(imageID, "wlid1", "wlid2")
+		wh.addToWlidsToContainerToImageIDMap("wlid1", container, imageID)
+	}
+
+	// the previous image is still run by another container of the WLID
+	wh.addToImageIDToWlidsMap("myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822", "wlid1")
+	wh.replaceInWlidsToContainerToImageIDMap("wlid1", "app", "myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822")
+	assert.ElementsMatch(t, []string{"wlid1", "wlid2"}, wh.GetWlidsForImageHash("myapp@sha256:6882017e7f8e9312816a4e6f174fd7c3690392272e93207bdc38e19ca7512255"))
+
+	// the previous image is no longer run by the WLID
+	wh.replaceInWlidsToContainerToImageIDMap("wlid1", "worker", "myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822")
+	assert.Equal(t, []string{"wlid2"}, wh.GetWlidsForImageHash("myapp@sha256:6882017e7f8e9312816a4e6f174fd7c3690392272e93207bdc38e19ca7512255"))
+	assert.Equal(t, []string{"wlid1"}, wh.GetWlidsForImageHash("myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822"))
+	assert.ElementsMatch(t, []string{"wlid1", "wlid2"}, wh.GetWlidsForImageHash("envoy@sha256:73971a8f26642b2749d12b0c0692ac2e75ea36137badf768fd3ef11da87c570f"))
+	assert.Equal(t, map[string]string{"app": "myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822", "worker": "myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822", "sidecar": "envoy@sha256:73971a8f26642b2749d12b0c0692ac2e75ea36137badf768fd3ef11da87c570f"}, wh.GetContainerToImageIDForWlid("wlid1"))
+}
+
+func TestHandlePodWatcherMutableTagDigestChange(t *testing.T) {
+	expectedWlid := "wlid://cluster-/namespace-default/pod-myapp"
+	firstDigest := newRunningPodFake("default", "myapp", map[string]string{"app": "myapp@sha256:6882017e7f8e9312816a4e6f174fd7c3690392272e93207bdc38e19ca7512255", "sidecar": "envoy@sha256:73971a8f26642b2749d12b0c0692ac2e75ea36137badf768fd3ef11da87c570f"})
+	secondDigest := newRunningPodFake("default", "myapp", map[string]string{"app": "myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822", "sidecar": "envoy@sha256:73971a8f26642b2749d12b0c0692ac2e75ea36137badf768fd3ef11da87c570f"})
+
+	tt := []struct {
+		name string
+		// secondDigestKnown is set if another workload already runs the second digest
+		secondDigestKnown bool
+	}{
+		{name: "new digest"},
+		{name: "new digest already known", secondDigestKnown: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// the API serves the restarted Pod when it is relisted once the watch ends
+			k8sAPI, _ := newK8sAPIFake(secondDigest.DeepCopy())
+			wh := NewWatchHandlerMock()
+			wh.k8sAPI = k8sAPI
+			otherWlid := "wlid://cluster-/namespace-default/pod-other"
+			if tc.secondDigestKnown {
+				wh.addToImageIDToWlidsMap("myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822", otherWlid)
+				wh.addToWlidsToContainerToImageIDMap(otherWlid, "app", "myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822")
+			}
+
+			recorder := &commandRecorder{}
+			podsWatch := watch.NewFake()
+			done := make(chan struct{})
+			go func() {
+				wh.handlePodWatcher(context.TODO(), podsWatch, newCommandDeduper(0, recorder.emit))
+				close(done)
+			}()
+
+			// the tag is pushed again and the Pod restarted with the same WLID
+			podsWatch.Modify(firstDigest.DeepCopy())
+			assert.Eventually(t, func() bool { return len(recorder.emitted()) == 1 }, time.Second, 10*time.Millisecond)
+			podsWatch.Modify(secondDigest.DeepCopy())
+			assert.Eventually(t, func() bool { return len(recorder.emitted()) == 2 }, time.Second, 10*time.Millisecond)
+			podsWatch.Stop()
+			<-done
+
+			emitted := recorder.emitted()
+			assert.Len(t, emitted, 2)
+			assert.Equal(t, map[string]string{"app": "myapp@sha256:6882017e7f8e9312816a4e6f174fd7c3690392272e93207bdc38e19ca7512255", "sidecar": "envoy@sha256:73971a8f26642b2749d12b0c0692ac2e75ea36137badf768fd3ef11da87c570f"}, emitted[0].Args[utils.ContainerToImageIdsArg])
+			assert.Equal(t, expectedWlid, emitted[1].Wlid)
+			assert.Equal(t, map[string]string{"app": "myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822"}, emitted[1].Args[utils.ContainerToImageIdsArg], "only the changed container should be scanned")
+
+			assert.Empty(t, wh.GetWlidsForImageHash("myapp@sha256:6882017e7f8e9312816a4e6f174fd7c3690392272e93207bdc38e19ca7512255"), "the previous digest should no longer reference the WLID")
+			expectedSecondDigestWlids := []string{expectedWlid}
+			if tc.secondDigestKnown {
+				expectedSecondDigestWlids = append(expectedSecondDigestWlids, otherWlid)
+			}
+			assert.ElementsMatch(t, expectedSecondDigestWlids, wh.GetWlidsForImageHash("myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822"))
+			assert.Equal(t, map[string]string{"app": "myapp@sha256:bcee845b1a09e476e6a5bb5afb7a689337a8241fb7378363977e9a1cbcd5c822", "sidecar": "envoy@sha256:73971a8f26642b2749d12b0c0692ac2e75ea36137badf768fd3ef11da87c570f"}, wh.GetContainerToImageIDForWlid(expectedWlid))
+		})
+	}
+}
+
+func TestGetInstanceIDs(t *testing.T) {
+	wh := NewWatchHandlerMock()
+	wh.managedInstanceIDSlugs = newPodInstanceIDs("instance-id-1", "instance-id-2")
+
+	instanceIDs := wh.GetInstanceIDs()
+	assert.Equal(t, []string{"instance-id-1", "instance-id-2"}, instanceIDs)
+
+	// the result is a copy that does not reflect later changes
+	instanceIDs[0] = "modified"
+	wh.cleanUpInstanceIDs()
+	assert.Equal(t, []string{"modified", "instance-id-2"}, instanceIDs)
+	assert.Equal(t, []string{}, wh.GetInstanceIDs())
+}
+
+func TestInstanceIDsConcurrentAccess(t *testing.T) {
+	instanceID, _ := instanceidv1.GenerateInstanceIDFromString("apiVersion-v1/namespace-default/kind-Pod/name-reverse-proxy/containerName-nginx")
+	knownInstanceIDSlug, _ := instanceID.GetSlug()
+
+	wh := NewWatchHandlerMock()
+
+	// run with -race: lookups must be synchronized with adds and cleanups
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				wh.addToInstanceIDsList("", instanceID)
+				wh.cleanUpInstanceIDs()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_ = wh.hasInstanceID(knownInstanceIDSlug)
+				_ = wh.GetInstanceIDs()
+			}
+		}()
+	}
+	wg.Wait()
+
+	wh.addToInstanceIDsList("", instanceID)
+	assert.True(t, wh.hasInstanceID(knownInstanceIDSlug))
+	assert.Equal(t, []string{knownInstanceIDSlug}, wh.GetInstanceIDs())
+}
+
+func TestAnnotationsToInstanceID(t *testing.T) {
+	validInstanceID := "apiVersion-apps/v1/namespace-default/kind-Deployment/name-nginx/containerName-nginx"
+	expectedInstanceID, _ := instanceidv1.GenerateInstanceIDFromString(validInstanceID)
+	expectedSlug, _ := expectedInstanceID.GetSlug()
+
+	tt := []struct {
+		name          string
+		annotations   map[string]string
+		expectedSlug  string
+		expectedError error
+	}{
+		{
+			name:         "Valid instance ID",
+			annotations:  map[string]string{instanceidv1.InstanceIDMetadataKey: validInstanceID},
+			expectedSlug: expectedSlug,
+		},
+		{
+			name:          "Missing instance ID",
+			annotations:   map[string]string{},
+			expectedError: ErrMissingInstanceIDAnnotation,
+		},
+		{
+			name:          "Missing fields",
+			annotations:   map[string]string{instanceidv1.InstanceIDMetadataKey: "apiVersion-v1/namespace-default/kind-Pod"},
+			expectedError: ErrMalformedInstanceIDAnnotation,
+		},
+		{
+			name:          "Empty fields",
+			annotations:   map[string]string{instanceidv1.InstanceIDMetadataKey: "apiVersion-v1/namespace-/kind-Pod/name-nginx/containerName-nginx"},
+			expectedError: ErrMalformedInstanceIDAnnotation,
+		},
+		{
+			name:          "Missing field prefixes",
+			annotations:   map[string]string{instanceidv1.InstanceIDMetadataKey: "v1/default/Pod/nginx/nginx"},
+			expectedError: ErrMalformedInstanceIDAnnotation,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			slug, err := annotationsToInstanceID(tc.annotations)
+			if tc.expectedError != nil {
+				assert.ErrorIs(t, err, tc.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedSlug, slug)
+		})
+	}
+}
+
+func TestHandleSBOMFilteredEventsConcurrentInstanceIDs(t *testing.T) {
+	instanceID, _ := instanceidv1.GenerateInstanceIDFromString("apiVersion-v1/namespace-default/kind-Pod/name-reverse-proxy/containerName-nginx")
+	knownInstanceIDSlug, _ := instanceID.GetSlug()
+
+	wh := NewWatchHandlerMock()
+	wh.storageClient = kssfake.NewSimpleClientset()
+
+	events := make(chan watch.Event)
+	errCh := make(chan error)
+	go wh.HandleSBOMFilteredEvents(context.TODO(), events, make(chan *apis.Command, 100), errCh)
+	go func() {
+		for range errCh {
+		}
+	}()
+
+	// reads of the instance IDs by the handler must not race with updates
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			wh.addToInstanceIDsList("", instanceID)
+			wh.cleanUpInstanceIDs()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		events <- watch.Event{
+			Type: watch.Added,
+			Object: &spdxv1beta1.SBOMSPDXv2p3Filtered{
+				ObjectMeta: v1.ObjectMeta{
+					Name:   fmt.Sprintf("filtered-%d", i),
+					Labels: managedLabels(),
+					Annotations: map[string]string{
+						instanceidv1.InstanceIDMetadataKey: "apiVersion-v1/namespace-default/kind-Pod/name-reverse-proxy/containerName-nginx",
+						instanceidv1.WlidMetadataKey:       "wlid://cluster-/namespace-default/pod-reverse-proxy",
+					},
+				},
+			},
+		}
+	}
+	close(events)
+	wg.Wait()
+
+	wh.addToInstanceIDsList("", instanceID)
+	assert.True(t, wh.hasInstanceID(knownInstanceIDSlug))
+}
+
+// newJobFake returns a Job, owned by the CronJob with the given name unless it is empty
+func newJobFake(namespace, name, cronJobName string) *batchv1.Job {
+	job := &batchv1.Job{
+		TypeMeta:   v1.TypeMeta{Kind: "Job", APIVersion: "batch/v1"},
+		ObjectMeta: v1.ObjectMeta{Name: name, Namespace: namespace},
+	}
+	if cronJobName != "" {
+		job.OwnerReferences = []v1.OwnerReference{{APIVersion: "batch/v1", Kind: "CronJob", Name: cronJobName}}
+	}
+	return job
+}
+
+// backupImageIDs are the image IDs of the containers of the Job Pods
+var backupImageIDs = map[string]string{"backup": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"}
+
+func TestGetParentIDForJobPods(t *testing.T) {
+	cronJob := &batchv1.CronJob{
+		TypeMeta:   v1.TypeMeta{Kind: "CronJob", APIVersion: "batch/v1"},
+		ObjectMeta: v1.ObjectMeta{Name: "backup", Namespace: "default"},
+	}
+
+	tt := []struct {
+		name         string
+		objects      []runtime.Object
+		pod          *core1.Pod
+		expectedWlid string
+	}{
+		{
+			name:         "Pod of a Job owned by a CronJob resolves to the CronJob",
+			objects:      []runtime.Object{cronJob, newJobFake("default", "backup-28000000", "backup")},
+			pod:          newRunningPodFake("default", "backup-28000000-abcde", backupImageIDs, withJobOwner("backup-28000000")),
+			expectedWlid: "wlid://cluster-/namespace-default/cronjob-backup",
+		},
+		{
+			name:         "Pod of a Job owned by a CronJob that cannot be fetched resolves to the CronJob",
+			objects:      []runtime.Object{newJobFake("default", "backup-28000000", "backup")},
+			pod:          newRunningPodFake("default", "backup-28000000-abcde", backupImageIDs, withJobOwner("backup-28000000")),
+			expectedWlid: "wlid://cluster-/namespace-default/cronjob-backup",
+		},
+		{
+			name:         "Pod of a standalone Job resolves to the Job",
+			objects:      []runtime.Object{newJobFake("default", "migrate", "")},
+			pod:          newRunningPodFake("default", "migrate-abcde", backupImageIDs, withJobOwner("migrate")),
+			expectedWlid: "wlid://cluster-/namespace-default/job-migrate",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			k8sAPI, _ := newK8sAPIFake(append(tc.objects, tc.pod)...)
+			wh := NewWatchHandlerMock()
+			wh.k8sAPI = k8sAPI
+
+			_, wlid, err := wh.getParentForPod(tc.pod.DeepCopy())
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedWlid, wlid)
+		})
+	}
+}
+
+func TestGetParentForPod(t *testing.T) {
+	objects := []runtime.Object{
+		&appsv1.Deployment{
+			TypeMeta:   v1.TypeMeta{Kind: "Deployment", APIVersion: "apps/v1"},
+			ObjectMeta: v1.ObjectMeta{Name: "nginx", Namespace: "default"},
+		},
+		&appsv1.ReplicaSet{
+			TypeMeta: v1.TypeMeta{Kind: "ReplicaSet", APIVersion: "apps/v1"},
+			ObjectMeta: v1.ObjectMeta{
+				Name:            "nginx-5d8b7f9c6d",
+				Namespace:       "default",
+				OwnerReferences: []v1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: "nginx"}},
+			},
+		},
+		&appsv1.ReplicaSet{
+			TypeMeta:   v1.TypeMeta{Kind: "ReplicaSet", APIVersion: "apps/v1"},
+			ObjectMeta: v1.ObjectMeta{Name: "bare", Namespace: "default"},
+		},
+		&appsv1.StatefulSet{
+			TypeMeta:   v1.TypeMeta{Kind: "StatefulSet", APIVersion: "apps/v1"},
+			ObjectMeta: v1.ObjectMeta{Name: "postgres", Namespace: "default"},
+		},
+		&appsv1.DaemonSet{
+			TypeMeta:   v1.TypeMeta{Kind: "DaemonSet", APIVersion: "apps/v1"},
+			ObjectMeta: v1.ObjectMeta{Name: "fluentd", Namespace: "default"},
+		},
+		&batchv1.CronJob{
+			TypeMeta:   v1.TypeMeta{Kind: "CronJob", APIVersion: "batch/v1"},
+			ObjectMeta: v1.ObjectMeta{Name: "backup", Namespace: "default"},
+		},
+		newJobFake("default", "backup-28000000", "backup"),
+		newJobFake("default", "migrate", ""),
+	}
+	ownedPod := func(name, ownerAPIVersion, ownerKind, ownerName string, labels map[string]string) *core1.Pod {
+		pod := newRunningPodFake("default", name, map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"})
+		pod.OwnerReferences = []v1.OwnerReference{{APIVersion: ownerAPIVersion, Kind: ownerKind, Name: ownerName}}
+		pod.Labels = labels
+		return pod
+	}
+
+	tt := []struct {
+		name         string
+		pod          *core1.Pod
+		expectedWlid string
+	}{
+		{
+			name:         "Deployment",
+			pod:          ownedPod("nginx-5d8b7f9c6d-abcde", "apps/v1", "ReplicaSet", "nginx-5d8b7f9c6d", map[string]string{"pod-template-hash": "5d8b7f9c6d"}),
+			expectedWlid: "wlid://cluster-/namespace-default/deployment-nginx",
+		},
+		{
+			name:         "ReplicaSet",
+			pod:          ownedPod("bare-abcde", "apps/v1", "ReplicaSet", "bare", nil),
+			expectedWlid: "wlid://cluster-/namespace-default/replicaset-bare",
+		},
+		{
+			name:         "StatefulSet",
+			pod:          ownedPod("postgres-0", "apps/v1", "StatefulSet", "postgres", nil),
+			expectedWlid: "wlid://cluster-/namespace-default/statefulset-postgres",
+		},
+		{
+			name:         "DaemonSet",
+			pod:          ownedPod("fluentd-abcde", "apps/v1", "DaemonSet", "fluentd", nil),
+			expectedWlid: "wlid://cluster-/namespace-default/daemonset-fluentd",
+		},
+		{
+			name:         "CronJob",
+			pod:          newRunningPodFake("default", "backup-28000000-abcde", backupImageIDs, withJobOwner("backup-28000000")),
+			expectedWlid: "wlid://cluster-/namespace-default/cronjob-backup",
+		},
+		{
+			name:         "Job",
+			pod:          newRunningPodFake("default", "migrate-abcde", backupImageIDs, withJobOwner("migrate")),
+			expectedWlid: "wlid://cluster-/namespace-default/job-migrate",
+		},
+		{
+			name:         "naked Pod",
+			pod:          newRunningPodFake("default", "standalone", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"}),
+			expectedWlid: "wlid://cluster-/namespace-default/pod-standalone",
+		},
+		{
+			name:         "static Pod",
+			pod:          ownedPod("kube-apiserver-control-plane", "v1", "Node", "control-plane", nil),
+			expectedWlid: "wlid://cluster-/namespace-default/pod-kube-apiserver-control-plane",
+		},
+		{
+			name:         "Pod of a custom resource",
+			pod:          ownedPod("vizier-abcde", "px.dev/v1alpha1", "Vizier", "pixie", nil),
+			expectedWlid: "wlid://cluster-/namespace-default/pod-vizier-abcde",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			k8sAPI, _ := newK8sAPIFake(append(objects, tc.pod)...)
+			wh := NewWatchHandlerMock()
+			wh.k8sAPI = k8sAPI
+			pod := tc.pod.DeepCopy()
+			pod.TypeMeta = v1.TypeMeta{}
+
+			parent, wlid, err := wh.getParentForPod(pod)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedWlid, wlid)
+			assert.Equal(t, tc.expectedWlid, pkgwlid.GetWLID(utils.ClusterConfig.ClusterName, parent.GetNamespace(), parent.GetKind(), parent.GetName()))
+			assert.Equal(t, v1.TypeMeta{}, pod.TypeMeta, "the Pod should not be mutated")
+		})
+	}
+}
+
+func TestCleanUpCollapsesCronJobRuns(t *testing.T) {
+	cronJob := &batchv1.CronJob{
+		TypeMeta:   v1.TypeMeta{Kind: "CronJob", APIVersion: "batch/v1"},
+		ObjectMeta: v1.ObjectMeta{Name: "backup", Namespace: "default"},
+	}
+	k8sAPI, _ := newK8sAPIFake(
+		cronJob,
+		newJobFake("default", "backup-28000000", "backup"),
+		newJobFake("default", "backup-28000060", "backup"),
+		newRunningPodFake("default", "backup-28000000-abcde", backupImageIDs, withJobOwner("backup-28000000")),
+		newRunningPodFake("default", "backup-28000060-fghij", backupImageIDs, withJobOwner("backup-28000060")),
+	)
+
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	wh.storageClient = kssfake.NewSimpleClientset()
+	// historical WLIDs of the Jobs, as tracked before resolving CronJobs
+	for _, jobWlid := range []string{"wlid://cluster-/namespace-default/job-backup-28000000", "wlid://cluster-/namespace-default/job-backup-28000060"} {
+		wh.addToImageIDToWlidsMap("alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547", jobWlid)
+		wh.addToWlidsToContainerToImageIDMap(jobWlid, "backup", "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547")
+	}
+
+	wh.cleanUp(context.TODO())
+
+	expectedWlid := "wlid://cluster-/namespace-default/cronjob-backup"
+	assert.Equal(t, []string{expectedWlid}, wh.GetWlidsForImageHash("alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"))
+	assert.Equal(t, WlidsToContainerToImageIDMap{expectedWlid: {"backup": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"}}, wh.GetWlidsToContainerToImageIDMap())
+}
+
+func TestForceResync(t *testing.T) {
+	k8sAPI, k8sClient := newK8sAPIFake(newRunningPodFake("default", "nginx", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"}))
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	wh.storageClient = kssfake.NewSimpleClientset()
+	// stale entries of a Pod that is gone
+	staleWlid := "wlid://cluster-/namespace-default/pod-gone"
+	wh.addToImageIDToWlidsMap("alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547", staleWlid)
+	wh.addToWlidsToContainerToImageIDMap(staleWlid, "alpine", "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547")
+
+	assert.NoError(t, wh.ForceResync(context.TODO()))
+
+	expectedWlid := "wlid://cluster-/namespace-default/pod-nginx"
+	assert.Equal(t, WlidsToContainerToImageIDMap{expectedWlid: {"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"}}, wh.GetWlidsToContainerToImageIDMap())
+	assert.Equal(t, []string{expectedWlid}, wh.GetWlidsForImageHash("nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"))
+	assert.Empty(t, wh.GetWlidsForImageHash("alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"))
+
+	// run with -race: resyncs must be serialized with the cleanUp routine
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, wh.ForceResync(context.TODO()))
+		}()
+		go func() {
+			defer wg.Done()
+			wh.cleanUp(context.TODO())
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, WlidsToContainerToImageIDMap{expectedWlid: {"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"}}, wh.GetWlidsToContainerToImageIDMap())
+
+	// a failing list is returned and leaves the maps untouched
+	listErr := errors.New("list failed")
+	k8sClient.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, listErr
+	})
+	assert.ErrorIs(t, wh.ForceResync(context.TODO()), listErr)
+	assert.Equal(t, WlidsToContainerToImageIDMap{expectedWlid: {"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"}}, wh.GetWlidsToContainerToImageIDMap())
+}
+
+func TestGetParentIDForNakedPods(t *testing.T) {
+	tt := []struct {
+		name            string
+		ownerReferences []v1.OwnerReference
+		labels          map[string]string
+	}{
+		{
+			name: "Pod without owners resolves to the Pod",
+		},
+		{
+			name:   "Pod without owners but with a pod-template-hash label resolves to the Pod",
+			labels: map[string]string{"pod-template-hash": "5d8b7f9c6d"},
+		},
+		{
+			name:            "Pod owned by a custom resource that cannot be fetched resolves to the Pod",
+			ownerReferences: []v1.OwnerReference{{APIVersion: "px.dev/v1alpha1", Kind: "Vizier", Name: "pixie"}},
+		},
+		{
+			name:            "Pod owned by a custom resource of an unknown kind resolves to the Pod",
+			ownerReferences: []v1.OwnerReference{{APIVersion: "example.com/v1", Kind: "Unknown", Name: "unknown"}},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := newRunningPodFake("default", "standalone", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"})
+			pod.OwnerReferences = tc.ownerReferences
+			pod.Labels = tc.labels
+
+			k8sAPI, k8sClient := newK8sAPIFake(pod)
+			wh := NewWatchHandlerMock()
+			wh.k8sAPI = k8sAPI
+			wh.storageClient = kssfake.NewSimpleClientset()
+
+			expectedWlid := "wlid://cluster-/namespace-default/pod-standalone"
+			_, wlid, err := wh.getParentForPod(pod.DeepCopy())
+			assert.NoError(t, err)
+			assert.Equal(t, expectedWlid, wlid)
+
+			// the images of the Pod are indexed under the Pod WLID
+			assert.NoError(t, wh.buildIDs(context.TODO(), podListIterator(&core1.PodList{Items: []core1.Pod{*pod}})))
+			assert.Equal(t, []string{expectedWlid}, wh.GetWlidsForImageHash("nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"))
+
+			// and kept by cleanUp as long as the Pod is running
+			wh.cleanUp(context.TODO())
+			assert.Equal(t, []string{expectedWlid}, wh.GetWlidsForImageHash("nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"))
+
+			// but removed once the Pod is gone
+			assert.NoError(t, k8sClient.CoreV1().Pods("default").Delete(context.TODO(), "standalone", v1.DeleteOptions{}))
+			wh.cleanUp(context.TODO())
+			assert.Empty(t, wh.GetWlidsForImageHash("nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"))
+		})
+	}
+}
+
+func TestPodWatchOptionsAllowBookmarks(t *testing.T) {
+	wh := NewWatchHandlerMock()
+	wh.setPodListResourceVersion("42")
+
+	assert.Equal(t, v1.ListOptions{ResourceVersion: "42", AllowWatchBookmarks: true}, wh.podWatchOptions())
+}
+
+func TestHandlePodWatcherBookmarks(t *testing.T) {
+	// a bookmark carries a Pod object with nothing but a resource version.
+	// Give it a phase and containers to make sure it is not handled as a Pod
+	bookmark := newRunningPodFake("", "", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"})
+	bookmark.ResourceVersion = "42"
+	expired := &v1.Status{Status: v1.StatusFailure, Code: 410, Reason: v1.StatusReasonExpired}
+	internalError := &v1.Status{Status: v1.StatusFailure, Code: 500, Reason: v1.StatusReasonInternalError}
+
+	tt := []struct {
+		name                    string
+		events                  []watch.Event
+		expectedRelist          bool
+		expectedResourceVersion string
+	}{
+		{
+			name:                    "closed watch resumes from the bookmark",
+			events:                  []watch.Event{{Type: watch.Bookmark, Object: bookmark}},
+			expectedRelist:          false,
+			expectedResourceVersion: "42",
+		},
+		{
+			name:           "closed watch without bookmarks relists",
+			expectedRelist: true,
+		},
+		{
+			name:           "expired resource version relists",
+			events:         []watch.Event{{Type: watch.Bookmark, Object: bookmark}, {Type: watch.Error, Object: expired}},
+			expectedRelist: true,
+		},
+		{
+			name:                    "failed watch resumes from the bookmark",
+			events:                  []watch.Event{{Type: watch.Bookmark, Object: bookmark}, {Type: watch.Error, Object: internalError}},
+			expectedRelist:          false,
+			expectedResourceVersion: "42",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			k8sAPI, k8sClient := newK8sAPIFake()
+			wh := NewWatchHandlerMock()
+			wh.k8sAPI = k8sAPI
+
+			recorder := &commandRecorder{}
+			podsWatch := watch.NewFakeWithChanSize(len(tc.events), false)
+			for _, event := range tc.events {
+				podsWatch.Action(event.Type, event.Object)
+			}
+			podsWatch.Stop()
+			wh.handlePodWatcher(context.TODO(), podsWatch, newCommandDeduper(0, recorder.emit))
+
+			relisted := false
+			for _, action := range k8sClient.Actions() {
+				if action.Matches("list", "pods") {
+					relisted = true
+				}
+			}
+			assert.Equal(t, tc.expectedRelist, relisted)
+			if !tc.expectedRelist {
+				assert.Equal(t, tc.expectedResourceVersion, wh.podListResourceVersion())
+			}
+			assert.Empty(t, recorder.emitted(), "bookmarks should not trigger scans")
+			assert.Empty(t, wh.GetWlidsToContainerToImageIDMap())
+		})
+	}
+}
+
+func TestPodWatchRelistsOnExpiredResourceVersion(t *testing.T) {
+	k8sAPI, k8sClient := newK8sAPIFake()
+	k8sClient.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, &core1.PodList{ListMeta: v1.ListMeta{ResourceVersion: "43"}}, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var watchedResourceVersions []string
+	k8sClient.PrependWatchReactor("pods", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		watchedResourceVersions = append(watchedResourceVersions, action.(k8stesting.WatchActionImpl).GetWatchRestrictions().ResourceVersion)
+		if len(watchedResourceVersions) == 1 {
+			return true, nil, k8serrors.NewResourceExpired("too old resource version: 42")
+		}
+		cancel()
+		fakeWatcher := watch.NewFake()
+		fakeWatcher.Stop()
+		return true, fakeWatcher, nil
+	})
+
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	wh.setPodListResourceVersion("42")
+
+	done := make(chan struct{})
+	go func() {
+		wh.PodWatch(ctx, &commandRecorder{})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the pod watch should be re-established right after relisting")
+	}
+	assert.Equal(t, []string{"42", "43"}, watchedResourceVersions, "the pod watch should not be re-established from the expired resource version")
+}
+
+func TestHandlePodWatcherForgetsExpiredResourceVersion(t *testing.T) {
+	k8sAPI, k8sClient := newK8sAPIFake()
+	k8sClient.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("list failed")
+	})
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	wh.setPodListResourceVersion("42")
+
+	podsWatch := watch.NewFakeWithChanSize(1, false)
+	podsWatch.Error(&v1.Status{Status: v1.StatusFailure, Code: 410, Reason: v1.StatusReasonGone})
+	wh.handlePodWatcher(context.TODO(), podsWatch, newCommandDeduper(0, (&commandRecorder{}).emit))
+
+	assert.Empty(t, wh.podListResourceVersion(), "the expired resource version should be forgotten even if the relist fails")
+}
+
+func TestHandlePodWatcherReturnsWhyItEnded(t *testing.T) {
+	bookmark := &core1.Pod{ObjectMeta: v1.ObjectMeta{ResourceVersion: "43"}}
+	expired := &v1.Status{Status: v1.StatusFailure, Code: 410, Reason: v1.StatusReasonExpired}
+
+	tt := []struct {
+		name       string
+		listFails  bool
+		cancelled  bool
+		end        func(podsWatch *watch.FakeWatcher)
+		expected   error
+		unexpected []error
+	}{
+		{
+			name: "resumable watch closing",
+			end: func(podsWatch *watch.FakeWatcher) {
+				podsWatch.Action(watch.Bookmark, bookmark)
+				podsWatch.Stop()
+			},
+			// the watch is resumed from the bookmark, without relisting
+			listFails: true,
+			expected:  ErrPodWatchClosed,
+		},
+		{
+			name:     "relisted watch closing",
+			end:      func(podsWatch *watch.FakeWatcher) { podsWatch.Stop() },
+			expected: ErrPodWatchClosed,
+		},
+		{
+			name:      "watch closing and relist failing",
+			listFails: true,
+			end:       func(podsWatch *watch.FakeWatcher) { podsWatch.Stop() },
+			expected:  ErrPodRelistFailed,
+		},
+		{
+			name:     "expired resource version",
+			end:      func(podsWatch *watch.FakeWatcher) { podsWatch.Error(expired) },
+			expected: ErrPodWatchClosed,
+		},
+		{
+			name:      "expired resource version and relist failing",
+			listFails: true,
+			end:       func(podsWatch *watch.FakeWatcher) { podsWatch.Error(expired) },
+			expected:  ErrPodRelistFailed,
+		},
+		{
+			name:      "context cancelled",
+			cancelled: true,
+			end:       func(podsWatch *watch.FakeWatcher) {},
+			expected:  ErrPodWatchCancelled,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			k8sAPI, k8sClient := newK8sAPIFake()
+			if tc.listFails {
+				k8sClient.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, errors.New("list failed")
+				})
+			}
+			wh := NewWatchHandlerMock()
+			wh.k8sAPI = k8sAPI
+			wh.setPodListResourceVersion("42")
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.cancelled {
+				cancel()
+			}
+
+			podsWatch := watch.NewFakeWithChanSize(2, false)
+			tc.end(podsWatch)
+			err := wh.handlePodWatcher(ctx, podsWatch, newCommandDeduper(0, (&commandRecorder{}).emit))
+
+			assert.ErrorIs(t, err, tc.expected)
+			for _, other := range []error{ErrPodWatchClosed, ErrPodRelistFailed, ErrPodWatchCancelled} {
+				if other != tc.expected {
+					assert.NotErrorIs(t, err, other)
+				}
+			}
+			assert.True(t, podsWatch.IsStopped(), "the watch should be stopped once the watcher returns")
+		})
+	}
+}
+
+func TestHandlePodEventSkipsNonPods(t *testing.T) {
+	status := &v1.Status{Status: v1.StatusFailure, Reason: v1.StatusReasonInternalError}
+	for _, eventType := range []watch.EventType{watch.Error, watch.Added, watch.Modified, watch.Deleted} {
+		t.Run(string(eventType), func(t *testing.T) {
+			wh := NewWatchHandlerMock()
+			recorder := &commandRecorder{}
+
+			assert.NotPanics(t, func() {
+				assert.NoError(t, wh.handlePodEvent(context.TODO(), watch.Event{Type: eventType, Object: status}, newCommandDeduper(0, recorder.emit)))
+			})
+			assert.Empty(t, recorder.emitted())
+			assert.Empty(t, wh.SnapshotImageHashWLIDs())
+		})
+	}
+}
+
+func TestPodWatchGivesUpAfterRelistFailures(t *testing.T) {
+	tt := []struct {
+		name                 string
+		podRelistMaxFailures int
+		expectedErr          bool
+	}{
+		{
+			name:                 "escalated",
+			podRelistMaxFailures: 1,
+			expectedErr:          true,
+		},
+		{
+			name:                 "retried",
+			podRelistMaxFailures: 2,
+		},
+		{
+			name:                 "retried forever",
+			podRelistMaxFailures: 0,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			k8sAPI, k8sClient := newK8sAPIFake()
+			k8sClient.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				// the pod watch backs off before retrying, unless it is cancelled
+				if !tc.expectedErr {
+					cancel()
+				}
+				return true, nil, errors.New("list failed")
+			})
+			k8sClient.PrependWatchReactor("pods", func(action k8stesting.Action) (bool, watch.Interface, error) {
+				fakeWatcher := watch.NewFake()
+				fakeWatcher.Stop()
+				return true, fakeWatcher, nil
+			})
+
+			wh := NewWatchHandlerMock()
+			wh.k8sAPI = k8sAPI
+			wh.setPodListResourceVersion("42")
+			wh.podRelistMaxFailures = tc.podRelistMaxFailures
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- wh.PodWatch(ctx, &commandRecorder{})
+			}()
+
+			select {
+			case err := <-errCh:
+				if tc.expectedErr {
+					assert.ErrorIs(t, err, ErrPodRelistFailed, "the pod watch should give up once the pods failed to be relisted too many times in a row")
+				} else {
+					assert.NoError(t, err, "the pod watch should keep retrying until its context is cancelled")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the pod watch should return")
+			}
+		})
+	}
+}
+
+func TestGetPodFromEventIfRunning(t *testing.T) {
+	nginxImageIDs := map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"}
+	runningPod := newRunningPodFake("default", "nginx", nginxImageIDs)
+	stoppedPod := newRunningPodFake("default", "nginx", nginxImageIDs, withContainerStates(core1.PodRunning, core1.ContainerState{Terminated: &core1.ContainerStateTerminated{}}))
+
+	tt := []struct {
+		name           string
+		event          watch.Event
+		objects        []runtime.Object
+		expectedOk     bool
+		expectedLookup bool
+	}{
+		{
+			name:       "running Pod is detected from the event",
+			event:      watch.Event{Type: watch.Modified, Object: runningPod},
+			expectedOk: true,
+		},
+		{
+			name:       "terminating Pod is detected from the event",
+			event:      watch.Event{Type: watch.Modified, Object: newRunningPodFake("default", "nginx", nginxImageIDs, withDeletion())},
+			objects:    []runtime.Object{runningPod},
+			expectedOk: false,
+		},
+		{
+			name:       "Pods that are not running are ignored",
+			event:      watch.Event{Type: watch.Modified, Object: &core1.Pod{Status: core1.PodStatus{Phase: core1.PodPending}}},
+			expectedOk: false,
+		},
+		{
+			name:       "events other than modifications are ignored",
+			event:      watch.Event{Type: watch.Added, Object: runningPod},
+			expectedOk: false,
+		},
+		{
+			name:           "existing Pod without running containers is looked up",
+			event:          watch.Event{Type: watch.Modified, Object: stoppedPod},
+			objects:        []runtime.Object{stoppedPod},
+			expectedOk:     true,
+			expectedLookup: true,
+		},
+		{
+			name:           "deleted Pod without running containers is looked up",
+			event:          watch.Event{Type: watch.Modified, Object: stoppedPod},
+			expectedOk:     false,
+			expectedLookup: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			k8sAPI, _ := newK8sAPIFake(tc.objects...)
+			wh := NewWatchHandlerMock()
+			wh.k8sAPI = k8sAPI
+
+			pod, ok := wh.getPodFromEventIfRunning(context.TODO(), tc.event)
+
+			assert.Equal(t, tc.expectedOk, ok)
+			if ok {
+				assert.Equal(t, tc.event.Object, pod)
+			}
+			lookups := k8sAPI.DynamicClient.(*dynamicfake.FakeDynamicClient).Actions()
+			assert.Equal(t, tc.expectedLookup, len(lookups) > 0)
+		})
+	}
+}
+
+func TestHandlePodWatcherGracefulDeletion(t *testing.T) {
+	nginxImageIDs := map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"}
+	runningPod := newRunningPodFake("default", "nginx", nginxImageIDs)
+	terminatedState := core1.ContainerState{Terminated: &core1.ContainerStateTerminated{ExitCode: 0, Reason: "Completed"}}
+
+	// the events the API server emits while a Pod is deleted gracefully
+	events := []watch.Event{
+		{Type: watch.Modified, Object: newRunningPodFake("default", "nginx", nginxImageIDs, withDeletion())},
+		{Type: watch.Modified, Object: newRunningPodFake("default", "nginx", nginxImageIDs, withDeletion(), withContainerStates(core1.PodRunning, terminatedState))},
+		{Type: watch.Modified, Object: newRunningPodFake("default", "nginx", nginxImageIDs, withDeletion(), withContainerStates(core1.PodSucceeded, terminatedState))},
+		{Type: watch.Deleted, Object: newRunningPodFake("default", "nginx", nginxImageIDs, withDeletion(), withContainerStates(core1.PodSucceeded, terminatedState))},
+	}
+
+	// the Pod is still served during the grace period, but no longer
+	// listed once it is deleted, when the watch ends
+	k8sAPI, k8sClient := newK8sAPIFake(runningPod)
+	assert.NoError(t, k8sClient.CoreV1().Pods(runningPod.Namespace).Delete(context.TODO(), runningPod.Name, v1.DeleteOptions{}))
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+
+	recorder := &commandRecorder{}
+	podsWatch := watch.NewFakeWithChanSize(len(events), false)
+	for _, event := range events {
+		podsWatch.Action(event.Type, event.Object)
+	}
+	podsWatch.Stop()
+	wh.handlePodWatcher(context.TODO(), podsWatch, newCommandDeduper(0, recorder.emit))
+
+	assert.Empty(t, recorder.emitted(), "terminating Pods should not trigger scans")
+	assert.Empty(t, wh.GetWlidsToContainerToImageIDMap())
+	assert.Empty(t, k8sAPI.DynamicClient.(*dynamicfake.FakeDynamicClient).Actions(), "terminating Pods should be detected without querying the API")
+}
+
+//go:embed testdata/static-pod-kube-apiserver.json
+var staticPodKubeAPIServerJson []byte
+
+func TestStaticPodsUsePodWlid(t *testing.T) {
+	node := &core1.Node{
+		TypeMeta:   v1.TypeMeta{Kind: "Node", APIVersion: "v1"},
+		ObjectMeta: v1.ObjectMeta{Name: "control-plane"},
+	}
+
+	tt := []struct {
+		name    string
+		objects []runtime.Object
+	}{
+		{
+			name:    "Node exists",
+			objects: []runtime.Object{node},
+		},
+		{
+			name: "Node cannot be fetched",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &core1.Pod{}
+			assert.NoError(t, json.Unmarshal(staticPodKubeAPIServerJson, pod))
+			imageID := pod.Status.ContainerStatuses[0].ImageID
+
+			k8sAPI, _ := newK8sAPIFake(append(tc.objects, pod.DeepCopy())...)
+			wh := NewWatchHandlerMock()
+			wh.k8sAPI = k8sAPI
+
+			expectedWlid := "wlid://cluster-/namespace-kube-system/pod-kube-apiserver-control-plane"
+
+			// buildIDs and the Pod watcher agree on the WLID
+			assert.NoError(t, wh.buildIDs(context.TODO(), podListIterator(&core1.PodList{Items: []core1.Pod{*pod}})))
+			assert.Equal(t, []string{expectedWlid}, wh.GetWlidsForImageHash(imageID))
+
+			_, wlid, err := wh.getParentForPod(pod.DeepCopy())
+			assert.NoError(t, err)
+			assert.Equal(t, expectedWlid, wlid)
+
+			// instance IDs are generated, so relevancy data of the control plane is not orphaned
+			instanceID, _ := instanceidv1.GenerateInstanceIDFromString("apiVersion-v1/namespace-kube-system/kind-Pod/name-kube-apiserver-control-plane/containerName-kube-apiserver")
+			instanceIDSlug, _ := instanceID.GetSlug()
+			assert.True(t, wh.hasInstanceID(instanceIDSlug))
+		})
+	}
+}
+
+//go:embed testdata/deployment-two-containers.json
+var deploymentTwoContainersJson []byte
+
+//go:embed testdata/deployment.json
+var deploymentJson []byte
+
+// prependPaginatedPodsReactor makes the fake client serve the Pods of podList
+// in consecutive pages of pageSize. Returns the counter of List calls
+func prependPaginatedPodsReactor(k8sClient *k8sfake.Clientset, podList *core1.PodList, pageSize int) *int {
+	listCalls := 0
+	k8sClient.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		start := (listCalls * pageSize) % len(podList.Items)
+		end := start + pageSize
+		listCalls++
+
+		page := &core1.PodList{ListMeta: v1.ListMeta{ResourceVersion: "100"}}
+		if end < len(podList.Items) {
+			page.Continue = "continue"
+		} else {
+			end = len(podList.Items)
+		}
+		for i := start; i < end; i++ {
+			page.Items = append(page.Items, *podList.Items[i].DeepCopy())
+		}
+		return true, page, nil
+	})
+	return &listCalls
+}
+
+func TestListPodsPaginated(t *testing.T) {
+	pendingPod := newRunningPodFake("default", "pending", map[string]string{"app": "docker-pullable://alpine@sha256:2b3c88defe3996017045aef9a1f1f28d287e4e7daa6297d0493220b6368a4c4e"})
+	pendingPod.Status.Phase = core1.PodPending
+	podList := &core1.PodList{
+		Items: []core1.Pod{
+			*newRunningPodFake("default", "pod1", map[string]string{"app": "docker-pullable://alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"}),
+			*newRunningPodFake("default", "pod2", map[string]string{"app": "docker-pullable://alpine@sha256:6d672e7c79ce066ef8afc7a801a52d2531e822561dd8f9d2f19583d6e2be55bb", "sidecar": "docker-pullable://alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"}),
+			*pendingPod,
+			*newRunningPodFake("other", "pod3", map[string]string{"app": "docker-pullable://alpine@sha256:8d8beb9fd7bbcfddb9838219929c6ac7c0f44bfd437d52a5c595e2745c1c2316"}),
+			*newRunningPodFake("other", "pod4", map[string]string{"app": "docker-pullable://alpine@sha256:8d8beb9fd7bbcfddb9838219929c6ac7c0f44bfd437d52a5c595e2745c1c2316"}),
+		},
+	}
+	objects := []runtime.Object{}
+	for i := range podList.Items {
+		objects = append(objects, &podList.Items[i])
+	}
+
+	// reference: build the maps from the whole list at once
+	k8sAPI, _ := newK8sAPIFake(objects...)
+	expected := NewWatchHandlerMock()
+	expected.k8sAPI = k8sAPI
+	assert.NoError(t, expected.buildIDs(context.TODO(), podListIterator(podList.DeepCopy())))
+
+	// paginated: serve the same Pods two at a time
+	k8sAPI, k8sClient := newK8sAPIFake(objects...)
+	listCalls := prependPaginatedPodsReactor(k8sClient, podList, 2)
+	actual := NewWatchHandlerMock()
+	actual.k8sAPI = k8sAPI
+
+	var resourceVersion string
+	err := actual.buildIDs(context.TODO(), func(handlePod func(pod *core1.Pod) error) (err error) {
+		resourceVersion, err = actual.listPods(context.TODO(), handlePod)
+		return err
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, *listCalls)
+	assert.Equal(t, "100", resourceVersion)
+	assert.Equal(t, expected.snapshotState(), actual.snapshotState())
+	assert.Len(t, actual.GetWlidsToContainerToImageIDMap(), 4)
+}
+
+func TestImagePinningClassification(t *testing.T) {
+	pod := newRunningPodFake("default", "pinning", map[string]string{
+		"pinned":  "docker-pullable://nginx@sha256:1f4e3b6489888647ce1834b601c6c06b9f8c03dee6e097e13ed3e28c01ea3ac8",
+		"mutable": "docker-pullable://alpine@sha256:c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ee",
+	})
+	pod.Spec.Containers[0].Image = "alpine:latest"
+	pod.Spec.Containers[1].Image = "nginx@sha256:1f4e3b6489888647ce1834b601c6c06b9f8c03dee6e097e13ed3e28c01ea3ac8"
+
+	k8sAPI, _ := newK8sAPIFake(pod)
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	assert.NoError(t, wh.buildIDs(context.TODO(), podListIterator(&core1.PodList{Items: []core1.Pod{*pod}})))
+
+	wlid := "wlid://cluster-/namespace-default/pod-pinning"
+	assert.Equal(t, map[string]bool{"mutable": false, "pinned": true}, wh.GetContainerToImagePinnedForWlid(wlid))
+	assert.Equal(t, map[string][]string{wlid: {"mutable"}}, wh.GetMutableTagContainers())
+	assert.Equal(t, int64(1), wh.Metrics()[metricMutableTagContainersTotal])
+
+	cmd := getImageScanCommand(wlid, wh.GetContainerToImageIDForWlid(wlid))
+	wh.setImagePinningArg(cmd)
+	assert.Equal(t, map[string]bool{"mutable": false, "pinned": true}, cmd.Args[utils.ContainerToImagePinnedArg])
+}
+
+func TestBuildIDsDoesNotMutatePods(t *testing.T) {
+	pod := newRunningPodFake("default", "pod1", map[string]string{"app": "docker-pullable://alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"})
+	pod.TypeMeta = v1.TypeMeta{}
+	k8sAPI, _ := newK8sAPIFake(newRunningPodFake("default", "pod1", map[string]string{"app": "docker-pullable://alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"}))
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+
+	podList := &core1.PodList{Items: []core1.Pod{*pod}}
+	expected := podList.DeepCopy()
+
+	assert.NoError(t, wh.buildIDs(context.TODO(), podListIterator(podList)))
+	assert.Equal(t, expected, podList)
+	assert.Len(t, wh.GetWlidsToContainerToImageIDMap(), 1)
+}
+
+func TestBuildIDsIndexesInitContainers(t *testing.T) {
+	ctx := context.TODO()
+	pod := newRunningPodFake("default", "migrating", map[string]string{"app": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"})
+	pod.Spec.InitContainers = []core1.Container{{Name: "migrate", Image: "migrate:latest"}}
+	pod.Status.InitContainerStatuses = []core1.ContainerStatus{
+		{
+			Name:    "migrate",
+			ImageID: "docker-pullable://migrate@sha256:2e0e455c9e1056b56154d3b2dafc55dcab163ce0acdc2ff6c3a06b80a5d0bf80",
+			State:   core1.ContainerState{Terminated: &core1.ContainerStateTerminated{ExitCode: 0}},
+		},
+	}
+	expectedWlid := "wlid://cluster-/namespace-default/pod-migrating"
+
+	k8sAPI, _ := newK8sAPIFake(pod)
+	storageClient := kssfake.NewSimpleClientset(
+		&spdxv1beta1.SBOMSummary{ObjectMeta: v1.ObjectMeta{Name: "migrate", Labels: managedLabels(), Annotations: map[string]string{instanceidv1.ImageIDMetadataKey: "migrate@sha256:2e0e455c9e1056b56154d3b2dafc55dcab163ce0acdc2ff6c3a06b80a5d0bf80"}}},
+		&spdxv1beta1.SBOMSPDXv2p3{ObjectMeta: v1.ObjectMeta{Name: "migrate", Labels: managedLabels()}},
+	)
+
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	wh.storageClient = storageClient
+	_ = wh.buildIDs(ctx, podListIterator(&core1.PodList{Items: []core1.Pod{*pod}}))
+
+	assert.Equal(t, []string{expectedWlid}, wh.GetWlidsForImageHash("migrate@sha256:2e0e455c9e1056b56154d3b2dafc55dcab163ce0acdc2ff6c3a06b80a5d0bf80"))
+	assert.Equal(t, map[string]string{"app": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547", "migrate": "migrate@sha256:2e0e455c9e1056b56154d3b2dafc55dcab163ce0acdc2ff6c3a06b80a5d0bf80"}, wh.GetContainerToImageIDForWlid(expectedWlid))
+	assert.Equal(t, map[string]string{"app": utils.ContainerTypeContainer, "migrate": utils.ContainerTypeInitContainer}, wh.GetContainerToContainerTypeForWlid(expectedWlid))
+
+	cmd := getImageScanCommand(expectedWlid, wh.GetContainerToImageIDForWlid(expectedWlid))
+	wh.setContainerTypeArg(cmd)
+	assert.Equal(t, map[string]string{"app": utils.ContainerTypeContainer, "migrate": utils.ContainerTypeInitContainer}, cmd.Args[utils.ContainerToContainerTypeArg])
+
+	// the SBOM of an image used only by an init container is not an orphan
+	wh.reclaimOrphans(ctx)
+	_, err := storageClient.SpdxV1beta1().SBOMSummaries("").Get(ctx, "migrate", v1.GetOptions{})
+	assert.NoError(t, err)
+	_, err = storageClient.SpdxV1beta1().SBOMSPDXv2p3s("").Get(ctx, "migrate", v1.GetOptions{})
+	assert.NoError(t, err)
+}
+
+func BenchmarkBuildIDs(b *testing.B) {
+	podsCount := 2000
+	podList := &core1.PodList{}
+	for i := 0; i < podsCount; i++ {
+		podList.Items = append(podList.Items, *newRunningPodFake("default", fmt.Sprintf("pod-%d", i), map[string]string{
+			"app": fmt.Sprintf("docker-pullable://alpine@sha256:%064x", i%50),
+		}))
+	}
+	objects := make([]runtime.Object, 0, podsCount)
+	for i := range podList.Items {
+		objects = append(objects, &podList.Items[i])
+	}
+
+	b.Run("whole list", func(b *testing.B) {
+		k8sAPI, k8sClient := newK8sAPIFake(objects...)
+		prependPaginatedPodsReactor(k8sClient, podList, podsCount)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			wh := NewWatchHandlerMock()
+			wh.k8sAPI = k8sAPI
+			podList, _ := k8sClient.CoreV1().Pods("").List(context.TODO(), v1.ListOptions{})
+			_ = wh.buildIDs(context.TODO(), podListIterator(podList))
+		}
+	})
+
+	b.Run("streamed pages", func(b *testing.B) {
+		k8sAPI, k8sClient := newK8sAPIFake(objects...)
+		prependPaginatedPodsReactor(k8sClient, podList, podListPageSize)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			wh := NewWatchHandlerMock()
+			wh.k8sAPI = k8sAPI
+			_ = wh.buildIDs(context.TODO(), func(handlePod func(pod *core1.Pod) error) error {
+				_, err := wh.listPods(context.TODO(), handlePod)
+				return err
+			})
+		}
+	})
+}
+
+func TestHandlePodWatcherInitContainers(t *testing.T) {
+	expectedWlid := "wlid://cluster-/namespace-default/pod-initialized"
+	pod := newRunningPodFake("default", "initialized", map[string]string{"app": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"})
+	pod.Spec.InitContainers = []core1.Container{{Name: "init", Image: "busybox"}}
+	pod.Status.InitContainerStatuses = []core1.ContainerStatus{
+		{
+			Name:    "init",
+			ImageID: "docker-pullable://busybox@sha256:22a1f96cbccbde731c101c7b6d6acb307af7e35957a2ea374b8e75f0e6d93620",
+			State:   core1.ContainerState{Terminated: &core1.ContainerStateTerminated{}},
+		},
+	}
+
+	k8sAPI, _ := newK8sAPIFake(pod.DeepCopy())
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+
+	// the init container has terminated long before the Pod is updated again, it is scanned once nonetheless
+	cmds := handlePodEvents(context.TODO(), wh, pod, pod.DeepCopy())
+
+	assert.Len(t, cmds, 1)
+	assert.Equal(t, expectedWlid, cmds[0].Wlid)
+	assert.Equal(t, map[string]string{"app": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547", "init": "busybox@sha256:22a1f96cbccbde731c101c7b6d6acb307af7e35957a2ea374b8e75f0e6d93620"}, cmds[0].Args[utils.ContainerToImageIdsArg])
+	assert.Equal(t, map[string]string{"app": utils.ContainerTypeContainer, "init": utils.ContainerTypeInitContainer}, cmds[0].Args[utils.ContainerToContainerTypeArg])
+	assert.Equal(t, map[string]string{"app": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547", "init": "busybox@sha256:22a1f96cbccbde731c101c7b6d6acb307af7e35957a2ea374b8e75f0e6d93620"}, wh.GetContainerToImageIDForWlid(expectedWlid))
+}
+
+func TestHandlePodWatcherContainersSharingAnImage(t *testing.T) {
+	wlid := "wlid://cluster-/namespace-default/pod-nginx"
+	otherWlid := "wlid://cluster-/namespace-default/pod-other"
+
+	t.Run("Sidecar running the image of the main container gets tracked", func(t *testing.T) {
+		pod := newRunningPodFake("default", "nginx", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240", "sidecar": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"})
+		k8sAPI, _ := newK8sAPIFake(pod.DeepCopy())
+		wh := NewWatchHandlerMock()
+		wh.k8sAPI = k8sAPI
+		// only the main container is known
+		wh.addToImageIDToWlidsMap("nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240", wlid)
+		wh.addToWlidsToContainerToImageIDMap(wlid, "nginx", "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240")
+
+		cmds := handlePodEvents(context.TODO(), wh, pod)
+
+		assert.Len(t, cmds, 1)
+		assert.Equal(t, map[string]string{"sidecar": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"}, cmds[0].Args[utils.ContainerToImageIdsArg])
+		assert.Equal(t, map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240", "sidecar": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"}, wh.GetContainerToImageIDForWlid(wlid))
+		assert.Equal(t, []string{wlid}, wh.GetWlidsForImageHash("nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"))
+
+		// once every container is tracked, the Pod triggers nothing
+		assert.Empty(t, handlePodEvents(context.TODO(), wh, pod))
+	})
+
+	t.Run("New workload of a known image gets associated with the image", func(t *testing.T) {
+		pod := newRunningPodFake("default", "nginx", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240", "sidecar": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"})
+		k8sAPI, _ := newK8sAPIFake(pod.DeepCopy())
+		wh := NewWatchHandlerMock()
+		wh.k8sAPI = k8sAPI
+		wh.addToImageIDToWlidsMap("nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240", otherWlid)
+		wh.addToWlidsToContainerToImageIDMap(otherWlid, "nginx", "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240")
+
+		cmds := handlePodEvents(context.TODO(), wh, pod)
+
+		assert.Len(t, cmds, 1)
+		assert.Equal(t, map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240", "sidecar": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"}, cmds[0].Args[utils.ContainerToImageIdsArg])
+		assert.Equal(t, map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240", "sidecar": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"}, wh.GetContainerToImageIDForWlid(wlid))
+		assert.ElementsMatch(t, []string{wlid, otherWlid}, wh.GetWlidsForImageHash("nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"))
+	})
+}
+
+func TestHandlePodWatcherRuntimeMigration(t *testing.T) {
+	wlid := "wlid://cluster-/namespace-default/pod-nginx"
+	digest := "sha256:c5360b25031e2982544581b9404c8c0eb24f455a8ef2304103d3278dff70f2ee"
+
+	// the Pod ran on a dockershim node before
+	dockershimPod := newRunningPodFake("default", "nginx", map[string]string{"nginx": "docker-pullable://nginx@" + digest})
+	k8sAPI, _ := newK8sAPIFake(dockershimPod.DeepCopy())
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	commands := handlePodEvents(context.TODO(), wh, dockershimPod)
+	if assert.Len(t, commands, 1) {
+		// the image ID is sent as reported by the runtime, it is only normalized to be compared
+		assert.Equal(t, map[string]string{"nginx": "nginx@" + digest}, commands[0].Args[utils.ContainerToImageIdsArg])
+	}
+	assert.Equal(t, map[string]string{"nginx": "nginx@" + digest}, wh.GetContainerToImageIDForWlid(wlid))
+
+	// once recreated on a containerd node, the same image is not scanned again
+	containerdPod := newRunningPodFake("default", "nginx", map[string]string{"nginx": "docker.io/library/nginx@" + digest})
+	containerdPod.UID = "recreated"
+	assert.Empty(t, handlePodEvents(context.TODO(), wh, containerdPod))
+	// nor if the runtime reports the digest only
+	localPod := newRunningPodFake("default", "nginx", map[string]string{"nginx": digest})
+	localPod.UID = "recreated-again"
+	assert.Empty(t, handlePodEvents(context.TODO(), wh, localPod))
+
+	assert.Equal(t, []string{wlid}, wh.GetWlidsForImageHash("docker.io/library/nginx@"+digest))
+	assert.True(t, wh.isImageIDTracked("nginx@"+digest))
+}
+
+func TestHandlePodWatcherDigestlessImages(t *testing.T) {
+	wlid := "wlid://cluster-/namespace-default/pod-local"
+	// e.g. a locally built image with imagePullPolicy: Never
+	pod := newRunningPodFake("default", "local", map[string]string{"app": "docker.io/library/myapp:dev", "sidecar": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"})
+
+	for _, tc := range []struct {
+		name  string
+		build bool
+	}{
+		{name: "Pod watcher"},
+		{name: "buildIDs", build: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			k8sAPI, _ := newK8sAPIFake(pod.DeepCopy())
+			wh := NewWatchHandlerMock()
+			wh.k8sAPI = k8sAPI
+
+			if tc.build {
+				assert.NoError(t, wh.buildIDs(context.TODO(), podListIterator(&core1.PodList{Items: []core1.Pod{*pod}})))
+			} else {
+				// the command carries the tag of the image
+				cmds := handlePodEvents(context.TODO(), wh, pod)
+				assert.Len(t, cmds, 1)
+				assert.Equal(t, map[string]string{"app": "docker.io/library/myapp:dev", "sidecar": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"}, cmds[0].Args[utils.ContainerToImageIdsArg])
+			}
+
+			// the image is tracked per container, but not by image hash
+			assert.Equal(t, map[string]string{"app": "docker.io/library/myapp:dev", "sidecar": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"}, wh.GetContainerToImageIDForWlid(wlid))
+			assert.Equal(t, map[string][]string{"sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240": {wlid}}, wh.SnapshotImageHashWLIDs())
+			assert.Equal(t, int64(1), wh.Metrics()[metricDigestlessContainersTotal])
+
+			// once tracked, the container is not scanned again
+			assert.Empty(t, handlePodEvents(context.TODO(), wh, pod))
+		})
+	}
+}
+
+// newJobPodsFake returns count running Pods, each owned by its own Job, along with the Pods and the Jobs as objects
+func newJobPodsFake(count int) (*core1.PodList, []runtime.Object) {
+	podList := &core1.PodList{}
+	objects := make([]runtime.Object, 0, 2*count)
+	for i := 0; i < count; i++ {
+		pod := newRunningPodFake("default", fmt.Sprintf("pod-%d", i), backupImageIDs, withJobOwner(fmt.Sprintf("job-%d", i)))
+		pod.Status.ContainerStatuses[0].ImageID = fmt.Sprintf("alpine@sha256:%064x", i%10)
+		podList.Items = append(podList.Items, *pod)
+		objects = append(objects, pod.DeepCopy(), newJobFake("default", fmt.Sprintf("job-%d", i), ""))
+	}
+	return podList, objects
+}
+
+func TestBuildIDsConcurrently(t *testing.T) {
+	podList, objects := newJobPodsFake(50)
+
+	// reference: build the maps one Pod at a time
+	k8sAPI, _ := newK8sAPIFake(objects...)
+	expected := NewWatchHandlerMock()
+	expected.k8sAPI = k8sAPI
+	expected.buildIDsWorkers = 1
+	assert.NoError(t, expected.buildIDs(context.TODO(), podListIterator(podList.DeepCopy())))
+	assert.Len(t, expected.GetWlidsToContainerToImageIDMap(), 50)
+
+	k8sAPI, _ = newK8sAPIFake(objects...)
+	actual := NewWatchHandlerMock()
+	actual.k8sAPI = k8sAPI
+	actual.buildIDsWorkers = 8
+	assert.NoError(t, actual.buildIDs(context.TODO(), podListIterator(podList.DeepCopy())))
+	assert.Equal(t, expected.snapshotState(), actual.snapshotState())
+}
+
+func TestBuildIDsConcurrentlySkipsFailingPods(t *testing.T) {
+	podList, objects := newJobPodsFake(20)
+
+	k8sAPI, _ := newK8sAPIFake(objects...)
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	wh.buildIDsWorkers = 4
+	failed := failJobLookups(wh, 3)
+
+	// the Pods whose parent fails to resolve are skipped, not the build
+	assert.NoError(t, wh.buildIDs(context.TODO(), podListIterator(podList)))
+	assert.Equal(t, 3, failed())
+	assert.Len(t, wh.GetWlidsToContainerToImageIDMap(), 17)
+}
+
+// slowDynamicClient is a dynamic client whose Gets of namespaced objects take a given latency, like round-trips to the API
+//
+// The latency is not simulated with a reactor, as fake clients serialize them.
+type slowDynamicClient struct {
+	dynamic.Interface
+	latency time.Duration
+}
+
+func (c slowDynamicClient) Resource(resource schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	return slowResource{c.Interface.Resource(resource), c.latency}
+}
+
+type slowResource struct {
+	dynamic.NamespaceableResourceInterface
+	latency time.Duration
+}
+
+func (r slowResource) Namespace(namespace string) dynamic.ResourceInterface {
+	return slowNamespacedResource{r.NamespaceableResourceInterface.Namespace(namespace), r.latency}
+}
+
+type slowNamespacedResource struct {
+	dynamic.ResourceInterface
+	latency time.Duration
+}
+
+func (r slowNamespacedResource) Get(ctx context.Context, name string, options v1.GetOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	time.Sleep(r.latency)
+	return r.ResourceInterface.Get(ctx, name, options, subresources...)
+}
+
+func BenchmarkBuildIDsWorkers(b *testing.B) {
+	podList, objects := newJobPodsFake(200)
+
+	for _, workers := range []int{1, 8, 32} {
+		b.Run(fmt.Sprintf("%d workers", workers), func(b *testing.B) {
+			k8sAPI, _ := newK8sAPIFake(objects...)
+			k8sAPI.DynamicClient = slowDynamicClient{k8sAPI.DynamicClient, time.Millisecond}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				wh := NewWatchHandlerMock()
+				wh.k8sAPI = k8sAPI
+				wh.buildIDsWorkers = workers
+				_ = wh.buildIDs(context.TODO(), podListIterator(podList))
+			}
+		})
+	}
+}
+
+func TestFirstCleanUpDelay(t *testing.T) {
+	interval := 10 * time.Minute
+
+	tt := []struct {
+		name     string
+		jitter   func() float64
+		expected time.Duration
+	}{
+		{
+			name:     "Without jitter, the first cleanUp waits for the interval",
+			expected: interval,
+		},
+		{
+			name:     "The lowest jitter adds nothing",
+			jitter:   func() float64 { return 0 },
+			expected: interval,
+		},
+		{
+			name:     "Jitter adds a part of the interval",
+			jitter:   func() float64 { return 0.25 },
+			expected: interval + interval/4,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			wh := NewWatchHandlerMock()
+			wh.cleanUpJitter = tc.jitter
+			assert.Equal(t, tc.expected, wh.firstCleanUpDelay(interval))
+		})
+	}
+
+	wh := NewWatchHandlerMock()
+	WithCleanUpJitter(true)(wh)
+	for i := 0; i < 100; i++ {
+		delay := wh.firstCleanUpDelay(interval)
+		assert.GreaterOrEqual(t, delay, interval)
+		assert.Less(t, delay, 2*interval)
+	}
+	WithCleanUpJitter(false)(wh)
+	assert.Equal(t, interval, wh.firstCleanUpDelay(interval))
+}
+
+func TestHandlePodWatcherRelistHandlesMissedPods(t *testing.T) {
+	trackedWlid := "wlid://cluster-/namespace-default/pod-tracked"
+	missedWlid := "wlid://cluster-/namespace-default/pod-missed"
+	expired := &v1.Status{Status: v1.StatusFailure, Code: 410, Reason: v1.StatusReasonExpired}
+
+	tt := []struct {
+		name string
+		// end ends the watch without a bookmark to resume it from
+		end func(podsWatch *watch.FakeWatcher)
+	}{
+		{
+			name: "watch closing",
+			end:  func(podsWatch *watch.FakeWatcher) { podsWatch.Stop() },
+		},
+		{
+			name: "expired resource version",
+			end:  func(podsWatch *watch.FakeWatcher) { podsWatch.Error(expired) },
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			tracked := newRunningPodFake("default", "tracked", map[string]string{"nginx": "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"})
+			// created after the last event the watch delivered
+			missed := newRunningPodFake("default", "missed", map[string]string{"redis": "redis@sha256:328695eff5583aa7bc95f9dd456106461d588df5bffc296107964fe27ee0e083"})
+			k8sAPI, _ := newK8sAPIFake(tracked.DeepCopy(), missed.DeepCopy())
+			wh := NewWatchHandlerMock()
+			wh.k8sAPI = k8sAPI
+			assert.NoError(t, wh.buildIDs(context.TODO(), podListIterator(&core1.PodList{Items: []core1.Pod{*tracked.DeepCopy()}})))
+			wh.setPodListResourceVersion("42")
+
+			recorder := &commandRecorder{}
+			podsWatch := watch.NewFakeWithChanSize(1, false)
+			tc.end(podsWatch)
+			wh.handlePodWatcher(context.TODO(), podsWatch, newCommandDeduper(0, recorder.emit))
+
+			// the relisted Pods are handled before the watcher returns, i.e. before the watch resumes
+			emitted := recorder.emitted()
+			if assert.Len(t, emitted, 1, "only the missed Pod should trigger a scan") {
+				assert.Equal(t, missedWlid, emitted[0].Wlid)
+				assert.Equal(t, map[string]string{"redis": "redis@sha256:328695eff5583aa7bc95f9dd456106461d588df5bffc296107964fe27ee0e083"}, emitted[0].Args[utils.ContainerToImageIdsArg])
+			}
+			assert.Equal(t, []string{missedWlid}, wh.GetWlidsForImageHash("redis@sha256:328695eff5583aa7bc95f9dd456106461d588df5bffc296107964fe27ee0e083"))
+			assert.Equal(t, []string{trackedWlid}, wh.GetWlidsForImageHash("nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"))
+		})
+	}
+}
+
+func TestPodRelistOptions(t *testing.T) {
+	wh := NewWatchHandlerMock()
+	assert.Equal(t, v1.ListOptions{}, wh.podRelistOptions(), "without a resource version, the most recent Pods should be listed")
+
+	wh.setPodListResourceVersion("42")
+	assert.Equal(t, v1.ListOptions{ResourceVersion: "42", ResourceVersionMatch: v1.ResourceVersionMatchNotOlderThan}, wh.podRelistOptions())
+}
+
+// optionsValidatingClient rejects the Pod lists whose options the API server rejects, which the fake clientset does not record
+//
+// The options of the accepted lists are passed to onList, if any.
+type optionsValidatingClient struct {
+	kubernetes.Interface
+	onList func(opts v1.ListOptions)
+}
+
+func (c optionsValidatingClient) CoreV1() corev1client.CoreV1Interface {
+	return optionsValidatingCoreV1{CoreV1Interface: c.Interface.CoreV1(), onList: c.onList}
+}
+
+type optionsValidatingCoreV1 struct {
+	corev1client.CoreV1Interface
+	onList func(opts v1.ListOptions)
+}
+
+func (c optionsValidatingCoreV1) Pods(namespace string) corev1client.PodInterface {
+	return optionsValidatingPods{PodInterface: c.CoreV1Interface.Pods(namespace), onList: c.onList}
+}
+
+type optionsValidatingPods struct {
+	corev1client.PodInterface
+	onList func(opts v1.ListOptions)
+}
+
+func (c optionsValidatingPods) List(ctx context.Context, opts v1.ListOptions) (*core1.PodList, error) {
+	errs := validation.ValidateListOptions(&internalversion.ListOptions{ResourceVersion: opts.ResourceVersion, ResourceVersionMatch: opts.ResourceVersionMatch, Continue: opts.Continue})
+	if len(errs) > 0 {
+		return nil, k8serrors.NewBadRequest(errs.ToAggregate().Error())
+	}
+	// the continue token pins the resource version of the list, see the storage of the API server
+	if opts.Continue != "" && opts.ResourceVersion != "" && opts.ResourceVersion != "0" {
+		return nil, k8serrors.NewBadRequest("specifying resource version is not allowed when using continue")
+	}
+	if c.onList != nil {
+		c.onList(opts)
+	}
+	return c.PodInterface.List(ctx, opts)
+}
+
+func TestUpdateResourceVersionPaginated(t *testing.T) {
+	ctx := context.TODO()
+	podList := &core1.PodList{}
+	for i := 0; i < podListPageSize+1; i++ {
+		podList.Items = append(podList.Items, *newRunningPodFake("default", fmt.Sprintf("pod-%d", i), map[string]string{"app": "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"}))
+	}
+	k8sAPI, k8sClient := newK8sAPIFake()
+	listCalls := prependPaginatedPodsReactor(k8sClient, podList, podListPageSize)
+	k8sAPI.KubernetesClient = optionsValidatingClient{Interface: k8sClient}
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	wh.setPodListResourceVersion("42")
+
+	handled := 0
+	assert.NoError(t, wh.updateResourceVersion(ctx, func(pod *core1.Pod) { handled++ }))
+	assert.Equal(t, 2, *listCalls, "the Pods should be listed in two pages")
+	assert.Equal(t, len(podList.Items), handled)
+	assert.Equal(t, "100", wh.podListResourceVersion())
+
+	// the resource version options still apply to the first page
+	_, err := optionsValidatingPods{PodInterface: k8sClient.CoreV1().Pods("")}.List(ctx, v1.ListOptions{ResourceVersion: "42", ResourceVersionMatch: v1.ResourceVersionMatchNotOlderThan, Continue: "continue"})
+	assert.Error(t, err, "the API server should reject the resource version options along with a continue token")
+}
@@ -0,0 +1,95 @@
+package watcher
+
+import (
+	"context"
+
+	"github.com/kubescape/go-logger"
+	"github.com/kubescape/go-logger/helpers"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// runWatchRetry runs the watches returned by newWatcher until the context is done, passing their events to handle
+//
+// The watch is established again after a backoff whenever it fails to be
+// established, closes or delivers an error status, which is reported as an
+// error of the watcher. handle reports its own errors, which do not restart
+// the watch. onReconnect, if set, is called whenever the watch is
+// established again after the first time. The watch is stopped once the
+// context is done.
+//
+// Watches that expired (410 Gone) are established again at once, as they
+// replay the current objects, unless the previous one expired too. Watches
+// the operator is not allowed to establish are backed off from like other
+// failures, with a warning pointing at its permissions.
+//
+// The loop runs in the goroutine of its caller, and reconnects within it:
+// no goroutine is spawned per reconnect, so a watch failing for the whole
+// length of an outage of the storage holds no more goroutines than a healthy
+// one. SBOMWatch, SBOMFilteredWatch and VulnerabilityManifestWatch all run
+// their watches through it, see bufferEvents.
+func (wh *WatchHandler) runWatchRetry(ctx context.Context, watcherName string, newWatcher func() (watch.Interface, error), handle func(event watch.Event), onReconnect func()) {
+	handle, stopHandling := wh.bufferEvents(ctx, handle)
+	defer stopHandling()
+
+	backoff := wh.newWatchBackoff(watcherName)
+	wh.health.Started(watcherName)
+	connected := false
+	expired := false
+	for ctx.Err() == nil {
+		watcher, err := newWatcher()
+		if err != nil {
+			backoff.wait(ctx, watcherName)
+			continue
+		}
+		backoff.Connected()
+		wh.health.Connected(watcherName)
+		if connected && onReconnect != nil {
+			onReconnect()
+		}
+		connected = true
+
+		err = wh.consumeWatch(ctx, watcherName, watcher, handle)
+		watcher.Stop()
+		if ctx.Err() != nil {
+			return
+		}
+		backoff.Disconnected()
+
+		wasExpired := expired
+		expired = isResourceVersionExpired(err)
+		switch {
+		case expired && !wasExpired:
+			logger.L().Ctx(ctx).Info("watch expired, watching again", helpers.String("watcher", watcherName))
+			continue
+		case k8serrors.IsForbidden(err) || k8serrors.IsUnauthorized(err):
+			logger.L().Ctx(ctx).Warning("the operator is not allowed to watch the storage, check its RBAC permissions and the storage aggregated API",
+				helpers.String("watcher", watcherName),
+				helpers.Error(err))
+		}
+		backoff.wait(ctx, watcherName)
+	}
+}
+
+// consumeWatch passes the events of a watch to handle until it closes, delivers an error status or the context is done
+//
+// The error of the delivered status is returned, nil otherwise.
+func (wh *WatchHandler) consumeWatch(ctx context.Context, watcherName string, watcher watch.Interface, handle func(event watch.Event)) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return nil
+			}
+			wh.health.Processed(watcherName)
+			// the watch failed, so it is restarted
+			if err := wh.watchStatusError(event); err != nil {
+				wh.reportError(ctx, watcherName, err)
+				return err
+			}
+			handle(event)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+	core1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// fakeWatchers hands out fake watches, recording how many were established
+type fakeWatchers struct {
+	watchers chan *watch.FakeWatcher
+	failures int // number of attempts failing before watches are handed out
+	attempts int
+	mu       sync.Mutex
+}
+
+func newFakeWatchers(failures int) *fakeWatchers {
+	return &fakeWatchers{watchers: make(chan *watch.FakeWatcher, 10), failures: failures}
+}
+
+func (f *fakeWatchers) newWatcher() (watch.Interface, error) {
+	f.mu.Lock()
+	f.attempts++
+	failing := f.attempts <= f.failures
+	f.mu.Unlock()
+	if failing {
+		return nil, errors.New("watch failed")
+	}
+
+	w := watch.NewFake()
+	f.watchers <- w
+	return w, nil
+}
+
+// next returns the next established watch
+func (f *fakeWatchers) next(t *testing.T) *watch.FakeWatcher {
+	select {
+	case w := <-f.watchers:
+		return w
+	case <-time.After(2 * retryInterval):
+		t.Fatal("the watch should be established")
+		return nil
+	}
+}
+
+func TestRunWatchRetry(t *testing.T) {
+	pod := func(name string) *core1.Pod {
+		return newRunningPodFake("default", name, nil)
+	}
+	errHandler := errors.New("handler failed")
+
+	t.Run("reconnects once the watch closes", func(t *testing.T) {
+		watchers := newFakeWatchers(0)
+		wh := NewWatchHandlerMock()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		handled := make(chan watch.Event, 2)
+		reconnects := make(chan struct{}, 2)
+		go wh.runWatchRetry(ctx, SBOMWatcherName, watchers.newWatcher,
+			func(event watch.Event) { handled <- event },
+			func() { reconnects <- struct{}{} })
+
+		first := watchers.next(t)
+		first.Action(watch.Added, pod("first"))
+		assert.Equal(t, "first", (<-handled).Object.(v1.Object).GetName())
+		assert.Empty(t, reconnects, "the first connect is no reconnect")
+		first.Stop()
+
+		second := watchers.next(t)
+		second.Action(watch.Added, pod("second"))
+		assert.Equal(t, "second", (<-handled).Object.(v1.Object).GetName())
+		assert.Len(t, reconnects, 1)
+	})
+
+	t.Run("retries failing watches", func(t *testing.T) {
+		watchers := newFakeWatchers(1)
+		wh := NewWatchHandlerMock()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go wh.runWatchRetry(ctx, SBOMWatcherName, watchers.newWatcher, func(event watch.Event) {}, nil)
+
+		watchers.next(t)
+		watchers.mu.Lock()
+		defer watchers.mu.Unlock()
+		assert.Equal(t, 2, watchers.attempts)
+	})
+
+	t.Run("handler errors", func(t *testing.T) {
+		watchers := newFakeWatchers(0)
+		wh := NewWatchHandlerMock()
+		reportedErrors := make(chan error, 2)
+		WithErrorHandler(func(err error) { reportedErrors <- err })(wh)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		handled := make(chan watch.Event, 2)
+		go wh.runWatchRetry(ctx, SBOMWatcherName, watchers.newWatcher, func(event watch.Event) {
+			wh.reportError(ctx, SBOMWatcherName, errHandler)
+			handled <- event
+		}, nil)
+
+		first := watchers.next(t)
+		first.Action(watch.Added, pod("failing"))
+		<-handled
+		assert.ErrorIs(t, <-reportedErrors, errHandler)
+		// events keep being handled from the same watch
+		first.Action(watch.Added, pod("next"))
+		assert.Equal(t, "next", (<-handled).Object.(v1.Object).GetName())
+		<-reportedErrors
+		assert.False(t, first.IsStopped(), "errors of the handler should not restart the watch")
+
+		// error statuses restart the watch without being handled
+		first.Error(&v1.Status{Status: v1.StatusFailure, Code: 500, Reason: v1.StatusReasonInternalError})
+		assert.ErrorIs(t, <-reportedErrors, ErrWatchStatus)
+		second := watchers.next(t)
+		assert.True(t, first.IsStopped(), "the failed watch should be stopped")
+		assert.Empty(t, handled)
+		second.Action(watch.Added, pod("after"))
+		assert.Equal(t, "after", (<-handled).Object.(v1.Object).GetName())
+	})
+
+	t.Run("expired watches", func(t *testing.T) {
+		watchers := newFakeWatchers(0)
+		wh := NewWatchHandlerMock()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go wh.runWatchRetry(ctx, SBOMWatcherName, watchers.newWatcher, func(event watch.Event) {}, nil)
+
+		first := watchers.next(t)
+		first.Error(newGoneWatchStatusFake())
+		select {
+		case second := <-watchers.watchers:
+			// watches expiring again are backed off from
+			second.Error(newGoneWatchStatusFake())
+			select {
+			case <-watchers.watchers:
+				t.Fatal("the watch expiring twice in a row should be backed off from")
+			case <-time.After(retryInterval / 4):
+			}
+		case <-time.After(retryInterval / 4):
+			t.Fatal("the expired watch should be established again at once")
+		}
+		assert.Equal(t, int64(2), wh.metrics.Get(watchStatusReasonMetric(v1.StatusReasonGone)))
+	})
+
+	t.Run("forbidden watches", func(t *testing.T) {
+		watchers := newFakeWatchers(0)
+		wh := NewWatchHandlerMock()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go wh.runWatchRetry(ctx, SBOMWatcherName, watchers.newWatcher, func(event watch.Event) {}, nil)
+
+		first := watchers.next(t)
+		first.Error(newForbiddenWatchStatusFake())
+		select {
+		case <-watchers.watchers:
+			t.Fatal("the forbidden watch should be backed off from")
+		case <-time.After(retryInterval / 4):
+		}
+		watchers.next(t)
+		assert.Equal(t, int64(1), wh.metrics.Get(watchStatusReasonMetric(v1.StatusReasonForbidden)))
+	})
+
+	t.Run("context cancellation", func(t *testing.T) {
+		watchers := newFakeWatchers(0)
+		wh := NewWatchHandlerMock()
+		ctx, cancel := context.WithCancel(context.Background())
+
+		done := make(chan struct{})
+		go func() {
+			wh.runWatchRetry(ctx, SBOMWatcherName, watchers.newWatcher, func(event watch.Event) {}, nil)
+			close(done)
+		}()
+
+		w := watchers.next(t)
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the watch loop should return once its context is cancelled")
+		}
+		assert.True(t, w.IsStopped(), "the watch should be stopped along with the loop")
+		assert.Empty(t, watchers.watchers, "the watch should not be established again")
+	})
+}
+
+func TestRunWatchRetryDoesNotLeak(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	watchers := newFakeWatchers(0)
+	wh := NewWatchHandlerMock()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan struct{})
+	go func() {
+		wh.runWatchRetry(ctx, VulnerabilityManifestWatchName, watchers.newWatcher, func(event watch.Event) {}, nil)
+		close(done)
+	}()
+
+	// the watch fails and closes at once, which is a single reason to restart it
+	first := watchers.next(t)
+	first.Error(&v1.Status{Status: v1.StatusFailure, Code: 500, Reason: v1.StatusReasonInternalError})
+	first.Stop()
+	watchers.next(t)
+	time.Sleep(100 * time.Millisecond)
+	watchers.mu.Lock()
+	assert.Equal(t, 2, watchers.attempts, "the watch should be established again once")
+	watchers.mu.Unlock()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the watch loop should return once its context is cancelled")
+	}
+}
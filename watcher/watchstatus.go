@@ -0,0 +1,61 @@
+package watcher
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// metricWatchStatusesTotal is the number of errors received by the watchers instead of the watched objects
+const metricWatchStatusesTotal = "operator_watch_statuses_total"
+
+// watchStatusReasonMetric returns the name of the metric counting the errors of a given reason received by the watchers, e.g. operator_watch_statuses_expired_total
+func watchStatusReasonMetric(reason v1.StatusReason) string {
+	if reason == "" {
+		reason = v1.StatusReasonUnknown
+	}
+	return "operator_watch_statuses_" + strings.ToLower(string(reason)) + "_total"
+}
+
+// watchStatusReasonOfMetric returns the reason of the errors counted by a metric, if it is a metric of watchStatusReasonMetric
+func watchStatusReasonOfMetric(name string) (string, bool) {
+	if name == metricWatchStatusesTotal || !strings.HasPrefix(name, "operator_watch_statuses_") || !strings.HasSuffix(name, "_total") {
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(name, "operator_watch_statuses_"), "_total"), true
+}
+
+// watchStatusError returns the error carried by an event, nil if the event carries none
+//
+// The API server sends an Error event, usually carrying a Status instead of
+// an object, when a watch fails, e.g. while it restarts or when the resource
+// version to watch from is too old (410 Gone). The watch should then be
+// restarted. Statuses carried by other events are handled the same.
+//
+// The returned error wraps both ErrWatchStatus and the API status, so that
+// callers can tell its reason with the helpers of k8serrors.
+func (wh *WatchHandler) watchStatusError(event watch.Event) error {
+	status, isStatus := event.Object.(*v1.Status)
+	if event.Type != watch.Error && !isStatus {
+		return nil
+	}
+
+	if !isStatus {
+		// e.g. the unstructured Status sent to dynamic clients
+		var apiStatus k8serrors.APIStatus
+		if err := k8serrors.FromObject(event.Object); errors.As(err, &apiStatus) {
+			decoded := apiStatus.Status()
+			status = &decoded
+		} else {
+			status = &v1.Status{Status: v1.StatusFailure, Reason: v1.StatusReasonUnknown, Message: err.Error()}
+		}
+	}
+
+	wh.metrics.Inc(metricWatchStatusesTotal)
+	wh.metrics.Inc(watchStatusReasonMetric(status.Reason))
+	return fmt.Errorf("%w: %w (reason: %s, code: %d)", ErrWatchStatus, &k8serrors.StatusError{ErrStatus: *status}, status.Reason, status.Code)
+}
@@ -0,0 +1,228 @@
+package watcher
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/armosec/armoapi-go/apis"
+	"github.com/kubescape/operator/utils"
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	core1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newWatchStatusFake returns the Status sent by the API server when a watch fails while it restarts
+func newWatchStatusFake() *v1.Status {
+	return &v1.Status{Status: v1.StatusFailure, Code: 500, Reason: v1.StatusReasonInternalError, Message: "etcdserver: leader changed"}
+}
+
+// newExpiredWatchStatusFake returns the Status sent to dynamic clients when the resource version to watch from is too old
+func newExpiredWatchStatusFake() *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Status",
+		"status":     v1.StatusFailure,
+		"code":       int64(410),
+		"reason":     string(v1.StatusReasonExpired),
+		"message":    "too old resource version: 1 (42)",
+	}}
+}
+
+// newGoneWatchStatusFake returns the Status sent by the API server when the resource version to watch from was compacted
+func newGoneWatchStatusFake() *v1.Status {
+	return &v1.Status{Status: v1.StatusFailure, Code: 410, Reason: v1.StatusReasonGone, Message: "resource version compacted"}
+}
+
+// newForbiddenWatchStatusFake returns the Status sent by the storage aggregated API when the operator is not allowed to watch its objects
+func newForbiddenWatchStatusFake() *v1.Status {
+	return &v1.Status{Status: v1.StatusFailure, Code: 403, Reason: v1.StatusReasonForbidden, Message: "sbomsummaries is forbidden"}
+}
+
+func TestWatchStatusError(t *testing.T) {
+	wh := NewWatchHandlerMock()
+
+	err := wh.watchStatusError(watch.Event{Type: watch.Error, Object: newWatchStatusFake()})
+	assert.ErrorIs(t, err, ErrWatchStatus)
+	assert.ErrorContains(t, err, "etcdserver: leader changed")
+	assert.Equal(t, int64(1), wh.metrics.Get(metricWatchStatusesTotal))
+
+	err = wh.watchStatusError(watch.Event{Type: watch.Error, Object: newExpiredWatchStatusFake()})
+	assert.ErrorIs(t, err, ErrWatchStatus)
+	assert.ErrorContains(t, err, "too old resource version")
+	assert.Equal(t, int64(2), wh.metrics.Get(metricWatchStatusesTotal))
+
+	assert.True(t, isResourceVersionExpired(err), "the reason of the status should be kept")
+
+	assert.NoError(t, wh.watchStatusError(watch.Event{Type: watch.Modified, Object: &core1.Pod{}}))
+	assert.Equal(t, int64(2), wh.metrics.Get(metricWatchStatusesTotal), "only errors should be counted")
+
+	// errors are counted per reason too
+	err = wh.watchStatusError(watch.Event{Type: watch.Error, Object: newForbiddenWatchStatusFake()})
+	assert.True(t, k8serrors.IsForbidden(err))
+	assert.Equal(t, int64(1), wh.metrics.Get("operator_watch_statuses_internalerror_total"))
+	assert.Equal(t, int64(1), wh.metrics.Get("operator_watch_statuses_expired_total"))
+	assert.Equal(t, int64(1), wh.metrics.Get("operator_watch_statuses_forbidden_total"))
+
+	err = wh.watchStatusError(watch.Event{Type: watch.Error, Object: &core1.Pod{}})
+	assert.ErrorIs(t, err, ErrWatchStatus)
+	assert.Equal(t, int64(1), wh.metrics.Get(watchStatusReasonMetric(v1.StatusReasonUnknown)), "errors without a status are of an unknown reason")
+}
+
+func TestHandlersReportWatchStatuses(t *testing.T) {
+	tt := []struct {
+		name   string
+		handle func(wh *WatchHandler, events <-chan watch.Event, errorCh chan<- error)
+	}{
+		{
+			name: "Vulnerability manifests",
+			handle: func(wh *WatchHandler, events <-chan watch.Event, errorCh chan<- error) {
+				wh.HandleVulnerabilityManifestEvents(context.TODO(), events, errorCh)
+			},
+		},
+		{
+			name: "SBOM summaries",
+			handle: func(wh *WatchHandler, events <-chan watch.Event, errorCh chan<- error) {
+				wh.HandleSBOMEvents(context.TODO(), events, nil, errorCh)
+			},
+		},
+		{
+			name: "Filtered SBOMs",
+			handle: func(wh *WatchHandler, events <-chan watch.Event, errorCh chan<- error) {
+				wh.HandleSBOMFilteredEvents(context.TODO(), events, make(chan *apis.Command), errorCh)
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			wh := NewWatchHandlerMock()
+			events := make(chan watch.Event, 2)
+			errorCh := make(chan error)
+			go tc.handle(wh, events, errorCh)
+
+			events <- watch.Event{Type: watch.Error, Object: newWatchStatusFake()}
+			events <- watch.Event{Type: watch.Error, Object: newExpiredWatchStatusFake()}
+			close(events)
+
+			var actualErrors []error
+			for err := range errorCh {
+				actualErrors = append(actualErrors, err)
+			}
+			if assert.Len(t, actualErrors, 2) {
+				for _, err := range actualErrors {
+					assert.ErrorIs(t, err, ErrWatchStatus)
+					assert.NotErrorIs(t, err, ErrUnsupportedObject, "watch errors should not be reported as unsupported objects")
+				}
+			}
+		})
+	}
+}
+
+func TestWatchesRestartOnWatchStatus(t *testing.T) {
+	tt := []struct {
+		name     string
+		resource string
+		watch    func(wh *WatchHandler, ctx context.Context, sink utils.CommandSink)
+	}{
+		{
+			name:     "Vulnerability manifests",
+			resource: "vulnerabilitymanifests",
+			watch: func(wh *WatchHandler, ctx context.Context, _ utils.CommandSink) {
+				wh.VulnerabilityManifestWatch(ctx)
+			},
+		},
+		{
+			// all the SBOM kinds share the same watch loop
+			name:     "SBOM summaries",
+			resource: "sbomsummaries",
+			watch:    (*WatchHandler).SBOMWatch,
+		},
+	}
+
+	for _, tc := range tt {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			// restarts back off for the retry interval
+			t.Parallel()
+
+			var mu sync.Mutex
+			var watchers []*watch.FakeWatcher
+			storageClient := kssfake.NewSimpleClientset()
+			storageClient.PrependWatchReactor(tc.resource, func(action k8stesting.Action) (bool, watch.Interface, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				watchers = append(watchers, watch.NewFake())
+				return true, watchers[len(watchers)-1], nil
+			})
+			watchCount := func() int {
+				mu.Lock()
+				defer mu.Unlock()
+				return len(watchers)
+			}
+
+			var reportedErrors []error
+			var errorsMu sync.Mutex
+			wh := NewWatchHandlerMock()
+			wh.storageClient = storageClient
+			WithErrorHandler(func(err error) {
+				errorsMu.Lock()
+				defer errorsMu.Unlock()
+				reportedErrors = append(reportedErrors, err)
+			})(wh)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go tc.watch(wh, ctx, &commandRecorder{})
+
+			assert.Eventually(t, func() bool { return watchCount() == 1 }, time.Second, 10*time.Millisecond)
+			mu.Lock()
+			failing := watchers[0]
+			mu.Unlock()
+			failing.Error(newWatchStatusFake())
+
+			assert.Eventually(t, func() bool { return watchCount() == 2 }, 2*retryInterval, 10*time.Millisecond, "the watch should be restarted")
+			assert.True(t, failing.IsStopped(), "the failed watch should be stopped")
+
+			errorsMu.Lock()
+			defer errorsMu.Unlock()
+			if assert.Len(t, reportedErrors, 1) {
+				assert.ErrorIs(t, reportedErrors[0], ErrWatchStatus)
+			}
+		})
+	}
+}
+
+func TestHandlePodWatcherRestartsOnWatchStatus(t *testing.T) {
+	k8sAPI, _ := newK8sAPIFake()
+	wh := NewWatchHandlerMock()
+	wh.k8sAPI = k8sAPI
+	var reportedErrors []error
+	WithErrorHandler(func(err error) { reportedErrors = append(reportedErrors, err) })(wh)
+
+	// the watch is never closed by the API server
+	podsWatch := watch.NewFake()
+	done := make(chan struct{})
+	go func() {
+		wh.handlePodWatcher(context.TODO(), podsWatch, newCommandDeduper(0, (&commandRecorder{}).emit))
+		close(done)
+	}()
+	podsWatch.Error(newWatchStatusFake())
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the Pod watcher should return once its watch fails")
+	}
+	assert.True(t, podsWatch.IsStopped())
+	assert.Equal(t, int64(1), wh.metrics.Get(metricWatchStatusesTotal))
+	if assert.Len(t, reportedErrors, 1) {
+		assert.ErrorIs(t, reportedErrors[0], ErrWatchStatus)
+	}
+}
@@ -0,0 +1,192 @@
+package watcher
+
+import (
+	"container/list"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// metricTrackedWlids is the number of WLIDs tracked in wlidsToContainerToImageIDMap
+	metricTrackedWlids = "operator_tracked_wlids"
+	// metricWlidEvictionsTotal is the number of WLIDs evicted from wlidsToContainerToImageIDMap once above the limit of WithMaxTrackedWlids
+	metricWlidEvictionsTotal = "operator_wlid_evictions_total"
+)
+
+// wlidLRU orders the WLIDs of wlidsToContainerToImageIDMap from the most to the least recently updated, to bound their number, see WithMaxTrackedWlids
+//
+// Clusters spawning many short-lived workloads, e.g. the Jobs of CI
+// pipelines, would otherwise grow the map until the next cleanUp. It is not
+// thread safe, it is guarded by wlidsToContainerToImageIDMapMutex.
+//
+// The nil value bounds nothing.
+type wlidLRU struct {
+	max      int
+	order    *list.List // of *wlidEntry, the most recently updated first
+	elements map[string]*list.Element
+}
+
+// wlidEntry is a WLID ordered by wlidLRU, along with the UIDs of its Pods
+type wlidEntry struct {
+	wlid string
+	pods map[types.UID]struct{}
+}
+
+// newWlidLRU returns the order of at most max WLIDs, the nil value if max is not positive
+func newWlidLRU(max int) *wlidLRU {
+	if max <= 0 {
+		return nil
+	}
+	return &wlidLRU{max: max, order: list.New(), elements: make(map[string]*list.Element)}
+}
+
+// entry returns the entry of a WLID, recording it as the most recently updated if it is not known yet
+func (l *wlidLRU) entry(wlid string) (*list.Element, bool) {
+	if element, ok := l.elements[wlid]; ok {
+		return element, true
+	}
+	element := l.order.PushFront(&wlidEntry{wlid: wlid, pods: make(map[types.UID]struct{})})
+	l.elements[wlid] = element
+	return element, false
+}
+
+// Touch records an update of a WLID
+func (l *wlidLRU) Touch(wlid string) {
+	if l == nil {
+		return
+	}
+	if element, known := l.entry(wlid); known {
+		l.order.MoveToFront(element)
+	}
+}
+
+// AddPod records a Pod of a WLID, whose instance IDs are forgotten along with the WLID once evicted
+func (l *wlidLRU) AddPod(wlid string, uid types.UID) {
+	if l == nil || uid == "" {
+		return
+	}
+	element, _ := l.entry(wlid)
+	element.Value.(*wlidEntry).pods[uid] = struct{}{}
+}
+
+// Retain forgets the WLIDs that are not in the map, and records those that are not known yet as the most recently updated
+func (l *wlidLRU) Retain(wlids WlidsToContainerToImageIDMap) {
+	if l == nil {
+		return
+	}
+	for wlid, element := range l.elements {
+		if _, ok := wlids[wlid]; !ok {
+			l.order.Remove(element)
+			delete(l.elements, wlid)
+		}
+	}
+	for wlid := range wlids {
+		l.entry(wlid)
+	}
+}
+
+// Excess forgets and returns the least recently updated WLIDs above the limit that are not running
+//
+// Running WLIDs are given a second chance instead: they are recorded as the
+// most recently updated, so that they are not checked again until the other
+// WLIDs are. The limit is soft, as running WLIDs are never returned.
+func (l *wlidLRU) Excess(running func(wlid string) bool) []wlidEntry {
+	if l == nil {
+		return nil
+	}
+	var excess []wlidEntry
+	// every WLID is checked at most once
+	for unchecked := l.order.Len(); unchecked > 0 && l.order.Len() > l.max; unchecked-- {
+		element := l.order.Back()
+		entry := element.Value.(*wlidEntry)
+		if running(entry.wlid) {
+			l.order.MoveToFront(element)
+			continue
+		}
+		l.order.Remove(element)
+		delete(l.elements, entry.wlid)
+		excess = append(excess, *entry)
+	}
+	return excess
+}
+
+// touchWlidUnsafe records an update of a WLID, evicting the least recently updated WLIDs above the limit, see evictWlidsUnsafe
+//
+// NOT THREAD SAFE! Assumes the caller is holding the WLIDs map lock.
+func (wh *WatchHandler) touchWlidUnsafe(wlid string) {
+	wh.wlids.Touch(wlid)
+	wh.evictWlidsUnsafe()
+}
+
+// trackWlidPod records a Pod of a WLID, see wlidLRU.AddPod
+func (wh *WatchHandler) trackWlidPod(wlid string, uid types.UID) {
+	wh.wlidsToContainerToImageIDMapMutex.Lock()
+	defer wh.wlidsToContainerToImageIDMapMutex.Unlock()
+
+	wh.wlids.AddPod(wlid, uid)
+}
+
+// evictWlidsUnsafe evicts the least recently updated WLIDs above the limit of WithMaxTrackedWlids from the internal maps
+//
+// Only the WLIDs without running Pods are evicted, as the storage objects of
+// the images of workloads that are still running must never be considered
+// orphaned. The evicted WLIDs are removed from the WLIDs of the images they
+// ran, which their deleted Pods did already unless they were not being
+// tracked, and the instance IDs of their Pods are forgotten.
+//
+// NOT THREAD SAFE! Assumes the caller is holding the WLIDs map lock.
+func (wh *WatchHandler) evictWlidsUnsafe() {
+	excess := wh.wlids.Excess(wh.podImageIDs.HasWlid)
+	if len(excess) == 0 {
+		return
+	}
+
+	wh.instanceIDsMutex.Lock()
+	defer wh.instanceIDsMutex.Unlock()
+
+	for _, entry := range excess {
+		for _, imageID := range wh.wlidsToContainerToImageIDMap[entry.wlid] {
+			wh.removeFromImageIDToWlidsMap(imageID, entry.wlid)
+		}
+		for uid := range entry.pods {
+			wh.managedInstanceIDSlugs.Forget(uid)
+		}
+		if _, ok := wh.wlidsToContainerToImageIDMap[entry.wlid]; !ok {
+			// recorded by a Pod event that tracked no container of its WLID
+			continue
+		}
+		delete(wh.wlidsToContainerToImageIDMap, entry.wlid)
+		delete(wh.wlidsToContainerToImagePinnedMap, entry.wlid)
+		delete(wh.wlidsToContainerToContainerTypeMap, entry.wlid)
+		wh.metrics.Inc(metricWlidEvictionsTotal)
+	}
+}
+
+// retainWlids orders the WLIDs of the internal maps again once they were replaced, evicting those above the limit of WithMaxTrackedWlids
+//
+// The Pods of the WLIDs are those tracked once the maps are replaced.
+func (wh *WatchHandler) retainWlids() {
+	wh.wlidsToContainerToImageIDMapMutex.Lock()
+	defer wh.wlidsToContainerToImageIDMapMutex.Unlock()
+
+	wh.wlids.Retain(wh.wlidsToContainerToImageIDMap)
+	if wh.wlids != nil {
+		for wlid, uids := range wh.podImageIDs.PodsByWlid() {
+			if _, ok := wh.wlidsToContainerToImageIDMap[wlid]; !ok {
+				continue
+			}
+			for _, uid := range uids {
+				wh.wlids.AddPod(wlid, uid)
+			}
+		}
+	}
+	wh.evictWlidsUnsafe()
+}
+
+// countTrackedWlids returns the number of WLIDs tracked in wlidsToContainerToImageIDMap
+func (wh *WatchHandler) countTrackedWlids() int {
+	wh.wlidsToContainerToImageIDMapMutex.RLock()
+	defer wh.wlidsToContainerToImageIDMapMutex.RUnlock()
+
+	return len(wh.wlidsToContainerToImageIDMap)
+}
@@ -0,0 +1,164 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+
+	instanceidhandlerv1 "github.com/kubescape/k8s-interface/instanceidhandler/v1"
+	spdxv1beta1 "github.com/kubescape/storage/pkg/apis/softwarecomposition/v1beta1"
+	kssfake "github.com/kubescape/storage/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	core1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestWlidLRU(t *testing.T) {
+	notRunning := func(string) bool { return false }
+	// wlids returns the WLIDs of the entries
+	wlids := func(entries []wlidEntry) []string {
+		var wlids []string
+		for _, entry := range entries {
+			wlids = append(wlids, entry.wlid)
+		}
+		return wlids
+	}
+
+	t.Run("the nil value bounds nothing", func(t *testing.T) {
+		l := newWlidLRU(0)
+		assert.Nil(t, l)
+		l.Touch("wlid-1")
+		l.Retain(WlidsToContainerToImageIDMap{"wlid-1": {}})
+		l.AddPod("wlid-1", "uid-1")
+		assert.Empty(t, l.Excess(notRunning))
+	})
+
+	t.Run("the least recently updated WLIDs are in excess", func(t *testing.T) {
+		l := newWlidLRU(2)
+		l.Touch("wlid-1")
+		l.Touch("wlid-2")
+		l.Touch("wlid-1")
+		l.Touch("wlid-3")
+		assert.Equal(t, []string{"wlid-2"}, wlids(l.Excess(notRunning)))
+		assert.Empty(t, l.Excess(notRunning))
+	})
+
+	t.Run("WLIDs no longer in the map are forgotten", func(t *testing.T) {
+		l := newWlidLRU(2)
+		l.Touch("wlid-1")
+		l.Touch("wlid-2")
+		l.Retain(WlidsToContainerToImageIDMap{"wlid-2": {}, "wlid-3": {}})
+		assert.Empty(t, l.Excess(notRunning))
+		l.Touch("wlid-4")
+		assert.Equal(t, []string{"wlid-2"}, wlids(l.Excess(notRunning)))
+	})
+
+	t.Run("running WLIDs are given a second chance", func(t *testing.T) {
+		l := newWlidLRU(1)
+		l.Touch("wlid-1")
+		l.Touch("wlid-2")
+		l.Touch("wlid-3")
+		l.AddPod("wlid-2", "uid-2")
+		running := func(wlid string) bool { return wlid == "wlid-1" }
+		excess := l.Excess(running)
+		assert.Equal(t, []string{"wlid-2", "wlid-3"}, wlids(excess))
+		assert.Equal(t, map[types.UID]struct{}{"uid-2": {}}, excess[0].pods)
+		running = func(string) bool { return true }
+		l.Touch("wlid-4")
+		assert.Empty(t, l.Excess(running), "the limit should be exceeded rather than evict running WLIDs")
+	})
+}
+
+func TestMaxTrackedWlids(t *testing.T) {
+	newWatchHandler := func(t *testing.T, max int) *WatchHandler {
+		k8sAPI, _ := newK8sAPIFake()
+		wh, err := NewWatchHandler(k8sAPI, kssfake.NewSimpleClientset(), nil, nil, WithMaxTrackedWlids(max))
+		assert.NoError(t, err)
+		return wh
+	}
+	// track tracks a workload running an image, as a Pod event does
+	track := func(wh *WatchHandler, wlid, imageID string) {
+		wh.addToWlidsToContainerToImageIDMap(wlid, "container", imageID)
+		wh.addToImageIDToWlidsMap(imageID, wlid)
+	}
+
+	t.Run("the least recently updated workloads are evicted", func(t *testing.T) {
+		wh := newWatchHandler(t, 2)
+		track(wh, "wlid-1", "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547")
+		track(wh, "wlid-2", "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547")
+		track(wh, "wlid-1", "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547")
+		track(wh, "wlid-3", "nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432")
+
+		assert.Len(t, wh.wlidsToContainerToImageIDMap, 2)
+		assert.NotContains(t, wh.wlidsToContainerToImageIDMap, "wlid-2")
+		assert.Equal(t, []string{"wlid-1"}, wh.GetWlidsForImageHash("alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"), "the evicted workload should no longer run its images")
+		assert.Equal(t, []string{"wlid-3"}, wh.GetWlidsForImageHash("nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432"))
+		assert.Equal(t, int64(1), wh.metrics.Get(metricWlidEvictionsTotal))
+		assert.Equal(t, 2, wh.countTrackedWlids())
+	})
+
+	t.Run("images only run by evicted workloads are orphaned", func(t *testing.T) {
+		wh := newWatchHandler(t, 1)
+		track(wh, "wlid-1", "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547")
+		track(wh, "wlid-2", "nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432")
+
+		assert.Empty(t, wh.GetWlidsForImageHash("alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547"))
+		assert.Equal(t, []string{"wlid-2"}, wh.GetWlidsForImageHash("nginx@sha256:9c6a3465a218b26cbcd3e5ed2ddf940ea8acce4ba0bc143465d4a5377bc1a432"))
+	})
+
+	t.Run("every workload is tracked by default", func(t *testing.T) {
+		wh := newWatchHandler(t, 0)
+		for _, wlid := range []string{"wlid-1", "wlid-2", "wlid-3"} {
+			track(wh, wlid, "alpine@sha256:7e8e9abeb3c1b7324ba9e3c9f6321aab93cb022bb556773f44c8a4eab55ab547")
+		}
+
+		assert.Len(t, wh.wlidsToContainerToImageIDMap, 3)
+		assert.Zero(t, wh.metrics.Get(metricWlidEvictionsTotal))
+	})
+}
+
+func TestMaxTrackedWlidsKeepsRunningWorkloads(t *testing.T) {
+	ctx := context.TODO()
+	serverImageID := "nginx@sha256:732d9ae3fd72209629341ae5eded145555ced85f2f786de9294c0d95dad75240"
+	serverWlid := "wlid://cluster-/namespace-default/pod-server"
+	// the SBOMs of the images of the long running server
+	storageClient := kssfake.NewSimpleClientset(
+		&spdxv1beta1.SBOMSummary{ObjectMeta: v1.ObjectMeta{Namespace: "kubescape", Name: "server", Labels: managedLabels(), Annotations: map[string]string{instanceidhandlerv1.ImageIDMetadataKey: serverImageID}}},
+		&spdxv1beta1.SBOMSPDXv2p3{ObjectMeta: v1.ObjectMeta{Namespace: "kubescape", Name: "server", Labels: managedLabels()}},
+	)
+	k8sAPI, _ := newK8sAPIFake()
+	wh, err := NewWatchHandler(k8sAPI, storageClient, nil, nil, WithMaxTrackedWlids(1))
+	assert.NoError(t, err)
+	commands := newCommandDeduper(0, (&commandRecorder{}).emit)
+	newPod := func(name, imageID string) *core1.Pod {
+		pod := newRunningPodFake("default", name, map[string]string{name: imageID})
+		pod.UID = types.UID(name)
+		return pod
+	}
+
+	server := newPod("server", serverImageID)
+	assert.NoError(t, wh.handlePodEvent(ctx, watch.Event{Type: watch.Modified, Object: server}, commands))
+	serverInstanceIDs := wh.GetInstanceIDs()
+	// the Pods of the CI pipelines come and go, each of another workload
+	for _, name := range []string{"ci-1", "ci-2", "ci-3"} {
+		ci := newPod(name, "alpine@"+testDigest(name))
+		assert.NoError(t, wh.handlePodEvent(ctx, watch.Event{Type: watch.Modified, Object: ci}, commands))
+		assert.NoError(t, wh.handlePodEvent(ctx, watch.Event{Type: watch.Deleted, Object: ci}, commands))
+	}
+	running := newPod("ci-4", "alpine@"+testDigest("ci-4"))
+	assert.NoError(t, wh.handlePodEvent(ctx, watch.Event{Type: watch.Modified, Object: running}, commands))
+
+	assert.Equal(t, int64(3), wh.metrics.Get(metricWlidEvictionsTotal), "the workloads without running Pods should be evicted")
+	assert.Equal(t, 2, wh.countTrackedWlids(), "the running workloads should be kept above the limit")
+	assert.Equal(t, []string{serverWlid}, wh.GetWlidsForImageHash(serverImageID))
+	assert.Len(t, wh.GetInstanceIDs(), len(serverInstanceIDs)+1, "the instance IDs of the evicted workloads should be forgotten")
+	assert.Subset(t, wh.GetInstanceIDs(), serverInstanceIDs)
+
+	wh.reclaimOrphans(ctx)
+
+	_, err = storageClient.SpdxV1beta1().SBOMSummaries("kubescape").Get(ctx, "server", v1.GetOptions{})
+	assert.NoError(t, err, "the SBOM of the running workload should not be deleted")
+	_, err = storageClient.SpdxV1beta1().SBOMSPDXv2p3s("kubescape").Get(ctx, "server", v1.GetOptions{})
+	assert.NoError(t, err)
+}